@@ -0,0 +1,259 @@
+// Package anomaly reports unusual overtime to HR, like a user booking twice
+// their usual hours, to catch burnout and data entry mistakes early.
+package anomaly
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"overtime/config"
+	"overtime/mailer"
+	"overtime/models"
+	"overtime/scheduler"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// historyMonths are the months before the current one the hours are
+	// compared with
+	historyMonths = 6
+	// spikeFactor is how many times their monthly average a user or team has
+	// to book in the current month to be reported
+	spikeFactor = 2
+	// Months with fewer hours are never reported, so a few hours after a
+	// quiet half year raise no alarm
+	minUserHours = 10
+	minTeamHours = 20
+)
+
+// Detector periodically compares each user's and team's overtime in the
+// current month with their average of the previous months and emails HR the
+// anomalies it has not reported yet
+type Detector struct {
+	db     *gorm.DB
+	config *config.Config
+	mailer *mailer.Mailer
+}
+
+func NewDetector(db *gorm.DB, cfg *config.Config, mail *mailer.Mailer) *Detector {
+	return &Detector{
+		db:     db,
+		config: cfg,
+		mailer: mail,
+	}
+}
+
+func (d *Detector) Enabled() bool {
+	return d.config.AnomalyInterval > 0
+}
+
+// Run checks once immediately and then on every interval, on whichever
+// replica claims the run from lock. It never returns.
+func (d *Detector) Run(lock *scheduler.Lock) {
+	ticker := time.NewTicker(d.config.AnomalyInterval)
+	defer ticker.Stop()
+	for {
+		if lock.Claim("anomaly", d.config.AnomalyInterval) {
+			if err := d.Check(); err != nil {
+				log.Printf("Anomaly check failed: %v", err)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// Check reports the new anomalies of every organization
+func (d *Detector) Check() error {
+	var organizations []models.Organization
+	if err := d.db.Find(&organizations).Error; err != nil {
+		return err
+	}
+
+	for _, organization := range organizations {
+		if err := d.checkOrganization(&organization, time.Now().UTC()); err != nil {
+			log.Printf("Anomaly check of organization %s failed: %v", organization.Name, err)
+		}
+	}
+	return nil
+}
+
+// anomaly is a user or team whose hours in the current month are unusual
+type anomaly struct {
+	alert models.AnomalyAlert
+	name  string
+}
+
+// monthlyHours are the hours a user or team booked in the current month and
+// in the months before
+type monthlyHours struct {
+	ID       uint
+	Name     string
+	Current  float64
+	Previous float64
+	// Since is when a user's account was created, users are only compared
+	// with the months they were there for
+	Since time.Time
+}
+
+func (d *Detector) checkOrganization(organization *models.Organization, now time.Time) error {
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	historyStart := monthStart.AddDate(0, -historyMonths, 0)
+	month := monthStart.Format("2006-01")
+
+	// Rejected entries are left out, pending ones count since a mistake
+	// should be caught before it is approved
+	sums := "COALESCE(SUM(CASE WHEN overtime_entries.date >= @month THEN overtime_entries.hours END), 0) AS current, " +
+		"COALESCE(SUM(CASE WHEN overtime_entries.date < @month THEN overtime_entries.hours END), 0) AS previous"
+	entries := func() *gorm.DB {
+		return d.db.Table("overtime_entries").
+			Joins("JOIN users ON users.id = overtime_entries.user_id").
+			Where("overtime_entries.organization_id = ? AND overtime_entries.deleted_at IS NULL AND users.deleted_at IS NULL AND overtime_entries.status <> ?",
+				organization.ID, models.StatusRejected).
+			Where("overtime_entries.date >= ? AND overtime_entries.date < ?", historyStart, monthStart.AddDate(0, 1, 0))
+	}
+
+	var users []monthlyHours
+	err := entries().
+		Select("users.id, COALESCE(NULLIF(users.full_name, ''), users.username) AS name, users.created_at AS since, "+sums,
+			map[string]interface{}{"month": monthStart}).
+		Group("users.id").
+		Scan(&users).Error
+	if err != nil {
+		return err
+	}
+
+	var teams []monthlyHours
+	err = entries().
+		Joins("JOIN teams ON teams.id = users.team_id").
+		Select("teams.id, teams.name, "+sums, map[string]interface{}{"month": monthStart}).
+		Group("teams.id").
+		Scan(&teams).Error
+	if err != nil {
+		return err
+	}
+
+	var found []anomaly
+	for _, user := range users {
+		// Full months since the account was created, roughly
+		months := historyMonths
+		if user.Since.After(historyStart) {
+			months = int(monthStart.Sub(user.Since).Hours() / 24 / 30)
+		}
+		if months < 1 {
+			// Too new to have a usual month
+			continue
+		}
+		if a, ok := spike(models.AnomalyUser, user, months, minUserHours); ok {
+			found = append(found, a)
+		}
+	}
+	for _, team := range teams {
+		if a, ok := spike(models.AnomalyTeam, team, historyMonths, minTeamHours); ok {
+			found = append(found, a)
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+
+	var reported []models.AnomalyAlert
+	if err := d.db.Where("organization_id = ? AND month = ?", organization.ID, month).Find(&reported).Error; err != nil {
+		return err
+	}
+	type subject struct {
+		kind string
+		id   uint
+	}
+	seen := make(map[subject]bool)
+	for _, alert := range reported {
+		seen[subject{alert.Kind, alert.SubjectID}] = true
+	}
+
+	var fresh []anomaly
+	for _, a := range found {
+		if !seen[subject{a.alert.Kind, a.alert.SubjectID}] {
+			a.alert.OrganizationID = organization.ID
+			a.alert.Month = month
+			fresh = append(fresh, a)
+		}
+	}
+	if len(fresh) == 0 {
+		return nil
+	}
+
+	// Anomalies are only recorded once the report went out, so a failed
+	// email is retried on the next run
+	if err := d.report(organization, monthStart, fresh); err != nil {
+		return err
+	}
+	for _, a := range fresh {
+		if err := d.db.Create(&a.alert).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spike reports whether hours in the current month exceed spikeFactor times
+// the average of the previous months
+func spike(kind string, hours monthlyHours, months int, minHours float64) (anomaly, bool) {
+	average := hours.Previous / float64(months)
+	if hours.Current < minHours || hours.Current <= spikeFactor*average {
+		return anomaly{}, false
+	}
+	return anomaly{
+		alert: models.AnomalyAlert{Kind: kind, SubjectID: hours.ID, Hours: hours.Current, Average: average},
+		name:  hours.Name,
+	}, true
+}
+
+// report emails the organization's HR staff the anomalies, or its admins if
+// it has no HR staff with an email address
+func (d *Detector) report(organization *models.Organization, month time.Time, anomalies []anomaly) error {
+	var recipients []models.User
+	d.db.Where("organization_id = ? AND role = ? AND email <> ''", organization.ID, models.RoleHR).Find(&recipients)
+	if len(recipients) == 0 {
+		d.db.Where("organization_id = ? AND role = ? AND email <> ''", organization.ID, models.RoleAdmin).Find(&recipients)
+	}
+	if len(recipients) == 0 {
+		log.Printf("Anomaly report of organization %s has no HR or admin to go to", organization.Name)
+		return nil
+	}
+
+	var to []string
+	for _, recipient := range recipients {
+		to = append(to, recipient.Email)
+	}
+
+	var lines []string
+	for _, a := range anomalies {
+		label := a.name
+		if a.alert.Kind == models.AnomalyTeam {
+			label = "Team " + a.name
+		}
+		lines = append(lines, fmt.Sprintf("- %s: %.1fh so far, %.1fh in an average month", label, a.alert.Hours, a.alert.Average))
+	}
+
+	body := fmt.Sprintf(`The following overtime in %s of %s is more than %d times the usual
+monthly hours of the previous %d months:
+
+%s
+
+This may point to excessive workloads or to mistakes in the entries.
+Review the entries here: %s/overtime/all?month=%d&year=%d
+`,
+		month.Format("January 2006"),
+		organization.Name,
+		spikeFactor,
+		historyMonths,
+		strings.Join(lines, "\n"),
+		d.config.BaseURL,
+		int(month.Month()),
+		month.Year(),
+	)
+
+	return d.mailer.Send(to, "Unusual overtime in "+month.Format("January 2006"), body)
+}
@@ -0,0 +1,255 @@
+// Package backup dumps the database with pg_dump to a directory or an S3
+// bucket, optionally encrypted, and restores such dumps with pg_restore.
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"overtime/config"
+	"overtime/s3"
+	"overtime/scheduler"
+)
+
+// Backups are named after the time they were taken, so sorting the names
+// sorts them by age
+const (
+	namePrefix      = "overtime-"
+	plainSuffix     = ".dump"
+	encryptedSuffix = ".dump.enc"
+)
+
+// ErrRunning is returned when a backup is requested while one is running
+var ErrRunning = errors.New("a backup is already running")
+
+type Service struct {
+	config *config.Config
+	store  Store
+	// command runs pg_dump and pg_restore
+	command func(name string, arg ...string) *exec.Cmd
+	running sync.Mutex
+}
+
+func New(cfg *config.Config) *Service {
+	var store Store = &dirStore{dir: cfg.BackupDir}
+	if cfg.BackupS3Bucket != "" {
+		store = &s3Store{
+			client: &s3.Client{
+				Endpoint:  cfg.BackupS3Endpoint,
+				Region:    cfg.BackupS3Region,
+				Bucket:    cfg.BackupS3Bucket,
+				AccessKey: cfg.BackupS3AccessKey,
+				SecretKey: cfg.BackupS3SecretKey,
+				HTTP:      &http.Client{Timeout: 30 * time.Minute},
+			},
+			prefix: cfg.BackupS3Prefix,
+		}
+	}
+	return &Service{config: cfg, store: store, command: exec.Command}
+}
+
+// Location describes where backups are stored
+func (s *Service) Location() string {
+	if s.config.BackupS3Bucket != "" {
+		return "s3://" + s.config.BackupS3Bucket + "/" + s.config.BackupS3Prefix
+	}
+	return s.config.BackupDir
+}
+
+// Encrypted reports whether new backups are encrypted
+func (s *Service) Encrypted() bool {
+	return s.config.BackupEncryptionKey != ""
+}
+
+// Scheduled reports whether backups are taken periodically
+func (s *Service) Scheduled() bool {
+	return s.config.BackupInterval > 0
+}
+
+// Run takes a backup on every interval, on whichever replica claims it from
+// lock. It never returns.
+func (s *Service) Run(lock *scheduler.Lock) {
+	ticker := time.NewTicker(s.config.BackupInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !lock.Claim("backup", s.config.BackupInterval) {
+			continue
+		}
+		if name, err := s.Backup(); err != nil {
+			log.Printf("Scheduled backup failed: %v", err)
+		} else {
+			log.Printf("Scheduled backup %s written to %s", name, s.Location())
+		}
+	}
+}
+
+// Backup dumps the database, stores the dump and removes the backups beyond
+// BackupKeep. It returns the name of the new backup.
+func (s *Service) Backup() (string, error) {
+	if !s.running.TryLock() {
+		return "", ErrRunning
+	}
+	defer s.running.Unlock()
+
+	name := namePrefix + time.Now().UTC().Format("20060102-150405")
+	if s.Encrypted() {
+		name += encryptedSuffix
+	} else {
+		name += plainSuffix
+	}
+
+	// The dump is staged in a temporary file because S3 needs its size
+	// before the upload starts
+	file, err := os.CreateTemp("", "overtime-backup-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	var out io.WriteCloser = nopCloser{file}
+	if s.Encrypted() {
+		if out, err = newEncrypter(file, s.config.BackupEncryptionKey); err != nil {
+			return "", err
+		}
+	}
+
+	var stderr bytes.Buffer
+	cmd := s.command("pg_dump", "--format=custom", "--no-owner", "--no-privileges", "--dbname="+s.config.DatabaseURL)
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", commandError("pg_dump", err, &stderr)
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if err := s.store.Put(name, file, size); err != nil {
+		return "", err
+	}
+
+	if err := s.prune(); err != nil {
+		log.Printf("Failed to remove old backups: %v", err)
+	}
+	return name, nil
+}
+
+// List returns the stored backups, oldest first
+func (s *Service) List() ([]string, error) {
+	return s.store.List()
+}
+
+// prune removes the oldest backups beyond BackupKeep
+func (s *Service) prune() error {
+	names, err := s.store.List()
+	if err != nil {
+		return err
+	}
+	for len(names) > s.config.BackupKeep {
+		if err := s.store.Delete(names[0]); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// Restore replaces the database contents with the named backup, or the
+// newest one for "latest"
+func (s *Service) Restore(name string) error {
+	if name == "latest" {
+		names, err := s.store.List()
+		if err != nil {
+			return err
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("no backups in %s", s.Location())
+		}
+		name = names[len(names)-1]
+	}
+	if !isBackupName(name) {
+		return fmt.Errorf("%q is not a backup name", name)
+	}
+
+	body, err := s.store.Get(name)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	reader := bufio.NewReader(body)
+	var in io.Reader = reader
+	if header, _ := reader.Peek(len(magic)); string(header) == magic {
+		if !s.Encrypted() {
+			return errors.New("the backup is encrypted, set BACKUP_ENCRYPTION_KEY")
+		}
+		reader.Discard(len(magic))
+		if in, err = newDecrypter(reader, s.config.BackupEncryptionKey); err != nil {
+			return err
+		}
+	}
+
+	// A backup that fails to decrypt ends pg_restore's input early, report
+	// why rather than pg_restore's complaint about the short input
+	input := &inputReader{r: in}
+	var stderr bytes.Buffer
+	cmd := s.command("pg_restore", "--clean", "--if-exists", "--no-owner", "--no-privileges", "--single-transaction",
+		"--dbname="+s.config.DatabaseURL)
+	cmd.Stdin = input
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if input.err != nil {
+			return input.err
+		}
+		return commandError("pg_restore", err, &stderr)
+	}
+	return nil
+}
+
+// inputReader remembers the error that ended a command's input
+type inputReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *inputReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// commandError adds what a failed command printed to its error
+func commandError(name string, err error, stderr *bytes.Buffer) error {
+	if message := strings.TrimSpace(stderr.String()); message != "" {
+		return fmt.Errorf("%s: %w: %s", name, err, message)
+	}
+	return fmt.Errorf("%s: %w", name, err)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,290 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"overtime/config"
+	"overtime/s3"
+)
+
+const fixtureSize = 200_000
+
+// dumpFixture returns size bytes standing in for a pg_dump archive
+func dumpFixture(size int) []byte {
+	data := make([]byte, size)
+	x := uint32(2463534242)
+	for i := range data {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		data[i] = byte(x)
+	}
+	copy(data, "PGDMP")
+	return data
+}
+
+// TestHelperProcess stands in for pg_dump, which writes the fixture, and
+// pg_restore, which copies its input to BACKUP_TEST_RESTORED
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("BACKUP_TEST_HELPER") != "1" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	switch args[1] {
+	case "pg_dump":
+		os.Stdout.Write(dumpFixture(fixtureSize))
+	case "pg_restore":
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			os.Exit(1)
+		}
+		if len(data) == 0 {
+			fmt.Fprintln(os.Stderr, "pg_restore: error: input file is too short")
+			os.Exit(1)
+		}
+		os.WriteFile(os.Getenv("BACKUP_TEST_RESTORED"), data, 0o600)
+	}
+	os.Exit(0)
+}
+
+// fakeCommands runs the helper process instead of the PostgreSQL tools and
+// records their arguments. The restored dump is written to the returned path.
+func fakeCommands(t *testing.T, s *Service) (restored string, calls *[][]string) {
+	restored = filepath.Join(t.TempDir(), "restored")
+	calls = &[][]string{}
+	s.command = func(name string, arg ...string) *exec.Cmd {
+		*calls = append(*calls, append([]string{name}, arg...))
+		cmd := exec.Command(os.Args[0], append([]string{"-test.run=^TestHelperProcess$", "--", name}, arg...)...)
+		cmd.Env = append(os.Environ(), "BACKUP_TEST_HELPER=1", "BACKUP_TEST_RESTORED="+restored)
+		return cmd
+	}
+	return restored, calls
+}
+
+// fakeS3 is a bucket in memory that lists two keys per page
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key, isObject := strings.CutPrefix(r.URL.Path, "/backups/")
+	switch {
+	case r.Method == http.MethodPut && isObject:
+		data, _ := io.ReadAll(r.Body)
+		if int64(len(data)) != r.ContentLength {
+			http.Error(w, "IncompleteBody", http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = data
+	case r.Method == http.MethodGet && isObject:
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case r.Method == http.MethodDelete && isObject:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && r.URL.Path == "/backups" && r.URL.Query().Get("list-type") == "2":
+		var keys []string
+		for key := range f.objects {
+			if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		start, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+		end := min(start+2, len(keys))
+
+		var result listBucketResult
+		for _, key := range keys[start:end] {
+			result.Contents = append(result.Contents, struct {
+				Key string `xml:"Key"`
+			}{key})
+		}
+		if end < len(keys) {
+			result.IsTruncated = true
+			result.NextContinuationToken = strconv.Itoa(end)
+		}
+		xml.NewEncoder(w).Encode(result)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type testStore struct {
+	name  string
+	store func(t *testing.T) (Store, func() map[string][]byte)
+}
+
+var testStores = []testStore{
+	{name: "directory", store: func(t *testing.T) (Store, func() map[string][]byte) {
+		dir := filepath.Join(t.TempDir(), "backups")
+		return &dirStore{dir: dir}, func() map[string][]byte {
+			files := map[string][]byte{}
+			entries, _ := os.ReadDir(dir)
+			for _, entry := range entries {
+				files[entry.Name()], _ = os.ReadFile(filepath.Join(dir, entry.Name()))
+			}
+			return files
+		}
+	}},
+	{name: "S3", store: func(t *testing.T) (Store, func() map[string][]byte) {
+		bucket := &fakeS3{objects: map[string][]byte{}}
+		server := httptest.NewServer(bucket)
+		t.Cleanup(server.Close)
+		client := &s3.Client{Endpoint: server.URL, Region: "eu-central-1", Bucket: "backups", AccessKey: "key", SecretKey: "secret", HTTP: server.Client()}
+		return &s3Store{client: client, prefix: "db/"}, func() map[string][]byte {
+			bucket.mu.Lock()
+			defer bucket.mu.Unlock()
+			files := map[string][]byte{}
+			for key, data := range bucket.objects {
+				files[strings.TrimPrefix(key, "db/")] = data
+			}
+			return files
+		}
+	}},
+}
+
+func TestBackupRestore(t *testing.T) {
+	fixture := dumpFixture(fixtureSize)
+	for _, ts := range testStores {
+		for _, key := range []string{"", "correct horse"} {
+			store, files := ts.store(t)
+			s := &Service{
+				config: &config.Config{DatabaseURL: "postgres://overtime@db/overtime", BackupKeep: 3, BackupEncryptionKey: key},
+				store:  store,
+			}
+			restored, calls := fakeCommands(t, s)
+			label := fmt.Sprintf("%s, encrypted %v", ts.name, key != "")
+
+			name, err := s.Backup()
+			if err != nil {
+				t.Fatalf("%s: %v", label, err)
+			}
+			if !isBackupName(name) || strings.HasSuffix(name, encryptedSuffix) != (key != "") {
+				t.Errorf("%s: backup named %q", label, name)
+			}
+
+			stored := files()[name]
+			if key == "" && !bytes.Equal(stored, fixture) {
+				t.Errorf("%s: stored %d bytes that differ from the dump", label, len(stored))
+			}
+			if key != "" && (!bytes.HasPrefix(stored, []byte(magic)) || bytes.Contains(stored, fixture[:100])) {
+				t.Errorf("%s: stored backup is not encrypted", label)
+			}
+
+			if err := s.Restore("latest"); err != nil {
+				t.Fatalf("%s: restore: %v", label, err)
+			}
+			if data, err := os.ReadFile(restored); err != nil || !bytes.Equal(data, fixture) {
+				t.Errorf("%s: restored %d bytes that differ from the dump (%v)", label, len(data), err)
+			}
+
+			want := [][]string{
+				{"pg_dump", "--format=custom", "--no-owner", "--no-privileges", "--dbname=postgres://overtime@db/overtime"},
+				{"pg_restore", "--clean", "--if-exists", "--no-owner", "--no-privileges", "--single-transaction", "--dbname=postgres://overtime@db/overtime"},
+			}
+			if fmt.Sprint(*calls) != fmt.Sprint(want) {
+				t.Errorf("%s: commands = %q, want %q", label, *calls, want)
+			}
+		}
+	}
+}
+
+func TestBackupPrunes(t *testing.T) {
+	for _, ts := range testStores {
+		store, files := ts.store(t)
+		old := []string{
+			"overtime-20240101-000000.dump",
+			"overtime-20240102-000000.dump.enc",
+			"overtime-20240103-000000.dump",
+		}
+		for _, name := range old {
+			if err := store.Put(name, strings.NewReader("old"), 3); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.Put("notes.txt", strings.NewReader("keep"), 4); err != nil {
+			t.Fatal(err)
+		}
+
+		s := &Service{config: &config.Config{BackupKeep: 2}, store: store}
+		fakeCommands(t, s)
+		name, err := s.Backup()
+		if err != nil {
+			t.Fatalf("%s: %v", ts.name, err)
+		}
+
+		names, err := s.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{old[2], name}; fmt.Sprint(names) != fmt.Sprint(want) {
+			t.Errorf("%s: backups after pruning = %v, want %v", ts.name, names, want)
+		}
+		if _, ok := files()["notes.txt"]; !ok {
+			t.Errorf("%s: pruning removed a file that is not a backup", ts.name)
+		}
+	}
+}
+
+func TestRestoreErrors(t *testing.T) {
+	store, _ := testStores[0].store(t)
+	s := &Service{config: &config.Config{BackupDir: "backups", BackupEncryptionKey: "key", BackupKeep: 5}, store: store}
+	fakeCommands(t, s)
+
+	if err := s.Restore("latest"); err == nil || !strings.Contains(err.Error(), "no backups") {
+		t.Errorf("restore without backups: error = %v", err)
+	}
+	if err := s.Restore("../config.env"); err == nil || !strings.Contains(err.Error(), "not a backup name") {
+		t.Errorf("restore of another file: error = %v", err)
+	}
+
+	name, err := s.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.config.BackupEncryptionKey = ""
+	if err := s.Restore(name); err == nil || !strings.Contains(err.Error(), "BACKUP_ENCRYPTION_KEY") {
+		t.Errorf("restore of an encrypted backup without a key: error = %v", err)
+	}
+	s.config.BackupEncryptionKey = "other key"
+	if err := s.Restore(name); err == nil || !strings.Contains(err.Error(), "wrong encryption key") {
+		t.Errorf("restore with another key: error = %v", err)
+	}
+
+	// pg_restore fails on the empty input and its message is reported
+	if err := store.Put("overtime-20990101-000000.dump", strings.NewReader(""), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Restore("latest"); err == nil || !strings.Contains(err.Error(), "input file is too short") {
+		t.Errorf("restore of an empty dump: error = %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package backup
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Encrypted backups start with magic and a random salt the key is derived
+// from, followed by AES-256-GCM sealed chunks. Each chunk's nonce holds its
+// number and whether it is the last one, so chunks cannot be reordered and a
+// truncated backup fails to decrypt.
+const (
+	magic     = "OVTBAK01"
+	saltSize  = 16
+	chunkSize = 64 << 10
+)
+
+var errTruncated = errors.New("backup: encrypted backup is truncated")
+
+func newAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key := argon2.IDKey([]byte(passphrase), salt, 3, 64*1024, 2, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(size int, counter uint64, last bool) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce, counter)
+	if last {
+		nonce[size-1] = 1
+	}
+	return nonce
+}
+
+type encrypter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+}
+
+// newEncrypter encrypts everything written to it into w. Close writes the
+// last chunk and must be called.
+func newEncrypter(w io.Writer, passphrase string) (io.WriteCloser, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, magic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(salt); err != nil {
+		return nil, err
+	}
+	return &encrypter{w: w, aead: aead}, nil
+}
+
+func (e *encrypter) Write(p []byte) (int, error) {
+	e.buf = append(e.buf, p...)
+	// Keep at least one byte back so Close always has a last chunk to seal
+	for len(e.buf) > chunkSize {
+		if err := e.seal(e.buf[:chunkSize], false); err != nil {
+			return 0, err
+		}
+		e.buf = e.buf[chunkSize:]
+	}
+	return len(p), nil
+}
+
+func (e *encrypter) Close() error {
+	return e.seal(e.buf, true)
+}
+
+func (e *encrypter) seal(chunk []byte, last bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.aead.NonceSize(), e.counter, last), chunk, nil)
+	e.counter++
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+type decrypter struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	done    bool
+}
+
+// newDecrypter decrypts a backup written by newEncrypter. The magic must
+// already have been read from r.
+func newDecrypter(r *bufio.Reader, passphrase string) (io.Reader, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return nil, errTruncated
+	}
+	aead, err := newAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &decrypter{r: r, aead: aead}, nil
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decrypter) open() error {
+	sealed := make([]byte, chunkSize+d.aead.Overhead())
+	n, err := io.ReadFull(d.r, sealed)
+	switch {
+	case err == io.EOF:
+		return errTruncated
+	case err == io.ErrUnexpectedEOF:
+		d.done = true
+	case err != nil:
+		return err
+	default:
+		// A full chunk is the last one when nothing follows it
+		if _, err := d.r.Peek(1); err == io.EOF {
+			d.done = true
+		}
+	}
+
+	chunk, err := d.aead.Open(nil, chunkNonce(d.aead.NonceSize(), d.counter, d.done), sealed[:n], nil)
+	if err != nil {
+		if d.done {
+			return errTruncated
+		}
+		return errors.New("backup: wrong encryption key or corrupted backup")
+	}
+	d.counter++
+	d.buf = chunk
+	return nil
+}
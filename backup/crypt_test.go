@@ -0,0 +1,107 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func encrypt(t *testing.T, data []byte, passphrase string) []byte {
+	var buf bytes.Buffer
+	w, err := newEncrypter(&buf, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Odd write sizes so chunks do not line up with the writes
+	for len(data) > 0 {
+		n := min(len(data), 10007)
+		if _, err := w.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(encrypted []byte, passphrase string) ([]byte, error) {
+	r := bufio.NewReader(bytes.NewReader(encrypted))
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	d, err := newDecrypter(r, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(d)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize, 3*chunkSize + 12345} {
+		data := dumpFixture(size)
+		encrypted := encrypt(t, data, "correct horse")
+
+		if !bytes.HasPrefix(encrypted, []byte(magic)) {
+			t.Errorf("%d bytes: encrypted backup does not start with the magic", size)
+		}
+		if size > 100 && bytes.Contains(encrypted, data[:100]) {
+			t.Errorf("%d bytes: encrypted backup contains the plain text", size)
+		}
+		got, err := decrypt(encrypted, "correct horse")
+		if err != nil {
+			t.Errorf("%d bytes: %v", size, err)
+			continue
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: decrypted %d bytes that differ from the original", size, len(got))
+		}
+	}
+}
+
+func TestEncryptSaltsEachBackup(t *testing.T) {
+	data := dumpFixture(1000)
+	if bytes.Equal(encrypt(t, data, "key"), encrypt(t, data, "key")) {
+		t.Error("two encryptions of the same dump are identical")
+	}
+}
+
+func TestDecryptRejectsTampering(t *testing.T) {
+	data := dumpFixture(2*chunkSize + 500)
+	encrypted := encrypt(t, data, "key")
+	sealedSize := chunkSize + 16
+	header := len(magic) + saltSize
+
+	flipped := bytes.Clone(encrypted)
+	flipped[header+chunkSize/2] ^= 1
+
+	// The second and third chunk swapped, the last one keeps its place at
+	// the end only by its length
+	reordered := append(bytes.Clone(encrypted[:header+sealedSize]), encrypted[header+2*sealedSize:]...)
+	reordered = append(reordered, encrypted[header+sealedSize:header+2*sealedSize]...)
+
+	tests := []struct {
+		name       string
+		encrypted  []byte
+		passphrase string
+		want       string
+	}{
+		{name: "wrong passphrase", encrypted: encrypted, passphrase: "other", want: "wrong encryption key"},
+		{name: "flipped bit", encrypted: flipped, passphrase: "key", want: "wrong encryption key"},
+		{name: "reordered chunks", encrypted: reordered, passphrase: "key", want: "backup:"},
+		{name: "truncated at a chunk", encrypted: encrypted[:header+2*sealedSize], passphrase: "key", want: "truncated"},
+		{name: "truncated in a chunk", encrypted: encrypted[:header+sealedSize+100], passphrase: "key", want: "truncated"},
+		{name: "only the header", encrypted: encrypted[:header], passphrase: "key", want: "truncated"},
+		{name: "truncated salt", encrypted: encrypted[:len(magic)+4], passphrase: "key", want: "truncated"},
+	}
+	for _, test := range tests {
+		got, err := decrypt(test.encrypted, test.passphrase)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: decrypted %d bytes with error %v, want %q", test.name, len(got), err, test.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package backup
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"overtime/s3"
+)
+
+// s3Store keeps backups in an S3 bucket, or any storage speaking the S3 API
+// such as MinIO
+type s3Store struct {
+	client *s3.Client
+	prefix string
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3Store) Put(name string, r io.Reader, size int64) error {
+	return s.client.Put(s.prefix+name, r, size)
+}
+
+func (s *s3Store) Get(name string) (io.ReadCloser, error) {
+	resp, err := s.client.Do(http.MethodGet, s.prefix+name, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Store) List() ([]string, error) {
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", s.prefix+namePrefix)
+
+	var names []string
+	for {
+		resp, err := s.client.Do(http.MethodGet, "", query, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: decode listing: %w", err)
+		}
+
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, s.prefix)
+			if isBackupName(name) {
+				names = append(names, name)
+			}
+		}
+		if !result.IsTruncated {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *s3Store) Delete(name string) error {
+	resp, err := s.client.Do(http.MethodDelete, s.prefix+name, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Store keeps backup files under their names
+type Store interface {
+	Put(name string, r io.Reader, size int64) error
+	Get(name string) (io.ReadCloser, error)
+	// List returns the names of the stored backups, oldest first
+	List() ([]string, error)
+	Delete(name string) error
+}
+
+// dirStore keeps backups in a local directory
+type dirStore struct {
+	dir string
+}
+
+func (s *dirStore) Put(name string, r io.Reader, size int64) error {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+
+	// Write under a temporary name so a failed backup never looks complete
+	path := filepath.Join(s.dir, name)
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		os.Remove(path + ".tmp")
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *dirStore) Get(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.dir, filepath.Base(name)))
+}
+
+func (s *dirStore) List() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if isBackupName(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *dirStore) Delete(name string) error {
+	return os.Remove(filepath.Join(s.dir, filepath.Base(name)))
+}
+
+func isBackupName(name string) bool {
+	return strings.HasPrefix(name, namePrefix) && (strings.HasSuffix(name, plainSuffix) || strings.HasSuffix(name, encryptedSuffix))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"overtime/backup"
+)
+
+// backupCommand implements `overtime backup`
+func backupCommand(backups *backup.Service) int {
+	name, err := backups.Backup()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Backup failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Backup %s written to %s\n", name, backups.Location())
+	return 0
+}
+
+// restoreCommand implements `overtime restore [name]`. Without a name it
+// lists the backups that can be restored.
+func restoreCommand(backups *backup.Service, name string) int {
+	if name == "" {
+		names, err := backups.List()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list backups: %v\n", err)
+			return 1
+		}
+		if len(names) == 0 {
+			fmt.Printf("No backups in %s\n", backups.Location())
+			return 0
+		}
+		fmt.Printf("Backups in %s, oldest first:\n", backups.Location())
+		for _, name := range names {
+			fmt.Println("  " + name)
+		}
+		return 0
+	}
+
+	if err := backups.Restore(name); err != nil {
+		fmt.Fprintf(os.Stderr, "Restore failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Restored %s\n", name)
+	return 0
+}
@@ -0,0 +1,121 @@
+// Package cache keeps rarely changing data, like an organization's teams, so
+// pages do not query it on every render. Values live in memory or, when
+// several replicas run, in Redis so that an invalidation reaches all of them.
+package cache
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"overtime/redis"
+)
+
+// keyPrefix keeps the keys apart from other data in a shared Redis
+const keyPrefix = "overtime:cache:"
+
+type Cache interface {
+	// Get decodes the value cached under key into dest and reports whether
+	// there was one
+	Get(key string, dest interface{}) bool
+	// Set caches value under key until it expires or is deleted
+	Set(key string, value interface{})
+	// Delete drops the keys, e.g. after the data behind them changed
+	Delete(keys ...string)
+}
+
+// New returns a cache whose entries expire after ttl, stored in Redis when a
+// client is given and in memory otherwise
+func New(ttl time.Duration, client *redis.Client) Cache {
+	if client != nil {
+		return &redisCache{client: client, ttl: ttl}
+	}
+	return &memoryCache{ttl: ttl, entries: map[string]memoryEntry{}}
+}
+
+// Values are stored encoded in both caches, so callers never share (and
+// modify) the cached value itself
+
+type memoryEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+type memoryCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+func (c *memoryCache) Get(key string, dest interface{}) bool {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+
+	return ok && json.Unmarshal(entry.data, dest) == nil
+}
+
+func (c *memoryCache) Set(key string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("Cache: failed to encode %s: %v", key, err)
+		return
+	}
+
+	c.mu.Lock()
+	c.entries[key] = memoryEntry{data: data, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+}
+
+func (c *memoryCache) Delete(keys ...string) {
+	c.mu.Lock()
+	for _, key := range keys {
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+}
+
+// redisCache treats Redis failures as cache misses, so pages keep working
+// from the database while Redis is down
+type redisCache struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func (c *redisCache) Get(key string, dest interface{}) bool {
+	data, err := c.client.Get(keyPrefix + key)
+	if err != nil {
+		if err != redis.ErrNil {
+			log.Printf("Cache: failed to read %s: %v", key, err)
+		}
+		return false
+	}
+	return json.Unmarshal(data, dest) == nil
+}
+
+func (c *redisCache) Set(key string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("Cache: failed to encode %s: %v", key, err)
+		return
+	}
+	if err := c.client.Set(keyPrefix+key, data, c.ttl); err != nil {
+		log.Printf("Cache: failed to write %s: %v", key, err)
+	}
+}
+
+func (c *redisCache) Delete(keys ...string) {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = keyPrefix + key
+	}
+	// A stale entry outlives a failed delete until it expires
+	if err := c.client.Del(prefixed...); err != nil {
+		log.Printf("Cache: failed to delete %v: %v", keys, err)
+	}
+}
@@ -0,0 +1,246 @@
+// Package caldav publishes approved overtime and time off to per-team CalDAV
+// calendars.
+package caldav
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"overtime/config"
+	"overtime/models"
+
+	"gorm.io/gorm"
+)
+
+type Publisher struct {
+	db     *gorm.DB
+	config *config.Config
+	http   *http.Client
+}
+
+func NewPublisher(db *gorm.DB, cfg *config.Config) *Publisher {
+	return &Publisher{
+		db:     db,
+		config: cfg,
+		http:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Sync brings the calendar of the entry owner's team in line with the entry:
+// approved entries are published as all-day events, anything else (pending,
+// rejected or deleted) is removed. Teams without a calendar are skipped.
+// It is safe to call after any change to an entry, and on a nil Publisher,
+// which publishes nothing.
+func (p *Publisher) Sync(entryID uint) {
+	if p == nil {
+		return
+	}
+	var entry models.OvertimeEntry
+	if err := p.db.Unscoped().Preload("User").Preload("User.Team").First(&entry, entryID).Error; err != nil {
+		log.Printf("CalDAV: failed to load entry %d: %v", entryID, err)
+		return
+	}
+
+	team := entry.User.Team
+	if team == nil || team.CalendarURL == "" {
+		return
+	}
+
+	name := fmt.Sprintf("overtime-entry-%d", entry.ID)
+	var err error
+	if entry.Status == models.StatusApproved && !entry.DeletedAt.Valid {
+		summary := fmt.Sprintf("Overtime: %s (%.2fh)", entry.User.DisplayName(), entry.Hours)
+		err = p.put(team.CalendarURL, name, p.event(name, entry.Date, entry.UpdatedAt, summary, entry.Description))
+	} else {
+		err = p.delete(team.CalendarURL, name)
+	}
+	if err != nil {
+		log.Printf("CalDAV: failed to sync entry %d to team %q: %v", entry.ID, team.Name, err)
+	}
+}
+
+// SyncTimeOff is Sync for time off requests: approved time off is published,
+// anything else removed
+func (p *Publisher) SyncTimeOff(requestID uint) {
+	var request models.TimeOffRequest
+	if err := p.db.Preload("User").Preload("User.Team").First(&request, requestID).Error; err != nil {
+		log.Printf("CalDAV: failed to load time off request %d: %v", requestID, err)
+		return
+	}
+
+	team := request.User.Team
+	if team == nil || team.CalendarURL == "" {
+		return
+	}
+
+	name := fmt.Sprintf("time-off-%d", request.ID)
+	var err error
+	if request.Status == models.StatusApproved {
+		summary := fmt.Sprintf("Time off: %s (%.2fh)", request.User.DisplayName(), request.Hours)
+		err = p.put(team.CalendarURL, name, p.event(name, request.Date, request.UpdatedAt, summary, request.Note))
+	} else {
+		err = p.delete(team.CalendarURL, name)
+	}
+	if err != nil {
+		log.Printf("CalDAV: failed to sync time off request %d to team %q: %v", request.ID, team.Name, err)
+	}
+}
+
+func (p *Publisher) put(collection, name, event string) error {
+	req, err := p.request(http.MethodPut, collection, name, strings.NewReader(event))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/calendar; charset=utf-8")
+	return p.do(req, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+}
+
+func (p *Publisher) delete(collection, name string) error {
+	req, err := p.request(http.MethodDelete, collection, name, nil)
+	if err != nil {
+		return err
+	}
+	// Events that were never published are not found, which is fine
+	return p.do(req, http.StatusOK, http.StatusNoContent, http.StatusNotFound)
+}
+
+// Accepts reports whether team calendars may be published to calendarURL:
+// any http(s) URL, or only ones on the CalDAV server when CALDAV_URL is set
+func (p *Publisher) Accepts(calendarURL string) bool {
+	u, err := url.Parse(calendarURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	if p.config.CalDAVURL == "" {
+		return true
+	}
+	server, err := url.Parse(p.config.CalDAVURL)
+	return err == nil && strings.EqualFold(u.Scheme, server.Scheme) && strings.EqualFold(u.Host, server.Host)
+}
+
+// request addresses the event resource called name in the collection. The
+// CalDAV credentials are only sent to the CalDAV server, so calendars set up
+// elsewhere are refused.
+func (p *Publisher) request(method, collection, name string, body io.Reader) (*http.Request, error) {
+	if !p.Accepts(collection) {
+		return nil, fmt.Errorf("calendar %s is not on the CalDAV server", collection)
+	}
+	resource, err := url.JoinPath(collection, name+".ics")
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, resource, body)
+	if err != nil {
+		return nil, err
+	}
+	if p.config.CalDAVUsername != "" {
+		req.SetBasicAuth(p.config.CalDAVUsername, p.config.CalDAVPassword)
+	}
+	return req, nil
+}
+
+func (p *Publisher) do(req *http.Request, accepted ...int) error {
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	for _, status := range accepted {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %s: unexpected status %s", req.Method, req.URL.Redacted(), resp.Status)
+}
+
+// event renders an iCalendar all-day event on day. name identifies the event
+// within the calendar.
+func (p *Publisher) event(name string, day, updated time.Time, summary, description string) string {
+	host := "overtime"
+	if base, err := url.Parse(p.config.BaseURL); err == nil && base.Hostname() != "" {
+		host = base.Hostname()
+	}
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//overtime//overtime//EN",
+		"BEGIN:VEVENT",
+		"UID:" + name + "@" + host,
+		"DTSTAMP:" + updated.UTC().Format("20060102T150405Z"),
+		"DTSTART;VALUE=DATE:" + day.Format("20060102"),
+		"DTEND;VALUE=DATE:" + day.AddDate(0, 0, 1).Format("20060102"),
+		"SUMMARY:" + escapeText(summary),
+		"TRANSP:TRANSPARENT",
+	}
+	if description != "" {
+		lines = append(lines, "DESCRIPTION:"+escapeText(description))
+	}
+	lines = append(lines, "END:VEVENT", "END:VCALENDAR")
+
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(fold(line))
+		b.WriteString("\r\n")
+	}
+	return b.String()
+}
+
+var textEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// escapeText escapes an iCalendar TEXT value (RFC 5545, section 3.3.11)
+func escapeText(s string) string {
+	return textEscaper.Replace(s)
+}
+
+// fold splits content lines longer than 75 octets without breaking UTF-8
+// sequences (RFC 5545, section 3.1)
+func fold(line string) string {
+	if len(line) <= 75 {
+		return line
+	}
+
+	var b strings.Builder
+	width := 0
+	for _, r := range line {
+		size := len(string(r))
+		if width+size > 75 {
+			b.WriteString("\r\n ")
+			width = 1
+		}
+		b.WriteRune(r)
+		width += size
+	}
+	return b.String()
+}
+
+// SyncTeam publishes every approved entry and time off of the team's members,
+// e.g. after the team's calendar was configured
+func (p *Publisher) SyncTeam(teamID uint) {
+	var ids []uint
+	p.db.Model(&models.OvertimeEntry{}).
+		Joins("JOIN users ON users.id = overtime_entries.user_id").
+		Where("users.team_id = ? AND overtime_entries.status = ?", teamID, models.StatusApproved).
+		Pluck("overtime_entries.id", &ids)
+
+	for _, id := range ids {
+		p.Sync(id)
+	}
+
+	var timeOffIDs []uint
+	p.db.Model(&models.TimeOffRequest{}).
+		Joins("JOIN users ON users.id = time_off_requests.user_id").
+		Where("users.team_id = ? AND time_off_requests.status = ?", teamID, models.StatusApproved).
+		Pluck("time_off_requests.id", &timeOffIDs)
+
+	for _, id := range timeOffIDs {
+		p.SyncTimeOff(id)
+	}
+}
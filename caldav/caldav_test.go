@@ -0,0 +1,67 @@
+package caldav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"overtime/config"
+)
+
+func TestAccepts(t *testing.T) {
+	open := &Publisher{config: &config.Config{}}
+	server := &Publisher{config: &config.Config{CalDAVURL: "https://dav.example.com/calendars/"}}
+
+	tests := []struct {
+		publisher *Publisher
+		url       string
+		want      bool
+	}{
+		{open, "https://elsewhere.example.org/team/", true},
+		{open, "ftp://dav.example.com/team/", false},
+		{server, "https://dav.example.com/calendars/team/", true},
+		{server, "https://DAV.example.com/other/", true},
+		{server, "http://dav.example.com/calendars/team/", false},
+		{server, "https://dav.example.com:8443/calendars/team/", false},
+		{server, "https://attacker.example.org/calendars/team/", false},
+		{server, "https://dav.example.com.attacker.example.org/", false},
+	}
+	for _, test := range tests {
+		if got := test.publisher.Accepts(test.url); got != test.want {
+			t.Errorf("Accepts(%q) with CALDAV_URL %q = %v, want %v", test.url, test.publisher.config.CalDAVURL, got, test.want)
+		}
+	}
+}
+
+func TestCredentialsOnlyGoToTheServer(t *testing.T) {
+	var authorized []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); ok {
+			authorized = append(authorized, r.Host)
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	dav := httptest.NewServer(handler)
+	defer dav.Close()
+	elsewhere := httptest.NewServer(handler)
+	defer elsewhere.Close()
+
+	p := &Publisher{
+		config: &config.Config{CalDAVURL: dav.URL, CalDAVUsername: "overtime", CalDAVPassword: "secret"},
+		http:   dav.Client(),
+	}
+	day := time.Date(2026, time.March, 10, 0, 0, 0, 0, time.UTC)
+
+	if err := p.put(dav.URL+"/team/", "event", p.event("event", day, day, "Overtime", "")); err != nil {
+		t.Fatalf("put on the server: %v", err)
+	}
+	err := p.put(elsewhere.URL+"/team/", "event", p.event("event", day, day, "Overtime", ""))
+	if err == nil || !strings.Contains(err.Error(), "not on the CalDAV server") {
+		t.Errorf("put elsewhere = %v, want it refused", err)
+	}
+	if len(authorized) != 1 || authorized[0] != strings.TrimPrefix(dav.URL, "http://") {
+		t.Errorf("credentials sent to %v, want only %s", authorized, dav.URL)
+	}
+}
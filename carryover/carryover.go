@@ -0,0 +1,124 @@
+// Package carryover applies the organizations' balance rules at the end of
+// every period: the hours of a balance above what a rule lets users carry
+// over expire, recorded as a compensation.
+package carryover
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"overtime/config"
+	"overtime/models"
+	"overtime/scheduler"
+	"overtime/services"
+
+	"gorm.io/gorm"
+)
+
+// Applier periodically applies every balance rule to the period that ended
+// last. A rule expires the hours of a user in a period once, later changes
+// to the period are left alone.
+type Applier struct {
+	db     *gorm.DB
+	config *config.Config
+}
+
+func NewApplier(db *gorm.DB, cfg *config.Config) *Applier {
+	return &Applier{db: db, config: cfg}
+}
+
+func (a *Applier) Enabled() bool {
+	return a.config.BalanceRulesInterval > 0
+}
+
+// Run applies the rules once immediately and then on every interval, on
+// whichever replica claims the run from lock. It never returns.
+func (a *Applier) Run(lock *scheduler.Lock) {
+	ticker := time.NewTicker(a.config.BalanceRulesInterval)
+	defer ticker.Stop()
+	for {
+		if lock.Claim("carryover", a.config.BalanceRulesInterval) {
+			if err := a.ApplyDue(); err != nil {
+				log.Printf("Applying balance rules failed: %v", err)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// ApplyDue applies every rule to the last period that ended, unless the rule
+// was created after that
+func (a *Applier) ApplyDue() error {
+	var rules []models.BalanceRule
+	if err := a.db.Order("organization_id, id").Find(&rules).Error; err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for i := range rules {
+		_, end, period := rules[i].Period.Before(now)
+		if !end.After(rules[i].CreatedAt) {
+			continue
+		}
+		if err := a.Apply(&rules[i], end, period); err != nil {
+			log.Printf("Applying balance rule %d to %s failed: %v", rules[i].ID, period, err)
+		}
+	}
+	return nil
+}
+
+// Apply expires the hours above the rule's maximum of the balances of the
+// organization's users at end, the end of the named period
+func (a *Applier) Apply(rule *models.BalanceRule, end time.Time, period string) error {
+	var users []models.User
+	if err := a.db.Where("organization_id = ?", rule.OrganizationID).Find(&users).Error; err != nil {
+		return err
+	}
+
+	for i := range users {
+		err := a.db.Transaction(func(tx *gorm.DB) error {
+			var applied int64
+			err := tx.Model(&models.Compensation{}).
+				Where("user_id = ? AND rule_id = ? AND period = ?", users[i].ID, rule.ID, period).
+				Count(&applied).Error
+			if err != nil || applied > 0 {
+				return err
+			}
+
+			balance, err := services.BalanceBefore(tx, users[i].ID, end)
+			if err != nil {
+				return err
+			}
+			expired := balance - rule.MaxHours
+			if expired <= 0 {
+				return nil
+			}
+
+			compensation := models.Compensation{
+				OrganizationID: rule.OrganizationID,
+				UserID:         users[i].ID,
+				// The last day of the period, so the next one starts at the maximum
+				Date:   end.AddDate(0, 0, -1),
+				Hours:  -expired,
+				Kind:   models.CompensationExpiry,
+				Reason: fmt.Sprintf("%.2fh above the %gh carried over at the end of %s expired", expired, rule.MaxHours, period),
+				RuleID: &rule.ID,
+				Period: period,
+			}
+			if err := tx.Create(&compensation).Error; err != nil {
+				return err
+			}
+			return tx.Create(&models.AuditLog{
+				OrganizationID: rule.OrganizationID,
+				UserID:         &users[i].ID,
+				Action:         models.AuditBalanceExpired,
+				Detail:         fmt.Sprintf("%s: %s, balance %.2fh", compensation.Reason, rule.Label(), balance),
+			}).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
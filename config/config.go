@@ -1,33 +1,540 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// defaultJWTSecret is only good for development, Load refuses it in production
+const defaultJWTSecret = "your-super-secret-key-change-in-production"
+
 type Config struct {
-	BaseURL          string
-	DatabaseURL      string
-	JWTSecret        string
-	JWTExpiration    time.Duration
-	ServerPort       string
-	InviteExpiration time.Duration
+	Environment            string
+	BaseURL                string
+	DatabaseURL            string
+	JWTSecret              string
+	JWTExpiration          time.Duration
+	ServerPort             string
+	InviteExpiration       time.Duration
+	ApprovalLinkExpiration time.Duration
+	// MagicLinkLogin offers emailed login links on the login page
+	MagicLinkLogin      bool
+	MagicLinkExpiration time.Duration
+	SMTPHost            string
+	SMTPPort            string
+	SMTPUsername        string
+	SMTPPassword        string
+	SMTPFrom            string
+	TempoAPIURL         string
+	TempoAPIToken       string
+	TempoOvertimeTag    string
+	TempoImportInterval time.Duration
+	TempoImportDays     int
+	TelegramBotToken    string
+	TelegramBotUsername string
+	// CalDAVURL is the CalDAV server team calendars are published to. Its
+	// credentials are only sent there, and calendars elsewhere are refused.
+	CalDAVURL      string
+	CalDAVUsername string
+	CalDAVPassword string
+	CookieName     string
+	CookieDomain   string
+	CookieSecure   bool
+	CookieSameSite http.SameSite
+	TLSCertFile    string
+	TLSKeyFile     string
+	// TLSAutocert obtains certificates for AutocertHosts from Let's Encrypt
+	TLSAutocert      bool
+	AutocertHosts    []string
+	AutocertEmail    string
+	AutocertCacheDir string
+	// TrustedProxies may set the client address, scheme and host with
+	// X-Forwarded-* headers
+	TrustedProxies []*net.IPNet
+	// DetectBaseURL derives links shown in the browser from the request when
+	// BASE_URL is not set. Emails and calendars always use BaseURL.
+	DetectBaseURL bool
+	// Argon2 cost of new password hashes, memory in KiB
+	Argon2Memory      int
+	Argon2Iterations  int
+	Argon2Parallelism int
+	// HTTPRedirectPort serves redirects to HTTPS and, with autocert, ACME
+	// challenges. Empty disables it.
+	HTTPRedirectPort string
+	// RequestTimeout cancels requests, and their database queries, that run
+	// longer. Zero disables it.
+	RequestTimeout time.Duration
+	// Database connection pool limits, zero means unlimited. Queries running
+	// longer than DatabaseSlowQueryThreshold are logged, zero disables it.
+	DatabaseMaxOpenConns       int
+	DatabaseMaxIdleConns       int
+	DatabaseConnMaxLifetime    time.Duration
+	DatabaseSlowQueryThreshold time.Duration
+	// RetentionInterval is how often retention policies are applied;
+	// RetentionNotice is how long after the emailed report data is deleted
+	RetentionInterval time.Duration
+	RetentionNotice   time.Duration
+	// AnomalyInterval is how often overtime is checked for unusual patterns
+	// to report to HR, zero disables the check
+	AnomalyInterval time.Duration
+	// DigestInterval is how often reviewers who chose a digest are emailed
+	// the entries submitted for their approval since the last one, zero
+	// disables digests
+	DigestInterval time.Duration
+	// DeliveryInterval is how often due export deliveries are sent, zero
+	// disables them. Deliveries to a directory go below DeliveryDir.
+	DeliveryInterval time.Duration
+	DeliveryDir      string
+	// MonthCloseInterval is how often organizations that close months are
+	// checked for a month due, zero disables closing
+	MonthCloseInterval time.Duration
+	// BalanceRulesInterval is how often the organizations' balance rules are
+	// applied to the period that ended last, zero disables them
+	BalanceRulesInterval time.Duration
+	// HRISSyncInterval is how often users are synced from the organizations'
+	// HR systems, zero disables the scheduled sync
+	HRISSyncInterval time.Duration
+	// Backups are written to BackupS3Bucket when set, otherwise to BackupDir.
+	// BackupInterval schedules them, zero only backs up on demand.
+	BackupDir           string
+	BackupInterval      time.Duration
+	BackupKeep          int
+	BackupEncryptionKey string
+	BackupS3Endpoint    string
+	BackupS3Region      string
+	BackupS3Bucket      string
+	BackupS3Prefix      string
+	BackupS3AccessKey   string
+	BackupS3SecretKey   string
+	// RedisURL, e.g. redis://localhost:6379/0, shares cached data, rate limit
+	// counters and scheduled job runs between replicas. Empty keeps them in
+	// memory. Cached entries expire after CacheTTL.
+	RedisURL string
+	CacheTTL time.Duration
+	// AdminSeed creates the admin account on a fresh database, with
+	// AdminInitialPassword or else a random password that is logged once.
+	// Deployments logging in through SSO only turn it off.
+	AdminSeed            bool
+	AdminInitialPassword string
+	// LoginRateLimit is how many logins an address may attempt for one
+	// account in LoginRateWindow, zero disables the limit
+	LoginRateLimit  int
+	LoginRateWindow time.Duration
+	// APIRateLimit is how many requests a session, by a browser or with its
+	// bearer token, may make in APIRateWindow, zero disables the limit
+	APIRateLimit  int
+	APIRateWindow time.Duration
+	// CaptchaProvider, hcaptcha or turnstile, challenges the login and
+	// registration forms of an address after CaptchaAfterFailures failed
+	// attempts in LoginRateWindow, zero challenges every attempt. Empty
+	// disables the challenge.
+	CaptchaProvider      string
+	CaptchaSiteKey       string
+	CaptchaSecretKey     string
+	CaptchaAfterFailures int
+	// FailedLoginAlertThreshold raises a security alert once an account had
+	// this many failed logins in LoginRateWindow, zero disables the alert
+	FailedLoginAlertThreshold int
+	// DiagnosticsAddr, e.g. localhost:6060, serves profiles and runtime
+	// statistics to platform admins. It should not be reachable from outside.
+	// Empty disables it.
+	DiagnosticsAddr string
+	// DevMode parses the templates again on every request and shows template
+	// errors in the browser
+	DevMode bool
+	// Gravatar shows the Gravatar of users without an uploaded avatar. It
+	// sends a hash of their email address to gravatar.com with every page.
+	Gravatar bool
 }
 
-func Load() *Config {
-	return &Config{
-		BaseURL:          getEnv("BASE_URL", "http://localhost:8080"),
-		DatabaseURL:      getEnv("DATABASE_URL", "postgresql://postgres@localhost:5432/overtime"),
-		JWTSecret:        getEnv("JWT_SECRET", "your-super-secret-key-change-in-production"),
-		JWTExpiration:    24 * time.Hour,
-		ServerPort:       getEnv("SERVER_PORT", "8080"),
-		InviteExpiration: 7 * 24 * time.Hour, // 7 days
+// Load reads the configuration from the environment and the optional config
+// file at path, with environment variables taking precedence, and validates it
+func Load(path string) (*Config, error) {
+	s := &source{file: map[string]string{}, read: map[string]bool{}}
+	if path != "" {
+		file, err := readFile(path)
+		if err != nil {
+			return nil, err
+		}
+		s.file = file
+	}
+
+	cfg := &Config{
+		Environment:            s.get("APP_ENV", "development"),
+		BaseURL:                s.get("BASE_URL", "http://localhost:8080"),
+		DatabaseURL:            s.get("DATABASE_URL", "postgresql://postgres@localhost:5432/overtime"),
+		JWTSecret:              s.get("JWT_SECRET", defaultJWTSecret),
+		JWTExpiration:          24 * time.Hour,
+		ServerPort:             s.get("SERVER_PORT", "8080"),
+		InviteExpiration:       7 * 24 * time.Hour, // 7 days
+		ApprovalLinkExpiration: 3 * 24 * time.Hour, // 3 days
+		SMTPHost:               s.get("SMTP_HOST", ""),
+		SMTPPort:               s.get("SMTP_PORT", "587"),
+		SMTPUsername:           s.get("SMTP_USERNAME", ""),
+		SMTPPassword:           s.get("SMTP_PASSWORD", ""),
+		SMTPFrom:               s.get("SMTP_FROM", "overtime@localhost"),
+		TempoAPIURL:            s.get("TEMPO_API_URL", "https://api.tempo.io/4"),
+		TempoAPIToken:          s.get("TEMPO_API_TOKEN", ""),
+		TempoOvertimeTag:       s.get("TEMPO_OVERTIME_TAG", "overtime"),
+		TempoImportInterval:    s.duration("TEMPO_IMPORT_INTERVAL", time.Hour),
+		TempoImportDays:        s.int("TEMPO_IMPORT_DAYS", 7),
+		TelegramBotToken:       s.get("TELEGRAM_BOT_TOKEN", ""),
+		TelegramBotUsername:    s.get("TELEGRAM_BOT_USERNAME", ""),
+		CalDAVURL:              s.get("CALDAV_URL", ""),
+		CalDAVUsername:         s.get("CALDAV_USERNAME", ""),
+		CalDAVPassword:         s.get("CALDAV_PASSWORD", ""),
+		CookieName:             s.get("COOKIE_NAME", "token"),
+		CookieDomain:           s.get("COOKIE_DOMAIN", ""),
+		CookieSameSite:         s.sameSite("COOKIE_SAMESITE", http.SameSiteStrictMode),
+	}
+	// Cookies are only sent over HTTPS when the site is served over HTTPS,
+	// unless configured otherwise
+	cfg.CookieSecure = s.bool("COOKIE_SECURE", strings.HasPrefix(cfg.BaseURL, "https://"))
+
+	cfg.DatabaseMaxOpenConns = s.optionalInt("DATABASE_MAX_OPEN_CONNS", 25)
+	cfg.DatabaseMaxIdleConns = s.optionalInt("DATABASE_MAX_IDLE_CONNS", 5)
+	cfg.DatabaseConnMaxLifetime = s.optionalDuration("DATABASE_CONN_MAX_LIFETIME", 30*time.Minute)
+	cfg.DatabaseSlowQueryThreshold = s.optionalDuration("DATABASE_SLOW_QUERY_THRESHOLD", 200*time.Millisecond)
+
+	cfg.RequestTimeout = s.optionalDuration("REQUEST_TIMEOUT", 30*time.Second)
+
+	cfg.AdminSeed = s.bool("ADMIN_SEED", true)
+	cfg.AdminInitialPassword = s.get("ADMIN_INITIAL_PASSWORD", "")
+
+	cfg.RedisURL = s.get("REDIS_URL", "")
+	cfg.CacheTTL = s.duration("CACHE_TTL", 10*time.Minute)
+
+	cfg.LoginRateLimit = s.optionalInt("LOGIN_RATE_LIMIT", 10)
+	cfg.LoginRateWindow = s.duration("LOGIN_RATE_WINDOW", 15*time.Minute)
+	cfg.APIRateLimit = s.optionalInt("API_RATE_LIMIT", 600)
+	cfg.APIRateWindow = s.duration("API_RATE_WINDOW", time.Minute)
+	cfg.CaptchaProvider = s.get("CAPTCHA_PROVIDER", "")
+	cfg.CaptchaSiteKey = s.get("CAPTCHA_SITE_KEY", "")
+	cfg.CaptchaSecretKey = s.get("CAPTCHA_SECRET_KEY", "")
+	cfg.CaptchaAfterFailures = s.optionalInt("CAPTCHA_AFTER_FAILURES", 3)
+	cfg.FailedLoginAlertThreshold = s.optionalInt("FAILED_LOGIN_ALERT_THRESHOLD", 5)
+
+	cfg.DiagnosticsAddr = s.get("DIAGNOSTICS_ADDR", "")
+	cfg.DevMode = s.bool("DEV_MODE", false)
+
+	cfg.Gravatar = s.bool("GRAVATAR", false)
+
+	cfg.MagicLinkLogin = s.bool("MAGIC_LINK_LOGIN", false)
+	cfg.MagicLinkExpiration = s.duration("MAGIC_LINK_EXPIRATION", 15*time.Minute)
+
+	cfg.RetentionInterval = s.duration("RETENTION_INTERVAL", 24*time.Hour)
+	cfg.RetentionNotice = s.duration("RETENTION_NOTICE", 7*24*time.Hour)
+
+	cfg.AnomalyInterval = s.optionalDuration("ANOMALY_INTERVAL", 24*time.Hour)
+
+	cfg.DigestInterval = s.optionalDuration("DIGEST_INTERVAL", 24*time.Hour)
+
+	cfg.DeliveryInterval = s.optionalDuration("DELIVERY_INTERVAL", time.Hour)
+	cfg.DeliveryDir = s.get("DELIVERY_DIR", "exports")
+
+	cfg.MonthCloseInterval = s.optionalDuration("MONTH_CLOSE_INTERVAL", time.Hour)
+
+	cfg.BalanceRulesInterval = s.optionalDuration("BALANCE_RULES_INTERVAL", time.Hour)
+
+	cfg.HRISSyncInterval = s.optionalDuration("HRIS_SYNC_INTERVAL", 24*time.Hour)
+
+	cfg.BackupDir = s.get("BACKUP_DIR", "backups")
+	cfg.BackupInterval = s.optionalDuration("BACKUP_INTERVAL", 0)
+	cfg.BackupKeep = s.int("BACKUP_KEEP", 14)
+	cfg.BackupEncryptionKey = s.get("BACKUP_ENCRYPTION_KEY", "")
+	cfg.BackupS3Region = s.get("BACKUP_S3_REGION", "us-east-1")
+	cfg.BackupS3Endpoint = s.get("BACKUP_S3_ENDPOINT", "https://s3."+cfg.BackupS3Region+".amazonaws.com")
+	cfg.BackupS3Bucket = s.get("BACKUP_S3_BUCKET", "")
+	cfg.BackupS3Prefix = s.get("BACKUP_S3_PREFIX", "")
+	cfg.BackupS3AccessKey = s.get("BACKUP_S3_ACCESS_KEY", "")
+	cfg.BackupS3SecretKey = s.get("BACKUP_S3_SECRET_KEY", "")
+
+	cfg.Argon2Memory = s.int("ARGON2_MEMORY", 64*1024)
+	cfg.Argon2Iterations = s.int("ARGON2_ITERATIONS", 3)
+	cfg.Argon2Parallelism = s.int("ARGON2_PARALLELISM", 2)
+
+	cfg.DetectBaseURL = s.get("BASE_URL", "") == ""
+	cfg.TrustedProxies = s.networks("TRUSTED_PROXIES")
+
+	cfg.TLSCertFile = s.get("TLS_CERT_FILE", "")
+	cfg.TLSKeyFile = s.get("TLS_KEY_FILE", "")
+	cfg.TLSAutocert = s.bool("TLS_AUTOCERT", false)
+	cfg.AutocertEmail = s.get("AUTOCERT_EMAIL", "")
+	cfg.AutocertCacheDir = s.get("AUTOCERT_CACHE_DIR", "autocert-cache")
+	cfg.HTTPRedirectPort = s.get("HTTP_REDIRECT_PORT", "")
+	if cfg.TLSAutocert {
+		// Let's Encrypt only validates on the standard ports
+		cfg.ServerPort = s.get("SERVER_PORT", "443")
+		cfg.HTTPRedirectPort = s.get("HTTP_REDIRECT_PORT", "80")
+
+		hosts := s.get("AUTOCERT_HOSTS", "")
+		if hosts == "" {
+			if u, err := url.Parse(cfg.BaseURL); err == nil {
+				hosts = u.Hostname()
+			}
+		}
+		for _, host := range strings.Split(hosts, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				cfg.AutocertHosts = append(cfg.AutocertHosts, host)
+			}
+		}
 	}
+
+	if path := s.get("VAULT_DATABASE_PATH", ""); path != "" {
+		username, password, err := vaultDatabaseCredentials(s.get("VAULT_ADDR", "http://127.0.0.1:8200"), s.get("VAULT_TOKEN", ""), path)
+		if err == nil {
+			cfg.DatabaseURL, err = withCredentials(cfg.DatabaseURL, username, password)
+		}
+		if err != nil {
+			s.errs = append(s.errs, fmt.Errorf("database credentials from vault: %w", err))
+		}
+	}
+
+	if unknown := s.unknownKeys(); len(unknown) > 0 {
+		s.errs = append(s.errs, fmt.Errorf("unknown settings in %s: %s", path, strings.Join(unknown, ", ")))
+	}
+	if err := errors.Join(s.errs...); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
 }
 
-func getEnv(key, defaultValue string) string {
+// IsProduction reports whether APP_ENV is production
+func (c *Config) IsProduction() bool {
+	return c.Environment == "production"
+}
+
+// Validate checks the settings the server cannot run without
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Environment != "development" && c.Environment != "production" {
+		errs = append(errs, fmt.Errorf("APP_ENV must be development or production, not %q", c.Environment))
+	}
+	if u, err := url.Parse(c.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("BASE_URL must be an http(s) URL, not %q", c.BaseURL))
+	}
+	if c.DatabaseURL == "" {
+		errs = append(errs, errors.New("DATABASE_URL is required"))
+	}
+	if port, err := strconv.Atoi(c.ServerPort); err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("SERVER_PORT must be a port number, not %q", c.ServerPort))
+	}
+	if err := (&http.Cookie{Name: c.CookieName}).Valid(); err != nil {
+		errs = append(errs, fmt.Errorf("COOKIE_NAME %q is not a valid cookie name", c.CookieName))
+	}
+	if c.CookieSameSite == http.SameSiteNoneMode && !c.CookieSecure {
+		errs = append(errs, errors.New("COOKIE_SAMESITE=none requires COOKIE_SECURE, browsers reject it otherwise"))
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+	}
+	if c.TLSAutocert && c.TLSCertFile != "" {
+		errs = append(errs, errors.New("TLS_AUTOCERT cannot be combined with TLS_CERT_FILE"))
+	}
+	if c.TLSAutocert && (len(c.AutocertHosts) == 0 || c.AutocertHosts[0] == "localhost") {
+		errs = append(errs, errors.New("TLS_AUTOCERT needs AUTOCERT_HOSTS or a public host name in BASE_URL"))
+	}
+	if c.HTTPRedirectPort != "" {
+		if port, err := strconv.Atoi(c.HTTPRedirectPort); err != nil || port < 1 || port > 65535 {
+			errs = append(errs, fmt.Errorf("HTTP_REDIRECT_PORT must be a port number, not %q", c.HTTPRedirectPort))
+		}
+	}
+	if c.DevMode && c.IsProduction() {
+		errs = append(errs, errors.New("DEV_MODE shows internals in the browser and cannot be used in production"))
+	}
+	if c.DiagnosticsAddr != "" {
+		if _, port, err := net.SplitHostPort(c.DiagnosticsAddr); err != nil || port == "" {
+			errs = append(errs, fmt.Errorf("DIAGNOSTICS_ADDR must be an address such as localhost:6060, not %q", c.DiagnosticsAddr))
+		}
+	}
+	if c.RedisURL != "" && !strings.HasPrefix(c.RedisURL, "redis://") && !strings.HasPrefix(c.RedisURL, "rediss://") {
+		errs = append(errs, fmt.Errorf("REDIS_URL must be a redis:// or rediss:// URL, not %q", c.RedisURL))
+	}
+	if c.CaptchaProvider != "" && c.CaptchaProvider != "hcaptcha" && c.CaptchaProvider != "turnstile" {
+		errs = append(errs, fmt.Errorf("CAPTCHA_PROVIDER must be hcaptcha or turnstile, not %q", c.CaptchaProvider))
+	}
+	if c.CaptchaProvider != "" && (c.CaptchaSiteKey == "" || c.CaptchaSecretKey == "") {
+		errs = append(errs, errors.New("CAPTCHA_PROVIDER needs CAPTCHA_SITE_KEY and CAPTCHA_SECRET_KEY"))
+	}
+	if c.Argon2Memory < 8*c.Argon2Parallelism || c.Argon2Parallelism > 255 {
+		errs = append(errs, errors.New("ARGON2_MEMORY must be at least 8 KiB per thread and ARGON2_PARALLELISM at most 255"))
+	}
+	if c.BackupKeep < 1 {
+		errs = append(errs, errors.New("BACKUP_KEEP must be at least 1"))
+	}
+	if c.BackupS3Bucket != "" && (c.BackupS3AccessKey == "" || c.BackupS3SecretKey == "") {
+		errs = append(errs, errors.New("BACKUP_S3_BUCKET needs BACKUP_S3_ACCESS_KEY and BACKUP_S3_SECRET_KEY"))
+	}
+	if c.CalDAVURL != "" {
+		if u, err := url.Parse(c.CalDAVURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("CALDAV_URL must be an http(s) URL, not %q", c.CalDAVURL))
+		}
+	}
+	if c.CalDAVUsername != "" && c.CalDAVURL == "" {
+		errs = append(errs, errors.New("CALDAV_USERNAME needs CALDAV_URL, the server its credentials are sent to"))
+	}
+	if c.JWTSecret == "" {
+		errs = append(errs, errors.New("JWT_SECRET is required"))
+	}
+	if c.IsProduction() && c.JWTSecret == defaultJWTSecret {
+		errs = append(errs, errors.New("JWT_SECRET is still the insecure default, set a secret of your own in production"))
+	}
+	return errors.Join(errs...)
+}
+
+// source looks settings up in the environment and then in the config file.
+// A setting can also be read from the file named by its _FILE variant, such
+// as JWT_SECRET_FILE, which is how Docker and Kubernetes mount secrets.
+// Invalid values are collected in errs so they can be reported together.
+type source struct {
+	file map[string]string
+	read map[string]bool
+	errs []error
+}
+
+func (s *source) get(key, defaultValue string) string {
+	s.read[key] = true
+	s.read[key+"_FILE"] = true
 	if value := os.Getenv(key); value != "" {
 		return value
 	}
+	if path := s.lookup(key + "_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			s.errs = append(s.errs, fmt.Errorf("%s_FILE: %w", key, err))
+			return defaultValue
+		}
+		return strings.TrimSpace(string(data))
+	}
+	if value := s.file[key]; value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func (s *source) lookup(key string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return s.file[key]
+}
+
+func (s *source) duration(key string, defaultValue time.Duration) time.Duration {
+	value := s.get(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		s.errs = append(s.errs, fmt.Errorf("%s must be a positive duration such as 1h, not %q", key, value))
+		return defaultValue
+	}
+	return d
+}
+
+// optionalDuration is like duration but also accepts 0, for settings where
+// zero turns a feature off
+func (s *source) optionalDuration(key string, defaultValue time.Duration) time.Duration {
+	value := s.get(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		s.errs = append(s.errs, fmt.Errorf("%s must be a duration such as 1h or 0, not %q", key, value))
+		return defaultValue
+	}
+	return d
+}
+
+func (s *source) bool(key string, defaultValue bool) bool {
+	value := s.get(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		s.errs = append(s.errs, fmt.Errorf("%s must be true or false, not %q", key, value))
+		return defaultValue
+	}
+	return b
+}
+
+func (s *source) sameSite(key string, defaultValue http.SameSite) http.SameSite {
+	value := s.get(key, "")
+	switch strings.ToLower(value) {
+	case "":
+		return defaultValue
+	case "strict":
+		return http.SameSiteStrictMode
+	case "lax":
+		return http.SameSiteLaxMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	s.errs = append(s.errs, fmt.Errorf("%s must be strict, lax or none, not %q", key, value))
 	return defaultValue
 }
+
+// networks parses a comma separated list of addresses and CIDR ranges
+func (s *source) networks(key string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, value := range strings.Split(s.get(key, ""), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			s.errs = append(s.errs, fmt.Errorf("%s: %q is not an address or CIDR range", key, value))
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func (s *source) int(key string, defaultValue int) int {
+	value := s.get(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		s.errs = append(s.errs, fmt.Errorf("%s must be a positive number, not %q", key, value))
+		return defaultValue
+	}
+	return n
+}
+
+// optionalInt is like int but also accepts 0, for settings where zero turns
+// a limit off
+func (s *source) optionalInt(key string, defaultValue int) int {
+	value := s.get(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		s.errs = append(s.errs, fmt.Errorf("%s must be a number, 0 or more, not %q", key, value))
+		return defaultValue
+	}
+	return n
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// vaultSecret covers both the database secrets engine, which returns the
+// credentials in data, and the KV version 2 engine, which nests them in
+// data.data
+type vaultSecret struct {
+	Data struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Data     struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"data"`
+	} `json:"data"`
+}
+
+// vaultDatabaseCredentials reads a username and password from the Vault
+// secret at path, for example database/creds/overtime or
+// secret/data/overtime/database
+func vaultDatabaseCredentials(addr, token, path string) (username, password string, err error) {
+	endpoint := strings.TrimRight(addr, "/") + "/v1/" + strings.TrimLeft(path, "/")
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("vault returned %s for %s", resp.Status, path)
+	}
+
+	var secret vaultSecret
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", "", fmt.Errorf("decoding vault secret %s: %w", path, err)
+	}
+
+	username, password = secret.Data.Username, secret.Data.Password
+	if username == "" {
+		username, password = secret.Data.Data.Username, secret.Data.Data.Password
+	}
+	if username == "" {
+		return "", "", fmt.Errorf("vault secret %s has no username", path)
+	}
+	return username, password, nil
+}
+
+// withCredentials replaces the user and password of a postgres:// URL
+func withCredentials(databaseURL, username, password string) (string, error) {
+	u, err := url.Parse(databaseURL)
+	if err != nil || u.Scheme == "" {
+		return "", fmt.Errorf("DATABASE_URL must be a URL to use credentials from Vault")
+	}
+	u.User = url.UserPassword(username, password)
+	return u.String(), nil
+}
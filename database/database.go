@@ -1,48 +1,259 @@
 package database
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"log"
+	"os"
+	"overtime/config"
 	"overtime/models"
+	"overtime/passhash"
 
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
 
-var DB *gorm.DB
-
-func Init(dsn string) error {
-	var err error
-	DB, err = gorm.Open(postgres.Open(dsn), &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Info),
+// Open connects to the database, migrates the schema and seeds the default
+// admin. The connection is passed on to everything that needs it.
+func Open(cfg *config.Config) (*gorm.DB, error) {
+	db, err := gorm.Open(postgres.Open(cfg.DatabaseURL), &gorm.Config{
+		Logger: newLogger(cfg),
 	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
 	}
+	sqlDB.SetMaxOpenConns(cfg.DatabaseMaxOpenConns)
+	sqlDB.SetMaxIdleConns(cfg.DatabaseMaxIdleConns)
+	sqlDB.SetConnMaxLifetime(cfg.DatabaseConnMaxLifetime)
+
+	// Replicas started together migrate and seed one after another
+	if err := withStartupLock(db, func() error { return migrate(db, cfg) }); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// migrate brings the schema up to date and seeds the default admin
+func migrate(db *gorm.DB, cfg *config.Config) error {
+	// Entries from before they named a project were worked on the owner's
+	// home project, and were in the owner's current team as far as is known
+	backfillEntryProjects := !db.Migrator().HasColumn(&models.OvertimeEntry{}, "project_id")
+	backfillEntryNames := !db.Migrator().HasColumn(&models.OvertimeEntry{}, "team_name")
+	// There were no holidays before entries were flagged, only weekends
+	backfillEntryDays := !db.Migrator().HasColumn(&models.OvertimeEntry{}, "day_kind")
 
 	// Auto migrate the schema
-	err = DB.AutoMigrate(&models.Team{}, &models.Project{}, &models.User{}, &models.OvertimeEntry{}, &models.Invite{}, &models.TeamSupervisor{})
+	err := db.AutoMigrate(&models.Organization{}, &models.Team{}, &models.Project{}, &models.CostCenter{}, &models.User{}, &models.Contract{}, &models.OvertimeEntry{}, &models.TimeOffRequest{}, &models.Invite{}, &models.TeamSupervisor{}, &models.ApprovalToken{}, &models.JiraAccount{}, &models.Setting{}, &models.PasswordHistory{}, &models.LoginToken{}, &models.AuditLog{}, &models.Session{}, &models.AnomalyAlert{}, &models.ExportDestination{}, &models.ExportDelivery{}, &models.Avatar{}, &models.InviteTemplate{}, &models.MonthArchive{}, &models.ExportArchive{}, &models.IdempotencyKey{}, &models.JobClaim{}, &models.SecurityAlert{}, &models.LoginAddress{}, &models.ExportLog{}, &models.ProjectMember{}, &models.TeamMembership{}, &models.HRISConnection{}, &models.Holiday{}, &models.BalanceRule{}, &models.Compensation{}, &models.PayoutRequest{})
+	if err != nil {
+		return err
+	}
+
+	// Replaced by idx_overtime_entries_user_date, which also serves lookups by user
+	if db.Migrator().HasIndex(&models.OvertimeEntry{}, "idx_overtime_entries_user_id") {
+		if err := db.Migrator().DropIndex(&models.OvertimeEntry{}, "idx_overtime_entries_user_id"); err != nil {
+			return err
+		}
+	}
+
+	if backfillEntryProjects {
+		err := db.Exec("UPDATE overtime_entries SET project_id = users.project_id FROM users WHERE users.id = overtime_entries.user_id").Error
+		if err != nil {
+			return err
+		}
+	}
+	if backfillEntryNames {
+		if err := migrateEntryNames(db); err != nil {
+			return err
+		}
+	}
+	if backfillEntryDays {
+		err := db.Exec("UPDATE overtime_entries SET day_kind = ? WHERE EXTRACT(ISODOW FROM date) >= 6", models.DayWeekend).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := migrateUserEmails(db); err != nil {
+		return err
+	}
+
+	if err := migrateUsernames(db); err != nil {
+		return err
+	}
+
+	// Group chats could be entered on the profile before chats were linked
+	// with a code sent from them
+	if err := db.Model(&models.User{}).Where("telegram_chat_id < 0").Update("telegram_chat_id", nil).Error; err != nil {
+		return err
+	}
+
+	organization, err := migrateOrganizations(db)
 	if err != nil {
 		return err
 	}
 
 	// Seed default admin if not exists
-	if err := seedDefaultAdmin(); err != nil {
+	return seedDefaultAdmin(db, cfg, organization)
+}
+
+// newLogger logs every query in development. Production only logs errors and
+// queries slower than the configured threshold.
+func newLogger(cfg *config.Config) logger.Interface {
+	level := logger.Info
+	if cfg.IsProduction() {
+		level = logger.Warn
+	}
+	return logger.New(log.New(os.Stdout, "\r\n", log.LstdFlags), logger.Config{
+		SlowThreshold:             cfg.DatabaseSlowQueryThreshold,
+		LogLevel:                  level,
+		IgnoreRecordNotFoundError: true,
+		Colorful:                  !cfg.IsProduction(),
+	})
+}
+
+// migrateOrganizations returns the first organization, creating it on a fresh
+// or single-tenant database. Records from before organizations were introduced
+// belong to it, and its administrators may manage the other organizations.
+func migrateOrganizations(db *gorm.DB) (*models.Organization, error) {
+	// Team and project names used to be unique across the whole instance
+	for _, index := range []struct {
+		model interface{}
+		name  string
+	}{
+		{&models.Team{}, "idx_teams_name"},
+		{&models.Project{}, "idx_projects_name"},
+	} {
+		if db.Migrator().HasIndex(index.model, index.name) {
+			if err := db.Migrator().DropIndex(index.model, index.name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var organization models.Organization
+	if err := db.Order("id asc").Limit(1).Find(&organization).Error; err != nil {
+		return nil, err
+	}
+	if organization.ID != 0 {
+		return &organization, nil
+	}
+
+	organization.Name = "Default"
+	if err := db.Create(&organization).Error; err != nil {
+		return nil, err
+	}
+
+	for _, model := range []interface{}{&models.User{}, &models.Team{}, &models.Project{}, &models.OvertimeEntry{}, &models.TimeOffRequest{}, &models.Invite{}} {
+		err := db.Unscoped().Model(model).
+			Where("organization_id IS NULL OR organization_id = 0").
+			Update("organization_id", organization.ID).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := db.Model(&models.User{}).Where("role = ?", models.RoleAdmin).Update("platform_admin", true).Error; err != nil {
+		return nil, err
+	}
+
+	log.Printf("Organization %q created for existing data", organization.Name)
+	return &organization, nil
+}
+
+// migrateEntryNames records the team and project names on existing entries,
+// from the owner's current team and the entry's project
+func migrateEntryNames(db *gorm.DB) error {
+	err := db.Exec("UPDATE overtime_entries SET team_name = teams.name FROM users JOIN teams ON teams.id = users.team_id WHERE users.id = overtime_entries.user_id").Error
+	if err != nil {
 		return err
 	}
+	return db.Exec("UPDATE overtime_entries SET project_name = projects.name FROM projects WHERE projects.id = overtime_entries.project_id").Error
+}
 
-	return nil
+// migrateUserEmails makes email addresses unique ignoring case, since they log
+// in like usernames. Addresses shared by several accounts from before have to
+// be cleaned up by hand first; they are logged and the index waits until then.
+func migrateUserEmails(db *gorm.DB) error {
+	if db.Migrator().HasIndex(&models.User{}, "idx_users_email_lower") {
+		return nil
+	}
+
+	var duplicates []struct {
+		Email string
+		Count int
+	}
+	err := db.Model(&models.User{}).Select("LOWER(email) AS email, COUNT(*) AS count").
+		Where("email <> ''").Group("LOWER(email)").Having("COUNT(*) > 1").Scan(&duplicates).Error
+	if err != nil {
+		return err
+	}
+	if len(duplicates) > 0 {
+		for _, duplicate := range duplicates {
+			log.Printf("Email address %s is used by %d accounts, none of them can log in with it", duplicate.Email, duplicate.Count)
+		}
+		log.Printf("Email addresses are not unique yet, change them on the users page and restart")
+		return nil
+	}
+
+	return db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_lower ON users (LOWER(email)) WHERE email <> '' AND deleted_at IS NULL").Error
 }
 
-func seedDefaultAdmin() error {
+// migrateUsernames makes usernames unique ignoring case, "Anna" and "anna"
+// could register separately before. Colliding accounts are logged and keep
+// logging in with their exact username until all but one are merged into
+// another account or deleted; the index waits until then.
+func migrateUsernames(db *gorm.DB) error {
+	if db.Migrator().HasIndex(&models.User{}, "idx_users_username_lower") {
+		return nil
+	}
+
+	var collisions []struct {
+		Username  string
+		Usernames string
+	}
+	err := db.Model(&models.User{}).Select("LOWER(username) AS username, STRING_AGG(username, ', ' ORDER BY id) AS usernames").
+		Where("deactivated_at IS NULL").Group("LOWER(username)").Having("COUNT(*) > 1").Scan(&collisions).Error
+	if err != nil {
+		return err
+	}
+	if len(collisions) > 0 {
+		for _, collision := range collisions {
+			log.Printf("Usernames %s differ only in case, none of them can log in ignoring case", collision.Usernames)
+		}
+		log.Printf("Usernames are not unique ignoring case yet, merge or delete the duplicate accounts and restart")
+		return nil
+	}
+
+	return db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username_lower ON users (LOWER(username)) WHERE deleted_at IS NULL AND deactivated_at IS NULL").Error
+}
+
+func seedDefaultAdmin(db *gorm.DB, cfg *config.Config, organization *models.Organization) error {
+	if !cfg.AdminSeed {
+		return nil
+	}
+
 	var count int64
-	DB.Model(&models.User{}).Where("username = ?", "admin").Count(&count)
+	db.Model(&models.User{}).Where("username = ?", "admin").Count(&count)
 	if count > 0 {
 		return nil
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("admin"), bcrypt.DefaultCost)
+	password := cfg.AdminInitialPassword
+	generated := password == ""
+	if generated {
+		var err error
+		if password, err = randomPassword(); err != nil {
+			return err
+		}
+	}
+
+	hashedPassword, err := passhash.Hash(password)
 	if err != nil {
 		return err
 	}
@@ -50,20 +261,32 @@ func seedDefaultAdmin() error {
 	admin := models.User{
 		Username:           "admin",
 		FullName:           "Administrator",
-		PasswordHash:       string(hashedPassword),
+		PasswordHash:       hashedPassword,
 		Role:               models.RoleAdmin,
 		MustChangePassword: true,
+		OrganizationID:     organization.ID,
+		PlatformAdmin:      true,
 	}
 
-	result := DB.Create(&admin)
+	result := db.Create(&admin)
 	if result.Error != nil {
 		return result.Error
 	}
 
-	log.Println("Default admin user created (username: admin, password: admin)")
+	// The generated password is shown this once and never stored in clear
+	if generated {
+		log.Printf("Default admin user created (username: admin, password: %s), change the password at the first login", password)
+	} else {
+		log.Println("Default admin user created (username: admin) with the password from ADMIN_INITIAL_PASSWORD")
+	}
 	return nil
 }
 
-func GetDB() *gorm.DB {
-	return DB
+// randomPassword generates the initial password of the default admin
+func randomPassword() (string, error) {
+	bytes := make([]byte, 18)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
 }
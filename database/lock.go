@@ -0,0 +1,49 @@
+package database
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+
+	"gorm.io/gorm"
+)
+
+// LockKey is the key of the Postgres advisory lock called name. Locks are
+// named so that they cannot clash by accident.
+func LockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("overtime:" + name))
+	return int64(h.Sum64())
+}
+
+// withStartupLock runs fn holding the advisory lock "startup", so that only
+// one replica at a time migrates the schema and seeds data. The lock belongs
+// to a connection of its own, which is why the pool must allow more than one.
+func withStartupLock(db *gorm.DB, fn func() error) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	key := LockKey("startup")
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&locked); err != nil {
+		return err
+	}
+	if !locked {
+		log.Printf("Waiting for another replica to finish migrating the database")
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", key); err != nil {
+			return err
+		}
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", key)
+
+	return fn()
+}
@@ -0,0 +1,228 @@
+// Package delivery sends the organizations' monthly overtime exports to
+// their export destinations, such as payroll's SFTP server, and alerts the
+// admins when a delivery fails.
+package delivery
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"overtime/config"
+	"overtime/mailer"
+	"overtime/models"
+	"overtime/s3"
+	"overtime/scheduler"
+
+	"gorm.io/gorm"
+)
+
+// maxErrorLength is the size of ExportDelivery.Error
+const maxErrorLength = 1000
+
+// Deliverer periodically sends the previous month's export to every enabled
+// destination whose day of the month has come and that did not get it yet.
+// Failed deliveries are retried on every run, the admins are emailed about
+// the first failure of each month.
+type Deliverer struct {
+	db     *gorm.DB
+	config *config.Config
+	mailer *mailer.Mailer
+	// export writes the organization's overtime in the month starting at
+	// month in the export format
+	export func(w io.Writer, organizationID uint, month time.Time, format string) error
+	// archive keeps a copy of a delivered export in the export archive
+	archive func(organizationID uint, month time.Time, filename, format, generator string, data []byte) error
+}
+
+func NewDeliverer(db *gorm.DB, cfg *config.Config, mail *mailer.Mailer, export func(w io.Writer, organizationID uint, month time.Time, format string) error,
+	archive func(organizationID uint, month time.Time, filename, format, generator string, data []byte) error) *Deliverer {
+	return &Deliverer{
+		db:      db,
+		config:  cfg,
+		mailer:  mail,
+		export:  export,
+		archive: archive,
+	}
+}
+
+func (d *Deliverer) Enabled() bool {
+	return d.config.DeliveryInterval > 0
+}
+
+// Run delivers the due exports once immediately and then on every interval,
+// on whichever replica claims the run from lock. It never returns.
+func (d *Deliverer) Run(lock *scheduler.Lock) {
+	ticker := time.NewTicker(d.config.DeliveryInterval)
+	defer ticker.Stop()
+	for {
+		if lock.Claim("delivery", d.config.DeliveryInterval) {
+			if err := d.DeliverDue(); err != nil {
+				log.Printf("Export delivery failed: %v", err)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// DeliverDue sends the previous month's export to the destinations due
+func (d *Deliverer) DeliverDue() error {
+	now := time.Now().UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0)
+
+	var destinations []models.ExportDestination
+	if err := d.db.Where("enabled = ? AND day <= ?", true, now.Day()).Find(&destinations).Error; err != nil {
+		return err
+	}
+
+	for i := range destinations {
+		var attempts []models.ExportDelivery
+		if err := d.db.Where("destination_id = ? AND month = ?", destinations[i].ID, month.Format("2006-01")).Find(&attempts).Error; err != nil {
+			return err
+		}
+		delivered := false
+		for _, attempt := range attempts {
+			delivered = delivered || attempt.Succeeded()
+		}
+		if delivered {
+			continue
+		}
+
+		if delivery := d.Deliver(&destinations[i], month); !delivery.Succeeded() && len(attempts) == 0 {
+			d.alert(&destinations[i], &delivery)
+		}
+	}
+	return nil
+}
+
+// Deliver sends the export of the month starting at month to the destination
+// and logs the attempt
+func (d *Deliverer) Deliver(destination *models.ExportDestination, month time.Time) models.ExportDelivery {
+	delivery := models.ExportDelivery{
+		OrganizationID: destination.OrganizationID,
+		DestinationID:  destination.ID,
+		Month:          month.Format("2006-01"),
+		Filename:       fmt.Sprintf("overtime_%d_%02d.csv", month.Year(), int(month.Month())),
+	}
+
+	var buf bytes.Buffer
+	err := d.export(&buf, destination.OrganizationID, month, destination.Format)
+	if err == nil {
+		err = d.send(destination, delivery.Filename, buf.Bytes())
+	}
+	if err == nil {
+		generator := fmt.Sprintf("delivery to %s", destination.Name)
+		if err := d.archive(destination.OrganizationID, month, delivery.Filename, destination.Format, generator, buf.Bytes()); err != nil {
+			log.Printf("Failed to archive %s delivered to export destination %d: %v", delivery.Filename, destination.ID, err)
+		}
+	}
+	if err != nil {
+		log.Printf("Delivery of %s to export destination %d failed: %v", delivery.Filename, destination.ID, err)
+		delivery.Error = err.Error()
+		for len(delivery.Error) > maxErrorLength {
+			_, size := utf8.DecodeLastRuneInString(delivery.Error)
+			delivery.Error = delivery.Error[:len(delivery.Error)-size]
+		}
+	}
+
+	if err := d.db.Create(&delivery).Error; err != nil {
+		log.Printf("Failed to log delivery to export destination %d: %v", destination.ID, err)
+	}
+	return delivery
+}
+
+func (d *Deliverer) send(destination *models.ExportDestination, filename string, data []byte) error {
+	switch destination.Kind {
+	case models.DestinationSFTP:
+		return sftpSend(destination, filename, data)
+	case models.DestinationS3:
+		return d.s3Send(destination, filename, data)
+	case models.DestinationDir:
+		return d.dirSend(destination, filename, data)
+	default:
+		return fmt.Errorf("unknown destination kind %q", destination.Kind)
+	}
+}
+
+func (d *Deliverer) s3Send(destination *models.ExportDestination, filename string, data []byte) error {
+	region := destination.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := destination.Host
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	client := &s3.Client{
+		Endpoint:  endpoint,
+		Region:    region,
+		Bucket:    destination.Bucket,
+		AccessKey: destination.Username,
+		SecretKey: destination.Password,
+		HTTP:      &http.Client{Timeout: time.Minute},
+	}
+
+	key := filename
+	if prefix := strings.Trim(destination.Path, "/"); prefix != "" {
+		key = prefix + "/" + filename
+	}
+	return client.Put(key, bytes.NewReader(data), int64(len(data)))
+}
+
+// dirSend writes the file into the organization's directory below
+// DeliveryDir, e.g. on a share payroll mounts. Paths cannot leave it.
+func (d *Deliverer) dirSend(destination *models.ExportDestination, filename string, data []byte) error {
+	dir := filepath.Join(d.config.DeliveryDir, strconv.FormatUint(uint64(destination.OrganizationID), 10),
+		filepath.Join("/", destination.Path))
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+
+	// Write under a temporary name so a failed delivery never looks complete
+	path := filepath.Join(dir, filename)
+	if err := os.WriteFile(path+".tmp", data, 0o640); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// alert emails the organization's admins that a delivery failed
+func (d *Deliverer) alert(destination *models.ExportDestination, delivery *models.ExportDelivery) {
+	var admins []models.User
+	d.db.Where("organization_id = ? AND role = ? AND email <> ''", destination.OrganizationID, models.RoleAdmin).Find(&admins)
+	if len(admins) == 0 {
+		return
+	}
+
+	var to []string
+	for _, admin := range admins {
+		to = append(to, admin.Email)
+	}
+
+	body := fmt.Sprintf(`The export %s could not be delivered to %s (%s):
+
+%s
+
+The delivery is retried every %s. Check the destination here: %s/deliveries
+`,
+		delivery.Filename,
+		destination.Name,
+		destination.KindLabel(),
+		delivery.Error,
+		d.config.DeliveryInterval,
+		d.config.BaseURL,
+	)
+
+	if err := d.mailer.Send(to, "Export delivery to "+destination.Name+" failed", body); err != nil {
+		log.Printf("Failed to send delivery alert for export destination %d: %v", destination.ID, err)
+	}
+}
@@ -0,0 +1,251 @@
+package delivery
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"overtime/models"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP version 3 packet types and flags, the subset needed to upload a file
+// (draft-ietf-secsh-filexfer-02)
+const (
+	sftpInit    = 1
+	sftpVersion = 2
+	sftpOpen    = 3
+	sftpClose   = 4
+	sftpWrite   = 6
+	sftpRemove  = 13
+	sftpRename  = 18
+	sftpStatus  = 101
+	sftpHandle  = 102
+
+	sftpFlagWrite    = 0x02
+	sftpFlagCreate   = 0x08
+	sftpFlagTruncate = 0x10
+
+	sftpOK = 0
+
+	// sftpChunk is the most data sent per write, servers must accept 32 KiB
+	sftpChunk = 32 * 1024
+)
+
+// sftpSend uploads data to the destination's server under a temporary name
+// and renames it once complete, so payroll never picks up half a file
+func sftpSend(destination *models.ExportDestination, filename string, data []byte) error {
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(destination.HostKey))
+	if err != nil {
+		return fmt.Errorf("sftp: invalid host key: %w", err)
+	}
+	client, err := ssh.Dial("tcp", destination.Host, &ssh.ClientConfig{
+		User:            destination.Username,
+		Auth:            []ssh.AuthMethod{ssh.Password(destination.Password)},
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return fmt.Errorf("sftp: %w", err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("sftp: %w", err)
+	}
+	defer session.Close()
+	in, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	out, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return fmt.Errorf("sftp: %w", err)
+	}
+
+	conn := &sftpConn{w: in, r: out}
+	if err := conn.init(); err != nil {
+		return err
+	}
+
+	target := path.Join(destination.Path, filename)
+	temporary := target + ".tmp"
+	handle, err := conn.open(temporary)
+	if err != nil {
+		return err
+	}
+	for offset := 0; offset < len(data); offset += sftpChunk {
+		end := min(offset+sftpChunk, len(data))
+		if err := conn.write(handle, uint64(offset), data[offset:end]); err != nil {
+			conn.close(handle)
+			return err
+		}
+	}
+	if err := conn.close(handle); err != nil {
+		return err
+	}
+
+	// Version 3 servers refuse to rename onto an existing file
+	conn.remove(target)
+	return conn.rename(temporary, target)
+}
+
+// sftpConn speaks the SFTP protocol one request at a time
+type sftpConn struct {
+	w  io.Writer
+	r  io.Reader
+	id uint32
+}
+
+// packet builds the payload of a request
+type packet []byte
+
+func (p packet) uint32(v uint32) packet {
+	return binary.BigEndian.AppendUint32(p, v)
+}
+
+func (p packet) uint64(v uint64) packet {
+	return binary.BigEndian.AppendUint64(p, v)
+}
+
+func (p packet) string(s []byte) packet {
+	return append(p.uint32(uint32(len(s))), s...)
+}
+
+func (c *sftpConn) send(kind byte, payload packet) error {
+	header := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	_, err := c.w.Write(append(append(header, kind), payload...))
+	return err
+}
+
+func (c *sftpConn) receive() (kind byte, payload []byte, err error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, fmt.Errorf("sftp: %w", err)
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > 256*1024 {
+		return 0, nil, errors.New("sftp: invalid packet length")
+	}
+	payload = make([]byte, length-1)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, fmt.Errorf("sftp: %w", err)
+	}
+	return header[4], payload, nil
+}
+
+// request sends a request with a new id and returns the response's type and
+// the payload after the id
+func (c *sftpConn) request(kind byte, build func(p packet) packet) (byte, []byte, error) {
+	c.id++
+	if err := c.send(kind, build(packet{}.uint32(c.id))); err != nil {
+		return 0, nil, err
+	}
+	reply, payload, err := c.receive()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(payload) < 4 || binary.BigEndian.Uint32(payload) != c.id {
+		return 0, nil, errors.New("sftp: unexpected response")
+	}
+	return reply, payload[4:], nil
+}
+
+// status turns a status response into an error, nil for success
+func status(reply byte, payload []byte) error {
+	if reply != sftpStatus || len(payload) < 4 {
+		return errors.New("sftp: unexpected response")
+	}
+	code := binary.BigEndian.Uint32(payload)
+	if code == sftpOK {
+		return nil
+	}
+	message := ""
+	if len(payload) >= 8 {
+		if n := binary.BigEndian.Uint32(payload[4:]); int(n) <= len(payload)-8 {
+			message = string(payload[8 : 8+n])
+		}
+	}
+	return fmt.Errorf("sftp: status %d: %s", code, message)
+}
+
+func (c *sftpConn) init() error {
+	if err := c.send(sftpInit, packet{}.uint32(3)); err != nil {
+		return err
+	}
+	reply, _, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if reply != sftpVersion {
+		return errors.New("sftp: unexpected response to init")
+	}
+	return nil
+}
+
+func (c *sftpConn) open(name string) ([]byte, error) {
+	reply, payload, err := c.request(sftpOpen, func(p packet) packet {
+		return p.string([]byte(name)).uint32(sftpFlagWrite | sftpFlagCreate | sftpFlagTruncate).uint32(0)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reply != sftpHandle {
+		return nil, fmt.Errorf("open %s: %w", name, status(reply, payload))
+	}
+	if len(payload) < 4 || int(binary.BigEndian.Uint32(payload)) > len(payload)-4 {
+		return nil, errors.New("sftp: invalid handle")
+	}
+	return payload[4 : 4+binary.BigEndian.Uint32(payload)], nil
+}
+
+func (c *sftpConn) write(handle []byte, offset uint64, data []byte) error {
+	reply, payload, err := c.request(sftpWrite, func(p packet) packet {
+		return p.string(handle).uint64(offset).string(data)
+	})
+	if err != nil {
+		return err
+	}
+	return status(reply, payload)
+}
+
+func (c *sftpConn) close(handle []byte) error {
+	reply, payload, err := c.request(sftpClose, func(p packet) packet {
+		return p.string(handle)
+	})
+	if err != nil {
+		return err
+	}
+	return status(reply, payload)
+}
+
+func (c *sftpConn) remove(name string) error {
+	reply, payload, err := c.request(sftpRemove, func(p packet) packet {
+		return p.string([]byte(name))
+	})
+	if err != nil {
+		return err
+	}
+	return status(reply, payload)
+}
+
+func (c *sftpConn) rename(from, to string) error {
+	reply, payload, err := c.request(sftpRename, func(p packet) packet {
+		return p.string([]byte(from)).string([]byte(to))
+	})
+	if err != nil {
+		return err
+	}
+	if err := status(reply, payload); err != nil {
+		return fmt.Errorf("rename %s: %w", from, err)
+	}
+	return nil
+}
@@ -0,0 +1,347 @@
+package delivery
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"overtime/models"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpServer is an SSH server on a local port with an SFTP version 3
+// subsystem keeping its files in memory. Files below /readonly cannot be
+// opened, and like version 3 servers it refuses to rename onto an existing
+// file.
+type sftpServer struct {
+	listener net.Listener
+	hostKey  ssh.Signer
+
+	mu     sync.Mutex
+	files  map[string][]byte
+	writes []sftpServerWrite
+}
+
+type sftpServerWrite struct {
+	name   string
+	offset uint64
+	size   int
+}
+
+func newSFTPServer(t *testing.T) *sftpServer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := &sftpServer{listener: listener, hostKey: hostKey, files: map[string][]byte{}}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if meta.User() == "payroll" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, io.ErrUnexpectedEOF
+		},
+	}
+	config.AddHostKey(hostKey)
+	go func() {
+		for {
+			nc, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveSSH(nc, config)
+		}
+	}()
+	return s
+}
+
+// destination returns an SFTP destination for the server
+func (s *sftpServer) destination() *models.ExportDestination {
+	return &models.ExportDestination{
+		Kind:     models.DestinationSFTP,
+		Host:     s.listener.Addr().String(),
+		HostKey:  string(ssh.MarshalAuthorizedKey(s.hostKey.PublicKey())),
+		Path:     "/payroll",
+		Username: "payroll",
+		Password: "secret",
+	}
+}
+
+func (s *sftpServer) serveSSH(nc net.Conn, config *ssh.ServerConfig) {
+	defer nc.Close()
+	_, channels, requests, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && bytes.Equal(req.Payload, sftpString("sftp"))
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						s.serveSFTP(channel)
+						channel.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+func sftpString(s string) []byte {
+	return packet{}.string([]byte(s))
+}
+
+// serveSFTP answers requests until the client closes the channel
+func (s *sftpServer) serveSFTP(rw io.ReadWriter) {
+	conn := &sftpConn{w: rw, r: rw}
+	kind, _, err := conn.receive()
+	if err != nil || kind != sftpInit {
+		return
+	}
+	conn.send(sftpVersion, packet{}.uint32(3))
+
+	handles := map[string]string{}
+	buffers := map[string][]byte{}
+	for {
+		kind, payload, err := conn.receive()
+		if err != nil {
+			return
+		}
+		r := &sftpReader{data: payload}
+		id := r.uint32()
+		reply := func(code uint32, message string) {
+			conn.send(sftpStatus, packet{}.uint32(id).uint32(code).string([]byte(message)).string(nil))
+		}
+
+		s.mu.Lock()
+		switch kind {
+		case sftpOpen:
+			name := r.string()
+			if flags := r.uint32(); flags != sftpFlagWrite|sftpFlagCreate|sftpFlagTruncate {
+				reply(4, "unexpected flags")
+			} else if strings.HasPrefix(name, "/readonly/") {
+				reply(3, "Permission denied")
+			} else {
+				handle := string(rune('a' + len(handles)))
+				handles[handle] = name
+				buffers[handle] = nil
+				conn.send(sftpHandle, packet{}.uint32(id).string([]byte(handle)))
+			}
+		case sftpWrite:
+			handle, offset, data := r.string(), r.uint64(), r.string()
+			if uint64(len(buffers[handle])) != offset {
+				reply(4, "write out of order")
+			} else {
+				buffers[handle] = append(buffers[handle], data...)
+				s.writes = append(s.writes, sftpServerWrite{name: handles[handle], offset: offset, size: len(data)})
+				reply(sftpOK, "")
+			}
+		case sftpClose:
+			handle := r.string()
+			s.files[handles[handle]] = buffers[handle]
+			delete(handles, handle)
+			reply(sftpOK, "")
+		case sftpRemove:
+			name := r.string()
+			if _, ok := s.files[name]; ok {
+				delete(s.files, name)
+				reply(sftpOK, "")
+			} else {
+				reply(2, "No such file")
+			}
+		case sftpRename:
+			from, to := r.string(), r.string()
+			if _, ok := s.files[to]; ok {
+				reply(4, "File exists")
+			} else {
+				s.files[to] = s.files[from]
+				delete(s.files, from)
+				reply(sftpOK, "")
+			}
+		default:
+			reply(8, "Operation unsupported")
+		}
+		s.mu.Unlock()
+	}
+}
+
+// sftpReader reads the fields of a request payload
+type sftpReader struct {
+	data []byte
+}
+
+func (r *sftpReader) uint32() uint32 {
+	if len(r.data) < 4 {
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *sftpReader) uint64() uint64 {
+	if len(r.data) < 8 {
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return v
+}
+
+func (r *sftpReader) string() string {
+	n := int(r.uint32())
+	if n > len(r.data) {
+		n = len(r.data)
+	}
+	s := string(r.data[:n])
+	r.data = r.data[n:]
+	return s
+}
+
+func TestSFTPSend(t *testing.T) {
+	s := newSFTPServer(t)
+	s.files["/payroll/overtime-2024-05.csv"] = []byte("last month's attempt")
+
+	data := make([]byte, 2*sftpChunk+1000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	if err := sftpSend(s.destination(), "overtime-2024-05.csv", data); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if got := s.files["/payroll/overtime-2024-05.csv"]; !bytes.Equal(got, data) {
+		t.Errorf("uploaded %d bytes, want the %d bytes sent", len(got), len(data))
+	}
+	if len(s.files) != 1 {
+		t.Errorf("files = %d, want only the export without its temporary file", len(s.files))
+	}
+	want := []sftpServerWrite{
+		{name: "/payroll/overtime-2024-05.csv.tmp", offset: 0, size: sftpChunk},
+		{name: "/payroll/overtime-2024-05.csv.tmp", offset: sftpChunk, size: sftpChunk},
+		{name: "/payroll/overtime-2024-05.csv.tmp", offset: 2 * sftpChunk, size: 1000},
+	}
+	if len(s.writes) != len(want) {
+		t.Fatalf("writes = %v, want %v", s.writes, want)
+	}
+	for i := range want {
+		if s.writes[i] != want[i] {
+			t.Errorf("write %d = %v, want %v", i, s.writes[i], want[i])
+		}
+	}
+}
+
+func TestSFTPSendEmptyFile(t *testing.T) {
+	s := newSFTPServer(t)
+	if err := sftpSend(s.destination(), "empty.csv", nil); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if got, ok := s.files["/payroll/empty.csv"]; !ok || len(got) != 0 {
+		t.Errorf("empty.csv = %q, %v; want an empty file", got, ok)
+	}
+}
+
+func TestSFTPSendErrors(t *testing.T) {
+	s := newSFTPServer(t)
+	other := newSFTPServer(t)
+
+	tests := []struct {
+		name   string
+		modify func(d *models.ExportDestination)
+		want   string
+	}{
+		{name: "status", modify: func(d *models.ExportDestination) { d.Path = "/readonly" }, want: "status 3: Permission denied"},
+		{name: "password", modify: func(d *models.ExportDestination) { d.Password = "wrong" }, want: "unable to authenticate"},
+		{name: "host key", modify: func(d *models.ExportDestination) { d.HostKey = other.destination().HostKey }, want: "host key mismatch"},
+		{name: "invalid host key", modify: func(d *models.ExportDestination) { d.HostKey = "ssh-ed25519 AAAA" }, want: "invalid host key"},
+	}
+	for _, test := range tests {
+		destination := s.destination()
+		test.modify(destination)
+		err := sftpSend(destination, "overtime.csv", []byte("a;b\n"))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error = %v, want one containing %q", test.name, err, test.want)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.files) != 0 {
+		t.Errorf("files = %v after failed uploads", s.files)
+	}
+}
+
+func TestSFTPFraming(t *testing.T) {
+	var sent bytes.Buffer
+	conn := &sftpConn{w: &sent}
+	if err := conn.send(sftpOpen, packet{}.uint32(7).string([]byte("/a")).uint64(1<<40)); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		0, 0, 0, 19, sftpOpen,
+		0, 0, 0, 7,
+		0, 0, 0, 2, '/', 'a',
+		0, 0, 1, 0, 0, 0, 0, 0,
+	}
+	if !bytes.Equal(sent.Bytes(), want) {
+		t.Errorf("packet = % x, want % x", sent.Bytes(), want)
+	}
+
+	tests := []struct {
+		name  string
+		reply []byte
+		want  string
+	}{
+		{name: "ok", reply: []byte{0, 0, 0, 13, sftpStatus, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{name: "status", reply: []byte{0, 0, 0, 17, sftpStatus, 0, 0, 0, 1, 0, 0, 0, 4, 0, 0, 0, 4, 'f', 'u', 'l', 'l'}, want: "sftp: status 4: full"},
+		{name: "message too long", reply: []byte{0, 0, 0, 13, sftpStatus, 0, 0, 0, 1, 0, 0, 0, 4, 0, 0, 0, 9}, want: "sftp: status 4: "},
+		{name: "other id", reply: []byte{0, 0, 0, 13, sftpStatus, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0}, want: "unexpected response"},
+		{name: "other type", reply: []byte{0, 0, 0, 9, sftpHandle, 0, 0, 0, 1, 0, 0, 0, 0}, want: "unexpected response"},
+		{name: "empty packet", reply: []byte{0, 0, 0, 0, 0}, want: "invalid packet length"},
+		{name: "huge packet", reply: []byte{0, 0x10, 0, 0, sftpStatus}, want: "invalid packet length"},
+		{name: "truncated", reply: []byte{0, 0, 0, 13, sftpStatus, 0, 0, 0, 1}, want: "unexpected EOF"},
+	}
+	for _, test := range tests {
+		conn := &sftpConn{w: io.Discard, r: bytes.NewReader(test.reply)}
+		err := conn.remove("/a")
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error = %v, want %q", test.name, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Package digest emails reviewers who prefer it one summary of the entries
+// submitted for their approval, instead of an email per entry.
+package digest
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"overtime/config"
+	"overtime/mailer"
+	"overtime/models"
+	"overtime/scheduler"
+
+	"gorm.io/gorm"
+)
+
+// Sender periodically emails every user with ApprovalDigest the pending
+// entries they may review that were submitted since their last digest
+type Sender struct {
+	db     *gorm.DB
+	config *config.Config
+	mailer *mailer.Mailer
+	// newEntries looks up the pending entries a user may review that were
+	// submitted after since
+	newEntries func(user *models.User, since time.Time) ([]models.OvertimeEntry, error)
+}
+
+func NewSender(db *gorm.DB, cfg *config.Config, mail *mailer.Mailer, newEntries func(user *models.User, since time.Time) ([]models.OvertimeEntry, error)) *Sender {
+	return &Sender{
+		db:         db,
+		config:     cfg,
+		mailer:     mail,
+		newEntries: newEntries,
+	}
+}
+
+func (s *Sender) Enabled() bool {
+	return s.config.DigestInterval > 0
+}
+
+// Run sends the digests once immediately and then on every interval, on
+// whichever replica claims the run from lock. It never returns.
+func (s *Sender) Run(lock *scheduler.Lock) {
+	ticker := time.NewTicker(s.config.DigestInterval)
+	defer ticker.Stop()
+	for {
+		if lock.Claim("digest", s.config.DigestInterval) {
+			if err := s.Send(); err != nil {
+				log.Printf("Approval digest failed: %v", err)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// Send emails the digests that are due
+func (s *Sender) Send() error {
+	var users []models.User
+	err := s.db.Preload("TeamAssignments").Preload("ProjectMemberships").
+		Where("approval_digest = ? AND email <> '' AND deactivated_at IS NULL AND role IN ?", true,
+			[]models.Role{models.RoleSupervisor, models.RoleHR, models.RoleAdmin}).
+		Find(&users).Error
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i := range users {
+		if err := s.sendUser(&users[i], now); err != nil {
+			log.Printf("Approval digest to %s failed: %v", users[i].Email, err)
+		}
+	}
+	return nil
+}
+
+func (s *Sender) sendUser(user *models.User, now time.Time) error {
+	// The first digest covers one interval
+	since := now.Add(-s.config.DigestInterval)
+	if user.DigestSentAt != nil {
+		since = *user.DigestSentAt
+	}
+
+	entries, err := s.newEntries(user, since)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		if err := s.mailer.Send([]string{user.Email}, subject(entries), body(s.config, user, entries)); err != nil {
+			return err
+		}
+	}
+	return s.db.Model(user).UpdateColumn("digest_sent_at", now).Error
+}
+
+func subject(entries []models.OvertimeEntry) string {
+	if len(entries) == 1 {
+		return "1 new overtime entry waits for your approval"
+	}
+	return fmt.Sprintf("%d new overtime entries wait for your approval", len(entries))
+}
+
+func body(cfg *config.Config, user *models.User, entries []models.OvertimeEntry) string {
+	var lines []string
+	var total float64
+	for _, entry := range entries {
+		line := fmt.Sprintf("- %s  %-30s %6.2f h", entry.Date.Format("2006-01-02"), entry.User.DisplayName(), entry.Hours)
+		if entry.Description != "" {
+			line += "  " + entry.Description
+		}
+		if entry.OverSoftLimit() {
+			line += "  [past the soft limit: " + entry.Acknowledgment + "]"
+		}
+		lines = append(lines, line)
+		total += entry.Hours
+	}
+
+	return fmt.Sprintf(`Hello %s,
+
+these overtime entries were submitted for your approval since your last
+digest, %.2f hours in total:
+
+%s
+
+Review them here: %s/approvals
+
+You get this digest instead of an email per entry. Change it on your
+profile: %s/profile
+`,
+		user.DisplayName(),
+		total,
+		strings.Join(lines, "\n"),
+		cfg.BaseURL,
+		cfg.BaseURL,
+	)
+}
@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"overtime/middleware"
+	"overtime/models"
+	"overtime/xlsx"
+
+	"gorm.io/gorm"
+)
+
+// noTeam labels the hours of project members without a team
+const noTeam = "No team"
+
+// allocationRow is the overtime a team spent on the project in one month.
+// Shares are percentages of the month's and of the year's hours.
+type allocationRow struct {
+	Month        time.Time
+	Team         string
+	Hours        float64
+	MonthPercent float64
+	TotalPercent float64
+}
+
+// allocationTeam is the overtime a team spent on the project in the year.
+// Hidden teams have too few employees for the report and show no hours.
+type allocationTeam struct {
+	Team    string
+	Hours   float64
+	Percent float64
+	Hidden  bool
+}
+
+// projectAllocation breaks a project's approved overtime in a year down by
+// team and month
+type projectAllocation struct {
+	Rows  []allocationRow
+	Teams []allocationTeam
+	Total float64
+}
+
+// buildProjectAllocation sums the approved overtime logged on the project in
+// the year per month and team. Teamless members are grouped as noTeam.
+// Teams of fewer than minEmployees employees with overtime in the year are
+// left out of the months and hidden among the teams.
+func buildProjectAllocation(db *gorm.DB, organizationID, projectID uint, year int, loc *time.Location, minEmployees int) projectAllocation {
+	start := time.Date(year, 1, 1, 0, 0, 0, 0, loc)
+
+	var entries []models.OvertimeEntry
+	db.Preload("User.Team").Scopes(inOrganization(organizationID)).
+		Joins("JOIN users ON users.id = overtime_entries.user_id").
+		Where("overtime_entries.project_id = ? AND overtime_entries.status = ?", projectID, models.StatusApproved).
+		Where("overtime_entries.date >= ? AND overtime_entries.date < ?", start, start.AddDate(1, 0, 0)).
+		Find(&entries)
+	applyEntryTeams(db, entries)
+
+	type key struct {
+		month time.Month
+		team  string
+	}
+	hours := make(map[key]float64)
+	monthHours := make(map[time.Month]float64)
+	teamHours := make(map[string]float64)
+	employees := make(map[string]map[uint]bool)
+	var allocation projectAllocation
+	for _, entry := range entries {
+		team := noTeam
+		if entry.TeamName != "" {
+			team = entry.TeamName
+		}
+		hours[key{entry.Date.Month(), team}] += entry.Hours
+		monthHours[entry.Date.Month()] += entry.Hours
+		teamHours[team] += entry.Hours
+		allocation.Total += entry.Hours
+		if employees[team] == nil {
+			employees[team] = make(map[uint]bool)
+		}
+		employees[team][entry.UserID] = true
+	}
+	hidden := func(team string) bool {
+		return len(employees[team]) < minEmployees
+	}
+
+	for k, h := range hours {
+		if hidden(k.team) {
+			continue
+		}
+		allocation.Rows = append(allocation.Rows, allocationRow{
+			Month:        time.Date(year, k.month, 1, 0, 0, 0, 0, loc),
+			Team:         k.team,
+			Hours:        h,
+			MonthPercent: 100 * h / monthHours[k.month],
+			TotalPercent: 100 * h / allocation.Total,
+		})
+	}
+	sort.Slice(allocation.Rows, func(i, j int) bool {
+		a, b := allocation.Rows[i], allocation.Rows[j]
+		if !a.Month.Equal(b.Month) {
+			return a.Month.Before(b.Month)
+		}
+		return teamBefore(a.Team, b.Team)
+	})
+
+	for team, h := range teamHours {
+		if hidden(team) {
+			allocation.Teams = append(allocation.Teams, allocationTeam{Team: team, Hidden: true})
+			continue
+		}
+		allocation.Teams = append(allocation.Teams, allocationTeam{Team: team, Hours: h, Percent: 100 * h / allocation.Total})
+	}
+	sort.Slice(allocation.Teams, func(i, j int) bool {
+		return teamBefore(allocation.Teams[i].Team, allocation.Teams[j].Team)
+	})
+	return allocation
+}
+
+// teamBefore orders teams by name with noTeam last
+func teamBefore(a, b string) bool {
+	if (a == noTeam) != (b == noTeam) {
+		return b == noTeam
+	}
+	return a < b
+}
+
+// allocationParams reads the project and year of the report from the query,
+// defaulting to the first project and the current year. ok is false if the
+// organization has no such project.
+func allocationParams(r *http.Request, user *models.User, projects []models.Project) (project *models.Project, year int, ok bool) {
+	year = user.Now().Year()
+	if y, err := strconv.Atoi(r.URL.Query().Get("year")); err == nil && y >= 2000 && y <= 2100 {
+		year = y
+	}
+
+	if len(projects) == 0 {
+		return nil, year, false
+	}
+	idStr := r.URL.Query().Get("project_id")
+	if idStr == "" {
+		return &projects[0], year, true
+	}
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		return nil, year, false
+	}
+	for i := range projects {
+		if projects[i].ID == uint(id) {
+			return &projects[i], year, true
+		}
+	}
+	return nil, year, false
+}
+
+// ProjectAllocationPage shows how a project's overtime splits across teams
+// and months, for billing clients (admin and HR)
+func (h *OvertimeHandler) ProjectAllocationPage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanViewAllOvertime() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	projects := organizationProjects(db, h.cache, user.OrganizationID)
+	project, year, ok := allocationParams(r, user, projects)
+	if !ok && len(projects) > 0 {
+		redirectWithError(w, r, "/allocation", "Project not found")
+		return
+	}
+
+	minGroup := reportMinGroup(loadAppSettings(db, h.config, user.OrganizationID), user, nil)
+	var allocation projectAllocation
+	var selectedProjectID uint
+	if ok {
+		allocation = buildProjectAllocation(db, user.OrganizationID, project.ID, year, user.Location(), minGroup)
+		selectedProjectID = project.ID
+	}
+
+	currentYear := user.Now().Year()
+	years := make([]int, 5)
+	for i := 0; i < 5; i++ {
+		years[i] = currentYear - i
+	}
+
+	data := map[string]interface{}{
+		"Projects":          projects,
+		"Allocation":        allocation,
+		"SelectedProjectID": selectedProjectID,
+		"SelectedYear":      year,
+		"Years":             years,
+		"MinGroupEmployees": minGroup,
+	}
+	render(w, r, h.templates, "allocation", data)
+}
+
+// ProjectAllocationXLSX exports the report of ProjectAllocationPage as an
+// Excel workbook
+func (h *OvertimeHandler) ProjectAllocationXLSX(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanViewAllOvertime() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	project, year, ok := allocationParams(r, user, organizationProjects(db, h.cache, user.OrganizationID))
+	if !ok {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	}
+	minGroup := reportMinGroup(loadAppSettings(db, h.config, user.OrganizationID), user, nil)
+	allocation := buildProjectAllocation(db, user.OrganizationID, project.ID, year, user.Location(), minGroup)
+
+	filename := fmt.Sprintf("overtime_allocation_%s_%d.xlsx", project.Name, year)
+	w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+
+	if err := writeAllocationXLSX(w, project, year, allocation, minGroup); err != nil {
+		log.Printf("Failed to write allocation of project %d: %v", project.ID, err)
+	}
+}
+
+func writeAllocationXLSX(w io.Writer, project *models.Project, year int, allocation projectAllocation, minEmployees int) error {
+	book, err := xlsx.NewWriter(w, "Allocation")
+	if err != nil {
+		return err
+	}
+	rows := [][]interface{}{
+		{fmt.Sprintf("Overtime allocation of %s in %d", project.Name, year)},
+		nil,
+		{"Month", "Team", "Hours", "Share of month", "Share of project"},
+	}
+	for _, row := range allocation.Rows {
+		rows = append(rows, []interface{}{row.Month.Format("2006-01"), row.Team, row.Hours,
+			xlsx.Percent(row.MonthPercent / 100), xlsx.Percent(row.TotalPercent / 100)})
+	}
+	rows = append(rows, nil, []interface{}{"Team", nil, "Hours", nil, "Share of project"})
+	for _, team := range allocation.Teams {
+		if team.Hidden {
+			rows = append(rows, []interface{}{team.Team, nil, fmt.Sprintf("fewer than %d employees", minEmployees)})
+			continue
+		}
+		rows = append(rows, []interface{}{team.Team, nil, team.Hours, nil, xlsx.Percent(team.Percent / 100)})
+	}
+	rows = append(rows, []interface{}{"Total", nil, allocation.Total})
+
+	for _, row := range rows {
+		if err := book.WriteRow(row...); err != nil {
+			return err
+		}
+	}
+	return book.Close()
+}
@@ -0,0 +1,437 @@
+package handlers
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"overtime/config"
+	"overtime/middleware"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type APIHandler struct {
+	config    *config.Config
+	templates map[string]*template.Template
+}
+
+func NewAPIHandler(cfg *config.Config, templates map[string]*template.Template) *APIHandler {
+	return &APIHandler{
+		config:    cfg,
+		templates: templates,
+	}
+}
+
+// apiOperation describes a JSON endpoint. The OpenAPI document is generated
+// from these definitions and the request and response types the handlers
+// decode and encode, so it cannot drift from the code.
+type apiOperation struct {
+	Method      string
+	Path        string
+	Summary     string
+	Description string
+	Public      bool
+	// Query maps query parameter names to their description
+	Query map[string]string
+	// Idempotent operations accept an Idempotency-Key header
+	Idempotent bool
+	Request    interface{}
+	Response   interface{}
+	// Status is the status of a successful response, 200 when zero
+	Status int
+	// Errors maps status codes to the plain-text errors the endpoint returns
+	Errors map[int]string
+}
+
+// entryFilters are the query parameters the entry lists are filtered by
+var entryFilters = map[string]string{
+	"team_id":    "Only entries of employees in this team",
+	"project_id": "Only entries logged on this project",
+	"month":      "Only entries of this month, 1 to 12, in year or in every year",
+	"year":       "Only entries of this year",
+}
+
+// apiOperations lists every JSON endpoint. Besides the API under /api, some
+// pages answer with JSON when the request has Accept: application/json.
+var apiOperations = []apiOperation{
+	{
+		Method:  http.MethodGet,
+		Path:    "/api/v1/openapi.json",
+		Summary: "This OpenAPI document",
+		Public:  true,
+	},
+	{
+		Method:      http.MethodPost,
+		Path:        "/api/v1/entries",
+		Summary:     "Create an overtime entry",
+		Description: "Creates a pending entry for the authenticated user or, for administrators and supervisors, for an employee they manage. Send an Idempotency-Key to retry safely: a retry with the same key and body within 24 hours returns the original response with Idempotent-Replayed: true instead of creating a duplicate.",
+		Idempotent:  true,
+		Request:     apiEntryRequest{},
+		Response:    apiEntry{},
+		Status:      http.StatusCreated,
+		Errors: map[int]string{
+			http.StatusBadRequest:           "Invalid JSON or Idempotency-Key",
+			http.StatusForbidden:            "The employee is not managed by the user",
+			http.StatusNotFound:             "Employee not found",
+			http.StatusConflict:             "A request with the same Idempotency-Key is still in progress",
+			http.StatusUnsupportedMediaType: "Body is not JSON",
+			http.StatusUnprocessableEntity:  "The entry was refused, e.g. for invalid hours or a closed month, or the Idempotency-Key was used for a different request",
+		},
+	},
+	{
+		Method:      http.MethodPost,
+		Path:        "/api/v1/entries:batchCreate",
+		Summary:     "Create many overtime entries",
+		Description: "Creates up to 100 entries like POST /api/v1/entries, in one transaction: when any entry is refused none is created, and the response is 422 with the same body, the refused entries carrying an error. Accepts an Idempotency-Key.",
+		Idempotent:  true,
+		Request:     batchCreateRequest{},
+		Response:    batchResponse{},
+		Errors: map[int]string{
+			http.StatusBadRequest:           "Invalid JSON, Idempotency-Key or too many entries",
+			http.StatusConflict:             "A request with the same Idempotency-Key is still in progress",
+			http.StatusUnsupportedMediaType: "Body is not JSON",
+		},
+	},
+	{
+		Method:      http.MethodPost,
+		Path:        "/api/v1/entries:batchUpdate",
+		Summary:     "Edit many overtime entries",
+		Description: "Replaces the date, hours, times and description of up to 100 entries like the edit form, in one transaction: when any entry is refused none is changed, and the response is 422 with the same body, the refused entries carrying an error. Edited rejected entries, and entries whose date, hours or times change, are resubmitted for approval. Accepts an Idempotency-Key.",
+		Idempotent:  true,
+		Request:     batchUpdateRequest{},
+		Response:    batchResponse{},
+		Errors: map[int]string{
+			http.StatusBadRequest:           "Invalid JSON, Idempotency-Key or too many entries",
+			http.StatusConflict:             "A request with the same Idempotency-Key is still in progress",
+			http.StatusUnsupportedMediaType: "Body is not JSON",
+		},
+	},
+	{
+		Method:      http.MethodPost,
+		Path:        "/api/v1/entries:batchDelete",
+		Summary:     "Delete many overtime entries",
+		Description: "Deletes up to 100 entries in one transaction: when any entry is refused none is deleted, and the response is 422 with the same body, the refused entries carrying an error. Accepts an Idempotency-Key.",
+		Idempotent:  true,
+		Request:     batchDeleteRequest{},
+		Response:    batchResponse{},
+		Errors: map[int]string{
+			http.StatusBadRequest:           "Invalid JSON, Idempotency-Key or too many entries",
+			http.StatusConflict:             "A request with the same Idempotency-Key is still in progress",
+			http.StatusUnsupportedMediaType: "Body is not JSON",
+		},
+	},
+	{
+		Method:      http.MethodPost,
+		Path:        "/api/v1/entries/sync",
+		Summary:     "Store overtime entries recorded offline",
+		Description: "Creates pending entries for the authenticated user. Entries are matched by client_id, so resending an entry returns the ID it was stored under instead of creating a duplicate.",
+		Request:     syncRequest{},
+		Response:    syncResponse{},
+		Errors: map[int]string{
+			http.StatusBadRequest:           "Invalid JSON or too many entries",
+			http.StatusUnsupportedMediaType: "Body is not JSON",
+		},
+	},
+	{
+		Method:      http.MethodGet,
+		Path:        "/dashboard",
+		Summary:     "List recent overtime entries",
+		Description: "Lists the latest 100 entries matching the filters, of the current user or of the whole organization for administrators and HR. Send Accept: application/json, the same URL shows the dashboard page otherwise.",
+		Query:       entryFilters,
+		Response:    entryListResponse{},
+	},
+	{
+		Method:      http.MethodGet,
+		Path:        "/overtime/all",
+		Summary:     "List all overtime entries of the organization",
+		Description: "Lists every entry matching the filters with the hours per employee. Send Accept: application/json.",
+		Query:       entryFilters,
+		Response:    allEntriesResponse{},
+		Errors: map[int]string{
+			http.StatusForbidden: "Only administrators and HR can list all entries",
+		},
+	},
+	{
+		Method:      http.MethodGet,
+		Path:        "/overtime/edit",
+		Summary:     "Get an overtime entry",
+		Description: "Returns an entry the current user may manage. Send Accept: application/json.",
+		Query:       map[string]string{"id": "ID of the entry"},
+		Response:    apiEntry{},
+		Errors: map[int]string{
+			http.StatusBadRequest: "Invalid entry ID",
+			http.StatusForbidden:  "The entry belongs to someone the user may not manage",
+			http.StatusNotFound:   "Entry not found",
+		},
+	},
+	{
+		Method:      http.MethodGet,
+		Path:        "/users",
+		Summary:     "List the users of the organization",
+		Description: "Send Accept: application/json.",
+		Query: map[string]string{
+			"team":    "Only users in the team with this ID",
+			"project": "Only users working on the project with this ID, as their home project or as members",
+		},
+		Response: userListResponse{},
+		Errors: map[int]string{
+			http.StatusForbidden: "Only administrators can list users",
+		},
+	},
+	{
+		Method:      http.MethodGet,
+		Path:        "/users/pending",
+		Summary:     "List the accounts from open signup waiting to be activated",
+		Description: "Send Accept: application/json.",
+		Response:    userListResponse{},
+		Errors: map[int]string{
+			http.StatusForbidden: "Only administrators can list users",
+		},
+	},
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// OpenAPISpec serves the OpenAPI 3 document for the JSON API
+func (h *APIHandler) OpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, openAPIDocument(baseURL(h.config, r), h.config.CookieName))
+}
+
+// DocsPage shows the API reference in Swagger UI
+func (h *APIHandler) DocsPage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	data := map[string]interface{}{
+		"SpecURL": "/api/v1/openapi.json",
+	}
+	render(w, r, h.templates, "api-docs", data)
+}
+
+func openAPIDocument(baseURL, cookieName string) map[string]interface{} {
+	paths := make(map[string]interface{})
+	for _, op := range apiOperations {
+		operation := map[string]interface{}{
+			"summary":     op.Summary,
+			"operationId": operationID(op),
+			"responses":   operationResponses(op),
+		}
+		if op.Description != "" {
+			operation["description"] = op.Description
+		}
+		if op.Public {
+			operation["security"] = []interface{}{}
+		}
+		parameters := queryParameters(op.Query)
+		if op.Idempotent {
+			parameters = append(parameters, map[string]interface{}{
+				"name":        "Idempotency-Key",
+				"in":          "header",
+				"description": "Unique key of the request, e.g. a UUID; retries with the same key replay the original response",
+				"schema":      map[string]interface{}{"type": "string", "maxLength": 255},
+			})
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		if op.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": jsonSchema(reflect.TypeOf(op.Request)),
+					},
+				},
+			}
+		}
+
+		item, ok := paths[op.Path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "overtime API",
+			"version": "1.0.0",
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": baseURL},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{
+					"type":         "http",
+					"scheme":       "bearer",
+					"bearerFormat": "JWT",
+				},
+				"cookieAuth": map[string]interface{}{
+					"type": "apiKey",
+					"in":   "cookie",
+					"name": cookieName,
+				},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"bearerAuth": []string{}},
+			map[string]interface{}{"cookieAuth": []string{}},
+		},
+	}
+}
+
+// operationID derives a stable identifier such as postEntriesSync from the path
+func operationID(op apiOperation) string {
+	id := strings.ToLower(op.Method)
+	for _, part := range strings.FieldsFunc(op.Path, func(r rune) bool {
+		return r == '/' || r == '.' || r == '_' || r == '-' || r == ':'
+	}) {
+		if part == "api" || part == "v1" {
+			continue
+		}
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+// queryParameters documents optional string query parameters, sorted by name
+func queryParameters(query map[string]string) []interface{} {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parameters := make([]interface{}, len(names))
+	for i, name := range names {
+		parameters[i] = map[string]interface{}{
+			"name":        name,
+			"in":          "query",
+			"description": query[name],
+			"schema":      map[string]interface{}{"type": "string"},
+		}
+	}
+	return parameters
+}
+
+func operationResponses(op apiOperation) map[string]interface{} {
+	ok := map[string]interface{}{"description": "OK"}
+	if op.Response != nil {
+		ok["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": jsonSchema(reflect.TypeOf(op.Response)),
+			},
+		}
+	} else {
+		ok["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": map[string]interface{}{"type": "object"},
+			},
+		}
+	}
+
+	status := http.StatusOK
+	if op.Status != 0 {
+		status = op.Status
+	}
+	ok["description"] = http.StatusText(status)
+	responses := map[string]interface{}{strconv.Itoa(status): ok}
+	if !op.Public {
+		responses["303"] = map[string]interface{}{"description": "Not authenticated, redirects to the login page"}
+		responses["429"] = map[string]interface{}{"description": "Too many requests with this session, retry after the seconds in Retry-After. Every response to an authenticated request carries X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset."}
+	}
+
+	codes := make([]int, 0, len(op.Errors))
+	for code := range op.Errors {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		responses[strconv.Itoa(code)] = map[string]interface{}{
+			"description": op.Errors[code],
+			"content": map[string]interface{}{
+				"text/plain": map[string]interface{}{
+					"schema": map[string]interface{}{"type": "string"},
+				},
+			},
+		}
+	}
+	return responses
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonSchema describes how encoding/json renders values of type t. Struct
+// fields are documented with their doc tag.
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := jsonSchema(t.Elem())
+		schema["nullable"] = true
+		return schema
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+
+			schema := jsonSchema(field.Type)
+			if doc := field.Tag.Get("doc"); doc != "" {
+				schema["description"] = doc
+			}
+			properties[name] = schema
+			if !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Ptr {
+				required = append(required, name)
+			}
+		}
+
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]interface{}{}
+}
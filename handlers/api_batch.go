@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"overtime/middleware"
+	"overtime/models"
+	"overtime/store"
+)
+
+// maxBatchEntries limits how many entries one batch request may carry
+const maxBatchEntries = 100
+
+// apiEntryUpdate replaces the date, hours, times and description of an entry,
+// like the edit form
+type apiEntryUpdate struct {
+	ID             uint     `json:"id" doc:"ID of the entry"`
+	Date           string   `json:"date" doc:"Day the overtime was worked, as YYYY-MM-DD in the employee's timezone"`
+	Hours          float64  `json:"hours,omitempty" doc:"Overtime hours, more than 0 and at most 24. Ignored when worked_hours is set."`
+	Description    string   `json:"description"`
+	WorkedHours    *float64 `json:"worked_hours,omitempty" doc:"Hours worked that day; the overtime is what exceeds a regular day of the employee's contract"`
+	StartTime      *string  `json:"start_time,omitempty" doc:"When the overtime started, as HH:MM; requires end_time"`
+	EndTime        *string  `json:"end_time,omitempty" doc:"When the overtime ended, as HH:MM; at or before the start means the next day"`
+	Acknowledgment string   `json:"acknowledgment,omitempty" doc:"Note on an entry past the soft limit per month, like who agreed to the hours; required past the limit"`
+}
+
+type batchCreateRequest struct {
+	Entries []apiEntryRequest `json:"entries"`
+}
+
+type batchUpdateRequest struct {
+	Entries []apiEntryUpdate `json:"entries"`
+}
+
+type batchDeleteRequest struct {
+	IDs []uint `json:"ids" doc:"IDs of the entries to delete"`
+}
+
+// batchResult tells what happened to one item of a batch
+type batchResult struct {
+	ID    uint      `json:"id,omitempty" doc:"ID of the updated or deleted entry"`
+	Entry *apiEntry `json:"entry,omitempty" doc:"The entry as stored, left out when the batch was refused"`
+	Error string    `json:"error,omitempty" doc:"Why the item was refused"`
+}
+
+type batchResponse struct {
+	Results []batchResult `json:"results" doc:"One result per submitted item, in request order"`
+}
+
+// errBatchRefused rolls a batch back when any of its items was refused
+var errBatchRefused = errors.New("batch refused")
+
+// itemError is the message for an item refused with err, and whether err is
+// an item's fault rather than the database's
+func itemError(err error) (string, bool) {
+	var entryErr models.EntryError
+	switch {
+	case errors.As(err, &entryErr):
+		return entryErr.Error(), true
+	case errors.Is(err, errForbidden), errors.Is(err, errEmployeeNotFound), errors.Is(err, errEntryNotFound):
+		return err.Error(), true
+	}
+	return "", false
+}
+
+// runBatch applies every item of a batch with apply in one transaction. The
+// items are all applied or, when any of them is refused, none: the batch is
+// answered with 422 and the errors of the refused items. after runs once the
+// transaction is committed.
+func (h *OvertimeHandler) runBatch(w http.ResponseWriter, r *http.Request, count int, apply func(tx store.Store, i int) (batchResult, error), after func()) {
+	if count > maxBatchEntries {
+		http.Error(w, "Too many entries, at most "+strconv.Itoa(maxBatchEntries)+" per request", http.StatusBadRequest)
+		return
+	}
+
+	results := make([]batchResult, count)
+	err := h.store.Transaction(r.Context(), func(tx store.Store) error {
+		refused := false
+		for i := range results {
+			result, err := apply(tx, i)
+			if err != nil {
+				message, ok := itemError(err)
+				if !ok {
+					return err
+				}
+				result.Error = message
+				refused = true
+			}
+			results[i] = result
+		}
+		if refused {
+			return errBatchRefused
+		}
+		return nil
+	})
+
+	switch {
+	case errors.Is(err, errBatchRefused):
+		// Nothing was stored
+		for i := range results {
+			results[i].Entry = nil
+		}
+		writeJSON(w, http.StatusUnprocessableEntity, batchResponse{Results: results})
+	case err != nil:
+		http.Error(w, "Failed to store the entries", http.StatusInternalServerError)
+	default:
+		after()
+		writeJSON(w, http.StatusOK, batchResponse{Results: results})
+	}
+}
+
+// BatchCreateEntries records many entries at once, e.g. from an importer or
+// the weekly grid
+func (h *OvertimeHandler) BatchCreateEntries(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+
+	var request batchCreateRequest
+	if !decodeJSON(w, r, &request) {
+		return
+	}
+
+	ctx := r.Context()
+	entries := make([]*models.OvertimeEntry, len(request.Entries))
+	h.runBatch(w, r, len(request.Entries), func(tx store.Store, i int) (batchResult, error) {
+		entry, err := newRequestedEntry(ctx, tx, user, request.Entries[i])
+		if err != nil {
+			return batchResult{}, err
+		}
+		if err := storeEntry(ctx, tx, h.config, entry, false); err != nil {
+			return batchResult{}, err
+		}
+		entries[i] = entry
+		created := newAPIEntry(user, entry)
+		return batchResult{Entry: &created}, nil
+	}, func() {
+		for _, entry := range entries {
+			go RequestApproval(h.store, h.config, h.mailer, *entry)
+		}
+	})
+}
+
+// BatchUpdateEntries edits many entries at once. Edited rejected entries and
+// changed figures are resubmitted and HR corrections audited, like on the
+// edit form.
+func (h *OvertimeHandler) BatchUpdateEntries(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+
+	var request batchUpdateRequest
+	if !decodeJSON(w, r, &request) {
+		return
+	}
+
+	ctx := r.Context()
+	entries := make([]*models.OvertimeEntry, len(request.Entries))
+	resubmitted := make([]bool, len(request.Entries))
+	h.runBatch(w, r, len(request.Entries), func(tx store.Store, i int) (batchResult, error) {
+		item := request.Entries[i]
+		result := batchResult{ID: item.ID}
+
+		entry, err := loadBatchEntry(ctx, tx, user, item.ID)
+		if err != nil {
+			return result, err
+		}
+		if !canEditEntry(ctx, tx, h.config, user, entry) {
+			return result, errForbidden
+		}
+
+		date, err := time.ParseInLocation("2006-01-02", item.Date, entry.User.Location())
+		if err != nil {
+			return result, models.ErrInvalidDate
+		}
+		before := *entry
+		edited := *entry
+		edited.Date = date
+		edited.Hours = item.Hours
+		edited.Description = item.Description
+		edited.WorkedHours = item.WorkedHours
+		edited.StartTime = item.StartTime
+		edited.EndTime = item.EndTime
+		edited.Acknowledgment = strings.TrimSpace(item.Acknowledgment)
+		if err := applyEntryEdit(ctx, tx, h.config, user, entry, &edited, false); err != nil {
+			return result, err
+		}
+
+		if resubmitted[i], err = storeEditedEntry(ctx, tx, r, entry, &before, user); err != nil {
+			return result, err
+		}
+		entries[i] = entry
+		updated := newAPIEntry(user, entry)
+		result.Entry = &updated
+		return result, nil
+	}, func() {
+		for i, entry := range entries {
+			if resubmitted[i] {
+				go RequestApproval(h.store, h.config, h.mailer, *entry)
+			}
+			go h.calendar.Sync(entry.ID)
+		}
+	})
+}
+
+// BatchDeleteEntries deletes many entries at once
+func (h *OvertimeHandler) BatchDeleteEntries(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+
+	var request batchDeleteRequest
+	if !decodeJSON(w, r, &request) {
+		return
+	}
+
+	ctx := r.Context()
+	h.runBatch(w, r, len(request.IDs), func(tx store.Store, i int) (batchResult, error) {
+		result := batchResult{ID: request.IDs[i]}
+
+		entry, err := loadBatchEntry(ctx, tx, user, request.IDs[i])
+		if err != nil {
+			return result, err
+		}
+		if !user.CanManageEntry(entry) {
+			return result, errForbidden
+		}
+		if !user.IsAdmin() {
+			if err := checkMonthOpen(ctx, tx, h.config, user.OrganizationID, entry.Date); err != nil {
+				return result, err
+			}
+		}
+		return result, tx.DeleteEntry(ctx, entry)
+	}, func() {
+		for _, id := range request.IDs {
+			go h.calendar.Sync(id)
+		}
+	})
+}
+
+// loadBatchEntry loads an entry of the user's organization for a batch
+func loadBatchEntry(ctx context.Context, tx store.Store, user *models.User, id uint) (*models.OvertimeEntry, error) {
+	entry, err := tx.Entry(ctx, user.OrganizationID, id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, errEntryNotFound
+	}
+	return entry, err
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"overtime/middleware"
+	"overtime/models"
+	"overtime/store"
+)
+
+// apiEntryRequest is an overtime entry submitted through the API
+type apiEntryRequest struct {
+	UserID      uint    `json:"user_id,omitempty" doc:"Employee to record the entry for, for administrators and supervisors; the current user when left out"`
+	Date        string  `json:"date" doc:"Day the overtime was worked, as YYYY-MM-DD in the employee's timezone"`
+	Hours       float64 `json:"hours,omitempty" doc:"Overtime hours, more than 0 and at most 24. Ignored when worked_hours is set."`
+	Description string  `json:"description"`
+	// WorkedHours is for organizations that calculate overtime from worked
+	// time
+	WorkedHours    *float64 `json:"worked_hours,omitempty" doc:"Hours worked that day; the overtime is what exceeds a regular day of the employee's contract"`
+	StartTime      *string  `json:"start_time,omitempty" doc:"When the overtime started, as HH:MM; requires end_time"`
+	EndTime        *string  `json:"end_time,omitempty" doc:"When the overtime ended, as HH:MM; at or before the start means the next day"`
+	ProjectID      uint     `json:"project_id,omitempty" doc:"Project the overtime was worked on, one the employee is assigned to; their home project when left out"`
+	Acknowledgment string   `json:"acknowledgment,omitempty" doc:"Note on an entry past the soft limit per month, like who agreed to the hours; required past the limit"`
+}
+
+// Errors for entries or employees out of the user's reach
+var (
+	errForbidden        = errors.New("Forbidden")
+	errEmployeeNotFound = errors.New("Employee not found")
+	errEntryNotFound    = errors.New("Entry not found")
+)
+
+// decodeJSON reads the JSON body of an API request into v. It answers the
+// request and returns false when the body is not JSON.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	// Requiring JSON keeps plain cross-site form posts out
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		http.Error(w, "Expected JSON", http.StatusUnsupportedMediaType)
+		return false
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// newRequestedEntry builds the entry item asks user to create, for user or,
+// for administrators and supervisors, for another employee. It returns
+// errEmployeeNotFound or errForbidden when the employee is out of reach and
+// models.ErrNotOnProject when they do not work on the picked project.
+func newRequestedEntry(ctx context.Context, s store.Store, user *models.User, item apiEntryRequest) (*models.OvertimeEntry, error) {
+	target := user
+	if item.UserID != 0 && item.UserID != user.ID {
+		if !user.IsAdmin() && !user.IsSupervisor() {
+			return nil, errForbidden
+		}
+		other, err := s.User(ctx, user.OrganizationID, item.UserID)
+		if err != nil {
+			return nil, errEmployeeNotFound
+		}
+		target = other
+	}
+
+	projectID, ok := entryProject(ctx, s, target, item.ProjectID)
+	if !ok {
+		return nil, models.ErrNotOnProject
+	}
+
+	date, err := time.ParseInLocation("2006-01-02", item.Date, target.Location())
+	if err != nil {
+		return nil, models.ErrInvalidDate
+	}
+
+	entry := &models.OvertimeEntry{
+		UserID:         target.ID,
+		User:           *target,
+		ProjectID:      projectID,
+		Date:           date,
+		Hours:          item.Hours,
+		Description:    item.Description,
+		CreatedBy:      &user.ID,
+		UpdatedBy:      &user.ID,
+		WorkedHours:    item.WorkedHours,
+		StartTime:      item.StartTime,
+		EndTime:        item.EndTime,
+		Acknowledgment: strings.TrimSpace(item.Acknowledgment),
+	}
+	if !user.CanManageEntry(entry) {
+		return nil, errForbidden
+	}
+	return entry, nil
+}
+
+// CreateAPIEntry records one overtime entry sent as JSON. Clients on flaky
+// networks should send an Idempotency-Key, see middleware.Idempotent.
+func (h *OvertimeHandler) CreateAPIEntry(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+
+	var item apiEntryRequest
+	if !decodeJSON(w, r, &item) {
+		return
+	}
+
+	entry, err := newRequestedEntry(r.Context(), h.store, user, item)
+	switch {
+	case errors.Is(err, errForbidden):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	case errors.Is(err, errEmployeeNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, entryErrorMessage(err, "Invalid entry"), http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := recordEntry(r.Context(), h.store, h.config, h.mailer, entry, false); err != nil {
+		var entryErr models.EntryError
+		if errors.As(err, &entryErr) {
+			http.Error(w, entryErr.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		http.Error(w, "Failed to create entry", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newAPIEntry(user, entry))
+}
@@ -0,0 +1,674 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"overtime/cache"
+	"overtime/caldav"
+	"overtime/config"
+	"overtime/mailer"
+	"overtime/middleware"
+	"overtime/models"
+	"overtime/services"
+	"overtime/store"
+
+	"gorm.io/gorm"
+)
+
+var errEntryNotPending = errors.New("entry is no longer pending")
+
+type ApprovalHandler struct {
+	db        *gorm.DB
+	store     store.Store
+	config    *config.Config
+	templates map[string]*template.Template
+	mailer    *mailer.Mailer
+	calendar  *caldav.Publisher
+	cache     cache.Cache
+}
+
+func NewApprovalHandler(db *gorm.DB, s store.Store, cfg *config.Config, templates map[string]*template.Template, mail *mailer.Mailer, calendar *caldav.Publisher, c cache.Cache) *ApprovalHandler {
+	return &ApprovalHandler{
+		db:        db,
+		store:     s,
+		config:    cfg,
+		templates: templates,
+		mailer:    mail,
+		calendar:  calendar,
+		cache:     c,
+	}
+}
+
+// approversFor returns the users who review the entry at its current stage.
+// The supervisor stage goes to the supervisors assigned to the owner's team
+// within their project, the HR stage to HR; administrators step in when
+// nobody fills the stage. entry.User must be set.
+func approversFor(ctx context.Context, s store.Store, entry *models.OvertimeEntry) ([]models.User, error) {
+	owner := &entry.User
+	notOwner := func(user models.User) bool { return user.ID == owner.ID }
+
+	var approvers []models.User
+	var err error
+	if entry.Stage == models.StageHR {
+		approvers, err = s.UsersWithRole(ctx, owner.OrganizationID, models.RoleHR)
+	} else if owner.TeamID != nil && entry.ProjectID != nil {
+		approvers, err = s.TeamSupervisors(ctx, owner.OrganizationID, *owner.TeamID, *entry.ProjectID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	approvers = slices.DeleteFunc(approvers, notOwner)
+
+	if len(approvers) == 0 {
+		if approvers, err = s.UsersWithRole(ctx, owner.OrganizationID, models.RoleAdmin); err != nil {
+			return nil, err
+		}
+		approvers = slices.DeleteFunc(approvers, notOwner)
+	}
+
+	return approvers, nil
+}
+
+// RequestApproval emails every approver of the entry's current stage a signed,
+// expiring link to approve or reject it without logging in. entry.User must be set.
+func RequestApproval(s store.Store, cfg *config.Config, mail *mailer.Mailer, entry models.OvertimeEntry) {
+	// Runs in the background, past the end of the request that started it
+	ctx := context.Background()
+
+	approvers, err := approversFor(ctx, s, &entry)
+	if err != nil {
+		log.Printf("Failed to load approvers for entry %d: %v", entry.ID, err)
+		return
+	}
+	for _, approver := range approvers {
+		// Reviewers with a digest hear about the entry with the next one
+		if approver.Email == "" || (approver.ApprovalDigest && cfg.DigestInterval > 0) {
+			continue
+		}
+
+		code, err := models.GenerateApprovalCode()
+		if err != nil {
+			log.Printf("Failed to generate approval code for entry %d: %v", entry.ID, err)
+			return
+		}
+
+		record := models.ApprovalToken{
+			Code:       code,
+			EntryID:    entry.ID,
+			ApproverID: approver.ID,
+			ExpiresAt:  time.Now().Add(cfg.ApprovalLinkExpiration),
+		}
+		if err := s.CreateApprovalToken(ctx, &record); err != nil {
+			log.Printf("Failed to store approval token for entry %d: %v", entry.ID, err)
+			continue
+		}
+
+		token, err := middleware.GenerateApprovalToken(code, entry.ID, approver.ID, cfg.ApprovalLinkExpiration)
+		if err != nil {
+			log.Printf("Failed to sign approval token for entry %d: %v", entry.ID, err)
+			continue
+		}
+
+		link := cfg.BaseURL + "/approvals/email?token=" + url.QueryEscape(token)
+		subject := fmt.Sprintf("Overtime approval: %s, %s", entry.User.DisplayName(), entry.Date.Format("2006-01-02"))
+		intro := fmt.Sprintf("%s submitted an overtime entry for your approval.", entry.User.DisplayName())
+		if entry.Stage == models.StageHR {
+			intro = fmt.Sprintf("An overtime entry by %s was approved by their supervisor and awaits final HR approval.", entry.User.DisplayName())
+		}
+		if entry.OverSoftLimit() {
+			intro += fmt.Sprintf("\n\nThe entry goes past the monthly soft limit, acknowledged with: %s", entry.Acknowledgment)
+		}
+		body := fmt.Sprintf(`%s
+
+Date:        %s
+Hours:       %.2f
+Description: %s
+
+Approve: %s&action=approve
+Reject:  %s&action=reject
+
+These links expire on %s and stop working once a decision has been recorded.
+`,
+			intro,
+			entry.Date.Format("2006-01-02"),
+			entry.Hours,
+			entry.Description,
+			link,
+			link,
+			record.ExpiresAt.Format("2006-01-02 15:04"),
+		)
+
+		if err := mail.Send([]string{approver.Email}, subject, body); err != nil {
+			log.Printf("Failed to email approval request for entry %d to %s: %v", entry.ID, approver.Email, err)
+		}
+	}
+}
+
+// notifyRejection tells the entry's owner why it was rejected and how to resubmit it.
+// entry.User must be set.
+func notifyRejection(cfg *config.Config, mail *mailer.Mailer, entry models.OvertimeEntry, reviewer *models.User) {
+	if entry.User.Email == "" {
+		return
+	}
+
+	subject := fmt.Sprintf("Overtime entry rejected: %s", entry.Date.Format("2006-01-02"))
+	body := fmt.Sprintf(`Your overtime entry was rejected by %s.
+
+Date:        %s
+Hours:       %.2f
+Description: %s
+Reason:      %s
+
+You can correct and resubmit the entry here: %s/overtime/edit?id=%d
+`,
+		reviewer.DisplayName(),
+		entry.Date.Format("2006-01-02"),
+		entry.Hours,
+		entry.Description,
+		entry.ReviewComment,
+		cfg.BaseURL,
+		entry.ID,
+	)
+
+	if err := mail.Send([]string{entry.User.Email}, subject, body); err != nil {
+		log.Printf("Failed to email rejection of entry %d to %s: %v", entry.ID, entry.User.Email, err)
+	}
+}
+
+// reviewableEntries scopes a query to the pending entries the reviewer may
+// decide on at their current approval stage
+func reviewableEntries(db *gorm.DB, reviewer *models.User) *gorm.DB {
+	query := db.Model(&models.OvertimeEntry{}).
+		Joins("JOIN users ON users.id = overtime_entries.user_id").
+		Scopes(inOrganization(reviewer.OrganizationID)).
+		Where("overtime_entries.status = ?", models.StatusPending)
+
+	switch {
+	case reviewer.IsAdmin():
+		return query
+	case reviewer.IsHR():
+		return query.Where("overtime_entries.stage = ? AND users.id <> ?", models.StageHR, reviewer.ID)
+	case reviewer.IsSupervisor() && len(reviewer.ProjectIDs()) > 0:
+		return query.Where("overtime_entries.stage = ? AND overtime_entries.project_id IN ? AND users.id <> ?",
+			models.StageSupervisor, reviewer.ProjectIDs(), reviewer.ID).
+			Scopes(inEntryTeams(reviewer.SupervisedTeamIDs()...))
+	default:
+		return query.Where("1 = 0")
+	}
+}
+
+// reviewEntry records a decision on a pending entry at its current approval stage.
+// Approving the supervisor stage of an entry whose team requires HR approval
+// advances it to the HR stage instead; advanced reports this so the caller can
+// notify HR once the transaction commits. Outstanding approval links for the
+// entry are invalidated either way.
+func reviewEntry(tx *gorm.DB, entry *models.OvertimeEntry, reviewer *models.User, status models.EntryStatus, comment string) (advanced bool, err error) {
+	if err := tx.Preload("User").Preload("User.Team").First(entry, entry.ID).Error; err != nil {
+		return false, err
+	}
+	if !entry.IsPending() {
+		return false, errEntryNotPending
+	}
+	// The approval chain is that of the team the user was in then
+	entries := []models.OvertimeEntry{*entry}
+	applyEntryTeams(tx, entries)
+	entry.User = entries[0].User
+
+	now := time.Now()
+	stage := entry.Stage
+	advanced = status == models.StatusApproved && stage != models.StageHR &&
+		entry.User.Team != nil && entry.User.Team.RequireHRApproval
+
+	updates := map[string]interface{}{
+		"status":         status,
+		"reviewed_by":    reviewer.ID,
+		"reviewed_at":    now,
+		"review_comment": comment,
+	}
+	if advanced {
+		updates = map[string]interface{}{
+			"stage":                  models.StageHR,
+			"supervisor_approved_by": reviewer.ID,
+			"supervisor_approved_at": now,
+		}
+	}
+
+	result := tx.Model(&models.OvertimeEntry{}).
+		Where("id = ? AND status = ? AND stage = ?", entry.ID, models.StatusPending, stage).
+		Updates(updates)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, errEntryNotPending
+	}
+
+	if advanced {
+		entry.Stage = models.StageHR
+		entry.SupervisorApprovedBy = &reviewer.ID
+		entry.SupervisorApprovedAt = &now
+	} else {
+		entry.Status = status
+		entry.ReviewedBy = &reviewer.ID
+		entry.ReviewedAt = &now
+		entry.ReviewComment = comment
+	}
+
+	err = tx.Model(&models.ApprovalToken{}).
+		Where("entry_id = ? AND used_at IS NULL", entry.ID).
+		Update("used_at", now).Error
+	return advanced, err
+}
+
+// loadApprovalLink resolves an emailed approval link to its entry and approver.
+// Links that are forged, expired, already used or no longer authorized yield
+// a message suitable for showing to the approver.
+func loadApprovalLink(db *gorm.DB, tokenString string) (*models.ApprovalToken, *models.User, string) {
+	claims, err := middleware.ValidateApprovalToken(tokenString)
+	if err != nil {
+		return nil, nil, "This approval link is invalid or has expired."
+	}
+
+	var record models.ApprovalToken
+	if err := db.Preload("Entry").Preload("Entry.User").Where("code = ?", claims.ID).First(&record).Error; err != nil {
+		return nil, nil, "This approval link is invalid or has expired."
+	}
+
+	if record.EntryID != claims.EntryID || record.ApproverID != claims.ApproverID || record.Entry == nil {
+		return nil, nil, "This approval link is invalid or has expired."
+	}
+
+	if !record.IsValid() {
+		return nil, nil, "This approval link has already been used or has expired."
+	}
+
+	var approver models.User
+	if err := db.Preload("TeamAssignments").Preload("ProjectMemberships").First(&approver, record.ApproverID).Error; err != nil {
+		return nil, nil, "This approval link is no longer valid."
+	}
+	if approver.DeactivatedAt != nil {
+		return nil, nil, "This approval link is no longer valid."
+	}
+
+	// Supervisors review the entries of the teams the users were in then
+	entries := []models.OvertimeEntry{*record.Entry}
+	applyEntryTeams(db, entries)
+	record.Entry.User = entries[0].User
+
+	if !approver.CanReviewEntry(record.Entry) {
+		return nil, nil, "You are no longer authorized to review this entry."
+	}
+
+	return &record, &approver, ""
+}
+
+// EmailApprovalPage confirms the decision requested by an emailed approval link.
+// Mail scanners prefetch links, so the decision itself is only recorded on POST.
+func (h *ApprovalHandler) EmailApprovalPage(w http.ResponseWriter, r *http.Request) {
+	tokenString := r.URL.Query().Get("token")
+	action := r.URL.Query().Get("action")
+
+	db := h.db.WithContext(r.Context())
+	record, _, problem := loadApprovalLink(db, tokenString)
+	if problem != "" {
+		data := map[string]interface{}{
+			"Error": problem,
+		}
+		render(w, r, h.templates, "approval-email", data)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Token":  tokenString,
+		"Action": action,
+		"Entry":  record.Entry,
+	}
+	render(w, r, h.templates, "approval-email", data)
+}
+
+// EmailApproval records the decision from an emailed approval link and invalidates it
+func (h *ApprovalHandler) EmailApproval(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	record, approver, problem := loadApprovalLink(db, r.FormValue("token"))
+	if problem != "" {
+		data := map[string]interface{}{
+			"Error": problem,
+		}
+		render(w, r, h.templates, "approval-email", data)
+		return
+	}
+
+	action := r.FormValue("action")
+	var status models.EntryStatus
+	switch action {
+	case "approve":
+		status = models.StatusApproved
+	case "reject":
+		status = models.StatusRejected
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if status == models.StatusRejected && reason == "" {
+		data := map[string]interface{}{
+			"Token":  r.FormValue("token"),
+			"Action": action,
+			"Entry":  record.Entry,
+			"Error":  "Please give a reason for the rejection.",
+		}
+		render(w, r, h.templates, "approval-email", data)
+		return
+	}
+
+	var advanced bool
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		advanced, err = reviewEntry(tx, record.Entry, approver, status, reason)
+		return err
+	})
+
+	data := map[string]interface{}{
+		"Entry": record.Entry,
+	}
+	switch {
+	case errors.Is(err, errEntryNotPending):
+		data["Error"] = "This entry has already been reviewed."
+	case err != nil:
+		data["Error"] = "Failed to record your decision. Please try again."
+	case advanced:
+		data["Success"] = "Entry approved and forwarded to HR for final approval."
+		go RequestApproval(h.store, h.config, h.mailer, *record.Entry)
+	case status == models.StatusApproved:
+		data["Success"] = "Entry approved."
+		go h.calendar.Sync(record.Entry.ID)
+	default:
+		data["Success"] = "Entry rejected."
+		go notifyRejection(h.config, h.mailer, *record.Entry, approver)
+	}
+	render(w, r, h.templates, "approval-email", data)
+}
+
+// PendingApprovalCount returns how many entries, time off and payout
+// requests wait for the user's decision. It backs the approvals badge in the
+// navigation.
+func PendingApprovalCount(db *gorm.DB, user *models.User) int64 {
+	if user == nil || !(user.IsAdmin() || user.IsSupervisor() || user.IsHR()) {
+		return 0
+	}
+
+	var entries, timeOff, payouts int64
+	reviewableEntries(db, user).Count(&entries)
+	reviewableTimeOff(db, user).Count(&timeOff)
+	reviewablePayouts(db, user).Count(&payouts)
+	return entries + timeOff + payouts
+}
+
+// newApprovalCount returns how many entries waiting for the user's decision
+// were submitted since they last opened the approvals page
+func newApprovalCount(db *gorm.DB, user *models.User) int64 {
+	query := reviewableEntries(db, user)
+	if user.ApprovalsSeenAt != nil {
+		query = query.Where("overtime_entries.created_at > ?", *user.ApprovalsSeenAt)
+	}
+	var count int64
+	query.Count(&count)
+	return count
+}
+
+// NewEntriesFor returns a lookup of the pending entries a user may review
+// that were submitted after since, for the approval digest
+func NewEntriesFor(db *gorm.DB) func(user *models.User, since time.Time) ([]models.OvertimeEntry, error) {
+	return func(user *models.User, since time.Time) ([]models.OvertimeEntry, error) {
+		var entries []models.OvertimeEntry
+		err := reviewableEntries(db, user).Preload("User").
+			Where("overtime_entries.created_at > ?", since).
+			Order("overtime_entries.date asc, overtime_entries.id asc").
+			Find(&entries).Error
+		return entries, err
+	}
+}
+
+// EntryApprovers returns a lookup of the users who review an entry at its
+// current stage, for reminders outside the web handlers. entry.User must be
+// set.
+func EntryApprovers(s store.Store) func(entry *models.OvertimeEntry) []models.User {
+	return func(entry *models.OvertimeEntry) []models.User {
+		approvers, err := approversFor(context.Background(), s, entry)
+		if err != nil {
+			log.Printf("Failed to load approvers for entry %d: %v", entry.ID, err)
+		}
+		return approvers
+	}
+}
+
+// ApprovalsPage lists the pending entries and time off requests the current
+// user can review. The filters only apply to entries.
+func (h *ApprovalHandler) ApprovalsPage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+
+	// Get filter parameters
+	teamIDStr := r.URL.Query().Get("team_id")
+	projectIDStr := r.URL.Query().Get("project_id")
+	monthStr := r.URL.Query().Get("month")
+	yearStr := r.URL.Query().Get("year")
+
+	db := h.db.WithContext(r.Context())
+	query := reviewableEntries(db, user)
+
+	// Entries submitted from now on are new to the user
+	db.Model(user).UpdateColumn("approvals_seen_at", time.Now())
+
+	// Apply team filter
+	var selectedTeamID uint
+	if teamIDStr != "" {
+		if tid, err := strconv.ParseUint(teamIDStr, 10, 32); err == nil && tid > 0 {
+			selectedTeamID = uint(tid)
+			query = query.Scopes(inEntryTeams(selectedTeamID))
+		}
+	}
+
+	// Apply project filter
+	var selectedProjectID uint
+	if projectIDStr != "" {
+		if pid, err := strconv.ParseUint(projectIDStr, 10, 32); err == nil && pid > 0 {
+			selectedProjectID = uint(pid)
+			query = query.Where("overtime_entries.project_id = ?", selectedProjectID)
+		}
+	}
+
+	// Apply month/year filter
+	var selectedMonth, selectedYear int
+	currentYear := user.Now().Year()
+
+	if monthStr != "" {
+		if m, err := strconv.Atoi(monthStr); err == nil && m >= 1 && m <= 12 {
+			selectedMonth = m
+		}
+	}
+	if yearStr != "" {
+		if y, err := strconv.Atoi(yearStr); err == nil && y >= 2000 && y <= 2100 {
+			selectedYear = y
+		}
+	}
+
+	// A week or custom range replaces the month and year
+	selectedRange := parseDateRange(r, user.Location())
+	query = entryPeriod(db, query, user.OrganizationID, selectedMonth, selectedYear, selectedRange, user.Location()).Session(&gorm.Session{})
+
+	var entries []models.OvertimeEntry
+	query.Preload("User").Preload("User.Team").Preload("Project").Preload("Creator").Preload("SupervisorApprover").
+		Order("overtime_entries.date asc, overtime_entries.created_at asc").Find(&entries)
+
+	// Supervisors only filter within their assigned teams and project
+	var teams []models.Team
+	var projects []models.Project
+	if user.IsSupervisor() {
+		supervised := user.SupervisedTeamIDs()
+		for _, team := range organizationTeams(db, h.cache, user.OrganizationID) {
+			if slices.Contains(supervised, team.ID) {
+				teams = append(teams, team)
+			}
+		}
+	} else {
+		teams = organizationTeams(db, h.cache, user.OrganizationID)
+		projects = organizationProjects(db, h.cache, user.OrganizationID)
+	}
+
+	// Generate years for dropdown
+	years := make([]int, 5)
+	for i := 0; i < 5; i++ {
+		years[i] = currentYear - i
+	}
+
+	// Reviewers see what each requester has left besides the request
+	var timeOff []models.TimeOffRequest
+	reviewableTimeOff(db, user).Preload("User").Preload("User.Team").
+		Order("time_off_requests.date asc").Find(&timeOff)
+	balances := make(map[uint]float64)
+	for _, request := range timeOff {
+		if _, ok := balances[request.UserID]; !ok {
+			balances[request.UserID], _ = services.TimeOffBalance(db, request.UserID)
+		}
+	}
+
+	var payouts []models.PayoutRequest
+	reviewablePayouts(db, user).Preload("User").Preload("User.Team").
+		Order("payout_requests.created_at asc").Find(&payouts)
+	for _, request := range payouts {
+		if _, ok := balances[request.UserID]; !ok {
+			balances[request.UserID], _ = services.TimeOffBalance(db, request.UserID)
+		}
+	}
+
+	data := map[string]interface{}{
+		"Entries":           entries,
+		"TotalHours":        totalHours(query),
+		"Teams":             teams,
+		"Projects":          projects,
+		"SelectedTeamID":    selectedTeamID,
+		"SelectedProjectID": selectedProjectID,
+		"SelectedMonth":     selectedMonth,
+		"SelectedYear":      selectedYear,
+		"SelectedRange":     selectedRange,
+		"Years":             years,
+		"TimeOff":           timeOff,
+		"TimeOffBalances":   balances,
+		"Payouts":           payouts,
+	}
+	render(w, r, h.templates, "approvals", data)
+}
+
+// BatchReview approves or rejects all selected entries in a single transaction
+func (h *ApprovalHandler) BatchReview(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/approvals", "Invalid form data")
+		return
+	}
+
+	var status models.EntryStatus
+	switch r.FormValue("action") {
+	case "approve":
+		status = models.StatusApproved
+	case "reject":
+		status = models.StatusRejected
+	default:
+		redirectWithError(w, r, "/approvals", "Invalid action")
+		return
+	}
+
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if status == models.StatusRejected && reason == "" {
+		redirectWithError(w, r, "/approvals", "A reason is required to reject entries")
+		return
+	}
+
+	var ids []uint
+	for _, idStr := range r.Form["entry_ids"] {
+		id, err := strconv.ParseUint(idStr, 10, 32)
+		if err != nil {
+			redirectWithError(w, r, "/approvals", "Invalid entry ID")
+			return
+		}
+		ids = append(ids, uint(id))
+	}
+	if len(ids) == 0 {
+		redirectWithError(w, r, "/approvals", "No entries selected")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	var forwarded, approved, rejected []models.OvertimeEntry
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var entries []models.OvertimeEntry
+		if err := reviewableEntries(tx, user).Where("overtime_entries.id IN ?", ids).Find(&entries).Error; err != nil {
+			return err
+		}
+		if len(entries) != len(ids) {
+			return errEntryNotPending
+		}
+
+		for i := range entries {
+			advanced, err := reviewEntry(tx, &entries[i], user, status, reason)
+			if err != nil {
+				return err
+			}
+			if advanced {
+				forwarded = append(forwarded, entries[i])
+			}
+			if entries[i].Status == models.StatusApproved {
+				approved = append(approved, entries[i])
+			}
+			if entries[i].IsRejected() {
+				rejected = append(rejected, entries[i])
+			}
+		}
+		return nil
+	})
+
+	if errors.Is(err, errEntryNotPending) {
+		redirectWithError(w, r, "/approvals", "Some selected entries are no longer pending")
+		return
+	}
+	if err != nil {
+		redirectWithError(w, r, "/approvals", "Failed to record decisions")
+		return
+	}
+
+	for _, entry := range forwarded {
+		go RequestApproval(h.store, h.config, h.mailer, entry)
+	}
+	for _, entry := range approved {
+		go h.calendar.Sync(entry.ID)
+	}
+	for _, entry := range rejected {
+		go notifyRejection(h.config, h.mailer, entry, user)
+	}
+
+	message := fmt.Sprintf("%d entries approved", len(ids))
+	if len(forwarded) > 0 {
+		message = fmt.Sprintf("%d entries approved, %d forwarded to HR", len(ids), len(forwarded))
+	}
+	if status == models.StatusRejected {
+		message = fmt.Sprintf("%d entries rejected", len(ids))
+	}
+	redirectWithSuccess(w, r, "/approvals", message)
+}
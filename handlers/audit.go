@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"overtime/middleware"
+	"overtime/models"
+
+	"gorm.io/gorm"
+)
+
+// recordAudit stores an audit log entry for the request. Failures are only
+// logged; they must not undo the action being audited.
+func recordAudit(db *gorm.DB, r *http.Request, organizationID uint, userID *uint, action, detail string) {
+	entry := newAuditLog(r, organizationID, userID, action, detail)
+	if err := db.Create(&entry).Error; err != nil {
+		log.Printf("Failed to record audit log %s: %v", action, err)
+	}
+}
+
+// newAuditLog builds an audit log entry for the request, for actions that
+// store it in their own transaction
+func newAuditLog(r *http.Request, organizationID uint, userID *uint, action, detail string) models.AuditLog {
+	return models.AuditLog{
+		OrganizationID: organizationID,
+		UserID:         userID,
+		Action:         action,
+		Detail:         detail,
+		IP:             middleware.ClientIP(r),
+	}
+}
@@ -1,73 +1,159 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"html/template"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
+	"overtime/cache"
+	"overtime/caldav"
+	"overtime/captcha"
 	"overtime/config"
-	"overtime/database"
+	"overtime/mailer"
 	"overtime/middleware"
 	"overtime/models"
+	"overtime/passhash"
+	"overtime/ratelimit"
+	"overtime/services"
 
-	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 type AuthHandler struct {
+	db        *gorm.DB
 	config    *config.Config
 	templates map[string]*template.Template
+	calendar  *caldav.Publisher
+	mailer    *mailer.Mailer
+	cache     cache.Cache
+	logins    *ratelimit.Limiter
+	// failures counts the failed logins and registrations per address, after
+	// too many the forms ask for a CAPTCHA if one is configured
+	failures *ratelimit.Limiter
+	captcha  *captcha.Verifier
+	// failedLogins counts the failed logins per account for security alerts
+	failedLogins *ratelimit.Limiter
 }
 
-func NewAuthHandler(cfg *config.Config, templates map[string]*template.Template) *AuthHandler {
+func NewAuthHandler(db *gorm.DB, cfg *config.Config, templates map[string]*template.Template, calendar *caldav.Publisher, mail *mailer.Mailer, c cache.Cache,
+	logins, failures, failedLogins *ratelimit.Limiter, verifier *captcha.Verifier) *AuthHandler {
 	return &AuthHandler{
-		config:    cfg,
-		templates: templates,
+		db:           db,
+		config:       cfg,
+		templates:    templates,
+		calendar:     calendar,
+		mailer:       mail,
+		cache:        c,
+		logins:       logins,
+		failures:     failures,
+		captcha:      verifier,
+		failedLogins: failedLogins,
 	}
 }
 
 func (h *AuthHandler) LoginPage(w http.ResponseWriter, r *http.Request) {
+	db := h.db.WithContext(r.Context())
 	data := map[string]interface{}{
-		"Error": r.URL.Query().Get("error"),
+		"MagicLink":  h.config.MagicLinkLogin,
+		"OpenSignup": loadAppSettings(db, h.config, defaultOrganizationID(db)).OpenSignup,
+		"Captcha":    h.captchaWidget(r),
 	}
-	h.templates["login"].ExecuteTemplate(w, "base", data)
+	render(w, r, h.templates, "login", data)
 }
 
 func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
-		http.Redirect(w, r, "/login?error=Invalid+form+data", http.StatusSeeOther)
+		redirectWithError(w, r, "/login", "Invalid form data")
+		return
+	}
+
+	if message := h.humanCheck(r); message != "" {
+		redirectWithError(w, r, "/login", message)
 		return
 	}
 
 	username := r.FormValue("username")
 	password := r.FormValue("password")
 
-	var user models.User
-	if err := database.GetDB().Where("username = ?", username).First(&user).Error; err != nil {
-		http.Redirect(w, r, "/login?error=Invalid+credentials", http.StatusSeeOther)
+	// Counted per account and address, so guessing one password is slowed
+	// down without locking out a whole office behind one address
+	if !h.logins.Allow(middleware.ClientIP(r) + ":" + services.NormalizeUsername(username)) {
+		redirectWithError(w, r, "/login", "Too many login attempts, try again later")
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
-		http.Redirect(w, r, "/login?error=Invalid+credentials", http.StatusSeeOther)
+	db := h.db.WithContext(r.Context())
+	user, ok := findLogin(db, username)
+	if !ok {
+		h.countFailure(r)
+		redirectWithError(w, r, "/login", "Invalid credentials")
 		return
 	}
 
-	token, err := middleware.GenerateToken(&user, h.config.JWTExpiration)
-	if err != nil {
-		http.Redirect(w, r, "/login?error=Failed+to+generate+token", http.StatusSeeOther)
+	ok, rehash := passhash.Verify(user.PasswordHash, password)
+	if !ok {
+		h.countFailure(r)
+		h.countFailedLogin(db, r, user)
+		redirectWithError(w, r, "/login", "Invalid credentials")
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    token,
-		Path:     "/",
-		MaxAge:   int(h.config.JWTExpiration.Seconds()),
-		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
-	})
+	if user.PendingVerification {
+		h.sendSignupVerification(db, user)
+		redirectWithError(w, r, "/login", "Confirm your email address with the link sent to "+user.Email+" first")
+		return
+	}
+	if user.PendingApproval {
+		redirectWithError(w, r, "/login", "Your account has not been activated by an administrator yet")
+		return
+	}
+	// findLogin leaves deactivated accounts out already
+	if user.DeactivatedAt != nil {
+		redirectWithError(w, r, "/login", "Invalid credentials")
+		return
+	}
+
+	// Upgrade bcrypt hashes and hashes with outdated parameters while the
+	// password is at hand
+	if rehash {
+		if hash, err := passhash.Hash(password); err == nil {
+			db.Model(user).Update("password_hash", hash)
+		}
+	}
+
+	if !h.startLogin(db, w, r, user) {
+		return
+	}
+	redirectAfterLogin(w, r, user)
+}
 
+// startLogin logs in a user who proved who they are, with their password or
+// a login link. Expired passwords go through the forced change like new
+// accounts. It reports whether the session was started, having answered
+// the request if not.
+func (h *AuthHandler) startLogin(db *gorm.DB, w http.ResponseWriter, r *http.Request, user *models.User) bool {
+	maxAge := loadAppSettings(db, h.config, user.OrganizationID).PasswordPolicy.MaxAge
+	if maxAge > 0 && !user.MustChangePassword && user.PasswordExpired(maxAge) {
+		user.MustChangePassword = true
+		db.Model(user).Update("must_change_password", true)
+	}
+
+	if err := middleware.StartSession(db, w, r, user, h.config.JWTExpiration); err != nil {
+		redirectWithError(w, r, "/login", "Failed to start session")
+		return false
+	}
+	h.checkLoginAddress(db, r, user)
+	return true
+}
+
+// redirectAfterLogin sends a user who just logged in to the forced password
+// change or their dashboard
+func redirectAfterLogin(w http.ResponseWriter, r *http.Request, user *models.User) {
 	if user.MustChangePassword {
 		http.Redirect(w, r, "/change-password", http.StatusSeeOther)
 		return
@@ -82,24 +168,49 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
 }
 
+// findLogin finds the account for what was entered as the login, a username
+// or an email address. Usernames match ignoring case, unless accounts from
+// before usernames were unique ignoring case still collide; only the exact
+// username logs in to those. Deactivated accounts are never found.
+func findLogin(db *gorm.DB, login string) (*models.User, bool) {
+	var users []models.User
+	if err := db.Where("username = ? AND deactivated_at IS NULL", login).Limit(1).Find(&users).Error; err != nil {
+		return nil, false
+	}
+	if len(users) == 0 {
+		if err := db.Where("LOWER(username) = ? AND deactivated_at IS NULL", services.NormalizeUsername(login)).Limit(2).Find(&users).Error; err != nil || len(users) > 1 {
+			return nil, false
+		}
+	}
+	if len(users) == 0 && strings.Contains(login, "@") {
+		// Addresses are unique, but two accounts may still share one from
+		// before they were; neither logs in with it then
+		if err := db.Where("LOWER(email) = LOWER(?) AND deactivated_at IS NULL", login).Limit(2).Find(&users).Error; err != nil || len(users) != 1 {
+			return nil, false
+		}
+	}
+	if len(users) == 0 {
+		return nil, false
+	}
+	return &users[0], true
+}
+
 func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    "",
-		Path:     "/",
-		MaxAge:   -1,
-		HttpOnly: true,
-	})
+	db := h.db.WithContext(r.Context())
+	if session := middleware.GetSessionFromContext(r.Context()); session != nil {
+		middleware.RevokeSession(db, session)
+	}
+	middleware.ClearAuthCookie(w, r)
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
 func (h *AuthHandler) ChangePasswordPage(w http.ResponseWriter, r *http.Request) {
 	user := middleware.GetUserFromContext(r.Context())
+	db := h.db.WithContext(r.Context())
 	data := map[string]interface{}{
-		"User":  user,
-		"Error": r.URL.Query().Get("error"),
+		"PasswordPolicy": loadAppSettings(db, h.config, user.OrganizationID).PasswordPolicy,
 	}
-	h.templates["change-password"].ExecuteTemplate(w, "base", data)
+	render(w, r, h.templates, "change-password", data)
 }
 
 func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
@@ -110,7 +221,7 @@ func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := r.ParseForm(); err != nil {
-		http.Redirect(w, r, "/change-password?error=Invalid+form+data", http.StatusSeeOther)
+		redirectWithError(w, r, "/change-password", "Invalid form data")
 		return
 	}
 
@@ -119,49 +230,61 @@ func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
 	confirmPassword := r.FormValue("confirm_password")
 
 	// Verify current password
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(currentPassword)); err != nil {
-		http.Redirect(w, r, "/change-password?error=Current+password+is+incorrect", http.StatusSeeOther)
+	if ok, _ := passhash.Verify(user.PasswordHash, currentPassword); !ok {
+		redirectWithError(w, r, "/change-password", "Current password is incorrect")
 		return
 	}
 
 	if newPassword != confirmPassword {
-		http.Redirect(w, r, "/change-password?error=Passwords+do+not+match", http.StatusSeeOther)
+		redirectWithError(w, r, "/change-password", "Passwords do not match")
 		return
 	}
 
-	if len(newPassword) < 5 {
-		http.Redirect(w, r, "/change-password?error=Password+must+be+at+least+5+characters", http.StatusSeeOther)
+	db := h.db.WithContext(r.Context())
+	policy := loadAppSettings(db, h.config, user.OrganizationID).PasswordPolicy
+	if err := checkPassword(policy, newPassword); err != nil {
+		redirectWithError(w, r, "/change-password", err.Error())
 		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
-	if err != nil {
-		http.Redirect(w, r, "/change-password?error=Failed+to+hash+password", http.StatusSeeOther)
+	if passwordReused(db, user, newPassword, policy.History) {
+		redirectWithError(w, r, "/change-password", fmt.Sprintf("Password must be different from your last %d passwords", policy.History))
 		return
 	}
 
-	user.PasswordHash = string(hashedPassword)
-	user.MustChangePassword = false
-	if err := database.GetDB().Save(user).Error; err != nil {
-		http.Redirect(w, r, "/change-password?error=Failed+to+update+password", http.StatusSeeOther)
+	hashedPassword, err := passhash.Hash(newPassword)
+	if err != nil {
+		redirectWithError(w, r, "/change-password", "Failed to hash password")
 		return
 	}
 
-	// Regenerate token with updated user info
-	token, err := middleware.GenerateToken(user, h.config.JWTExpiration)
+	// Setting the first password of a new account is no news
+	changed := user.PasswordChangedAt != nil
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := recordPasswordHistory(tx, user); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		user.PasswordHash = hashedPassword
+		user.PasswordChangedAt = &now
+		user.MustChangePassword = false
+		return tx.Save(user).Error
+	})
 	if err != nil {
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		redirectWithError(w, r, "/change-password", "Failed to update password")
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    token,
-		Path:     "/",
-		MaxAge:   int(h.config.JWTExpiration.Seconds()),
-		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
-	})
+	// Other devices have to log in with the new password
+	current := middleware.GetSessionFromContext(r.Context())
+	db.Model(&models.Session{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL", user.ID, current.ID).
+		Update("revoked_at", time.Now())
+
+	if changed {
+		h.raiseSecurityAlert(db, user, models.AlertPasswordChanged, "The password was changed, other sessions were logged out.", middleware.ClientIP(r))
+	}
 
 	// Redirect supervisors to their dedicated dashboard
 	if user.IsSupervisor() {
@@ -172,15 +295,96 @@ func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
 }
 
+// commonTimezones are suggested in timezone pickers; any IANA name is accepted
+var commonTimezones = []string{
+	"UTC",
+	"Europe/London", "Europe/Dublin", "Europe/Lisbon", "Europe/Berlin", "Europe/Paris",
+	"Europe/Madrid", "Europe/Rome", "Europe/Amsterdam", "Europe/Vienna", "Europe/Zurich",
+	"Europe/Warsaw", "Europe/Prague", "Europe/Stockholm", "Europe/Helsinki", "Europe/Athens",
+	"Europe/Istanbul", "Europe/Moscow",
+	"America/New_York", "America/Chicago", "America/Denver", "America/Los_Angeles",
+	"America/Toronto", "America/Mexico_City", "America/Sao_Paulo",
+	"Asia/Dubai", "Asia/Kolkata", "Asia/Singapore", "Asia/Shanghai", "Asia/Tokyo",
+	"Australia/Perth", "Australia/Brisbane", "Australia/Sydney", "Pacific/Auckland",
+}
+
+// parseTimezone validates an IANA timezone name; empty means the UTC default
+func parseTimezone(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", true
+	}
+	if _, err := time.LoadLocation(name); err != nil {
+		return "", false
+	}
+	return name, true
+}
+
+func (h *AuthHandler) ProfilePage(w http.ResponseWriter, r *http.Request) {
+	render(w, r, h.templates, "profile", h.profileData())
+}
+
+// profileData is the data of the profile page
+func (h *AuthHandler) profileData() map[string]interface{} {
+	return map[string]interface{}{
+		"Timezones":   commonTimezones,
+		"TelegramBot": h.config.TelegramBotUsername,
+		"Telegram":    h.config.TelegramBotToken != "",
+		"Gravatar":    h.config.Gravatar,
+		"Digest":      h.config.DigestInterval > 0,
+	}
+}
+
+func (h *AuthHandler) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/profile", "Invalid form data")
+		return
+	}
+
+	timezone, ok := parseTimezone(r.FormValue("timezone"))
+	if !ok {
+		redirectWithError(w, r, "/profile", "Unknown timezone")
+		return
+	}
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	updates := map[string]interface{}{
+		"email":    email,
+		"timezone": timezone,
+	}
+
+	db := h.db.WithContext(r.Context())
+	if taken, err := services.EmailTaken(db, email, user.ID); err != nil || taken {
+		redirectWithError(w, r, "/profile", "Email address is already used by another account")
+		return
+	}
+	if h.config.DigestInterval > 0 && (user.IsSupervisor() || user.IsHR() || user.IsAdmin()) {
+		updates["approval_digest"] = r.FormValue("approval_digest") != ""
+	}
+	updates["security_alerts"] = r.FormValue("security_alerts") != ""
+	if user.IsAdmin() {
+		updates["receive_security_alerts"] = r.FormValue("receive_security_alerts") != ""
+	}
+	if err := db.Model(user).Updates(updates).Error; err != nil {
+		redirectWithError(w, r, "/profile", "Failed to update profile")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/profile", "Profile updated")
+}
+
 func (h *AuthHandler) RegisterPage(w http.ResponseWriter, r *http.Request) {
 	code := r.URL.Query().Get("code")
 	if code == "" {
-		http.Error(w, "Invalid invite link", http.StatusBadRequest)
+		h.signUpPage(w, r)
 		return
 	}
 
+	db := h.db.WithContext(r.Context())
 	var invite models.Invite
-	if err := database.GetDB().Preload("Team").Preload("Project").Where("code = ?", code).First(&invite).Error; err != nil {
+	if err := db.Preload("Organization").Preload("Team").Preload("Project").Where("code = ?", code).First(&invite).Error; err != nil {
 		http.Error(w, "Invalid invite link", http.StatusBadRequest)
 		return
 	}
@@ -190,15 +394,21 @@ func (h *AuthHandler) RegisterPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	flash := middleware.PopFlash(w, r)
 	data := map[string]interface{}{
-		"Code":     code,
-		"FullName": invite.FullName,
-		"Role":     invite.Role,
-		"Team":     invite.Team,
-		"Project":  invite.Project,
-		"Error":    r.URL.Query().Get("error"),
-	}
-	h.templates["register"].ExecuteTemplate(w, "base", data)
+		"Code":           code,
+		"FullName":       invite.FullName,
+		"Email":          invite.Email,
+		"Role":           invite.Role,
+		"Organization":   invite.Organization,
+		"Team":           invite.Team,
+		"Project":        invite.Project,
+		"PasswordPolicy": loadAppSettings(db, h.config, invite.OrganizationID).PasswordPolicy,
+		"Captcha":        h.captchaWidget(r),
+		"Form":           flash.Form,
+		"Error":          flash.Error,
+	}
+	render(w, r, h.templates, "register", data)
 }
 
 func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
@@ -208,12 +418,22 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 	}
 
 	code := r.FormValue("code")
+	if code == "" {
+		h.signUp(w, r)
+		return
+	}
+	if message := h.humanCheck(r); message != "" {
+		redirectWithFormError(w, r, "/register?code="+code, message)
+		return
+	}
 	username := r.FormValue("username")
+	email := strings.TrimSpace(r.FormValue("email"))
 	password := r.FormValue("password")
 	confirmPassword := r.FormValue("confirm_password")
 
+	db := h.db.WithContext(r.Context())
 	var invite models.Invite
-	if err := database.GetDB().Where("code = ?", code).First(&invite).Error; err != nil {
+	if err := db.Where("code = ?", code).First(&invite).Error; err != nil {
 		http.Error(w, "Invalid invite link", http.StatusBadRequest)
 		return
 	}
@@ -223,82 +443,52 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	username = services.NormalizeUsername(username)
 	if len(username) < 3 {
-		http.Redirect(w, r, "/register?code="+code+"&error=Username+must+be+at+least+3+characters", http.StatusSeeOther)
+		redirectWithFormError(w, r, "/register?code="+code, "Username must be at least 3 characters")
 		return
 	}
 
 	if password != confirmPassword {
-		http.Redirect(w, r, "/register?code="+code+"&error=Passwords+do+not+match", http.StatusSeeOther)
+		redirectWithFormError(w, r, "/register?code="+code, "Passwords do not match")
 		return
 	}
 
-	if len(password) < 5 {
-		http.Redirect(w, r, "/register?code="+code+"&error=Password+must+be+at+least+5+characters", http.StatusSeeOther)
+	if err := checkPassword(loadAppSettings(db, h.config, invite.OrganizationID).PasswordPolicy, password); err != nil {
+		redirectWithFormError(w, r, "/register?code="+code, err.Error())
 		return
 	}
 
-	// Check if username already exists
-	var existingUser models.User
-	if err := database.GetDB().Where("username = ?", username).First(&existingUser).Error; err == nil {
-		http.Redirect(w, r, "/register?code="+code+"&error=Username+already+exists", http.StatusSeeOther)
+	user, err := services.Register(db, services.Registration{
+		InviteCode: code,
+		Username:   username,
+		Email:      email,
+		Password:   password,
+	})
+	switch {
+	case errors.Is(err, services.ErrInviteInvalid):
+		http.Error(w, "Invalid invite link", http.StatusBadRequest)
 		return
-	}
-
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		http.Redirect(w, r, "/register?code="+code+"&error=Failed+to+create+account", http.StatusSeeOther)
+	case errors.Is(err, services.ErrInviteExpired):
+		http.Error(w, "Invite link has expired or already been used", http.StatusBadRequest)
 		return
-	}
-
-	user := models.User{
-		Username:           username,
-		FullName:           invite.FullName,
-		PasswordHash:       string(hashedPassword),
-		Role:               invite.Role,
-		MustChangePassword: false,
-		TeamID:             invite.TeamID,
-		ProjectID:          invite.ProjectID,
-	}
-
-	if err := database.GetDB().Create(&user).Error; err != nil {
-		http.Redirect(w, r, "/register?code="+code+"&error=Failed+to+create+account", http.StatusSeeOther)
+	case errors.Is(err, services.ErrUsernameTaken):
+		redirectWithFormError(w, r, "/register?code="+code, "Username already exists")
+		return
+	case errors.Is(err, services.ErrEmailTaken):
+		redirectWithFormError(w, r, "/register?code="+code, "Email address is already used by another account")
+		return
+	case err != nil:
+		redirectWithFormError(w, r, "/register?code="+code, "Failed to create account")
 		return
 	}
 
-	// User set their own password during registration, no need to change it
-	database.GetDB().Model(&user).Update("must_change_password", false)
-
-	// If this is a supervisor with a team assigned, create the TeamSupervisor assignment
-	// (the project is stored on the User record via ProjectID)
-	if user.IsSupervisor() && invite.TeamID != nil {
-		assignment := models.TeamSupervisor{
-			UserID: user.ID,
-			TeamID: *invite.TeamID,
-		}
-		database.GetDB().Create(&assignment)
-	}
-
-	// Mark invite as used
-	invite.Used = true
-	database.GetDB().Save(&invite)
-
-	// Generate token and log user in
-	token, err := middleware.GenerateToken(&user, h.config.JWTExpiration)
-	if err != nil {
+	// Log the new user in
+	if err := middleware.StartSession(db, w, r, user, h.config.JWTExpiration); err != nil {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    token,
-		Path:     "/",
-		MaxAge:   int(h.config.JWTExpiration.Seconds()),
-		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
-	})
-
 	// Redirect supervisors to their dedicated dashboard
 	if user.IsSupervisor() {
 		http.Redirect(w, r, "/supervisor/dashboard", http.StatusSeeOther)
@@ -315,26 +505,56 @@ func (h *AuthHandler) InvitesPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db := database.GetDB()
+	db := h.db.WithContext(r.Context())
 
+	status := r.URL.Query().Get("status")
+	now := time.Now()
+	query := db.Preload("Team").Preload("Project").Scopes(inOrganization(user.OrganizationID)).
+		Where("created_by = ?", user.ID)
+	switch status {
+	case "used":
+		query = query.Where("used = ?", true)
+	case "expired":
+		query = query.Where("used = ? AND expires_at <= ?", false, now)
+	case "all":
+	default:
+		status = "active"
+		query = query.Where("used = ? AND expires_at > ?", false, now)
+	}
 	var invites []models.Invite
-	db.Preload("Team").Preload("Project").Where("created_by = ?", user.ID).Order("created_at desc").Find(&invites)
+	query.Order("created_at desc").Find(&invites)
 
-	var teams []models.Team
-	var projects []models.Project
-	db.Find(&teams)
-	db.Find(&projects)
+	var counts struct {
+		Active  int64
+		Used    int64
+		Expired int64
+	}
+	db.Model(&models.Invite{}).Scopes(inOrganization(user.OrganizationID)).Where("created_by = ?", user.ID).
+		Select("COUNT(*) FILTER (WHERE NOT used AND expires_at > ?) AS active, COUNT(*) FILTER (WHERE used) AS used, COUNT(*) FILTER (WHERE NOT used AND expires_at <= ?) AS expired", now, now).
+		Scan(&counts)
+
+	var templates []models.InviteTemplate
+	db.Preload("Team").Preload("Project").Scopes(inOrganization(user.OrganizationID)).
+		Order("name").Find(&templates)
 
+	teams := organizationTeams(db, h.cache, user.OrganizationID)
+	projects := organizationProjects(db, h.cache, user.OrganizationID)
+
+	flash := middleware.PopFlash(w, r)
 	data := map[string]interface{}{
-		"User":     user,
-		"BaseURL":  h.config.BaseURL,
-		"Invites":  invites,
-		"Teams":    teams,
-		"Projects": projects,
-		"Error":    r.URL.Query().Get("error"),
-		"Success":  r.URL.Query().Get("success"),
-	}
-	h.templates["invites"].ExecuteTemplate(w, "base", data)
+		"BaseURL":   baseURL(h.config, r),
+		"Invites":   invites,
+		"Status":    status,
+		"Counts":    counts,
+		"Retention": loadAppSettings(db, h.config, user.OrganizationID).Retention.InviteDays,
+		"Templates": templates,
+		"Teams":     teams,
+		"Projects":  projects,
+		"Form":      flash.Form,
+		"Error":     flash.Error,
+		"Success":   flash.Success,
+	}
+	render(w, r, h.templates, "invites", data)
 }
 
 func (h *AuthHandler) CreateInvite(w http.ResponseWriter, r *http.Request) {
@@ -345,44 +565,54 @@ func (h *AuthHandler) CreateInvite(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := r.ParseForm(); err != nil {
-		http.Redirect(w, r, "/invites?error=Invalid+form+data", http.StatusSeeOther)
+		redirectWithError(w, r, "/invites", "Invalid form data")
 		return
 	}
 
 	fullName := r.FormValue("full_name")
 	if fullName == "" {
-		http.Redirect(w, r, "/invites?error=Full+name+is+required", http.StatusSeeOther)
+		redirectWithFormError(w, r, "/invites", "Full name is required")
 		return
 	}
 
-	roleStr := r.FormValue("role")
-	var role models.Role
-	switch roleStr {
-	case "EMPLOYEE":
-		role = models.RoleEmployee
-	case "SUPERVISOR":
-		role = models.RoleSupervisor
-	case "HR":
-		role = models.RoleHR
-	case "ADMIN":
-		role = models.RoleAdmin
-	default:
-		http.Redirect(w, r, "/invites?error=Invalid+role", http.StatusSeeOther)
+	email := strings.TrimSpace(r.FormValue("email"))
+	if email != "" && (!strings.Contains(email, "@") || len(email) > 255) {
+		redirectWithFormError(w, r, "/invites", "Invalid email address")
+		return
+	}
+
+	role, ok := parseInviteRole(r.FormValue("role"))
+	if !ok {
+		redirectWithFormError(w, r, "/invites", "Invalid role")
 		return
 	}
 
 	code, err := models.GenerateInviteCode()
 	if err != nil {
-		http.Redirect(w, r, "/invites?error=Failed+to+generate+invite+code", http.StatusSeeOther)
+		redirectWithFormError(w, r, "/invites", "Failed to generate invite code")
+		return
+	}
+	shortCode, err := models.GenerateShortCode()
+	if err != nil {
+		redirectWithFormError(w, r, "/invites", "Failed to generate invite code")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	if taken, err := services.EmailTaken(db, email, 0); err != nil || taken {
+		redirectWithFormError(w, r, "/invites", "Email address is already used by another account")
 		return
 	}
 
 	invite := models.Invite{
-		Code:      code,
-		FullName:  fullName,
-		Role:      role,
-		CreatedBy: user.ID,
-		ExpiresAt: time.Now().Add(h.config.InviteExpiration),
+		OrganizationID: user.OrganizationID,
+		Code:           code,
+		ShortCode:      &shortCode,
+		FullName:       fullName,
+		Email:          email,
+		Role:           role,
+		CreatedBy:      user.ID,
+		ExpiresAt:      time.Now().Add(loadAppSettings(db, h.config, user.OrganizationID).InviteExpiration),
 	}
 
 	// Handle team assignment
@@ -390,6 +620,10 @@ func (h *AuthHandler) CreateInvite(w http.ResponseWriter, r *http.Request) {
 	if teamIDStr != "" {
 		if tid, err := strconv.ParseUint(teamIDStr, 10, 32); err == nil && tid > 0 {
 			teamID := uint(tid)
+			if !organizationExists(db, &models.Team{}, teamID, user.OrganizationID) {
+				redirectWithFormError(w, r, "/invites", "Team not found")
+				return
+			}
 			invite.TeamID = &teamID
 		}
 	}
@@ -399,33 +633,38 @@ func (h *AuthHandler) CreateInvite(w http.ResponseWriter, r *http.Request) {
 	if projectIDStr != "" {
 		if pid, err := strconv.ParseUint(projectIDStr, 10, 32); err == nil && pid > 0 {
 			projectID := uint(pid)
+			if !organizationExists(db, &models.Project{}, projectID, user.OrganizationID) {
+				redirectWithFormError(w, r, "/invites", "Project not found")
+				return
+			}
 			invite.ProjectID = &projectID
 		}
 	}
 
-	if err := database.GetDB().Create(&invite).Error; err != nil {
-		http.Redirect(w, r, "/invites?error=Failed+to+create+invite", http.StatusSeeOther)
+	if err := db.Create(&invite).Error; err != nil {
+		redirectWithFormError(w, r, "/invites", "Failed to create invite")
 		return
 	}
 
-	http.Redirect(w, r, "/invites?success=Invite+created+successfully", http.StatusSeeOther)
+	redirectWithSuccess(w, r, "/invites", "Invite created successfully")
 }
 
+// UsersPage lists the users. HR sees the list to manage teams and projects.
 func (h *AuthHandler) UsersPage(w http.ResponseWriter, r *http.Request) {
 	user := middleware.GetUserFromContext(r.Context())
-	if !user.IsAdmin() {
+	if !user.CanManageMemberships() {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
-	db := database.GetDB()
+	db := h.db.WithContext(r.Context())
 
 	// Get filter parameters
 	teamFilter := r.URL.Query().Get("team")
 	projectFilter := r.URL.Query().Get("project")
 
 	// Build query with filters
-	query := db.Preload("Team").Preload("Project").Order("created_at desc")
+	query := db.Preload("Team").Preload("Project").Scopes(inOrganization(user.OrganizationID)).Order("created_at desc")
 
 	if teamFilter != "" {
 		if teamID, err := strconv.ParseUint(teamFilter, 10, 32); err == nil {
@@ -435,71 +674,125 @@ func (h *AuthHandler) UsersPage(w http.ResponseWriter, r *http.Request) {
 
 	if projectFilter != "" {
 		if projectID, err := strconv.ParseUint(projectFilter, 10, 32); err == nil {
-			query = query.Where("project_id = ?", projectID)
+			query = query.Scopes(onProjects([]uint{uint(projectID)}))
 		}
 	}
 
 	var users []models.User
 	query.Find(&users)
 
-	var teams []models.Team
-	var projects []models.Project
-	db.Find(&teams)
-	db.Find(&projects)
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, userListResponse{Users: newAPIUsers(users)})
+		return
+	}
+
+	teams := organizationTeams(db, h.cache, user.OrganizationID)
+	projects := organizationProjects(db, h.cache, user.OrganizationID)
+
+	// Any two active accounts can be merged, whatever the filter shows
+	var active []models.User
+	db.Scopes(inOrganization(user.OrganizationID)).Where("deactivated_at IS NULL").Order("username asc").Find(&active)
 
 	data := map[string]interface{}{
-		"User":          user,
 		"Users":         users,
+		"ActiveUsers":   active,
 		"Teams":         teams,
 		"Projects":      projects,
 		"TeamFilter":    teamFilter,
 		"ProjectFilter": projectFilter,
-		"Error":         r.URL.Query().Get("error"),
-		"Success":       r.URL.Query().Get("success"),
+		"PendingUsers":  pendingUserCount(db, user.OrganizationID),
+		"ExportFormat":  loadAppSettings(db, h.config, user.OrganizationID).ExportFormat,
 	}
-	h.templates["users"].ExecuteTemplate(w, "base", data)
+	render(w, r, h.templates, "users", data)
 }
 
+// EditUserPage shows a user for editing, HR only gets to change their teams
+// and projects
 func (h *AuthHandler) EditUserPage(w http.ResponseWriter, r *http.Request) {
 	user := middleware.GetUserFromContext(r.Context())
-	if !user.IsAdmin() {
+	if !user.CanManageMemberships() {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
 	idStr := r.URL.Query().Get("id")
 	if idStr == "" {
-		http.Redirect(w, r, "/users?error=Invalid+user+ID", http.StatusSeeOther)
+		redirectWithError(w, r, "/users", "Invalid user ID")
 		return
 	}
 
 	id, err := strconv.ParseUint(idStr, 10, 32)
 	if err != nil {
-		http.Redirect(w, r, "/users?error=Invalid+user+ID", http.StatusSeeOther)
+		redirectWithError(w, r, "/users", "Invalid user ID")
 		return
 	}
 
-	db := database.GetDB()
+	db := h.db.WithContext(r.Context())
 
 	var editUser models.User
-	if err := db.Preload("Team").Preload("Project").First(&editUser, id).Error; err != nil {
-		http.Redirect(w, r, "/users?error=User+not+found", http.StatusSeeOther)
+	if err := db.Preload("Team").Preload("Project").Scopes(inOrganization(user.OrganizationID)).First(&editUser, id).Error; err != nil {
+		redirectWithError(w, r, "/users", "User not found")
 		return
 	}
 
-	var teams []models.Team
-	var projects []models.Project
-	db.Find(&teams)
-	db.Find(&projects)
+	teams := organizationTeams(db, h.cache, user.OrganizationID)
+	projects := organizationProjects(db, h.cache, user.OrganizationID)
 
-	data := map[string]interface{}{
-		"User":     user,
-		"EditUser": &editUser,
-		"Teams":    teams,
-		"Projects": projects,
-		"Error":    r.URL.Query().Get("error"),
+	teamID, projectID, costCenterID := "", "", ""
+	if editUser.TeamID != nil {
+		teamID = strconv.FormatUint(uint64(*editUser.TeamID), 10)
+	}
+	if editUser.ProjectID != nil {
+		projectID = strconv.FormatUint(uint64(*editUser.ProjectID), 10)
+	}
+	if editUser.CostCenterID != nil {
+		costCenterID = strconv.FormatUint(uint64(*editUser.CostCenterID), 10)
 	}
-	h.templates["user-edit"].ExecuteTemplate(w, "base", data)
+
+	var jiraAccount models.JiraAccount
+	db.Where("user_id = ?", editUser.ID).Limit(1).Find(&jiraAccount)
+
+	hourlyRate := ""
+	if editUser.HourlyRate != nil {
+		hourlyRate = strconv.FormatFloat(*editUser.HourlyRate, 'f', -1, 64)
+	}
+
+	flash := middleware.PopFlash(w, r)
+	form := formValues(map[string]string{
+		"full_name":       editUser.FullName,
+		"email":           editUser.Email,
+		"timezone":        editUser.Timezone,
+		"role":            string(editUser.Role),
+		"team_id":         teamID,
+		"project_id":      projectID,
+		"jira_account_id": jiraAccount.AccountID,
+		"hourly_rate":     hourlyRate,
+		"cost_center_id":  costCenterID,
+		"employee_number": identifierValue(editUser.EmployeeNumber),
+		"external_id":     identifierValue(editUser.ExternalID),
+	}, flash.Form)
+
+	balance, _ := services.TimeOffBalance(db, editUser.ID)
+	var compensations []models.Compensation
+	db.Preload("Creator").Where("user_id = ?", editUser.ID).Order("date desc, id desc").Find(&compensations)
+
+	data := map[string]interface{}{
+		"EditUser":      &editUser,
+		"Balance":       balance,
+		"Compensations": compensations,
+		"Form":          form,
+		"Teams":         teams,
+		"Projects":      projects,
+		"CostCenters":   organizationCostCenters(db, h.cache, user.OrganizationID),
+		"Contracts":     userContracts(db, editUser.ID),
+		"Memberships":   projectMemberships(db, editUser.ID),
+		"TeamHistory":   teamHistory(db, editUser.ID),
+		"Today":         user.Now().Format("2006-01-02"),
+		"Timezones":     commonTimezones,
+		"Currency":      loadAppSettings(db, h.config, user.OrganizationID).Currency,
+		"Error":         flash.Error,
+	}
+	render(w, r, h.templates, "user-edit", data)
 }
 
 func (h *AuthHandler) UpdateUser(w http.ResponseWriter, r *http.Request) {
@@ -510,22 +803,22 @@ func (h *AuthHandler) UpdateUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := r.ParseForm(); err != nil {
-		http.Redirect(w, r, "/users?error=Invalid+form+data", http.StatusSeeOther)
+		redirectWithError(w, r, "/users", "Invalid form data")
 		return
 	}
 
 	idStr := r.FormValue("id")
 	id, err := strconv.ParseUint(idStr, 10, 32)
 	if err != nil {
-		http.Redirect(w, r, "/users?error=Invalid+user+ID", http.StatusSeeOther)
+		redirectWithError(w, r, "/users", "Invalid user ID")
 		return
 	}
 
-	db := database.GetDB()
+	db := h.db.WithContext(r.Context())
 
 	var editUser models.User
-	if err := db.First(&editUser, id).Error; err != nil {
-		http.Redirect(w, r, "/users?error=User+not+found", http.StatusSeeOther)
+	if err := db.Scopes(inOrganization(user.OrganizationID)).First(&editUser, id).Error; err != nil {
+		redirectWithError(w, r, "/users", "User not found")
 		return
 	}
 
@@ -535,6 +828,19 @@ func (h *AuthHandler) UpdateUser(w http.ResponseWriter, r *http.Request) {
 		editUser.FullName = fullName
 	}
 
+	editUser.Email = strings.TrimSpace(r.FormValue("email"))
+	if taken, err := services.EmailTaken(db, editUser.Email, editUser.ID); err != nil || taken {
+		redirectWithFormError(w, r, "/users/edit?id="+idStr, "Email address is already used by another account")
+		return
+	}
+
+	timezone, ok := parseTimezone(r.FormValue("timezone"))
+	if !ok {
+		redirectWithFormError(w, r, "/users/edit?id="+idStr, "Unknown timezone")
+		return
+	}
+	editUser.Timezone = timezone
+
 	// Update role
 	roleStr := r.FormValue("role")
 	switch roleStr {
@@ -548,34 +854,84 @@ func (h *AuthHandler) UpdateUser(w http.ResponseWriter, r *http.Request) {
 		editUser.Role = models.RoleAdmin
 	}
 
-	// Update team
-	teamIDStr := r.FormValue("team_id")
-	if teamIDStr == "" {
-		editUser.TeamID = nil
-	} else {
-		if tid, err := strconv.ParseUint(teamIDStr, 10, 32); err == nil {
-			teamID := uint(tid)
-			editUser.TeamID = &teamID
+	// An empty cost center falls back to the team's
+	costCenterID, ok := parseCostCenter(db, r.FormValue("cost_center_id"), user.OrganizationID)
+	if !ok {
+		redirectWithFormError(w, r, "/users/edit?id="+idStr, "Cost center not found")
+		return
+	}
+	editUser.CostCenterID = costCenterID
+
+	// An empty rate falls back to the project's
+	editUser.HourlyRate = nil
+	if value := r.FormValue("hourly_rate"); strings.TrimSpace(value) != "" {
+		rate, ok := parseHourlyRate(value)
+		if !ok {
+			redirectWithFormError(w, r, "/users/edit?id="+idStr, fmt.Sprintf("Hourly rate must be between 0 and %d", maxHourlyRate))
+			return
 		}
+		editUser.HourlyRate = &rate
 	}
 
-	// Update project
-	projectIDStr := r.FormValue("project_id")
-	if projectIDStr == "" {
-		editUser.ProjectID = nil
-	} else {
-		if pid, err := strconv.ParseUint(projectIDStr, 10, 32); err == nil {
-			projectID := uint(pid)
-			editUser.ProjectID = &projectID
+	employeeNumber, ok := parseIdentifier(r.FormValue("employee_number"), maxEmployeeNumberLength)
+	if !ok {
+		redirectWithFormError(w, r, "/users/edit?id="+idStr, fmt.Sprintf("Employee number may have at most %d characters", maxEmployeeNumberLength))
+		return
+	}
+	if identifierTaken(db, user.OrganizationID, "employee_number", employeeNumber, editUser.ID) {
+		redirectWithFormError(w, r, "/users/edit?id="+idStr, "Employee number is already used by another user")
+		return
+	}
+	editUser.EmployeeNumber = employeeNumber
+
+	externalID, ok := parseIdentifier(r.FormValue("external_id"), maxExternalIDLength)
+	if !ok {
+		redirectWithFormError(w, r, "/users/edit?id="+idStr, fmt.Sprintf("External ID may have at most %d characters", maxExternalIDLength))
+		return
+	}
+	if identifierTaken(db, user.OrganizationID, "external_id", externalID, editUser.ID) {
+		redirectWithFormError(w, r, "/users/edit?id="+idStr, "External ID is already used by another user")
+		return
+	}
+	editUser.ExternalID = externalID
+
+	jiraAccountID := strings.TrimSpace(r.FormValue("jira_account_id"))
+	if jiraAccountID != "" {
+		var linked models.JiraAccount
+		if err := db.Where("account_id = ? AND user_id <> ?", jiraAccountID, editUser.ID).First(&linked).Error; err == nil {
+			redirectWithFormError(w, r, "/users/edit?id="+idStr, "Jira account is already linked to another user")
+			return
 		}
 	}
 
-	if err := db.Save(&editUser).Error; err != nil {
-		http.Redirect(w, r, "/users/edit?id="+idStr+"&error=Failed+to+update+user", http.StatusSeeOther)
+	// Team and home project change through UpdateMembership
+	if err := db.Omit("team_id", "project_id").Save(&editUser).Error; err != nil {
+		redirectWithFormError(w, r, "/users/edit?id="+idStr, "Failed to update user")
 		return
 	}
 
-	http.Redirect(w, r, "/users?success=User+updated+successfully", http.StatusSeeOther)
+	if err := linkJiraAccount(db, editUser.ID, jiraAccountID); err != nil {
+		redirectWithFormError(w, r, "/users/edit?id="+idStr, "Failed to update Jira account")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/users", "User updated successfully")
+}
+
+// linkJiraAccount maps the user to a Jira account for worklog imports, or
+// removes the mapping when accountID is empty
+func linkJiraAccount(db *gorm.DB, userID uint, accountID string) error {
+	if accountID == "" {
+		return db.Where("user_id = ?", userID).Delete(&models.JiraAccount{}).Error
+	}
+
+	var account models.JiraAccount
+	if err := db.Where("user_id = ?", userID).Limit(1).Find(&account).Error; err != nil {
+		return err
+	}
+	account.UserID = userID
+	account.AccountID = accountID
+	return db.Save(&account).Error
 }
 
 func (h *AuthHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
@@ -586,38 +942,93 @@ func (h *AuthHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := r.ParseForm(); err != nil {
-		http.Redirect(w, r, "/users?error=Invalid+form+data", http.StatusSeeOther)
+		redirectWithError(w, r, "/users", "Invalid form data")
 		return
 	}
 
 	idStr := r.FormValue("id")
 	id, err := strconv.ParseUint(idStr, 10, 32)
 	if err != nil {
-		http.Redirect(w, r, "/users?error=Invalid+user+ID", http.StatusSeeOther)
+		redirectWithError(w, r, "/users", "Invalid user ID")
 		return
 	}
 
 	// Prevent self-deletion
 	if uint(id) == user.ID {
-		http.Redirect(w, r, "/users?error=Cannot+delete+your+own+account", http.StatusSeeOther)
+		redirectWithError(w, r, "/users", "Cannot delete your own account")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	err = services.DeleteUser(db, user.OrganizationID, uint(id))
+	switch {
+	case errors.Is(err, services.ErrNotFound):
+		redirectWithError(w, r, "/users", "User not found")
+		return
+	case err != nil:
+		redirectWithError(w, r, "/users", "Failed to delete user")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/users", "User deleted successfully")
+}
+
+// MergeUsers folds a duplicate account into the one the person keeps, e.g.
+// after they were invited twice, and deactivates the duplicate
+func (h *AuthHandler) MergeUsers(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
-	db := database.GetDB()
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/users", "Invalid form data")
+		return
+	}
 
-	// Delete user's overtime entries first
-	if err := db.Where("user_id = ?", id).Delete(&models.OvertimeEntry{}).Error; err != nil {
-		http.Redirect(w, r, "/users?error=Failed+to+delete+user+entries", http.StatusSeeOther)
+	sourceID, err := strconv.ParseUint(r.FormValue("source_id"), 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/users", "Invalid user ID")
+		return
+	}
+	targetID, err := strconv.ParseUint(r.FormValue("target_id"), 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/users", "Invalid user ID")
+		return
+	}
+	if sourceID == targetID {
+		redirectWithError(w, r, "/users", "Choose two different users to merge")
+		return
+	}
+	if uint(sourceID) == user.ID {
+		redirectWithError(w, r, "/users", "Cannot merge your own account into another")
 		return
 	}
 
-	// Delete the user (soft delete since User has DeletedAt)
-	if err := db.Delete(&models.User{}, id).Error; err != nil {
-		http.Redirect(w, r, "/users?error=Failed+to+delete+user", http.StatusSeeOther)
+	db := h.db.WithContext(r.Context())
+	source, target, err := services.MergeUsers(db, user.OrganizationID, uint(sourceID), uint(targetID))
+	switch {
+	case errors.Is(err, services.ErrNotFound):
+		redirectWithError(w, r, "/users", "User not found")
+		return
+	case errors.Is(err, services.ErrDeactivated):
+		redirectWithError(w, r, "/users", "Deactivated users cannot be merged")
+		return
+	case errors.Is(err, services.ErrAlreadyAnonymized):
+		redirectWithError(w, r, "/users", "Cannot merge into an anonymized user")
+		return
+	case err != nil:
+		redirectWithError(w, r, "/users", "Failed to merge users")
 		return
 	}
 
-	http.Redirect(w, r, "/users?success=User+deleted+successfully", http.StatusSeeOther)
+	recordAudit(db, r, user.OrganizationID, &target.ID, models.AuditUsersMerged,
+		fmt.Sprintf("%s (%d) merged into this account by %s", source.Username, source.ID, user.Username))
+	recordAudit(db, r, user.OrganizationID, &source.ID, models.AuditUsersMerged,
+		fmt.Sprintf("merged into %s (%d) and deactivated by %s", target.Username, target.ID, user.Username))
+
+	redirectWithSuccess(w, r, "/users", fmt.Sprintf("%s merged into %s", source.Username, target.Username))
 }
 
 func (h *AuthHandler) TeamsPage(w http.ResponseWriter, r *http.Request) {
@@ -627,18 +1038,15 @@ func (h *AuthHandler) TeamsPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db := database.GetDB()
+	db := h.db.WithContext(r.Context())
 
-	var teams []models.Team
-	db.Find(&teams)
+	teams := organizationTeams(db, h.cache, user.OrganizationID)
 
 	data := map[string]interface{}{
-		"User":    user,
-		"Teams":   teams,
-		"Error":   r.URL.Query().Get("error"),
-		"Success": r.URL.Query().Get("success"),
+		"Teams":       teams,
+		"CostCenters": organizationCostCenters(db, h.cache, user.OrganizationID),
 	}
-	h.templates["teams"].ExecuteTemplate(w, "base", data)
+	render(w, r, h.templates, "teams", data)
 }
 
 func (h *AuthHandler) CreateTeam(w http.ResponseWriter, r *http.Request) {
@@ -649,23 +1057,30 @@ func (h *AuthHandler) CreateTeam(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := r.ParseForm(); err != nil {
-		http.Redirect(w, r, "/teams?error=Invalid+form+data", http.StatusSeeOther)
+		redirectWithError(w, r, "/teams", "Invalid form data")
 		return
 	}
 
 	name := r.FormValue("name")
 	if name == "" {
-		http.Redirect(w, r, "/teams?error=Team+name+is+required", http.StatusSeeOther)
+		redirectWithError(w, r, "/teams", "Team name is required")
 		return
 	}
 
-	team := models.Team{Name: name}
-	if err := database.GetDB().Create(&team).Error; err != nil {
-		http.Redirect(w, r, "/teams?error=Failed+to+create+team", http.StatusSeeOther)
+	team := models.Team{
+		OrganizationID:    user.OrganizationID,
+		Name:              name,
+		RequireHRApproval: r.FormValue("require_hr_approval") == "on",
+	}
+	db := h.db.WithContext(r.Context())
+	if err := db.Create(&team).Error; err != nil {
+		redirectWithError(w, r, "/teams", "Failed to create team")
 		return
 	}
 
-	http.Redirect(w, r, "/teams?success=Team+created+successfully", http.StatusSeeOther)
+	h.cache.Delete(teamsCacheKey(user.OrganizationID))
+
+	redirectWithSuccess(w, r, "/teams", "Team created successfully")
 }
 
 func (h *AuthHandler) DeleteTeam(w http.ResponseWriter, r *http.Request) {
@@ -676,33 +1091,126 @@ func (h *AuthHandler) DeleteTeam(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := r.ParseForm(); err != nil {
-		http.Redirect(w, r, "/teams?error=Invalid+form+data", http.StatusSeeOther)
+		redirectWithError(w, r, "/teams", "Invalid form data")
 		return
 	}
 
 	idStr := r.FormValue("id")
 	id, err := strconv.ParseUint(idStr, 10, 32)
 	if err != nil {
-		http.Redirect(w, r, "/teams?error=Invalid+team+ID", http.StatusSeeOther)
+		redirectWithError(w, r, "/teams", "Invalid team ID")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	err = services.DeleteTeam(db, user.OrganizationID, uint(id))
+	switch {
+	case errors.Is(err, services.ErrNotFound):
+		redirectWithError(w, r, "/teams", "Team not found")
+		return
+	case errors.Is(err, services.ErrInUse):
+		redirectWithError(w, r, "/teams", "Cannot delete team with assigned users")
+		return
+	case err != nil:
+		redirectWithError(w, r, "/teams", "Failed to delete team")
 		return
 	}
 
-	db := database.GetDB()
+	h.cache.Delete(teamsCacheKey(user.OrganizationID))
 
-	// Check if any users are assigned to this team
-	var userCount int64
-	db.Model(&models.User{}).Where("team_id = ?", id).Count(&userCount)
-	if userCount > 0 {
-		http.Redirect(w, r, "/teams?error=Cannot+delete+team+with+assigned+users", http.StatusSeeOther)
+	redirectWithSuccess(w, r, "/teams", "Team deleted successfully")
+}
+
+// UpdateTeamApprovalChain switches a team between supervisor-only and supervisor → HR approval
+func (h *AuthHandler) UpdateTeamApprovalChain(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
-	if err := db.Delete(&models.Team{}, id).Error; err != nil {
-		http.Redirect(w, r, "/teams?error=Failed+to+delete+team", http.StatusSeeOther)
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/teams", "Invalid form data")
 		return
 	}
 
-	http.Redirect(w, r, "/teams?success=Team+deleted+successfully", http.StatusSeeOther)
+	idStr := r.FormValue("id")
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/teams", "Invalid team ID")
+		return
+	}
+
+	var requireHR bool
+	switch r.FormValue("chain") {
+	case "supervisor":
+		requireHR = false
+	case "supervisor_hr":
+		requireHR = true
+	default:
+		redirectWithError(w, r, "/teams", "Invalid approval chain")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	result := db.Model(&models.Team{}).Scopes(inOrganization(user.OrganizationID)).Where("id = ?", id).Update("require_hr_approval", requireHR)
+	if result.Error != nil || result.RowsAffected == 0 {
+		redirectWithError(w, r, "/teams", "Failed to update approval chain")
+		return
+	}
+
+	h.cache.Delete(teamsCacheKey(user.OrganizationID))
+
+	redirectWithSuccess(w, r, "/teams", "Approval chain updated")
+}
+
+func (h *AuthHandler) UpdateTeamCalendar(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/teams", "Invalid form data")
+		return
+	}
+
+	idStr := r.FormValue("id")
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/teams", "Invalid team ID")
+		return
+	}
+
+	calendarURL := strings.TrimSpace(r.FormValue("calendar_url"))
+	if calendarURL != "" {
+		if parsed, err := url.Parse(calendarURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			redirectWithError(w, r, "/teams", "Calendar URL must be an http(s) URL")
+			return
+		}
+		if !h.calendar.Accepts(calendarURL) {
+			redirectWithError(w, r, "/teams", "Calendar URL must be on the CalDAV server "+h.config.CalDAVURL)
+			return
+		}
+	}
+
+	db := h.db.WithContext(r.Context())
+	result := db.Model(&models.Team{}).Scopes(inOrganization(user.OrganizationID)).Where("id = ?", id).Update("calendar_url", calendarURL)
+	if result.Error != nil || result.RowsAffected == 0 {
+		redirectWithError(w, r, "/teams", "Failed to update calendar")
+		return
+	}
+	h.cache.Delete(teamsCacheKey(user.OrganizationID))
+
+	if calendarURL == "" {
+		redirectWithSuccess(w, r, "/teams", "Calendar publishing disabled")
+		return
+	}
+
+	// Publish the team's existing approved overtime to the new calendar
+	go h.calendar.SyncTeam(uint(id))
+	redirectWithSuccess(w, r, "/teams", "Calendar updated, approved overtime is being published")
 }
 
 func (h *AuthHandler) ProjectsPage(w http.ResponseWriter, r *http.Request) {
@@ -712,18 +1220,15 @@ func (h *AuthHandler) ProjectsPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db := database.GetDB()
+	db := h.db.WithContext(r.Context())
 
-	var projects []models.Project
-	db.Find(&projects)
+	projects := organizationProjects(db, h.cache, user.OrganizationID)
 
 	data := map[string]interface{}{
-		"User":     user,
 		"Projects": projects,
-		"Error":    r.URL.Query().Get("error"),
-		"Success":  r.URL.Query().Get("success"),
+		"Currency": loadAppSettings(db, h.config, user.OrganizationID).Currency,
 	}
-	h.templates["projects"].ExecuteTemplate(w, "base", data)
+	render(w, r, h.templates, "projects", data)
 }
 
 func (h *AuthHandler) CreateProject(w http.ResponseWriter, r *http.Request) {
@@ -734,26 +1239,39 @@ func (h *AuthHandler) CreateProject(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := r.ParseForm(); err != nil {
-		http.Redirect(w, r, "/projects?error=Invalid+form+data", http.StatusSeeOther)
+		redirectWithError(w, r, "/projects", "Invalid form data")
 		return
 	}
 
 	name := r.FormValue("name")
 	if name == "" {
-		http.Redirect(w, r, "/projects?error=Project+name+is+required", http.StatusSeeOther)
+		redirectWithError(w, r, "/projects", "Project name is required")
 		return
 	}
 
-	project := models.Project{Name: name}
-	if err := database.GetDB().Create(&project).Error; err != nil {
-		http.Redirect(w, r, "/projects?error=Failed+to+create+project", http.StatusSeeOther)
+	var rate float64
+	if value := r.FormValue("hourly_rate"); strings.TrimSpace(value) != "" {
+		var ok bool
+		if rate, ok = parseHourlyRate(value); !ok {
+			redirectWithError(w, r, "/projects", fmt.Sprintf("Hourly rate must be between 0 and %d", maxHourlyRate))
+			return
+		}
+	}
+
+	project := models.Project{OrganizationID: user.OrganizationID, Name: name, HourlyRate: rate}
+	db := h.db.WithContext(r.Context())
+	if err := db.Create(&project).Error; err != nil {
+		redirectWithError(w, r, "/projects", "Failed to create project")
 		return
 	}
 
-	http.Redirect(w, r, "/projects?success=Project+created+successfully", http.StatusSeeOther)
+	h.cache.Delete(projectsCacheKey(user.OrganizationID))
+
+	redirectWithSuccess(w, r, "/projects", "Project created successfully")
 }
 
-func (h *AuthHandler) DeleteProject(w http.ResponseWriter, r *http.Request) {
+// UpdateProjectRate sets what an hour of overtime on a project costs
+func (h *AuthHandler) UpdateProjectRate(w http.ResponseWriter, r *http.Request) {
 	user := middleware.GetUserFromContext(r.Context())
 	if !user.IsAdmin() {
 		http.Error(w, "Forbidden", http.StatusForbidden)
@@ -761,31 +1279,69 @@ func (h *AuthHandler) DeleteProject(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := r.ParseForm(); err != nil {
-		http.Redirect(w, r, "/projects?error=Invalid+form+data", http.StatusSeeOther)
+		redirectWithError(w, r, "/projects", "Invalid form data")
 		return
 	}
 
 	idStr := r.FormValue("id")
 	id, err := strconv.ParseUint(idStr, 10, 32)
 	if err != nil {
-		http.Redirect(w, r, "/projects?error=Invalid+project+ID", http.StatusSeeOther)
+		redirectWithError(w, r, "/projects", "Invalid project ID")
 		return
 	}
 
-	db := database.GetDB()
+	rate, ok := parseHourlyRate(r.FormValue("hourly_rate"))
+	if !ok {
+		redirectWithError(w, r, "/projects", fmt.Sprintf("Hourly rate must be between 0 and %d", maxHourlyRate))
+		return
+	}
 
-	// Check if any users are assigned to this project
-	var userCount int64
-	db.Model(&models.User{}).Where("project_id = ?", id).Count(&userCount)
-	if userCount > 0 {
-		http.Redirect(w, r, "/projects?error=Cannot+delete+project+with+assigned+users", http.StatusSeeOther)
+	db := h.db.WithContext(r.Context())
+	result := db.Model(&models.Project{}).Scopes(inOrganization(user.OrganizationID)).Where("id = ?", id).Update("hourly_rate", rate)
+	if result.Error != nil || result.RowsAffected == 0 {
+		redirectWithError(w, r, "/projects", "Failed to update hourly rate")
 		return
 	}
 
-	if err := db.Delete(&models.Project{}, id).Error; err != nil {
-		http.Redirect(w, r, "/projects?error=Failed+to+delete+project", http.StatusSeeOther)
+	h.cache.Delete(projectsCacheKey(user.OrganizationID))
+
+	redirectWithSuccess(w, r, "/projects", "Hourly rate updated")
+}
+
+func (h *AuthHandler) DeleteProject(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/projects", "Invalid form data")
 		return
 	}
 
-	http.Redirect(w, r, "/projects?success=Project+deleted+successfully", http.StatusSeeOther)
+	idStr := r.FormValue("id")
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/projects", "Invalid project ID")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	err = services.DeleteProject(db, user.OrganizationID, uint(id))
+	switch {
+	case errors.Is(err, services.ErrNotFound):
+		redirectWithError(w, r, "/projects", "Project not found")
+		return
+	case errors.Is(err, services.ErrInUse):
+		redirectWithError(w, r, "/projects", "Cannot delete project with assigned users or logged overtime")
+		return
+	case err != nil:
+		redirectWithError(w, r, "/projects", "Failed to delete project")
+		return
+	}
+
+	h.cache.Delete(projectsCacheKey(user.OrganizationID))
+
+	redirectWithSuccess(w, r, "/projects", "Project deleted successfully")
 }
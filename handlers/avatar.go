@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"overtime/config"
+	"overtime/middleware"
+	"overtime/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxAvatarUpload limits uploaded pictures, they are scaled down before
+// being stored
+const maxAvatarUpload = 2 << 20
+
+// maxAvatarPixels refuses pictures that would take too much memory to
+// decode, however small the file
+const maxAvatarPixels = 25_000_000
+
+// avatarSize is the width and height of stored avatars, twice the size they
+// are shown at for high resolution screens
+const avatarSize = 64
+
+// Avatar is how a user is pictured next to their name: the uploaded avatar
+// or Gravatar at URL, otherwise their initials
+type Avatar struct {
+	URL      string
+	Initials string
+	Name     string
+}
+
+// AvatarFor returns the avatar of a user. It backs the avatar template
+// function.
+func AvatarFor(cfg *config.Config, user *models.User) Avatar {
+	if user == nil {
+		return Avatar{}
+	}
+	avatar := Avatar{Name: user.DisplayName(), Initials: initials(user.DisplayName())}
+	switch {
+	case user.AvatarVersion != 0:
+		avatar.URL = fmt.Sprintf("/avatar?user=%d&v=%d", user.ID, user.AvatarVersion)
+	case cfg.Gravatar && user.Email != "":
+		hash := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(user.Email))))
+		avatar.URL = fmt.Sprintf("https://www.gravatar.com/avatar/%x?s=%d&d=identicon", hash, avatarSize)
+	}
+	return avatar
+}
+
+// initials are the first letters of the first and last word of a name
+func initials(name string) string {
+	words := strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) == 0 {
+		return "?"
+	}
+	first := []rune(words[0])[:1]
+	if len(words) > 1 {
+		first = append(first, []rune(words[len(words)-1])[0])
+	}
+	return strings.ToUpper(string(first))
+}
+
+// scaleAvatar crops the middle square out of a picture and scales it to
+// avatarSize, averaging the pixels that fall on each avatar pixel
+func scaleAvatar(src image.Image) *image.RGBA {
+	bounds := src.Bounds()
+	side := min(bounds.Dx(), bounds.Dy())
+	square := image.Rect(0, 0, side, side)
+	offset := image.Pt(bounds.Min.X+(bounds.Dx()-side)/2, bounds.Min.Y+(bounds.Dy()-side)/2)
+	cropped := image.NewRGBA(square)
+	draw.Draw(cropped, square, src, offset, draw.Src)
+
+	scaled := image.NewRGBA(image.Rect(0, 0, avatarSize, avatarSize))
+	for y := 0; y < avatarSize; y++ {
+		y0, y1 := y*side/avatarSize, max((y+1)*side/avatarSize, y*side/avatarSize+1)
+		for x := 0; x < avatarSize; x++ {
+			x0, x1 := x*side/avatarSize, max((x+1)*side/avatarSize, x*side/avatarSize+1)
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := cropped.Pix[cropped.PixOffset(x0, sy):cropped.PixOffset(x1, sy)]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			i := scaled.PixOffset(x, y)
+			for c := range sum {
+				scaled.Pix[i+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return scaled
+}
+
+// readAvatar decodes an uploaded PNG, JPEG or GIF and returns it as a
+// scaled PNG
+func readAvatar(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxAvatarUpload+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxAvatarUpload {
+		return nil, importError("The picture is too large (at most 2 MB)")
+	}
+	imageConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, importError("The picture must be a PNG, JPEG or GIF image")
+	}
+	if imageConfig.Width*imageConfig.Height > maxAvatarPixels {
+		return nil, importError("The picture has too many pixels")
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil || src.Bounds().Empty() {
+		return nil, importError("The picture could not be read")
+	}
+
+	var scaled bytes.Buffer
+	if err := png.Encode(&scaled, scaleAvatar(src)); err != nil {
+		return nil, err
+	}
+	return scaled.Bytes(), nil
+}
+
+// UpdateAvatar stores the picture the user uploaded on their profile, or
+// removes it
+func (h *AuthHandler) UpdateAvatar(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	db := h.db.WithContext(r.Context())
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAvatarUpload+(64<<10))
+	if err := r.ParseMultipartForm(maxAvatarUpload); err != nil {
+		redirectWithError(w, r, "/profile", "Invalid form data (the picture may be too large, at most 2 MB)")
+		return
+	}
+
+	if r.FormValue("remove") != "" {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("user_id = ?", user.ID).Delete(&models.Avatar{}).Error; err != nil {
+				return err
+			}
+			return tx.Model(user).Update("avatar_version", 0).Error
+		})
+		if err != nil {
+			redirectWithError(w, r, "/profile", "Failed to remove the picture")
+			return
+		}
+		redirectWithSuccess(w, r, "/profile", "Picture removed")
+		return
+	}
+
+	file, _, err := r.FormFile("avatar")
+	if err != nil {
+		redirectWithError(w, r, "/profile", "Choose a picture to upload")
+		return
+	}
+	defer file.Close()
+
+	data, err := readAvatar(file)
+	var message importError
+	if errors.As(err, &message) {
+		redirectWithError(w, r, "/profile", message.Error())
+		return
+	}
+	if err != nil {
+		redirectWithError(w, r, "/profile", "Failed to read the picture")
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		avatar := models.Avatar{UserID: user.ID, Data: data}
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"data", "updated_at"}),
+		}).Create(&avatar).Error; err != nil {
+			return err
+		}
+		return tx.Model(user).Update("avatar_version", time.Now().UnixNano()).Error
+	})
+	if err != nil {
+		redirectWithError(w, r, "/profile", "Failed to save the picture")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/profile", "Picture updated")
+}
+
+// ServeAvatar serves the uploaded avatar of a user of the same organization
+func (h *AuthHandler) ServeAvatar(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	id, err := strconv.ParseUint(r.URL.Query().Get("user"), 10, 32)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	var avatar models.Avatar
+	err = db.Where("user_id = ? AND user_id IN (?)", id,
+		db.Model(&models.User{}).Select("id").Scopes(inOrganization(user.OrganizationID))).
+		First(&avatar).Error
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Avatar URLs carry the avatar version, so a new picture gets a new URL
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Write(avatar.Data)
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"overtime/backup"
+	"overtime/config"
+	"overtime/middleware"
+)
+
+type BackupHandler struct {
+	config    *config.Config
+	templates map[string]*template.Template
+	backups   *backup.Service
+}
+
+func NewBackupHandler(cfg *config.Config, templates map[string]*template.Template, backups *backup.Service) *BackupHandler {
+	return &BackupHandler{
+		config:    cfg,
+		templates: templates,
+		backups:   backups,
+	}
+}
+
+// BackupsPage lists the database backups (platform admins only). Backups
+// cover every organization, so organization admins have no access.
+func (h *BackupHandler) BackupsPage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanManageOrganizations() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	flash := middleware.PopFlash(w, r)
+	names, err := h.backups.List()
+	if err != nil {
+		log.Printf("Failed to list backups: %v", err)
+		if flash.Error == "" {
+			flash.Error = "Failed to list backups"
+		}
+	}
+
+	// Newest first
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+
+	data := map[string]interface{}{
+		"Backups":   names,
+		"Location":  h.backups.Location(),
+		"Encrypted": h.backups.Encrypted(),
+		"Interval":  h.config.BackupInterval,
+		"Keep":      h.config.BackupKeep,
+		"Error":     flash.Error,
+		"Success":   flash.Success,
+	}
+	render(w, r, h.templates, "backups", data)
+}
+
+// CreateBackup backs the database up right away
+func (h *BackupHandler) CreateBackup(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanManageOrganizations() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	name, err := h.backups.Backup()
+	if errors.Is(err, backup.ErrRunning) {
+		redirectWithError(w, r, "/backups", "A backup is already running, try again in a moment")
+		return
+	}
+	if err != nil {
+		log.Printf("Backup failed: %v", err)
+		redirectWithError(w, r, "/backups", "Backup failed, see the server log")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/backups", "Backup "+name+" created")
+}
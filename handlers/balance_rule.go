@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"net/http"
+	"overtime/middleware"
+	"overtime/models"
+	"strconv"
+	"strings"
+)
+
+// CreateBalanceRule adds a limit on the balance carried over into the next
+// period. It first applies at the end of the current period.
+func (h *SettingsHandler) CreateBalanceRule(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/settings", "Invalid form data")
+		return
+	}
+
+	period := models.BalancePeriod(r.FormValue("period"))
+	if !period.Valid() {
+		redirectWithFormError(w, r, "/settings", "Invalid period")
+		return
+	}
+	maxHours, err := strconv.ParseFloat(strings.TrimSpace(r.FormValue("max_hours")), 64)
+	if err != nil || maxHours < 0 || maxHours > 10000 {
+		redirectWithFormError(w, r, "/settings", "Hours carried over must be between 0 and 10000")
+		return
+	}
+
+	rule := models.BalanceRule{OrganizationID: user.OrganizationID, Period: period, MaxHours: maxHours}
+	db := h.db.WithContext(r.Context())
+	if err := db.Create(&rule).Error; err != nil {
+		redirectWithFormError(w, r, "/settings", "Failed to add balance rule")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/settings", "Balance rule added")
+}
+
+// DeleteBalanceRule stops applying a rule. The hours it let expire stay
+// expired.
+func (h *SettingsHandler) DeleteBalanceRule(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/settings", "Invalid form data")
+		return
+	}
+
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/settings", "Invalid balance rule ID")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	result := db.Scopes(inOrganization(user.OrganizationID)).Delete(&models.BalanceRule{}, id)
+	if result.Error != nil {
+		redirectWithError(w, r, "/settings", "Failed to delete balance rule")
+		return
+	}
+	if result.RowsAffected == 0 {
+		redirectWithError(w, r, "/settings", "Balance rule not found")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/settings", "Balance rule deleted")
+}
@@ -0,0 +1,274 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"overtime/config"
+	"overtime/middleware"
+	"overtime/models"
+	"overtime/store"
+)
+
+// maxBulkShiftDays limits how far a bulk edit may move entries at once
+const maxBulkShiftDays = 366
+
+var errEntriesMissing = errors.New("selected entries not found")
+
+// bulkEdit is what a bulk edit changes on every selected entry. A zero
+// value field is left alone.
+type bulkEdit struct {
+	date      string
+	shiftDays int
+	status    models.EntryStatus
+	reason    string
+}
+
+// describe summarizes the changes for flash messages and the audit log
+func (b bulkEdit) describe() string {
+	var changes []string
+	if b.date != "" {
+		changes = append(changes, "moved to "+b.date)
+	}
+	if b.shiftDays != 0 {
+		changes = append(changes, fmt.Sprintf("moved by %+d days", b.shiftDays))
+	}
+	if b.status != "" {
+		changes = append(changes, "set to "+strings.ToLower(string(b.status)))
+	}
+	return strings.Join(changes, ", ")
+}
+
+// apply changes the entry's date and status. Moved entries are checked like
+// an edit of a single entry, entries that worked time was entered for get
+// their overtime recalculated against the contract of the new day. Status
+// changes take a reviewer of the entry's approval stage, and approving the
+// supervisor stage of an entry whose team requires HR approval advances it
+// to the HR stage like a single approval does. entry.User.Team must be
+// loaded.
+func (b bulkEdit) apply(ctx context.Context, tx store.Store, cfg *config.Config, r *http.Request, user *models.User, entry *models.OvertimeEntry, now time.Time) error {
+	edited := *entry
+	if b.date != "" {
+		date, err := time.ParseInLocation("2006-01-02", b.date, entry.Date.Location())
+		if err != nil {
+			return models.ErrInvalidDate
+		}
+		edited.Date = date
+	}
+	if b.shiftDays != 0 {
+		edited.Date = edited.Date.AddDate(0, 0, b.shiftDays)
+	}
+
+	if edited.Date.Format("2006-01-02") != entry.Date.Format("2006-01-02") {
+		if err := recordEntryDay(ctx, tx, &edited); err != nil {
+			return err
+		}
+		if err := applyWorkedHours(ctx, tx, &edited); err != nil {
+			return err
+		}
+		if !dateOverride(r, user) {
+			if err := checkMonthOpen(ctx, tx, cfg, user.OrganizationID, entry.Date); err != nil {
+				return err
+			}
+			if err := checkEntryDate(ctx, tx, cfg, &edited); err != nil {
+				return err
+			}
+		}
+		if err := checkEntryCaps(ctx, tx, cfg, &edited); err != nil {
+			return err
+		}
+	}
+
+	if b.status != "" && b.status != entry.Status {
+		if !user.CanReviewEntry(entry) {
+			return models.EntryError("You may not decide on the entry at its approval stage")
+		}
+		edited.Status = b.status
+		edited.ReviewComment = ""
+		switch b.status {
+		case models.StatusPending:
+			// Back to the start of the approval chain, like a resubmission
+			edited.Stage = models.StageSupervisor
+			edited.ReviewedBy = nil
+			edited.ReviewedAt = nil
+			edited.SupervisorApprovedBy = nil
+			edited.SupervisorApprovedAt = nil
+		case models.StatusApproved:
+			if entry.IsPending() && entry.Stage != models.StageHR &&
+				entry.User.Team != nil && entry.User.Team.RequireHRApproval {
+				edited.Status = models.StatusPending
+				edited.Stage = models.StageHR
+				edited.SupervisorApprovedBy = &user.ID
+				edited.SupervisorApprovedAt = &now
+				break
+			}
+			edited.ReviewedBy = &user.ID
+			edited.ReviewedAt = &now
+		case models.StatusRejected:
+			edited.ReviewComment = b.reason
+			fallthrough
+		default:
+			edited.ReviewedBy = &user.ID
+			edited.ReviewedAt = &now
+		}
+	}
+
+	edited.UpdatedBy = &user.ID
+	if err := tx.SaveEntry(ctx, &edited); err != nil {
+		return err
+	}
+	*entry = edited
+	return nil
+}
+
+// BulkEditEntries moves the selected entries to another date or by a number
+// of days and sets their approval status, all or nothing. Every affected
+// user gets an audit log entry listing what changed.
+func (h *OvertimeHandler) BulkEditEntries(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanViewAllOvertime() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/overtime/all", "Invalid form data")
+		return
+	}
+
+	// Return to the list as it was filtered
+	back := "/overtime/all"
+	if query, err := url.ParseQuery(r.FormValue("query")); err == nil && len(query) > 0 {
+		back += "?" + query.Encode()
+	}
+
+	var ids []uint
+	for _, idStr := range r.Form["entry_ids"] {
+		id, err := strconv.ParseUint(idStr, 10, 32)
+		if err != nil {
+			redirectWithError(w, r, back, "Invalid entry ID")
+			return
+		}
+		ids = append(ids, uint(id))
+	}
+	if len(ids) == 0 {
+		redirectWithError(w, r, back, "No entries selected")
+		return
+	}
+
+	edit := bulkEdit{
+		date:   r.FormValue("date"),
+		status: models.EntryStatus(r.FormValue("status")),
+		reason: strings.TrimSpace(r.FormValue("reason")),
+	}
+	if shift := strings.TrimSpace(r.FormValue("shift_days")); shift != "" {
+		days, err := strconv.Atoi(shift)
+		if err != nil || days < -maxBulkShiftDays || days > maxBulkShiftDays {
+			redirectWithError(w, r, back, fmt.Sprintf("Days to move by must be between %d and %d", -maxBulkShiftDays, maxBulkShiftDays))
+			return
+		}
+		edit.shiftDays = days
+	}
+	if edit.date != "" && edit.shiftDays != 0 {
+		redirectWithError(w, r, back, "Either set a date or move by a number of days, not both")
+		return
+	}
+	switch edit.status {
+	case "", models.StatusPending, models.StatusApproved:
+	case models.StatusRejected:
+		if edit.reason == "" {
+			redirectWithError(w, r, back, "A reason is required to reject entries")
+			return
+		}
+		if len(edit.reason) > 500 {
+			redirectWithError(w, r, back, "The reason may have at most 500 characters")
+			return
+		}
+	default:
+		redirectWithError(w, r, back, "Invalid status")
+		return
+	}
+	changes := edit.describe()
+	if changes == "" {
+		redirectWithError(w, r, back, "Nothing to change")
+		return
+	}
+
+	ctx := r.Context()
+	now := time.Now()
+	var entries, statusChanged []models.OvertimeEntry
+	err := h.store.Transaction(ctx, func(tx store.Store) error {
+		var err error
+		if entries, err = tx.Entries(ctx, user.OrganizationID, ids); err != nil {
+			return err
+		}
+		if len(entries) != len(ids) {
+			return errEntriesMissing
+		}
+
+		byUser := make(map[uint][]string)
+		var order []uint
+		for i := range entries {
+			entry := &entries[i]
+			previous, previousStage := entry.Status, entry.Stage
+			if err := edit.apply(ctx, tx, h.config, r, user, entry, now); err != nil {
+				var entryErr models.EntryError
+				if errors.As(err, &entryErr) {
+					return models.EntryError(fmt.Sprintf("%s, %s: %s", entry.User.DisplayName(), entry.Date.Format("2006-01-02"), entryErr))
+				}
+				return err
+			}
+			// Entries advanced to the HR stage are pending again, for HR
+			if entry.Status != previous || entry.Stage != previousStage {
+				statusChanged = append(statusChanged, *entry)
+			}
+			if _, ok := byUser[entry.UserID]; !ok {
+				order = append(order, entry.UserID)
+			}
+			byUser[entry.UserID] = append(byUser[entry.UserID], strconv.FormatUint(uint64(entry.ID), 10))
+		}
+
+		for _, userID := range order {
+			detail := fmt.Sprintf("entries %s %s by %s", strings.Join(byUser[userID], ", "), changes, user.Username)
+			audit := newAuditLog(r, user.OrganizationID, &userID, models.AuditEntriesBulkEdited, detail)
+			if err := tx.CreateAuditLog(ctx, &audit); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	var entryErr models.EntryError
+	if errors.As(err, &entryErr) {
+		redirectWithError(w, r, back, "Nothing was changed. "+entryErr.Error())
+		return
+	}
+	if errors.Is(err, errEntriesMissing) {
+		redirectWithError(w, r, back, "Some selected entries no longer exist")
+		return
+	}
+	if err != nil {
+		redirectWithError(w, r, back, "Failed to update entries")
+		return
+	}
+
+	for _, entry := range entries {
+		go h.calendar.Sync(entry.ID)
+	}
+	for _, entry := range statusChanged {
+		switch entry.Status {
+		case models.StatusPending:
+			go RequestApproval(h.store, h.config, h.mailer, entry)
+		case models.StatusRejected:
+			go notifyRejection(h.config, h.mailer, entry, user)
+		}
+	}
+
+	redirectWithSuccess(w, r, back, fmt.Sprintf("%d entries %s", len(entries), changes))
+}
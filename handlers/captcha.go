@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"overtime/captcha"
+	"overtime/middleware"
+)
+
+// honeypotField is a login and registration form field hidden from people.
+// Bots filling in every field give themselves away with it.
+const honeypotField = "website"
+
+// captchaRequired reports whether the requesting address has to solve a
+// CAPTCHA, having failed to log in or register too often
+func (h *AuthHandler) captchaRequired(r *http.Request) bool {
+	return h.captcha != nil && h.failures.Hits(middleware.ClientIP(r)) >= h.config.CaptchaAfterFailures
+}
+
+// captchaWidget is the CAPTCHA the login and registration forms show the
+// requesting address, nil unless it has to solve one
+func (h *AuthHandler) captchaWidget(r *http.Request) *captcha.Widget {
+	if !h.captchaRequired(r) {
+		return nil
+	}
+	return h.captcha.Widget()
+}
+
+// countFailure records a failed login or registration of the requesting
+// address
+func (h *AuthHandler) countFailure(r *http.Request) {
+	h.failures.Hit(middleware.ClientIP(r))
+}
+
+// humanCheck returns why a submitted login or registration form looks like a
+// bot's, empty if it does not: the honeypot was filled in or a required
+// CAPTCHA not solved. The failure is counted.
+func (h *AuthHandler) humanCheck(r *http.Request) string {
+	if r.FormValue(honeypotField) != "" {
+		h.countFailure(r)
+		return "Invalid form data"
+	}
+	if !h.captchaRequired(r) {
+		return ""
+	}
+
+	ok, err := h.captcha.Verify(r.Context(), r, middleware.ClientIP(r))
+	if err != nil {
+		// The rate limit still holds, an unreachable provider should not
+		// lock everyone out
+		log.Printf("CAPTCHA verification failed: %v", err)
+		return ""
+	}
+	if !ok {
+		h.countFailure(r)
+		return "Please confirm that you are not a robot"
+	}
+	return ""
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"overtime/middleware"
+	"overtime/models"
+)
+
+// CreateAdjustment corrects a user's balance by hand, e.g. after a migration
+// error or a settlement. The reason is required, since adjustments are not
+// backed by entries. Adjustments cannot be deleted, a wrong one is corrected
+// with another.
+func (h *AuthHandler) CreateAdjustment(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanAdjustBalances() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/users", "Invalid form data")
+		return
+	}
+
+	idStr := r.FormValue("user_id")
+	userID, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/users", "Invalid user ID")
+		return
+	}
+	editURL := "/users/edit?id=" + idStr
+
+	date, err := time.Parse("2006-01-02", r.FormValue("date"))
+	if err != nil {
+		redirectWithFormError(w, r, editURL, "Invalid date")
+		return
+	}
+	hours, err := strconv.ParseFloat(strings.TrimSpace(r.FormValue("hours")), 64)
+	if err != nil || hours == 0 || math.Abs(hours) > 1000 {
+		redirectWithFormError(w, r, editURL, "Hours must be between -1000 and 1000 and not 0")
+		return
+	}
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" {
+		redirectWithFormError(w, r, editURL, "A reason is required for adjustments")
+		return
+	}
+	if utf8.RuneCountInString(reason) > 500 {
+		redirectWithFormError(w, r, editURL, "Reason is too long (at most 500 characters)")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	var editUser models.User
+	if err := db.Scopes(inOrganization(user.OrganizationID)).First(&editUser, userID).Error; err != nil {
+		redirectWithError(w, r, "/users", "User not found")
+		return
+	}
+	if editUser.ID == user.ID && !user.IsAdmin() {
+		redirectWithFormError(w, r, editURL, "You cannot adjust your own balance")
+		return
+	}
+
+	adjustment := models.Compensation{
+		OrganizationID: user.OrganizationID,
+		UserID:         editUser.ID,
+		Date:           date,
+		Hours:          hours,
+		Kind:           models.CompensationAdjustment,
+		Reason:         reason,
+		CreatedBy:      &user.ID,
+	}
+	if err := db.Create(&adjustment).Error; err != nil {
+		redirectWithFormError(w, r, editURL, "Failed to adjust balance")
+		return
+	}
+
+	recordAudit(db, r, user.OrganizationID, &editUser.ID, models.AuditBalanceAdjusted,
+		fmt.Sprintf("%+.2fh on %s by %s: %s", hours, date.Format("2006-01-02"), user.Username, reason))
+
+	redirectWithSuccess(w, r, editURL, "Balance adjusted")
+}
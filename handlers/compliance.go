@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"overtime/middleware"
+	"overtime/models"
+
+	"gorm.io/gorm"
+)
+
+// Limits of the EU Working Time Directive (2003/88/EC) the compliance report
+// checks. The average weekly working time is taken over a reference period of
+// four months.
+const (
+	maxAverageWeeklyHours = 48
+	minDailyRest          = 11 * time.Hour
+	complianceWeeks       = 17
+)
+
+// complianceFinding is one possible breach of the working time rules
+type complianceFinding struct {
+	User   string
+	Rule   string
+	From   time.Time
+	To     time.Time
+	Detail string
+}
+
+// compliancePeriod returns the reference period ending with until: the
+// complianceWeeks weeks up to and including the week of until, from Monday
+// on, and the day after until. Days are in UTC like entry dates.
+func compliancePeriod(until time.Time) (from, end time.Time) {
+	end = time.Date(until.Year(), until.Month(), until.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1)
+	monday := end.AddDate(0, 0, -1-(int(until.Weekday())+6)%7)
+	return monday.AddDate(0, 0, -7*(complianceWeeks-1)), end
+}
+
+// dayOf returns the date of t as midnight UTC, so dates from the database and
+// from the calendar compare equal
+func dayOf(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// checkWorkingTime applies the working time rules to one user's entries that
+// were not rejected and approved time off in the period [from, end). Working
+// time is the contracted hours plus overtime less time off; users are assumed
+// to work Monday to Friday and on every day they recorded overtime on, unless
+// they took the day off. Weeks before the account was created are left out.
+func checkWorkingTime(user *models.User, entries []models.OvertimeEntry, contracts []models.Contract, timeOff []models.TimeOffRequest, from, end time.Time, maxConsecutiveDays int) []complianceFinding {
+	var findings []complianceFinding
+	finding := func(rule string, from, to time.Time, detail string) {
+		findings = append(findings, complianceFinding{User: user.DisplayName(), Rule: rule, From: from, To: to, Detail: detail})
+	}
+
+	worked := make(map[time.Time]float64)
+	for _, entry := range entries {
+		worked[dayOf(entry.Date)] += entry.Hours
+	}
+	off := make(map[time.Time]float64)
+	for _, request := range timeOff {
+		off[dayOf(request.Date)] += request.Hours
+	}
+
+	// Average weekly working time
+	start := from
+	if created := dayOf(user.CreatedAt); created.After(start) {
+		start = created.AddDate(0, 0, -(int(created.Weekday())+6)%7)
+	}
+	var total float64
+	weeks := 0
+	for week := start; week.Before(end); week = week.AddDate(0, 0, 7) {
+		weeks++
+		contract := models.ContractOn(contracts, week)
+		if contract == nil {
+			total += models.FullTimeWeeklyHours
+		} else {
+			total += contract.WeeklyHours
+		}
+		for day := week; day.Before(week.AddDate(0, 0, 7)) && day.Before(end); day = day.AddDate(0, 0, 1) {
+			total += worked[day] - off[day]
+		}
+	}
+	if weeks > 0 && total/float64(weeks) > maxAverageWeeklyHours {
+		finding("Average weekly working time", start, end.AddDate(0, 0, -1),
+			fmt.Sprintf("%.1fh per week on average over %d weeks (at most %dh)", total/float64(weeks), weeks, maxAverageWeeklyHours))
+	}
+
+	// Daily rest between entries on different days
+	type period struct{ start, end time.Time }
+	var periods []period
+	for i := range entries {
+		if s, e, ok := entries[i].WorkPeriod(); ok {
+			periods = append(periods, period{s, e})
+		}
+	}
+	sort.Slice(periods, func(i, j int) bool { return periods[i].start.Before(periods[j].start) })
+	for i := 1; i < len(periods); i++ {
+		previous, next := periods[i-1], periods[i]
+		if dayOf(previous.start).Equal(dayOf(next.start)) {
+			continue
+		}
+		if rest := next.start.Sub(previous.end); rest < minDailyRest {
+			finding("Daily rest", dayOf(previous.start), dayOf(next.start),
+				fmt.Sprintf("%.1fh of rest from %s to %s (at least %.0fh)", rest.Hours(),
+					previous.end.Format("2006-01-02 15:04"), next.start.Format("2006-01-02 15:04"), minDailyRest.Hours()))
+		}
+	}
+
+	// Consecutive working days
+	var runStart time.Time
+	run := 0
+	closeRun := func(last time.Time) {
+		if run > maxConsecutiveDays {
+			finding("Consecutive working days", runStart, last,
+				fmt.Sprintf("%d days in a row (at most %d)", run, maxConsecutiveDays))
+		}
+		run = 0
+	}
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		weekday := day.Weekday() != time.Saturday && day.Weekday() != time.Sunday
+		_, overtime := worked[day]
+		_, dayOff := off[day]
+		if overtime || (weekday && !dayOff) {
+			if run == 0 {
+				runStart = day
+			}
+			run++
+			continue
+		}
+		closeRun(day.AddDate(0, 0, -1))
+	}
+	closeRun(end.AddDate(0, 0, -1))
+
+	return findings
+}
+
+// complianceFindings checks every user of the organization over the
+// reference period ending with until. Users are named by pseudonym for roles
+// limited to pseudonymous data.
+func complianceFindings(db *gorm.DB, organizationID uint, until time.Time, maxConsecutiveDays int, pseudonyms *pseudonymizer) (findings []complianceFinding, from time.Time) {
+	from, end := compliancePeriod(until)
+
+	var users []models.User
+	db.Scopes(inOrganization(organizationID)).Where("anonymized_at IS NULL").Order("full_name asc, username asc").Find(&users)
+	pseudonyms.applyUsers(users)
+
+	var entries []models.OvertimeEntry
+	db.Scopes(inOrganization(organizationID)).
+		Where("status <> ? AND date >= ? AND date < ?", models.StatusRejected, from, end).
+		Order("date asc").Find(&entries)
+	entriesByUser := make(map[uint][]models.OvertimeEntry)
+	for _, entry := range entries {
+		entriesByUser[entry.UserID] = append(entriesByUser[entry.UserID], entry)
+	}
+
+	var contracts []models.Contract
+	db.Scopes(inOrganization(organizationID)).Find(&contracts)
+	contractsByUser := make(map[uint][]models.Contract)
+	for _, contract := range contracts {
+		contractsByUser[contract.UserID] = append(contractsByUser[contract.UserID], contract)
+	}
+
+	var timeOff []models.TimeOffRequest
+	db.Scopes(inOrganization(organizationID)).
+		Where("status = ? AND date >= ? AND date < ?", models.StatusApproved, from, end).
+		Find(&timeOff)
+	timeOffByUser := make(map[uint][]models.TimeOffRequest)
+	for _, request := range timeOff {
+		timeOffByUser[request.UserID] = append(timeOffByUser[request.UserID], request)
+	}
+
+	for i := range users {
+		findings = append(findings, checkWorkingTime(&users[i], entriesByUser[users[i].ID], contractsByUser[users[i].ID],
+			timeOffByUser[users[i].ID], from, end, maxConsecutiveDays)...)
+	}
+	return findings, from
+}
+
+// complianceUntil reads the last day of the report from the query, today in
+// the user's timezone by default
+func complianceUntil(r *http.Request, user *models.User) time.Time {
+	if until, err := time.Parse("2006-01-02", r.URL.Query().Get("until")); err == nil {
+		return until
+	}
+	return user.Now()
+}
+
+// CompliancePage flags possible breaches of the Working Time Directive
+// (admin and HR)
+func (h *OvertimeHandler) CompliancePage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanViewAllOvertime() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	app := loadAppSettings(db, h.config, user.OrganizationID)
+	until := complianceUntil(r, user)
+	findings, from := complianceFindings(db, user.OrganizationID, until, app.MaxConsecutiveDays, worksCouncilView(db, h.config, user))
+
+	data := map[string]interface{}{
+		"Findings":           findings,
+		"From":               from.Format("2006-01-02"),
+		"Until":              until.Format("2006-01-02"),
+		"Weeks":              complianceWeeks,
+		"MaxWeeklyHours":     maxAverageWeeklyHours,
+		"MinRestHours":       int(minDailyRest.Hours()),
+		"MaxConsecutiveDays": app.MaxConsecutiveDays,
+		"ExportFormat":       app.ExportFormat,
+	}
+	render(w, r, h.templates, "compliance", data)
+}
+
+// ComplianceCSV exports the compliance findings, e.g. for the works council
+func (h *OvertimeHandler) ComplianceCSV(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanViewAllOvertime() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	app := loadAppSettings(db, h.config, user.OrganizationID)
+	format := parseExportFormat(r.URL.Query().Get("format"), app.ExportFormat)
+	until := complianceUntil(r, user)
+	pseudonyms := worksCouncilView(db, h.config, user)
+	findings, from := complianceFindings(db, user.OrganizationID, until, app.MaxConsecutiveDays, pseudonyms)
+
+	filename := fmt.Sprintf("compliance_%s_%s.csv", from.Format("2006-01-02"), until.Format("2006-01-02"))
+	err := logExport(db, r, user, models.ExportLog{
+		Kind:          models.ExportCompliance,
+		Filename:      filename,
+		Format:        format,
+		Filters:       exportFilters(r, "until"),
+		Rows:          exportRows(len(findings)),
+		Pseudonymized: pseudonyms != nil,
+	})
+	if err != nil {
+		http.Error(w, "Failed to log the export", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+
+	writer := newExportWriter(w, format)
+	writer.Write([]string{"Employee", "Rule", "From", "To", "Detail"})
+	for _, finding := range findings {
+		writer.Write([]string{
+			finding.User,
+			finding.Rule,
+			finding.From.Format("2006-01-02"),
+			finding.To.Format("2006-01-02"),
+			finding.Detail,
+		})
+	}
+	writer.Flush()
+}
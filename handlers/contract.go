@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"net/http"
+	"overtime/middleware"
+	"overtime/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// userContracts returns the contracts of a user, latest first
+func userContracts(db *gorm.DB, userID uint) []models.Contract {
+	var contracts []models.Contract
+	db.Where("user_id = ?", userID).Order("valid_from desc").Find(&contracts)
+	return contracts
+}
+
+// CreateContract records a user's working time from a given day on (admin only)
+func (h *AuthHandler) CreateContract(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/users", "Invalid form data")
+		return
+	}
+
+	idStr := r.FormValue("user_id")
+	userID, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/users", "Invalid user ID")
+		return
+	}
+	editURL := "/users/edit?id=" + idStr
+
+	validFrom, err := time.Parse("2006-01-02", r.FormValue("valid_from"))
+	if err != nil {
+		redirectWithError(w, r, editURL, "Invalid start date")
+		return
+	}
+
+	weeklyHours, err := strconv.ParseFloat(strings.TrimSpace(r.FormValue("weekly_hours")), 64)
+	if err != nil || weeklyHours <= 0 || weeklyHours > 80 {
+		redirectWithError(w, r, editURL, "Weekly hours must be more than 0 and at most 80")
+		return
+	}
+
+	partTime, err := strconv.ParseFloat(strings.TrimSpace(r.FormValue("part_time_percent")), 64)
+	if err != nil || partTime <= 0 || partTime > 100 {
+		redirectWithError(w, r, editURL, "Part-time percentage must be more than 0 and at most 100")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	if !organizationExists(db, &models.User{}, uint(userID), user.OrganizationID) {
+		redirectWithError(w, r, "/users", "User not found")
+		return
+	}
+
+	contract := models.Contract{
+		OrganizationID:  user.OrganizationID,
+		UserID:          uint(userID),
+		ValidFrom:       validFrom,
+		WeeklyHours:     weeklyHours,
+		PartTimePercent: partTime,
+	}
+	if err := db.Create(&contract).Error; err != nil {
+		redirectWithError(w, r, editURL, "Failed to add contract (one may already start on that day)")
+		return
+	}
+
+	redirectWithSuccess(w, r, editURL, "Contract added")
+}
+
+// DeleteContract removes a contract, the previous one applies again
+func (h *AuthHandler) DeleteContract(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/users", "Invalid form data")
+		return
+	}
+
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/users", "Invalid contract ID")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	var contract models.Contract
+	if err := db.Scopes(inOrganization(user.OrganizationID)).First(&contract, id).Error; err != nil {
+		redirectWithError(w, r, "/users", "Contract not found")
+		return
+	}
+
+	editURL := "/users/edit?id=" + strconv.FormatUint(uint64(contract.UserID), 10)
+	if err := db.Delete(&contract).Error; err != nil {
+		redirectWithError(w, r, editURL, "Failed to delete contract")
+		return
+	}
+
+	redirectWithSuccess(w, r, editURL, "Contract deleted")
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"overtime/models"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxHourlyRate catches typos such as a missing decimal point
+const maxHourlyRate = 100000
+
+// parseHourlyRate parses a rate entered in a form. ok is false unless value
+// is a number between 0 and maxHourlyRate.
+func parseHourlyRate(value string) (rate float64, ok bool) {
+	rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || rate < 0 || rate > maxHourlyRate {
+		return 0, false
+	}
+	return rate, true
+}
+
+// costsByUser sums what the entries cost per user, keyed by display name like
+// hoursByUser, and in total. Costs use the current rates with night hours
+// weighed by the night's multiplier, the entries' projects must be loaded.
+func costsByUser(entries []models.OvertimeEntry, night models.NightWindow) (map[string]float64, float64) {
+	costs := make(map[string]float64)
+	var total float64
+	for i := range entries {
+		cost := night.WeightedHours(&entries[i]) * entries[i].OvertimeRate()
+		costs[entries[i].User.DisplayName()] += cost
+		total += cost
+	}
+	return costs, total
+}
+
+// costCenterLabel names the cost center the user's overtime is booked on for
+// exports, the user's team and cost centers must be loaded
+func costCenterLabel(user *models.User) string {
+	if costCenter := user.OvertimeCostCenter(); costCenter != nil {
+		return costCenter.Label()
+	}
+	return ""
+}
+
+// costCenterTotal is the overtime booked on one cost center
+type costCenterTotal struct {
+	CostCenter string  `json:"cost_center" doc:"Code and name of the cost center, empty for users booked on none"`
+	Hours      float64 `json:"hours"`
+	Cost       float64 `json:"cost,omitempty" doc:"For administrators and HR"`
+	// Hidden cost centers show no hours, too few employees are booked on
+	// them for the report
+	Hidden bool `json:"hidden,omitempty" doc:"Set when too few employees are booked on the cost center to show its hours"`
+}
+
+// costCenterTotals groups the entries by the cost center they are booked on,
+// ordered by label with entries booked on none last. It returns nil when no
+// entry is booked on a cost center. Costs are left out unless withCosts,
+// cost centers with fewer than minEmployees employees are hidden. Night hours
+// cost their multiple.
+func costCenterTotals(entries []models.OvertimeEntry, withCosts bool, minEmployees int, night models.NightWindow) []costCenterTotal {
+	byLabel := make(map[string]*costCenterTotal)
+	employees := make(map[string]map[uint]bool)
+	booked := false
+	for i := range entries {
+		label := costCenterLabel(&entries[i].User)
+		booked = booked || label != ""
+
+		total, ok := byLabel[label]
+		if !ok {
+			total = &costCenterTotal{CostCenter: label}
+			byLabel[label] = total
+			employees[label] = make(map[uint]bool)
+		}
+		total.Hours += entries[i].Hours
+		if withCosts {
+			total.Cost += night.WeightedHours(&entries[i]) * entries[i].OvertimeRate()
+		}
+		employees[label][entries[i].UserID] = true
+	}
+	if !booked {
+		return nil
+	}
+
+	totals := make([]costCenterTotal, 0, len(byLabel))
+	for label, total := range byLabel {
+		if len(employees[label]) < minEmployees {
+			total.Hours = 0
+			total.Cost = 0
+			total.Hidden = true
+		}
+		totals = append(totals, *total)
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		if (totals[i].CostCenter == "") != (totals[j].CostCenter == "") {
+			return totals[j].CostCenter == ""
+		}
+		return totals[i].CostCenter < totals[j].CostCenter
+	})
+	return totals
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"overtime/middleware"
+	"overtime/models"
+	"overtime/services"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+// CostCentersPage lists the cost centers overtime is booked on (admin only)
+func (h *AuthHandler) CostCentersPage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+
+	data := map[string]interface{}{
+		"CostCenters": organizationCostCenters(db, h.cache, user.OrganizationID),
+	}
+	render(w, r, h.templates, "cost-centers", data)
+}
+
+func (h *AuthHandler) CreateCostCenter(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/cost-centers", "Invalid form data")
+		return
+	}
+
+	code := strings.TrimSpace(r.FormValue("code"))
+	if code == "" {
+		redirectWithError(w, r, "/cost-centers", "Cost center code is required")
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if utf8.RuneCountInString(code) > 50 || utf8.RuneCountInString(name) > 200 {
+		redirectWithError(w, r, "/cost-centers", "Cost center code or name is too long")
+		return
+	}
+
+	costCenter := models.CostCenter{OrganizationID: user.OrganizationID, Code: code, Name: name}
+	db := h.db.WithContext(r.Context())
+	if err := db.Create(&costCenter).Error; err != nil {
+		redirectWithError(w, r, "/cost-centers", "Failed to create cost center (the code may already exist)")
+		return
+	}
+
+	h.cache.Delete(costCentersCacheKey(user.OrganizationID))
+
+	redirectWithSuccess(w, r, "/cost-centers", "Cost center created successfully")
+}
+
+func (h *AuthHandler) DeleteCostCenter(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/cost-centers", "Invalid form data")
+		return
+	}
+
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/cost-centers", "Invalid cost center ID")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	err = services.DeleteCostCenter(db, user.OrganizationID, uint(id))
+	switch {
+	case errors.Is(err, services.ErrNotFound):
+		redirectWithError(w, r, "/cost-centers", "Cost center not found")
+		return
+	case errors.Is(err, services.ErrInUse):
+		redirectWithError(w, r, "/cost-centers", "Cannot delete a cost center that teams or users are booked on")
+		return
+	case err != nil:
+		redirectWithError(w, r, "/cost-centers", "Failed to delete cost center")
+		return
+	}
+
+	h.cache.Delete(costCentersCacheKey(user.OrganizationID))
+
+	redirectWithSuccess(w, r, "/cost-centers", "Cost center deleted successfully")
+}
+
+// UpdateTeamCostCenter sets the cost center the team's overtime is booked on
+func (h *AuthHandler) UpdateTeamCostCenter(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/teams", "Invalid form data")
+		return
+	}
+
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/teams", "Invalid team ID")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	costCenterID, ok := parseCostCenter(db, r.FormValue("cost_center_id"), user.OrganizationID)
+	if !ok {
+		redirectWithError(w, r, "/teams", "Cost center not found")
+		return
+	}
+
+	result := db.Model(&models.Team{}).Scopes(inOrganization(user.OrganizationID)).Where("id = ?", id).Update("cost_center_id", costCenterID)
+	if result.Error != nil || result.RowsAffected == 0 {
+		redirectWithError(w, r, "/teams", "Failed to update cost center")
+		return
+	}
+
+	h.cache.Delete(teamsCacheKey(user.OrganizationID))
+
+	redirectWithSuccess(w, r, "/teams", "Cost center updated")
+}
+
+// parseCostCenter parses a cost center picked in a form, where the empty
+// value means none. ok is false unless the cost center is the organization's.
+func parseCostCenter(db *gorm.DB, value string, organizationID uint) (id *uint, ok bool) {
+	if value == "" {
+		return nil, true
+	}
+	parsed, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return nil, false
+	}
+	costCenterID := uint(parsed)
+	if !organizationExists(db, &models.CostCenter{}, costCenterID, organizationID) {
+		return nil, false
+	}
+	return &costCenterID, true
+}
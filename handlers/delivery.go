@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"overtime/config"
+	"overtime/delivery"
+	"overtime/middleware"
+	"overtime/models"
+
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+// deliveryLogSize is how many of the latest deliveries the page lists
+const deliveryLogSize = 50
+
+type DeliveryHandler struct {
+	db         *gorm.DB
+	config     *config.Config
+	templates  map[string]*template.Template
+	deliveries *delivery.Deliverer
+}
+
+func NewDeliveryHandler(db *gorm.DB, cfg *config.Config, templates map[string]*template.Template, deliveries *delivery.Deliverer) *DeliveryHandler {
+	return &DeliveryHandler{
+		db:         db,
+		config:     cfg,
+		templates:  templates,
+		deliveries: deliveries,
+	}
+}
+
+// findDestination loads the organization's destination named by the form's id
+func findDestination(db *gorm.DB, r *http.Request, organizationID uint) (*models.ExportDestination, bool) {
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		return nil, false
+	}
+	var destination models.ExportDestination
+	if err := db.Scopes(inOrganization(organizationID)).First(&destination, id).Error; err != nil {
+		return nil, false
+	}
+	return &destination, true
+}
+
+// DeliveriesPage lists where the monthly export is delivered to and the
+// latest deliveries (admin only)
+func (h *DeliveryHandler) DeliveriesPage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	var destinations []models.ExportDestination
+	db.Scopes(inOrganization(user.OrganizationID)).Order("name asc").Find(&destinations)
+	names := make(map[uint]string, len(destinations))
+	for _, destination := range destinations {
+		names[destination.ID] = destination.Name
+	}
+
+	var deliveries []models.ExportDelivery
+	db.Scopes(inOrganization(user.OrganizationID)).Order("created_at desc").Limit(deliveryLogSize).Find(&deliveries)
+
+	now := user.Now()
+	previousMonth := time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC)
+	data := map[string]interface{}{
+		"Destinations":     destinations,
+		"DestinationNames": names,
+		"Deliveries":       deliveries,
+		"Enabled":          h.deliveries.Enabled(),
+		"Interval":         h.config.DeliveryInterval,
+		"PreviousMonth":    previousMonth.Format("2006-01"),
+		"ExportFormat":     loadAppSettings(db, h.config, user.OrganizationID).ExportFormat,
+	}
+	render(w, r, h.templates, "deliveries", data)
+}
+
+// CreateDestination adds an export destination
+func (h *DeliveryHandler) CreateDestination(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/deliveries", "Invalid form data")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	destination := models.ExportDestination{
+		OrganizationID: user.OrganizationID,
+		Name:           strings.TrimSpace(r.FormValue("name")),
+		Kind:           r.FormValue("kind"),
+		Host:           strings.TrimSpace(r.FormValue("host")),
+		HostKey:        strings.TrimSpace(r.FormValue("host_key")),
+		Bucket:         strings.TrimSpace(r.FormValue("bucket")),
+		Region:         strings.TrimSpace(r.FormValue("region")),
+		Path:           strings.TrimSpace(r.FormValue("path")),
+		Username:       strings.TrimSpace(r.FormValue("username")),
+		Password:       r.FormValue("password"),
+		Format:         parseExportFormat(r.FormValue("format"), loadAppSettings(db, h.config, user.OrganizationID).ExportFormat),
+		Enabled:        true,
+	}
+
+	if destination.Name == "" || utf8.RuneCountInString(destination.Name) > 100 {
+		redirectWithError(w, r, "/deliveries", "Name is required and may have at most 100 characters")
+		return
+	}
+	day, err := strconv.Atoi(r.FormValue("day"))
+	if err != nil || day < 1 || day > 28 {
+		redirectWithError(w, r, "/deliveries", "Day of the month must be between 1 and 28")
+		return
+	}
+	destination.Day = day
+	for _, value := range []string{destination.Host, destination.Bucket, destination.Path, destination.Username, destination.Password} {
+		if len(value) > 255 {
+			redirectWithError(w, r, "/deliveries", "Values may have at most 255 characters")
+			return
+		}
+	}
+	if len(destination.HostKey) > 1000 || len(destination.Region) > 50 {
+		redirectWithError(w, r, "/deliveries", "Host key or region is too long")
+		return
+	}
+
+	switch destination.Kind {
+	case models.DestinationSFTP:
+		if _, port, err := net.SplitHostPort(destination.Host); err != nil || port == "" {
+			redirectWithError(w, r, "/deliveries", "SFTP host must be given as host:port")
+			return
+		}
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(destination.HostKey)); err != nil {
+			redirectWithError(w, r, "/deliveries", "Invalid host key, paste a line of the server's ssh-keyscan output without the host name")
+			return
+		}
+		if destination.Username == "" || destination.Password == "" {
+			redirectWithError(w, r, "/deliveries", "SFTP username and password are required")
+			return
+		}
+	case models.DestinationS3:
+		if destination.Host != "" {
+			if endpoint, err := url.Parse(destination.Host); err != nil || (endpoint.Scheme != "https" && endpoint.Scheme != "http") || endpoint.Host == "" {
+				redirectWithError(w, r, "/deliveries", "S3 endpoint must be an http or https URL")
+				return
+			}
+		}
+		if destination.Bucket == "" || destination.Username == "" || destination.Password == "" {
+			redirectWithError(w, r, "/deliveries", "Bucket, access key and secret key are required")
+			return
+		}
+	case models.DestinationDir:
+		// Only the path applies
+		destination.Host, destination.HostKey, destination.Bucket, destination.Region = "", "", "", ""
+		destination.Username, destination.Password = "", ""
+	default:
+		redirectWithError(w, r, "/deliveries", "Invalid destination type")
+		return
+	}
+
+	if err := db.Create(&destination).Error; err != nil {
+		redirectWithError(w, r, "/deliveries", "Failed to add destination")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/deliveries", "Destination added")
+}
+
+// ToggleDestination pauses or resumes the scheduled deliveries to a
+// destination
+func (h *DeliveryHandler) ToggleDestination(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	destination, ok := findDestination(db, r, user.OrganizationID)
+	if !ok {
+		redirectWithError(w, r, "/deliveries", "Destination not found")
+		return
+	}
+
+	enabled := !destination.Enabled
+	if err := db.Model(destination).Update("enabled", enabled).Error; err != nil {
+		redirectWithError(w, r, "/deliveries", "Failed to update destination")
+		return
+	}
+
+	if enabled {
+		redirectWithSuccess(w, r, "/deliveries", "Deliveries to "+destination.Name+" resumed")
+	} else {
+		redirectWithSuccess(w, r, "/deliveries", "Deliveries to "+destination.Name+" paused")
+	}
+}
+
+// DeleteDestination removes a destination with its delivery log
+func (h *DeliveryHandler) DeleteDestination(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	destination, ok := findDestination(db, r, user.OrganizationID)
+	if !ok {
+		redirectWithError(w, r, "/deliveries", "Destination not found")
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("destination_id = ?", destination.ID).Delete(&models.ExportDelivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(destination).Error
+	})
+	if err != nil {
+		redirectWithError(w, r, "/deliveries", "Failed to delete destination")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/deliveries", "Destination deleted")
+}
+
+// SendDestination delivers a month's export right away, e.g. to test a new
+// destination or to resend a corrected month
+func (h *DeliveryHandler) SendDestination(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	destination, ok := findDestination(db, r, user.OrganizationID)
+	if !ok {
+		redirectWithError(w, r, "/deliveries", "Destination not found")
+		return
+	}
+	month, err := time.Parse("2006-01", r.FormValue("month"))
+	if err != nil {
+		redirectWithError(w, r, "/deliveries", "Invalid month")
+		return
+	}
+
+	result := h.deliveries.Deliver(destination, month)
+	if !result.Succeeded() {
+		redirectWithError(w, r, "/deliveries", "Delivery failed: "+result.Error)
+		return
+	}
+
+	redirectWithSuccess(w, r, "/deliveries", result.Filename+" delivered to "+destination.Name)
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"overtime/middleware"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// started is when the process started, for the uptime shown on the
+// diagnostics page
+var started = time.Now()
+
+type DiagnosticsHandler struct {
+	db        *gorm.DB
+	templates map[string]*template.Template
+}
+
+func NewDiagnosticsHandler(db *gorm.DB, templates map[string]*template.Template) *DiagnosticsHandler {
+	return &DiagnosticsHandler{
+		db:        db,
+		templates: templates,
+	}
+}
+
+// diagnosticsStat is one labelled value on the diagnostics page
+type diagnosticsStat struct {
+	Label string
+	Value string
+}
+
+type diagnosticsSection struct {
+	Title string
+	Stats []diagnosticsStat
+}
+
+// DiagnosticsPage shows the runtime, memory and database pool statistics of
+// this process (platform admins only), next to links to its profiles
+func (h *DiagnosticsHandler) DiagnosticsPage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanManageOrganizations() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	var lastGC string
+	if mem.NumGC > 0 {
+		lastGC = time.Since(time.Unix(0, int64(mem.LastGC))).Round(time.Second).String() + " ago"
+	}
+
+	data := map[string]interface{}{
+		"Sections": []diagnosticsSection{
+			{"runtime", []diagnosticsStat{
+				{"uptime", time.Since(started).Round(time.Second).String()},
+				{"goroutines", fmt.Sprint(runtime.NumGoroutine())},
+				{"cpus", fmt.Sprint(runtime.NumCPU())},
+				{"GOMAXPROCS", fmt.Sprint(runtime.GOMAXPROCS(0))},
+			}},
+			{"memory", []diagnosticsStat{
+				{"heap in use", formatBytes(mem.HeapInuse)},
+				{"heap allocated", formatBytes(mem.HeapAlloc)},
+				{"heap objects", fmt.Sprint(mem.HeapObjects)},
+				{"allocated in total", formatBytes(mem.TotalAlloc)},
+				{"obtained from the OS", formatBytes(mem.Sys)},
+				{"garbage collections", fmt.Sprint(mem.NumGC)},
+				{"last collection", lastGC},
+			}},
+			{"database pool", h.databaseStats()},
+			{"build", buildStats()},
+		},
+	}
+	render(w, r, h.templates, "diagnostics", data)
+}
+
+func (h *DiagnosticsHandler) databaseStats() []diagnosticsStat {
+	sqlDB, err := h.db.DB()
+	if err != nil {
+		return []diagnosticsStat{{"error", err.Error()}}
+	}
+
+	stats := sqlDB.Stats()
+	maxOpen := "unlimited"
+	if stats.MaxOpenConnections > 0 {
+		maxOpen = fmt.Sprint(stats.MaxOpenConnections)
+	}
+	return []diagnosticsStat{
+		{"open connections", fmt.Sprintf("%d of %s", stats.OpenConnections, maxOpen)},
+		{"in use", fmt.Sprint(stats.InUse)},
+		{"idle", fmt.Sprint(stats.Idle)},
+		{"waited for a connection", fmt.Sprintf("%d times, %s in total", stats.WaitCount, stats.WaitDuration.Round(time.Millisecond))},
+		{"closed as idle", fmt.Sprint(stats.MaxIdleClosed + stats.MaxIdleTimeClosed)},
+		{"closed as too old", fmt.Sprint(stats.MaxLifetimeClosed)},
+	}
+}
+
+func buildStats() []diagnosticsStat {
+	stats := []diagnosticsStat{{"go", runtime.Version()}}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return stats
+	}
+
+	stats = append(stats, diagnosticsStat{"module", info.Main.Path + " " + info.Main.Version})
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision", "vcs.time", "vcs.modified":
+			stats = append(stats, diagnosticsStat{setting.Key, setting.Value})
+		}
+	}
+	return stats
+}
+
+// formatBytes renders a size in the largest binary unit below it, e.g. 1.5 MiB
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
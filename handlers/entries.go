@@ -0,0 +1,492 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"overtime/config"
+	"overtime/mailer"
+	"overtime/models"
+	"overtime/store"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// recordEntry validates and stores a new entry as pending and asks its
+// approvers for a decision. entry.User must be set. overrideDate skips the
+// organization's limits on the entry's date.
+func recordEntry(ctx context.Context, s store.Store, cfg *config.Config, mail *mailer.Mailer, entry *models.OvertimeEntry, overrideDate bool) error {
+	if err := storeEntry(ctx, s, cfg, entry, overrideDate); err != nil {
+		return err
+	}
+
+	go RequestApproval(s, cfg, mail, *entry)
+	return nil
+}
+
+// storeEntry is recordEntry without the approval request, for entries stored
+// in a transaction that has yet to be committed
+func storeEntry(ctx context.Context, s store.Store, cfg *config.Config, entry *models.OvertimeEntry, overrideDate bool) error {
+	entry.OrganizationID = entry.User.OrganizationID
+	if err := recordEntryDay(ctx, s, entry); err != nil {
+		return err
+	}
+	if err := applyWorkedHours(ctx, s, entry); err != nil {
+		return err
+	}
+	if err := entry.Validate(); err != nil {
+		return err
+	}
+	if !overrideDate {
+		if err := checkEntryDate(ctx, s, cfg, entry); err != nil {
+			return err
+		}
+	}
+
+	entry.Status = models.StatusPending
+	// Entries logged without picking a project are on the home project
+	if entry.ProjectID == nil {
+		entry.ProjectID = entry.User.ProjectID
+	}
+	if err := recordEntryNames(ctx, s, entry); err != nil {
+		return err
+	}
+	if err := checkEntryCaps(ctx, s, cfg, entry); err != nil {
+		return err
+	}
+	if err := checkSoftLimit(ctx, s, cfg, entry); err != nil {
+		return err
+	}
+	return s.CreateEntry(ctx, entry)
+}
+
+// recordEntryNames records the names of the team the entry's user was in on
+// its date and of its project on the entry. entry.User must be set.
+func recordEntryNames(ctx context.Context, s store.Store, entry *models.OvertimeEntry) error {
+	memberships, err := s.TeamMemberships(ctx, entry.UserID)
+	if err != nil {
+		return err
+	}
+	teamID := entry.User.TeamID
+	if m := models.TeamOn(memberships, entry.Date); m != nil {
+		teamID = m.TeamID
+	}
+
+	entry.TeamName, entry.ProjectName = "", ""
+	if teamID != nil {
+		team, err := s.Team(ctx, *teamID)
+		if err != nil {
+			return err
+		}
+		entry.TeamName = team.Name
+	}
+	if entry.ProjectID != nil {
+		project, err := s.Project(ctx, *entry.ProjectID)
+		if err != nil {
+			return err
+		}
+		entry.ProjectName = project.Name
+	}
+	return nil
+}
+
+// recordEntryDay flags the entry if its date is a weekend or one of its
+// organization's holidays. entry.OrganizationID must be set.
+func recordEntryDay(ctx context.Context, s store.Store, entry *models.OvertimeEntry) error {
+	holiday, err := s.IsHoliday(ctx, entry.OrganizationID, entry.Date)
+	if err != nil {
+		return err
+	}
+	entry.DayKind = models.DayKind(entry.Date, holiday)
+	return nil
+}
+
+// applyWorkedHours calculates the overtime of an entry recorded as worked
+// time: the hours worked beyond a regular day of the user's contract, or all
+// of them on weekends and holidays. Entries without worked hours keep their
+// declared overtime. The entry's day must be recorded first.
+func applyWorkedHours(ctx context.Context, s store.Store, entry *models.OvertimeEntry) error {
+	if entry.WorkedHours == nil {
+		return nil
+	}
+	worked := *entry.WorkedHours
+	if worked <= 0 || worked > 24 {
+		return models.ErrInvalidWorkedHours
+	}
+
+	var regular float64
+	if entry.DayKind == "" {
+		contracts, err := s.Contracts(ctx, entry.UserID)
+		if err != nil {
+			return err
+		}
+		regular = models.ContractOn(contracts, entry.Date).DailyHours()
+	}
+	overtime := math.Round((worked-regular)*100) / 100
+	if overtime <= 0 {
+		return models.EntryError(fmt.Sprintf("No overtime: %g hours worked do not exceed the regular %g hours of the day", worked, regular))
+	}
+	entry.Hours = overtime
+	return nil
+}
+
+// checkEntryCaps enforces the organization's hour caps on a new or edited
+// entry. The daily and monthly caps count the user's pending and approved
+// entries on the day and in the month of the entry, not counting the entry
+// itself. The monthly cap is meant for full-time staff and shrinks with the
+// part-time share of the user's contract.
+func checkEntryCaps(ctx context.Context, s store.Store, cfg *config.Config, entry *models.OvertimeEntry) error {
+	app := storeAppSettings(ctx, s, cfg, entry.OrganizationID)
+	if entry.Hours > app.MaxHoursPerEntry {
+		return models.EntryError(fmt.Sprintf("Too many hours for one entry (at most %g)", app.MaxHoursPerEntry))
+	}
+
+	day := time.Date(entry.Date.Year(), entry.Date.Month(), entry.Date.Day(), 0, 0, 0, 0, entry.Date.Location())
+	bookedToday, err := s.BookedHours(ctx, entry.UserID, entry.ID, day, day.AddDate(0, 0, 1))
+	if err != nil {
+		return err
+	}
+	if bookedToday+entry.Hours > app.MaxHoursPerDay {
+		return models.EntryError(fmt.Sprintf("This entry would exceed the daily limit of %g hours (%g already booked that day)", app.MaxHoursPerDay, bookedToday))
+	}
+
+	if app.MaxHoursPerMonth <= 0 {
+		return nil
+	}
+	limit, err := monthlyLimit(ctx, s, entry, app.MaxHoursPerMonth)
+	if err != nil {
+		return err
+	}
+	booked, err := bookedInMonth(ctx, s, entry)
+	if err != nil {
+		return err
+	}
+	if booked+entry.Hours > limit {
+		return models.EntryError(fmt.Sprintf("This entry would exceed the monthly limit of %g hours (%g already booked)", limit, booked))
+	}
+	return nil
+}
+
+// checkSoftLimit requires an acknowledgment on entries that take the user's
+// month over the organization's soft limit, which shrinks with part-time
+// contracts like the monthly cap. Entries within the limit lose their
+// acknowledgment, so it only flags entries past the limit.
+func checkSoftLimit(ctx context.Context, s store.Store, cfg *config.Config, entry *models.OvertimeEntry) error {
+	app := storeAppSettings(ctx, s, cfg, entry.OrganizationID)
+	if app.SoftHoursPerMonth <= 0 {
+		entry.Acknowledgment = ""
+		return nil
+	}
+
+	limit, err := monthlyLimit(ctx, s, entry, app.SoftHoursPerMonth)
+	if err != nil {
+		return err
+	}
+	booked, err := bookedInMonth(ctx, s, entry)
+	if err != nil {
+		return err
+	}
+	if booked+entry.Hours <= limit {
+		entry.Acknowledgment = ""
+		return nil
+	}
+	if entry.Acknowledgment == "" {
+		return models.EntryError(fmt.Sprintf("This entry goes past the soft limit of %g hours this month (%g already booked), acknowledge it with a note like who agreed to the hours", limit, booked))
+	}
+	return nil
+}
+
+// monthlyLimit scales a monthly limit meant for full-time staff to the
+// contract of the entry's user on the entry's date
+func monthlyLimit(ctx context.Context, s store.Store, entry *models.OvertimeEntry, hours float64) (float64, error) {
+	contracts, err := s.Contracts(ctx, entry.UserID)
+	if err != nil {
+		return 0, err
+	}
+	contract := models.ContractOn(contracts, entry.Date)
+	return math.Round(hours*contract.PartTimeFactor()*100) / 100, nil
+}
+
+// bookedInMonth sums the user's pending and approved hours in the month of
+// the entry, not counting the entry itself
+func bookedInMonth(ctx context.Context, s store.Store, entry *models.OvertimeEntry) (float64, error) {
+	monthStart := time.Date(entry.Date.Year(), entry.Date.Month(), 1, 0, 0, 0, 0, entry.Date.Location())
+	return s.BookedHours(ctx, entry.UserID, entry.ID, monthStart, monthStart.AddDate(0, 1, 0))
+}
+
+// checkEntryDate keeps entries within the organization's booking window: out
+// of closed months, at most MaxFutureDays after today in the user's
+// timezone, at most MaxPastMonths back and not before the user's first
+// contract started.
+// entry.User must be set.
+func checkEntryDate(ctx context.Context, s store.Store, cfg *config.Config, entry *models.OvertimeEntry) error {
+	app := storeAppSettings(ctx, s, cfg, entry.User.OrganizationID)
+	if app.MonthClose.Closed(entry.Date) {
+		return closedMonthError(entry.Date)
+	}
+	today := entry.User.Now()
+	date := entry.Date.Format("2006-01-02")
+
+	if latest := today.AddDate(0, 0, app.MaxFutureDays).Format("2006-01-02"); date > latest {
+		return models.EntryError(fmt.Sprintf("Entries may be dated at most %d days ahead (until %s)", app.MaxFutureDays, latest))
+	}
+	if app.MaxPastMonths > 0 {
+		if earliest := today.AddDate(0, -app.MaxPastMonths, 0).Format("2006-01-02"); date < earliest {
+			return models.EntryError(fmt.Sprintf("Entries may be dated at most %d months back (from %s)", app.MaxPastMonths, earliest))
+		}
+	}
+
+	// Contracts are loaded newest first
+	contracts, err := s.Contracts(ctx, entry.UserID)
+	if err != nil {
+		return err
+	}
+	if len(contracts) > 0 {
+		if start := contracts[len(contracts)-1].ValidFrom.Format("2006-01-02"); date < start {
+			return models.EntryError(fmt.Sprintf("Entries may not be dated before the employment started on %s", start))
+		}
+	}
+	return nil
+}
+
+// checkMonthOpen keeps the entries of closed months as they are
+func checkMonthOpen(ctx context.Context, s store.Store, cfg *config.Config, organizationID uint, date time.Time) error {
+	if storeAppSettings(ctx, s, cfg, organizationID).MonthClose.Closed(date) {
+		return closedMonthError(date)
+	}
+	return nil
+}
+
+func closedMonthError(date time.Time) error {
+	return models.EntryError(fmt.Sprintf("%s is closed, only administrators can change its entries", date.Format("January 2006")))
+}
+
+// dateOverride reports whether an admin asked to record an entry outside the
+// booking window or in a closed month, e.g. to correct an old month
+func dateOverride(r *http.Request, user *models.User) bool {
+	return user.IsAdmin() && r.FormValue("override_date_limits") != ""
+}
+
+// EntryRecorder returns recordEntry for integrations outside the web
+// handlers, so entries from chat bots go through the same validation
+func EntryRecorder(s store.Store, cfg *config.Config, mail *mailer.Mailer) func(entry *models.OvertimeEntry) error {
+	return func(entry *models.OvertimeEntry) error {
+		return recordEntry(context.Background(), s, cfg, mail, entry, false)
+	}
+}
+
+// entryErrorMessage returns the message to show for a failed entry change:
+// validation problems are shown as is, anything else as fallback
+func entryErrorMessage(err error, fallback string) string {
+	var entryErr models.EntryError
+	if errors.As(err, &entryErr) {
+		return entryErr.Error()
+	}
+	return fallback
+}
+
+// dateRange is a period of entry lists picked as an ISO week, as an
+// <input type="week"> submits it, or from and to dates. Week, From and To are
+// the values as submitted, empty when not picked.
+type dateRange struct {
+	Week string
+	From string
+	To   string
+	// start and end (exclusive) bound the range, zero for an open end
+	start time.Time
+	end   time.Time
+}
+
+// parseDateRange reads the week, from and to parameters in loc. From and to
+// take precedence over a week, invalid values are ignored.
+func parseDateRange(r *http.Request, loc *time.Location) dateRange {
+	var d dateRange
+	from, fromErr := time.ParseInLocation("2006-01-02", r.URL.Query().Get("from"), loc)
+	to, toErr := time.ParseInLocation("2006-01-02", r.URL.Query().Get("to"), loc)
+	if fromErr == nil && toErr == nil && to.Before(from) {
+		from, to = to, from
+	}
+	if fromErr == nil {
+		d.From = from.Format("2006-01-02")
+		d.start = from
+	}
+	if toErr == nil {
+		d.To = to.Format("2006-01-02")
+		d.end = to.AddDate(0, 0, 1)
+	}
+	if d.IsSet() {
+		return d
+	}
+
+	if monday, ok := parseISOWeek(r.URL.Query().Get("week"), loc); ok {
+		year, week := monday.ISOWeek()
+		d.Week = fmt.Sprintf("%d-W%02d", year, week)
+		d.start = monday
+		d.end = monday.AddDate(0, 0, 7)
+	}
+	return d
+}
+
+// parseISOWeek returns the Monday of a week given as YYYY-Www
+func parseISOWeek(value string, loc *time.Location) (time.Time, bool) {
+	var year, week int
+	if _, err := fmt.Sscanf(value, "%4d-W%2d", &year, &week); err != nil || year < 2000 || year > 2100 {
+		return time.Time{}, false
+	}
+	// January 4th is always in the first week
+	jan4 := time.Date(year, 1, 4, 0, 0, 0, 0, loc)
+	monday := jan4.AddDate(0, 0, -(int(jan4.Weekday())+6)%7+(week-1)*7)
+	if y, w := monday.ISOWeek(); y != year || w != week {
+		return time.Time{}, false
+	}
+	return monday, true
+}
+
+// IsSet reports whether a week or dates were picked
+func (d dateRange) IsSet() bool {
+	return !d.start.IsZero() || !d.end.IsZero()
+}
+
+// entryPeriod restricts a query on overtime entries to a custom range or else
+// to a month of a year, a whole year or, without a year, that month of every
+// year. Periods are date ranges rather than EXTRACT(...) so the date indexes
+// apply.
+func entryPeriod(db, query *gorm.DB, organizationID uint, month, year int, custom dateRange, loc *time.Location) *gorm.DB {
+	switch {
+	case custom.IsSet():
+		if !custom.start.IsZero() {
+			query = query.Where("overtime_entries.date >= ?", custom.start)
+		}
+		if !custom.end.IsZero() {
+			query = query.Where("overtime_entries.date < ?", custom.end)
+		}
+		return query
+	case month > 0 && year > 0:
+		start := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, loc)
+		return query.Where("overtime_entries.date >= ? AND overtime_entries.date < ?", start, start.AddDate(0, 1, 0))
+	case year > 0:
+		start := time.Date(year, 1, 1, 0, 0, 0, 0, loc)
+		return query.Where("overtime_entries.date >= ? AND overtime_entries.date < ?", start, start.AddDate(1, 0, 0))
+	case month > 0:
+		// One range for each year the organization has entries in
+		var bounds struct {
+			First *time.Time
+			Last  *time.Time
+		}
+		db.Model(&models.OvertimeEntry{}).Scopes(inOrganization(organizationID)).
+			Select("MIN(date) AS first, MAX(date) AS last").Scan(&bounds)
+		if bounds.First == nil || bounds.Last == nil {
+			return query.Where("1 = 0")
+		}
+
+		var ranges []string
+		var args []interface{}
+		for y := bounds.First.Year(); y <= bounds.Last.Year(); y++ {
+			start := time.Date(y, time.Month(month), 1, 0, 0, 0, 0, loc)
+			ranges = append(ranges, "(overtime_entries.date >= ? AND overtime_entries.date < ?)")
+			args = append(args, start, start.AddDate(0, 1, 0))
+		}
+		return query.Where("("+strings.Join(ranges, " OR ")+")", args...)
+	default:
+		return query
+	}
+}
+
+// entryFilterUsers returns the users entry lists can be filtered by,
+// including deactivated users whose entries are still listed
+func entryFilterUsers(db *gorm.DB, organizationID uint) []models.User {
+	var users []models.User
+	db.Scopes(inOrganization(organizationID)).Where("pending_approval = ?", false).
+		Order("full_name asc, username asc").Find(&users)
+	return users
+}
+
+// totalHours sums the hours of the entries query matches
+func totalHours(query *gorm.DB) float64 {
+	var total float64
+	query.Select("COALESCE(SUM(overtime_entries.hours), 0)").Scan(&total)
+	return total
+}
+
+// entryTotals counts the entries query matches and sums their hours
+func entryTotals(query *gorm.DB) (count int64, hours float64) {
+	var totals struct {
+		Count int64
+		Hours float64
+	}
+	query.Select("COUNT(*) AS count, COALESCE(SUM(overtime_entries.hours), 0) AS hours").Scan(&totals)
+	return totals.Count, totals.Hours
+}
+
+// entrySummary is what the dashboard cards show about the entries in view.
+// The hours leave rejected entries out.
+type entrySummary struct {
+	ThisMonth      float64
+	LastMonth      float64
+	YearToDate     float64
+	PendingEntries int64
+	PendingHours   float64
+}
+
+// summarizeEntries sums the entries query matches in one statement, with
+// months and years in loc
+func summarizeEntries(query *gorm.DB, now time.Time, loc *time.Location) entrySummary {
+	now = now.In(loc)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+	yearStart := time.Date(now.Year(), 1, 1, 0, 0, 0, 0, loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+
+	var summary entrySummary
+	query.Select(`COALESCE(SUM(overtime_entries.hours) FILTER (WHERE overtime_entries.status <> @rejected
+			AND overtime_entries.date >= @month AND overtime_entries.date < @next_month), 0) AS this_month,
+		COALESCE(SUM(overtime_entries.hours) FILTER (WHERE overtime_entries.status <> @rejected
+			AND overtime_entries.date >= @last_month AND overtime_entries.date < @month), 0) AS last_month,
+		COALESCE(SUM(overtime_entries.hours) FILTER (WHERE overtime_entries.status <> @rejected
+			AND overtime_entries.date >= @year AND overtime_entries.date <= @today), 0) AS year_to_date,
+		COUNT(*) FILTER (WHERE overtime_entries.status = @pending) AS pending_entries,
+		COALESCE(SUM(overtime_entries.hours) FILTER (WHERE overtime_entries.status = @pending), 0) AS pending_hours`,
+		map[string]interface{}{
+			"rejected":   models.StatusRejected,
+			"pending":    models.StatusPending,
+			"month":      monthStart,
+			"next_month": monthStart.AddDate(0, 1, 0),
+			"last_month": monthStart.AddDate(0, -1, 0),
+			"year":       yearStart,
+			"today":      today,
+		}).Scan(&summary)
+	return summary
+}
+
+// hoursByUser sums the hours of the entries query matches per user, keyed by
+// display name, and in total
+func hoursByUser(db, query *gorm.DB) (map[string]float64, float64) {
+	var sums []struct {
+		UserID uint
+		Hours  float64
+	}
+	query.Select("overtime_entries.user_id, SUM(overtime_entries.hours) AS hours").
+		Group("overtime_entries.user_id").Scan(&sums)
+
+	userIDs := make([]uint, len(sums))
+	for i, sum := range sums {
+		userIDs[i] = sum.UserID
+	}
+	var users []models.User
+	db.Where("id IN ?", userIDs).Find(&users)
+	names := make(map[uint]string, len(users))
+	for _, user := range users {
+		names[user.ID] = user.DisplayName()
+	}
+
+	hours := make(map[string]float64, len(sums))
+	var total float64
+	for _, sum := range sums {
+		hours[names[sum.UserID]] += sum.Hours
+		total += sum.Hours
+	}
+	return hours, total
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"overtime/config"
+	"overtime/models"
+
+	"gorm.io/gorm"
+)
+
+// Export formats. The semicolon variant uses decimal commas, which is what
+// spreadsheet software expects in most European locales.
+const (
+	exportCSV          = "csv"
+	exportCSVSemicolon = "csv-semicolon"
+)
+
+var exportFormats = []string{exportCSV, exportCSVSemicolon}
+
+// exportXLSX is offered besides the CSV formats by exports that come as Excel
+// workbooks too
+const exportXLSX = "xlsx"
+
+// parseExportFormat returns the requested export format, or fallback when the
+// request names none or an unknown one
+func parseExportFormat(name, fallback string) string {
+	for _, format := range exportFormats {
+		if name == format {
+			return format
+		}
+	}
+	return fallback
+}
+
+func newExportWriter(w io.Writer, format string) *csv.Writer {
+	writer := csv.NewWriter(w)
+	if format == exportCSVSemicolon {
+		writer.Comma = ';'
+	}
+	return writer
+}
+
+// formatExportNumber formats hours and amounts with two decimals
+func formatExportNumber(number float64, format string) string {
+	value := fmt.Sprintf("%.2f", number)
+	if format == exportCSVSemicolon {
+		value = strings.Replace(value, ".", ",", 1)
+	}
+	return value
+}
+
+// entryExport says how exports write entries: numbers in format, rates and
+// costs in currency unless it is empty, and the night hours apart from the
+// others when the organization has a night window. Weekend and holiday hours
+// are always broken down.
+type entryExport struct {
+	format   string
+	currency string
+	night    models.NightWindow
+}
+
+// writeEntriesCSV writes the monthly export of the entries, whose projects
+// and users' cost centers must be loaded
+func writeEntriesCSV(w io.Writer, entries []models.OvertimeEntry, export entryExport) error {
+	writer := newExportWriter(w, export.format)
+	writer.Write(export.header())
+	for _, entry := range entries {
+		writer.Write(export.record(&entry))
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// header names the columns of record
+func (x entryExport) header() []string {
+	header := []string{"Employee", "Employee number", "External ID", "Team", "Project", "Cost center", "Date", "Hours"}
+	if x.night.Enabled() {
+		header = append(header, "Regular hours", "Night hours")
+	}
+	header = append(header, "Weekend hours", "Holiday hours", "Description")
+	if x.currency != "" {
+		header = append(header, "Rate ("+x.currency+")", "Cost ("+x.currency+")")
+	}
+	return header
+}
+
+// record is the line of an entry in an export. Night hours are split off the
+// entry's hours and cost their multiple of the rate.
+func (x entryExport) record(entry *models.OvertimeEntry) []string {
+	record := []string{
+		entry.User.DisplayName(),
+		identifierValue(entry.User.EmployeeNumber),
+		identifierValue(entry.User.ExternalID),
+		entry.TeamName,
+		entry.ProjectName,
+		costCenterLabel(&entry.User),
+		entry.Date.Format("2006-01-02"),
+		formatExportNumber(entry.Hours, x.format),
+	}
+	if x.night.Enabled() {
+		night := x.night.NightHours(entry)
+		record = append(record, formatExportNumber(entry.Hours-night, x.format), formatExportNumber(night, x.format))
+	}
+	weekend, holiday := dayKindHours(entry)
+	record = append(record, formatExportNumber(weekend, x.format), formatExportNumber(holiday, x.format), entry.Description)
+	if x.currency != "" {
+		rate := entry.OvertimeRate()
+		record = append(record, formatExportNumber(rate, x.format), formatExportNumber(x.night.WeightedHours(entry)*rate, x.format))
+	}
+	return record
+}
+
+// dayKindHours returns the entry's hours as weekend or holiday hours,
+// whichever day it was flagged as
+func dayKindHours(entry *models.OvertimeEntry) (weekend, holiday float64) {
+	switch entry.DayKind {
+	case models.DayWeekend:
+		return entry.Hours, 0
+	case models.DayHoliday:
+		return 0, entry.Hours
+	}
+	return 0, 0
+}
+
+// payoutLines returns the payouts approved in the month starting at month
+// as entries to export, paid at the user's own rate
+func payoutLines(db *gorm.DB, organizationID uint, month time.Time) ([]models.OvertimeEntry, error) {
+	var payouts []models.Compensation
+	err := db.Preload("User").Preload("User.Team").
+		Preload("User.CostCenter").Preload("User.Team.CostCenter").
+		Scopes(inOrganization(organizationID)).
+		Where("kind = ? AND date >= ? AND date < ?", models.CompensationPayout, month, month.AddDate(0, 1, 0)).
+		Order("date asc, user_id asc").
+		Find(&payouts).Error
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]models.OvertimeEntry, len(payouts))
+	for i, payout := range payouts {
+		lines[i] = models.OvertimeEntry{
+			UserID:         payout.UserID,
+			User:           payout.User,
+			OrganizationID: payout.OrganizationID,
+			Date:           payout.Date,
+			Hours:          -payout.Hours,
+			Description:    payout.Reason,
+		}
+		if payout.User.Team != nil {
+			lines[i].TeamName = payout.User.Team.Name
+		}
+	}
+	return lines, nil
+}
+
+// MonthlyExport returns the export of an organization's overtime in a month,
+// with rates and costs, for scheduled deliveries to payroll. The payouts
+// approved in the month follow the entries.
+func MonthlyExport(db *gorm.DB, cfg *config.Config) func(w io.Writer, organizationID uint, month time.Time, format string) error {
+	return func(w io.Writer, organizationID uint, month time.Time, format string) error {
+		var entries []models.OvertimeEntry
+		err := db.Preload("User").Preload("User.Team").Preload("Project").
+			Preload("User.CostCenter").Preload("User.Team.CostCenter").
+			Scopes(inOrganization(organizationID)).
+			Where("overtime_entries.date >= ? AND overtime_entries.date < ?", month, month.AddDate(0, 1, 0)).
+			Order("overtime_entries.date asc, overtime_entries.user_id asc").
+			Find(&entries).Error
+		if err != nil {
+			return err
+		}
+		applyEntryTeams(db, entries)
+		payouts, err := payoutLines(db, organizationID, month)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, payouts...)
+		app := loadAppSettings(db, cfg, organizationID)
+		return writeEntriesCSV(w, entries, entryExport{format: format, currency: app.Currency, night: app.Night})
+	}
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"overtime/config"
+	"overtime/middleware"
+	"overtime/models"
+
+	"gorm.io/gorm"
+)
+
+// maxListedExportArchives is how many archived exports the archive page lists
+const maxListedExportArchives = 200
+
+// archiveExport keeps a copy of a monthly export in the export archive when
+// the organization archives exports. archive describes the export, its
+// checksum and size are taken from data.
+func archiveExport(db *gorm.DB, cfg *config.Config, archive models.ExportArchive, data []byte) error {
+	if !loadAppSettings(db, cfg, archive.OrganizationID).ArchiveExports {
+		return nil
+	}
+
+	sum := sha256.Sum256(data)
+	archive.Checksum = hex.EncodeToString(sum[:])
+	archive.Size = len(data)
+	archive.Data = data
+	return db.Create(&archive).Error
+}
+
+// ExportArchiver returns archiveExport for the exports of background jobs,
+// such as deliveries to payroll
+func ExportArchiver(db *gorm.DB, cfg *config.Config) func(organizationID uint, month time.Time, filename, format, generator string, data []byte) error {
+	return func(organizationID uint, month time.Time, filename, format, generator string, data []byte) error {
+		return archiveExport(db, cfg, models.ExportArchive{
+			OrganizationID: organizationID,
+			Month:          month.Format("2006-01"),
+			Filename:       filename,
+			Format:         format,
+			Generator:      generator,
+		}, data)
+	}
+}
+
+// exportFilters returns the filters of an export download as a query string
+// for its archive
+func exportFilters(r *http.Request, names ...string) string {
+	filters := url.Values{}
+	for _, name := range names {
+		if value := r.URL.Query().Get(name); value != "" {
+			filters.Set(name, value)
+		}
+	}
+	return filters.Encode()
+}
+
+// ExportArchivePage lists the archived exports, newest first, optionally of
+// one month
+func (h *OvertimeHandler) ExportArchivePage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanExport() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	query := db.Omit("data").Scopes(inOrganization(user.OrganizationID))
+	month := r.URL.Query().Get("month")
+	if _, err := time.Parse("2006-01", month); err == nil {
+		query = query.Where("month = ?", month)
+	} else {
+		month = ""
+	}
+
+	var archives []models.ExportArchive
+	query.Order("created_at desc, id desc").Limit(maxListedExportArchives).Find(&archives)
+
+	data := map[string]interface{}{
+		"Archives":      archives,
+		"SelectedMonth": month,
+		"Enabled":       loadAppSettings(db, h.config, user.OrganizationID).ArchiveExports,
+		"Limit":         maxListedExportArchives,
+	}
+	render(w, r, h.templates, "export-archive", data)
+}
+
+// DownloadExportArchive serves an archived export as it was generated
+func (h *OvertimeHandler) DownloadExportArchive(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanExport() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 32)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	var archive models.ExportArchive
+	if err := db.Scopes(inOrganization(user.OrganizationID)).First(&archive, id).Error; err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	err = logExport(db, r, user, models.ExportLog{
+		Kind:     models.ExportArchived,
+		Filename: archive.Filename,
+		Format:   archive.Format,
+		Filters:  exportFilters(r, "id"),
+	})
+	if err != nil {
+		http.Error(w, "Failed to log the export", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", archive.Filename))
+	w.Write(archive.Data)
+}
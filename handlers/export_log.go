@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"overtime/middleware"
+	"overtime/models"
+
+	"gorm.io/gorm"
+)
+
+// maxListedExportLogs is how many exports the export log page lists
+const maxListedExportLogs = 200
+
+// exportKinds name the kinds of exports on the export log page
+var exportKinds = []struct{ Kind, Label string }{
+	{models.ExportOvertime, "monthly export"},
+	{models.ExportSupervisor, "supervisor export"},
+	{models.ExportCompliance, "compliance report"},
+	{models.ExportMatrix, "team matrix"},
+	{models.ExportArchived, "archived export"},
+	{models.ExportMonthArchive, "month close archive"},
+	{models.ExportPersonalData, "own personal data"},
+	{models.ExportUsers, "user list"},
+}
+
+// exportRows is the row count of an export log entry
+func exportRows(rows int) *int {
+	return &rows
+}
+
+// logExport records that user downloads an export described by export. It
+// must succeed before the export is handed out, a download the log misses
+// could not be accounted for.
+func logExport(db *gorm.DB, r *http.Request, user *models.User, export models.ExportLog) error {
+	export.OrganizationID = user.OrganizationID
+	export.UserID = user.ID
+	export.IP = middleware.ClientIP(r)
+	return db.Create(&export).Error
+}
+
+// ExportLogPage lists who downloaded which personal data, newest first,
+// optionally of one user or kind of export (admin only)
+func (h *OvertimeHandler) ExportLogPage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	query := db.Preload("User").Scopes(inOrganization(user.OrganizationID))
+	var selectedUserID uint64
+	if uid, err := strconv.ParseUint(r.URL.Query().Get("user_id"), 10, 32); err == nil && uid > 0 {
+		selectedUserID = uid
+		query = query.Where("user_id = ?", uid)
+	}
+	kind := r.URL.Query().Get("kind")
+	if kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+
+	var exports []models.ExportLog
+	query.Order("created_at desc, id desc").Limit(maxListedExportLogs).Find(&exports)
+
+	labels := make(map[string]string, len(exportKinds))
+	for _, kind := range exportKinds {
+		labels[kind.Kind] = kind.Label
+	}
+
+	data := map[string]interface{}{
+		"Exports":        exports,
+		"Kinds":          exportKinds,
+		"KindLabels":     labels,
+		"Users":          entryFilterUsers(db, user.OrganizationID),
+		"SelectedUserID": uint(selectedUserID),
+		"SelectedKind":   kind,
+		"Limit":          maxListedExportLogs,
+	}
+	render(w, r, h.templates, "export-log", data)
+}
+
+// UpdateExportLogHold puts an export log entry on legal hold or releases it
+// (admin only)
+func (h *OvertimeHandler) UpdateExportLogHold(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/export/log", "Invalid form data")
+		return
+	}
+
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/export/log", "Export not found")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	var export models.ExportLog
+	if err := db.Scopes(inOrganization(user.OrganizationID)).First(&export, id).Error; err != nil {
+		redirectWithError(w, r, "/export/log", "Export not found")
+		return
+	}
+
+	hold := r.FormValue("hold") == "true"
+	if err := db.Model(&export).Update("legal_hold", hold).Error; err != nil {
+		redirectWithError(w, r, "/export/log", "Failed to update the legal hold")
+		return
+	}
+
+	action := "released from"
+	if hold {
+		action = "put on"
+	}
+	recordAudit(db, r, user.OrganizationID, &export.UserID, models.AuditExportLegalHold,
+		fmt.Sprintf("export %d %s legal hold by %s", export.ID, action, user.Username))
+	redirectWithSuccess(w, r, "/export/log", "Export "+action+" legal hold")
+}
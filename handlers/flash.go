@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"overtime/middleware"
+	"strings"
+)
+
+// maxKeptFormValue caps each kept form value so the flash cookie stays small
+const maxKeptFormValue = 1000
+
+// maxKeptForm caps the JSON of all kept form values together. Base64 encoded
+// and signed, next to the message, it has to fit the 4KB browsers keep of a
+// cookie.
+const maxKeptForm = 2000
+
+// redirectWithError redirects to url and shows message as an error there
+func redirectWithError(w http.ResponseWriter, r *http.Request, url, message string) {
+	middleware.SetFlash(w, r, middleware.Flash{Error: message})
+	http.Redirect(w, r, url, http.StatusSeeOther)
+}
+
+// redirectWithFormError is like redirectWithError but also keeps the submitted
+// form values so the form can be shown again as the user left it
+func redirectWithFormError(w http.ResponseWriter, r *http.Request, url, message string) {
+	middleware.SetFlash(w, r, middleware.Flash{Error: message, Form: submittedValues(r)})
+	http.Redirect(w, r, url, http.StatusSeeOther)
+}
+
+// redirectWithSuccess redirects to url and shows message as a confirmation there
+func redirectWithSuccess(w http.ResponseWriter, r *http.Request, url, message string) {
+	middleware.SetFlash(w, r, middleware.Flash{Success: message})
+	http.Redirect(w, r, url, http.StatusSeeOther)
+}
+
+// submittedValues returns the posted form values worth keeping. Passwords are
+// never stored in the cookie. Forms too large for it keep nothing, so that the
+// message still gets through.
+func submittedValues(r *http.Request) map[string]string {
+	values := make(map[string]string)
+	for name := range r.PostForm {
+		if strings.Contains(name, "password") {
+			continue
+		}
+		value := r.PostForm.Get(name)
+		if len(value) > maxKeptFormValue {
+			value = value[:maxKeptFormValue]
+		}
+		values[name] = value
+	}
+	if encoded, err := json.Marshal(values); err != nil || len(encoded) > maxKeptForm {
+		return nil
+	}
+	return values
+}
+
+// formValues merges the values kept from a rejected submission over the
+// defaults the form would normally show
+func formValues(defaults, submitted map[string]string) map[string]string {
+	values := make(map[string]string, len(defaults))
+	for name, value := range defaults {
+		values[name] = value
+	}
+	for name, value := range submitted {
+		values[name] = value
+	}
+	if encoded, err := json.Marshal(values); err != nil || len(encoded) > maxKeptForm {
+		return nil
+	}
+	return values
+}
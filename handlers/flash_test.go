@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRedirectWithFormErrorFitsCookie(t *testing.T) {
+	tests := []struct {
+		name     string
+		form     url.Values
+		keepForm bool
+	}{
+		{"small form", url.Values{"description": {"late deploy"}, "password": {"secret"}}, true},
+		{"one long field", url.Values{"description": {strings.Repeat("a", 5000)}}, true},
+		{"many long fields", url.Values{
+			"description": {strings.Repeat("a", 1000)},
+			"note":        {strings.Repeat("b", 1000)},
+			"reason":      {strings.Repeat("c", 1000)},
+		}, false},
+		{"escaped characters", url.Values{"description": {strings.Repeat("<", 1000)}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/overtime", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if err := r.ParseForm(); err != nil {
+				t.Fatal(err)
+			}
+
+			values := submittedValues(r)
+			if _, ok := values["password"]; ok {
+				t.Error("password kept")
+			}
+			if (values != nil) != tt.keepForm {
+				t.Errorf("kept form = %v, want %v", values != nil, tt.keepForm)
+			}
+
+			w := httptest.NewRecorder()
+			redirectWithFormError(w, r, "/overtime", "Hours must be positive")
+			cookies := w.Result().Cookies()
+			if len(cookies) != 1 {
+				t.Fatalf("got %d cookies", len(cookies))
+			}
+			if size := len(cookies[0].String()); size > 4096 {
+				t.Errorf("flash cookie is %d bytes", size)
+			}
+		})
+	}
+}
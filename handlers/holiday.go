@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"net/http"
+	"overtime/middleware"
+	"overtime/models"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+// organizationHolidays returns the organization's holidays from the start of
+// last year on, which the settings page lists
+func organizationHolidays(db *gorm.DB, organizationID uint, now time.Time) []models.Holiday {
+	var holidays []models.Holiday
+	db.Scopes(inOrganization(organizationID)).
+		Where("date >= ?", time.Date(now.Year()-1, time.January, 1, 0, 0, 0, 0, time.UTC).Format("2006-01-02")).
+		Order("date").Find(&holidays)
+	return holidays
+}
+
+// retagEntryDays flags the organization's entries on the date again after
+// it became or stopped being a holiday
+func retagEntryDays(tx *gorm.DB, organizationID uint, date time.Time, holiday bool) error {
+	return tx.Model(&models.OvertimeEntry{}).
+		Where("organization_id = ? AND date = ?", organizationID, date.Format("2006-01-02")).
+		Update("day_kind", models.DayKind(date, holiday)).Error
+}
+
+// CreateHoliday adds a holiday and flags the entries already on its date
+func (h *SettingsHandler) CreateHoliday(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/settings", "Invalid form data")
+		return
+	}
+
+	date, err := time.Parse("2006-01-02", r.FormValue("date"))
+	if err != nil {
+		redirectWithFormError(w, r, "/settings", "Invalid holiday date")
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		redirectWithFormError(w, r, "/settings", "Holiday name is required")
+		return
+	}
+	if utf8.RuneCountInString(name) > 100 {
+		redirectWithFormError(w, r, "/settings", "Holiday name is too long (at most 100 characters)")
+		return
+	}
+
+	holiday := models.Holiday{OrganizationID: user.OrganizationID, Date: date, Name: name}
+	db := h.db.WithContext(r.Context())
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&holiday).Error; err != nil {
+			return err
+		}
+		return retagEntryDays(tx, user.OrganizationID, date, true)
+	})
+	if err != nil {
+		redirectWithFormError(w, r, "/settings", "Failed to add holiday (the date may already be one)")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/settings", "Holiday added")
+}
+
+// DeleteHoliday removes a holiday, its entries are flagged as weekend or
+// working day entries again
+func (h *SettingsHandler) DeleteHoliday(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/settings", "Invalid form data")
+		return
+	}
+
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/settings", "Invalid holiday ID")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	var holiday models.Holiday
+	if err := db.Scopes(inOrganization(user.OrganizationID)).First(&holiday, id).Error; err != nil {
+		redirectWithError(w, r, "/settings", "Holiday not found")
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&holiday).Error; err != nil {
+			return err
+		}
+		return retagEntryDays(tx, user.OrganizationID, holiday.Date, false)
+	})
+	if err != nil {
+		redirectWithError(w, r, "/settings", "Failed to delete holiday")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/settings", "Holiday deleted")
+}
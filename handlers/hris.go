@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"html/template"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"overtime/config"
+	"overtime/hris"
+	"overtime/middleware"
+	"overtime/models"
+
+	"gorm.io/gorm"
+)
+
+// bambooHRCompany is a BambooHR company subdomain
+var bambooHRCompany = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,99}$`)
+
+type HRISHandler struct {
+	db        *gorm.DB
+	config    *config.Config
+	templates map[string]*template.Template
+	syncer    *hris.Syncer
+}
+
+func NewHRISHandler(db *gorm.DB, cfg *config.Config, templates map[string]*template.Template, syncer *hris.Syncer) *HRISHandler {
+	return &HRISHandler{
+		db:        db,
+		config:    cfg,
+		templates: templates,
+		syncer:    syncer,
+	}
+}
+
+// findHRISConnection loads the organization's HR system connection
+func findHRISConnection(db *gorm.DB, organizationID uint) (*models.HRISConnection, bool) {
+	var connection models.HRISConnection
+	if err := db.Scopes(inOrganization(organizationID)).First(&connection).Error; err != nil {
+		return nil, false
+	}
+	return &connection, true
+}
+
+// HRISPage shows the organization's HR system connection and how the last
+// sync went (admin only)
+func (h *HRISHandler) HRISPage(w http.ResponseWriter, r *http.Request) {
+	h.renderPage(w, r, nil, false)
+}
+
+// HRISPreview shows the changes a sync would make without making them, a
+// dry run of the sync (admin only)
+func (h *HRISHandler) HRISPreview(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	connection, ok := findHRISConnection(h.db.WithContext(r.Context()), user.OrganizationID)
+	if !ok {
+		redirectWithError(w, r, "/hris", "Connect an HR system first")
+		return
+	}
+	changes, err := h.syncer.Preview(connection)
+	if err != nil {
+		redirectWithError(w, r, "/hris", "Could not read the employees: "+err.Error())
+		return
+	}
+	h.renderPage(w, r, changes, true)
+}
+
+func (h *HRISHandler) renderPage(w http.ResponseWriter, r *http.Request, changes []hris.Change, preview bool) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	connection, _ := findHRISConnection(h.db.WithContext(r.Context()), user.OrganizationID)
+	data := map[string]interface{}{
+		"Connection": connection,
+		"Enabled":    h.syncer.Enabled(),
+		"Interval":   h.config.HRISSyncInterval,
+		"Preview":    preview,
+		"Changes":    changes,
+		"Summary":    hris.Summary(changes),
+	}
+	render(w, r, h.templates, "hris", data)
+}
+
+// SaveHRISConnection connects the organization to its HR system or changes
+// the connection. An empty secret keeps the stored one.
+func (h *HRISHandler) SaveHRISConnection(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/hris", "Invalid form data")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	connection, ok := findHRISConnection(db, user.OrganizationID)
+	if !ok {
+		connection = &models.HRISConnection{OrganizationID: user.OrganizationID, Enabled: true}
+	}
+	connection.Kind = r.FormValue("kind")
+	connection.Company = strings.ToLower(strings.TrimSpace(r.FormValue("company")))
+	connection.ClientID = strings.TrimSpace(r.FormValue("client_id"))
+	if secret := strings.TrimSpace(r.FormValue("secret")); secret != "" {
+		connection.Secret = secret
+	}
+
+	if len(connection.ClientID) > 255 || len(connection.Secret) > 255 {
+		redirectWithError(w, r, "/hris", "Client ID and secret may have at most 255 characters")
+		return
+	}
+	switch connection.Kind {
+	case models.HRISPersonio:
+		if connection.ClientID == "" || connection.Secret == "" {
+			redirectWithError(w, r, "/hris", "Personio client ID and secret are required")
+			return
+		}
+		connection.Company = ""
+	case models.HRISBambooHR:
+		if !bambooHRCompany.MatchString(connection.Company) || connection.Secret == "" {
+			redirectWithError(w, r, "/hris", "BambooHR company subdomain and API key are required")
+			return
+		}
+		connection.ClientID = ""
+	default:
+		redirectWithError(w, r, "/hris", "Invalid HR system")
+		return
+	}
+
+	if err := db.Save(connection).Error; err != nil {
+		redirectWithError(w, r, "/hris", "Failed to save the connection")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/hris", connection.KindLabel()+" connected, preview the sync to check it")
+}
+
+// ToggleHRISConnection pauses or resumes the scheduled sync
+func (h *HRISHandler) ToggleHRISConnection(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	connection, ok := findHRISConnection(db, user.OrganizationID)
+	if !ok {
+		redirectWithError(w, r, "/hris", "No HR system connected")
+		return
+	}
+
+	enabled := !connection.Enabled
+	if err := db.Model(connection).Update("enabled", enabled).Error; err != nil {
+		redirectWithError(w, r, "/hris", "Failed to update the connection")
+		return
+	}
+
+	if enabled {
+		redirectWithSuccess(w, r, "/hris", "Sync from "+connection.KindLabel()+" resumed")
+	} else {
+		redirectWithSuccess(w, r, "/hris", "Sync from "+connection.KindLabel()+" paused")
+	}
+}
+
+// DeleteHRISConnection disconnects the HR system. Synced users stay as they
+// are, with their employee IDs for a later connection.
+func (h *HRISHandler) DeleteHRISConnection(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	connection, ok := findHRISConnection(db, user.OrganizationID)
+	if !ok {
+		redirectWithError(w, r, "/hris", "No HR system connected")
+		return
+	}
+	if err := db.Delete(connection).Error; err != nil {
+		redirectWithError(w, r, "/hris", "Failed to delete the connection")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/hris", connection.KindLabel()+" disconnected")
+}
+
+// SyncHRIS syncs the users right away and sums up what changed
+func (h *HRISHandler) SyncHRIS(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	connection, ok := findHRISConnection(h.db.WithContext(r.Context()), user.OrganizationID)
+	if !ok {
+		redirectWithError(w, r, "/hris", "No HR system connected")
+		return
+	}
+
+	changes, err := h.syncer.Sync(connection)
+	if err != nil {
+		redirectWithError(w, r, "/hris", "Sync failed: "+err.Error())
+		return
+	}
+	if hris.Count(changes)[hris.ChangeSkip] > 0 {
+		redirectWithError(w, r, "/hris", "Synced with "+hris.Summary(changes)+", preview the sync to see why")
+		return
+	}
+	redirectWithSuccess(w, r, "/hris", "Synced: "+hris.Summary(changes))
+}
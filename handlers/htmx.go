@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"net/http"
+	"overtime/models"
+)
+
+// Entry list views that render rows through the shared entry-row templates
+const (
+	viewDashboard  = "dashboard"
+	viewAllEntries = "all"
+)
+
+// isHTMX reports whether the request was sent by htmx and expects a fragment
+// instead of a full page
+func isHTMX(r *http.Request) bool {
+	return r.Header.Get("HX-Request") == "true"
+}
+
+// entryRow is the data behind a single row of an entry table. The columns
+// shown depend on the list the row belongs to and on the viewing user.
+type entryRow struct {
+	User  *models.User
+	Entry *models.OvertimeEntry
+	View  string
+	Error string
+	// HREdits is set when the viewing user may correct entries as HR
+	HREdits bool
+	// CSRFToken is sent by the row's forms
+	CSRFToken string
+}
+
+func entryRows(user *models.User, entries []models.OvertimeEntry, view string, hrEdits bool, csrfToken string) []entryRow {
+	rows := make([]entryRow, len(entries))
+	for i := range entries {
+		rows[i] = entryRow{User: user, Entry: &entries[i], View: view, HREdits: hrEdits, CSRFToken: csrfToken}
+	}
+	return rows
+}
+
+// ShowEmployee reports whether the row includes the employee column
+func (row entryRow) ShowEmployee() bool {
+	return row.View == viewAllEntries || row.User.CanViewAllOvertime()
+}
+
+// ShowTeamProject reports whether the row includes the team and project columns
+func (row entryRow) ShowTeamProject() bool {
+	return row.View == viewDashboard && row.User.CanViewAllOvertime()
+}
+
+// ShowSelect reports whether the row has a checkbox for the bulk edit
+func (row entryRow) ShowSelect() bool {
+	return row.View == viewAllEntries
+}
+
+// ShowActions reports whether the row includes the actions column
+func (row entryRow) ShowActions() bool {
+	if row.View == viewAllEntries {
+		return row.User.IsAdmin() || row.HREdits
+	}
+	return row.User.IsAdmin() || row.User.IsEmployee() || row.HREdits
+}
+
+// CanManage reports whether the viewing user may edit or delete the entry
+func (row entryRow) CanManage() bool {
+	return row.User.CanManageEntry(row.Entry)
+}
+
+// CanCorrect reports whether the viewing user may edit, but not delete, the
+// entry as HR
+func (row entryRow) CanCorrect() bool {
+	return row.User.CanCorrectOvertimeFor(&row.Entry.User, row.HREdits)
+}
+
+// parseView returns the entry list view named in the request, defaulting to
+// the dashboard
+func parseView(name string) string {
+	if name == viewAllEntries {
+		return viewAllEntries
+	}
+	return viewDashboard
+}
+
+// redirectOrFail reports a failed action as a plain error response to htmx,
+// which shows it in place, and as a flash message after a redirect otherwise
+func redirectOrFail(w http.ResponseWriter, r *http.Request, url, message string) {
+	if isHTMX(r) {
+		http.Error(w, message, http.StatusUnprocessableEntity)
+		return
+	}
+	redirectWithError(w, r, url, message)
+}
@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"overtime/middleware"
+	"overtime/models"
+
+	"gorm.io/gorm"
+)
+
+// maxIdentifierImportSize limits the CSV of employee numbers and external IDs
+const maxIdentifierImportSize = 1 << 20
+
+// Longest employee number and external ID, the sizes of their columns
+const (
+	maxEmployeeNumberLength = 50
+	maxExternalIDLength     = 128
+)
+
+// parseIdentifier reads an employee number or external ID. Empty values
+// clear the identifier and are returned as nil.
+func parseIdentifier(value string, maxLength int) (*string, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, true
+	}
+	if utf8.RuneCountInString(value) > maxLength || strings.IndexFunc(value, unicode.IsControl) >= 0 {
+		return nil, false
+	}
+	return &value, true
+}
+
+// identifierValue returns the identifier, empty when it is not set
+func identifierValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+// identifierTaken reports whether another user of the organization already
+// has the employee number or external ID in column
+func identifierTaken(db *gorm.DB, organizationID uint, column string, value *string, userID uint) bool {
+	if value == nil {
+		return false
+	}
+	var count int64
+	db.Model(&models.User{}).Scopes(inOrganization(organizationID)).
+		Where(column+" = ? AND id <> ?", *value, userID).Count(&count)
+	return count > 0
+}
+
+// importError is a problem with an imported file that is shown as is
+type importError string
+
+func (e importError) Error() string {
+	return string(e)
+}
+
+// identifierImport is one row of an identifier import
+type identifierImport struct {
+	line           int
+	username       string
+	employeeNumber *string
+	externalID     *string
+}
+
+// readIdentifierImport parses a CSV with the columns username,
+// employee_number and external_id in any order, separated by commas or
+// semicolons. An identifier column may be left out to keep the values.
+func readIdentifierImport(r io.Reader) (rows []identifierImport, hasEmployeeNumber, hasExternalID bool, err error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, false, false, err
+	}
+	text := strings.TrimPrefix(string(data), "\uFEFF")
+	firstLine, _, _ := strings.Cut(text, "\n")
+
+	reader := csv.NewReader(strings.NewReader(text))
+	if strings.Count(firstLine, ";") > strings.Count(firstLine, ",") {
+		reader.Comma = ';'
+	}
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, false, false, importError("The file is empty")
+	}
+	if err != nil {
+		return nil, false, false, importError("The file is not a valid CSV: " + err.Error())
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	usernameColumn, ok := columns["username"]
+	if !ok {
+		return nil, false, false, importError("The first line must name the columns, including username")
+	}
+	employeeNumberColumn, hasEmployeeNumber := columns["employee_number"]
+	externalIDColumn, hasExternalID := columns["external_id"]
+	if !hasEmployeeNumber && !hasExternalID {
+		return nil, false, false, importError("The file needs an employee_number or external_id column")
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, false, false, importError("The file is not a valid CSV: " + err.Error())
+		}
+		line, _ := reader.FieldPos(0)
+		cell := func(column int) string {
+			if column < len(record) {
+				return record[column]
+			}
+			return ""
+		}
+		row := identifierImport{line: line, username: strings.TrimSpace(cell(usernameColumn))}
+		if row.username == "" {
+			continue
+		}
+		if hasEmployeeNumber {
+			if row.employeeNumber, ok = parseIdentifier(cell(employeeNumberColumn), maxEmployeeNumberLength); !ok {
+				return nil, false, false, importError(fmt.Sprintf("Line %d: employee number may have at most %d characters", line, maxEmployeeNumberLength))
+			}
+		}
+		if hasExternalID {
+			if row.externalID, ok = parseIdentifier(cell(externalIDColumn), maxExternalIDLength); !ok {
+				return nil, false, false, importError(fmt.Sprintf("Line %d: external ID may have at most %d characters", line, maxExternalIDLength))
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, hasEmployeeNumber, hasExternalID, nil
+}
+
+// ImportUserIdentifiers sets the employee numbers and external IDs of the
+// organization's users from a CSV, e.g. exported from the payroll system.
+// The import is all or nothing; empty cells clear an identifier.
+func (h *AuthHandler) ImportUserIdentifiers(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxIdentifierImportSize+(64<<10))
+	if err := r.ParseMultipartForm(maxIdentifierImportSize); err != nil {
+		redirectWithError(w, r, "/users", "Invalid form data (the file may be too large, at most 1 MB)")
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		redirectWithError(w, r, "/users", "Choose a CSV file to import")
+		return
+	}
+	defer file.Close()
+
+	rows, hasEmployeeNumber, hasExternalID, err := readIdentifierImport(file)
+	var message importError
+	if errors.As(err, &message) {
+		redirectWithError(w, r, "/users", message.Error())
+		return
+	}
+	if err != nil {
+		redirectWithError(w, r, "/users", "Failed to read the file")
+		return
+	}
+	if len(rows) == 0 {
+		redirectWithError(w, r, "/users", "The file lists no users")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	changed := map[uint]bool{}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var users []models.User
+		if err := tx.Scopes(inOrganization(user.OrganizationID)).Where("deactivated_at IS NULL").Find(&users).Error; err != nil {
+			return err
+		}
+		byUsername := make(map[string]*models.User, len(users))
+		for i := range users {
+			byUsername[strings.ToLower(users[i].Username)] = &users[i]
+		}
+
+		// Check the identifiers as they will be, so numbers can be swapped
+		for _, row := range rows {
+			target, ok := byUsername[strings.ToLower(row.username)]
+			if !ok {
+				return importError(fmt.Sprintf("Line %d: no active user %s", row.line, row.username))
+			}
+			if hasEmployeeNumber {
+				target.EmployeeNumber = row.employeeNumber
+			}
+			if hasExternalID {
+				target.ExternalID = row.externalID
+			}
+			changed[target.ID] = true
+		}
+		employeeNumbers, externalIDs := map[string]string{}, map[string]string{}
+		for _, u := range users {
+			if u.EmployeeNumber != nil {
+				if other, ok := employeeNumbers[*u.EmployeeNumber]; ok {
+					return importError(fmt.Sprintf("Employee number %s would belong to both %s and %s", *u.EmployeeNumber, other, u.Username))
+				}
+				employeeNumbers[*u.EmployeeNumber] = u.Username
+			}
+			if u.ExternalID != nil {
+				if other, ok := externalIDs[*u.ExternalID]; ok {
+					return importError(fmt.Sprintf("External ID %s would belong to both %s and %s", *u.ExternalID, other, u.Username))
+				}
+				externalIDs[*u.ExternalID] = u.Username
+			}
+		}
+
+		// Clear before setting, the unique indexes see every single update
+		ids := make([]uint, 0, len(changed))
+		for id := range changed {
+			ids = append(ids, id)
+		}
+		cleared := map[string]interface{}{}
+		if hasEmployeeNumber {
+			cleared["employee_number"] = nil
+		}
+		if hasExternalID {
+			cleared["external_id"] = nil
+		}
+		if err := tx.Model(&models.User{}).Where("id IN ?", ids).Updates(cleared).Error; err != nil {
+			return err
+		}
+		for _, u := range users {
+			if !changed[u.ID] {
+				continue
+			}
+			values := map[string]interface{}{}
+			if hasEmployeeNumber {
+				values["employee_number"] = u.EmployeeNumber
+			}
+			if hasExternalID {
+				values["external_id"] = u.ExternalID
+			}
+			if err := tx.Model(&models.User{}).Where("id = ?", u.ID).Updates(values).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.As(err, &message) {
+		redirectWithError(w, r, "/users", "Nothing was imported. "+message.Error())
+		return
+	}
+	if err != nil {
+		redirectWithError(w, r, "/users", "Failed to import identifiers")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/users", fmt.Sprintf("Identifiers of %d users imported", len(changed)))
+}
@@ -0,0 +1,317 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"overtime/middleware"
+	"overtime/models"
+	"overtime/services"
+
+	"gorm.io/gorm"
+)
+
+// maxInviteImportSize limits the CSV of names invites are created for
+const maxInviteImportSize = 256 << 10
+
+// maxBulkInvites is the most invites created from one CSV
+const maxBulkInvites = 200
+
+// parseInviteRole reads the role an invite grants
+func parseInviteRole(value string) (models.Role, bool) {
+	switch models.Role(value) {
+	case models.RoleEmployee, models.RoleSupervisor, models.RoleHR, models.RoleAdmin:
+		return models.Role(value), true
+	}
+	return "", false
+}
+
+// parseAssignment reads an optional team or project of the organization, nil
+// when value is empty
+func parseAssignment(db *gorm.DB, model interface{}, value string, organizationID uint) (*uint, bool) {
+	if value == "" {
+		return nil, true
+	}
+	parsed, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || !organizationExists(db, model, uint(parsed), organizationID) {
+		return nil, false
+	}
+	id := uint(parsed)
+	return &id, true
+}
+
+// CreateInviteTemplate saves a role, team and project to create invites with
+func (h *AuthHandler) CreateInviteTemplate(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanCreateInvites() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/invites", "Invalid form data")
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || utf8.RuneCountInString(name) > 100 {
+		redirectWithError(w, r, "/invites", "Template name is required (at most 100 characters)")
+		return
+	}
+	role, ok := parseInviteRole(r.FormValue("role"))
+	if !ok {
+		redirectWithError(w, r, "/invites", "Invalid role")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	teamID, ok := parseAssignment(db, &models.Team{}, r.FormValue("team_id"), user.OrganizationID)
+	if !ok {
+		redirectWithError(w, r, "/invites", "Team not found")
+		return
+	}
+	projectID, ok := parseAssignment(db, &models.Project{}, r.FormValue("project_id"), user.OrganizationID)
+	if !ok {
+		redirectWithError(w, r, "/invites", "Project not found")
+		return
+	}
+
+	template := models.InviteTemplate{
+		OrganizationID: user.OrganizationID,
+		Name:           name,
+		Role:           role,
+		TeamID:         teamID,
+		ProjectID:      projectID,
+	}
+	if err := db.Create(&template).Error; err != nil {
+		redirectWithError(w, r, "/invites", "Failed to create template, the name may already be used")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/invites", fmt.Sprintf("Template %s created", template.Name))
+}
+
+// DeleteInviteTemplate deletes an invite template, invites created from it
+// stay as they are
+func (h *AuthHandler) DeleteInviteTemplate(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanCreateInvites() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/invites", "Invalid form data")
+		return
+	}
+
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/invites", "Invalid template ID")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	result := db.Scopes(inOrganization(user.OrganizationID)).Delete(&models.InviteTemplate{}, id)
+	if result.Error != nil {
+		redirectWithError(w, r, "/invites", "Failed to delete template")
+		return
+	}
+	if result.RowsAffected == 0 {
+		redirectWithError(w, r, "/invites", "Template not found")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/invites", "Template deleted")
+}
+
+// inviteImport is one row of a CSV invites are created from
+type inviteImport struct {
+	line     int
+	fullName string
+	email    string
+}
+
+// readInviteImport parses a CSV with the columns full_name and, optionally,
+// email, separated by commas or semicolons
+func readInviteImport(r io.Reader) ([]inviteImport, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimPrefix(string(data), "\uFEFF")
+	firstLine, _, _ := strings.Cut(text, "\n")
+
+	reader := csv.NewReader(strings.NewReader(text))
+	if strings.Count(firstLine, ";") > strings.Count(firstLine, ",") {
+		reader.Comma = ';'
+	}
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, importError("The file is empty")
+	}
+	if err != nil {
+		return nil, importError("The file is not a valid CSV: " + err.Error())
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	fullNameColumn, ok := columns["full_name"]
+	if !ok {
+		return nil, importError("The first line must name the columns, including full_name")
+	}
+	emailColumn, hasEmail := columns["email"]
+
+	var rows []inviteImport
+	emails := map[string]int{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, importError("The file is not a valid CSV: " + err.Error())
+		}
+		line, _ := reader.FieldPos(0)
+		cell := func(column int) string {
+			if column < len(record) {
+				return strings.TrimSpace(record[column])
+			}
+			return ""
+		}
+		row := inviteImport{line: line, fullName: cell(fullNameColumn)}
+		if hasEmail {
+			row.email = cell(emailColumn)
+		}
+		if row.fullName == "" && row.email == "" {
+			continue
+		}
+		if row.fullName == "" || utf8.RuneCountInString(row.fullName) > 200 {
+			return nil, importError(fmt.Sprintf("Line %d: full name is required (at most 200 characters)", line))
+		}
+		if row.email != "" {
+			if !strings.Contains(row.email, "@") || len(row.email) > 255 {
+				return nil, importError(fmt.Sprintf("Line %d: invalid email address", line))
+			}
+			if other, ok := emails[strings.ToLower(row.email)]; ok {
+				return nil, importError(fmt.Sprintf("Line %d: email address %s is already on line %d", line, row.email, other))
+			}
+			emails[strings.ToLower(row.email)] = line
+		}
+		rows = append(rows, row)
+		if len(rows) > maxBulkInvites {
+			return nil, importError(fmt.Sprintf("At most %d invites can be created at once", maxBulkInvites))
+		}
+	}
+	return rows, nil
+}
+
+// BulkCreateInvites creates an invite from a template for every name in a
+// CSV. It is all or nothing.
+func (h *AuthHandler) BulkCreateInvites(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanCreateInvites() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxInviteImportSize+(64<<10))
+	if err := r.ParseMultipartForm(maxInviteImportSize); err != nil {
+		redirectWithError(w, r, "/invites", "Invalid form data (the file may be too large, at most 256 KB)")
+		return
+	}
+
+	templateID, err := strconv.ParseUint(r.FormValue("template_id"), 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/invites", "Choose a template")
+		return
+	}
+	db := h.db.WithContext(r.Context())
+	var template models.InviteTemplate
+	if err := db.Scopes(inOrganization(user.OrganizationID)).First(&template, templateID).Error; err != nil {
+		redirectWithError(w, r, "/invites", "Template not found")
+		return
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		redirectWithError(w, r, "/invites", "Choose a CSV file of names")
+		return
+	}
+	defer file.Close()
+
+	rows, err := readInviteImport(file)
+	var message importError
+	if errors.As(err, &message) {
+		redirectWithError(w, r, "/invites", message.Error())
+		return
+	}
+	if err != nil {
+		redirectWithError(w, r, "/invites", "Failed to read the file")
+		return
+	}
+	if len(rows) == 0 {
+		redirectWithError(w, r, "/invites", "The file lists no names")
+		return
+	}
+
+	expiresAt := time.Now().Add(loadAppSettings(db, h.config, user.OrganizationID).InviteExpiration)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, row := range rows {
+			taken, err := services.EmailTaken(tx, row.email, 0)
+			if err != nil {
+				return err
+			}
+			if taken {
+				return importError(fmt.Sprintf("Line %d: email address %s is already used by another account", row.line, row.email))
+			}
+
+			code, err := models.GenerateInviteCode()
+			if err != nil {
+				return err
+			}
+			shortCode, err := models.GenerateShortCode()
+			if err != nil {
+				return err
+			}
+			invite := models.Invite{
+				OrganizationID: user.OrganizationID,
+				Code:           code,
+				ShortCode:      &shortCode,
+				FullName:       row.fullName,
+				Email:          row.email,
+				Role:           template.Role,
+				CreatedBy:      user.ID,
+				ExpiresAt:      expiresAt,
+				TeamID:         template.TeamID,
+				ProjectID:      template.ProjectID,
+			}
+			if err := tx.Create(&invite).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.As(err, &message) {
+		redirectWithError(w, r, "/invites", message.Error())
+		return
+	}
+	if err != nil {
+		redirectWithError(w, r, "/invites", "Failed to create invites")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/invites", fmt.Sprintf("%d invites created from template %s", len(rows), template.Name))
+}
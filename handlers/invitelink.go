@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"image/png"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"overtime/middleware"
+	"overtime/models"
+	"overtime/qrcode"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// qrScale is the number of pixels per QR code module, large enough to print
+// and to scan from a screen
+const qrScale = 6
+
+// inviteLink is the link to register with an invite, the short one when the
+// invite has a short code
+func inviteLink(base string, invite *models.Invite) string {
+	if invite.ShortCode != nil {
+		return base + "/i/" + *invite.ShortCode
+	}
+	return base + "/register?code=" + url.QueryEscape(invite.Code)
+}
+
+// ShortInviteLink redirects a short /i/ link to the registration form of
+// its invite
+func (h *AuthHandler) ShortInviteLink(w http.ResponseWriter, r *http.Request) {
+	db := h.db.WithContext(r.Context())
+	var invite models.Invite
+	if err := db.Where("short_code = ?", chi.URLParam(r, "code")).First(&invite).Error; err != nil {
+		http.Error(w, "Invalid invite link", http.StatusBadRequest)
+		return
+	}
+
+	if !invite.IsValid() {
+		http.Error(w, "Invite link has expired or already been used", http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/register?code="+url.QueryEscape(invite.Code), http.StatusSeeOther)
+}
+
+// InviteQRCode serves the link of one of the user's invites as a QR code
+// PNG, to be scanned when inviting someone in person
+func (h *AuthHandler) InviteQRCode(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanCreateInvites() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 32)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	var invite models.Invite
+	if err := db.Scopes(inOrganization(user.OrganizationID)).
+		Where("created_by = ?", user.ID).First(&invite, id).Error; err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	code, err := qrcode.Encode(inviteLink(baseURL(h.config, r), &invite))
+	if err != nil {
+		http.Error(w, "The invite link is too long for a QR code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if err := png.Encode(w, code.Image(qrScale)); err != nil {
+		log.Printf("Failed to write QR code of invite %d: %v", invite.ID, err)
+	}
+}
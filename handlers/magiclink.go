@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"overtime/middleware"
+	"overtime/models"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// magicLinkInterval limits how often a login link is sent to the same user
+const magicLinkInterval = time.Minute
+
+// magicLinkSent is shown whether or not an account matched, so the form does
+// not reveal which email addresses are registered
+const magicLinkSent = "If an account uses this email address, a login link is on its way."
+
+// LoginLinkPage asks for the email address to send a login link to
+func (h *AuthHandler) LoginLinkPage(w http.ResponseWriter, r *http.Request) {
+	if !h.config.MagicLinkLogin {
+		http.NotFound(w, r)
+		return
+	}
+
+	render(w, r, h.templates, "login-link", map[string]interface{}{})
+}
+
+// SendLoginLink emails a single-use login link to every account with the
+// given address. Accounts that still have to set their password are left out,
+// they need to log in with it.
+func (h *AuthHandler) SendLoginLink(w http.ResponseWriter, r *http.Request) {
+	if !h.config.MagicLinkLogin {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/login/link", "Invalid form data")
+		return
+	}
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	if email == "" {
+		redirectWithError(w, r, "/login/link", "Email is required")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+
+	var users []models.User
+	db.Where("LOWER(email) = LOWER(?) AND must_change_password = ? AND pending_approval = ? AND pending_verification = ? AND deactivated_at IS NULL", email, false, false, false).Find(&users)
+
+	for _, user := range users {
+		var recent int64
+		db.Model(&models.LoginToken{}).
+			Where("user_id = ? AND purpose = '' AND created_at > ?", user.ID, time.Now().Add(-magicLinkInterval)).
+			Count(&recent)
+		if recent > 0 {
+			continue
+		}
+
+		code, err := models.GenerateApprovalCode()
+		if err != nil {
+			log.Printf("Failed to generate login code for user %d: %v", user.ID, err)
+			continue
+		}
+
+		record := models.LoginToken{
+			Code:      code,
+			UserID:    user.ID,
+			ExpiresAt: time.Now().Add(h.config.MagicLinkExpiration),
+		}
+		if err := db.Create(&record).Error; err != nil {
+			log.Printf("Failed to store login token for user %d: %v", user.ID, err)
+			continue
+		}
+
+		token, err := middleware.GenerateLoginToken(code, user.ID, h.config.MagicLinkExpiration)
+		if err != nil {
+			log.Printf("Failed to sign login token for user %d: %v", user.ID, err)
+			continue
+		}
+
+		// Never the request's host: whoever asks for the link picks it, and the
+		// token would go to their server
+		link := h.config.BaseURL + "/login/magic?token=" + url.QueryEscape(token)
+		body := fmt.Sprintf(`Someone asked for a login link for the account %s.
+
+Log in: %s
+
+The link works once and expires on %s. If you did not ask for it, you can
+ignore this email.
+`,
+			user.Username,
+			link,
+			record.ExpiresAt.In(user.Location()).Format("2006-01-02 15:04"),
+		)
+
+		go func(to string) {
+			if err := h.mailer.Send([]string{to}, "Your login link", body); err != nil {
+				log.Printf("Failed to email login link to %s: %v", to, err)
+			}
+		}(user.Email)
+
+		recordAudit(db, r, user.OrganizationID, &user.ID, models.AuditMagicLinkRequested, "")
+	}
+
+	redirectWithSuccess(w, r, "/login/link", magicLinkSent)
+}
+
+// loadLoginLink resolves an emailed link for purpose, empty for login links,
+// to its record, or returns a message for links that are forged, expired or
+// already used
+func loadLoginLink(db *gorm.DB, tokenString, purpose string) (*models.LoginToken, string) {
+	claims, err := middleware.ValidateLoginToken(tokenString)
+	if err != nil {
+		return nil, "This link is invalid or has expired."
+	}
+
+	var record models.LoginToken
+	if err := db.Preload("User").Where("code = ?", claims.ID).First(&record).Error; err != nil {
+		return nil, "This link is invalid or has expired."
+	}
+
+	if record.UserID != claims.UserID || record.User == nil || record.Purpose != purpose {
+		return nil, "This link is invalid or has expired."
+	}
+
+	if record.User.DeactivatedAt != nil {
+		return nil, "This account has been deactivated."
+	}
+
+	if !record.IsValid() {
+		return nil, "This link has already been used or has expired."
+	}
+
+	return &record, ""
+}
+
+// MagicLinkPage confirms the login. Mail scanners prefetch links, so the link
+// is only used up on POST.
+func (h *AuthHandler) MagicLinkPage(w http.ResponseWriter, r *http.Request) {
+	if !h.config.MagicLinkLogin {
+		http.NotFound(w, r)
+		return
+	}
+
+	tokenString := r.URL.Query().Get("token")
+
+	db := h.db.WithContext(r.Context())
+	record, problem := loadLoginLink(db, tokenString, "")
+	if problem != "" {
+		data := map[string]interface{}{
+			"Error": problem,
+		}
+		render(w, r, h.templates, "login-link", data)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Token":    tokenString,
+		"Username": record.User.Username,
+	}
+	render(w, r, h.templates, "login-link", data)
+}
+
+// MagicLinkLogin logs the user in with an emailed login link
+func (h *AuthHandler) MagicLinkLogin(w http.ResponseWriter, r *http.Request) {
+	if !h.config.MagicLinkLogin {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	record, problem := loadLoginLink(db, r.FormValue("token"), "")
+	if problem != "" {
+		data := map[string]interface{}{
+			"Error": problem,
+		}
+		render(w, r, h.templates, "login-link", data)
+		return
+	}
+
+	// Only one of two concurrent requests may use the link
+	result := db.Model(&models.LoginToken{}).
+		Where("id = ? AND used_at IS NULL", record.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil || result.RowsAffected != 1 {
+		data := map[string]interface{}{
+			"Error": "This login link has already been used or has expired.",
+		}
+		render(w, r, h.templates, "login-link", data)
+		return
+	}
+
+	user := record.User
+	if !h.startLogin(db, w, r, user) {
+		return
+	}
+	recordAudit(db, r, user.OrganizationID, &user.ID, models.AuditMagicLinkLogin, "")
+	redirectAfterLogin(w, r, user)
+}
@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"overtime/cache"
+	"overtime/middleware"
+	"overtime/models"
+
+	"gorm.io/gorm"
+)
+
+// matrixRow is one employee's overtime per day of the month
+type matrixRow struct {
+	User  string
+	Hours []float64
+	Total float64
+}
+
+// teamMatrix lays out a team's overtime in a month as employees by days.
+// Aggregated matrices only have the day totals of their Employees, Hidden
+// ones not even those.
+type teamMatrix struct {
+	Days       []time.Time
+	Rows       []matrixRow
+	DayTotals  []float64
+	Total      float64
+	Employees  int
+	Aggregated bool
+	Hidden     bool
+}
+
+// matrixTeams returns the teams the user may see the matrix of: every team
+// for admins and HR, the assigned teams for supervisors
+func matrixTeams(db *gorm.DB, c cache.Cache, user *models.User) []models.Team {
+	teams := organizationTeams(db, c, user.OrganizationID)
+	if !user.IsSupervisor() {
+		return teams
+	}
+
+	supervised := user.SupervisedTeamIDs()
+	var assigned []models.Team
+	for _, team := range teams {
+		if slices.Contains(supervised, team.ID) {
+			assigned = append(assigned, team)
+		}
+	}
+	return assigned
+}
+
+// buildTeamMatrix loads the overtime of the team's members in the month.
+// Supervisors only see the members within their project. Rejected entries
+// are left out, pending ones unless withPending. Members are listed by
+// pseudonym for roles limited to pseudonymous data.
+func buildTeamMatrix(db *gorm.DB, user *models.User, teamID uint, monthStart time.Time, withPending bool, pseudonyms *pseudonymizer) teamMatrix {
+	monthEnd := monthStart.AddDate(0, 1, 0)
+
+	members := db.Scopes(inOrganization(user.OrganizationID)).Where("team_id = ?", teamID)
+	if user.IsSupervisor() && len(user.ProjectIDs()) > 0 {
+		members = members.Scopes(onProjects(user.ProjectIDs()))
+	} else if user.IsSupervisor() {
+		members = members.Where("1 = 0")
+	}
+	var users []models.User
+	members.Order("full_name asc, username asc").Find(&users)
+	pseudonyms.applyUsers(users)
+
+	statuses := []models.EntryStatus{models.StatusApproved}
+	if withPending {
+		statuses = append(statuses, models.StatusPending)
+	}
+	userIDs := make([]uint, len(users))
+	for i := range users {
+		userIDs[i] = users[i].ID
+	}
+	var entries []models.OvertimeEntry
+	if len(userIDs) > 0 {
+		query := db.Where("user_id IN ? AND status IN ? AND date >= ? AND date < ?", userIDs, statuses, monthStart, monthEnd)
+		if user.IsSupervisor() {
+			query = query.Where("project_id IN ?", user.ProjectIDs())
+		}
+		query.Find(&entries)
+	}
+
+	var matrix teamMatrix
+	for day := monthStart; day.Before(monthEnd); day = day.AddDate(0, 0, 1) {
+		matrix.Days = append(matrix.Days, day)
+	}
+	matrix.DayTotals = make([]float64, len(matrix.Days))
+
+	rows := make(map[uint]*matrixRow, len(users))
+	matrix.Rows = make([]matrixRow, len(users))
+	for i := range users {
+		matrix.Rows[i] = matrixRow{User: users[i].DisplayName(), Hours: make([]float64, len(matrix.Days))}
+		rows[users[i].ID] = &matrix.Rows[i]
+	}
+	for _, entry := range entries {
+		day := entry.Date.Day() - 1
+		row := rows[entry.UserID]
+		row.Hours[day] += entry.Hours
+		row.Total += entry.Hours
+		matrix.DayTotals[day] += entry.Hours
+		matrix.Total += entry.Hours
+	}
+	return matrix
+}
+
+// aggregate leaves the day totals of the matrix for reports limited to
+// groups of at least minEmployees employees, and hides those as well for
+// smaller teams. Zero leaves the matrix as it is.
+func (m *teamMatrix) aggregate(minEmployees int) {
+	if minEmployees == 0 {
+		return
+	}
+	m.Employees = len(m.Rows)
+	m.Rows = nil
+	m.Aggregated = true
+	if m.Employees < minEmployees {
+		m.DayTotals = make([]float64, len(m.Days))
+		m.Total = 0
+		m.Hidden = true
+	}
+}
+
+// matrixParams reads the team, month and pending option of the matrix from
+// the query, defaulting to the first team and the current month. ok is false
+// if the user may not see the requested team.
+func matrixParams(r *http.Request, user *models.User, teams []models.Team) (teamID uint, monthStart time.Time, withPending, ok bool) {
+	now := user.Now()
+	month, year := int(now.Month()), now.Year()
+	if m, err := strconv.Atoi(r.URL.Query().Get("month")); err == nil && m >= 1 && m <= 12 {
+		month = m
+	}
+	if y, err := strconv.Atoi(r.URL.Query().Get("year")); err == nil && y >= 2000 && y <= 2100 {
+		year = y
+	}
+	monthStart = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, user.Location())
+	withPending = r.URL.Query().Get("pending") != ""
+
+	if len(teams) == 0 {
+		return 0, monthStart, withPending, false
+	}
+	teamID = teams[0].ID
+	if idStr := r.URL.Query().Get("team_id"); idStr != "" {
+		id, err := strconv.ParseUint(idStr, 10, 32)
+		if err != nil || !slices.ContainsFunc(teams, func(t models.Team) bool { return t.ID == uint(id) }) {
+			return 0, monthStart, withPending, false
+		}
+		teamID = uint(id)
+	}
+	return teamID, monthStart, withPending, true
+}
+
+// TeamMatrixPage shows a team's overtime in a month as employees by days
+func (h *OvertimeHandler) TeamMatrixPage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	db := h.db.WithContext(r.Context())
+
+	teams := matrixTeams(db, h.cache, user)
+	teamID, monthStart, withPending, ok := matrixParams(r, user, teams)
+	if !ok && len(teams) > 0 {
+		redirectWithError(w, r, "/matrix", "Team not found")
+		return
+	}
+
+	app := loadAppSettings(db, h.config, user.OrganizationID)
+	minGroup := reportMinGroup(app, user, nil)
+	var matrix teamMatrix
+	if ok {
+		matrix = buildTeamMatrix(db, user, teamID, monthStart, withPending, worksCouncilView(db, h.config, user))
+		matrix.aggregate(minGroup)
+	}
+
+	currentYear := user.Now().Year()
+	years := make([]int, 5)
+	for i := 0; i < 5; i++ {
+		years[i] = currentYear - i
+	}
+
+	data := map[string]interface{}{
+		"Teams":             teams,
+		"Matrix":            matrix,
+		"SelectedTeamID":    teamID,
+		"SelectedMonth":     int(monthStart.Month()),
+		"SelectedYear":      monthStart.Year(),
+		"WithPending":       withPending,
+		"Years":             years,
+		"ExportFormat":      app.ExportFormat,
+		"MinGroupEmployees": minGroup,
+	}
+	render(w, r, h.templates, "matrix", data)
+}
+
+// TeamMatrixCSV exports the matrix of TeamMatrixPage
+func (h *OvertimeHandler) TeamMatrixCSV(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	db := h.db.WithContext(r.Context())
+
+	teams := matrixTeams(db, h.cache, user)
+	teamID, monthStart, withPending, ok := matrixParams(r, user, teams)
+	if !ok {
+		http.Error(w, "Team not found", http.StatusNotFound)
+		return
+	}
+	app := loadAppSettings(db, h.config, user.OrganizationID)
+	format := parseExportFormat(r.URL.Query().Get("format"), app.ExportFormat)
+	pseudonyms := worksCouncilView(db, h.config, user)
+	matrix := buildTeamMatrix(db, user, teamID, monthStart, withPending, pseudonyms)
+	minGroup := reportMinGroup(app, user, nil)
+	matrix.aggregate(minGroup)
+	if matrix.Hidden {
+		http.Error(w, fmt.Sprintf("The team has fewer than %d employees, its figures are not shown", minGroup), http.StatusForbidden)
+		return
+	}
+
+	var teamName string
+	for _, team := range teams {
+		if team.ID == teamID {
+			teamName = team.Name
+		}
+	}
+
+	filename := fmt.Sprintf("overtime_matrix_%s_%d_%02d.csv", teamName, monthStart.Year(), int(monthStart.Month()))
+	err := logExport(db, r, user, models.ExportLog{
+		Kind:          models.ExportMatrix,
+		Filename:      filename,
+		Format:        format,
+		Filters:       exportFilters(r, "team_id", "month", "year", "pending"),
+		Rows:          exportRows(len(matrix.Rows)),
+		Pseudonymized: pseudonyms != nil,
+	})
+	if err != nil {
+		http.Error(w, "Failed to log the export", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+
+	writer := newExportWriter(w, format)
+	defer writer.Flush()
+
+	cell := func(hours float64) string {
+		if hours == 0 {
+			return ""
+		}
+		return formatExportNumber(hours, format)
+	}
+
+	header := []string{"Employee"}
+	for _, day := range matrix.Days {
+		header = append(header, day.Format("2006-01-02"))
+	}
+	writer.Write(append(header, "Total"))
+
+	for _, row := range matrix.Rows {
+		record := []string{row.User}
+		for _, hours := range row.Hours {
+			record = append(record, cell(hours))
+		}
+		writer.Write(append(record, formatExportNumber(row.Total, format)))
+	}
+
+	totals := []string{"Total"}
+	for _, hours := range matrix.DayTotals {
+		totals = append(totals, cell(hours))
+	}
+	writer.Write(append(totals, formatExportNumber(matrix.Total, format)))
+}
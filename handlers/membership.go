@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"overtime/middleware"
+	"overtime/models"
+
+	"gorm.io/gorm"
+)
+
+// teamName returns the name of the team with the ID, for audit details
+func teamName(teams []models.Team, id *uint) string {
+	if id != nil {
+		for _, t := range teams {
+			if t.ID == *id {
+				return t.Name
+			}
+		}
+	}
+	return "no team"
+}
+
+// projectName returns the name of the project with the ID, for audit details
+func projectName(projects []models.Project, id *uint) string {
+	if id != nil {
+		for _, p := range projects {
+			if p.ID == *id {
+				return p.Name
+			}
+		}
+	}
+	return "no project"
+}
+
+// UpdateMembership moves a user to another team or home project. Unlike the
+// rest of the user, HR may change these too.
+func (h *AuthHandler) UpdateMembership(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanManageMemberships() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/users", "Invalid form data")
+		return
+	}
+
+	idStr := r.FormValue("id")
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/users", "Invalid user ID")
+		return
+	}
+	editURL := "/users/edit?id=" + idStr
+
+	db := h.db.WithContext(r.Context())
+
+	var editUser models.User
+	if err := db.Scopes(inOrganization(user.OrganizationID)).First(&editUser, id).Error; err != nil {
+		redirectWithError(w, r, "/users", "User not found")
+		return
+	}
+
+	teams := organizationTeams(db, h.cache, user.OrganizationID)
+	projects := organizationProjects(db, h.cache, user.OrganizationID)
+
+	// Update team
+	previousTeamID := editUser.TeamID
+	teamIDStr := r.FormValue("team_id")
+	if teamIDStr == "" {
+		editUser.TeamID = nil
+	} else {
+		if tid, err := strconv.ParseUint(teamIDStr, 10, 32); err == nil {
+			teamID := uint(tid)
+			if !organizationExists(db, &models.Team{}, teamID, user.OrganizationID) {
+				redirectWithFormError(w, r, editURL, "Team not found")
+				return
+			}
+			editUser.TeamID = &teamID
+		}
+	}
+	// Reports attribute entries to the previous team until the change
+	teamChanged := !sameID(previousTeamID, editUser.TeamID)
+	today := user.Now().Format("2006-01-02")
+	teamFromStr := r.FormValue("team_from")
+	if teamFromStr == "" {
+		teamFromStr = today
+	}
+	teamFrom, err := time.Parse("2006-01-02", teamFromStr)
+	if teamChanged && (err != nil || teamFromStr > today) {
+		redirectWithFormError(w, r, editURL, "The team change must be effective today or earlier")
+		return
+	}
+
+	// Update project
+	previousProjectID := editUser.ProjectID
+	projectIDStr := r.FormValue("project_id")
+	if projectIDStr == "" {
+		editUser.ProjectID = nil
+	} else {
+		if pid, err := strconv.ParseUint(projectIDStr, 10, 32); err == nil {
+			projectID := uint(pid)
+			if !organizationExists(db, &models.Project{}, projectID, user.OrganizationID) {
+				redirectWithFormError(w, r, editURL, "Project not found")
+				return
+			}
+			editUser.ProjectID = &projectID
+		}
+	}
+	projectChanged := !sameID(previousProjectID, editUser.ProjectID)
+
+	if !teamChanged && !projectChanged {
+		redirectWithSuccess(w, r, editURL, "Nothing changed")
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&editUser).Select("team_id", "project_id").Updates(&editUser).Error; err != nil {
+			return err
+		}
+		if teamChanged {
+			return recordTeamChange(tx, &editUser, previousTeamID, teamFrom)
+		}
+		return nil
+	})
+	if errors.Is(err, errTeamChangeBefore) {
+		redirectWithFormError(w, r, editURL, err.Error())
+		return
+	}
+	if err != nil {
+		redirectWithFormError(w, r, editURL, "Failed to update team and project")
+		return
+	}
+
+	if teamChanged {
+		recordAudit(db, r, user.OrganizationID, &editUser.ID, models.AuditMembershipChanged,
+			fmt.Sprintf("team %s -> %s from %s by %s", teamName(teams, previousTeamID), teamName(teams, editUser.TeamID), teamFromStr, user.Username))
+	}
+	if projectChanged {
+		recordAudit(db, r, user.OrganizationID, &editUser.ID, models.AuditMembershipChanged,
+			fmt.Sprintf("home project %s -> %s by %s", projectName(projects, previousProjectID), projectName(projects, editUser.ProjectID), user.Username))
+	}
+
+	redirectWithSuccess(w, r, editURL, "Team and project updated")
+}
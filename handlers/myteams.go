@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"overtime/middleware"
+	"overtime/models"
+	"overtime/services"
+)
+
+// teamMember is a member of a supervised team with their overtime of the
+// current month and what waits for the supervisor
+type teamMember struct {
+	User models.User
+	// ApprovedHours and PendingHours are the month to date
+	ApprovedHours  float64
+	PendingHours   float64
+	Balance        float64
+	PendingEntries int64
+	PendingTimeOff int64
+}
+
+// supervisedTeam is a team on the supervisor's My teams page
+type supervisedTeam struct {
+	Team    models.Team
+	Members []teamMember
+	// Pending counts the entries and time off requests waiting for the
+	// supervisor in the team
+	Pending int64
+}
+
+// MyTeamsPage shows a supervisor the members of their teams within their
+// project, with each member's hours this month, time off balance and what
+// waits for approval
+func (h *SupervisorHandler) MyTeamsPage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsSupervisor() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	db.Preload("Project").First(user, user.ID)
+
+	if len(user.ProjectIDs()) == 0 {
+		data := map[string]interface{}{
+			"Error": "You are not assigned to a project. Please contact an administrator.",
+		}
+		render(w, r, h.templates, "supervisor-teams", data)
+		return
+	}
+
+	teams := h.getAuthorizedTeams(r.Context(), user.ID)
+	if len(teams) == 0 {
+		data := map[string]interface{}{
+			"Projects": userProjects(db, user),
+			"Error":    "You are not assigned to supervise any teams. Please contact an administrator.",
+		}
+		render(w, r, h.templates, "supervisor-teams", data)
+		return
+	}
+
+	teamIDs := make([]uint, len(teams))
+	for i, team := range teams {
+		teamIDs[i] = team.ID
+	}
+	var users []models.User
+	db.Scopes(inOrganization(user.OrganizationID), onProjects(user.ProjectIDs())).
+		Where("team_id IN ? AND deactivated_at IS NULL AND pending_approval = ?", teamIDs, false).
+		Order("full_name asc, username asc").Find(&users)
+	userIDs := make([]uint, len(users))
+	for i := range users {
+		userIDs[i] = users[i].ID
+	}
+
+	// Month to date in the supervisor's time zone, like the team matrix
+	now := user.Now()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, user.Location())
+	var hours []struct {
+		UserID uint
+		Status models.EntryStatus
+		Hours  float64
+	}
+	var pendingEntries, pendingTimeOff []struct {
+		UserID uint
+		Count  int64
+	}
+	if len(userIDs) > 0 {
+		db.Model(&models.OvertimeEntry{}).
+			Where("user_id IN ? AND project_id IN ? AND status IN ? AND date >= ? AND date <= ?", userIDs, user.ProjectIDs(),
+				[]models.EntryStatus{models.StatusApproved, models.StatusPending}, monthStart, now).
+			Select("user_id, status, SUM(hours) AS hours").Group("user_id, status").Scan(&hours)
+		reviewableEntries(db, user).Where("users.id IN ?", userIDs).
+			Select("users.id AS user_id, COUNT(*) AS count").Group("users.id").Scan(&pendingEntries)
+		reviewableTimeOff(db, user).Where("users.id IN ?", userIDs).
+			Select("users.id AS user_id, COUNT(*) AS count").Group("users.id").Scan(&pendingTimeOff)
+	}
+
+	members := make(map[uint]*teamMember, len(users))
+	byTeam := make(map[uint][]*teamMember, len(teams))
+	for i := range users {
+		member := &teamMember{User: users[i]}
+		member.Balance, _ = services.TimeOffBalance(db, users[i].ID)
+		members[users[i].ID] = member
+		byTeam[*users[i].TeamID] = append(byTeam[*users[i].TeamID], member)
+	}
+	for _, sum := range hours {
+		if sum.Status == models.StatusApproved {
+			members[sum.UserID].ApprovedHours = sum.Hours
+		} else {
+			members[sum.UserID].PendingHours = sum.Hours
+		}
+	}
+	for _, count := range pendingEntries {
+		members[count.UserID].PendingEntries = count.Count
+	}
+	for _, count := range pendingTimeOff {
+		members[count.UserID].PendingTimeOff = count.Count
+	}
+
+	supervised := make([]supervisedTeam, len(teams))
+	for i, team := range teams {
+		supervised[i].Team = team
+		for _, member := range byTeam[team.ID] {
+			supervised[i].Members = append(supervised[i].Members, *member)
+			supervised[i].Pending += member.PendingEntries + member.PendingTimeOff
+		}
+	}
+
+	data := map[string]interface{}{
+		"Projects":   userProjects(db, user),
+		"Teams":      supervised,
+		"MonthStart": monthStart,
+	}
+	render(w, r, h.templates, "supervisor-teams", data)
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"overtime/models"
+	"strings"
+)
+
+// navLink is a link in the navigation bar
+type navLink struct {
+	Label string
+	URL   string
+	// Active marks the link of the page being shown
+	Active bool
+	// Approvals shows how many entries wait for the user's decision
+	Approvals bool
+}
+
+// navigation returns the links of the navigation bar for the pages user may
+// open, following the role checks of the routes in main.go
+func navigation(user *models.User, path string) []navLink {
+	var links []navLink
+	add := func(label, url string) {
+		links = append(links, navLink{Label: label, URL: url})
+	}
+
+	if user.IsSupervisor() {
+		add("dashboard", "/supervisor/dashboard")
+		add("my-teams", "/supervisor/teams")
+		add("export", "/supervisor/export")
+	} else {
+		add("dashboard", "/dashboard")
+	}
+	add("time-off", "/time-off")
+	if user.IsAdmin() || user.IsSupervisor() || user.IsHR() {
+		links = append(links, navLink{Label: "approvals", URL: "/approvals", Approvals: true})
+		add("team-matrix", "/matrix")
+	}
+	if user.CanViewAllOvertime() {
+		add("all-entries", "/overtime/all")
+		add("export", "/export")
+		add("compliance", "/compliance")
+		add("allocation", "/allocation")
+	}
+	if user.CanCreateInvites() {
+		add("invites", "/invites")
+	}
+	if user.CanManageMemberships() {
+		add("users", "/users")
+	}
+	if user.CanCreateInvites() {
+		add("supervisors", "/supervisors")
+	}
+	if user.CanManageOrganizations() {
+		add("organizations", "/organizations")
+		add("backups", "/backups")
+	}
+	if user.IsAdmin() {
+		add("settings", "/settings")
+		add("deliveries", "/deliveries")
+		add("hr-sync", "/hris")
+		add("api", "/api/docs")
+	}
+	add("profile", "/profile")
+	add("logout", "/logout")
+
+	for i := range links {
+		links[i].Active = path == links[i].URL || strings.HasPrefix(path, links[i].URL+"/")
+	}
+	return links
+}
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"mime"
+	"net/http"
+	"overtime/models"
+	"strings"
+)
+
+// wantsJSON reports whether the client asked for JSON instead of a page with
+// Accept: application/json. Whichever of JSON and HTML is listed first wins,
+// so browsers sending their usual Accept header still get pages.
+func wantsJSON(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/json":
+			return true
+		case "text/html":
+			return false
+		}
+	}
+	return false
+}
+
+// redirectOrStatus answers JSON clients with message and status, everyone
+// else is redirected to url with message as the flash error
+func redirectOrStatus(w http.ResponseWriter, r *http.Request, url, message string, status int) {
+	if wantsJSON(r) {
+		http.Error(w, message, status)
+		return
+	}
+	redirectWithError(w, r, url, message)
+}
+
+// apiEntry is an overtime entry as JSON clients see it. The models are not
+// encoded directly, they reference each other and carry internal fields.
+type apiEntry struct {
+	ID            uint    `json:"id"`
+	Date          string  `json:"date" doc:"Day the overtime was worked, as YYYY-MM-DD"`
+	Hours         float64 `json:"hours"`
+	Description   string  `json:"description"`
+	Status        string  `json:"status" doc:"PENDING, APPROVED or REJECTED"`
+	Stage         string  `json:"stage,omitempty" doc:"Approver a pending entry waits for, SUPERVISOR or HR"`
+	ReviewComment string  `json:"review_comment,omitempty" doc:"The reviewer's note, e.g. the reason for a rejection"`
+	UserID        uint    `json:"user_id"`
+	User          string  `json:"user" doc:"Display name of the employee"`
+	// EmployeeNumber and UserExternalID identify the employee in payroll
+	// and ERP systems
+	EmployeeNumber string `json:"employee_number,omitempty" doc:"The employee's number in payroll"`
+	UserExternalID string `json:"user_external_id,omitempty" doc:"The employee's ID in an external system"`
+	Team           string `json:"team,omitempty"`
+	ProjectID      *uint  `json:"project_id,omitempty" doc:"Project the overtime was logged on"`
+	Project        string `json:"project,omitempty"`
+	CanManage      bool   `json:"can_manage" doc:"Whether the current user may edit or delete the entry"`
+	CorrectedBy    string `json:"corrected_by,omitempty" doc:"Display name of the HR user who last corrected the entry"`
+	// WorkedHours is only set for overtime calculated from worked time
+	WorkedHours    *float64 `json:"worked_hours,omitempty" doc:"Hours worked that day"`
+	StartTime      *string  `json:"start_time,omitempty" doc:"When the overtime started, as HH:MM"`
+	EndTime        *string  `json:"end_time,omitempty" doc:"When the overtime ended, as HH:MM; at or before the start means the next day"`
+	Acknowledgment string   `json:"acknowledgment,omitempty" doc:"The employee's note on an entry past the soft limit per month; set only for such entries"`
+	DayKind        string   `json:"day_kind,omitempty" doc:"WEEKEND or HOLIDAY for overtime worked on a weekend or one of the organization's holidays"`
+}
+
+type entryListResponse struct {
+	Entries      []apiEntry `json:"entries"`
+	TotalHours   float64    `json:"total_hours" doc:"Sum of the hours of every entry matching the filters, including entries not listed"`
+	TotalEntries int64      `json:"total_entries" doc:"Number of entries matching the filters, of which the latest 100 are listed"`
+}
+
+type allEntriesResponse struct {
+	Entries     []apiEntry         `json:"entries"`
+	TotalHours  float64            `json:"total_hours"`
+	HoursByUser map[string]float64 `json:"hours_by_user" doc:"Hours per employee, keyed by display name"`
+	TotalCost   float64            `json:"total_cost,omitempty" doc:"What the entries cost at the current hourly rates, for administrators and HR"`
+	CostByUser  map[string]float64 `json:"cost_by_user,omitempty" doc:"Cost per employee, keyed by display name"`
+	Currency    string             `json:"currency,omitempty" doc:"ISO 4217 code of the costs"`
+	CostCenters []costCenterTotal  `json:"cost_centers,omitempty" doc:"Hours per cost center, left out when no entry is booked on one"`
+	Groups      []groupTotal       `json:"groups,omitempty" doc:"Hours per team and project, given instead of the entries to roles limited to pseudonymous data"`
+}
+
+// apiUser is a user account as JSON clients see it
+type apiUser struct {
+	ID                 uint   `json:"id"`
+	Username           string `json:"username"`
+	FullName           string `json:"full_name"`
+	Email              string `json:"email"`
+	Role               string `json:"role"`
+	TeamID             *uint  `json:"team_id"`
+	Team               string `json:"team,omitempty"`
+	ProjectID          *uint  `json:"project_id"`
+	Project            string `json:"project,omitempty"`
+	MustChangePassword bool   `json:"must_change_password"`
+	Deactivated        bool   `json:"deactivated,omitempty"`
+	PendingApproval    bool   `json:"pending_approval,omitempty" doc:"Registered without an invite and not activated yet"`
+	// PendingVerification is set until the address of an account from open
+	// signup is confirmed
+	PendingVerification bool   `json:"pending_verification,omitempty" doc:"Registered without an invite and the email address not confirmed yet"`
+	EmployeeNumber      string `json:"employee_number,omitempty"`
+	ExternalID          string `json:"external_id,omitempty"`
+}
+
+type userListResponse struct {
+	Users []apiUser `json:"users"`
+}
+
+func newAPIEntry(user *models.User, entry *models.OvertimeEntry) apiEntry {
+	e := apiEntry{
+		ID:             entry.ID,
+		Date:           entry.Date.Format("2006-01-02"),
+		Hours:          entry.Hours,
+		WorkedHours:    entry.WorkedHours,
+		StartTime:      entry.StartTime,
+		EndTime:        entry.EndTime,
+		Acknowledgment: entry.Acknowledgment,
+		DayKind:        entry.DayKind,
+		Description:    entry.Description,
+		Status:         string(entry.Status),
+		ReviewComment:  entry.ReviewComment,
+		UserID:         entry.UserID,
+		User:           entry.User.DisplayName(),
+		EmployeeNumber: identifierValue(entry.User.EmployeeNumber),
+		UserExternalID: identifierValue(entry.User.ExternalID),
+		ProjectID:      entry.ProjectID,
+		CanManage:      user.CanManageEntry(entry),
+	}
+	if entry.IsPending() {
+		e.Stage = string(entry.Stage)
+	}
+	if entry.Corrector != nil {
+		e.CorrectedBy = entry.Corrector.DisplayName()
+	}
+	e.Team = entry.TeamName
+	e.Project = entry.ProjectName
+	return e
+}
+
+func newAPIEntries(user *models.User, entries []models.OvertimeEntry) []apiEntry {
+	list := make([]apiEntry, len(entries))
+	for i := range entries {
+		list[i] = newAPIEntry(user, &entries[i])
+	}
+	return list
+}
+
+func newAPIUsers(users []models.User) []apiUser {
+	list := make([]apiUser, len(users))
+	for i, u := range users {
+		list[i] = apiUser{
+			ID:                  u.ID,
+			Username:            u.Username,
+			FullName:            u.FullName,
+			Email:               u.Email,
+			Role:                string(u.Role),
+			TeamID:              u.TeamID,
+			ProjectID:           u.ProjectID,
+			MustChangePassword:  u.MustChangePassword,
+			Deactivated:         u.DeactivatedAt != nil,
+			PendingApproval:     u.PendingApproval,
+			PendingVerification: u.PendingVerification,
+			EmployeeNumber:      identifierValue(u.EmployeeNumber),
+			ExternalID:          identifierValue(u.ExternalID),
+		}
+		if u.Team != nil {
+			list[i].Team = u.Team.Name
+		}
+		if u.Project != nil {
+			list[i].Project = u.Project.Name
+		}
+	}
+	return list
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"overtime/middleware"
+	"overtime/models"
+	"overtime/xlsx"
+
+	"gorm.io/gorm"
+)
+
+// orgChartHeader are the columns of the org chart export
+var orgChartHeader = []string{"Username", "Full name", "Email", "Employee number", "External ID", "Role", "Status",
+	"Team", "Home project", "Other projects", "Supervised teams", "Supervisors"}
+
+// userStatus names the state of a user's account in the org chart export
+func userStatus(u *models.User) string {
+	switch {
+	case u.AnonymizedAt != nil:
+		return "anonymized"
+	case u.DeactivatedAt != nil:
+		return "deactivated"
+	case u.PendingApproval:
+		return "pending approval"
+	}
+	return "active"
+}
+
+// supervisorsOf returns the usernames of the supervisors who are assigned to
+// the user's team and share a project with them
+func supervisorsOf(supervisors []models.User, u *models.User) []string {
+	var names []string
+	if u.TeamID == nil {
+		return names
+	}
+	for i := range supervisors {
+		supervisor := &supervisors[i]
+		if supervisor.ID == u.ID || !slices.Contains(supervisor.SupervisedTeamIDs(), *u.TeamID) {
+			continue
+		}
+		for _, projectID := range u.ProjectIDs() {
+			if supervisor.OnProject(projectID) {
+				names = append(names, supervisor.Username)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// orgChartRecords returns a row per user of the org chart export. The users'
+// teams, projects, memberships and team assignments must be loaded.
+func orgChartRecords(users, supervisors []models.User) [][]string {
+	records := make([][]string, 0, len(users))
+	for i := range users {
+		u := &users[i]
+		team, project := "", ""
+		if u.Team != nil {
+			team = u.Team.Name
+		}
+		if u.Project != nil {
+			project = u.Project.Name
+		}
+		var others, supervised []string
+		for _, m := range u.ProjectMemberships {
+			if m.Project != nil && (u.ProjectID == nil || m.ProjectID != *u.ProjectID) {
+				others = append(others, m.Project.Name)
+			}
+		}
+		if u.IsSupervisor() {
+			for _, a := range u.TeamAssignments {
+				if a.Team != nil {
+					supervised = append(supervised, a.Team.Name)
+				}
+			}
+		}
+		records = append(records, []string{
+			u.Username,
+			u.FullName,
+			u.Email,
+			identifierValue(u.EmployeeNumber),
+			identifierValue(u.ExternalID),
+			string(u.Role),
+			userStatus(u),
+			team,
+			project,
+			strings.Join(others, ", "),
+			strings.Join(supervised, ", "),
+			strings.Join(supervisorsOf(supervisors, u), ", "),
+		})
+	}
+	return records
+}
+
+// ExportUsers exports the users with their role, status, team, projects and
+// supervisor assignments as CSV or Excel workbook, for reconciling them with
+// the HR system. It takes the filters of the users page (admin only).
+func (h *AuthHandler) ExportUsers(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	withAssignments := func(db *gorm.DB) *gorm.DB {
+		return db.Preload("ProjectMemberships.Project").Preload("TeamAssignments.Team").
+			Scopes(inOrganization(user.OrganizationID))
+	}
+	query := db.Preload("Team").Preload("Project").Scopes(withAssignments).Order("username asc")
+	if teamID, err := strconv.ParseUint(r.URL.Query().Get("team"), 10, 32); err == nil {
+		query = query.Where("team_id = ?", teamID)
+	}
+	if projectID, err := strconv.ParseUint(r.URL.Query().Get("project"), 10, 32); err == nil {
+		query = query.Scopes(onProjects([]uint{uint(projectID)}))
+	}
+	var users []models.User
+	if err := query.Find(&users).Error; err != nil {
+		http.Error(w, "Failed to load users", http.StatusInternalServerError)
+		return
+	}
+	// Supervisors are listed whatever the filters leave out
+	var supervisors []models.User
+	db.Scopes(withAssignments).Where("role = ? AND deactivated_at IS NULL", models.RoleSupervisor).Find(&supervisors)
+
+	format := r.URL.Query().Get("format")
+	if format != exportXLSX {
+		format = parseExportFormat(format, loadAppSettings(db, h.config, user.OrganizationID).ExportFormat)
+	}
+	extension := "csv"
+	if format == exportXLSX {
+		extension = "xlsx"
+	}
+	filename := fmt.Sprintf("users_%s.%s", user.Now().Format("2006-01-02"), extension)
+	err := logExport(db, r, user, models.ExportLog{
+		Kind:     models.ExportUsers,
+		Filename: filename,
+		Format:   format,
+		Filters:  exportFilters(r, "team", "project"),
+		Rows:     exportRows(len(users)),
+	})
+	if err != nil {
+		http.Error(w, "Failed to log the export", http.StatusInternalServerError)
+		return
+	}
+
+	records := orgChartRecords(users, supervisors)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	if format != exportXLSX {
+		w.Header().Set("Content-Type", "text/csv")
+		writer := newExportWriter(w, format)
+		writer.Write(orgChartHeader)
+		writer.WriteAll(records)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	if err := writeOrgChartXLSX(w, records, user.Now()); err != nil {
+		log.Printf("Failed to write users of organization %d: %v", user.OrganizationID, err)
+	}
+}
+
+func writeOrgChartXLSX(w io.Writer, records [][]string, now time.Time) error {
+	book, err := xlsx.NewWriter(w, "Users")
+	if err != nil {
+		return err
+	}
+	if err := book.WriteRow("Users on " + now.Format("2006-01-02")); err != nil {
+		return err
+	}
+	if err := book.WriteRow(); err != nil {
+		return err
+	}
+	for _, record := range append([][]string{orgChartHeader}, records...) {
+		cells := make([]interface{}, len(record))
+		for i, value := range record {
+			cells[i] = value
+		}
+		if err := book.WriteRow(cells...); err != nil {
+			return err
+		}
+	}
+	return book.Close()
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"net/http"
+	"overtime/middleware"
+	"overtime/models"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// inOrganization restricts a query to the records of one organization. The
+// condition names the queried table, so it stays unambiguous in joins.
+func inOrganization(organizationID uint) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where(clause.Eq{
+			Column: clause.Column{Table: clause.CurrentTable, Name: "organization_id"},
+			Value:  organizationID,
+		})
+	}
+}
+
+// organizationExists reports whether the record with the given ID belongs to
+// the organization, e.g. a team or project picked in a form
+func organizationExists(db *gorm.DB, model interface{}, id, organizationID uint) bool {
+	var count int64
+	db.Model(model).Scopes(inOrganization(organizationID)).Where("id = ?", id).Count(&count)
+	return count > 0
+}
+
+type organizationRow struct {
+	models.Organization
+	UserCount int64
+}
+
+// OrganizationsPage lists the organizations hosted on the instance (platform admins only)
+func (h *AuthHandler) OrganizationsPage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanManageOrganizations() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+
+	var organizations []organizationRow
+	db.Model(&models.Organization{}).
+		Select("organizations.*, COUNT(users.id) AS user_count").
+		Joins("LEFT JOIN users ON users.organization_id = organizations.id AND users.deleted_at IS NULL").
+		Group("organizations.id").
+		Order("organizations.name asc").
+		Scan(&organizations)
+
+	// Admin invites of other organizations are only listed here
+	var invites []models.Invite
+	db.Preload("Organization").
+		Where("role = ? AND used = ? AND expires_at > ?", models.RoleAdmin, false, time.Now()).
+		Order("created_at desc").
+		Find(&invites)
+
+	flash := middleware.PopFlash(w, r)
+	data := map[string]interface{}{
+		"BaseURL":       baseURL(h.config, r),
+		"Organizations": organizations,
+		"Invites":       invites,
+		"Form":          flash.Form,
+		"Error":         flash.Error,
+		"Success":       flash.Success,
+	}
+	render(w, r, h.templates, "organizations", data)
+}
+
+// CreateOrganization creates an organization together with an invite for its
+// first administrator
+func (h *AuthHandler) CreateOrganization(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanManageOrganizations() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/organizations", "Invalid form data")
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		redirectWithFormError(w, r, "/organizations", "Organization name is required")
+		return
+	}
+
+	adminName := strings.TrimSpace(r.FormValue("admin_full_name"))
+	if adminName == "" {
+		redirectWithFormError(w, r, "/organizations", "Administrator name is required")
+		return
+	}
+
+	code, err := models.GenerateInviteCode()
+	if err != nil {
+		redirectWithFormError(w, r, "/organizations", "Failed to generate invite code")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	err = db.Transaction(func(tx *gorm.DB) error {
+		organization := models.Organization{Name: name}
+		if err := tx.Create(&organization).Error; err != nil {
+			return err
+		}
+
+		invite := models.Invite{
+			OrganizationID: organization.ID,
+			Code:           code,
+			FullName:       adminName,
+			Role:           models.RoleAdmin,
+			CreatedBy:      user.ID,
+			ExpiresAt:      time.Now().Add(h.config.InviteExpiration),
+		}
+		return tx.Create(&invite).Error
+	})
+	if err != nil {
+		redirectWithFormError(w, r, "/organizations", "Failed to create organization (the name may already be taken)")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/organizations", "Organization created, send the administrator their invite link")
+}
@@ -1,30 +1,51 @@
 package handlers
 
 import (
-	"encoding/csv"
+	"bytes"
+	"context"
 	"fmt"
 	"html/template"
 	"net/http"
+	"overtime/cache"
+	"overtime/caldav"
 	"overtime/config"
-	"overtime/database"
+	"overtime/mailer"
 	"overtime/middleware"
 	"overtime/models"
+	"overtime/services"
+	"overtime/store"
 	"strconv"
+	"strings"
 	"time"
+
+	"gorm.io/gorm"
 )
 
 type OvertimeHandler struct {
+	db        *gorm.DB
+	store     store.Store
 	config    *config.Config
 	templates map[string]*template.Template
+	mailer    *mailer.Mailer
+	calendar  *caldav.Publisher
+	cache     cache.Cache
 }
 
-func NewOvertimeHandler(cfg *config.Config, templates map[string]*template.Template) *OvertimeHandler {
+func NewOvertimeHandler(db *gorm.DB, s store.Store, cfg *config.Config, templates map[string]*template.Template, mail *mailer.Mailer, calendar *caldav.Publisher, c cache.Cache) *OvertimeHandler {
 	return &OvertimeHandler{
+		db:        db,
+		store:     s,
 		config:    cfg,
 		templates: templates,
+		mailer:    mail,
+		calendar:  calendar,
+		cache:     c,
 	}
 }
 
+// dashboardEntryLimit is how many of the latest entries the dashboard lists
+const dashboardEntryLimit = 100
+
 func (h *OvertimeHandler) Dashboard(w http.ResponseWriter, r *http.Request) {
 	user := middleware.GetUserFromContext(r.Context())
 	if user == nil {
@@ -38,13 +59,14 @@ func (h *OvertimeHandler) Dashboard(w http.ResponseWriter, r *http.Request) {
 	monthStr := r.URL.Query().Get("month")
 	yearStr := r.URL.Query().Get("year")
 
-	var entries []models.OvertimeEntry
-	var totalHours float64
-
-	db := database.GetDB()
+	db := h.db.WithContext(r.Context())
+	var pseudonyms *pseudonymizer
+	if user.CanViewAllOvertime() {
+		pseudonyms = worksCouncilView(db, h.config, user)
+	}
 
 	// Build query based on user permissions
-	query := db.Preload("User").Preload("User.Team").Preload("User.Project")
+	query := db.Model(&models.OvertimeEntry{}).Scopes(inOrganization(user.OrganizationID))
 
 	if user.CanViewAllOvertime() {
 		// Admin/HR can see all entries
@@ -58,7 +80,7 @@ func (h *OvertimeHandler) Dashboard(w http.ResponseWriter, r *http.Request) {
 		if tid, err := strconv.ParseUint(teamIDStr, 10, 32); err == nil && tid > 0 {
 			selectedTeamID = uint(tid)
 			query = query.Joins("JOIN users ON users.id = overtime_entries.user_id").
-				Where("users.team_id = ?", selectedTeamID)
+				Scopes(inEntryTeams(selectedTeamID))
 		}
 	}
 
@@ -67,17 +89,27 @@ func (h *OvertimeHandler) Dashboard(w http.ResponseWriter, r *http.Request) {
 	if projectIDStr != "" {
 		if pid, err := strconv.ParseUint(projectIDStr, 10, 32); err == nil && pid > 0 {
 			selectedProjectID = uint(pid)
-			if teamIDStr == "" {
-				query = query.Joins("JOIN users ON users.id = overtime_entries.user_id")
-			}
-			query = query.Where("users.project_id = ?", selectedProjectID)
+			query = query.Where("overtime_entries.project_id = ?", selectedProjectID)
+		}
+	}
+
+	// Apply user filter
+	var selectedUserID uint
+	if user.CanViewAllOvertime() && pseudonyms == nil {
+		if uid, err := strconv.ParseUint(r.URL.Query().Get("user_id"), 10, 32); err == nil && uid > 0 {
+			selectedUserID = uint(uid)
+			query = query.Where("overtime_entries.user_id = ?", selectedUserID)
 		}
 	}
 
+	// The summary cards ignore the month and year filters. They are summed
+	// now because the date filters below change query in place.
+	summary := summarizeEntries(query.Session(&gorm.Session{}), time.Now(), user.Location())
+
 	// Apply month/year filter
 	var selectedMonth, selectedYear int
-	currentYear := time.Now().Year()
-	currentMonth := int(time.Now().Month())
+	currentYear := user.Now().Year()
+	currentMonth := int(user.Now().Month())
 
 	if monthStr != "" {
 		if m, err := strconv.Atoi(monthStr); err == nil && m >= 1 && m <= 12 {
@@ -90,34 +122,34 @@ func (h *OvertimeHandler) Dashboard(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Apply date filters
-	if selectedMonth > 0 && selectedYear > 0 {
-		// Both month and year specified
-		startDate := time.Date(selectedYear, time.Month(selectedMonth), 1, 0, 0, 0, 0, time.UTC)
-		endDate := startDate.AddDate(0, 1, 0)
-		query = query.Where("overtime_entries.date >= ? AND overtime_entries.date < ?", startDate, endDate)
-	} else if selectedMonth > 0 {
-		// Only month specified - filter by month across all years
-		query = query.Where("EXTRACT(MONTH FROM overtime_entries.date) = ?", selectedMonth)
-	} else if selectedYear > 0 {
-		// Only year specified - filter by year across all months
-		startDate := time.Date(selectedYear, 1, 1, 0, 0, 0, 0, time.UTC)
-		endDate := startDate.AddDate(1, 0, 0)
-		query = query.Where("overtime_entries.date >= ? AND overtime_entries.date < ?", startDate, endDate)
-	}
-
-	query.Order("overtime_entries.date desc").Limit(100).Find(&entries)
+	// Apply date filters, a week or custom range replaces the month and year
+	selectedRange := parseDateRange(r, user.Location())
+	query = entryPeriod(db, query, user.OrganizationID, selectedMonth, selectedYear, selectedRange, user.Location()).Session(&gorm.Session{})
 
-	// Calculate total hours for filtered entries
-	for _, entry := range entries {
-		totalHours += entry.Hours
+	// Only the latest entries are listed, the totals cover all of them
+	var entries []models.OvertimeEntry
+	query.Preload("User").Preload("User.Team").Preload("Project").Preload("Creator").Preload("Corrector").
+		Order("overtime_entries.date desc").Limit(dashboardEntryLimit).Find(&entries)
+	applyEntryTeams(db, entries)
+	entryCount, hours := entryTotals(query)
+	pseudonyms.applyEntries(entries)
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, entryListResponse{
+			Entries:      newAPIEntries(user, entries),
+			TotalHours:   hours,
+			TotalEntries: entryCount,
+		})
+		return
 	}
 
 	// Get all teams and projects for filter dropdowns
-	var teams []models.Team
-	var projects []models.Project
-	db.Find(&teams)
-	db.Find(&projects)
+	teams := organizationTeams(db, h.cache, user.OrganizationID)
+	projects := organizationProjects(db, h.cache, user.OrganizationID)
+	var users []models.User
+	if user.CanViewAllOvertime() && pseudonyms == nil {
+		users = entryFilterUsers(db, user.OrganizationID)
+	}
 
 	// Generate years for dropdown
 	years := make([]int, 5)
@@ -125,40 +157,100 @@ func (h *OvertimeHandler) Dashboard(w http.ResponseWriter, r *http.Request) {
 		years[i] = currentYear - i
 	}
 
+	// Only users who record overtime have a balance to show
+	var balance float64
+	showBalance := user.IsAdmin() || user.IsEmployee()
+	if showBalance {
+		balance, _ = services.TimeOffBalance(db, user.ID)
+	}
+
+	hrEdits := hrEditsEntries(db, h.config, user)
 	data := map[string]interface{}{
-		"User":              user,
-		"Entries":           entries,
-		"TotalHours":        totalHours,
-		"Error":             r.URL.Query().Get("error"),
-		"Success":           r.URL.Query().Get("success"),
+		"Rows":              entryRows(user, entries, viewDashboard, hrEdits, middleware.CSRFToken(w, r)),
+		"HREdits":           hrEdits,
+		"Query":             r.URL.RawQuery,
+		"TotalHours":        hours,
+		"EntryCount":        entryCount,
+		"Summary":           summary,
+		"Balance":           balance,
+		"ShowBalance":       showBalance,
 		"Teams":             teams,
 		"Projects":          projects,
+		"Users":             users,
+		"WorksCouncil":      pseudonyms != nil,
 		"SelectedTeamID":    selectedTeamID,
 		"SelectedProjectID": selectedProjectID,
+		"SelectedUserID":    selectedUserID,
 		"SelectedMonth":     selectedMonth,
 		"SelectedYear":      selectedYear,
+		"SelectedRange":     selectedRange,
 		"CurrentMonth":      currentMonth,
 		"CurrentYear":       currentYear,
 		"Years":             years,
 	}
-	h.templates["dashboard"].ExecuteTemplate(w, "base", data)
+	if isHTMX(r) {
+		renderFragment(w, r, h.templates, "dashboard", "entries", data)
+		return
+	}
+
+	// The quick-add form keeps its values when an entry is refused
+	flash := middleware.PopFlash(w, r)
+	data["Form"] = formValues(map[string]string{
+		"date": user.Now().Format("2006-01-02"),
+	}, flash.Form)
+	data["Error"] = flash.Error
+	data["Success"] = flash.Success
+	data["WorkedTime"] = loadAppSettings(db, h.config, user.OrganizationID).OvertimeMode == models.OvertimeModeWorked
+	render(w, r, h.templates, "dashboard", data)
 }
 
-func (h *OvertimeHandler) NewEntryPage(w http.ResponseWriter, r *http.Request) {
-	user := middleware.GetUserFromContext(r.Context())
+// entriesURL returns the entry list the user lands on after managing an entry
+func entriesURL(user *models.User) string {
+	if user.IsSupervisor() {
+		return "/supervisor/dashboard"
+	}
+	return "/dashboard"
+}
 
+// manageableUsers returns the users the given user may record overtime for.
+// Regular employees only manage their own entries, so the list is empty.
+func manageableUsers(db *gorm.DB, user *models.User) []models.User {
 	var users []models.User
-	if user.IsAdmin() {
-		database.GetDB().Find(&users)
+	db = db.Scopes(inOrganization(user.OrganizationID))
+	switch {
+	case user.IsAdmin():
+		db.Order("full_name asc").Find(&users)
+	case user.IsSupervisor() && len(user.ProjectIDs()) > 0:
+		projectIDs := user.ProjectIDs()
+		db.Where("id = ? OR (team_id IN ? AND (project_id IN ? OR id IN (SELECT user_id FROM project_members WHERE project_id IN ?)))",
+			user.ID, user.SupervisedTeamIDs(), projectIDs, projectIDs).
+			Order("full_name asc").Find(&users)
 	}
+	return users
+}
+
+func (h *OvertimeHandler) NewEntryPage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
 
+	db := h.db.WithContext(r.Context())
+	users := manageableUsers(db, user)
+
+	flash := middleware.PopFlash(w, r)
+	form := formValues(map[string]string{
+		"user_id": strconv.FormatUint(uint64(user.ID), 10),
+		"date":    user.Now().Format("2006-01-02"),
+	}, flash.Form)
+
+	app := loadAppSettings(db, h.config, user.OrganizationID)
 	data := map[string]interface{}{
-		"User":  user,
-		"Users": users,
-		"Error": r.URL.Query().Get("error"),
-		"Today": time.Now().Format("2006-01-02"),
+		"Users":      users,
+		"Projects":   userProjects(db, user),
+		"Form":       form,
+		"WorkedTime": app.OvertimeMode == models.OvertimeModeWorked,
+		"SoftLimit":  app.SoftHoursPerMonth,
+		"Error":      flash.Error,
 	}
-	h.templates["overtime-form"].ExecuteTemplate(w, "base", data)
+	render(w, r, h.templates, "overtime-form", data)
 }
 
 func (h *OvertimeHandler) CreateEntry(w http.ResponseWriter, r *http.Request) {
@@ -169,92 +261,141 @@ func (h *OvertimeHandler) CreateEntry(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := r.ParseForm(); err != nil {
-		http.Redirect(w, r, "/overtime/new?error=Invalid+form+data", http.StatusSeeOther)
+		redirectWithError(w, r, "/overtime/new", "Invalid form data")
 		return
 	}
 
+	// The dashboard's quick-add form shows its errors on the dashboard
+	back := "/overtime/new"
+	if r.FormValue("quick_add") != "" {
+		back = "/dashboard"
+	}
+
 	dateStr := r.FormValue("date")
-	hoursStr := r.FormValue("hours")
 	description := r.FormValue("description")
 	userIDStr := r.FormValue("user_id")
 
-	date, err := time.Parse("2006-01-02", dateStr)
+	date, err := time.ParseInLocation("2006-01-02", dateStr, user.Location())
 	if err != nil {
-		http.Redirect(w, r, "/overtime/new?error=Invalid+date+format", http.StatusSeeOther)
+		redirectWithFormError(w, r, back, models.ErrInvalidDate.Error())
 		return
 	}
 
-	hours, err := strconv.ParseFloat(hoursStr, 64)
-	if err != nil || hours <= 0 || hours > 24 {
-		http.Redirect(w, r, "/overtime/new?error=Invalid+hours+(must+be+between+0+and+24)", http.StatusSeeOther)
-		return
-	}
-
-	targetUserID := user.ID
-	if userIDStr != "" && user.IsAdmin() {
+	target := user
+	if userIDStr != "" && (user.IsAdmin() || user.IsSupervisor()) {
 		parsedID, err := strconv.ParseUint(userIDStr, 10, 32)
-		if err == nil {
-			targetUserID = uint(parsedID)
+		if err == nil && uint(parsedID) != user.ID {
+			targetUser, err := h.store.User(r.Context(), user.OrganizationID, uint(parsedID))
+			if err != nil {
+				redirectWithFormError(w, r, back, "Employee not found")
+				return
+			}
+			target = targetUser
 		}
 	}
 
-	if !user.CanManageOvertimeFor(targetUserID) {
-		http.Error(w, "Forbidden", http.StatusForbidden)
+	var picked uint64
+	if value := r.FormValue("project_id"); value != "" {
+		if picked, err = strconv.ParseUint(value, 10, 32); err != nil {
+			redirectWithFormError(w, r, back, "Project not found")
+			return
+		}
+	}
+	projectID, ok := entryProject(r.Context(), h.store, target, uint(picked))
+	if !ok {
+		redirectWithFormError(w, r, back, models.ErrNotOnProject.Error())
 		return
 	}
 
 	entry := models.OvertimeEntry{
-		UserID:      targetUserID,
+		UserID:      target.ID,
+		User:        *target,
+		ProjectID:   projectID,
 		Date:        date,
-		Hours:       hours,
 		Description: description,
+		CreatedBy:   &user.ID,
+		UpdatedBy:   &user.ID,
+	}
+	if !user.CanManageEntry(&entry) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if message := parseEntryHours(r, &entry); message != "" {
+		redirectWithFormError(w, r, back, message)
+		return
+	}
+	parseEntryTimes(r, &entry)
+	if message := parseEntryAcknowledgment(r, &entry); message != "" {
+		redirectWithFormError(w, r, back, message)
+		return
 	}
 
-	if err := database.GetDB().Create(&entry).Error; err != nil {
-		http.Redirect(w, r, "/overtime/new?error=Failed+to+create+entry", http.StatusSeeOther)
+	if err := recordEntry(r.Context(), h.store, h.config, h.mailer, &entry, dateOverride(r, user)); err != nil {
+		redirectWithFormError(w, r, back, entryErrorMessage(err, "Failed to create entry"))
 		return
 	}
 
-	http.Redirect(w, r, "/dashboard?success=Overtime+entry+created", http.StatusSeeOther)
+	redirectWithSuccess(w, r, entriesURL(user), "Overtime entry created")
 }
 
 func (h *OvertimeHandler) EditEntryPage(w http.ResponseWriter, r *http.Request) {
 	user := middleware.GetUserFromContext(r.Context())
 	idStr := r.URL.Query().Get("id")
 	if idStr == "" {
-		http.Redirect(w, r, "/dashboard?error=Invalid+entry+ID", http.StatusSeeOther)
+		redirectOrStatus(w, r, "/dashboard", "Invalid entry ID", http.StatusBadRequest)
 		return
 	}
 
 	id, err := strconv.ParseUint(idStr, 10, 32)
 	if err != nil {
-		http.Redirect(w, r, "/dashboard?error=Invalid+entry+ID", http.StatusSeeOther)
+		redirectOrStatus(w, r, "/dashboard", "Invalid entry ID", http.StatusBadRequest)
 		return
 	}
 
-	var entry models.OvertimeEntry
-	if err := database.GetDB().Preload("User").First(&entry, id).Error; err != nil {
-		http.Redirect(w, r, "/dashboard?error=Entry+not+found", http.StatusSeeOther)
+	entry, err := h.store.Entry(r.Context(), user.OrganizationID, uint(id))
+	if err != nil {
+		redirectOrStatus(w, r, "/dashboard", "Entry not found", http.StatusNotFound)
 		return
 	}
 
-	if !user.CanManageOvertimeFor(entry.UserID) {
+	if !canEditEntry(r.Context(), h.store, h.config, user, entry) {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
-	var users []models.User
-	if user.IsAdmin() {
-		database.GetDB().Find(&users)
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, newAPIEntry(user, entry))
+		return
+	}
+
+	// Entries recorded as worked time are edited as worked time
+	values := map[string]string{
+		"date":        entry.Date.Format("2006-01-02"),
+		"hours":       strconv.FormatFloat(entry.Hours, 'f', 1, 64),
+		"description": entry.Description,
+	}
+	if entry.WorkedHours != nil {
+		values["worked_hours"] = strconv.FormatFloat(*entry.WorkedHours, 'f', -1, 64)
 	}
+	if entry.StartTime != nil && entry.EndTime != nil {
+		values["start_time"] = *entry.StartTime
+		values["end_time"] = *entry.EndTime
+	}
+	flash := middleware.PopFlash(w, r)
+	// A resubmitted form tells whether the box was left unticked
+	if entry.OverSoftLimit() && flash.Form == nil {
+		values["acknowledge"] = "1"
+		values["acknowledgment"] = entry.Acknowledgment
+	}
+	form := formValues(values, flash.Form)
 
 	data := map[string]interface{}{
-		"User":  user,
-		"Entry": &entry,
-		"Users": users,
-		"Error": r.URL.Query().Get("error"),
+		"Entry":     entry,
+		"Form":      form,
+		"SoftLimit": h.appSettings(r, user.OrganizationID).SoftHoursPerMonth,
+		"Error":     flash.Error,
 	}
-	h.templates["overtime-edit"].ExecuteTemplate(w, "base", data)
+	render(w, r, h.templates, "overtime-edit", data)
 }
 
 func (h *OvertimeHandler) UpdateEntry(w http.ResponseWriter, r *http.Request) {
@@ -265,54 +406,276 @@ func (h *OvertimeHandler) UpdateEntry(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := r.ParseForm(); err != nil {
-		http.Redirect(w, r, "/dashboard?error=Invalid+form+data", http.StatusSeeOther)
+		redirectWithError(w, r, "/dashboard", "Invalid form data")
 		return
 	}
 
 	idStr := r.FormValue("id")
 	id, err := strconv.ParseUint(idStr, 10, 32)
 	if err != nil {
-		http.Redirect(w, r, "/dashboard?error=Invalid+entry+ID", http.StatusSeeOther)
+		redirectWithError(w, r, "/dashboard", "Invalid entry ID")
 		return
 	}
 
-	var entry models.OvertimeEntry
-	if err := database.GetDB().First(&entry, id).Error; err != nil {
-		http.Redirect(w, r, "/dashboard?error=Entry+not+found", http.StatusSeeOther)
+	entry, err := h.store.Entry(r.Context(), user.OrganizationID, uint(id))
+	if err != nil {
+		redirectWithError(w, r, "/dashboard", "Entry not found")
 		return
 	}
 
-	if !user.CanManageOvertimeFor(entry.UserID) {
+	if !canEditEntry(r.Context(), h.store, h.config, user, entry) {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
-	dateStr := r.FormValue("date")
-	hoursStr := r.FormValue("hours")
-	description := r.FormValue("description")
+	before := *entry
+	if message := h.applyEntryForm(r, user, entry); message != "" {
+		redirectWithFormError(w, r, fmt.Sprintf("/overtime/edit?id=%d", id), message)
+		return
+	}
 
-	date, err := time.Parse("2006-01-02", dateStr)
+	resubmitted, err := h.saveEntry(r, entry, &before, user)
 	if err != nil {
-		http.Redirect(w, r, fmt.Sprintf("/overtime/edit?id=%d&error=Invalid+date+format", id), http.StatusSeeOther)
+		redirectWithFormError(w, r, fmt.Sprintf("/overtime/edit?id=%d", id), "Failed to update entry")
 		return
 	}
 
-	hours, err := strconv.ParseFloat(hoursStr, 64)
-	if err != nil || hours <= 0 || hours > 24 {
-		http.Redirect(w, r, fmt.Sprintf("/overtime/edit?id=%d&error=Invalid+hours", id), http.StatusSeeOther)
+	if resubmitted {
+		redirectWithSuccess(w, r, entriesURL(user), "Overtime entry resubmitted for approval")
 		return
 	}
 
-	entry.Date = date
+	redirectWithSuccess(w, r, entriesURL(user), "Overtime entry updated")
+}
+
+// applyEntryForm copies the submitted date, hours, times and description onto
+// the entry. It returns a user-facing message when the values are invalid.
+func (h *OvertimeHandler) applyEntryForm(r *http.Request, user *models.User, entry *models.OvertimeEntry) string {
+	date, err := time.ParseInLocation("2006-01-02", r.FormValue("date"), user.Location())
+	if err != nil {
+		return models.ErrInvalidDate.Error()
+	}
+
+	edited := *entry
+	edited.Date = date
+	edited.Description = r.FormValue("description")
+	if message := parseEntryHours(r, &edited); message != "" {
+		return message
+	}
+	parseEntryTimes(r, &edited)
+	if message := parseEntryAcknowledgment(r, &edited); message != "" {
+		return message
+	}
+	if err := applyEntryEdit(r.Context(), h.store, h.config, user, entry, &edited, dateOverride(r, user)); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// applyEntryEdit checks edited, a copy of the entry with new date, hours,
+// times and description, and copies them onto the entry. overrideDate skips
+// the organization's limits on the entry's dates.
+func applyEntryEdit(ctx context.Context, s store.Store, cfg *config.Config, user *models.User, entry, edited *models.OvertimeEntry, overrideDate bool) error {
+	// Worked hours of moved entries count against the kind of their new day
+	moved := edited.Date.Format("2006-01-02") != entry.Date.Format("2006-01-02")
+	if moved {
+		if err := recordEntryDay(ctx, s, edited); err != nil {
+			return err
+		}
+	}
+	if err := applyWorkedHours(ctx, s, edited); err != nil {
+		return err
+	}
+	if err := edited.Validate(); err != nil {
+		return err
+	}
+	if !overrideDate {
+		if err := checkMonthOpen(ctx, s, cfg, user.OrganizationID, entry.Date); err != nil {
+			return err
+		}
+	}
+	// Entries keep their date when it is left alone, even once it has left
+	// the booking window
+	if moved && !overrideDate {
+		if err := checkEntryDate(ctx, s, cfg, edited); err != nil {
+			return err
+		}
+	}
+	// Moved entries belong to the team of their new date
+	if moved {
+		if err := recordEntryNames(ctx, s, edited); err != nil {
+			return err
+		}
+	}
+	if err := checkEntryCaps(ctx, s, cfg, edited); err != nil {
+		return err
+	}
+	if err := checkSoftLimit(ctx, s, cfg, edited); err != nil {
+		return err
+	}
+
+	entry.Date = edited.Date
+	entry.Hours = edited.Hours
+	entry.WorkedHours = edited.WorkedHours
+	entry.StartTime = edited.StartTime
+	entry.EndTime = edited.EndTime
+	entry.Description = edited.Description
+	entry.TeamName = edited.TeamName
+	entry.ProjectName = edited.ProjectName
+	entry.Acknowledgment = edited.Acknowledgment
+	entry.DayKind = edited.DayKind
+	return nil
+}
+
+// parseEntryHours reads the hours of an entry form: the worked hours of the
+// day if the form asks for them, otherwise the overtime itself. It returns a
+// user-facing message when the value is invalid.
+func parseEntryHours(r *http.Request, entry *models.OvertimeEntry) string {
+	if _, ok := r.Form["worked_hours"]; ok {
+		worked, err := strconv.ParseFloat(r.FormValue("worked_hours"), 64)
+		if err != nil {
+			return models.ErrInvalidWorkedHours.Error()
+		}
+		entry.WorkedHours = &worked
+		return ""
+	}
+
+	hours, err := strconv.ParseFloat(r.FormValue("hours"), 64)
+	if err != nil {
+		return models.ErrInvalidHours.Error()
+	}
 	entry.Hours = hours
-	entry.Description = description
+	entry.WorkedHours = nil
+	return ""
+}
 
-	if err := database.GetDB().Save(&entry).Error; err != nil {
-		http.Redirect(w, r, fmt.Sprintf("/overtime/edit?id=%d&error=Failed+to+update+entry", id), http.StatusSeeOther)
+// parseEntryTimes reads the optional start and end time of an entry form.
+// Forms without the fields, like the inline row editor, keep the entry's
+// times. Validate checks them.
+func parseEntryTimes(r *http.Request, entry *models.OvertimeEntry) {
+	if _, ok := r.Form["start_time"]; !ok {
 		return
 	}
+	entry.StartTime, entry.EndTime = nil, nil
+	if start := strings.TrimSpace(r.FormValue("start_time")); start != "" {
+		entry.StartTime = &start
+	}
+	if end := strings.TrimSpace(r.FormValue("end_time")); end != "" {
+		entry.EndTime = &end
+	}
+}
+
+// parseEntryAcknowledgment reads the acknowledgment of an entry past the soft
+// limit, whose note only counts with its box ticked. Forms without the
+// fields, like the inline row editor, keep the entry's acknowledgment. It
+// returns a user-facing message when the note is missing.
+func parseEntryAcknowledgment(r *http.Request, entry *models.OvertimeEntry) string {
+	if _, ok := r.Form["acknowledgment"]; !ok {
+		return ""
+	}
+	entry.Acknowledgment = ""
+	if r.FormValue("acknowledge") == "" {
+		return ""
+	}
+	note := strings.TrimSpace(r.FormValue("acknowledgment"))
+	if note == "" {
+		return "Note who agreed to the hours past the soft limit"
+	}
+	entry.Acknowledgment = note
+	return ""
+}
+
+// saveEntry stores an edited entry, before holds it as it was loaded. Editing a
+// rejected entry, or the date, hours or times of any other, resubmits it to
+// the start of the approval chain, which is reported through resubmitted:
+// approvals given for the old figures no longer count and their emailed
+// links stop working. HR corrections are marked on the entry and audited
+// instead.
+func (h *OvertimeHandler) saveEntry(r *http.Request, entry, before *models.OvertimeEntry, user *models.User) (resubmitted bool, err error) {
+	err = h.store.Transaction(r.Context(), func(tx store.Store) error {
+		resubmitted, err = storeEditedEntry(r.Context(), tx, r, entry, before, user)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if resubmitted {
+		go RequestApproval(h.store, h.config, h.mailer, *entry)
+	}
+	go h.calendar.Sync(entry.ID)
+	return resubmitted, nil
+}
+
+// storeEditedEntry saves an edited entry within tx as saveEntry describes,
+// leaving the approval request and calendar to the caller
+func storeEditedEntry(ctx context.Context, tx store.Store, r *http.Request, entry, before *models.OvertimeEntry, user *models.User) (resubmitted bool, err error) {
+	entry.UpdatedBy = &user.ID
+	corrected := !user.CanManageEntry(entry)
+	if corrected {
+		entry.CorrectedBy = &user.ID
+	}
+
+	resubmitted = entry.IsRejected() || (!corrected && entryFiguresChanged(before, entry))
+	if resubmitted {
+		if err := tx.RevokeApprovalTokens(ctx, entry.ID); err != nil {
+			return false, err
+		}
+		entry.Status = models.StatusPending
+		entry.Stage = models.StageSupervisor
+		entry.ReviewedBy = nil
+		entry.ReviewedAt = nil
+		entry.SupervisorApprovedBy = nil
+		entry.SupervisorApprovedAt = nil
+	}
+
+	if err := tx.SaveEntry(ctx, entry); err != nil {
+		return false, err
+	}
+	if corrected {
+		audit := newAuditLog(r, user.OrganizationID, &entry.UserID, models.AuditEntryCorrected, describeCorrection(before, entry, user))
+		if err := tx.CreateAuditLog(ctx, &audit); err != nil {
+			return false, err
+		}
+	}
+	return resubmitted, nil
+}
+
+// entryFiguresChanged reports whether an edit changed what approvers decide
+// on: the date, hours or times of the entry
+func entryFiguresChanged(before, after *models.OvertimeEntry) bool {
+	return after.Date.Format("2006-01-02") != before.Date.Format("2006-01-02") ||
+		after.Hours != before.Hours || entryTimes(after) != entryTimes(before)
+}
 
-	http.Redirect(w, r, "/dashboard?success=Overtime+entry+updated", http.StatusSeeOther)
+// describeCorrection summarizes for the audit log what HR changed on an entry
+func describeCorrection(before, after *models.OvertimeEntry, user *models.User) string {
+	var changes []string
+	if date := after.Date.Format("2006-01-02"); date != before.Date.Format("2006-01-02") {
+		changes = append(changes, fmt.Sprintf("date %s to %s", before.Date.Format("2006-01-02"), date))
+	}
+	if after.Hours != before.Hours {
+		changes = append(changes, fmt.Sprintf("hours %s to %s",
+			strconv.FormatFloat(before.Hours, 'f', -1, 64), strconv.FormatFloat(after.Hours, 'f', -1, 64)))
+	}
+	if after.Description != before.Description {
+		changes = append(changes, fmt.Sprintf("description %q to %q", before.Description, after.Description))
+	}
+	if entryTimes(after) != entryTimes(before) {
+		changes = append(changes, fmt.Sprintf("times %s to %s", entryTimes(before), entryTimes(after)))
+	}
+	if len(changes) == 0 {
+		return fmt.Sprintf("entry %d saved unchanged by %s", after.ID, user.Username)
+	}
+	return fmt.Sprintf("entry %d corrected by %s: %s", after.ID, user.Username, strings.Join(changes, ", "))
+}
+
+// entryTimes formats the start and end of an entry, "none" without them
+func entryTimes(entry *models.OvertimeEntry) string {
+	if entry.StartTime == nil || entry.EndTime == nil {
+		return "none"
+	}
+	return *entry.StartTime + "-" + *entry.EndTime
 }
 
 func (h *OvertimeHandler) DeleteEntry(w http.ResponseWriter, r *http.Request) {
@@ -323,34 +686,148 @@ func (h *OvertimeHandler) DeleteEntry(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := r.ParseForm(); err != nil {
-		http.Redirect(w, r, "/dashboard?error=Invalid+form+data", http.StatusSeeOther)
+		redirectOrFail(w, r, "/dashboard", "Invalid form data")
 		return
 	}
 
 	idStr := r.FormValue("id")
 	id, err := strconv.ParseUint(idStr, 10, 32)
 	if err != nil {
-		http.Redirect(w, r, "/dashboard?error=Invalid+entry+ID", http.StatusSeeOther)
+		redirectOrFail(w, r, "/dashboard", "Invalid entry ID")
 		return
 	}
 
-	var entry models.OvertimeEntry
-	if err := database.GetDB().First(&entry, id).Error; err != nil {
-		http.Redirect(w, r, "/dashboard?error=Entry+not+found", http.StatusSeeOther)
+	entry, err := h.store.Entry(r.Context(), user.OrganizationID, uint(id))
+	if err != nil {
+		redirectOrFail(w, r, "/dashboard", "Entry not found")
+		return
+	}
+
+	if !user.CanManageEntry(entry) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !user.IsAdmin() {
+		if h.appSettings(r, user.OrganizationID).MonthClose.Closed(entry.Date) {
+			redirectOrFail(w, r, "/dashboard", closedMonthError(entry.Date).Error())
+			return
+		}
+	}
+
+	if err := h.store.DeleteEntry(r.Context(), entry); err != nil {
+		redirectOrFail(w, r, "/dashboard", "Failed to delete entry")
+		return
+	}
+	go h.calendar.Sync(entry.ID)
+
+	if isHTMX(r) {
+		// The row is swapped for the empty response; the list reloads its totals
+		w.Header().Set("HX-Trigger", "entries-changed")
+		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	if !user.CanManageOvertimeFor(entry.UserID) {
+	redirectWithSuccess(w, r, entriesURL(user), "Overtime entry deleted")
+}
+
+// hrEditsEntries reports whether the user is HR in an organization that lets
+// HR correct entries
+func hrEditsEntries(db *gorm.DB, cfg *config.Config, user *models.User) bool {
+	return user.IsHR() && loadAppSettings(db, cfg, user.OrganizationID).HREditEntries
+}
+
+// canEditEntry reports whether the user may edit the entry, either managing it
+// or correcting it as HR
+func canEditEntry(ctx context.Context, s store.Store, cfg *config.Config, user *models.User, entry *models.OvertimeEntry) bool {
+	hrEdits := user.IsHR() && storeAppSettings(ctx, s, cfg, user.OrganizationID).HREditEntries
+	return user.CanManageEntry(entry) || user.CanCorrectOvertimeFor(&entry.User, hrEdits)
+}
+
+// appSettings returns the organization's settings from the store, the
+// defaults if they cannot be loaded
+func (h *OvertimeHandler) appSettings(r *http.Request, organizationID uint) appSettings {
+	return storeAppSettings(r.Context(), h.store, h.config, organizationID)
+}
+
+// loadManagedEntry loads the entry named by the id parameter for inline row
+// actions, writing an error response when it is missing or not editable. It
+// also reports whether HR corrects entries in the user's organization.
+func (h *OvertimeHandler) loadManagedEntry(w http.ResponseWriter, r *http.Request, user *models.User) (entry *models.OvertimeEntry, hrEdits, ok bool) {
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid entry ID", http.StatusBadRequest)
+		return nil, false, false
+	}
+
+	entry, err = h.store.Entry(r.Context(), user.OrganizationID, uint(id))
+	if err != nil {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return nil, false, false
+	}
+
+	hrEdits = user.IsHR() && h.appSettings(r, user.OrganizationID).HREditEntries
+	if !user.CanManageEntry(entry) && !user.CanCorrectOvertimeFor(&entry.User, hrEdits) {
 		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false, false
+	}
+	return entry, hrEdits, true
+}
+
+// EntryRow renders a single entry table row, used to cancel inline editing
+func (h *OvertimeHandler) EntryRow(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	entry, hrEdits, ok := h.loadManagedEntry(w, r, user)
+	if !ok {
+		return
+	}
+
+	row := entryRow{User: user, Entry: entry, View: parseView(r.FormValue("view")), HREdits: hrEdits, CSRFToken: middleware.CSRFToken(w, r)}
+	renderFragment(w, r, h.templates, "dashboard", "entry-row", row)
+}
+
+// EditEntryRow renders an entry table row as an inline edit form
+func (h *OvertimeHandler) EditEntryRow(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	entry, hrEdits, ok := h.loadManagedEntry(w, r, user)
+	if !ok {
+		return
+	}
+
+	row := entryRow{User: user, Entry: entry, View: parseView(r.FormValue("view")), HREdits: hrEdits, CSRFToken: middleware.CSRFToken(w, r)}
+	renderFragment(w, r, h.templates, "dashboard", "entry-row-edit", row)
+}
+
+// UpdateEntryRow saves an inline row edit and renders the updated row. Invalid
+// input re-renders the edit form with the error.
+func (h *OvertimeHandler) UpdateEntryRow(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	entry, hrEdits, ok := h.loadManagedEntry(w, r, user)
+	if !ok {
+		return
+	}
+
+	row := entryRow{User: user, Entry: entry, View: parseView(r.FormValue("view")), HREdits: hrEdits, CSRFToken: middleware.CSRFToken(w, r)}
+
+	before := *entry
+	if message := h.applyEntryForm(r, user, entry); message != "" {
+		row.Error = message
+		renderFragment(w, r, h.templates, "dashboard", "entry-row-edit", row)
 		return
 	}
 
-	if err := database.GetDB().Delete(&entry).Error; err != nil {
-		http.Redirect(w, r, "/dashboard?error=Failed+to+delete+entry", http.StatusSeeOther)
+	if _, err := h.saveEntry(r, entry, &before, user); err != nil {
+		row.Error = "Failed to update entry"
+		renderFragment(w, r, h.templates, "dashboard", "entry-row-edit", row)
 		return
 	}
 
-	http.Redirect(w, r, "/dashboard?success=Overtime+entry+deleted", http.StatusSeeOther)
+	w.Header().Set("HX-Trigger", "entries-changed")
+	renderFragment(w, r, h.templates, "dashboard", "entry-row", row)
 }
 
 func (h *OvertimeHandler) ExportPage(w http.ResponseWriter, r *http.Request) {
@@ -360,111 +837,212 @@ func (h *OvertimeHandler) ExportPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db := database.GetDB()
+	db := h.db.WithContext(r.Context())
 
-	currentYear := time.Now().Year()
+	currentYear := user.Now().Year()
 	years := make([]int, 5)
 	for i := 0; i < 5; i++ {
 		years[i] = currentYear - i
 	}
 
-	var teams []models.Team
-	var projects []models.Project
-	db.Find(&teams)
-	db.Find(&projects)
+	teams := organizationTeams(db, h.cache, user.OrganizationID)
+	projects := organizationProjects(db, h.cache, user.OrganizationID)
+	var users []models.User
+	pseudonyms := worksCouncilView(db, h.config, user)
+	if pseudonyms == nil {
+		users = entryFilterUsers(db, user.OrganizationID)
+	}
 
 	data := map[string]interface{}{
-		"User":         user,
 		"Years":        years,
-		"CurrentMonth": int(time.Now().Month()),
+		"CurrentMonth": int(user.Now().Month()),
 		"CurrentYear":  currentYear,
 		"Teams":        teams,
 		"Projects":     projects,
+		"Users":        users,
+		"WorksCouncil": pseudonyms != nil,
+		"ExportFormat": loadAppSettings(db, h.config, user.OrganizationID).ExportFormat,
 	}
-	h.templates["export"].ExecuteTemplate(w, "base", data)
+	render(w, r, h.templates, "export", data)
 }
 
-func (h *OvertimeHandler) ExportCSV(w http.ResponseWriter, r *http.Request) {
-	user := middleware.GetUserFromContext(r.Context())
-	if !user.CanExport() {
-		http.Error(w, "Forbidden", http.StatusForbidden)
-		return
-	}
-
-	monthStr := r.URL.Query().Get("month")
-	yearStr := r.URL.Query().Get("year")
-	teamIDStr := r.URL.Query().Get("team_id")
-	projectIDStr := r.URL.Query().Get("project_id")
-
-	month, err := strconv.Atoi(monthStr)
+// exportQuery builds the query of the monthly export from the month, year,
+// team, project and user parameters, with the users' teams, projects and cost
+// centers preloaded. The user parameter is ignored for roles limited to
+// pseudonymous data. It returns a message when month or year are invalid.
+func exportQuery(db *gorm.DB, r *http.Request, user *models.User, pseudonyms *pseudonymizer) (query *gorm.DB, month, year int, message string) {
+	month, err := strconv.Atoi(r.URL.Query().Get("month"))
 	if err != nil || month < 1 || month > 12 {
-		http.Error(w, "Invalid month", http.StatusBadRequest)
-		return
+		return nil, 0, 0, "Invalid month"
 	}
 
-	year, err := strconv.Atoi(yearStr)
+	year, err = strconv.Atoi(r.URL.Query().Get("year"))
 	if err != nil || year < 2000 || year > 2100 {
-		http.Error(w, "Invalid year", http.StatusBadRequest)
-		return
+		return nil, 0, 0, "Invalid year"
 	}
 
-	startDate := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	startDate := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, user.Location())
 	endDate := startDate.AddDate(0, 1, 0)
 
-	db := database.GetDB()
-	query := db.Preload("User").Preload("User.Team").Preload("User.Project").
+	query = db.Preload("User").Preload("User.Team").Preload("Project").
+		Preload("User.CostCenter").Preload("User.Team.CostCenter").
+		Scopes(inOrganization(user.OrganizationID)).
 		Where("overtime_entries.date >= ? AND overtime_entries.date < ?", startDate, endDate)
 
 	// Apply team filter
+	teamIDStr := r.URL.Query().Get("team_id")
 	if teamIDStr != "" {
 		if tid, err := strconv.ParseUint(teamIDStr, 10, 32); err == nil && tid > 0 {
 			query = query.Joins("JOIN users ON users.id = overtime_entries.user_id").
-				Where("users.team_id = ?", tid)
+				Scopes(inEntryTeams(uint(tid)))
 		}
 	}
 
 	// Apply project filter
-	if projectIDStr != "" {
+	if projectIDStr := r.URL.Query().Get("project_id"); projectIDStr != "" {
 		if pid, err := strconv.ParseUint(projectIDStr, 10, 32); err == nil && pid > 0 {
-			if teamIDStr == "" {
-				query = query.Joins("JOIN users ON users.id = overtime_entries.user_id")
-			}
-			query = query.Where("users.project_id = ?", pid)
+			query = query.Where("overtime_entries.project_id = ?", pid)
 		}
 	}
 
+	// Apply user filter
+	if uid, err := strconv.ParseUint(r.URL.Query().Get("user_id"), 10, 32); err == nil && uid > 0 && pseudonyms == nil {
+		query = query.Where("overtime_entries.user_id = ?", uid)
+	}
+
+	return query.Order("overtime_entries.date asc, overtime_entries.user_id asc"), month, year, ""
+}
+
+func (h *OvertimeHandler) ExportCSV(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanExport() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	app := loadAppSettings(db, h.config, user.OrganizationID)
+	format := parseExportFormat(r.URL.Query().Get("format"), app.ExportFormat)
+
+	pseudonyms := worksCouncilView(db, h.config, user)
+	query, month, year, message := exportQuery(db, r, user, pseudonyms)
+	if message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+
 	var entries []models.OvertimeEntry
-	query.Order("overtime_entries.date asc, overtime_entries.user_id asc").Find(&entries)
+	query.Find(&entries)
+	applyEntryTeams(db, entries)
+	pseudonyms.applyEntries(entries)
+
+	export := entryExport{format: format, night: app.Night}
+	if user.CanViewCosts() {
+		export.currency = app.Currency
+	}
+	var buf bytes.Buffer
+	writeEntriesCSV(&buf, entries, export)
 
+	// Nothing is handed out that the archive misses
 	filename := fmt.Sprintf("overtime_%d_%02d.csv", year, month)
+	err := archiveExport(db, h.config, models.ExportArchive{
+		OrganizationID: user.OrganizationID,
+		Month:          fmt.Sprintf("%d-%02d", year, month),
+		Filename:       filename,
+		Format:         format,
+		Generator:      "download by " + user.DisplayName(),
+		Filters:        exportFilters(r, "team_id", "project_id", "user_id"),
+	}, buf.Bytes())
+	if err != nil {
+		http.Error(w, "Failed to archive the export", http.StatusInternalServerError)
+		return
+	}
+	err = logExport(db, r, user, models.ExportLog{
+		Kind:          models.ExportOvertime,
+		Filename:      filename,
+		Format:        format,
+		Filters:       exportFilters(r, "month", "year", "team_id", "project_id", "user_id"),
+		Rows:          exportRows(len(entries)),
+		Pseudonymized: pseudonyms != nil,
+	})
+	if err != nil {
+		http.Error(w, "Failed to log the export", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/csv")
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	w.Write(buf.Bytes())
+}
 
-	writer := csv.NewWriter(w)
-	defer writer.Flush()
+// exportPreviewRows is how many lines of the export its preview shows
+const exportPreviewRows = 50
 
-	// Write header
-	writer.Write([]string{"Employee", "Team", "Project", "Date", "Hours", "Description"})
+// ExportPreview shows the first lines of the export the form would download
+// and its totals, to check the filters before sending the file on
+func (h *OvertimeHandler) ExportPreview(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanExport() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	app := loadAppSettings(db, h.config, user.OrganizationID)
+	format := parseExportFormat(r.URL.Query().Get("format"), app.ExportFormat)
+
+	pseudonyms := worksCouncilView(db, h.config, user)
+	query, _, _, message := exportQuery(db, r, user, pseudonyms)
+	if message != "" {
+		renderFragment(w, r, h.templates, "export", "export-preview", map[string]interface{}{"Error": message})
+		return
+	}
 
-	// Write data
-	for _, entry := range entries {
-		teamName := ""
-		projectName := ""
-		if entry.User.Team != nil {
-			teamName = entry.User.Team.Name
+	var entries []models.OvertimeEntry
+	query.Find(&entries)
+	applyEntryTeams(db, entries)
+	pseudonyms.applyEntries(entries)
+
+	export := entryExport{format: format, night: app.Night}
+	if user.CanViewCosts() {
+		export.currency = app.Currency
+	}
+
+	var rows [][]string
+	var hours, night, weekend, holiday, cost float64
+	var pending int
+	users := make(map[uint]bool)
+	for i := range entries {
+		if i < exportPreviewRows {
+			rows = append(rows, export.record(&entries[i]))
 		}
-		if entry.User.Project != nil {
-			projectName = entry.User.Project.Name
+		hours += entries[i].Hours
+		night += app.Night.NightHours(&entries[i])
+		weekendHours, holidayHours := dayKindHours(&entries[i])
+		weekend += weekendHours
+		holiday += holidayHours
+		cost += app.Night.WeightedHours(&entries[i]) * entries[i].OvertimeRate()
+		if entries[i].IsPending() {
+			pending++
 		}
-		writer.Write([]string{
-			entry.User.DisplayName(),
-			teamName,
-			projectName,
-			entry.Date.Format("2006-01-02"),
-			fmt.Sprintf("%.2f", entry.Hours),
-			entry.Description,
-		})
+		users[entries[i].UserID] = true
+	}
+
+	data := map[string]interface{}{
+		"Header":     export.header(),
+		"Rows":       rows,
+		"Count":      len(entries),
+		"Users":      len(users),
+		"Hours":      hours,
+		"NightHours": night,
+		"Night":      app.Night.Enabled(),
+		"Weekend":    weekend,
+		"Holiday":    holiday,
+		"Cost":       cost,
+		"Currency":   export.currency,
+		"Pending":    pending,
 	}
+	renderFragment(w, r, h.templates, "export", "export-preview", data)
 }
 
 func (h *OvertimeHandler) AllEntriesPage(w http.ResponseWriter, r *http.Request) {
@@ -480,8 +1058,9 @@ func (h *OvertimeHandler) AllEntriesPage(w http.ResponseWriter, r *http.Request)
 	monthStr := r.URL.Query().Get("month")
 	yearStr := r.URL.Query().Get("year")
 
-	db := database.GetDB()
-	query := db.Preload("User").Preload("User.Team").Preload("User.Project")
+	db := h.db.WithContext(r.Context())
+	pseudonyms := worksCouncilView(db, h.config, user)
+	query := db.Model(&models.OvertimeEntry{}).Scopes(inOrganization(user.OrganizationID))
 
 	// Apply team filter
 	var selectedTeamID uint
@@ -489,7 +1068,7 @@ func (h *OvertimeHandler) AllEntriesPage(w http.ResponseWriter, r *http.Request)
 		if tid, err := strconv.ParseUint(teamIDStr, 10, 32); err == nil && tid > 0 {
 			selectedTeamID = uint(tid)
 			query = query.Joins("JOIN users ON users.id = overtime_entries.user_id").
-				Where("users.team_id = ?", selectedTeamID)
+				Scopes(inEntryTeams(selectedTeamID))
 		}
 	}
 
@@ -498,16 +1077,21 @@ func (h *OvertimeHandler) AllEntriesPage(w http.ResponseWriter, r *http.Request)
 	if projectIDStr != "" {
 		if pid, err := strconv.ParseUint(projectIDStr, 10, 32); err == nil && pid > 0 {
 			selectedProjectID = uint(pid)
-			if teamIDStr == "" {
-				query = query.Joins("JOIN users ON users.id = overtime_entries.user_id")
-			}
-			query = query.Where("users.project_id = ?", selectedProjectID)
+			query = query.Where("overtime_entries.project_id = ?", selectedProjectID)
 		}
 	}
 
+	// Apply user filter, roles limited to pseudonymous data cannot pick
+	// individuals
+	var selectedUserID uint
+	if uid, err := strconv.ParseUint(r.URL.Query().Get("user_id"), 10, 32); err == nil && uid > 0 && pseudonyms == nil {
+		selectedUserID = uint(uid)
+		query = query.Where("overtime_entries.user_id = ?", selectedUserID)
+	}
+
 	// Apply month/year filter
 	var selectedMonth, selectedYear int
-	currentYear := time.Now().Year()
+	currentYear := user.Now().Year()
 
 	if monthStr != "" {
 		if m, err := strconv.Atoi(monthStr); err == nil && m >= 1 && m <= 12 {
@@ -520,38 +1104,64 @@ func (h *OvertimeHandler) AllEntriesPage(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	// Apply date filters
-	if selectedMonth > 0 && selectedYear > 0 {
-		// Both month and year specified
-		startDate := time.Date(selectedYear, time.Month(selectedMonth), 1, 0, 0, 0, 0, time.UTC)
-		endDate := startDate.AddDate(0, 1, 0)
-		query = query.Where("overtime_entries.date >= ? AND overtime_entries.date < ?", startDate, endDate)
-	} else if selectedMonth > 0 {
-		// Only month specified - filter by month across all years
-		query = query.Where("EXTRACT(MONTH FROM overtime_entries.date) = ?", selectedMonth)
-	} else if selectedYear > 0 {
-		// Only year specified - filter by year across all months
-		startDate := time.Date(selectedYear, 1, 1, 0, 0, 0, 0, time.UTC)
-		endDate := startDate.AddDate(1, 0, 0)
-		query = query.Where("overtime_entries.date >= ? AND overtime_entries.date < ?", startDate, endDate)
-	}
+	// Apply date filters, a week or custom range replaces the month and year
+	selectedRange := parseDateRange(r, user.Location())
+	query = entryPeriod(db, query, user.OrganizationID, selectedMonth, selectedYear, selectedRange, user.Location()).Session(&gorm.Session{})
 
 	var entries []models.OvertimeEntry
-	query.Order("overtime_entries.date desc").Find(&entries)
+	query.Preload("User").Preload("User.Team").Preload("Project").Preload("Creator").Preload("Corrector").
+		Preload("User.CostCenter").Preload("User.Team.CostCenter").
+		Order("overtime_entries.date desc").Find(&entries)
+	applyEntryTeams(db, entries)
+
+	// Summary per user, or only per team and project for reports limited to
+	// aggregates
+	app := loadAppSettings(db, h.config, user.OrganizationID)
+	minGroup := reportMinGroup(app, user, pseudonyms)
+	userHours, totalHours := hoursByUser(db, query)
+	var groups []groupTotal
+	if minGroup > 0 {
+		groups = groupTotals(entries, minGroup)
+		userHours = nil
+	}
 
-	// Group by user for summary
-	userHours := make(map[string]float64)
-	var totalHours float64
-	for _, entry := range entries {
-		userHours[entry.User.DisplayName()] += entry.Hours
-		totalHours += entry.Hours
+	// Costs are only shown once rates were set
+	var userCosts map[string]float64
+	var totalCost float64
+	var currency string
+	if user.CanViewCosts() && minGroup == 0 {
+		userCosts, totalCost = costsByUser(entries, app.Night)
+		if totalCost == 0 {
+			userCosts = nil
+		}
+		currency = app.Currency
+	}
+	costCenters := costCenterTotals(entries, userCosts != nil, minGroup, app.Night)
+	if pseudonyms != nil {
+		entries = nil
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, allEntriesResponse{
+			Entries:     newAPIEntries(user, entries),
+			TotalHours:  totalHours,
+			HoursByUser: userHours,
+			TotalCost:   totalCost,
+			CostByUser:  userCosts,
+			Currency:    currency,
+			CostCenters: costCenters,
+			Groups:      groups,
+		})
+		return
 	}
 
 	// Get all teams and projects for filter dropdowns
-	var teams []models.Team
-	var projects []models.Project
-	db.Find(&teams)
-	db.Find(&projects)
+	teams := organizationTeams(db, h.cache, user.OrganizationID)
+	projects := organizationProjects(db, h.cache, user.OrganizationID)
+	var users []models.User
+	if pseudonyms == nil {
+		users = entryFilterUsers(db, user.OrganizationID)
+	}
 
 	// Generate years for dropdown
 	years := make([]int, 5)
@@ -559,18 +1169,35 @@ func (h *OvertimeHandler) AllEntriesPage(w http.ResponseWriter, r *http.Request)
 		years[i] = currentYear - i
 	}
 
+	hrEdits := hrEditsEntries(db, h.config, user)
 	data := map[string]interface{}{
-		"User":              user,
-		"Entries":           entries,
+		"Rows":              entryRows(user, entries, viewAllEntries, hrEdits, middleware.CSRFToken(w, r)),
+		"HREdits":           hrEdits,
+		"Query":             r.URL.RawQuery,
 		"UserHours":         userHours,
 		"TotalHours":        totalHours,
+		"UserCosts":         userCosts,
+		"TotalCost":         totalCost,
+		"Currency":          currency,
+		"CostCenters":       costCenters,
+		"Groups":            groups,
+		"Aggregated":        minGroup > 0,
+		"WorksCouncil":      pseudonyms != nil,
+		"MinGroupEmployees": minGroup,
 		"Teams":             teams,
 		"Projects":          projects,
+		"Users":             users,
 		"SelectedTeamID":    selectedTeamID,
 		"SelectedProjectID": selectedProjectID,
+		"SelectedUserID":    selectedUserID,
 		"SelectedMonth":     selectedMonth,
 		"SelectedYear":      selectedYear,
+		"SelectedRange":     selectedRange,
 		"Years":             years,
 	}
-	h.templates["all-entries"].ExecuteTemplate(w, "base", data)
+	if isHTMX(r) {
+		renderFragment(w, r, h.templates, "all-entries", "entries", data)
+		return
+	}
+	render(w, r, h.templates, "all-entries", data)
 }
@@ -0,0 +1,410 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"overtime/config"
+	"overtime/mailer"
+	"overtime/middleware"
+	"overtime/models"
+	"overtime/store"
+)
+
+// fakeStore keeps the records in memory. Approval requests run in the
+// background, so the store is locked and sends the tokens it stores to
+// tokens.
+type fakeStore struct {
+	mu          sync.Mutex
+	entries     map[uint]*models.OvertimeEntry
+	users       map[uint]models.User
+	contracts   []models.Contract
+	teams       map[uint]models.Team
+	projects    map[uint]models.Project
+	supervisors []models.User
+	settings    map[string]models.Setting
+	deleted     []uint
+	revoked     []uint
+	audits      []models.AuditLog
+	tokens      chan models.ApprovalToken
+}
+
+func (s *fakeStore) Transaction(ctx context.Context, fn func(tx store.Store) error) error {
+	return fn(s)
+}
+
+func (s *fakeStore) Entry(ctx context.Context, organizationID, id uint) (*models.OvertimeEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[id]
+	if !ok || entry.OrganizationID != organizationID {
+		return nil, store.ErrNotFound
+	}
+	copied := *entry
+	return &copied, nil
+}
+
+func (s *fakeStore) Entries(ctx context.Context, organizationID uint, ids []uint) ([]models.OvertimeEntry, error) {
+	var entries []models.OvertimeEntry
+	for _, id := range ids {
+		if entry, err := s.Entry(ctx, organizationID, id); err == nil {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries, nil
+}
+
+func (s *fakeStore) CreateEntry(ctx context.Context, entry *models.OvertimeEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries == nil {
+		s.entries = make(map[uint]*models.OvertimeEntry)
+	}
+	entry.ID = uint(len(s.entries) + 100)
+	copied := *entry
+	s.entries[entry.ID] = &copied
+	return nil
+}
+
+func (s *fakeStore) SaveEntry(ctx context.Context, entry *models.OvertimeEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *entry
+	s.entries[entry.ID] = &copied
+	return nil
+}
+
+func (s *fakeStore) DeleteEntry(ctx context.Context, entry *models.OvertimeEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, entry.ID)
+	s.deleted = append(s.deleted, entry.ID)
+	return nil
+}
+
+func (s *fakeStore) BookedHours(ctx context.Context, userID, exceptID uint, from, to time.Time) (float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var booked float64
+	for _, entry := range s.entries {
+		if entry.UserID == userID && entry.ID != exceptID && !entry.IsRejected() &&
+			!entry.Date.Before(from) && entry.Date.Before(to) {
+			booked += entry.Hours
+		}
+	}
+	return booked, nil
+}
+
+func (s *fakeStore) User(ctx context.Context, organizationID, id uint) (*models.User, error) {
+	user, ok := s.users[id]
+	if !ok || user.OrganizationID != organizationID {
+		return nil, store.ErrNotFound
+	}
+	return &user, nil
+}
+
+func (s *fakeStore) UsersWithRole(ctx context.Context, organizationID uint, role models.Role) ([]models.User, error) {
+	var users []models.User
+	for _, user := range s.users {
+		if user.OrganizationID == organizationID && user.Role == role {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func (s *fakeStore) TeamSupervisors(ctx context.Context, organizationID, teamID, projectID uint) ([]models.User, error) {
+	return s.supervisors, nil
+}
+
+func (s *fakeStore) Contracts(ctx context.Context, userID uint) ([]models.Contract, error) {
+	return s.contracts, nil
+}
+
+func (s *fakeStore) OnProject(ctx context.Context, userID, projectID uint) (bool, error) {
+	return false, nil
+}
+
+func (s *fakeStore) TeamMemberships(ctx context.Context, userID uint) ([]models.TeamMembership, error) {
+	return nil, nil
+}
+
+func (s *fakeStore) Team(ctx context.Context, id uint) (*models.Team, error) {
+	team, ok := s.teams[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return &team, nil
+}
+
+func (s *fakeStore) Project(ctx context.Context, id uint) (*models.Project, error) {
+	project, ok := s.projects[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return &project, nil
+}
+
+func (s *fakeStore) CreateApprovalToken(ctx context.Context, token *models.ApprovalToken) error {
+	if s.tokens != nil {
+		s.tokens <- *token
+	}
+	return nil
+}
+
+func (s *fakeStore) RevokeApprovalTokens(ctx context.Context, entryID uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked = append(s.revoked, entryID)
+	return nil
+}
+
+func (s *fakeStore) IsHoliday(ctx context.Context, organizationID uint, date time.Time) (bool, error) {
+	return false, nil
+}
+
+func (s *fakeStore) Settings(ctx context.Context, organizationID uint, names ...string) (map[string]models.Setting, error) {
+	return s.settings, nil
+}
+
+func (s *fakeStore) CreateAuditLog(ctx context.Context, entry *models.AuditLog) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.audits = append(s.audits, *entry)
+	return nil
+}
+
+// withUser returns r as sent by the logged in user
+func withUser(r *http.Request, user models.User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), middleware.UserContextKey, &user))
+}
+
+// postForm returns a form POST to path
+func postForm(path string, form url.Values) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+// waitForToken returns the next approval token the store was given
+func waitForToken(t *testing.T, s *fakeStore) models.ApprovalToken {
+	t.Helper()
+	select {
+	case token := <-s.tokens:
+		return token
+	case <-time.After(5 * time.Second):
+		t.Fatal("no approval requested")
+		return models.ApprovalToken{}
+	}
+}
+
+func TestDeleteEntry(t *testing.T) {
+	owner := models.User{ID: 1, OrganizationID: 1, Username: "anna", Role: models.RoleEmployee}
+	other := models.User{ID: 2, OrganizationID: 1, Username: "ben", Role: models.RoleEmployee}
+	admin := models.User{ID: 3, OrganizationID: 1, Username: "admin", Role: models.RoleAdmin}
+	outsider := models.User{ID: 4, OrganizationID: 2, Username: "carla", Role: models.RoleAdmin}
+
+	march := time.Date(2026, time.March, 10, 0, 0, 0, 0, time.UTC)
+	closed := map[string]models.Setting{models.SettingClosedThrough: {Name: models.SettingClosedThrough, Value: "2026-03"}}
+
+	tests := []struct {
+		name     string
+		user     models.User
+		settings map[string]models.Setting
+		status   int
+		deleted  bool
+	}{
+		{"owner", owner, nil, http.StatusSeeOther, true},
+		{"other employee", other, nil, http.StatusForbidden, false},
+		{"other organization", outsider, nil, http.StatusSeeOther, false},
+		{"owner in closed month", owner, closed, http.StatusSeeOther, false},
+		{"admin in closed month", admin, closed, http.StatusSeeOther, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &fakeStore{
+				entries: map[uint]*models.OvertimeEntry{
+					7: {ID: 7, OrganizationID: 1, UserID: owner.ID, User: owner, Date: march, Hours: 2},
+				},
+				settings: test.settings,
+			}
+			h := NewOvertimeHandler(nil, s, &config.Config{}, nil, nil, nil, nil)
+
+			r := withUser(postForm("/overtime/delete", url.Values{"id": {"7"}}), test.user)
+			w := httptest.NewRecorder()
+
+			h.DeleteEntry(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if deleted := len(s.deleted) == 1; deleted != test.deleted {
+				t.Errorf("deleted = %v, want %v", deleted, test.deleted)
+			}
+		})
+	}
+}
+
+func TestEntryRowNotFound(t *testing.T) {
+	s := &fakeStore{entries: map[uint]*models.OvertimeEntry{}}
+	h := NewOvertimeHandler(nil, s, &config.Config{}, nil, nil, nil, nil)
+
+	user := models.User{ID: 1, OrganizationID: 1, Role: models.RoleEmployee}
+	r := withUser(httptest.NewRequest(http.MethodGet, "/overtime/row?id=7", nil), user)
+	w := httptest.NewRecorder()
+
+	h.EntryRow(w, r)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestCreateEntry(t *testing.T) {
+	projectID, teamID := uint(5), uint(6)
+	owner := models.User{ID: 1, OrganizationID: 1, Username: "anna", Role: models.RoleEmployee, TeamID: &teamID, ProjectID: &projectID}
+	supervisor := models.User{ID: 2, OrganizationID: 1, Username: "sam", Email: "sam@example.com", Role: models.RoleSupervisor}
+	today := owner.Now().Format("2006-01-02")
+	date, _ := time.ParseInLocation("2006-01-02", today, owner.Location())
+	dailyCap := map[string]models.Setting{models.SettingMaxHoursPerDay: {Name: models.SettingMaxHoursPerDay, Value: "8"}}
+
+	tests := []struct {
+		name     string
+		form     url.Values
+		settings map[string]models.Setting
+		created  bool
+	}{
+		{"logged", url.Values{"date": {today}, "hours": {"2"}}, nil, true},
+		{"over the daily limit", url.Values{"date": {today}, "hours": {"3"}}, dailyCap, false},
+		{"not on the project", url.Values{"date": {today}, "hours": {"2"}, "project_id": {"9"}}, nil, false},
+		{"too far ahead", url.Values{"date": {date.AddDate(0, 2, 0).Format("2006-01-02")}, "hours": {"2"}}, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &fakeStore{
+				entries: map[uint]*models.OvertimeEntry{
+					7: {ID: 7, OrganizationID: 1, UserID: owner.ID, Date: date, Hours: 6, Status: models.StatusApproved},
+				},
+				teams:       map[uint]models.Team{teamID: {ID: teamID, Name: "Support"}},
+				projects:    map[uint]models.Project{projectID: {ID: projectID, Name: "Helpdesk"}},
+				supervisors: []models.User{supervisor},
+				settings:    test.settings,
+				tokens:      make(chan models.ApprovalToken, 1),
+			}
+			h := NewOvertimeHandler(nil, s, &config.Config{}, nil, mailer.New(&config.Config{}), nil, nil)
+
+			w := httptest.NewRecorder()
+			h.CreateEntry(w, withUser(postForm("/overtime", test.form), owner))
+
+			if w.Code != http.StatusSeeOther {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusSeeOther)
+			}
+			if created := len(s.entries) == 2; created != test.created {
+				t.Fatalf("created = %v, want %v", created, test.created)
+			}
+			if !test.created {
+				return
+			}
+
+			token := waitForToken(t, s)
+			entry := s.entries[token.EntryID]
+			if entry == nil || entry.Status != models.StatusPending || entry.Hours != 2 {
+				t.Fatalf("entry = %+v, want a pending entry of 2 hours", entry)
+			}
+			if entry.TeamName != "Support" || entry.ProjectName != "Helpdesk" {
+				t.Errorf("names = %q, %q, want Support, Helpdesk", entry.TeamName, entry.ProjectName)
+			}
+			if token.ApproverID != supervisor.ID {
+				t.Errorf("approver = %d, want %d", token.ApproverID, supervisor.ID)
+			}
+		})
+	}
+}
+
+func TestUpdateEntry(t *testing.T) {
+	projectID, teamID := uint(5), uint(6)
+	owner := models.User{ID: 1, OrganizationID: 1, Username: "anna", Role: models.RoleEmployee, TeamID: &teamID, ProjectID: &projectID}
+	supervisor := models.User{ID: 2, OrganizationID: 1, Username: "sam", Email: "sam@example.com", Role: models.RoleSupervisor}
+	hr := models.User{ID: 3, OrganizationID: 1, Username: "hanna", Role: models.RoleHR}
+	hrEdits := map[string]models.Setting{models.SettingHREditEntries: {Name: models.SettingHREditEntries, Value: "true"}}
+	today := owner.Now().Format("2006-01-02")
+	date, _ := time.ParseInLocation("2006-01-02", today, owner.Location())
+	reviewedAt := date.Add(time.Hour)
+
+	tests := []struct {
+		name        string
+		user        models.User
+		status      models.EntryStatus
+		hours       float64
+		settings    map[string]models.Setting
+		resubmitted bool
+	}{
+		{"approved entry with new hours", owner, models.StatusApproved, 3, nil, true},
+		{"approved entry with new description", owner, models.StatusApproved, 2, nil, false},
+		{"entry approved by the supervisor with new hours", owner, models.StatusPending, 3, nil, true},
+		{"rejected entry", owner, models.StatusRejected, 2, nil, true},
+		{"approved entry corrected by HR", hr, models.StatusApproved, 3, hrEdits, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entry := &models.OvertimeEntry{ID: 7, OrganizationID: 1, UserID: owner.ID, User: owner, ProjectID: &projectID,
+				Date: date, Hours: 2, Description: "release", Status: test.status, Stage: models.StageHR,
+				SupervisorApprovedBy: &supervisor.ID, SupervisorApprovedAt: &reviewedAt}
+			if test.status != models.StatusPending {
+				entry.ReviewedBy, entry.ReviewedAt = &hr.ID, &reviewedAt
+			}
+			s := &fakeStore{
+				entries:     map[uint]*models.OvertimeEntry{7: entry},
+				supervisors: []models.User{supervisor},
+				settings:    test.settings,
+				tokens:      make(chan models.ApprovalToken, 1),
+			}
+			h := NewOvertimeHandler(nil, s, &config.Config{}, nil, mailer.New(&config.Config{}), nil, nil)
+
+			form := url.Values{"id": {"7"}, "date": {today}, "hours": {strconv.FormatFloat(test.hours, 'f', -1, 64)}, "description": {"release and hotfix"}}
+			w := httptest.NewRecorder()
+			h.UpdateEntry(w, withUser(postForm("/overtime/edit", form), test.user))
+
+			if w.Code != http.StatusSeeOther {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusSeeOther)
+			}
+			s.mu.Lock()
+			saved := *s.entries[7]
+			revoked := len(s.revoked) > 0
+			audited := len(s.audits) > 0
+			s.mu.Unlock()
+			if saved.Description != "release and hotfix" || saved.Hours != test.hours {
+				t.Fatalf("saved = %q, %g hours, want the edit", saved.Description, saved.Hours)
+			}
+			if revoked != test.resubmitted {
+				t.Errorf("tokens revoked = %v, want %v", revoked, test.resubmitted)
+			}
+			if corrected := test.user.ID == hr.ID; audited != corrected {
+				t.Errorf("audited = %v, want %v", audited, corrected)
+			}
+
+			if !test.resubmitted {
+				if saved.Status != test.status || saved.SupervisorApprovedBy == nil {
+					t.Errorf("status = %s, supervisor approval %v, want %s and kept", saved.Status, saved.SupervisorApprovedBy, test.status)
+				}
+				return
+			}
+			if saved.Status != models.StatusPending || saved.Stage != models.StageSupervisor {
+				t.Errorf("status = %s at stage %s, want pending at the supervisor", saved.Status, saved.Stage)
+			}
+			if saved.ReviewedBy != nil || saved.ReviewedAt != nil || saved.SupervisorApprovedBy != nil || saved.SupervisorApprovedAt != nil {
+				t.Errorf("review fields = %+v, want them cleared", saved)
+			}
+			if token := waitForToken(t, s); token.EntryID != 7 || token.ApproverID != supervisor.ID {
+				t.Errorf("approval requested for entry %d from %d, want 7 from %d", token.EntryID, token.ApproverID, supervisor.ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"overtime/models"
+	"overtime/passhash"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// pwnedPasswordsURL is the k-anonymity range API of Have I Been Pwned: only
+// the first five characters of the password's SHA-1 hash are sent
+const pwnedPasswordsURL = "https://api.pwnedpasswords.com/range/"
+
+var pwnedClient = &http.Client{Timeout: 5 * time.Second}
+
+// maxPasswordHistory is the most previous passwords kept per user
+const maxPasswordHistory = 24
+
+// checkPassword applies the policy to a new password, including the breach
+// check when the policy asks for it
+func checkPassword(policy models.PasswordPolicy, password string) error {
+	if err := policy.Validate(password); err != nil {
+		return err
+	}
+	if !policy.CheckBreached {
+		return nil
+	}
+
+	breached, err := passwordBreached(password)
+	if err != nil {
+		// An unreachable API must not lock people out of registering
+		log.Printf("Password breach check failed: %v", err)
+		return nil
+	}
+	if breached {
+		return models.ErrPasswordBreached
+	}
+	return nil
+}
+
+func passwordBreached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	req, err := http.NewRequest(http.MethodGet, pwnedPasswordsURL+prefix, nil)
+	if err != nil {
+		return false, err
+	}
+	// Padding hides how many hashes share the prefix from observers
+	req.Header.Set("Add-Padding", "true")
+
+	resp, err := pwnedClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("pwned passwords returned %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		candidate, count, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		// Padding entries have a count of zero
+		if ok && candidate == suffix && count != "0" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// passwordReused reports whether password is the user's current password or
+// one of the ones before it that the policy's history still covers
+func passwordReused(db *gorm.DB, user *models.User, password string, history int) bool {
+	if history <= 0 {
+		return false
+	}
+	if ok, _ := passhash.Verify(user.PasswordHash, password); ok {
+		return true
+	}
+
+	var previous []models.PasswordHistory
+	db.Where("user_id = ?", user.ID).Order("created_at desc").Limit(history - 1).Find(&previous)
+	for _, old := range previous {
+		if ok, _ := passhash.Verify(old.PasswordHash, password); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// recordPasswordHistory keeps the user's current hash before it is replaced
+// and forgets hashes beyond maxPasswordHistory
+func recordPasswordHistory(tx *gorm.DB, user *models.User) error {
+	if err := tx.Create(&models.PasswordHistory{UserID: user.ID, PasswordHash: user.PasswordHash}).Error; err != nil {
+		return err
+	}
+	kept := tx.Model(&models.PasswordHistory{}).Select("id").
+		Where("user_id = ?", user.ID).Order("created_at desc").Limit(maxPasswordHistory)
+	return tx.Where("user_id = ? AND id NOT IN (?)", user.ID, kept).Delete(&models.PasswordHistory{}).Error
+}
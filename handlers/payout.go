@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"overtime/config"
+	"overtime/mailer"
+	"overtime/middleware"
+	"overtime/models"
+	"overtime/services"
+
+	"gorm.io/gorm"
+)
+
+// reviewablePayouts scopes a query to the pending payout requests the
+// reviewer may decide on. Payouts are decided by HR and admins only, and HR
+// cannot decide on their own requests.
+func reviewablePayouts(db *gorm.DB, reviewer *models.User) *gorm.DB {
+	query := db.Model(&models.PayoutRequest{}).
+		Scopes(inOrganization(reviewer.OrganizationID)).
+		Where("payout_requests.status = ?", models.StatusPending)
+	if !reviewer.CanReviewPayouts() {
+		return query.Where("1 = 0")
+	}
+	if !reviewer.IsAdmin() {
+		query = query.Where("payout_requests.user_id <> ?", reviewer.ID)
+	}
+	return query
+}
+
+// notifyPayoutDecision tells the requester whether their payout was
+// approved. request.User must be set.
+func notifyPayoutDecision(cfg *config.Config, mail *mailer.Mailer, request models.PayoutRequest, reviewer *models.User) {
+	if request.User.Email == "" {
+		return
+	}
+
+	decision := "approved"
+	if request.Status == models.StatusRejected {
+		decision = "rejected"
+	}
+	subject := fmt.Sprintf("Payout %s: %.2f hours", decision, request.Hours)
+	body := fmt.Sprintf(`Your request to have overtime paid out was %s by %s.
+
+Hours:   %.2f
+Comment: %s
+
+Your requests and balance: %s/time-off
+`,
+		decision,
+		reviewer.DisplayName(),
+		request.Hours,
+		request.ReviewComment,
+		cfg.BaseURL,
+	)
+
+	if err := mail.Send([]string{request.User.Email}, subject, body); err != nil {
+		log.Printf("Failed to email decision on payout request %d to %s: %v", request.ID, request.User.Email, err)
+	}
+}
+
+// RequestPayout asks to have overtime from the user's balance paid out
+func (h *ApprovalHandler) RequestPayout(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/time-off", "Invalid form data")
+		return
+	}
+
+	hours, err := strconv.ParseFloat(strings.TrimSpace(r.FormValue("hours")), 64)
+	if err != nil || hours <= 0 || hours > 1000 {
+		redirectWithError(w, r, "/time-off", "Hours must be more than 0 and at most 1000")
+		return
+	}
+
+	note := strings.TrimSpace(r.FormValue("note"))
+	if utf8.RuneCountInString(note) > 500 {
+		redirectWithError(w, r, "/time-off", "Note is too long (at most 500 characters)")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	request := models.PayoutRequest{
+		OrganizationID: user.OrganizationID,
+		UserID:         user.ID,
+		Hours:          hours,
+		Note:           note,
+	}
+	err = services.RequestPayout(db, &request)
+	if errors.Is(err, services.ErrInsufficientBalance) {
+		balance, _ := services.TimeOffBalance(db, user.ID)
+		redirectWithError(w, r, "/time-off", fmt.Sprintf("Not enough overtime for this payout, %.2fh are available", balance))
+		return
+	}
+	if err != nil {
+		redirectWithError(w, r, "/time-off", "Failed to request payout")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/time-off", "Payout requested, waiting for approval by HR")
+}
+
+// CancelPayout withdraws one of the user's pending payout requests,
+// returning its hours to the balance
+func (h *ApprovalHandler) CancelPayout(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/time-off", "Invalid form data")
+		return
+	}
+
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/time-off", "Invalid request ID")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	result := db.Where("id = ? AND user_id = ? AND status = ?", id, user.ID, models.StatusPending).
+		Delete(&models.PayoutRequest{})
+	if result.Error != nil {
+		redirectWithError(w, r, "/time-off", "Failed to cancel request")
+		return
+	}
+	if result.RowsAffected == 0 {
+		redirectWithError(w, r, "/time-off", "Only pending requests can be cancelled")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/time-off", "Payout request cancelled")
+}
+
+// ReviewPayout approves or rejects a pending payout request. Approved
+// payouts are taken off the balance and exported to payroll with the month
+// of the approval.
+func (h *ApprovalHandler) ReviewPayout(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanReviewPayouts() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/approvals", "Invalid form data")
+		return
+	}
+
+	var status models.EntryStatus
+	switch r.FormValue("action") {
+	case "approve":
+		status = models.StatusApproved
+	case "reject":
+		status = models.StatusRejected
+	default:
+		redirectWithError(w, r, "/approvals", "Invalid action")
+		return
+	}
+
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if status == models.StatusRejected && reason == "" {
+		redirectWithError(w, r, "/approvals", "A reason is required to reject a payout")
+		return
+	}
+
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/approvals", "Invalid request ID")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	var request models.PayoutRequest
+	if err := reviewablePayouts(db, user).Where("payout_requests.id = ?", id).First(&request).Error; err != nil {
+		redirectWithError(w, r, "/approvals", "Payout request not found or no longer pending")
+		return
+	}
+	if err := db.First(&request.User, request.UserID).Error; err != nil {
+		redirectWithError(w, r, "/approvals", "Payout request not found or no longer pending")
+		return
+	}
+
+	now := user.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	err = services.ReviewPayout(db, &request, user.ID, status, reason, today)
+	switch {
+	case errors.Is(err, services.ErrNotPending):
+		redirectWithError(w, r, "/approvals", "Payout request not found or no longer pending")
+		return
+	case errors.Is(err, services.ErrInsufficientBalance):
+		redirectWithError(w, r, "/approvals", request.User.DisplayName()+" no longer has enough overtime for this payout")
+		return
+	case err != nil:
+		redirectWithError(w, r, "/approvals", "Failed to record decision")
+		return
+	}
+
+	go notifyPayoutDecision(h.config, h.mailer, request, user)
+	if status == models.StatusApproved {
+		recordAudit(db, r, user.OrganizationID, &request.UserID, models.AuditPayoutApproved,
+			fmt.Sprintf("payout of %.2fh approved by %s for %s", request.Hours, user.Username, today.Format("2006-01")))
+		redirectWithSuccess(w, r, "/approvals", "Payout approved")
+		return
+	}
+	redirectWithSuccess(w, r, "/approvals", "Payout rejected")
+}
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"overtime/config"
+	"overtime/mailer"
+	"overtime/middleware"
+	"overtime/models"
+	"overtime/services"
+
+	"gorm.io/gorm"
+)
+
+// pendingUserCount returns how many accounts from open signup wait for an
+// administrator of the organization. Accounts wait for the administrator
+// once their email address is confirmed.
+func pendingUserCount(db *gorm.DB, organizationID uint) int64 {
+	var count int64
+	db.Model(&models.User{}).Scopes(inOrganization(organizationID)).Where("pending_approval = ? AND pending_verification = ?", true, false).Count(&count)
+	return count
+}
+
+// notifyPendingSignup tells the organization's administrators that an
+// account from open signup waits for them
+func notifyPendingSignup(db *gorm.DB, cfg *config.Config, mail *mailer.Mailer, user *models.User) {
+	var admins []models.User
+	db.Where("organization_id = ? AND role = ? AND email <> '' AND pending_approval = ?", user.OrganizationID, models.RoleAdmin, false).Find(&admins)
+	if len(admins) == 0 {
+		return
+	}
+	to := make([]string, len(admins))
+	for i, admin := range admins {
+		to[i] = admin.Email
+	}
+
+	subject := fmt.Sprintf("New account waiting for activation: %s", user.Username)
+	body := fmt.Sprintf(`%s registered and waits for an administrator to activate the account.
+
+Username: %s
+Email:    %s
+
+Activate or reject it here: %s/users/pending
+`,
+		user.DisplayName(),
+		user.Username,
+		user.Email,
+		cfg.BaseURL,
+	)
+	if err := mail.Send(to, subject, body); err != nil {
+		log.Printf("Failed to email administrators about pending user %d: %v", user.ID, err)
+	}
+}
+
+// notifyActivation tells a user from open signup that they can log in now
+func notifyActivation(cfg *config.Config, mail *mailer.Mailer, user *models.User) {
+	if user.Email == "" {
+		return
+	}
+	body := fmt.Sprintf(`Your account %s was activated, you can log in now: %s/login
+`, user.Username, cfg.BaseURL)
+	if err := mail.Send([]string{user.Email}, "Your account was activated", body); err != nil {
+		log.Printf("Failed to email activation to %s: %v", user.Email, err)
+	}
+}
+
+// PendingUsersPage lists the accounts from open signup that wait to be
+// activated (admin only)
+func (h *AuthHandler) PendingUsersPage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	var pending []models.User
+	db.Scopes(inOrganization(user.OrganizationID)).Where("pending_approval = ? AND pending_verification = ?", true, false).Order("created_at asc").Find(&pending)
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, userListResponse{Users: newAPIUsers(pending)})
+		return
+	}
+
+	data := map[string]interface{}{
+		"Pending":  pending,
+		"Teams":    organizationTeams(db, h.cache, user.OrganizationID),
+		"Projects": organizationProjects(db, h.cache, user.OrganizationID),
+	}
+	render(w, r, h.templates, "pending-users", data)
+}
+
+// ActivateUser lets an account from open signup log in, assigned to a team
+// and project. Both are required when the organization has any.
+func (h *AuthHandler) ActivateUser(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/users/pending", "Invalid form data")
+		return
+	}
+
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/users/pending", "Invalid user ID")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	assignment := func(model interface{}, field string, options int) (*uint, bool) {
+		value := r.FormValue(field)
+		if value == "" {
+			return nil, options == 0
+		}
+		parsed, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || !organizationExists(db, model, uint(parsed), user.OrganizationID) {
+			return nil, false
+		}
+		assigned := uint(parsed)
+		return &assigned, true
+	}
+	teamID, ok := assignment(&models.Team{}, "team_id", len(organizationTeams(db, h.cache, user.OrganizationID)))
+	if !ok {
+		redirectWithError(w, r, "/users/pending", "Choose a team for the user")
+		return
+	}
+	projectID, ok := assignment(&models.Project{}, "project_id", len(organizationProjects(db, h.cache, user.OrganizationID)))
+	if !ok {
+		redirectWithError(w, r, "/users/pending", "Choose a project for the user")
+		return
+	}
+
+	activated, err := services.ActivateUser(db, user.OrganizationID, uint(id), teamID, projectID)
+	switch {
+	case errors.Is(err, services.ErrNotFound):
+		redirectWithError(w, r, "/users/pending", "User not found")
+		return
+	case errors.Is(err, services.ErrNotPending):
+		redirectWithError(w, r, "/users/pending", "The account was already activated")
+		return
+	case err != nil:
+		redirectWithError(w, r, "/users/pending", "Failed to activate the account")
+		return
+	}
+
+	recordAudit(db, r, user.OrganizationID, &activated.ID, models.AuditUserActivated, "by "+user.Username)
+	go notifyActivation(h.config, h.mailer, activated)
+
+	redirectWithSuccess(w, r, "/users/pending", fmt.Sprintf("%s can log in now", activated.Username))
+}
+
+// RejectUser deletes an account from open signup instead of activating it
+func (h *AuthHandler) RejectUser(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/users/pending", "Invalid form data")
+		return
+	}
+
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/users/pending", "Invalid user ID")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	rejected, err := services.RejectUser(db, user.OrganizationID, uint(id))
+	switch {
+	case errors.Is(err, services.ErrNotFound):
+		redirectWithError(w, r, "/users/pending", "User not found")
+		return
+	case errors.Is(err, services.ErrNotPending):
+		redirectWithError(w, r, "/users/pending", "The account was already activated, delete it on the users page")
+		return
+	case err != nil:
+		redirectWithError(w, r, "/users/pending", "Failed to reject the account")
+		return
+	}
+
+	recordAudit(db, r, user.OrganizationID, &rejected.ID, models.AuditUserRejected, "by "+user.Username)
+
+	redirectWithSuccess(w, r, "/users/pending", fmt.Sprintf("Account %s rejected", rejected.Username))
+}
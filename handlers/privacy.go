@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"overtime/middleware"
+	"overtime/models"
+	"overtime/services"
+	"strconv"
+	"time"
+)
+
+// dataExportProfile adds the account details the user's JSON leaves out
+type dataExportProfile struct {
+	User           *models.User `json:"user"`
+	TelegramChatID *int64       `json:"telegram_chat_id,omitempty"`
+	JiraAccountID  string       `json:"jira_account_id,omitempty"`
+}
+
+type dataExportEntry struct {
+	ID            uint               `json:"id"`
+	Date          string             `json:"date"`
+	Hours         float64            `json:"hours"`
+	Description   string             `json:"description"`
+	Status        models.EntryStatus `json:"status"`
+	ReviewComment string             `json:"review_comment,omitempty"`
+	CreatedAt     time.Time          `json:"created_at"`
+	UpdatedAt     time.Time          `json:"updated_at"`
+}
+
+type dataExportTimeOff struct {
+	ID            uint               `json:"id"`
+	Date          string             `json:"date"`
+	Hours         float64            `json:"hours"`
+	Note          string             `json:"note"`
+	Status        models.EntryStatus `json:"status"`
+	ReviewComment string             `json:"review_comment,omitempty"`
+	CreatedAt     time.Time          `json:"created_at"`
+}
+
+// ExportMyData sends the current user a zip archive of everything stored
+// about them, for subject access requests
+func (h *AuthHandler) ExportMyData(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	db := h.db.WithContext(r.Context())
+
+	var profile models.User
+	if err := db.Preload("Organization").Preload("Team").Preload("Project").First(&profile, user.ID).Error; err != nil {
+		redirectWithError(w, r, "/profile", "Failed to export data")
+		return
+	}
+
+	var jiraAccount models.JiraAccount
+	db.Where("user_id = ?", user.ID).First(&jiraAccount)
+
+	var entries []models.OvertimeEntry
+	db.Where("user_id = ?", user.ID).Order("date asc").Find(&entries)
+
+	var timeOff []models.TimeOffRequest
+	db.Where("user_id = ?", user.ID).Order("date asc").Find(&timeOff)
+
+	var sessions []models.Session
+	db.Where("user_id = ?", user.ID).Order("created_at asc").Find(&sessions)
+
+	var auditLogs []models.AuditLog
+	db.Where("user_id = ?", user.ID).Order("created_at asc").Find(&auditLogs)
+
+	exported := make([]dataExportEntry, 0, len(entries))
+	for _, entry := range entries {
+		exported = append(exported, dataExportEntry{
+			ID:            entry.ID,
+			Date:          entry.Date.Format("2006-01-02"),
+			Hours:         entry.Hours,
+			Description:   entry.Description,
+			Status:        entry.Status,
+			ReviewComment: entry.ReviewComment,
+			CreatedAt:     entry.CreatedAt,
+			UpdatedAt:     entry.UpdatedAt,
+		})
+	}
+
+	exportedTimeOff := make([]dataExportTimeOff, 0, len(timeOff))
+	for _, request := range timeOff {
+		exportedTimeOff = append(exportedTimeOff, dataExportTimeOff{
+			ID:            request.ID,
+			Date:          request.Date.Format("2006-01-02"),
+			Hours:         request.Hours,
+			Note:          request.Note,
+			Status:        request.Status,
+			ReviewComment: request.ReviewComment,
+			CreatedAt:     request.CreatedAt,
+		})
+	}
+
+	filename := fmt.Sprintf("overtime_data_%s_%s.zip", user.Username, time.Now().Format("2006-01-02"))
+	err := logExport(db, r, user, models.ExportLog{
+		Kind:     models.ExportPersonalData,
+		Filename: filename,
+		Format:   "zip",
+		Rows:     exportRows(len(entries) + len(timeOff)),
+	})
+	if err != nil {
+		redirectWithError(w, r, "/profile", "Failed to export data")
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+
+	archive := zip.NewWriter(w)
+	defer archive.Close()
+
+	writeJSON := func(name string, v interface{}) {
+		file, err := archive.Create(name)
+		if err != nil {
+			return
+		}
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(v)
+	}
+
+	writeJSON("profile.json", dataExportProfile{
+		User:           &profile,
+		TelegramChatID: profile.TelegramChatID,
+		JiraAccountID:  jiraAccount.AccountID,
+	})
+	writeJSON("entries.json", exported)
+	writeJSON("time_off.json", exportedTimeOff)
+	writeJSON("sessions.json", sessions)
+	writeJSON("audit_log.json", auditLogs)
+
+	file, err := archive.Create("entries.csv")
+	if err != nil {
+		return
+	}
+	format := loadAppSettings(db, h.config, user.OrganizationID).ExportFormat
+	writer := newExportWriter(file, format)
+	writer.Write([]string{"Date", "Hours", "Status", "Description", "Review comment"})
+	for _, entry := range entries {
+		writer.Write([]string{
+			entry.Date.Format("2006-01-02"),
+			formatExportNumber(entry.Hours, format),
+			string(entry.Status),
+			entry.Description,
+			entry.ReviewComment,
+		})
+	}
+	writer.Flush()
+}
+
+// AnonymizeUser scrubs a user's personal data for an erasure request. Their
+// entries stay with dates, hours and status so totals and reports still add
+// up, but lose their descriptions.
+func (h *AuthHandler) AnonymizeUser(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/users", "Invalid form data")
+		return
+	}
+
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/users", "Invalid user ID")
+		return
+	}
+
+	if uint(id) == user.ID {
+		redirectWithError(w, r, "/users", "Cannot anonymize yourself")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	target, err := services.AnonymizeUser(db, user.OrganizationID, uint(id))
+	switch {
+	case errors.Is(err, services.ErrNotFound):
+		redirectWithError(w, r, "/users", "User not found")
+		return
+	case errors.Is(err, services.ErrAlreadyAnonymized):
+		redirectWithError(w, r, "/users", "User is already anonymized")
+		return
+	case err != nil:
+		redirectWithError(w, r, "/users", "Failed to anonymize user")
+		return
+	}
+
+	recordAudit(db, r, target.OrganizationID, &target.ID, models.AuditUserAnonymized, "by "+user.Username)
+
+	redirectWithSuccess(w, r, "/users", "User anonymized")
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"overtime/middleware"
+	"overtime/models"
+	"overtime/store"
+
+	"gorm.io/gorm"
+)
+
+// onProjects restricts a query on users to those working on one of the
+// projects, as their home project or as members
+func onProjects(projectIDs []uint) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("(users.project_id IN ? OR users.id IN (SELECT user_id FROM project_members WHERE project_id IN ?))", projectIDs, projectIDs)
+	}
+}
+
+// projectMemberships returns the projects a user is a member of besides their
+// home project, by name
+func projectMemberships(db *gorm.DB, userID uint) []models.ProjectMember {
+	var memberships []models.ProjectMember
+	db.Preload("Project").Joins("JOIN projects ON projects.id = project_members.project_id").
+		Where("project_members.user_id = ?", userID).Order("projects.name asc").Find(&memberships)
+	return memberships
+}
+
+// userProjects returns the projects a user can log overtime on, their home
+// project first
+func userProjects(db *gorm.DB, user *models.User) []models.Project {
+	var projects []models.Project
+	if user.ProjectID != nil {
+		var home models.Project
+		if err := db.First(&home, *user.ProjectID).Error; err == nil {
+			projects = append(projects, home)
+		}
+	}
+	for _, m := range projectMemberships(db, user.ID) {
+		if m.Project != nil && (user.ProjectID == nil || m.ProjectID != *user.ProjectID) {
+			projects = append(projects, *m.Project)
+		}
+	}
+	return projects
+}
+
+// entryProject resolves the project picked for an entry of target: their
+// home project when picked is 0, otherwise one of their projects. ok is false
+// if target does not work on the picked project.
+func entryProject(ctx context.Context, s store.Store, target *models.User, picked uint) (projectID *uint, ok bool) {
+	if picked == 0 {
+		return target.ProjectID, true
+	}
+	if target.ProjectID != nil && *target.ProjectID == picked {
+		return &picked, true
+	}
+	member, _ := s.OnProject(ctx, target.ID, picked)
+	return &picked, member
+}
+
+// CreateProjectMember assigns a user to a project besides their home project
+// (admin and HR)
+func (h *AuthHandler) CreateProjectMember(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanManageMemberships() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/users", "Invalid form data")
+		return
+	}
+
+	idStr := r.FormValue("user_id")
+	userID, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/users", "Invalid user ID")
+		return
+	}
+	editURL := "/users/edit?id=" + idStr
+
+	projectID, err := strconv.ParseUint(r.FormValue("project_id"), 10, 32)
+	if err != nil {
+		redirectWithError(w, r, editURL, "Invalid project ID")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	var member models.User
+	if err := db.Scopes(inOrganization(user.OrganizationID)).First(&member, userID).Error; err != nil {
+		redirectWithError(w, r, "/users", "User not found")
+		return
+	}
+	if !organizationExists(db, &models.Project{}, uint(projectID), user.OrganizationID) {
+		redirectWithError(w, r, editURL, "Project not found")
+		return
+	}
+	if member.ProjectID != nil && *member.ProjectID == uint(projectID) {
+		redirectWithError(w, r, editURL, "The project is the user's home project")
+		return
+	}
+
+	membership := models.ProjectMember{
+		OrganizationID: user.OrganizationID,
+		UserID:         member.ID,
+		ProjectID:      uint(projectID),
+	}
+	if err := db.Create(&membership).Error; err != nil {
+		redirectWithError(w, r, editURL, "Failed to add project (the user may already be a member)")
+		return
+	}
+	recordAudit(db, r, user.OrganizationID, &member.ID, models.AuditMembershipChanged,
+		fmt.Sprintf("added to project %s by %s", projectName(organizationProjects(db, h.cache, user.OrganizationID), &membership.ProjectID), user.Username))
+
+	redirectWithSuccess(w, r, editURL, "Project added")
+}
+
+// DeleteProjectMember removes a user from a project. Their entries keep the
+// project they were logged on.
+func (h *AuthHandler) DeleteProjectMember(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.CanManageMemberships() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/users", "Invalid form data")
+		return
+	}
+
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/users", "Invalid membership ID")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	var membership models.ProjectMember
+	if err := db.Scopes(inOrganization(user.OrganizationID)).First(&membership, id).Error; err != nil {
+		redirectWithError(w, r, "/users", "Membership not found")
+		return
+	}
+
+	editURL := "/users/edit?id=" + strconv.FormatUint(uint64(membership.UserID), 10)
+	if err := db.Delete(&membership).Error; err != nil {
+		redirectWithError(w, r, editURL, "Failed to remove project")
+		return
+	}
+	recordAudit(db, r, user.OrganizationID, &membership.UserID, models.AuditMembershipChanged,
+		fmt.Sprintf("removed from project %s by %s", projectName(organizationProjects(db, h.cache, user.OrganizationID), &membership.ProjectID), user.Username))
+
+	redirectWithSuccess(w, r, editURL, "Project removed")
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"fmt"
+	"overtime/cache"
+	"overtime/models"
+
+	"gorm.io/gorm"
+)
+
+// Teams, projects and cost centers fill the filters and pickers of most
+// pages, so they are cached per organization. Handlers that change them
+// forget the cached lists.
+
+func teamsCacheKey(organizationID uint) string {
+	return fmt.Sprintf("teams:%d", organizationID)
+}
+
+func projectsCacheKey(organizationID uint) string {
+	return fmt.Sprintf("projects:%d", organizationID)
+}
+
+func costCentersCacheKey(organizationID uint) string {
+	return fmt.Sprintf("cost-centers:%d", organizationID)
+}
+
+// organizationTeams returns the teams of the organization
+func organizationTeams(db *gorm.DB, c cache.Cache, organizationID uint) []models.Team {
+	var teams []models.Team
+	if c.Get(teamsCacheKey(organizationID), &teams) {
+		return teams
+	}
+	if err := db.Scopes(inOrganization(organizationID)).Find(&teams).Error; err == nil {
+		c.Set(teamsCacheKey(organizationID), teams)
+	}
+	return teams
+}
+
+// organizationProjects returns the projects of the organization
+func organizationProjects(db *gorm.DB, c cache.Cache, organizationID uint) []models.Project {
+	var projects []models.Project
+	if c.Get(projectsCacheKey(organizationID), &projects) {
+		return projects
+	}
+	if err := db.Scopes(inOrganization(organizationID)).Find(&projects).Error; err == nil {
+		c.Set(projectsCacheKey(organizationID), projects)
+	}
+	return projects
+}
+
+// organizationCostCenters returns the cost centers of the organization
+func organizationCostCenters(db *gorm.DB, c cache.Cache, organizationID uint) []models.CostCenter {
+	var costCenters []models.CostCenter
+	if c.Get(costCentersCacheKey(organizationID), &costCenters) {
+		return costCenters
+	}
+	if err := db.Scopes(inOrganization(organizationID)).Order("code").Find(&costCenters).Error; err == nil {
+		c.Set(costCentersCacheKey(organizationID), costCenters)
+	}
+	return costCenters
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"overtime/middleware"
+	"overtime/models"
+)
+
+// showTemplateErrors puts the details of template failures on the error
+// page, for DEV_MODE
+var showTemplateErrors bool
+
+// ShowTemplateErrors shows template failures in the browser instead of only
+// logging them
+func ShowTemplateErrors(enabled bool) {
+	showTemplateErrors = enabled
+}
+
+const renderFailed = "Something went wrong showing this page. Please try again, or report the problem if it persists."
+
+// render shows page with data in the base layout. Handlers only set the data
+// of their page, the fields every page has are filled in by pageDefaults.
+func render(w http.ResponseWriter, r *http.Request, templates map[string]*template.Template, page string, data map[string]interface{}) {
+	renderStatus(w, r, templates, page, http.StatusOK, data)
+}
+
+// renderStatus is render with a status other than 200. The page is rendered
+// into a buffer first, so a failing template results in an error page rather
+// than half a page.
+func renderStatus(w http.ResponseWriter, r *http.Request, templates map[string]*template.Template, page string, status int, data map[string]interface{}) {
+	pageDefaults(w, r, data)
+
+	var buf bytes.Buffer
+	if err := execute(&buf, templates, page, "base", data); err != nil {
+		renderError(w, r, templates, page, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+// renderFragment shows one template of page, such as a table row replaced by
+// htmx. Like render it fills in the current user and the CSRF token when data
+// is a map. A failure answers with a plain 500, which htmx reports.
+func renderFragment(w http.ResponseWriter, r *http.Request, templates map[string]*template.Template, page, name string, data interface{}) {
+	if data, ok := data.(map[string]interface{}); ok {
+		setUser(r, data)
+		setCSRFToken(w, r, data)
+	}
+
+	var buf bytes.Buffer
+	if err := execute(&buf, templates, page, name, data); err != nil {
+		log.Printf("Failed to render %s of %s: %v", name, page, err)
+		message := renderFailed
+		if showTemplateErrors {
+			message = err.Error()
+		}
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// pageDefaults fills in the fields every page has, unless the handler set
+// them: User, the logged in user if any; Nav, the navigation links for their
+// role; CSRFToken, which every form sends; and Error and Success, the flash
+// messages.
+func pageDefaults(w http.ResponseWriter, r *http.Request, data map[string]interface{}) {
+	setUser(r, data)
+	setCSRFToken(w, r, data)
+	if user, ok := data["User"].(*models.User); ok && user != nil {
+		if _, ok := data["Nav"]; !ok {
+			data["Nav"] = navigation(user, r.URL.Path)
+		}
+	}
+
+	_, hasError := data["Error"]
+	_, hasSuccess := data["Success"]
+	if !hasError || !hasSuccess {
+		flash := middleware.PopFlash(w, r)
+		if !hasError {
+			data["Error"] = flash.Error
+		}
+		if !hasSuccess {
+			data["Success"] = flash.Success
+		}
+	}
+}
+
+func setUser(r *http.Request, data map[string]interface{}) {
+	if _, ok := data["User"]; ok {
+		return
+	}
+	if user := middleware.GetUserFromContext(r.Context()); user != nil {
+		data["User"] = user
+	}
+}
+
+func setCSRFToken(w http.ResponseWriter, r *http.Request, data map[string]interface{}) {
+	if _, ok := data["CSRFToken"]; !ok {
+		data["CSRFToken"] = middleware.CSRFToken(w, r)
+	}
+}
+
+func execute(buf *bytes.Buffer, templates map[string]*template.Template, page, name string, data interface{}) error {
+	tmpl, ok := templates[page]
+	if !ok {
+		return fmt.Errorf("no template for page %q", page)
+	}
+	return tmpl.ExecuteTemplate(buf, name, data)
+}
+
+// renderError logs why page could not be rendered and answers with the error
+// page, or plain text if that fails too
+func renderError(w http.ResponseWriter, r *http.Request, templates map[string]*template.Template, page string, err error) {
+	log.Printf("Failed to render %s: %v", page, err)
+
+	message := renderFailed
+	if showTemplateErrors {
+		message = fmt.Sprintf("Failed to render %s: %v", page, err)
+	}
+
+	var buf bytes.Buffer
+	data := map[string]interface{}{
+		"Error":   message,
+		"Success": "",
+	}
+	pageDefaults(w, r, data)
+	if page == "error" || execute(&buf, templates, "error", "base", data) != nil {
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	buf.WriteTo(w)
+}
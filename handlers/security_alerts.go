@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"overtime/config"
+	"overtime/mailer"
+	"overtime/middleware"
+	"overtime/models"
+
+	"gorm.io/gorm"
+)
+
+// alertSubjects are the email subjects of the kinds of security alerts
+var alertSubjects = map[string]string{
+	models.AlertFailedLogins:    "Repeated failed logins",
+	models.AlertNewAddress:      "Login from a new address",
+	models.AlertPasswordChanged: "Password changed",
+}
+
+// raiseSecurityAlert shows the user an alert about suspicious activity on
+// their account and emails it to the organization's administrators, unless
+// the user turned alerts off
+func (h *AuthHandler) raiseSecurityAlert(db *gorm.DB, user *models.User, kind, detail, ip string) {
+	if !user.SecurityAlerts {
+		return
+	}
+
+	alert := models.SecurityAlert{
+		OrganizationID: user.OrganizationID,
+		UserID:         user.ID,
+		Kind:           kind,
+		Detail:         detail,
+		IP:             ip,
+	}
+	if err := db.Create(&alert).Error; err != nil {
+		log.Printf("Failed to record security alert for user %d: %v", user.ID, err)
+		return
+	}
+
+	go notifySecurityAlert(h.db, h.config, h.mailer, user, alert)
+}
+
+// notifySecurityAlert emails an alert to the administrators of the user's
+// organization who receive security alerts
+func notifySecurityAlert(db *gorm.DB, cfg *config.Config, mail *mailer.Mailer, user *models.User, alert models.SecurityAlert) {
+	var admins []models.User
+	db.Where("organization_id = ? AND role = ? AND email <> '' AND receive_security_alerts = ?", user.OrganizationID, models.RoleAdmin, true).Find(&admins)
+	if len(admins) == 0 {
+		return
+	}
+	to := make([]string, len(admins))
+	for i, admin := range admins {
+		to[i] = admin.Email
+	}
+
+	subject := fmt.Sprintf("Security alert for %s: %s", user.Username, alertSubjects[alert.Kind])
+	body := fmt.Sprintf(`%s
+
+User:    %s (%s)
+Address: %s
+Time:    %s
+
+Review the account here: %s/users/edit?id=%d
+`,
+		alert.Detail,
+		user.DisplayName(),
+		user.Username,
+		alert.IP,
+		alert.CreatedAt.UTC().Format("2006-01-02 15:04 MST"),
+		cfg.BaseURL,
+		user.ID,
+	)
+	if err := mail.Send(to, subject, body); err != nil {
+		log.Printf("Failed to email administrators about security alert %d: %v", alert.ID, err)
+	}
+}
+
+// countFailedLogin counts a wrong password entered for user and raises an
+// alert once the account reaches the configured number of failures
+func (h *AuthHandler) countFailedLogin(db *gorm.DB, r *http.Request, user *models.User) {
+	usage := h.failedLogins.Hit(strconv.FormatUint(uint64(user.ID), 10))
+	// Only the failure reaching the threshold raises it, not every one after
+	if usage.Limit == 0 || !usage.Allowed || usage.Remaining > 0 {
+		return
+	}
+	detail := fmt.Sprintf("%d failed logins within %s.", usage.Limit, h.config.LoginRateWindow)
+	h.raiseSecurityAlert(db, user, models.AlertFailedLogins, detail, middleware.ClientIP(r))
+}
+
+// loginNetwork is the network of an address that logins are compared by
+func loginNetwork(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return address
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// checkLoginAddress remembers the network user logged in from and raises an
+// alert when it is a new one. The first login of an account only remembers
+// it.
+func (h *AuthHandler) checkLoginAddress(db *gorm.DB, r *http.Request, user *models.User) {
+	ip := middleware.ClientIP(r)
+	network := loginNetwork(ip)
+	now := time.Now()
+
+	var known models.LoginAddress
+	err := db.Where("user_id = ? AND network = ?", user.ID, network).First(&known).Error
+	if err == nil {
+		db.Model(&known).Update("last_seen_at", now)
+		return
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return
+	}
+
+	var count int64
+	db.Model(&models.LoginAddress{}).Where("user_id = ?", user.ID).Count(&count)
+	if err := db.Create(&models.LoginAddress{UserID: user.ID, Network: network, FirstSeenAt: now, LastSeenAt: now}).Error; err != nil {
+		// A concurrent login recorded it
+		return
+	}
+	if count > 0 {
+		h.raiseSecurityAlert(db, user, models.AlertNewAddress, "Logged in from a network not used before: "+network+".", ip)
+	}
+}
+
+// SecurityAlerts returns the alerts the user has not dismissed yet, newest
+// first. It backs the banner shown on every page.
+func SecurityAlerts(db *gorm.DB, user *models.User) []models.SecurityAlert {
+	if user == nil {
+		return nil
+	}
+	var alerts []models.SecurityAlert
+	db.Where("user_id = ? AND seen_at IS NULL", user.ID).Order("created_at DESC").Limit(5).Find(&alerts)
+	return alerts
+}
+
+// DismissSecurityAlerts hides the user's alerts
+func (h *AuthHandler) DismissSecurityAlerts(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	db := h.db.WithContext(r.Context())
+	db.Model(&models.SecurityAlert{}).Where("user_id = ? AND seen_at IS NULL", user.ID).Update("seen_at", time.Now())
+
+	redirect := "/dashboard"
+	if user.IsSupervisor() {
+		redirect = "/supervisor/dashboard"
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
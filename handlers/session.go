@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"overtime/middleware"
+	"overtime/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sessionsURL is the sessions page of target as seen by user
+func sessionsURL(user, target *models.User) string {
+	if target.ID == user.ID {
+		return "/sessions"
+	}
+	return fmt.Sprintf("/sessions?user=%d", target.ID)
+}
+
+// SessionsPage lists the active sessions of the current user, or of any user
+// in the organization for admins
+func (h *AuthHandler) SessionsPage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	db := h.db.WithContext(r.Context())
+
+	target := user
+	if idStr := r.URL.Query().Get("user"); idStr != "" {
+		if !user.IsAdmin() {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		id, err := strconv.ParseUint(idStr, 10, 32)
+		if err != nil {
+			redirectWithError(w, r, "/users", "Invalid user ID")
+			return
+		}
+
+		var other models.User
+		if err := db.Scopes(inOrganization(user.OrganizationID)).First(&other, id).Error; err != nil {
+			redirectWithError(w, r, "/users", "User not found")
+			return
+		}
+		target = &other
+	}
+
+	var sessions []models.Session
+	db.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", target.ID, time.Now()).
+		Order("last_seen_at desc").Find(&sessions)
+
+	var currentID uint
+	if current := middleware.GetSessionFromContext(r.Context()); current != nil {
+		currentID = current.ID
+	}
+
+	data := map[string]interface{}{
+		"Target":    target,
+		"Sessions":  sessions,
+		"CurrentID": currentID,
+	}
+	render(w, r, h.templates, "sessions", data)
+}
+
+// RevokeSession logs one device out. Users may revoke their own sessions,
+// admins those of anyone in their organization.
+func (h *AuthHandler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/sessions", "Invalid form data")
+		return
+	}
+
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/sessions", "Invalid session ID")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	var session models.Session
+	if err := db.Preload("User").First(&session, id).Error; err != nil || session.User == nil {
+		redirectWithError(w, r, "/sessions", "Session not found")
+		return
+	}
+
+	if session.UserID != user.ID && !(user.IsAdmin() && user.SameOrganization(session.User)) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := middleware.RevokeSession(db, &session); err != nil {
+		redirectWithError(w, r, sessionsURL(user, session.User), "Failed to revoke session")
+		return
+	}
+
+	detail := fmt.Sprintf("%s from %s, revoked by %s", session.Device(), session.IP, user.Username)
+	recordAudit(db, r, session.User.OrganizationID, &session.UserID, models.AuditSessionRevoked, detail)
+
+	// Revoking the current session is a logout
+	if current := middleware.GetSessionFromContext(r.Context()); current != nil && current.ID == session.ID {
+		middleware.ClearAuthCookie(w, r)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	redirectWithSuccess(w, r, sessionsURL(user, session.User), "Session revoked")
+}
+
+// maxListedTokens is how many tokens the token usage page lists
+const maxListedTokens = 200
+
+// TokenUsagePage lists the active sessions of the organization, by browsers
+// and with bearer tokens, most recently used first, with how many requests
+// they made and how many of them were over the rate limit
+func (h *AuthHandler) TokenUsagePage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var sessions []models.Session
+	h.db.WithContext(r.Context()).Preload("User").
+		Joins("JOIN users ON users.id = sessions.user_id").
+		Where("users.organization_id = ? AND sessions.api_used_at IS NOT NULL", user.OrganizationID).
+		Where("sessions.revoked_at IS NULL AND sessions.expires_at > ?", time.Now()).
+		Order("sessions.api_used_at desc").Limit(maxListedTokens).
+		Find(&sessions)
+
+	data := map[string]interface{}{
+		"Sessions":  sessions,
+		"RateLimit": h.config.APIRateLimit,
+		"Window":    h.config.APIRateWindow,
+		"Limit":     maxListedTokens,
+	}
+	render(w, r, h.templates, "token-usage", data)
+}
+
+// UpdateTokenRateLimit sets the requests per window a session may make, so
+// a runaway integration can be held to less than API_RATE_LIMIT, or a busy
+// one allowed more. An empty or zero limit returns the session to
+// API_RATE_LIMIT.
+func (h *AuthHandler) UpdateTokenRateLimit(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/api/usage", "Invalid form data")
+		return
+	}
+
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/api/usage", "Invalid session ID")
+		return
+	}
+
+	limit := 0
+	if value := strings.TrimSpace(r.FormValue("limit")); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			redirectWithError(w, r, "/api/usage", "Rate limit must be a positive number of requests")
+			return
+		}
+	}
+
+	db := h.db.WithContext(r.Context())
+	var session models.Session
+	if err := db.Preload("User").First(&session, id).Error; err != nil || session.User == nil || !user.SameOrganization(session.User) {
+		redirectWithError(w, r, "/api/usage", "Session not found")
+		return
+	}
+
+	if err := db.Model(&session).Update("api_rate_limit", limit).Error; err != nil {
+		redirectWithError(w, r, "/api/usage", "Failed to update rate limit")
+		return
+	}
+
+	detail := fmt.Sprintf("%s from %s limited to %d requests per %s by %s", session.Device(), session.IP, limit, h.config.APIRateWindow, user.Username)
+	if limit == 0 {
+		detail = fmt.Sprintf("%s from %s returned to the default rate limit by %s", session.Device(), session.IP, user.Username)
+	}
+	recordAudit(db, r, session.User.OrganizationID, &session.UserID, models.AuditTokenRateLimited, detail)
+
+	redirectWithSuccess(w, r, "/api/usage", "Rate limit updated")
+}
@@ -0,0 +1,863 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"overtime/config"
+	"overtime/middleware"
+	"overtime/models"
+	"overtime/store"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxLogoSize limits uploaded logos, which are stored in the settings table
+const maxLogoSize = 256 << 10
+
+// defaultAccentColor is the accent of the default terminal theme
+const defaultAccentColor = "#00ff00"
+
+var accentColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// defaultCurrency is used for costs until an organization picks its currency
+const defaultCurrency = "EUR"
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+var domainPattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,}$`)
+
+// maxSignupDomains limits the email domains open signup can be limited to
+const maxSignupDomains = 20
+
+// maxListedArchives is how many month archives the settings page lists
+const maxListedArchives = 24
+
+// logoTypes are the accepted logo formats. SVG is left out because it can
+// carry scripts when opened directly.
+var logoTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+type SettingsHandler struct {
+	db        *gorm.DB
+	config    *config.Config
+	templates map[string]*template.Template
+}
+
+func NewSettingsHandler(db *gorm.DB, cfg *config.Config, templates map[string]*template.Template) *SettingsHandler {
+	return &SettingsHandler{
+		db:        db,
+		config:    cfg,
+		templates: templates,
+	}
+}
+
+// loadSettings returns the named settings of the organization. Settings that
+// were never saved are missing from the result.
+func loadSettings(db *gorm.DB, organizationID uint, names ...string) map[string]models.Setting {
+	var settings []models.Setting
+	db.Scopes(inOrganization(organizationID)).Where("name IN ?", names).Find(&settings)
+
+	byName := make(map[string]models.Setting, len(settings))
+	for _, setting := range settings {
+		byName[setting.Name] = setting
+	}
+	return byName
+}
+
+// saveSetting stores a setting, removing it when value is empty so the
+// default applies again
+func saveSetting(tx *gorm.DB, organizationID uint, name, value string) error {
+	if value == "" {
+		return tx.Scopes(inOrganization(organizationID)).Where("name = ?", name).Delete(&models.Setting{}).Error
+	}
+
+	setting := models.Setting{OrganizationID: organizationID, Name: name, Value: value}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "organization_id"}, {Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value", "updated_at"}),
+	}).Create(&setting).Error
+}
+
+// defaultOrganizationID returns the organization whose branding is shown to
+// visitors who are not logged in
+func defaultOrganizationID(db *gorm.DB) uint {
+	var organization models.Organization
+	db.Order("id asc").Limit(1).Find(&organization)
+	return organization.ID
+}
+
+// BrandingFor returns the branding of the user's organization, or of the
+// default organization when nobody is logged in. It backs the branding
+// template function.
+func BrandingFor(db *gorm.DB, user *models.User) models.Branding {
+	organizationID := defaultOrganizationID(db)
+	if user != nil {
+		organizationID = user.OrganizationID
+	}
+
+	settings := loadSettings(db, organizationID, models.SettingCompanyName, models.SettingAccentColor, models.SettingFooterText, models.SettingLogoType)
+	branding := models.Branding{
+		OrganizationID: organizationID,
+		CompanyName:    settings[models.SettingCompanyName].Value,
+		AccentColor:    settings[models.SettingAccentColor].Value,
+		FooterText:     settings[models.SettingFooterText].Value,
+	}
+	if logo, ok := settings[models.SettingLogoType]; ok {
+		branding.LogoVersion = logo.UpdatedAt.Unix()
+	}
+	return branding
+}
+
+// appSettings are an organization's runtime settings with the defaults
+// applied for values that were never saved
+type appSettings struct {
+	InviteExpiration time.Duration
+	PasswordPolicy   models.PasswordPolicy
+	// MaxHoursPerEntry caps single entries; MaxHoursPerDay and
+	// MaxHoursPerMonth cap the pending and approved hours of a user per day
+	// and month, zero means no monthly cap
+	MaxHoursPerEntry float64
+	MaxHoursPerDay   float64
+	MaxHoursPerMonth float64
+	// SoftHoursPerMonth is the monthly hours past which entries need the
+	// user's acknowledgment, zero means no soft limit
+	SoftHoursPerMonth float64
+	// Night is when overtime counts as night work
+	Night        models.NightWindow
+	ExportFormat string
+	Retention    models.RetentionPolicy
+	Currency     string
+	// OvertimeMode is how the entry form asks for overtime
+	OvertimeMode string
+	// MaxConsecutiveDays is how many days in a row users may work
+	MaxConsecutiveDays int
+	// Entries may be dated at most MaxFutureDays after today and at most
+	// MaxPastMonths back, zero months means no limit
+	MaxFutureDays int
+	MaxPastMonths int
+	// OpenSignup lets people register as employees without an invite, with
+	// an address at one of SignupDomains if any are listed. SignupApproval
+	// holds their accounts until an administrator activates them.
+	OpenSignup     bool
+	SignupDomains  []string
+	SignupApproval bool
+	// HREditEntries lets HR correct other users' entries
+	HREditEntries bool
+	MonthClose    models.MonthClose
+	// ArchiveExports keeps a copy of every monthly export
+	ArchiveExports bool
+	// WorksCouncilRoles see pseudonymous data and aggregates instead of
+	// individuals in entry lists and reports
+	WorksCouncilRoles []models.Role
+	// AnalyticsMinGroup limits the reports of roles other than
+	// administrators to groups of at least this many employees, zero shows
+	// figures per employee
+	AnalyticsMinGroup int
+}
+
+// appSettingNames are the settings appSettings are made of
+var appSettingNames = []string{models.SettingInviteExpirationDays, models.SettingPasswordMinLength,
+	models.SettingPasswordMinClasses, models.SettingPasswordBreachCheck, models.SettingPasswordHistory,
+	models.SettingPasswordMaxAgeDays, models.SettingMaxHoursPerEntry, models.SettingMaxHoursPerMonth, models.SettingSoftHoursPerMonth, models.SettingExportFormat,
+	models.SettingNightStart, models.SettingNightEnd, models.SettingNightMultiplier,
+	models.SettingMaxHoursPerDay, models.SettingRetentionEntryYears, models.SettingRetentionAuditLogYears, models.SettingRetentionInviteDays, models.SettingCurrency,
+	models.SettingOvertimeMode, models.SettingMaxConsecutiveDays, models.SettingMaxFutureDays, models.SettingMaxPastMonths,
+	models.SettingOpenSignup, models.SettingSignupDomains, models.SettingSignupApproval,
+	models.SettingHREditEntries, models.SettingMonthCloseDay, models.SettingClosedThrough, models.SettingArchiveExports,
+	models.SettingWorksCouncilRoles, models.SettingAnalyticsMinGroup}
+
+func loadAppSettings(db *gorm.DB, cfg *config.Config, organizationID uint) appSettings {
+	return parseAppSettings(cfg, loadSettings(db, organizationID, appSettingNames...))
+}
+
+// storeAppSettings is loadAppSettings from a store, the defaults if the
+// settings cannot be loaded
+func storeAppSettings(ctx context.Context, s store.Store, cfg *config.Config, organizationID uint) appSettings {
+	settings, _ := s.Settings(ctx, organizationID, appSettingNames...)
+	return parseAppSettings(cfg, settings)
+}
+
+// parseAppSettings applies the saved settings by name over the defaults
+func parseAppSettings(cfg *config.Config, settings map[string]models.Setting) appSettings {
+	app := appSettings{
+		InviteExpiration: cfg.InviteExpiration,
+		PasswordPolicy:   models.DefaultPasswordPolicy,
+		MaxHoursPerEntry: 24,
+		MaxHoursPerDay:   24,
+		ExportFormat:     exportCSV,
+		Currency:         defaultCurrency,
+		OvertimeMode:     models.OvertimeModeDeclared,
+		// The Working Time Directive asks for a day of rest every seven days
+		MaxConsecutiveDays: 6,
+		MaxFutureDays:      31,
+		MaxPastMonths:      12,
+		Night:              models.NightWindow{Multiplier: 1},
+	}
+
+	if days, err := strconv.Atoi(settings[models.SettingInviteExpirationDays].Value); err == nil && days > 0 {
+		app.InviteExpiration = time.Duration(days) * 24 * time.Hour
+	}
+	if length, err := strconv.Atoi(settings[models.SettingPasswordMinLength].Value); err == nil && length > 0 {
+		app.PasswordPolicy.MinLength = length
+	}
+	if classes, err := strconv.Atoi(settings[models.SettingPasswordMinClasses].Value); err == nil && classes > 0 {
+		app.PasswordPolicy.MinClasses = classes
+	}
+	app.PasswordPolicy.CheckBreached = settings[models.SettingPasswordBreachCheck].Value == "true"
+	if history, err := strconv.Atoi(settings[models.SettingPasswordHistory].Value); err == nil && history > 0 {
+		app.PasswordPolicy.History = history
+	}
+	if days, err := strconv.Atoi(settings[models.SettingPasswordMaxAgeDays].Value); err == nil && days > 0 {
+		app.PasswordPolicy.MaxAge = time.Duration(days) * 24 * time.Hour
+	}
+	if hours, err := strconv.ParseFloat(settings[models.SettingMaxHoursPerEntry].Value, 64); err == nil && hours > 0 {
+		app.MaxHoursPerEntry = hours
+	}
+	if hours, err := strconv.ParseFloat(settings[models.SettingMaxHoursPerDay].Value, 64); err == nil && hours > 0 {
+		app.MaxHoursPerDay = hours
+	}
+	if hours, err := strconv.ParseFloat(settings[models.SettingMaxHoursPerMonth].Value, 64); err == nil && hours > 0 {
+		app.MaxHoursPerMonth = hours
+	}
+	if hours, err := strconv.ParseFloat(settings[models.SettingSoftHoursPerMonth].Value, 64); err == nil && hours > 0 {
+		app.SoftHoursPerMonth = hours
+	}
+	app.Night.Start = settings[models.SettingNightStart].Value
+	app.Night.End = settings[models.SettingNightEnd].Value
+	if multiplier, err := strconv.ParseFloat(settings[models.SettingNightMultiplier].Value, 64); err == nil && multiplier > 0 {
+		app.Night.Multiplier = multiplier
+	}
+	app.ExportFormat = parseExportFormat(settings[models.SettingExportFormat].Value, app.ExportFormat)
+	if years, err := strconv.Atoi(settings[models.SettingRetentionEntryYears].Value); err == nil && years > 0 {
+		app.Retention.EntryYears = years
+	}
+	if years, err := strconv.Atoi(settings[models.SettingRetentionAuditLogYears].Value); err == nil && years > 0 {
+		app.Retention.AuditLogYears = years
+	}
+	if days, err := strconv.Atoi(settings[models.SettingRetentionInviteDays].Value); err == nil && days > 0 {
+		app.Retention.InviteDays = days
+	}
+	if currency := settings[models.SettingCurrency].Value; currency != "" {
+		app.Currency = currency
+	}
+	if settings[models.SettingOvertimeMode].Value == models.OvertimeModeWorked {
+		app.OvertimeMode = models.OvertimeModeWorked
+	}
+	if days, err := strconv.Atoi(settings[models.SettingMaxConsecutiveDays].Value); err == nil && days > 0 {
+		app.MaxConsecutiveDays = days
+	}
+	if days, err := strconv.Atoi(settings[models.SettingMaxFutureDays].Value); err == nil && days >= 0 {
+		app.MaxFutureDays = days
+	}
+	if months, err := strconv.Atoi(settings[models.SettingMaxPastMonths].Value); err == nil && months >= 0 {
+		app.MaxPastMonths = months
+	}
+	app.OpenSignup = settings[models.SettingOpenSignup].Value == "true"
+	if domains := settings[models.SettingSignupDomains].Value; domains != "" {
+		app.SignupDomains = strings.Split(domains, ",")
+	}
+	app.SignupApproval = settings[models.SettingSignupApproval].Value == "true"
+	app.HREditEntries = settings[models.SettingHREditEntries].Value == "true"
+	if day, err := strconv.Atoi(settings[models.SettingMonthCloseDay].Value); err == nil && day > 0 {
+		app.MonthClose.Day = day
+	}
+	app.MonthClose.ClosedThrough = settings[models.SettingClosedThrough].Value
+	app.MonthClose.Format = app.ExportFormat
+	app.ArchiveExports = settings[models.SettingArchiveExports].Value == "true"
+	if roles := settings[models.SettingWorksCouncilRoles].Value; roles != "" {
+		for _, role := range strings.Split(roles, ",") {
+			app.WorksCouncilRoles = append(app.WorksCouncilRoles, models.Role(role))
+		}
+	}
+	if size, err := strconv.Atoi(settings[models.SettingAnalyticsMinGroup].Value); err == nil && size > 0 {
+		app.AnalyticsMinGroup = size
+	}
+	return app
+}
+
+// RetentionPolicies returns a lookup of each organization's retention policy
+// for the retention purger
+func RetentionPolicies(db *gorm.DB, cfg *config.Config) func(organizationID uint) models.RetentionPolicy {
+	return func(organizationID uint) models.RetentionPolicy {
+		return loadAppSettings(db, cfg, organizationID).Retention
+	}
+}
+
+// MonthCloses returns a lookup of how each organization closes months for
+// the month closer
+func MonthCloses(db *gorm.DB, cfg *config.Config) func(organizationID uint) models.MonthClose {
+	return func(organizationID uint) models.MonthClose {
+		return loadAppSettings(db, cfg, organizationID).MonthClose
+	}
+}
+
+// SettingsPage shows the organization settings (admin only)
+func (h *SettingsHandler) SettingsPage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	branding := BrandingFor(db, user)
+	accentColor := branding.AccentColor
+	if accentColor == "" {
+		accentColor = defaultAccentColor
+	}
+
+	app := loadAppSettings(db, h.config, user.OrganizationID)
+	maxHoursPerMonth := ""
+	if app.MaxHoursPerMonth > 0 {
+		maxHoursPerMonth = strconv.FormatFloat(app.MaxHoursPerMonth, 'f', -1, 64)
+	}
+	softHoursPerMonth := ""
+	if app.SoftHoursPerMonth > 0 {
+		softHoursPerMonth = strconv.FormatFloat(app.SoftHoursPerMonth, 'f', -1, 64)
+	}
+
+	flash := middleware.PopFlash(w, r)
+	defaults := map[string]string{
+		"company_name":           branding.CompanyName,
+		"accent_color":           accentColor,
+		"footer_text":            branding.FooterText,
+		"invite_expiration_days": strconv.Itoa(int(app.InviteExpiration.Hours() / 24)),
+		"password_min_length":    strconv.Itoa(app.PasswordPolicy.MinLength),
+		"password_min_classes":   strconv.Itoa(app.PasswordPolicy.MinClasses),
+		"password_breach_check":  strconv.FormatBool(app.PasswordPolicy.CheckBreached),
+		"password_history":       strconv.Itoa(app.PasswordPolicy.History),
+		"password_max_age_days":  strconv.Itoa(int(app.PasswordPolicy.MaxAge.Hours() / 24)),
+		"max_hours_per_entry":    strconv.FormatFloat(app.MaxHoursPerEntry, 'f', -1, 64),
+		"max_hours_per_day":      strconv.FormatFloat(app.MaxHoursPerDay, 'f', -1, 64),
+		"max_hours_per_month":    maxHoursPerMonth,
+		"soft_hours_per_month":   softHoursPerMonth,
+		"night_start":            app.Night.Start,
+		"night_end":              app.Night.End,
+		"night_multiplier":       strconv.FormatFloat(app.Night.Multiplier, 'f', -1, 64),
+		"export_format":          app.ExportFormat,
+		"currency":               app.Currency,
+		"overtime_mode":          app.OvertimeMode,
+		"max_consecutive_days":   strconv.Itoa(app.MaxConsecutiveDays),
+		"max_future_days":        strconv.Itoa(app.MaxFutureDays),
+		"max_past_months":        strconv.Itoa(app.MaxPastMonths),
+		"retention_entry_years":  strconv.Itoa(app.Retention.EntryYears),
+		"retention_audit_years":  strconv.Itoa(app.Retention.AuditLogYears),
+		"retention_invite_days":  strconv.Itoa(app.Retention.InviteDays),
+		"open_signup":            strconv.FormatBool(app.OpenSignup),
+		"signup_domains":         strings.Join(app.SignupDomains, ", "),
+		"signup_approval":        strconv.FormatBool(app.SignupApproval),
+		"hr_edit_entries":        strconv.FormatBool(app.HREditEntries),
+		"month_close_day":        strconv.Itoa(app.MonthClose.Day),
+		"closed_through":         app.MonthClose.ClosedThrough,
+		"archive_exports":        strconv.FormatBool(app.ArchiveExports),
+		"analytics_min_group":    strconv.Itoa(app.AnalyticsMinGroup),
+	}
+	for _, role := range app.WorksCouncilRoles {
+		defaults[worksCouncilField(role)] = "true"
+	}
+	form := formValues(defaults, flash.Form)
+
+	var archives []models.MonthArchive
+	db.Select("id", "created_at", "month", "filename", "entries", "hours", "pending").
+		Scopes(inOrganization(user.OrganizationID)).Order("month desc").Limit(maxListedArchives).Find(&archives)
+
+	var rules []models.BalanceRule
+	db.Scopes(inOrganization(user.OrganizationID)).Order("id").Find(&rules)
+
+	data := map[string]interface{}{
+		"Branding":     branding,
+		"Archives":     archives,
+		"Holidays":     organizationHolidays(db, user.OrganizationID, user.Now()),
+		"BalanceRules": rules,
+		"Form":         form,
+		"SignupURL":    fmt.Sprintf("%s/register?organization=%d", baseURL(h.config, r), user.OrganizationID),
+		"Error":        flash.Error,
+		"Success":      flash.Success,
+	}
+	render(w, r, h.templates, "settings", data)
+}
+
+// UpdateBranding saves the company name, accent color, footer text and logo
+func (h *SettingsHandler) UpdateBranding(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxLogoSize+(64<<10))
+	if err := r.ParseMultipartForm(maxLogoSize); err != nil {
+		redirectWithError(w, r, "/settings", "Invalid form data (the logo may be too large, at most 256 KB)")
+		return
+	}
+
+	companyName := strings.TrimSpace(r.FormValue("company_name"))
+	if utf8.RuneCountInString(companyName) > 100 {
+		redirectWithFormError(w, r, "/settings", "Company name is too long (at most 100 characters)")
+		return
+	}
+
+	footerText := strings.TrimSpace(r.FormValue("footer_text"))
+	if utf8.RuneCountInString(footerText) > 500 {
+		redirectWithFormError(w, r, "/settings", "Footer text is too long (at most 500 characters)")
+		return
+	}
+
+	accentColor := strings.ToLower(strings.TrimSpace(r.FormValue("accent_color")))
+	if accentColor != "" && !accentColorPattern.MatchString(accentColor) {
+		redirectWithFormError(w, r, "/settings", "Accent color must be a hex color like #00ff00")
+		return
+	}
+	if accentColor == defaultAccentColor {
+		accentColor = ""
+	}
+
+	var logo, logoType string
+	file, _, err := r.FormFile("logo")
+	if err == nil {
+		defer file.Close()
+		data, err := io.ReadAll(io.LimitReader(file, maxLogoSize+1))
+		if err != nil || len(data) > maxLogoSize {
+			redirectWithFormError(w, r, "/settings", "Logo is too large (at most 256 KB)")
+			return
+		}
+		logoType = http.DetectContentType(data)
+		if !logoTypes[logoType] {
+			redirectWithFormError(w, r, "/settings", "Logo must be a PNG, JPEG, GIF or WebP image")
+			return
+		}
+		logo = base64.StdEncoding.EncodeToString(data)
+	} else if err != http.ErrMissingFile {
+		redirectWithFormError(w, r, "/settings", "Failed to read the logo")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	err = db.Transaction(func(tx *gorm.DB) error {
+		values := map[string]string{
+			models.SettingCompanyName: companyName,
+			models.SettingAccentColor: accentColor,
+			models.SettingFooterText:  footerText,
+		}
+		if logo != "" || r.FormValue("remove_logo") == "on" {
+			values[models.SettingLogo] = logo
+			values[models.SettingLogoType] = logoType
+		}
+		for name, value := range values {
+			if err := saveSetting(tx, user.OrganizationID, name, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		redirectWithFormError(w, r, "/settings", "Failed to save settings")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/settings", "Branding updated")
+}
+
+// UpdateApplicationSettings saves the runtime settings
+func (h *SettingsHandler) UpdateApplicationSettings(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/settings", "Invalid form data")
+		return
+	}
+
+	inviteDays, err := strconv.Atoi(r.FormValue("invite_expiration_days"))
+	if err != nil || inviteDays < 1 || inviteDays > 90 {
+		redirectWithFormError(w, r, "/settings", "Invite expiration must be between 1 and 90 days")
+		return
+	}
+
+	passwordLength, err := strconv.Atoi(r.FormValue("password_min_length"))
+	if err != nil || passwordLength < 5 || passwordLength > 128 {
+		redirectWithFormError(w, r, "/settings", "Minimum password length must be between 5 and 128")
+		return
+	}
+
+	passwordClasses, err := strconv.Atoi(r.FormValue("password_min_classes"))
+	if err != nil || passwordClasses < 0 || passwordClasses > 4 {
+		redirectWithFormError(w, r, "/settings", "Required character classes must be between 0 and 4")
+		return
+	}
+
+	// Unchecked boxes are not submitted
+	breachCheck := ""
+	if r.FormValue("password_breach_check") != "" {
+		breachCheck = "true"
+	}
+	hrEdits := ""
+	if r.FormValue("hr_edit_entries") != "" {
+		hrEdits = "true"
+	}
+	archiveExports := ""
+	if r.FormValue("archive_exports") != "" {
+		archiveExports = "true"
+	}
+	var limitedRoles []string
+	for _, role := range worksCouncilRoles {
+		if r.FormValue(worksCouncilField(role)) != "" {
+			limitedRoles = append(limitedRoles, string(role))
+		}
+	}
+
+	passwordHistory, err := strconv.Atoi(r.FormValue("password_history"))
+	if err != nil || passwordHistory < 0 || passwordHistory > maxPasswordHistory {
+		redirectWithFormError(w, r, "/settings", fmt.Sprintf("Password history must be between 0 and %d", maxPasswordHistory))
+		return
+	}
+
+	passwordMaxAge, err := strconv.Atoi(r.FormValue("password_max_age_days"))
+	if err != nil || passwordMaxAge < 0 || passwordMaxAge > 3650 {
+		redirectWithFormError(w, r, "/settings", "Password expiry must be between 0 and 3650 days")
+		return
+	}
+
+	maxPerEntry, err := strconv.ParseFloat(r.FormValue("max_hours_per_entry"), 64)
+	if err != nil || maxPerEntry <= 0 || maxPerEntry > 24 {
+		redirectWithFormError(w, r, "/settings", "Maximum hours per entry must be more than 0 and at most 24")
+		return
+	}
+
+	maxPerDay, err := strconv.ParseFloat(r.FormValue("max_hours_per_day"), 64)
+	if err != nil || maxPerDay <= 0 || maxPerDay > 24 {
+		redirectWithFormError(w, r, "/settings", "Maximum hours per day must be more than 0 and at most 24")
+		return
+	}
+
+	var maxPerMonth float64
+	if value := strings.TrimSpace(r.FormValue("max_hours_per_month")); value != "" {
+		maxPerMonth, err = strconv.ParseFloat(value, 64)
+		if err != nil || maxPerMonth < 0 || maxPerMonth > 744 {
+			redirectWithFormError(w, r, "/settings", "Maximum hours per month must be between 0 and 744")
+			return
+		}
+	}
+
+	var softPerMonth float64
+	if value := strings.TrimSpace(r.FormValue("soft_hours_per_month")); value != "" {
+		softPerMonth, err = strconv.ParseFloat(value, 64)
+		if err != nil || softPerMonth < 0 || softPerMonth > 744 {
+			redirectWithFormError(w, r, "/settings", "Soft limit per month must be between 0 and 744 hours")
+			return
+		}
+	}
+	if softPerMonth > 0 && maxPerMonth > 0 && softPerMonth >= maxPerMonth {
+		redirectWithFormError(w, r, "/settings", "The soft limit per month must be below the maximum hours per month")
+		return
+	}
+
+	// Both ends of the night window or neither
+	nightStart := strings.TrimSpace(r.FormValue("night_start"))
+	nightEnd := strings.TrimSpace(r.FormValue("night_end"))
+	if (nightStart == "") != (nightEnd == "") || !validClock(nightStart) || !validClock(nightEnd) {
+		redirectWithFormError(w, r, "/settings", "Enter both the start and the end of the night as HH:MM, or neither")
+		return
+	}
+	if nightStart == nightEnd {
+		nightStart, nightEnd = "", ""
+	}
+	nightMultiplier, err := strconv.ParseFloat(r.FormValue("night_multiplier"), 64)
+	if err != nil || nightMultiplier < 1 || nightMultiplier > 5 {
+		redirectWithFormError(w, r, "/settings", "The night multiplier must be between 1 and 5")
+		return
+	}
+
+	exportFormat := parseExportFormat(r.FormValue("export_format"), "")
+	if exportFormat == "" {
+		redirectWithFormError(w, r, "/settings", "Unknown export format")
+		return
+	}
+
+	currency := strings.ToUpper(strings.TrimSpace(r.FormValue("currency")))
+	if !currencyPattern.MatchString(currency) {
+		redirectWithFormError(w, r, "/settings", "Currency must be a three letter code like EUR")
+		return
+	}
+	if currency == defaultCurrency {
+		currency = ""
+	}
+
+	overtimeMode := ""
+	switch r.FormValue("overtime_mode") {
+	case models.OvertimeModeDeclared:
+	case models.OvertimeModeWorked:
+		overtimeMode = models.OvertimeModeWorked
+	default:
+		redirectWithFormError(w, r, "/settings", "Unknown overtime mode")
+		return
+	}
+
+	maxConsecutiveDays, err := strconv.Atoi(r.FormValue("max_consecutive_days"))
+	if err != nil || maxConsecutiveDays < 1 || maxConsecutiveDays > 31 {
+		redirectWithFormError(w, r, "/settings", "Consecutive working days must be between 1 and 31")
+		return
+	}
+
+	maxFutureDays, err := strconv.Atoi(r.FormValue("max_future_days"))
+	if err != nil || maxFutureDays < 0 || maxFutureDays > 366 {
+		redirectWithFormError(w, r, "/settings", "Days in the future must be between 0 and 366")
+		return
+	}
+
+	maxPastMonths, err := strconv.Atoi(r.FormValue("max_past_months"))
+	if err != nil || maxPastMonths < 0 || maxPastMonths > 120 {
+		redirectWithFormError(w, r, "/settings", "Months in the past must be between 0 and 120")
+		return
+	}
+
+	entryYears, err := strconv.Atoi(r.FormValue("retention_entry_years"))
+	if err != nil || entryYears < 0 || entryYears > 100 {
+		redirectWithFormError(w, r, "/settings", "Entry retention must be between 0 and 100 years")
+		return
+	}
+
+	auditYears, err := strconv.Atoi(r.FormValue("retention_audit_years"))
+	if err != nil || auditYears < 0 || auditYears > 100 {
+		redirectWithFormError(w, r, "/settings", "Audit log retention must be between 0 and 100 years")
+		return
+	}
+
+	inviteRetention, err := strconv.Atoi(r.FormValue("retention_invite_days"))
+	if err != nil || inviteRetention < 0 || inviteRetention > 3650 {
+		redirectWithFormError(w, r, "/settings", "Invite retention must be between 0 and 3650 days")
+		return
+	}
+
+	monthCloseDay, err := strconv.Atoi(r.FormValue("month_close_day"))
+	if err != nil || monthCloseDay < 0 || monthCloseDay > 28 {
+		redirectWithFormError(w, r, "/settings", "The day months close on must be between 0 and 28")
+		return
+	}
+
+	analyticsMinGroup, err := strconv.Atoi(r.FormValue("analytics_min_group"))
+	if err != nil || analyticsMinGroup < 0 || analyticsMinGroup == 1 || analyticsMinGroup > maxAnalyticsMinGroup {
+		redirectWithFormError(w, r, "/settings", fmt.Sprintf("Report group size must be 0 or between 2 and %d", maxAnalyticsMinGroup))
+		return
+	}
+
+	closedThrough := strings.TrimSpace(r.FormValue("closed_through"))
+	if closedThrough != "" {
+		if _, err := time.Parse("2006-01", closedThrough); err != nil {
+			redirectWithFormError(w, r, "/settings", "Closed months must be given as a month like 2026-01")
+			return
+		}
+	}
+
+	monthly := ""
+	if maxPerMonth > 0 {
+		monthly = strconv.FormatFloat(maxPerMonth, 'f', -1, 64)
+	}
+	softMonthly := ""
+	if softPerMonth > 0 {
+		softMonthly = strconv.FormatFloat(softPerMonth, 'f', -1, 64)
+	}
+
+	// A changed retention policy is reported anew before it deletes anything
+	retention := models.RetentionPolicy{EntryYears: entryYears, AuditLogYears: auditYears, InviteDays: inviteRetention}
+	db := h.db.WithContext(r.Context())
+	retentionChanged := retention != loadAppSettings(db, h.config, user.OrganizationID).Retention
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if retentionChanged {
+			if err := saveSetting(tx, user.OrganizationID, models.SettingRetentionReportedAt, ""); err != nil {
+				return err
+			}
+		}
+
+		values := map[string]string{
+			models.SettingInviteExpirationDays:   strconv.Itoa(inviteDays),
+			models.SettingPasswordMinLength:      strconv.Itoa(passwordLength),
+			models.SettingPasswordMinClasses:     strconv.Itoa(passwordClasses),
+			models.SettingPasswordBreachCheck:    breachCheck,
+			models.SettingPasswordHistory:        strconv.Itoa(passwordHistory),
+			models.SettingPasswordMaxAgeDays:     strconv.Itoa(passwordMaxAge),
+			models.SettingMaxHoursPerEntry:       strconv.FormatFloat(maxPerEntry, 'f', -1, 64),
+			models.SettingMaxHoursPerDay:         strconv.FormatFloat(maxPerDay, 'f', -1, 64),
+			models.SettingMaxHoursPerMonth:       monthly,
+			models.SettingSoftHoursPerMonth:      softMonthly,
+			models.SettingNightStart:             nightStart,
+			models.SettingNightEnd:               nightEnd,
+			models.SettingNightMultiplier:        strconv.FormatFloat(nightMultiplier, 'f', -1, 64),
+			models.SettingExportFormat:           exportFormat,
+			models.SettingCurrency:               currency,
+			models.SettingOvertimeMode:           overtimeMode,
+			models.SettingMaxConsecutiveDays:     strconv.Itoa(maxConsecutiveDays),
+			models.SettingMaxFutureDays:          strconv.Itoa(maxFutureDays),
+			models.SettingMaxPastMonths:          strconv.Itoa(maxPastMonths),
+			models.SettingRetentionEntryYears:    strconv.Itoa(entryYears),
+			models.SettingRetentionAuditLogYears: strconv.Itoa(auditYears),
+			models.SettingRetentionInviteDays:    strconv.Itoa(inviteRetention),
+			models.SettingHREditEntries:          hrEdits,
+			models.SettingMonthCloseDay:          strconv.Itoa(monthCloseDay),
+			models.SettingClosedThrough:          closedThrough,
+			models.SettingArchiveExports:         archiveExports,
+			models.SettingWorksCouncilRoles:      strings.Join(limitedRoles, ","),
+			models.SettingAnalyticsMinGroup:      strconv.Itoa(analyticsMinGroup),
+		}
+		for name, value := range values {
+			if err := saveSetting(tx, user.OrganizationID, name, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		redirectWithFormError(w, r, "/settings", "Failed to save settings")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/settings", "Settings updated")
+}
+
+// UpdateSignupSettings saves whether people can register without an invite,
+// the email domains they may register with and whether an administrator has
+// to activate their accounts
+func (h *SettingsHandler) UpdateSignupSettings(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/settings", "Invalid form data")
+		return
+	}
+
+	var domains []string
+	for _, domain := range strings.FieldsFunc(strings.ToLower(r.FormValue("signup_domains")), func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	}) {
+		domain = strings.TrimPrefix(domain, "@")
+		if !domainPattern.MatchString(domain) {
+			redirectWithFormError(w, r, "/settings", fmt.Sprintf("%s is not a domain, e.g. example.com", domain))
+			return
+		}
+		domains = append(domains, domain)
+	}
+	if len(domains) > maxSignupDomains {
+		redirectWithFormError(w, r, "/settings", fmt.Sprintf("List at most %d domains", maxSignupDomains))
+		return
+	}
+
+	flag := func(name string) string {
+		if r.FormValue(name) != "" {
+			return "true"
+		}
+		return ""
+	}
+
+	db := h.db.WithContext(r.Context())
+	err := db.Transaction(func(tx *gorm.DB) error {
+		values := map[string]string{
+			models.SettingOpenSignup:     flag("open_signup"),
+			models.SettingSignupDomains:  strings.Join(domains, ","),
+			models.SettingSignupApproval: flag("signup_approval"),
+		}
+		for name, value := range values {
+			if err := saveSetting(tx, user.OrganizationID, name, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		redirectWithFormError(w, r, "/settings", "Failed to save settings")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/settings", "Settings updated")
+}
+
+// Logo serves an organization's logo. It is public so the login page can
+// show the default organization's logo.
+func (h *SettingsHandler) Logo(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("organization"), 10, 32)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	settings := loadSettings(db, uint(id), models.SettingLogo, models.SettingLogoType)
+	data, err := base64.StdEncoding.DecodeString(settings[models.SettingLogo].Value)
+	if err != nil || len(data) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Logo URLs carry the logo version, so a new logo gets a new URL
+	w.Header().Set("Content-Type", settings[models.SettingLogoType].Value)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(data)
+}
+
+// MonthArchive downloads the export archived when a month was closed
+// (admin only)
+func (h *SettingsHandler) MonthArchive(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if !user.IsAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 32)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	var archive models.MonthArchive
+	if err := db.Scopes(inOrganization(user.OrganizationID)).First(&archive, id).Error; err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	err = logExport(db, r, user, models.ExportLog{
+		Kind:     models.ExportMonthArchive,
+		Filename: archive.Filename,
+		Filters:  "month=" + archive.Month,
+		Rows:     exportRows(int(archive.Entries)),
+	})
+	if err != nil {
+		http.Error(w, "Failed to log the export", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", archive.Filename))
+	w.Write(archive.Data)
+}
+
+// validClock reports whether value is empty or a time of day as HH:MM
+func validClock(value string) bool {
+	if value == "" {
+		return true
+	}
+	_, err := time.Parse("15:04", value)
+	return err == nil
+}
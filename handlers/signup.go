@@ -0,0 +1,311 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"overtime/config"
+	"overtime/middleware"
+	"overtime/models"
+	"overtime/services"
+
+	"gorm.io/gorm"
+)
+
+// signupVerificationExpiration is how long the link confirming the email
+// address of an account from open signup works
+const signupVerificationExpiration = 24 * time.Hour
+
+// signupOrganization returns the organization named by the organization
+// parameter, or the default organization, and its settings if it has open
+// signup
+func signupOrganization(db *gorm.DB, cfg *config.Config, r *http.Request) (*models.Organization, appSettings, bool) {
+	organizationID := defaultOrganizationID(db)
+	if id := r.FormValue("organization"); id != "" {
+		parsed, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, appSettings{}, false
+		}
+		organizationID = uint(parsed)
+	}
+
+	var organization models.Organization
+	if err := db.First(&organization, organizationID).Error; err != nil {
+		return nil, appSettings{}, false
+	}
+	app := loadAppSettings(db, cfg, organization.ID)
+	return &organization, app, app.OpenSignup
+}
+
+// signupDomainAllowed reports whether the email address is at one of the
+// domains, any address is allowed when no domains are listed
+func signupDomainAllowed(domains []string, email string) bool {
+	if len(domains) == 0 {
+		return true
+	}
+	_, domain, ok := strings.Cut(strings.ToLower(email), "@")
+	if !ok {
+		return false
+	}
+	for _, allowed := range domains {
+		if domain == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// sendSignupVerification emails a link confirming the address of an account
+// from open signup, unless one was sent within magicLinkInterval
+func (h *AuthHandler) sendSignupVerification(db *gorm.DB, user *models.User) {
+	var recent int64
+	db.Model(&models.LoginToken{}).
+		Where("user_id = ? AND purpose = ? AND created_at > ?", user.ID, models.LoginTokenVerifySignup, time.Now().Add(-magicLinkInterval)).
+		Count(&recent)
+	if recent > 0 {
+		return
+	}
+
+	code, err := models.GenerateApprovalCode()
+	if err != nil {
+		log.Printf("Failed to generate verification code for user %d: %v", user.ID, err)
+		return
+	}
+	record := models.LoginToken{
+		Code:      code,
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(signupVerificationExpiration),
+		Purpose:   models.LoginTokenVerifySignup,
+	}
+	if err := db.Create(&record).Error; err != nil {
+		log.Printf("Failed to store verification token for user %d: %v", user.ID, err)
+		return
+	}
+	token, err := middleware.GenerateLoginToken(code, user.ID, signupVerificationExpiration)
+	if err != nil {
+		log.Printf("Failed to sign verification token for user %d: %v", user.ID, err)
+		return
+	}
+
+	link := h.config.BaseURL + "/register/verify?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf(`Someone signed up for the account %s with this email address.
+
+Confirm it: %s
+
+The link works once and expires on %s. If you did not sign up, you can
+ignore this email, the account cannot be used without the confirmation.
+`,
+		user.Username,
+		link,
+		record.ExpiresAt.In(user.Location()).Format("2006-01-02 15:04"),
+	)
+
+	go func(to string) {
+		if err := h.mailer.Send([]string{to}, "Confirm your email address", body); err != nil {
+			log.Printf("Failed to email verification link to %s: %v", to, err)
+		}
+	}(user.Email)
+}
+
+// signUpPage shows the registration form of an organization with open
+// signup, for visitors without an invite
+func (h *AuthHandler) signUpPage(w http.ResponseWriter, r *http.Request) {
+	db := h.db.WithContext(r.Context())
+	organization, app, ok := signupOrganization(db, h.config, r)
+	if !ok {
+		http.Error(w, "Registration requires an invite link", http.StatusBadRequest)
+		return
+	}
+
+	flash := middleware.PopFlash(w, r)
+	data := map[string]interface{}{
+		"OpenSignup":     true,
+		"Organization":   organization,
+		"Role":           models.RoleEmployee,
+		"SignupDomains":  app.SignupDomains,
+		"SignupApproval": app.SignupApproval,
+		"PasswordPolicy": app.PasswordPolicy,
+		"Captcha":        h.captchaWidget(r),
+		"Form":           flash.Form,
+		"Error":          flash.Error,
+	}
+	render(w, r, h.templates, "register", data)
+}
+
+// signUp creates an employee account in an organization with open signup.
+// The new user is logged in unless the email address has to be confirmed or
+// an administrator has to activate the account first. Domains are only
+// trusted once the address is confirmed.
+func (h *AuthHandler) signUp(w http.ResponseWriter, r *http.Request) {
+	db := h.db.WithContext(r.Context())
+	organization, app, ok := signupOrganization(db, h.config, r)
+	if !ok {
+		http.Error(w, "Registration requires an invite link", http.StatusBadRequest)
+		return
+	}
+
+	page := fmt.Sprintf("/register?organization=%d", organization.ID)
+	if message := h.humanCheck(r); message != "" {
+		redirectWithFormError(w, r, page, message)
+		return
+	}
+	username := services.NormalizeUsername(r.FormValue("username"))
+	fullName := strings.TrimSpace(r.FormValue("full_name"))
+	email := strings.TrimSpace(r.FormValue("email"))
+	password := r.FormValue("password")
+
+	if len(username) < 3 {
+		redirectWithFormError(w, r, page, "Username must be at least 3 characters")
+		return
+	}
+	if fullName == "" || utf8.RuneCountInString(fullName) > 200 {
+		redirectWithFormError(w, r, page, "Enter your full name (at most 200 characters)")
+		return
+	}
+	if len(app.SignupDomains) > 0 && email == "" {
+		redirectWithFormError(w, r, page, "Enter your work email address")
+		return
+	}
+	if email != "" && (!strings.Contains(email, "@") || len(email) > 255) {
+		redirectWithFormError(w, r, page, "Invalid email address")
+		return
+	}
+	if !signupDomainAllowed(app.SignupDomains, email) {
+		redirectWithFormError(w, r, page, "Registration is limited to email addresses at "+strings.Join(app.SignupDomains, ", "))
+		return
+	}
+	if password != r.FormValue("confirm_password") {
+		redirectWithFormError(w, r, page, "Passwords do not match")
+		return
+	}
+	if err := checkPassword(app.PasswordPolicy, password); err != nil {
+		redirectWithFormError(w, r, page, err.Error())
+		return
+	}
+
+	user, err := services.SignUp(db, organization.ID, services.Registration{
+		Username: username,
+		FullName: fullName,
+		Email:    email,
+		Password: password,
+	}, app.SignupApproval)
+	switch {
+	case errors.Is(err, services.ErrUsernameTaken):
+		redirectWithFormError(w, r, page, "Username already exists")
+		return
+	case errors.Is(err, services.ErrEmailTaken):
+		redirectWithFormError(w, r, page, "Email address is already used by another account")
+		return
+	case err != nil:
+		redirectWithFormError(w, r, page, "Failed to create account")
+		return
+	}
+
+	recordAudit(db, r, organization.ID, &user.ID, models.AuditUserSignedUp, "")
+
+	if user.PendingVerification {
+		h.sendSignupVerification(db, user)
+		redirectWithSuccess(w, r, "/login", "Your account was created. Confirm your email address with the link sent to "+user.Email+" to continue.")
+		return
+	}
+	if user.PendingApproval {
+		go notifyPendingSignup(h.db, h.config, h.mailer, user)
+		redirectWithSuccess(w, r, "/login", "Your account was created. You can log in once an administrator has activated it.")
+		return
+	}
+
+	if err := middleware.StartSession(db, w, r, user, h.config.JWTExpiration); err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+// SignupVerificationPage confirms the email address of an account from open
+// signup. Mail scanners prefetch links, so the link is only used up on POST.
+func (h *AuthHandler) SignupVerificationPage(w http.ResponseWriter, r *http.Request) {
+	tokenString := r.URL.Query().Get("token")
+
+	db := h.db.WithContext(r.Context())
+	record, problem := loadLoginLink(db, tokenString, models.LoginTokenVerifySignup)
+	if problem != "" {
+		data := map[string]interface{}{
+			"Error": problem,
+		}
+		render(w, r, h.templates, "signup-verify", data)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Token":    tokenString,
+		"Username": record.User.Username,
+		"Email":    record.User.Email,
+	}
+	render(w, r, h.templates, "signup-verify", data)
+}
+
+// VerifySignup confirms the email address of an account from open signup
+// with an emailed link. The user is logged in unless an administrator has to
+// activate the account, who is told about it only now.
+func (h *AuthHandler) VerifySignup(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	record, problem := loadLoginLink(db, r.FormValue("token"), models.LoginTokenVerifySignup)
+	if problem != "" {
+		data := map[string]interface{}{
+			"Error": problem,
+		}
+		render(w, r, h.templates, "signup-verify", data)
+		return
+	}
+
+	// Only one of two concurrent requests may use the link
+	result := db.Model(&models.LoginToken{}).
+		Where("id = ? AND used_at IS NULL", record.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil || result.RowsAffected != 1 {
+		data := map[string]interface{}{
+			"Error": "This link has already been used or has expired.",
+		}
+		render(w, r, h.templates, "signup-verify", data)
+		return
+	}
+
+	user, err := services.VerifySignup(db, record.UserID)
+	if errors.Is(err, services.ErrNotPending) {
+		redirectWithSuccess(w, r, "/login", "Your email address is already confirmed")
+		return
+	}
+	if err != nil {
+		data := map[string]interface{}{
+			"Error": "Failed to confirm your email address. Please try again.",
+		}
+		render(w, r, h.templates, "signup-verify", data)
+		return
+	}
+
+	recordAudit(db, r, user.OrganizationID, &user.ID, models.AuditSignupVerified, user.Email)
+
+	if user.PendingApproval {
+		go notifyPendingSignup(h.db, h.config, h.mailer, user)
+		redirectWithSuccess(w, r, "/login", "Your email address is confirmed. You can log in once an administrator has activated the account.")
+		return
+	}
+
+	if err := middleware.StartSession(db, w, r, user, h.config.JWTExpiration); err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
@@ -1,27 +1,35 @@
 package handlers
 
 import (
-	"encoding/csv"
+	"bytes"
+	"context"
 	"fmt"
 	"html/template"
+	"io"
 	"net/http"
+	"overtime/cache"
 	"overtime/config"
-	"overtime/database"
 	"overtime/middleware"
 	"overtime/models"
 	"strconv"
 	"time"
+
+	"gorm.io/gorm"
 )
 
 type SupervisorHandler struct {
+	db        *gorm.DB
 	config    *config.Config
 	templates map[string]*template.Template
+	cache     cache.Cache
 }
 
-func NewSupervisorHandler(cfg *config.Config, templates map[string]*template.Template) *SupervisorHandler {
+func NewSupervisorHandler(db *gorm.DB, cfg *config.Config, templates map[string]*template.Template, c cache.Cache) *SupervisorHandler {
 	return &SupervisorHandler{
+		db:        db,
 		config:    cfg,
 		templates: templates,
+		cache:     c,
 	}
 }
 
@@ -33,27 +41,25 @@ func (h *SupervisorHandler) SupervisorsPage(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	db := database.GetDB()
+	db := h.db.WithContext(r.Context())
 
 	var assignments []models.TeamSupervisor
-	db.Preload("User").Preload("User.Project").Preload("Team").Find(&assignments)
+	db.Preload("User").Preload("User.Project").Preload("Team").
+		Where("team_id IN (?)", db.Model(&models.Team{}).Select("id").Where("organization_id = ?", user.OrganizationID)).
+		Find(&assignments)
 
 	// Get all users with SUPERVISOR role
 	var supervisors []models.User
-	db.Preload("Project").Where("role = ?", models.RoleSupervisor).Find(&supervisors)
+	db.Preload("Project").Scopes(inOrganization(user.OrganizationID)).Where("role = ?", models.RoleSupervisor).Find(&supervisors)
 
-	var teams []models.Team
-	db.Find(&teams)
+	teams := organizationTeams(db, h.cache, user.OrganizationID)
 
 	data := map[string]interface{}{
-		"User":        user,
 		"Assignments": assignments,
 		"Supervisors": supervisors,
 		"Teams":       teams,
-		"Error":       r.URL.Query().Get("error"),
-		"Success":     r.URL.Query().Get("success"),
 	}
-	h.templates["supervisors"].ExecuteTemplate(w, "base", data)
+	render(w, r, h.templates, "supervisors", data)
 }
 
 // AssignSupervisor assigns a supervisor to a team
@@ -65,7 +71,7 @@ func (h *SupervisorHandler) AssignSupervisor(w http.ResponseWriter, r *http.Requ
 	}
 
 	if err := r.ParseForm(); err != nil {
-		http.Redirect(w, r, "/supervisors?error=Invalid+form+data", http.StatusSeeOther)
+		redirectWithError(w, r, "/supervisors", "Invalid form data")
 		return
 	}
 
@@ -74,38 +80,44 @@ func (h *SupervisorHandler) AssignSupervisor(w http.ResponseWriter, r *http.Requ
 
 	userID, err := strconv.ParseUint(userIDStr, 10, 32)
 	if err != nil {
-		http.Redirect(w, r, "/supervisors?error=Invalid+user+ID", http.StatusSeeOther)
+		redirectWithError(w, r, "/supervisors", "Invalid user ID")
 		return
 	}
 
 	teamID, err := strconv.ParseUint(teamIDStr, 10, 32)
 	if err != nil {
-		http.Redirect(w, r, "/supervisors?error=Invalid+team+ID", http.StatusSeeOther)
+		redirectWithError(w, r, "/supervisors", "Invalid team ID")
 		return
 	}
 
+	db := h.db.WithContext(r.Context())
+
 	// Verify the user is a supervisor with a project assigned
 	var supervisor models.User
-	if err := database.GetDB().First(&supervisor, userID).Error; err != nil {
-		http.Redirect(w, r, "/supervisors?error=User+not+found", http.StatusSeeOther)
+	if err := db.Preload("ProjectMemberships").Scopes(inOrganization(user.OrganizationID)).First(&supervisor, userID).Error; err != nil {
+		redirectWithError(w, r, "/supervisors", "User not found")
 		return
 	}
 	if !supervisor.IsSupervisor() {
-		http.Redirect(w, r, "/supervisors?error=User+is+not+a+supervisor", http.StatusSeeOther)
+		redirectWithError(w, r, "/supervisors", "User is not a supervisor")
+		return
+	}
+	if len(supervisor.ProjectIDs()) == 0 {
+		redirectWithError(w, r, "/supervisors", "Supervisor has no project assigned")
 		return
 	}
-	if supervisor.ProjectID == nil {
-		http.Redirect(w, r, "/supervisors?error=Supervisor+has+no+project+assigned", http.StatusSeeOther)
+	if !organizationExists(db, &models.Team{}, uint(teamID), user.OrganizationID) {
+		redirectWithError(w, r, "/supervisors", "Team not found")
 		return
 	}
 
 	// Check if assignment already exists
 	var existingCount int64
-	database.GetDB().Model(&models.TeamSupervisor{}).
+	db.Model(&models.TeamSupervisor{}).
 		Where("user_id = ? AND team_id = ?", userID, teamID).
 		Count(&existingCount)
 	if existingCount > 0 {
-		http.Redirect(w, r, "/supervisors?error=Assignment+already+exists", http.StatusSeeOther)
+		redirectWithError(w, r, "/supervisors", "Assignment already exists")
 		return
 	}
 
@@ -114,12 +126,12 @@ func (h *SupervisorHandler) AssignSupervisor(w http.ResponseWriter, r *http.Requ
 		TeamID: uint(teamID),
 	}
 
-	if err := database.GetDB().Create(&assignment).Error; err != nil {
-		http.Redirect(w, r, "/supervisors?error=Failed+to+create+assignment", http.StatusSeeOther)
+	if err := db.Create(&assignment).Error; err != nil {
+		redirectWithError(w, r, "/supervisors", "Failed to create assignment")
 		return
 	}
 
-	http.Redirect(w, r, "/supervisors?success=Team+assigned+to+supervisor+successfully", http.StatusSeeOther)
+	redirectWithSuccess(w, r, "/supervisors", "Team assigned to supervisor successfully")
 }
 
 // RemoveSupervisorAssignment removes a supervisor's team assignment
@@ -131,28 +143,31 @@ func (h *SupervisorHandler) RemoveSupervisorAssignment(w http.ResponseWriter, r
 	}
 
 	if err := r.ParseForm(); err != nil {
-		http.Redirect(w, r, "/supervisors?error=Invalid+form+data", http.StatusSeeOther)
+		redirectWithError(w, r, "/supervisors", "Invalid form data")
 		return
 	}
 
 	idStr := r.FormValue("id")
 	id, err := strconv.ParseUint(idStr, 10, 32)
 	if err != nil {
-		http.Redirect(w, r, "/supervisors?error=Invalid+assignment+ID", http.StatusSeeOther)
+		redirectWithError(w, r, "/supervisors", "Invalid assignment ID")
 		return
 	}
 
-	if err := database.GetDB().Delete(&models.TeamSupervisor{}, id).Error; err != nil {
-		http.Redirect(w, r, "/supervisors?error=Failed+to+remove+assignment", http.StatusSeeOther)
+	db := h.db.WithContext(r.Context())
+	result := db.Where("team_id IN (?)", db.Model(&models.Team{}).Select("id").Where("organization_id = ?", user.OrganizationID)).
+		Delete(&models.TeamSupervisor{}, id)
+	if result.Error != nil || result.RowsAffected == 0 {
+		redirectWithError(w, r, "/supervisors", "Failed to remove assignment")
 		return
 	}
 
-	http.Redirect(w, r, "/supervisors?success=Team+assignment+removed+successfully", http.StatusSeeOther)
+	redirectWithSuccess(w, r, "/supervisors", "Team assignment removed successfully")
 }
 
 // getAuthorizedTeams returns the teams a supervisor is authorized to view
-func (h *SupervisorHandler) getAuthorizedTeams(userID uint) []models.Team {
-	db := database.GetDB()
+func (h *SupervisorHandler) getAuthorizedTeams(ctx context.Context, userID uint) []models.Team {
+	db := h.db.WithContext(ctx)
 
 	var assignments []models.TeamSupervisor
 	db.Preload("Team").Where("user_id = ?", userID).Find(&assignments)
@@ -168,8 +183,8 @@ func (h *SupervisorHandler) getAuthorizedTeams(userID uint) []models.Team {
 }
 
 // getAuthorizedTeamIDs returns the team IDs a supervisor is authorized to view
-func (h *SupervisorHandler) getAuthorizedTeamIDs(userID uint) []uint {
-	db := database.GetDB()
+func (h *SupervisorHandler) getAuthorizedTeamIDs(ctx context.Context, userID uint) []uint {
+	db := h.db.WithContext(ctx)
 
 	var assignments []models.TeamSupervisor
 	db.Where("user_id = ?", userID).Find(&assignments)
@@ -190,29 +205,28 @@ func (h *SupervisorHandler) SupervisorDashboard(w http.ResponseWriter, r *http.R
 		return
 	}
 
+	db := h.db.WithContext(r.Context())
+
 	// Reload user with project
-	db := database.GetDB()
 	db.Preload("Project").First(user, user.ID)
 
-	if user.ProjectID == nil {
+	if len(user.ProjectIDs()) == 0 {
 		data := map[string]interface{}{
-			"User":  user,
 			"Error": "You are not assigned to a project. Please contact an administrator.",
 		}
-		h.templates["supervisor-dashboard"].ExecuteTemplate(w, "base", data)
+		render(w, r, h.templates, "supervisor-dashboard", data)
 		return
 	}
 
 	// Get supervisor's authorized teams
-	teams := h.getAuthorizedTeams(user.ID)
+	teams := h.getAuthorizedTeams(r.Context(), user.ID)
 
 	if len(teams) == 0 {
 		data := map[string]interface{}{
-			"User":    user,
-			"Project": user.Project,
-			"Error":   "You are not assigned to supervise any teams. Please contact an administrator.",
+			"Projects": userProjects(db, user),
+			"Error":    "You are not assigned to supervise any teams. Please contact an administrator.",
 		}
-		h.templates["supervisor-dashboard"].ExecuteTemplate(w, "base", data)
+		render(w, r, h.templates, "supervisor-dashboard", data)
 		return
 	}
 
@@ -222,7 +236,7 @@ func (h *SupervisorHandler) SupervisorDashboard(w http.ResponseWriter, r *http.R
 	yearStr := r.URL.Query().Get("year")
 
 	// Get authorized team IDs
-	authorizedTeamIDs := h.getAuthorizedTeamIDs(user.ID)
+	authorizedTeamIDs := h.getAuthorizedTeamIDs(r.Context(), user.ID)
 
 	var selectedTeamID uint
 	if teamIDStr != "" {
@@ -238,19 +252,16 @@ func (h *SupervisorHandler) SupervisorDashboard(w http.ResponseWriter, r *http.R
 	}
 
 	// Build query for entries
-	var entries []models.OvertimeEntry
-	var totalHours float64
-	userHours := make(map[string]float64)
-
-	query := db.Preload("User").Preload("User.Team").Preload("User.Project").
+	query := db.Model(&models.OvertimeEntry{}).
 		Joins("JOIN users ON users.id = overtime_entries.user_id").
-		Where("users.project_id = ?", *user.ProjectID)
+		Scopes(inOrganization(user.OrganizationID)).
+		Where("overtime_entries.project_id IN ?", user.ProjectIDs())
 
 	// Filter by team(s)
 	if selectedTeamID > 0 {
-		query = query.Where("users.team_id = ?", selectedTeamID)
+		query = query.Scopes(inEntryTeams(selectedTeamID))
 	} else {
-		query = query.Where("users.team_id IN ?", authorizedTeamIDs)
+		query = query.Scopes(inEntryTeams(authorizedTeamIDs...))
 	}
 
 	// Apply month/year filter
@@ -267,49 +278,51 @@ func (h *SupervisorHandler) SupervisorDashboard(w http.ResponseWriter, r *http.R
 		}
 	}
 
-	// Apply date filters
-	if selectedMonth > 0 && selectedYear > 0 {
-		startDate := time.Date(selectedYear, time.Month(selectedMonth), 1, 0, 0, 0, 0, time.UTC)
-		endDate := startDate.AddDate(0, 1, 0)
-		query = query.Where("overtime_entries.date >= ? AND overtime_entries.date < ?", startDate, endDate)
-	} else if selectedMonth > 0 {
-		query = query.Where("EXTRACT(MONTH FROM overtime_entries.date) = ?", selectedMonth)
-	} else if selectedYear > 0 {
-		startDate := time.Date(selectedYear, 1, 1, 0, 0, 0, 0, time.UTC)
-		endDate := startDate.AddDate(1, 0, 0)
-		query = query.Where("overtime_entries.date >= ? AND overtime_entries.date < ?", startDate, endDate)
-	}
+	// Apply date filters, a week or custom range replaces the month and year
+	selectedRange := parseDateRange(r, user.Location())
+	query = entryPeriod(db, query, user.OrganizationID, selectedMonth, selectedYear, selectedRange, user.Location()).Session(&gorm.Session{})
 
-	query.Order("overtime_entries.date desc").Find(&entries)
+	var entries []models.OvertimeEntry
+	query.Preload("User").Preload("User.Team").Preload("Project").Preload("Creator").
+		Order("overtime_entries.date desc").Find(&entries)
+	applyEntryTeams(db, entries)
 
-	// Calculate totals
-	for _, entry := range entries {
-		userHours[entry.User.DisplayName()] += entry.Hours
-		totalHours += entry.Hours
+	// Calculate totals, per team instead of per employee for reports limited
+	// to aggregates
+	userHours, totalHours := hoursByUser(db, query)
+	employees := len(userHours)
+	minGroup := reportMinGroup(loadAppSettings(db, h.config, user.OrganizationID), user, nil)
+	var groups []groupTotal
+	if minGroup > 0 {
+		groups = groupTotals(entries, minGroup)
+		userHours = nil
 	}
 
 	// Generate years for dropdown
-	currentYear := time.Now().Year()
+	currentYear := user.Now().Year()
 	years := make([]int, 5)
 	for i := 0; i < 5; i++ {
 		years[i] = currentYear - i
 	}
 
 	data := map[string]interface{}{
-		"User":           user,
-		"Project":        user.Project,
-		"Teams":          teams,
-		"SelectedTeamID": selectedTeamID,
-		"Entries":        entries,
-		"UserHours":      userHours,
-		"TotalHours":     totalHours,
-		"SelectedMonth":  selectedMonth,
-		"SelectedYear":   selectedYear,
-		"Years":          years,
-		"Error":          r.URL.Query().Get("error"),
-		"Success":        r.URL.Query().Get("success"),
-	}
-	h.templates["supervisor-dashboard"].ExecuteTemplate(w, "base", data)
+		"Projects":          userProjects(db, user),
+		"Teams":             teams,
+		"SelectedTeamID":    selectedTeamID,
+		"Entries":           entries,
+		"UserHours":         userHours,
+		"Employees":         employees,
+		"Groups":            groups,
+		"Aggregated":        minGroup > 0,
+		"MinGroupEmployees": minGroup,
+		"TotalHours":        totalHours,
+		"SelectedMonth":     selectedMonth,
+		"SelectedYear":      selectedYear,
+		"SelectedRange":     selectedRange,
+		"Years":             years,
+		"NewApprovals":      newApprovalCount(db, user),
+	}
+	render(w, r, h.templates, "supervisor-dashboard", data)
 }
 
 // SupervisorExportPage shows the export page for supervisors
@@ -320,47 +333,46 @@ func (h *SupervisorHandler) SupervisorExportPage(w http.ResponseWriter, r *http.
 		return
 	}
 
+	db := h.db.WithContext(r.Context())
+
 	// Reload user with project
-	db := database.GetDB()
 	db.Preload("Project").First(user, user.ID)
 
-	if user.ProjectID == nil {
+	if len(user.ProjectIDs()) == 0 {
 		data := map[string]interface{}{
-			"User":  user,
 			"Error": "You are not assigned to a project.",
 		}
-		h.templates["supervisor-export"].ExecuteTemplate(w, "base", data)
+		render(w, r, h.templates, "supervisor-export", data)
 		return
 	}
 
 	// Get supervisor's authorized teams
-	teams := h.getAuthorizedTeams(user.ID)
+	teams := h.getAuthorizedTeams(r.Context(), user.ID)
 
 	if len(teams) == 0 {
 		data := map[string]interface{}{
-			"User":    user,
-			"Project": user.Project,
-			"Error":   "You are not assigned to supervise any teams.",
+			"Projects": userProjects(db, user),
+			"Error":    "You are not assigned to supervise any teams.",
 		}
-		h.templates["supervisor-export"].ExecuteTemplate(w, "base", data)
+		render(w, r, h.templates, "supervisor-export", data)
 		return
 	}
 
-	currentYear := time.Now().Year()
+	currentYear := user.Now().Year()
 	years := make([]int, 5)
 	for i := 0; i < 5; i++ {
 		years[i] = currentYear - i
 	}
 
 	data := map[string]interface{}{
-		"User":         user,
-		"Project":      user.Project,
+		"Projects":     userProjects(db, user),
 		"Teams":        teams,
 		"Years":        years,
-		"CurrentMonth": int(time.Now().Month()),
+		"CurrentMonth": int(user.Now().Month()),
 		"CurrentYear":  currentYear,
+		"ExportFormat": loadAppSettings(db, h.config, user.OrganizationID).ExportFormat,
 	}
-	h.templates["supervisor-export"].ExecuteTemplate(w, "base", data)
+	render(w, r, h.templates, "supervisor-export", data)
 }
 
 // SupervisorExportCSV exports overtime data for supervisor's assigned teams
@@ -371,11 +383,12 @@ func (h *SupervisorHandler) SupervisorExportCSV(w http.ResponseWriter, r *http.R
 		return
 	}
 
+	db := h.db.WithContext(r.Context())
+
 	// Reload user with project
-	db := database.GetDB()
 	db.Preload("Project").First(user, user.ID)
 
-	if user.ProjectID == nil {
+	if len(user.ProjectIDs()) == 0 {
 		http.Error(w, "No project assigned", http.StatusForbidden)
 		return
 	}
@@ -383,6 +396,8 @@ func (h *SupervisorHandler) SupervisorExportCSV(w http.ResponseWriter, r *http.R
 	teamIDStr := r.URL.Query().Get("team_id")
 	monthStr := r.URL.Query().Get("month")
 	yearStr := r.URL.Query().Get("year")
+	app := loadAppSettings(db, h.config, user.OrganizationID)
+	format := parseExportFormat(r.URL.Query().Get("format"), app.ExportFormat)
 
 	month, err := strconv.Atoi(monthStr)
 	if err != nil || month < 1 || month > 12 {
@@ -397,7 +412,7 @@ func (h *SupervisorHandler) SupervisorExportCSV(w http.ResponseWriter, r *http.R
 	}
 
 	// Get authorized team IDs
-	authorizedTeamIDs := h.getAuthorizedTeamIDs(user.ID)
+	authorizedTeamIDs := h.getAuthorizedTeamIDs(r.Context(), user.ID)
 	if len(authorizedTeamIDs) == 0 {
 		http.Error(w, "No teams assigned", http.StatusForbidden)
 		return
@@ -416,61 +431,228 @@ func (h *SupervisorHandler) SupervisorExportCSV(w http.ResponseWriter, r *http.R
 		}
 	}
 
-	startDate := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	startDate := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, user.Location())
 	endDate := startDate.AddDate(0, 1, 0)
 
-	query := db.Preload("User").Preload("User.Team").Preload("User.Project").
+	query := db.Preload("User").Preload("User.Team").Preload("Project").
+		Preload("User.CostCenter").Preload("User.Team.CostCenter").
 		Joins("JOIN users ON users.id = overtime_entries.user_id").
-		Where("users.project_id = ?", *user.ProjectID)
+		Scopes(inOrganization(user.OrganizationID)).
+		Where("overtime_entries.project_id IN ?", user.ProjectIDs())
 
 	// Filter by team(s)
 	if selectedTeamID > 0 {
-		query = query.Where("users.team_id = ?", selectedTeamID)
+		query = query.Scopes(inEntryTeams(selectedTeamID))
 	} else {
-		query = query.Where("users.team_id IN ?", authorizedTeamIDs)
+		query = query.Scopes(inEntryTeams(authorizedTeamIDs...))
 	}
 
 	var entries []models.OvertimeEntry
 	query.Where("overtime_entries.date >= ? AND overtime_entries.date < ?", startDate, endDate).
 		Order("overtime_entries.date asc, overtime_entries.user_id asc").
 		Find(&entries)
+	applyEntryTeams(db, entries)
 
 	// Build filename
+	project := "all-projects"
+	if user.Project != nil && len(user.ProjectIDs()) == 1 {
+		project = user.Project.Name
+	}
 	var filename string
 	if selectedTeamID > 0 {
 		var team models.Team
-		db.First(&team, selectedTeamID)
-		filename = fmt.Sprintf("overtime_%s_%s_%d_%02d.csv", team.Name, user.Project.Name, year, month)
+		if err := db.Scopes(inOrganization(user.OrganizationID)).First(&team, selectedTeamID).Error; err != nil {
+			http.Error(w, "Team not found", http.StatusNotFound)
+			return
+		}
+		filename = fmt.Sprintf("overtime_%s_%s_%d_%02d.csv", team.Name, project, year, month)
 	} else {
-		filename = fmt.Sprintf("overtime_all-teams_%s_%d_%02d.csv", user.Project.Name, year, month)
+		filename = fmt.Sprintf("overtime_all-teams_%s_%d_%02d.csv", project, year, month)
+	}
+
+	// The summary lists every member, also those without entries in the month
+	entryUserIDs := make([]uint, 0, len(entries))
+	for _, entry := range entries {
+		entryUserIDs = append(entryUserIDs, entry.UserID)
+	}
+	members := db.Scopes(inOrganization(user.OrganizationID), onProjects(user.ProjectIDs()))
+	if selectedTeamID > 0 {
+		members = members.Where("team_id = ?", selectedTeamID)
+	} else {
+		members = members.Where("team_id IN ?", authorizedTeamIDs)
+	}
+	var users []models.User
+	members.Where("deactivated_at IS NULL OR id IN ?", entryUserIDs).Order("full_name asc, username asc").Find(&users)
+
+	pseudonyms := worksCouncilView(db, h.config, user)
+	pseudonyms.applyEntries(entries)
+	pseudonyms.applyUsers(users)
+
+	var buf bytes.Buffer
+	writeSupervisorExport(&buf, entries, balanceSummaries(db, users, entries, startDate, endDate), entryExport{format: format, night: app.Night})
+
+	err = archiveExport(db, h.config, models.ExportArchive{
+		OrganizationID: user.OrganizationID,
+		Month:          fmt.Sprintf("%d-%02d", year, month),
+		Filename:       filename,
+		Format:         format,
+		Generator:      "supervisor download by " + user.DisplayName(),
+		Filters:        exportFilters(r, "team_id"),
+	}, buf.Bytes())
+	if err != nil {
+		http.Error(w, "Failed to archive the export", http.StatusInternalServerError)
+		return
+	}
+	err = logExport(db, r, user, models.ExportLog{
+		Kind:          models.ExportSupervisor,
+		Filename:      filename,
+		Format:        format,
+		Filters:       exportFilters(r, "month", "year", "team_id"),
+		Rows:          exportRows(len(entries)),
+		Pseudonymized: pseudonyms != nil,
+	})
+	if err != nil {
+		http.Error(w, "Failed to log the export", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "text/csv")
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	w.Write(buf.Bytes())
+}
 
-	writer := csv.NewWriter(w)
-	defer writer.Flush()
+// balanceSummary is a member's line in the summary of the supervisor
+// export. Balances are approved overtime less the time off taken or
+// requested, changed by compensations, like the time off balance.
+type balanceSummary struct {
+	User         models.User
+	Opening      float64
+	Approved     float64
+	Pending      float64
+	Rejected     float64
+	TimeOff      float64
+	Compensation float64
+	Closing      float64
+}
 
-	// Write header
-	writer.Write([]string{"Employee", "Team", "Project", "Date", "Hours", "Description"})
+// balanceSummaries sums up the month from start to end for each user, the
+// entries of the month must be given
+func balanceSummaries(db *gorm.DB, users []models.User, entries []models.OvertimeEntry, start, end time.Time) []balanceSummary {
+	summaries := make([]balanceSummary, len(users))
+	byUser := make(map[uint]*balanceSummary, len(users))
+	userIDs := make([]uint, len(users))
+	for i := range users {
+		summaries[i].User = users[i]
+		byUser[users[i].ID] = &summaries[i]
+		userIDs[i] = users[i].ID
+	}
+	if len(users) == 0 {
+		return summaries
+	}
 
-	// Write data
 	for _, entry := range entries {
-		teamName := ""
-		projectName := ""
-		if entry.User.Team != nil {
-			teamName = entry.User.Team.Name
+		summary, ok := byUser[entry.UserID]
+		if !ok {
+			continue
 		}
-		if entry.User.Project != nil {
-			projectName = entry.User.Project.Name
+		switch entry.Status {
+		case models.StatusApproved:
+			summary.Approved += entry.Hours
+		case models.StatusPending:
+			summary.Pending += entry.Hours
+		case models.StatusRejected:
+			summary.Rejected += entry.Hours
 		}
+	}
+
+	type sum struct {
+		UserID uint
+		Hours  float64
+	}
+	timeOffStatuses := []models.EntryStatus{models.StatusApproved, models.StatusPending}
+	var overtimeBefore, timeOffBefore, timeOffDuring, compensationBefore, compensationDuring []sum
+	db.Model(&models.OvertimeEntry{}).
+		Where("user_id IN ? AND status = ? AND date < ?", userIDs, models.StatusApproved, start).
+		Select("user_id, SUM(hours) AS hours").Group("user_id").Scan(&overtimeBefore)
+	db.Model(&models.TimeOffRequest{}).
+		Where("user_id IN ? AND status IN ? AND date < ?", userIDs, timeOffStatuses, start).
+		Select("user_id, SUM(hours) AS hours").Group("user_id").Scan(&timeOffBefore)
+	db.Model(&models.TimeOffRequest{}).
+		Where("user_id IN ? AND status IN ? AND date >= ? AND date < ?", userIDs, timeOffStatuses, start, end).
+		Select("user_id, SUM(hours) AS hours").Group("user_id").Scan(&timeOffDuring)
+	db.Model(&models.Compensation{}).
+		Where("user_id IN ? AND date < ?", userIDs, start).
+		Select("user_id, SUM(hours) AS hours").Group("user_id").Scan(&compensationBefore)
+	db.Model(&models.Compensation{}).
+		Where("user_id IN ? AND date >= ? AND date < ?", userIDs, start, end).
+		Select("user_id, SUM(hours) AS hours").Group("user_id").Scan(&compensationDuring)
+	for _, s := range overtimeBefore {
+		byUser[s.UserID].Opening += s.Hours
+	}
+	for _, s := range timeOffBefore {
+		byUser[s.UserID].Opening -= s.Hours
+	}
+	for _, s := range timeOffDuring {
+		byUser[s.UserID].TimeOff = s.Hours
+	}
+	for _, s := range compensationBefore {
+		byUser[s.UserID].Opening += s.Hours
+	}
+	for _, s := range compensationDuring {
+		byUser[s.UserID].Compensation = s.Hours
+	}
+
+	for i := range summaries {
+		summaries[i].Closing = summaries[i].Opening + summaries[i].Approved - summaries[i].TimeOff + summaries[i].Compensation
+	}
+	return summaries
+}
+
+// writeSupervisorExport writes the entries with their approval status,
+// followed by a summary of each member's hours and balance
+func writeSupervisorExport(w io.Writer, entries []models.OvertimeEntry, summaries []balanceSummary, export entryExport) error {
+	format := export.format
+	writer := newExportWriter(w, format)
+	writer.Write(append(export.header(), "Status"))
+	for _, entry := range entries {
+		writer.Write(append(export.record(&entry), string(entry.Status)))
+	}
+
+	writer.Write([]string{})
+	writer.Write([]string{"Summary"})
+	writer.Write([]string{"Employee", "Employee number", "Opening balance", "Approved", "Pending", "Rejected", "Time off", "Compensation", "Closing balance"})
+	var total balanceSummary
+	for _, summary := range summaries {
 		writer.Write([]string{
-			entry.User.DisplayName(),
-			teamName,
-			projectName,
-			entry.Date.Format("2006-01-02"),
-			fmt.Sprintf("%.2f", entry.Hours),
-			entry.Description,
+			summary.User.DisplayName(),
+			identifierValue(summary.User.EmployeeNumber),
+			formatExportNumber(summary.Opening, format),
+			formatExportNumber(summary.Approved, format),
+			formatExportNumber(summary.Pending, format),
+			formatExportNumber(summary.Rejected, format),
+			formatExportNumber(summary.TimeOff, format),
+			formatExportNumber(summary.Compensation, format),
+			formatExportNumber(summary.Closing, format),
 		})
-	}
+		total.Opening += summary.Opening
+		total.Approved += summary.Approved
+		total.Pending += summary.Pending
+		total.Rejected += summary.Rejected
+		total.TimeOff += summary.TimeOff
+		total.Compensation += summary.Compensation
+		total.Closing += summary.Closing
+	}
+	writer.Write([]string{
+		"Total",
+		"",
+		formatExportNumber(total.Opening, format),
+		formatExportNumber(total.Approved, format),
+		formatExportNumber(total.Pending, format),
+		formatExportNumber(total.Rejected, format),
+		formatExportNumber(total.TimeOff, format),
+		formatExportNumber(total.Compensation, format),
+		formatExportNumber(total.Closing, format),
+	})
+	writer.Flush()
+	return writer.Error()
 }
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"overtime/middleware"
+	"overtime/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSyncEntries limits how many queued entries one sync request may carry
+const maxSyncEntries = 100
+
+// syncEntry is an overtime entry the offline app recorded without a connection
+type syncEntry struct {
+	ClientID    string  `json:"client_id" doc:"Unique ID generated by the client, used to skip entries that were already synced"`
+	Date        string  `json:"date" doc:"Day the overtime was worked, as YYYY-MM-DD in the user's timezone"`
+	Hours       float64 `json:"hours,omitempty" doc:"Overtime hours, more than 0 and at most 24. Ignored when worked_hours is set."`
+	Description string  `json:"description"`
+	// WorkedHours comes from the entry form of organizations that calculate
+	// overtime from worked time
+	WorkedHours    *float64 `json:"worked_hours,omitempty" doc:"Hours worked that day; the overtime is what exceeds a regular day of the user's contract"`
+	StartTime      *string  `json:"start_time,omitempty" doc:"When the overtime started, as HH:MM; requires end_time"`
+	EndTime        *string  `json:"end_time,omitempty" doc:"When the overtime ended, as HH:MM; at or before the start means the next day"`
+	Acknowledgment string   `json:"acknowledgment,omitempty" doc:"Note on an entry past the soft limit per month, like who agreed to the hours; required past the limit"`
+}
+
+// syncResult tells the offline app what happened to one queued entry. Entries
+// with an error were refused and should not be sent again.
+type syncResult struct {
+	ClientID string `json:"client_id"`
+	ID       uint   `json:"id,omitempty" doc:"ID of the stored entry"`
+	Error    string `json:"error,omitempty" doc:"Why the entry was refused; refused entries should not be sent again"`
+}
+
+type syncRequest struct {
+	Entries []syncEntry `json:"entries"`
+}
+
+type syncResponse struct {
+	Results []syncResult `json:"results" doc:"One result per submitted entry, in request order"`
+}
+
+// SyncEntries stores the entries queued by the offline app for the current
+// user. Sending the same entry twice is harmless: entries are matched by their
+// client ID and reported with the ID they were stored under.
+func (h *OvertimeHandler) SyncEntries(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+
+	var request syncRequest
+	if !decodeJSON(w, r, &request) {
+		return
+	}
+
+	if len(request.Entries) > maxSyncEntries {
+		http.Error(w, "Too many entries, at most "+strconv.Itoa(maxSyncEntries)+" per request", http.StatusBadRequest)
+		return
+	}
+
+	response := syncResponse{Results: make([]syncResult, 0, len(request.Entries))}
+	for _, item := range request.Entries {
+		response.Results = append(response.Results, h.syncEntry(r.Context(), user, item))
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *OvertimeHandler) syncEntry(ctx context.Context, user *models.User, item syncEntry) syncResult {
+	result := syncResult{ClientID: item.ClientID}
+
+	if item.ClientID == "" || len(item.ClientID) > 64 {
+		result.Error = "Invalid client ID"
+		return result
+	}
+
+	db := h.db.WithContext(ctx)
+
+	// Deleted entries count as synced, otherwise the app would resend them forever
+	var existing models.OvertimeEntry
+	if err := db.Unscoped().Where("client_id = ?", item.ClientID).First(&existing).Error; err == nil {
+		if existing.UserID != user.ID {
+			result.Error = "Client ID already in use"
+			return result
+		}
+		result.ID = existing.ID
+		return result
+	}
+
+	date, err := time.ParseInLocation("2006-01-02", item.Date, user.Location())
+	if err != nil {
+		result.Error = models.ErrInvalidDate.Error()
+		return result
+	}
+
+	clientID := item.ClientID
+	entry := models.OvertimeEntry{
+		UserID:         user.ID,
+		User:           *user,
+		Date:           date,
+		Hours:          item.Hours,
+		Description:    item.Description,
+		CreatedBy:      &user.ID,
+		UpdatedBy:      &user.ID,
+		ClientID:       &clientID,
+		WorkedHours:    item.WorkedHours,
+		StartTime:      item.StartTime,
+		EndTime:        item.EndTime,
+		Acknowledgment: strings.TrimSpace(item.Acknowledgment),
+	}
+
+	if err := recordEntry(ctx, h.store, h.config, h.mailer, &entry, false); err != nil {
+		result.Error = entryErrorMessage(err, "Failed to create entry")
+		return result
+	}
+
+	result.ID = entry.ID
+	return result
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"overtime/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// teamOnDateSQL is the team a user was in on a date, for queries on a table
+// with user_id and date columns joined with the users: the membership in
+// effect then, see models.TeamOn, or the current team of users whose team
+// never changed
+const teamOnDateSQL = `CASE WHEN EXISTS (SELECT 1 FROM team_memberships tm WHERE tm.user_id = $table.user_id)
+	THEN (SELECT tm.team_id FROM team_memberships tm WHERE tm.user_id = $table.user_id
+		ORDER BY tm.valid_from <= $table.date DESC,
+			CASE WHEN tm.valid_from <= $table.date THEN tm.valid_from END DESC,
+			tm.valid_from ASC
+		LIMIT 1)
+	ELSE users.team_id END`
+
+// entryTeamSQL is the team an entry's user was in on the entry's date
+var entryTeamSQL = strings.ReplaceAll(teamOnDateSQL, "$table", "overtime_entries")
+
+// timeOffTeamSQL is the team a requester was in on the day they asked off
+var timeOffTeamSQL = strings.ReplaceAll(teamOnDateSQL, "$table", "time_off_requests")
+
+// inEntryTeams restricts a query on entries joined with their users to the
+// entries logged while the user was in one of the teams
+func inEntryTeams(teamIDs ...uint) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("("+entryTeamSQL+") IN ?", teamIDs)
+	}
+}
+
+// inTimeOffTeams restricts a query on time off requests joined with their
+// users to the requests for days the user was in one of the teams
+func inTimeOffTeams(teamIDs ...uint) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("("+timeOffTeamSQL+") IN ?", teamIDs)
+	}
+}
+
+// applyEntryTeams sets the team of every entry's user to the team they were
+// in on the entry's date, for reports and exports. The teams' cost centers
+// are loaded with them.
+func applyEntryTeams(db *gorm.DB, entries []models.OvertimeEntry) {
+	seen := make(map[uint]bool)
+	var userIDs []uint
+	for i := range entries {
+		if !seen[entries[i].UserID] {
+			seen[entries[i].UserID] = true
+			userIDs = append(userIDs, entries[i].UserID)
+		}
+	}
+	if len(userIDs) == 0 {
+		return
+	}
+
+	var memberships []models.TeamMembership
+	db.Preload("Team.CostCenter").Where("user_id IN ?", userIDs).Find(&memberships)
+	byUser := make(map[uint][]models.TeamMembership)
+	for _, m := range memberships {
+		byUser[m.UserID] = append(byUser[m.UserID], m)
+	}
+
+	for i := range entries {
+		if m := models.TeamOn(byUser[entries[i].UserID], entries[i].Date); m != nil {
+			entries[i].User.TeamID = m.TeamID
+			entries[i].User.Team = m.Team
+		}
+	}
+}
+
+// sameID reports whether two optional IDs are equal
+func sameID(a, b *uint) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// teamHistory returns a user's team memberships, latest first
+func teamHistory(db *gorm.DB, userID uint) []models.TeamMembership {
+	var memberships []models.TeamMembership
+	db.Preload("Team").Where("user_id = ?", userID).Order("valid_from desc").Find(&memberships)
+	return memberships
+}
+
+// errTeamChangeBefore refuses a team change effective before the last
+// recorded one, the user's current team would no longer be the latest
+var errTeamChangeBefore = errors.New("The team change must not be effective before the last one")
+
+// recordTeamChange remembers that user moved from the team previous to their
+// current team on the day from. The first change also records the previous
+// team, from the day the user was created.
+func recordTeamChange(tx *gorm.DB, user *models.User, previous *uint, from time.Time) error {
+	var last models.TeamMembership
+	if err := tx.Where("user_id = ?", user.ID).Order("valid_from desc").Limit(1).Find(&last).Error; err != nil {
+		return err
+	}
+	if last.ID != 0 && last.ValidFrom.Format("2006-01-02") > from.Format("2006-01-02") {
+		return errTeamChangeBefore
+	}
+
+	created := time.Date(user.CreatedAt.Year(), user.CreatedAt.Month(), user.CreatedAt.Day(), 0, 0, 0, 0, time.UTC)
+	if last.ID == 0 && created.Before(from) {
+		first := models.TeamMembership{
+			OrganizationID: user.OrganizationID,
+			UserID:         user.ID,
+			ValidFrom:      created,
+			TeamID:         previous,
+		}
+		if err := tx.Create(&first).Error; err != nil {
+			return err
+		}
+	}
+
+	membership := models.TeamMembership{
+		OrganizationID: user.OrganizationID,
+		UserID:         user.ID,
+		ValidFrom:      from,
+		TeamID:         user.TeamID,
+	}
+	// A second change on the same day replaces the first
+	err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "valid_from"}},
+		DoUpdates: clause.AssignmentColumns([]string{"team_id"}),
+	}).Create(&membership).Error
+	if err != nil {
+		return err
+	}
+
+	// Entries since the change were logged in the new team, also those
+	// logged before it was recorded
+	teamName := ""
+	if user.TeamID != nil {
+		var team models.Team
+		if err := tx.First(&team, *user.TeamID).Error; err != nil {
+			return err
+		}
+		teamName = team.Name
+	}
+	return tx.Unscoped().Model(&models.OvertimeEntry{}).Where("user_id = ? AND date >= ?", user.ID, from).
+		Update("team_name", teamName).Error
+}
+
+// TeamChangeRecorder returns recordTeamChange for the HR system sync, so the
+// team changes it makes show in the team history
+func TeamChangeRecorder() func(tx *gorm.DB, user *models.User, previous *uint, from time.Time) error {
+	return recordTeamChange
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"overtime/middleware"
+	"overtime/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// telegramLinkExpiration is how long a Telegram link code can be sent to the
+// bot
+const telegramLinkExpiration = 15 * time.Minute
+
+// LinkTelegram shows a one-time code on the profile page. Sending it to the
+// bot from a private chat links that chat to the account, which proves the
+// user owns it.
+func (h *AuthHandler) LinkTelegram(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if h.config.TelegramBotToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	code, err := models.GenerateTelegramLinkCode()
+	if err != nil {
+		log.Printf("Failed to generate Telegram link code for user %d: %v", user.ID, err)
+		redirectWithError(w, r, "/profile", "Failed to create a link code")
+		return
+	}
+	record := models.LoginToken{
+		Code:      code,
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(telegramLinkExpiration),
+		Purpose:   models.LoginTokenLinkTelegram,
+	}
+
+	// Only the latest code works
+	db := h.db.WithContext(r.Context())
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ? AND purpose = ? AND used_at IS NULL", user.ID, models.LoginTokenLinkTelegram).
+			Delete(&models.LoginToken{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&record).Error
+	})
+	if err != nil {
+		redirectWithError(w, r, "/profile", "Failed to create a link code")
+		return
+	}
+
+	data := h.profileData()
+	data["TelegramCode"] = code
+	data["TelegramCodeExpires"] = record.ExpiresAt.In(user.Location())
+	render(w, r, h.templates, "profile", data)
+}
+
+// UnlinkTelegram removes the link to the user's Telegram chat
+func (h *AuthHandler) UnlinkTelegram(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+
+	if err := h.db.WithContext(r.Context()).Model(user).Update("telegram_chat_id", nil).Error; err != nil {
+		redirectWithError(w, r, "/profile", "Failed to unlink Telegram")
+		return
+	}
+	redirectWithSuccess(w, r, "/profile", "Telegram chat unlinked")
+}
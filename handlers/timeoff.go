@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"overtime/config"
+	"overtime/mailer"
+	"overtime/middleware"
+	"overtime/models"
+	"overtime/services"
+
+	"gorm.io/gorm"
+)
+
+// reviewableTimeOff scopes a query to the pending time off requests the
+// reviewer may decide on. Time off is approved like the supervisor stage of
+// an entry, by the supervisors of the team the requester was in on the day,
+// there is no HR stage.
+func reviewableTimeOff(db *gorm.DB, reviewer *models.User) *gorm.DB {
+	query := db.Model(&models.TimeOffRequest{}).
+		Joins("JOIN users ON users.id = time_off_requests.user_id").
+		Scopes(inOrganization(reviewer.OrganizationID)).
+		Where("time_off_requests.status = ?", models.StatusPending)
+
+	switch {
+	case reviewer.IsAdmin():
+		return query
+	case reviewer.IsSupervisor() && len(reviewer.ProjectIDs()) > 0:
+		return query.Scopes(onProjects(reviewer.ProjectIDs()), inTimeOffTeams(reviewer.SupervisedTeamIDs()...)).
+			Where("users.id <> ?", reviewer.ID)
+	default:
+		return query.Where("1 = 0")
+	}
+}
+
+// notifyTimeOffDecision tells the requester whether their time off was
+// approved. request.User must be set.
+func notifyTimeOffDecision(cfg *config.Config, mail *mailer.Mailer, request models.TimeOffRequest, reviewer *models.User) {
+	if request.User.Email == "" {
+		return
+	}
+
+	decision := "approved"
+	if request.Status == models.StatusRejected {
+		decision = "rejected"
+	}
+	subject := fmt.Sprintf("Time off %s: %s", decision, request.Date.Format("2006-01-02"))
+	body := fmt.Sprintf(`Your time off request was %s by %s.
+
+Date:    %s
+Hours:   %.2f
+Comment: %s
+
+Your requests and balance: %s/time-off
+`,
+		decision,
+		reviewer.DisplayName(),
+		request.Date.Format("2006-01-02"),
+		request.Hours,
+		request.ReviewComment,
+		cfg.BaseURL,
+	)
+
+	if err := mail.Send([]string{request.User.Email}, subject, body); err != nil {
+		log.Printf("Failed to email decision on time off request %d to %s: %v", request.ID, request.User.Email, err)
+	}
+}
+
+// TimeOffPage shows the user's overtime balance, their time off and payout
+// requests and the compensations that changed the balance
+func (h *ApprovalHandler) TimeOffPage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	db := h.db.WithContext(r.Context())
+
+	balance, _ := services.TimeOffBalance(db, user.ID)
+
+	var requests []models.TimeOffRequest
+	db.Preload("Reviewer").Where("user_id = ?", user.ID).Order("date desc").Find(&requests)
+
+	var payouts []models.PayoutRequest
+	db.Preload("Reviewer").Where("user_id = ?", user.ID).Order("created_at desc").Find(&payouts)
+
+	var compensations []models.Compensation
+	db.Preload("Creator").Where("user_id = ?", user.ID).Order("date desc, id desc").Find(&compensations)
+
+	// A full day off takes the hours of a regular working day
+	today := user.Now()
+	contract := models.ContractOn(userContracts(db, user.ID), today)
+
+	data := map[string]interface{}{
+		"Balance":       balance,
+		"Requests":      requests,
+		"Payouts":       payouts,
+		"Compensations": compensations,
+		"Today":         today.Format("2006-01-02"),
+		"DayHours":      contract.DailyHours(),
+	}
+	render(w, r, h.templates, "time-off", data)
+}
+
+// RequestTimeOff asks to take overtime from the user's balance as time off
+func (h *ApprovalHandler) RequestTimeOff(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/time-off", "Invalid form data")
+		return
+	}
+
+	date, err := time.Parse("2006-01-02", r.FormValue("date"))
+	if err != nil {
+		redirectWithError(w, r, "/time-off", "Invalid date")
+		return
+	}
+
+	hours, err := strconv.ParseFloat(strings.TrimSpace(r.FormValue("hours")), 64)
+	if err != nil || hours <= 0 || hours > 24 {
+		redirectWithError(w, r, "/time-off", "Hours must be more than 0 and at most 24")
+		return
+	}
+
+	note := strings.TrimSpace(r.FormValue("note"))
+	if utf8.RuneCountInString(note) > 500 {
+		redirectWithError(w, r, "/time-off", "Note is too long (at most 500 characters)")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	request := models.TimeOffRequest{
+		OrganizationID: user.OrganizationID,
+		UserID:         user.ID,
+		Date:           date,
+		Hours:          hours,
+		Note:           note,
+	}
+	err = services.RequestTimeOff(db, &request)
+	if errors.Is(err, services.ErrInsufficientBalance) {
+		balance, _ := services.TimeOffBalance(db, user.ID)
+		redirectWithError(w, r, "/time-off", fmt.Sprintf("Not enough overtime for this request, %.2fh are available", balance))
+		return
+	}
+	if err != nil {
+		redirectWithError(w, r, "/time-off", "Failed to request time off")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/time-off", "Time off requested, waiting for approval")
+}
+
+// CancelTimeOff withdraws one of the user's pending requests, returning its
+// hours to the balance
+func (h *ApprovalHandler) CancelTimeOff(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/time-off", "Invalid form data")
+		return
+	}
+
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/time-off", "Invalid request ID")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	result := db.Where("id = ? AND user_id = ? AND status = ?", id, user.ID, models.StatusPending).
+		Delete(&models.TimeOffRequest{})
+	if result.Error != nil {
+		redirectWithError(w, r, "/time-off", "Failed to cancel request")
+		return
+	}
+	if result.RowsAffected == 0 {
+		redirectWithError(w, r, "/time-off", "Only pending requests can be cancelled")
+		return
+	}
+
+	redirectWithSuccess(w, r, "/time-off", "Request cancelled")
+}
+
+// ReviewTimeOff approves or rejects a pending time off request. Approved
+// time off is published to the team calendar.
+func (h *ApprovalHandler) ReviewTimeOff(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+
+	if err := r.ParseForm(); err != nil {
+		redirectWithError(w, r, "/approvals", "Invalid form data")
+		return
+	}
+
+	var status models.EntryStatus
+	switch r.FormValue("action") {
+	case "approve":
+		status = models.StatusApproved
+	case "reject":
+		status = models.StatusRejected
+	default:
+		redirectWithError(w, r, "/approvals", "Invalid action")
+		return
+	}
+
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if status == models.StatusRejected && reason == "" {
+		redirectWithError(w, r, "/approvals", "A reason is required to reject time off")
+		return
+	}
+
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		redirectWithError(w, r, "/approvals", "Invalid request ID")
+		return
+	}
+
+	db := h.db.WithContext(r.Context())
+	var request models.TimeOffRequest
+	if err := reviewableTimeOff(db, user).Where("time_off_requests.id = ?", id).First(&request).Error; err != nil {
+		redirectWithError(w, r, "/approvals", "Time off request not found or no longer pending")
+		return
+	}
+	if err := db.First(&request.User, request.UserID).Error; err != nil {
+		redirectWithError(w, r, "/approvals", "Time off request not found or no longer pending")
+		return
+	}
+
+	err = services.ReviewTimeOff(db, &request, user.ID, status, reason)
+	switch {
+	case errors.Is(err, services.ErrNotPending):
+		redirectWithError(w, r, "/approvals", "Time off request not found or no longer pending")
+		return
+	case errors.Is(err, services.ErrInsufficientBalance):
+		redirectWithError(w, r, "/approvals", request.User.DisplayName()+" no longer has enough overtime for this time off")
+		return
+	case err != nil:
+		redirectWithError(w, r, "/approvals", "Failed to record decision")
+		return
+	}
+
+	go notifyTimeOffDecision(h.config, h.mailer, request, user)
+	if status == models.StatusApproved {
+		go h.calendar.SyncTimeOff(request.ID)
+		redirectWithSuccess(w, r, "/approvals", "Time off approved")
+		return
+	}
+	redirectWithSuccess(w, r, "/approvals", "Time off rejected")
+}
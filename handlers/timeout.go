@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+const requestCancelled = "The request took too long and was cancelled. Anything you submitted may not have been saved, please check before trying again."
+
+// RequestCancelled answers requests that middleware.Timeout cancelled. Pages
+// get an error page, htmx, API and JSON requests the plain message.
+func RequestCancelled(templates map[string]*template.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isHTMX(r) || wantsJSON(r) || strings.HasPrefix(r.URL.Path, "/api/") {
+			http.Error(w, requestCancelled, http.StatusServiceUnavailable)
+			return
+		}
+
+		data := map[string]interface{}{
+			"Error": requestCancelled,
+		}
+		// Loading a page again is safe, resubmitting a form may not be
+		if r.Method == http.MethodGet {
+			data["Retry"] = r.URL.RequestURI()
+		}
+		renderStatus(w, r, templates, "timeout", http.StatusServiceUnavailable, data)
+	}
+}
@@ -0,0 +1,16 @@
+package handlers
+
+import (
+	"net/http"
+	"overtime/config"
+	"overtime/middleware"
+)
+
+// baseURL returns the address links shown in the browser should use: BASE_URL
+// when it is configured, otherwise the one the request came in on
+func baseURL(cfg *config.Config, r *http.Request) string {
+	if cfg.DetectBaseURL {
+		return middleware.RequestBaseURL(r)
+	}
+	return cfg.BaseURL
+}
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"overtime/config"
+	"overtime/models"
+
+	"gorm.io/gorm"
+)
+
+// minGroupEmployees is how many employees a team and project needs before
+// its hours are shown to roles limited to aggregates, smaller groups would
+// give individuals away
+const minGroupEmployees = 3
+
+// maxAnalyticsMinGroup caps the group size an organization can require of
+// report figures
+const maxAnalyticsMinGroup = 100
+
+// worksCouncilRoles are the roles an organization can limit to pseudonymous
+// data. Administrators manage the users and always see them.
+var worksCouncilRoles = []models.Role{models.RoleHR, models.RoleSupervisor}
+
+// worksCouncilField names the settings checkbox that limits role
+func worksCouncilField(role models.Role) string {
+	return "works_council_" + strings.ToLower(string(role))
+}
+
+// pseudonymizer replaces the person identifying data of users in the lists
+// and reports shown to roles the organization limits to pseudonymous data,
+// e.g. under a works council agreement. A nil pseudonymizer leaves users as
+// they are.
+type pseudonymizer struct {
+	key []byte
+}
+
+// worksCouncilView returns the pseudonymizer for the data shown to user, nil
+// unless the organization limits their role
+func worksCouncilView(db *gorm.DB, cfg *config.Config, user *models.User) *pseudonymizer {
+	if user.IsAdmin() {
+		return nil
+	}
+	for _, role := range loadAppSettings(db, cfg, user.OrganizationID).WorksCouncilRoles {
+		if user.Role == role {
+			return &pseudonymizer{key: []byte(cfg.JWTSecret)}
+		}
+	}
+	return nil
+}
+
+// reportMinGroup returns how many employees a group needs before the
+// reports shown to user show its figures, zero when they show figures per
+// employee. Roles limited to pseudonymous data see groups of at least
+// minGroupEmployees. Administrators always see employees.
+func reportMinGroup(app appSettings, user *models.User, pseudonyms *pseudonymizer) int {
+	if user.IsAdmin() {
+		return 0
+	}
+	size := app.AnalyticsMinGroup
+	if pseudonyms != nil && size < minGroupEmployees {
+		size = minGroupEmployees
+	}
+	return size
+}
+
+// pseudonym names a user the same way in every list and report, without a
+// way back to the user for anyone who does not know the key
+func (p *pseudonymizer) pseudonym(userID uint) string {
+	mac := hmac.New(sha256.New, p.key)
+	fmt.Fprintf(mac, "pseudonym:%d", userID)
+	return "Employee " + strings.ToUpper(hex.EncodeToString(mac.Sum(nil))[:6])
+}
+
+// apply pseudonymizes a loaded user in place. The user must not be saved
+// afterwards.
+func (p *pseudonymizer) apply(user *models.User) {
+	if p == nil || user == nil {
+		return
+	}
+	name := p.pseudonym(user.ID)
+	user.Username = name
+	user.FullName = name
+	user.Email = ""
+	user.EmployeeNumber = nil
+	user.ExternalID = nil
+	user.AvatarVersion = 0
+}
+
+// applyUsers pseudonymizes loaded users and orders them by pseudonym, an
+// order by name would give them away
+func (p *pseudonymizer) applyUsers(users []models.User) {
+	if p == nil {
+		return
+	}
+	for i := range users {
+		p.apply(&users[i])
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].FullName < users[j].FullName })
+}
+
+// applyEntries pseudonymizes the users of loaded entries
+func (p *pseudonymizer) applyEntries(entries []models.OvertimeEntry) {
+	if p == nil {
+		return
+	}
+	for i := range entries {
+		p.apply(&entries[i].User)
+		p.apply(entries[i].Creator)
+		p.apply(entries[i].Corrector)
+	}
+}
+
+// groupTotal is the overtime of a team's members in a project, which reports
+// limited to aggregates show instead of the employees. Hidden groups have
+// fewer employees than the report requires and show no hours.
+type groupTotal struct {
+	Team      string `json:"team"`
+	Project   string `json:"project"`
+	Employees int    `json:"employees"`
+	// Entries and Hours are zero for hidden groups
+	Entries int     `json:"entries"`
+	Hours   float64 `json:"hours"`
+	Hidden  bool    `json:"hidden"`
+}
+
+// groupTotals sums up the entries per team and project they were logged
+// in. Groups of fewer than minEmployees employees
+// are hidden.
+func groupTotals(entries []models.OvertimeEntry, minEmployees int) []groupTotal {
+	type key struct{ team, project string }
+	totals := make(map[key]*groupTotal)
+	employees := make(map[key]map[uint]bool)
+	for _, entry := range entries {
+		k := key{team: noTeam, project: "No project"}
+		if entry.TeamName != "" {
+			k.team = entry.TeamName
+		}
+		if entry.ProjectName != "" {
+			k.project = entry.ProjectName
+		}
+		total, ok := totals[k]
+		if !ok {
+			total = &groupTotal{Team: k.team, Project: k.project}
+			totals[k] = total
+			employees[k] = make(map[uint]bool)
+		}
+		total.Entries++
+		total.Hours += entry.Hours
+		employees[k][entry.UserID] = true
+	}
+
+	groups := make([]groupTotal, 0, len(totals))
+	for k, total := range totals {
+		total.Employees = len(employees[k])
+		if total.Employees < minEmployees {
+			total.Entries = 0
+			total.Hours = 0
+			total.Hidden = true
+		}
+		groups = append(groups, *total)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Team != groups[j].Team {
+			return teamBefore(groups[i].Team, groups[j].Team)
+		}
+		return groups[i].Project < groups[j].Project
+	})
+	return groups
+}
@@ -0,0 +1,65 @@
+package hris
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"overtime/models"
+)
+
+const bambooHRURL = "https://api.bamboohr.com/api/gateway.php/"
+
+// bambooHRFields are the fields of the employee report the sync requests
+var bambooHRFields = []string{"id", "firstName", "lastName", "workEmail", "department", "status", "standardHoursPerWeek"}
+
+// bambooHREmployees lists the employees of the connection's company through
+// a custom report, which unlike the directory includes inactive employees
+func (s *Syncer) bambooHREmployees(connection *models.HRISConnection) ([]Employee, error) {
+	body, err := json.Marshal(map[string]interface{}{"title": "Overtime user sync", "fields": bambooHRFields})
+	if err != nil {
+		return nil, err
+	}
+	reportURL := bambooHRURL + url.PathEscape(connection.Company) + "/v1/reports/custom?format=JSON&onlyCurrent=true"
+	req, err := http.NewRequest(http.MethodPost, reportURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(connection.Secret, "x")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bamboohr: unexpected status %s", resp.Status)
+	}
+
+	var report struct {
+		Employees []map[string]json.RawMessage `json:"employees"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return nil, fmt.Errorf("bamboohr: decode report: %w", err)
+	}
+
+	employees := make([]Employee, 0, len(report.Employees))
+	for _, fields := range report.Employees {
+		hours, _ := strconv.ParseFloat(text(fields["standardHoursPerWeek"]), 64)
+		employees = append(employees, Employee{
+			ID:          text(fields["id"]),
+			FullName:    strings.TrimSpace(text(fields["firstName"]) + " " + text(fields["lastName"])),
+			Email:       text(fields["workEmail"]),
+			Team:        text(fields["department"]),
+			WeeklyHours: hours,
+			Active:      !strings.EqualFold(text(fields["status"]), "inactive"),
+		})
+	}
+	return employees, nil
+}
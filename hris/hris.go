@@ -0,0 +1,586 @@
+// Package hris syncs the organizations' users from their HR systems,
+// Personio or BambooHR, which are the source of truth for names, email
+// addresses, teams and contract hours. Users are created for new employees
+// and deactivated once they leave.
+package hris
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"overtime/config"
+	"overtime/mailer"
+	"overtime/models"
+	"overtime/scheduler"
+	"overtime/services"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxErrorLength is the size of HRISConnection.LastError
+const maxErrorLength = 1000
+
+// Employee is a person as the HR system lists them
+type Employee struct {
+	ID       string
+	FullName string
+	Email    string
+	// Team is the name of the employee's department, empty when unknown
+	Team string
+	// WeeklyHours are the contract's hours, zero when unknown
+	WeeklyHours float64
+	Active      bool
+}
+
+// Kinds of changes a sync makes to a user
+const (
+	ChangeCreate     = "create"
+	ChangeUpdate     = "update"
+	ChangeDeactivate = "deactivate"
+	ChangeReactivate = "reactivate"
+	ChangeSkip       = "skip"
+)
+
+// Field is a value of a user that a sync changes
+type Field struct {
+	Name string
+	From string
+	To   string
+}
+
+// Change is what a sync does to one user. Note tells why an employee is
+// skipped or a value is kept.
+type Change struct {
+	Kind string
+	// Employee is nil for users the HR system no longer lists, User is nil
+	// for users to create
+	Employee *Employee
+	User     *models.User
+	Fields   []Field
+	Note     string
+
+	teamID      *uint
+	teamChanged bool
+	weeklyHours float64
+}
+
+// Name is who the change is about
+func (c *Change) Name() string {
+	if c.User != nil {
+		return c.User.DisplayName()
+	}
+	return c.Employee.FullName
+}
+
+// Syncer periodically syncs the users of every organization with an enabled
+// HR system connection
+type Syncer struct {
+	db     *gorm.DB
+	config *config.Config
+	mailer *mailer.Mailer
+	http   *http.Client
+	// recordTeamChange records in the team history that user moved from the
+	// team previous to their current team on the day from
+	recordTeamChange func(tx *gorm.DB, user *models.User, previous *uint, from time.Time) error
+}
+
+func NewSyncer(db *gorm.DB, cfg *config.Config, mail *mailer.Mailer, recordTeamChange func(tx *gorm.DB, user *models.User, previous *uint, from time.Time) error) *Syncer {
+	return &Syncer{
+		db:               db,
+		config:           cfg,
+		mailer:           mail,
+		http:             &http.Client{Timeout: time.Minute},
+		recordTeamChange: recordTeamChange,
+	}
+}
+
+func (s *Syncer) Enabled() bool {
+	return s.config.HRISSyncInterval > 0
+}
+
+// Run syncs once immediately and then on every interval, on whichever
+// replica claims the run from lock. It never returns.
+func (s *Syncer) Run(lock *scheduler.Lock) {
+	ticker := time.NewTicker(s.config.HRISSyncInterval)
+	defer ticker.Stop()
+	for {
+		if lock.Claim("hris-sync", s.config.HRISSyncInterval) {
+			if err := s.SyncAll(); err != nil {
+				log.Printf("HR system sync failed: %v", err)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// SyncAll syncs the users of every enabled connection
+func (s *Syncer) SyncAll() error {
+	var connections []models.HRISConnection
+	if err := s.db.Where("enabled = ?", true).Find(&connections).Error; err != nil {
+		return err
+	}
+	for i := range connections {
+		s.Sync(&connections[i])
+	}
+	return nil
+}
+
+// Preview returns the changes a sync of the connection would make, without
+// making them
+func (s *Syncer) Preview(connection *models.HRISConnection) ([]Change, error) {
+	employees, err := s.employees(connection)
+	if err != nil {
+		return nil, err
+	}
+	return s.plan(connection.OrganizationID, employees, today())
+}
+
+// Sync applies the changes to the organization's users and records the
+// outcome on the connection. The admins are emailed when a sync fails after
+// the previous one succeeded.
+func (s *Syncer) Sync(connection *models.HRISConnection) ([]Change, error) {
+	var changes []Change
+	employees, err := s.employees(connection)
+	if err == nil {
+		changes, err = s.plan(connection.OrganizationID, employees, today())
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{"last_sync_at": now, "last_error": ""}
+	if err != nil {
+		log.Printf("HR system sync of organization %d failed: %v", connection.OrganizationID, err)
+		message := err.Error()
+		for len(message) > maxErrorLength {
+			_, size := utf8.DecodeLastRuneInString(message)
+			message = message[:len(message)-size]
+		}
+		updates["last_error"] = message
+		if connection.LastError == "" {
+			s.alert(connection, message)
+		}
+	} else {
+		for i := range changes {
+			if err := s.apply(connection, &changes[i], today()); err != nil {
+				log.Printf("HR system sync of organization %d: failed to %s %s: %v", connection.OrganizationID, changes[i].Kind, changes[i].Name(), err)
+				changes[i].Kind, changes[i].Note = ChangeSkip, "Failed: "+err.Error()
+			}
+		}
+		updates["last_result"] = Summary(changes)
+	}
+	if err := s.db.Model(connection).Updates(updates).Error; err != nil {
+		log.Printf("Failed to record HR system sync of organization %d: %v", connection.OrganizationID, err)
+	}
+	return changes, err
+}
+
+// Count returns the number of changes of each kind. Updates that only come
+// with a note change nothing and are not counted.
+func Count(changes []Change) map[string]int {
+	counts := make(map[string]int)
+	for _, change := range changes {
+		if change.Kind != ChangeUpdate || len(change.Fields) > 0 {
+			counts[change.Kind]++
+		}
+	}
+	return counts
+}
+
+// Summary sums up the number of changes of each kind
+func Summary(changes []Change) string {
+	counts := Count(changes)
+	var parts []string
+	for _, kind := range []struct{ kind, label string }{
+		{ChangeCreate, "created"},
+		{ChangeUpdate, "updated"},
+		{ChangeReactivate, "reactivated"},
+		{ChangeDeactivate, "deactivated"},
+		{ChangeSkip, "skipped"},
+	} {
+		if counts[kind.kind] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[kind.kind], kind.label))
+		}
+	}
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (s *Syncer) employees(connection *models.HRISConnection) ([]Employee, error) {
+	var employees []Employee
+	var err error
+	switch connection.Kind {
+	case models.HRISPersonio:
+		employees, err = s.personioEmployees(connection)
+	case models.HRISBambooHR:
+		employees, err = s.bambooHREmployees(connection)
+	default:
+		return nil, fmt.Errorf("unknown HR system %q", connection.Kind)
+	}
+	// An empty list would deactivate everyone, it is more likely a
+	// misconfigured account
+	if err == nil && len(employees) == 0 {
+		err = errors.New("the HR system listed no employees")
+	}
+	return employees, err
+}
+
+// plan compares the organization's users with the employees and returns the
+// changes a sync makes. Changes that touch nothing are left out.
+func (s *Syncer) plan(organizationID uint, employees []Employee, day time.Time) ([]Change, error) {
+	var users []models.User
+	if err := s.db.Preload("Team").Where("organization_id = ?", organizationID).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	var teams []models.Team
+	if err := s.db.Where("organization_id = ?", organizationID).Find(&teams).Error; err != nil {
+		return nil, err
+	}
+	var contracts []models.Contract
+	if err := s.db.Where("organization_id = ?", organizationID).Find(&contracts).Error; err != nil {
+		return nil, err
+	}
+
+	teamsByName := make(map[string]*models.Team, len(teams))
+	for i := range teams {
+		teamsByName[strings.ToLower(teams[i].Name)] = &teams[i]
+	}
+	userContracts := make(map[uint][]models.Contract)
+	for _, contract := range contracts {
+		userContracts[contract.UserID] = append(userContracts[contract.UserID], contract)
+	}
+	byID := make(map[string]*models.User)
+	byEmail := make(map[string]*models.User)
+	for i := range users {
+		user := &users[i]
+		switch {
+		case user.HRISID != nil:
+			byID[*user.HRISID] = user
+		// Addresses of accounts from open signup are not trusted until they
+		// are confirmed
+		case user.Email != "" && user.DeactivatedAt == nil && user.AnonymizedAt == nil && !user.PendingVerification:
+			byEmail[strings.ToLower(user.Email)] = user
+		}
+	}
+
+	var changes []Change
+	listed := make(map[uint]bool)
+	for i := range employees {
+		employee := &employees[i]
+		if employee.ID == "" {
+			continue
+		}
+		user := byID[employee.ID]
+		if user == nil && employee.Email != "" {
+			user = byEmail[strings.ToLower(employee.Email)]
+		}
+
+		var change *Change
+		var err error
+		if user != nil {
+			listed[user.ID] = true
+			change, err = s.planUser(user, employee, teamsByName, userContracts[user.ID], day)
+		} else if employee.Active {
+			change, err = s.planNewUser(employee, teamsByName)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+
+	for i := range users {
+		user := &users[i]
+		if user.HRISID != nil && !listed[user.ID] && user.DeactivatedAt == nil && user.AnonymizedAt == nil {
+			changes = append(changes, Change{Kind: ChangeDeactivate, User: user, Note: "No longer listed in the HR system"})
+		}
+	}
+	return changes, nil
+}
+
+// planUser returns the changes to a user matched to the employee, nil when
+// there are none
+func (s *Syncer) planUser(user *models.User, employee *Employee, teams map[string]*models.Team, contracts []models.Contract, day time.Time) (*Change, error) {
+	// Anonymized users keep nothing to sync
+	if user.AnonymizedAt != nil {
+		return nil, nil
+	}
+	change := &Change{Kind: ChangeUpdate, Employee: employee, User: user}
+	if !employee.Active {
+		if user.DeactivatedAt != nil {
+			return nil, nil
+		}
+		change.Kind, change.Note = ChangeDeactivate, "Inactive in the HR system"
+		return change, nil
+	}
+	if user.DeactivatedAt != nil {
+		change.Kind = ChangeReactivate
+	}
+
+	if user.HRISID == nil {
+		change.Fields = append(change.Fields, Field{"HR system ID", "", employee.ID})
+	}
+	if employee.FullName != "" && employee.FullName != user.FullName {
+		change.Fields = append(change.Fields, Field{"Name", user.FullName, employee.FullName})
+	}
+	if employee.Email != "" && !strings.EqualFold(employee.Email, user.Email) {
+		taken, err := services.EmailTaken(s.db, employee.Email, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		if taken {
+			change.Note = fmt.Sprintf("Keeps the email address, %s is used by another account", employee.Email)
+		} else {
+			change.Fields = append(change.Fields, Field{"Email", user.Email, employee.Email})
+		}
+	}
+	if employee.Team != "" {
+		team, ok := teams[strings.ToLower(employee.Team)]
+		switch {
+		case !ok:
+			change.Note = fmt.Sprintf("Keeps the team, there is no team %q", employee.Team)
+		case user.TeamID == nil || *user.TeamID != team.ID:
+			from := ""
+			if user.Team != nil {
+				from = user.Team.Name
+			}
+			change.Fields = append(change.Fields, Field{"Team", from, team.Name})
+			change.teamID, change.teamChanged = &team.ID, true
+		}
+	}
+	if employee.WeeklyHours > 0 {
+		current := float64(models.FullTimeWeeklyHours)
+		if contract := models.ContractOn(contracts, day); contract != nil {
+			current = contract.WeeklyHours
+		}
+		if math.Abs(employee.WeeklyHours-current) >= 0.01 {
+			change.Fields = append(change.Fields, Field{"Weekly hours", formatHours(current), formatHours(employee.WeeklyHours)})
+			change.weeklyHours = employee.WeeklyHours
+		}
+	}
+
+	if change.Kind == ChangeUpdate && len(change.Fields) == 0 && change.Note == "" {
+		return nil, nil
+	}
+	return change, nil
+}
+
+// planNewUser returns the creation of a user for the employee, or why it is
+// skipped. New users log in with their email address.
+func (s *Syncer) planNewUser(employee *Employee, teams map[string]*models.Team) (*Change, error) {
+	change := &Change{Kind: ChangeCreate, Employee: employee}
+	if employee.Email == "" {
+		change.Kind, change.Note = ChangeSkip, "No email address in the HR system"
+		return change, nil
+	}
+	username := services.NormalizeUsername(employee.Email)
+	usernameTaken, err := services.UsernameTaken(s.db, username)
+	if err != nil {
+		return nil, err
+	}
+	emailTaken, err := services.EmailTaken(s.db, employee.Email, 0)
+	if err != nil {
+		return nil, err
+	}
+	if usernameTaken || emailTaken {
+		change.Kind, change.Note = ChangeSkip, fmt.Sprintf("%s is already used by another account", employee.Email)
+		return change, nil
+	}
+
+	change.Fields = append(change.Fields, Field{Name: "Username", To: username}, Field{Name: "Email", To: employee.Email})
+	if employee.Team != "" {
+		if team, ok := teams[strings.ToLower(employee.Team)]; ok {
+			change.Fields = append(change.Fields, Field{Name: "Team", To: team.Name})
+			change.teamID = &team.ID
+		} else {
+			change.Note = fmt.Sprintf("Gets no team, there is no team %q", employee.Team)
+		}
+	}
+	if employee.WeeklyHours > 0 {
+		change.Fields = append(change.Fields, Field{Name: "Weekly hours", To: formatHours(employee.WeeklyHours)})
+		change.weeklyHours = employee.WeeklyHours
+	}
+	return change, nil
+}
+
+// apply makes the change to the user in a transaction of its own and
+// records it in the audit log
+func (s *Syncer) apply(connection *models.HRISConnection, change *Change, day time.Time) error {
+	if change.Kind == ChangeSkip || (change.Kind == ChangeUpdate && len(change.Fields) == 0) {
+		return nil
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		user := change.User
+		switch change.Kind {
+		case ChangeCreate:
+			// An unconfirmed signup does not keep the employee's address from
+			// them, addresses are unique
+			if err := tx.Where("LOWER(email) = LOWER(?) AND pending_verification = ?", change.Employee.Email, true).
+				Delete(&models.User{}).Error; err != nil {
+				return err
+			}
+			user = &models.User{
+				OrganizationID: connection.OrganizationID,
+				Username:       services.NormalizeUsername(change.Employee.Email),
+				FullName:       change.Employee.FullName,
+				Email:          change.Employee.Email,
+				HRISID:         &change.Employee.ID,
+				// Matches no password, they log in with emailed login links
+				PasswordHash: "!",
+				Role:         models.RoleEmployee,
+				TeamID:       change.teamID,
+			}
+			if err := tx.Create(user).Error; err != nil {
+				return err
+			}
+			// Create skips zero values that have a column default
+			if err := tx.Model(user).Update("must_change_password", false).Error; err != nil {
+				return err
+			}
+			change.User = user
+		case ChangeDeactivate:
+			if err := tx.Model(user).Update("deactivated_at", time.Now()).Error; err != nil {
+				return err
+			}
+			for _, model := range []interface{}{&models.Session{}, &models.LoginToken{}} {
+				if err := tx.Where("user_id = ?", user.ID).Delete(model).Error; err != nil {
+					return err
+				}
+			}
+			// Their emailed approval links stop working too
+			if err := tx.Where("approver_id = ? AND used_at IS NULL", user.ID).Delete(&models.ApprovalToken{}).Error; err != nil {
+				return err
+			}
+		default:
+			updates := map[string]interface{}{
+				"hris_id":   change.Employee.ID,
+				"full_name": change.Employee.FullName,
+			}
+			for _, field := range change.Fields {
+				if field.Name == "Email" {
+					updates["email"] = field.To
+				}
+			}
+			if change.Kind == ChangeReactivate {
+				updates["deactivated_at"] = nil
+			}
+			if change.teamChanged {
+				previous := user.TeamID
+				updates["team_id"] = change.teamID
+				user.TeamID = change.teamID
+				if err := s.recordTeamChange(tx, user, previous, day); err != nil {
+					return err
+				}
+			}
+			if change.Employee.FullName == "" {
+				delete(updates, "full_name")
+			}
+			if err := tx.Model(user).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+
+		if change.weeklyHours > 0 {
+			contract := models.Contract{
+				OrganizationID:  connection.OrganizationID,
+				UserID:          user.ID,
+				ValidFrom:       day,
+				WeeklyHours:     change.weeklyHours,
+				PartTimePercent: math.Min(100, change.weeklyHours/models.FullTimeWeeklyHours*100),
+			}
+			err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "user_id"}, {Name: "valid_from"}},
+				DoUpdates: clause.AssignmentColumns([]string{"weekly_hours", "part_time_percent", "updated_at"}),
+			}).Create(&contract).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Create(&models.AuditLog{
+			OrganizationID: connection.OrganizationID,
+			UserID:         &user.ID,
+			Action:         models.AuditUserSynced,
+			Detail:         change.detail(connection),
+		}).Error
+	})
+}
+
+// detail describes the change for the audit log
+func (c *Change) detail(connection *models.HRISConnection) string {
+	var fields []string
+	for _, field := range c.Fields {
+		fields = append(fields, fmt.Sprintf("%s %q -> %q", strings.ToLower(field.Name), field.From, field.To))
+	}
+	detail := fmt.Sprintf("%s from %s", c.Kind, connection.KindLabel())
+	if len(fields) > 0 {
+		detail += ": " + strings.Join(fields, ", ")
+	}
+	if c.Note != "" {
+		detail += " (" + c.Note + ")"
+	}
+	return detail
+}
+
+// alert emails the organization's admins that the sync failed
+func (s *Syncer) alert(connection *models.HRISConnection, message string) {
+	var admins []models.User
+	s.db.Where("organization_id = ? AND role = ? AND email <> '' AND deactivated_at IS NULL", connection.OrganizationID, models.RoleAdmin).Find(&admins)
+	if len(admins) == 0 {
+		return
+	}
+	var to []string
+	for _, admin := range admins {
+		to = append(to, admin.Email)
+	}
+
+	body := fmt.Sprintf(`Users could not be synced from %s:
+
+%s
+
+Users are not created, updated or deactivated until the sync succeeds again.
+Check the connection here: %s/hris
+`,
+		connection.KindLabel(),
+		message,
+		s.config.BaseURL,
+	)
+	if err := s.mailer.Send(to, "User sync from "+connection.KindLabel()+" failed", body); err != nil {
+		log.Printf("Failed to send HR system sync alert for organization %d: %v", connection.OrganizationID, err)
+	}
+}
+
+// today is the date the sync's team changes and contracts start on
+func today() time.Time {
+	now := time.Now().UTC()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func formatHours(hours float64) string {
+	return strconv.FormatFloat(hours, 'f', -1, 64)
+}
+
+// text returns an API value that is a string or a number as a string, and
+// an empty string for null or anything else
+func text(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return strings.TrimSpace(s)
+	}
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n.String()
+	}
+	return ""
+}
@@ -0,0 +1,128 @@
+package hris
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"overtime/models"
+)
+
+const personioURL = "https://api.personio.de/v1"
+
+// personioPageSize is how many employees are requested at once
+const personioPageSize = 200
+
+// personioAttribute is an employee attribute of the Personio API, whose value
+// is a string, a number or an object depending on the attribute
+type personioAttribute struct {
+	Value json.RawMessage `json:"value"`
+}
+
+type personioResponse struct {
+	Success bool            `json:"success"`
+	Data    json.RawMessage `json:"data"`
+	Error   struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// personioEmployees lists the employees of the company whose API credentials
+// the connection holds
+func (s *Syncer) personioEmployees(connection *models.HRISConnection) ([]Employee, error) {
+	token, err := s.personioToken(connection)
+	if err != nil {
+		return nil, err
+	}
+
+	var employees []Employee
+	for offset := 0; ; offset += personioPageSize {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/company/employees?limit=%d&offset=%d", personioURL, personioPageSize, offset), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		var page []struct {
+			Attributes map[string]personioAttribute `json:"attributes"`
+		}
+		header, err := s.personioDo(req, &page)
+		if err != nil {
+			return nil, err
+		}
+		// Personio hands out a new token with every response
+		if next := strings.TrimPrefix(header.Get("Authorization"), "Bearer "); next != "" {
+			token = next
+		}
+
+		for _, item := range page {
+			employees = append(employees, personioEmployee(item.Attributes))
+		}
+		if len(page) < personioPageSize {
+			return employees, nil
+		}
+	}
+}
+
+func (s *Syncer) personioToken(connection *models.HRISConnection) (string, error) {
+	body, err := json.Marshal(map[string]string{"client_id": connection.ClientID, "client_secret": connection.Secret})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, personioURL+"/auth", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var auth struct {
+		Token string `json:"token"`
+	}
+	if _, err := s.personioDo(req, &auth); err != nil {
+		return "", err
+	}
+	return auth.Token, nil
+}
+
+// personioDo sends the request and decodes the data of the response into v
+func (s *Syncer) personioDo(req *http.Request, v interface{}) (http.Header, error) {
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var response personioResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("personio: unexpected response with status %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || !response.Success {
+		return nil, fmt.Errorf("personio: %s %s", resp.Status, response.Error.Message)
+	}
+	if err := json.Unmarshal(response.Data, v); err != nil {
+		return nil, fmt.Errorf("personio: decode response: %w", err)
+	}
+	return resp.Header, nil
+}
+
+func personioEmployee(attributes map[string]personioAttribute) Employee {
+	var department struct {
+		Attributes struct {
+			Name string `json:"name"`
+		} `json:"attributes"`
+	}
+	json.Unmarshal(attributes["department"].Value, &department)
+	hours, _ := strconv.ParseFloat(text(attributes["weekly_working_hours"].Value), 64)
+
+	return Employee{
+		ID:          text(attributes["id"].Value),
+		FullName:    strings.TrimSpace(text(attributes["first_name"].Value) + " " + text(attributes["last_name"].Value)),
+		Email:       text(attributes["email"].Value),
+		Team:        department.Attributes.Name,
+		WeeklyHours: hours,
+		// Onboarding employees and those on leave keep their accounts
+		Active: text(attributes["status"].Value) != "inactive",
+	}
+}
@@ -0,0 +1,56 @@
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"overtime/config"
+)
+
+type Mailer struct {
+	config *config.Config
+}
+
+func New(cfg *config.Config) *Mailer {
+	return &Mailer{config: cfg}
+}
+
+// Enabled reports whether an SMTP server is configured
+func (m *Mailer) Enabled() bool {
+	return m.config.SMTPHost != ""
+}
+
+// Send delivers a plain-text email. Without SMTP configuration the message
+// is logged and dropped so the rest of the application keeps working.
+func (m *Mailer) Send(to []string, subject, body string) error {
+	if len(to) == 0 {
+		return nil
+	}
+
+	if !m.Enabled() {
+		log.Printf("SMTP not configured, skipping email %q to %s", subject, strings.Join(to, ", "))
+		return nil
+	}
+
+	var auth smtp.Auth
+	if m.config.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", m.config.SMTPUsername, m.config.SMTPPassword, m.config.SMTPHost)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", m.config.SMTPFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	addr := net.JoinHostPort(m.config.SMTPHost, m.config.SMTPPort)
+	return smtp.SendMail(addr, auth, m.config.SMTPFrom, to, []byte(msg.String()))
+}
@@ -1,32 +1,117 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"os"
+	"strings"
+	"time"
+	_ "time/tzdata" // embed the timezone database for per-user timezones
 
+	"overtime/anomaly"
+	"overtime/backup"
+	"overtime/cache"
+	"overtime/caldav"
+	"overtime/captcha"
+	"overtime/carryover"
 	"overtime/config"
 	"overtime/database"
+	"overtime/delivery"
+	"overtime/digest"
 	"overtime/handlers"
+	"overtime/hris"
+	"overtime/mailer"
 	"overtime/middleware"
 	"overtime/models"
+	"overtime/monthclose"
+	"overtime/passhash"
+	"overtime/ratelimit"
+	"overtime/redis"
+	"overtime/retention"
+	"overtime/scheduler"
+	"overtime/store"
+	"overtime/telegram"
+	"overtime/tempo"
 
 	"github.com/go-chi/chi/v5"
 	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 func main() {
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML config file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: overtime [-config file] [command]
+
+Without a command the server is started. Commands:
+  backup           back up the database now
+  restore          list the stored backups
+  restore <name>   replace the database contents with a backup, "latest" for
+                   the newest one; stop the server first
+
+Flags:
+`)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
 	// Load configuration
-	cfg := config.Load()
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
 	// Initialize JWT secret
 	middleware.SetJWTSecret(cfg.JWTSecret)
+	middleware.SetCookieOptions(middleware.CookieOptions{
+		Name:     cfg.CookieName,
+		Domain:   cfg.CookieDomain,
+		Secure:   cfg.CookieSecure,
+		SameSite: cfg.CookieSameSite,
+	})
+	middleware.SetTrustedProxies(cfg.TrustedProxies)
+
+	// Cost of new password hashes
+	passhash.SetParams(passhash.Params{
+		Memory:      uint32(cfg.Argon2Memory),
+		Iterations:  uint32(cfg.Argon2Iterations),
+		Parallelism: uint8(cfg.Argon2Parallelism),
+	})
+
+	backups := backup.New(cfg)
+
+	// Backup commands run instead of the server
+	switch flag.Arg(0) {
+	case "":
+	case "backup":
+		os.Exit(backupCommand(backups))
+	case "restore":
+		os.Exit(restoreCommand(backups, flag.Arg(1)))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
 
 	// Initialize database
-	if err := database.Init(cfg.DatabaseURL); err != nil {
+	db, err := database.Open(cfg)
+	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 
+	// State shared between replicas, like cached data, rate limit counters and
+	// job claims, lives in Redis when configured and in memory otherwise. Job
+	// claims fall back to the database.
+	var redisClient *redis.Client
+	if cfg.RedisURL != "" {
+		if redisClient, err = redis.New(cfg.RedisURL); err != nil {
+			log.Fatalf("Failed to configure Redis: %v", err)
+		}
+	}
+	jobs := scheduler.NewLock(redisClient, db)
+
 	// Define template functions
 	funcMap := template.FuncMap{
 		"deref": func(p *uint) uint {
@@ -35,48 +120,171 @@ func main() {
 			}
 			return *p
 		},
+		"pendingApprovals": func(u *models.User) int64 {
+			return handlers.PendingApprovalCount(db, u)
+		},
+		"securityAlerts": func(u *models.User) []models.SecurityAlert {
+			return handlers.SecurityAlerts(db, u)
+		},
+		"branding": func(u *models.User) models.Branding {
+			return handlers.BrandingFor(db, u)
+		},
+		"avatar": func(u models.User) handlers.Avatar {
+			return handlers.AvatarFor(cfg, &u)
+		},
 	}
 
 	// Parse templates - each page template paired with base
 	templates := make(map[string]*template.Template)
-	pages := []string{
-		"login", "register", "change-password", "dashboard",
-		"overtime-form", "overtime-edit", "invites", "export", "all-entries",
-		"users", "user-edit", "teams", "projects",
-		"supervisors", "supervisor-dashboard", "supervisor-export",
+	if err := parseTemplates(templates, funcMap); err != nil {
+		log.Fatalf("Failed to parse templates: %v", err)
 	}
-	for _, page := range pages {
-		templates[page] = template.Must(template.New("").Funcs(funcMap).ParseFiles(
-			"templates/base.html",
-			"templates/"+page+".html",
-		))
+
+	// Initialize mailer
+	mail := mailer.New(cfg)
+
+	// Publish approved overtime to team calendars
+	calendar := caldav.NewPublisher(db, cfg)
+
+	// Entries are logged, edited and reviewed through the store
+	records := store.NewGORM(db)
+
+	// Import overtime worklogs from Jira/Tempo in the background
+	recordEntry := handlers.EntryRecorder(records, cfg, mail)
+	importer := tempo.NewImporter(db, cfg, recordEntry)
+	if importer.Enabled() {
+		go importer.Run(jobs)
 	}
 
+	// Log overtime from Telegram
+	bot := telegram.NewBot(db, cfg, recordEntry)
+	if bot.Enabled() {
+		go bot.Run(jobs)
+	}
+
+	if backups.Scheduled() {
+		go backups.Run(jobs)
+	}
+
+	// Delete data past the organizations' retention periods
+	purger := retention.NewPurger(db, cfg, mail, handlers.RetentionPolicies(db, cfg))
+	go purger.Run(jobs)
+
+	// Tell HR about unusual overtime
+	detector := anomaly.NewDetector(db, cfg, mail)
+	if detector.Enabled() {
+		go detector.Run(jobs)
+	}
+
+	// Email reviewers who chose a digest the entries waiting for them
+	digests := digest.NewSender(db, cfg, mail, handlers.NewEntriesFor(db))
+	if digests.Enabled() {
+		go digests.Run(jobs)
+	}
+
+	// Send the monthly export to the organizations' export destinations
+	deliverer := delivery.NewDeliverer(db, cfg, mail, handlers.MonthlyExport(db, cfg), handlers.ExportArchiver(db, cfg))
+	if deliverer.Enabled() {
+		go deliverer.Run(jobs)
+	}
+
+	// Lock and archive the previous month of organizations that close months
+	closer := monthclose.NewCloser(db, cfg, mail, handlers.MonthCloses(db, cfg), handlers.MonthlyExport(db, cfg),
+		handlers.ExportArchiver(db, cfg), handlers.EntryApprovers(records))
+	if closer.Enabled() {
+		go closer.Run(jobs)
+	}
+
+	// Let the hours above what balance rules carry over expire
+	applier := carryover.NewApplier(db, cfg)
+	if applier.Enabled() {
+		go applier.Run(jobs)
+	}
+
+	// Sync users from the organizations' HR systems
+	syncer := hris.NewSyncer(db, cfg, mail, handlers.TeamChangeRecorder())
+	if syncer.Enabled() {
+		go syncer.Run(jobs)
+	}
+
+	// Teams and projects are cached in Redis when configured so that changes
+	// reach every replica
+	refCache := cache.New(cfg.CacheTTL, redisClient)
+
 	// Initialize handlers
-	authHandler := handlers.NewAuthHandler(cfg, templates)
-	overtimeHandler := handlers.NewOvertimeHandler(cfg, templates)
-	supervisorHandler := handlers.NewSupervisorHandler(cfg, templates)
+	logins := ratelimit.New("login", cfg.LoginRateLimit, cfg.LoginRateWindow, redisClient)
+	tokens := ratelimit.New("api", cfg.APIRateLimit, cfg.APIRateWindow, redisClient)
+	// Requests per session are written to the sessions once a minute
+	sessionUsage := middleware.NewSessionUsage(db)
+	go sessionUsage.Run(time.Minute)
+	failures := ratelimit.New("login-failures", cfg.CaptchaAfterFailures, cfg.LoginRateWindow, redisClient)
+	failedLogins := ratelimit.New("failed-logins", cfg.FailedLoginAlertThreshold, cfg.LoginRateWindow, redisClient)
+	verifier := captcha.New(cfg.CaptchaProvider, cfg.CaptchaSiteKey, cfg.CaptchaSecretKey)
+	authHandler := handlers.NewAuthHandler(db, cfg, templates, calendar, mail, refCache, logins, failures, failedLogins, verifier)
+	overtimeHandler := handlers.NewOvertimeHandler(db, records, cfg, templates, mail, calendar, refCache)
+	supervisorHandler := handlers.NewSupervisorHandler(db, cfg, templates, refCache)
+	approvalHandler := handlers.NewApprovalHandler(db, records, cfg, templates, mail, calendar, refCache)
+	apiHandler := handlers.NewAPIHandler(cfg, templates)
+	settingsHandler := handlers.NewSettingsHandler(db, cfg, templates)
+	backupHandler := handlers.NewBackupHandler(cfg, templates, backups)
+	deliveryHandler := handlers.NewDeliveryHandler(db, cfg, templates, deliverer)
+	diagnosticsHandler := handlers.NewDiagnosticsHandler(db, templates)
+	hrisHandler := handlers.NewHRISHandler(db, cfg, templates, syncer)
 
 	// Setup router
 	router := chi.NewRouter()
+	router.Use(middleware.ProxyHeaders)
 	router.Use(chimiddleware.Logger)
 	router.Use(chimiddleware.Recoverer)
+	router.Use(middleware.CSRF)
+	if cfg.DevMode {
+		log.Printf("DEV_MODE: templates are parsed again on every request")
+		router.Use(reloadTemplates(templates, funcMap))
+		handlers.ShowTemplateErrors(true)
+	}
 
-	// // Static files
-	// router.Handle("/static/*", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	// Static files
+	router.Handle("/static/*", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+
+	// The service worker is served from the root so it may control every page
+	router.Get("/sw.js", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeFile(w, r, "static/sw.js")
+	})
+
+	// Requests are cancelled after REQUEST_TIMEOUT, aborting their database
+	// queries
+	routes := router.With(middleware.Timeout(cfg.RequestTimeout, handlers.RequestCancelled(templates)))
 
 	// Public routes
-	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+	routes.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 	})
-	router.Get("/login", authHandler.LoginPage)
-	router.Post("/login", authHandler.Login)
-	router.Get("/register", authHandler.RegisterPage)
-	router.Post("/register", authHandler.Register)
+	routes.Get("/login", authHandler.LoginPage)
+	routes.Post("/login", authHandler.Login)
+	routes.Get("/login/link", authHandler.LoginLinkPage)
+	routes.Post("/login/link", authHandler.SendLoginLink)
+	routes.Get("/login/magic", authHandler.MagicLinkPage)
+	routes.Post("/login/magic", authHandler.MagicLinkLogin)
+	routes.Get("/register", authHandler.RegisterPage)
+	routes.Post("/register", authHandler.Register)
+	routes.Get("/register/verify", authHandler.SignupVerificationPage)
+	routes.Post("/register/verify", authHandler.VerifySignup)
+	routes.Get("/i/{code}", authHandler.ShortInviteLink)
+
+	// One-click approval links from email (authorized by the signed token)
+	routes.Get("/approvals/email", approvalHandler.EmailApprovalPage)
+	routes.Post("/approvals/email", approvalHandler.EmailApproval)
+
+	// Organization logos are shown on the login page too
+	routes.Get("/branding/logo", settingsHandler.Logo)
+
+	// API reference
+	routes.Get("/api/v1/openapi.json", apiHandler.OpenAPISpec)
 
 	// Protected routes
-	router.Group(func(r chi.Router) {
-		r.Use(middleware.AuthMiddleware)
+	routes.Group(func(r chi.Router) {
+		r.Use(middleware.AuthMiddleware(db), middleware.LimitSessions(sessionUsage, tokens))
 
 		// Logout (doesn't need password change check)
 		r.Get("/logout", authHandler.Logout)
@@ -92,25 +300,85 @@ func main() {
 			// Dashboard
 			r.Get("/dashboard", overtimeHandler.Dashboard)
 
+			// Profile settings
+			r.Get("/profile", authHandler.ProfilePage)
+			r.Post("/profile", authHandler.UpdateProfile)
+			r.Get("/profile/export", authHandler.ExportMyData)
+			r.Post("/profile/avatar", authHandler.UpdateAvatar)
+			r.Post("/profile/telegram", authHandler.LinkTelegram)
+			r.Post("/profile/telegram/unlink", authHandler.UnlinkTelegram)
+			r.Post("/security-alerts/dismiss", authHandler.DismissSecurityAlerts)
+			r.Get("/avatar", authHandler.ServeAvatar)
+
+			// Devices logged in as the user; admins may pass ?user=
+			r.Get("/sessions", authHandler.SessionsPage)
+			r.Post("/sessions/revoke", authHandler.RevokeSession)
+
 			// Overtime entries (all authenticated users can access)
 			r.Get("/overtime/new", overtimeHandler.NewEntryPage)
 			r.Post("/overtime/new", overtimeHandler.CreateEntry)
 			r.Get("/overtime/edit", overtimeHandler.EditEntryPage)
 			r.Post("/overtime/edit", overtimeHandler.UpdateEntry)
 			r.Post("/overtime/delete", overtimeHandler.DeleteEntry)
+			r.Get("/overtime/row", overtimeHandler.EntryRow)
+			r.Get("/overtime/row/edit", overtimeHandler.EditEntryRow)
+			r.Post("/overtime/row", overtimeHandler.UpdateEntryRow)
+
+			// Overtime taken as time off
+			r.Get("/time-off", approvalHandler.TimeOffPage)
+			r.Post("/time-off", approvalHandler.RequestTimeOff)
+			r.Post("/time-off/cancel", approvalHandler.CancelTimeOff)
+			r.Post("/time-off/payout", approvalHandler.RequestPayout)
+			r.Post("/time-off/payout/cancel", approvalHandler.CancelPayout)
+
+			// Entries created by API clients and queued by the offline app
+			r.Group(func(r chi.Router) {
+				r.Use(middleware.Idempotent(db))
+				r.Post("/api/v1/entries", overtimeHandler.CreateAPIEntry)
+				r.Post("/api/v1/entries:batchCreate", overtimeHandler.BatchCreateEntries)
+				r.Post("/api/v1/entries:batchUpdate", overtimeHandler.BatchUpdateEntries)
+				r.Post("/api/v1/entries:batchDelete", overtimeHandler.BatchDeleteEntries)
+			})
+			r.Post("/api/v1/entries/sync", overtimeHandler.SyncEntries)
 
 			// Admin and HR only routes
 			r.Group(func(r chi.Router) {
 				r.Use(middleware.RequireRole(models.RoleAdmin, models.RoleHR))
 				r.Get("/overtime/all", overtimeHandler.AllEntriesPage)
+				r.Post("/overtime/bulk", overtimeHandler.BulkEditEntries)
 				r.Get("/export", overtimeHandler.ExportPage)
 				r.Get("/export/csv", overtimeHandler.ExportCSV)
+				r.Get("/export/preview", overtimeHandler.ExportPreview)
+				r.Get("/export/archive", overtimeHandler.ExportArchivePage)
+				r.Get("/export/archive/download", overtimeHandler.DownloadExportArchive)
+				r.Get("/compliance", overtimeHandler.CompliancePage)
+				r.Get("/compliance/csv", overtimeHandler.ComplianceCSV)
+				r.Get("/allocation", overtimeHandler.ProjectAllocationPage)
+				r.Get("/allocation/xlsx", overtimeHandler.ProjectAllocationXLSX)
+				r.Get("/users", authHandler.UsersPage)
+				r.Get("/users/edit", authHandler.EditUserPage)
+				r.Post("/users/membership", authHandler.UpdateMembership)
+				r.Post("/users/projects", authHandler.CreateProjectMember)
+				r.Post("/users/projects/delete", authHandler.DeleteProjectMember)
+				r.Post("/users/adjustments", authHandler.CreateAdjustment)
+			})
+
+			// Approver routes
+			r.Group(func(r chi.Router) {
+				r.Use(middleware.RequireRole(models.RoleAdmin, models.RoleSupervisor, models.RoleHR))
+				r.Get("/approvals", approvalHandler.ApprovalsPage)
+				r.Post("/approvals/batch", approvalHandler.BatchReview)
+				r.Post("/approvals/time-off", approvalHandler.ReviewTimeOff)
+				r.Post("/approvals/payouts", approvalHandler.ReviewPayout)
+				r.Get("/matrix", overtimeHandler.TeamMatrixPage)
+				r.Get("/matrix/csv", overtimeHandler.TeamMatrixCSV)
 			})
 
 			// Supervisor only routes
 			r.Group(func(r chi.Router) {
 				r.Use(middleware.RequireRole(models.RoleSupervisor))
 				r.Get("/supervisor/dashboard", supervisorHandler.SupervisorDashboard)
+				r.Get("/supervisor/teams", supervisorHandler.MyTeamsPage)
 				r.Get("/supervisor/export", supervisorHandler.SupervisorExportPage)
 				r.Get("/supervisor/export/csv", supervisorHandler.SupervisorExportCSV)
 			})
@@ -120,24 +388,152 @@ func main() {
 				r.Use(middleware.RequireRole(models.RoleAdmin))
 				r.Get("/invites", authHandler.InvitesPage)
 				r.Post("/invites", authHandler.CreateInvite)
-				r.Get("/users", authHandler.UsersPage)
-				r.Get("/users/edit", authHandler.EditUserPage)
+				r.Get("/invites/qr", authHandler.InviteQRCode)
+				r.Post("/invites/bulk", authHandler.BulkCreateInvites)
+				r.Post("/invites/templates", authHandler.CreateInviteTemplate)
+				r.Post("/invites/templates/delete", authHandler.DeleteInviteTemplate)
+				r.Get("/users/export", authHandler.ExportUsers)
 				r.Post("/users/edit", authHandler.UpdateUser)
 				r.Post("/users/delete", authHandler.DeleteUser)
+				r.Post("/users/anonymize", authHandler.AnonymizeUser)
+				r.Post("/users/merge", authHandler.MergeUsers)
+				r.Get("/users/pending", authHandler.PendingUsersPage)
+				r.Post("/users/activate", authHandler.ActivateUser)
+				r.Post("/users/reject", authHandler.RejectUser)
+				r.Post("/users/identifiers", authHandler.ImportUserIdentifiers)
+				r.Post("/users/contracts", authHandler.CreateContract)
+				r.Post("/users/contracts/delete", authHandler.DeleteContract)
 				r.Get("/teams", authHandler.TeamsPage)
 				r.Post("/teams", authHandler.CreateTeam)
 				r.Post("/teams/delete", authHandler.DeleteTeam)
+				r.Post("/teams/approval-chain", authHandler.UpdateTeamApprovalChain)
+				r.Post("/teams/calendar", authHandler.UpdateTeamCalendar)
+				r.Post("/teams/cost-center", authHandler.UpdateTeamCostCenter)
 				r.Get("/projects", authHandler.ProjectsPage)
 				r.Post("/projects", authHandler.CreateProject)
+				r.Post("/projects/rate", authHandler.UpdateProjectRate)
 				r.Post("/projects/delete", authHandler.DeleteProject)
+				r.Get("/cost-centers", authHandler.CostCentersPage)
+				r.Post("/cost-centers", authHandler.CreateCostCenter)
+				r.Post("/cost-centers/delete", authHandler.DeleteCostCenter)
 				r.Get("/supervisors", supervisorHandler.SupervisorsPage)
 				r.Post("/supervisors/assign", supervisorHandler.AssignSupervisor)
 				r.Post("/supervisors/remove", supervisorHandler.RemoveSupervisorAssignment)
+				r.Get("/api/docs", apiHandler.DocsPage)
+				r.Get("/api/usage", authHandler.TokenUsagePage)
+				r.Post("/api/usage/limit", authHandler.UpdateTokenRateLimit)
+				r.Get("/export/log", overtimeHandler.ExportLogPage)
+				r.Post("/export/log/hold", overtimeHandler.UpdateExportLogHold)
+				r.Get("/organizations", authHandler.OrganizationsPage)
+				r.Post("/organizations", authHandler.CreateOrganization)
+				r.Get("/settings", settingsHandler.SettingsPage)
+				r.Post("/settings/branding", settingsHandler.UpdateBranding)
+				r.Post("/settings/application", settingsHandler.UpdateApplicationSettings)
+				r.Post("/settings/signup", settingsHandler.UpdateSignupSettings)
+				r.Post("/settings/holidays", settingsHandler.CreateHoliday)
+				r.Post("/settings/holidays/delete", settingsHandler.DeleteHoliday)
+				r.Post("/settings/balance-rules", settingsHandler.CreateBalanceRule)
+				r.Post("/settings/balance-rules/delete", settingsHandler.DeleteBalanceRule)
+				r.Get("/settings/archive", settingsHandler.MonthArchive)
+				r.Get("/deliveries", deliveryHandler.DeliveriesPage)
+				r.Post("/deliveries", deliveryHandler.CreateDestination)
+				r.Post("/deliveries/toggle", deliveryHandler.ToggleDestination)
+				r.Post("/deliveries/delete", deliveryHandler.DeleteDestination)
+				r.Post("/deliveries/send", deliveryHandler.SendDestination)
+				r.Get("/hris", hrisHandler.HRISPage)
+				r.Post("/hris", hrisHandler.SaveHRISConnection)
+				r.Get("/hris/preview", hrisHandler.HRISPreview)
+				r.Post("/hris/sync", hrisHandler.SyncHRIS)
+				r.Post("/hris/toggle", hrisHandler.ToggleHRISConnection)
+				r.Post("/hris/delete", hrisHandler.DeleteHRISConnection)
 			})
 		})
 	})
 
-	log.Printf("Server starting on port %s", cfg.ServerPort)
-	log.Printf("Default admin credentials: admin / admin")
-	log.Fatal(http.ListenAndServe(":"+cfg.ServerPort, router))
+	// Backups take as long as the database dump, so they get as long as the
+	// upload to S3 may take instead of REQUEST_TIMEOUT
+	backupTimeout := 30 * time.Minute
+	if cfg.RequestTimeout == 0 {
+		backupTimeout = 0
+	}
+	router.Group(func(r chi.Router) {
+		r.Use(middleware.Timeout(backupTimeout, handlers.RequestCancelled(templates)))
+		r.Use(middleware.AuthMiddleware(db), middleware.LimitSessions(sessionUsage, tokens))
+		r.Use(middleware.RequirePasswordChange, middleware.RequireRole(models.RoleAdmin))
+		r.Get("/backups", backupHandler.BackupsPage)
+		r.Post("/backups", backupHandler.CreateBackup)
+	})
+
+	// Profiles and runtime statistics are served on their own, internal
+	// address. Anything else there, like the layout's links, is sent to the
+	// application.
+	if cfg.DiagnosticsAddr != "" {
+		diagnostics := chi.NewRouter()
+		diagnostics.Use(chimiddleware.Recoverer)
+		diagnostics.Handle("/static/*", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+		diagnostics.NotFound(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, strings.TrimRight(cfg.BaseURL, "/")+r.URL.RequestURI(), http.StatusSeeOther)
+		})
+		diagnostics.Group(func(r chi.Router) {
+			r.Use(middleware.AuthMiddleware(db), middleware.RequirePasswordChange, middleware.RequirePlatformAdmin)
+			r.Get("/", diagnosticsHandler.DiagnosticsPage)
+			r.Mount("/debug", chimiddleware.Profiler())
+		})
+
+		log.Printf("Diagnostics listening on %s", cfg.DiagnosticsAddr)
+		go listenHTTP(cfg.DiagnosticsAddr, diagnostics)
+	}
+
+	log.Fatal(serve(cfg, router))
+}
+
+// serve runs the server, terminating TLS itself when a certificate is
+// configured or obtained from Let's Encrypt
+func serve(cfg *config.Config, handler http.Handler) error {
+	server := &http.Server{
+		Addr:              ":" + cfg.ServerPort,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	// Plain HTTP requests are sent to BASE_URL
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, strings.TrimRight(cfg.BaseURL, "/")+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+
+	switch {
+	case cfg.TLSAutocert:
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.AutocertHosts...),
+			Cache:      autocert.DirCache(cfg.AutocertCacheDir),
+			Email:      cfg.AutocertEmail,
+		}
+		server.TLSConfig = manager.TLSConfig()
+		if cfg.HTTPRedirectPort != "" {
+			go listenHTTP(":"+cfg.HTTPRedirectPort, manager.HTTPHandler(redirect))
+		}
+		log.Printf("Server starting on port %s with Let's Encrypt certificates for %s", cfg.ServerPort, strings.Join(cfg.AutocertHosts, ", "))
+		return server.ListenAndServeTLS("", "")
+
+	case cfg.TLSCertFile != "":
+		if cfg.HTTPRedirectPort != "" {
+			go listenHTTP(":"+cfg.HTTPRedirectPort, redirect)
+		}
+		log.Printf("Server starting on port %s with TLS", cfg.ServerPort)
+		return server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+
+	default:
+		log.Printf("Server starting on port %s", cfg.ServerPort)
+		return server.ListenAndServe()
+	}
+}
+
+func listenHTTP(addr string, handler http.Handler) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Fatal(server.ListenAndServe())
 }
@@ -3,12 +3,12 @@ package middleware
 import (
 	"context"
 	"net/http"
-	"overtime/database"
 	"overtime/models"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
 )
 
 type contextKey string
@@ -28,12 +28,14 @@ func SetJWTSecret(secret string) {
 	jwtSecret = []byte(secret)
 }
 
-func GenerateToken(user *models.User, expiration time.Duration) (string, error) {
+// GenerateToken signs an auth token for the session with the given code
+func GenerateToken(user *models.User, sessionCode string, expiration time.Duration) (string, error) {
 	claims := &Claims{
 		UserID:   user.ID,
 		Username: user.Username,
 		Role:     user.Role,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        sessionCode,
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiration)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
@@ -59,55 +61,151 @@ func ValidateToken(tokenString string) (*Claims, error) {
 	return nil, jwt.ErrSignatureInvalid
 }
 
-func AuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Try to get token from cookie first
-		var tokenString string
-		cookie, err := r.Cookie("token")
-		if err == nil {
-			tokenString = cookie.Value
-		}
+// ApprovalClaims are carried by one-click approval links. The token ID
+// references the ApprovalToken record used to invalidate the link.
+type ApprovalClaims struct {
+	EntryID    uint `json:"entry_id"`
+	ApproverID uint `json:"approver_id"`
+	jwt.RegisteredClaims
+}
 
-		// If no cookie, try Authorization header
-		if tokenString == "" {
-			authHeader := r.Header.Get("Authorization")
-			if authHeader != "" {
-				parts := strings.Split(authHeader, " ")
-				if len(parts) == 2 && parts[0] == "Bearer" {
-					tokenString = parts[1]
-				}
+const approvalSubject = "approval"
+
+func GenerateApprovalToken(code string, entryID, approverID uint, expiration time.Duration) (string, error) {
+	claims := &ApprovalClaims{
+		EntryID:    entryID,
+		ApproverID: approverID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        code,
+			Subject:   approvalSubject,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiration)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtSecret)
+}
+
+func ValidateApprovalToken(tokenString string) (*ApprovalClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &ApprovalClaims{}, func(token *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithSubject(approvalSubject))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if claims, ok := token.Claims.(*ApprovalClaims); ok && token.Valid && claims.ID != "" {
+		return claims, nil
+	}
+
+	return nil, jwt.ErrSignatureInvalid
+}
+
+// LoginClaims are carried by emailed login links. The token ID references the
+// LoginToken record that makes the link single-use.
+type LoginClaims struct {
+	UserID uint `json:"user_id"`
+	jwt.RegisteredClaims
+}
+
+const loginSubject = "login"
+
+func GenerateLoginToken(code string, userID uint, expiration time.Duration) (string, error) {
+	claims := &LoginClaims{
+		UserID: userID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        code,
+			Subject:   loginSubject,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiration)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtSecret)
+}
+
+func ValidateLoginToken(tokenString string) (*LoginClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &LoginClaims{}, func(token *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithSubject(loginSubject))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if claims, ok := token.Claims.(*LoginClaims); ok && token.Valid && claims.ID != "" {
+		return claims, nil
+	}
+
+	return nil, jwt.ErrSignatureInvalid
+}
+
+// requestToken returns the auth token of the request, from the cookie or else
+// the Authorization header, and whether it is a bearer token
+func requestToken(r *http.Request) (string, bool) {
+	if cookie, err := r.Cookie(cookieOptions.Name); err == nil && cookie.Value != "" {
+		return cookie.Value, false
+	}
+
+	parts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(parts) == 2 && parts[0] == "Bearer" {
+		return parts[1], true
+	}
+	return "", false
+}
+
+// AuthMiddleware loads the user of the request's session from db
+func AuthMiddleware(db *gorm.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenString, _ := requestToken(r)
+			if tokenString == "" {
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+				return
 			}
-		}
 
-		if tokenString == "" {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
+			claims, err := ValidateToken(tokenString)
+			if err != nil {
+				// Clear invalid cookie
+				ClearAuthCookie(w, r)
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+				return
+			}
 
-		claims, err := ValidateToken(tokenString)
-		if err != nil {
-			// Clear invalid cookie
-			http.SetCookie(w, &http.Cookie{
-				Name:     "token",
-				Value:    "",
-				Path:     "/",
-				MaxAge:   -1,
-				HttpOnly: true,
-			})
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
+			// A cancelled request tells nothing about the session, so it must
+			// not log the device out; Timeout answers it instead
+			db := db.WithContext(r.Context())
+			session, ok := loadSession(db, claims)
+			if r.Context().Err() != nil {
+				return
+			}
 
-		// Get full user from database
-		var user models.User
-		if err := database.GetDB().First(&user, claims.UserID).Error; err != nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
+			// Revoked and expired sessions log the device out
+			if !ok {
+				ClearAuthCookie(w, r)
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+				return
+			}
+			touchSession(db, r, session)
 
-		ctx := context.WithValue(r.Context(), UserContextKey, &user)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+			// Get full user from database
+			var user models.User
+			if err := db.Preload("Organization").Preload("TeamAssignments").Preload("ProjectMemberships").First(&user, claims.UserID).Error; err != nil {
+				if r.Context().Err() != nil {
+					return
+				}
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), UserContextKey, &user)
+			ctx = context.WithValue(ctx, SessionContextKey, session)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
 }
 
 func RequirePasswordChange(next http.Handler) http.Handler {
@@ -147,6 +245,23 @@ func RequireRole(roles ...models.Role) func(http.Handler) http.Handler {
 	}
 }
 
+// RequirePlatformAdmin allows only admins who manage every organization, for
+// data that is not scoped to one
+func RequirePlatformAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := GetUserFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !user.CanManageOrganizations() {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func GetUserFromContext(ctx context.Context) *models.User {
 	user, ok := ctx.Value(UserContextKey).(*models.User)
 	if !ok {
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+)
+
+// CookieOptions are the name and security attributes of the auth cookie.
+// Domain and Secure also apply to the flash cookie. Cookies set on requests
+// that came in over HTTPS are always Secure.
+type CookieOptions struct {
+	Name     string
+	Domain   string
+	Secure   bool
+	SameSite http.SameSite
+}
+
+var cookieOptions = CookieOptions{Name: "token", SameSite: http.SameSiteStrictMode}
+
+func SetCookieOptions(options CookieOptions) {
+	cookieOptions = options
+}
+
+// SetAuthCookie stores the session token for the given lifetime
+func SetAuthCookie(w http.ResponseWriter, r *http.Request, token string, expiration time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieOptions.Name,
+		Value:    token,
+		Path:     "/",
+		Domain:   cookieOptions.Domain,
+		MaxAge:   int(expiration.Seconds()),
+		HttpOnly: true,
+		Secure:   secureCookie(r),
+		SameSite: cookieOptions.SameSite,
+	})
+}
+
+// ClearAuthCookie logs the browser out
+func ClearAuthCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieOptions.Name,
+		Value:    "",
+		Path:     "/",
+		Domain:   cookieOptions.Domain,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secureCookie(r),
+		SameSite: cookieOptions.SameSite,
+	})
+}
+
+func secureCookie(r *http.Request) bool {
+	return cookieOptions.Secure || RequestScheme(r) == "https"
+}
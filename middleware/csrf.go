@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"mime"
+	"net/http"
+)
+
+// CSRFField and CSRFHeader carry the CSRF token of unsafe requests: forms
+// send the field, htmx and scripts the header. Multipart forms send the field
+// in their URL, since reading their body is up to the handler and its size
+// limit.
+const (
+	CSRFField  = "csrf_token"
+	CSRFHeader = "X-CSRF-Token"
+)
+
+// csrfCookieName is the cookie holding the browser's CSRF token, named after
+// the auth cookie
+func csrfCookieName() string {
+	return cookieOptions.Name + "_csrf"
+}
+
+// CSRFToken returns the token the browser's forms must send, setting the
+// cookie holding it if the browser has none yet
+func CSRFToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookieName()); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	cookie := &http.Cookie{
+		Name:     csrfCookieName(),
+		Value:    base64.RawURLEncoding.EncodeToString(buf),
+		Path:     "/",
+		Domain:   cookieOptions.Domain,
+		HttpOnly: true,
+		Secure:   secureCookie(r),
+		// Like the auth cookie, so pages embedded with COOKIE_SAMESITE=none
+		// can post their forms
+		SameSite: cookieOptions.SameSite,
+	}
+	http.SetCookie(w, cookie)
+	// Later calls for the same request return the same token
+	r.AddCookie(cookie)
+	return cookie.Value
+}
+
+// CSRF refuses unsafe requests that do not send the browser's CSRF token, so
+// other sites cannot make a logged in browser submit forms whatever
+// COOKIE_SAMESITE allows. Requests authenticated with only a bearer token are
+// left alone, browsers do not send those on their own.
+func CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, bearer := requestToken(r); bearer {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sent := r.Header.Get(CSRFHeader)
+		if sent == "" {
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+				sent = r.URL.Query().Get(CSRFField)
+			} else {
+				sent = r.PostFormValue(CSRFField)
+			}
+		}
+
+		cookie, err := r.Cookie(csrfCookieName())
+		if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(cookie.Value)) != 1 {
+			http.Error(w, "This form has expired, reload the page and try again", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
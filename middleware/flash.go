@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const flashCookieName = "flash"
+
+// Flash carries one-shot status messages across a redirect
+type Flash struct {
+	Error   string `json:"error,omitempty"`
+	Success string `json:"success,omitempty"`
+	// Form holds the values of a rejected submission so the form can be filled in again
+	Form map[string]string `json:"form,omitempty"`
+}
+
+// SetFlash stores messages in a signed cookie to be shown on the next page
+func SetFlash(w http.ResponseWriter, r *http.Request, flash Flash) {
+	payload, err := json.Marshal(flash)
+	if err != nil {
+		return
+	}
+	value := base64.RawURLEncoding.EncodeToString(payload)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookieName,
+		Value:    value + "." + signFlash(value),
+		Path:     "/",
+		Domain:   cookieOptions.Domain,
+		MaxAge:   60,
+		HttpOnly: true,
+		Secure:   secureCookie(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// PopFlash returns and clears the pending flash messages. Cookies that were
+// not signed by this server are ignored.
+func PopFlash(w http.ResponseWriter, r *http.Request) Flash {
+	cookie, err := r.Cookie(flashCookieName)
+	if err != nil {
+		return Flash{}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookieName,
+		Value:    "",
+		Path:     "/",
+		Domain:   cookieOptions.Domain,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secureCookie(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	value, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(signFlash(value))) {
+		return Flash{}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return Flash{}
+	}
+
+	var flash Flash
+	if err := json.Unmarshal(payload, &flash); err != nil {
+		return Flash{}
+	}
+	return flash
+}
+
+func signFlash(value string) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte("flash:" + value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
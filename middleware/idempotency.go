@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"overtime/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// idempotencyKeyTTL is how long the response to a request with an
+// Idempotency-Key is replayed
+const idempotencyKeyTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLength is the longest Idempotency-Key accepted
+const maxIdempotencyKeyLength = 255
+
+// maxIdempotentBody limits the request bodies read for their fingerprint
+const maxIdempotentBody = 1 << 20
+
+// Idempotent lets clients retry a request safely by sending the same
+// Idempotency-Key header: the first response is stored and replayed to every
+// retry within idempotencyKeyTTL, marked with Idempotent-Replayed: true. A
+// key reused for a different request is refused with 422, a retry while the
+// first request is still running with 409. Server errors are not stored, so
+// such requests can be retried. Requests without the header pass through. It
+// must run after AuthMiddleware.
+func Idempotent(db *gorm.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("Idempotency-Key")
+			user := GetUserFromContext(r.Context())
+			if key == "" || user == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+			if err != nil {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			sum := sha256.New()
+			io.WriteString(sum, r.Method+" "+r.URL.Path+"\n")
+			sum.Write(body)
+			fingerprint := hex.EncodeToString(sum.Sum(nil))
+
+			rdb := db.WithContext(r.Context())
+			rdb.Where("user_id = ? AND created_at < ?", user.ID, time.Now().Add(-idempotencyKeyTTL)).Delete(&models.IdempotencyKey{})
+
+			record := models.IdempotencyKey{UserID: user.ID, Key: key, Fingerprint: fingerprint}
+			result := rdb.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+			if result.Error != nil {
+				http.Error(w, "Failed to store the Idempotency-Key", http.StatusInternalServerError)
+				return
+			}
+
+			// The key was used before
+			if result.RowsAffected == 0 {
+				var existing models.IdempotencyKey
+				if err := rdb.Where("user_id = ? AND key = ?", user.ID, key).First(&existing).Error; err != nil {
+					http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+					return
+				}
+				switch {
+				case existing.Fingerprint != fingerprint:
+					http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+				case !existing.Completed():
+					http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+				default:
+					if existing.ContentType != "" {
+						w.Header().Set("Content-Type", existing.ContentType)
+					}
+					w.Header().Set("Idempotent-Replayed", "true")
+					w.WriteHeader(existing.Status)
+					w.Write(existing.Body)
+				}
+				return
+			}
+
+			rw := &recordingWriter{ResponseWriter: w}
+			next.ServeHTTP(rw, r)
+
+			// The request may have been cancelled, the key must be settled
+			// regardless
+			if rw.status == 0 || rw.status >= http.StatusInternalServerError || r.Context().Err() != nil {
+				db.Delete(&record)
+				return
+			}
+			db.Model(&record).Updates(map[string]interface{}{
+				"status":       rw.status,
+				"content_type": w.Header().Get("Content-Type"),
+				"body":         rw.body.Bytes(),
+			})
+		})
+	}
+}
+
+// recordingWriter keeps a copy of the response it writes
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
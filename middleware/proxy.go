@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+var trustedProxies []*net.IPNet
+
+func SetTrustedProxies(networks []*net.IPNet) {
+	trustedProxies = networks
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProxyHeaders applies X-Forwarded-For, X-Forwarded-Proto and
+// X-Forwarded-Host to requests from trusted proxies: the remote address
+// becomes the client's, and the URL scheme and host become those the client
+// used. Requests from anywhere else are left alone so the headers cannot be
+// spoofed.
+func ProxyHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isTrustedProxy(net.ParseIP(ClientIP(r))) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Each proxy appends the address it received the request from, so
+		// the client is the rightmost address that is not one of ours
+		var forwardedFor []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			forwardedFor = append(forwardedFor, strings.Split(header, ",")...)
+		}
+		for i := len(forwardedFor) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(forwardedFor[i]))
+			if ip == nil {
+				break
+			}
+			r.RemoteAddr = ip.String()
+			if !isTrustedProxy(ip) {
+				break
+			}
+		}
+
+		if proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			r.URL.Scheme = proto
+		}
+		if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+			r.Host = host
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ClientIP returns the address of the client, which is the proxy's unless the
+// request passed through ProxyHeaders
+func ClientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// RequestScheme returns http or https, whichever the client used
+func RequestScheme(r *http.Request) string {
+	if r.URL.Scheme != "" {
+		return r.URL.Scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// RequestBaseURL returns the scheme and host the client used to reach the
+// server
+func RequestBaseURL(r *http.Request) string {
+	return RequestScheme(r) + "://" + r.Host
+}
@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"overtime/models"
+	"overtime/ratelimit"
+
+	"gorm.io/gorm"
+)
+
+// SessionUsage counts the requests of each session in memory and adds them
+// to the sessions in the database every flush interval, so that requests do
+// not each write their session. Every replica adds its own counts.
+type SessionUsage struct {
+	db *gorm.DB
+
+	mu     sync.Mutex
+	counts map[uint]*sessionCount
+}
+
+type sessionCount struct {
+	requests  int
+	throttled int
+	usedAt    time.Time
+}
+
+func NewSessionUsage(db *gorm.DB) *SessionUsage {
+	return &SessionUsage{db: db, counts: map[uint]*sessionCount{}}
+}
+
+// count records a request of the session, throttled if it was over the limit
+func (u *SessionUsage) count(sessionID uint, throttled bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	c, ok := u.counts[sessionID]
+	if !ok {
+		c = &sessionCount{}
+		u.counts[sessionID] = c
+	}
+	c.requests++
+	if throttled {
+		c.throttled++
+	}
+	c.usedAt = time.Now()
+}
+
+// Run flushes the counts every interval. It never returns.
+func (u *SessionUsage) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		u.Flush()
+	}
+}
+
+// Flush adds the counts collected since the last flush to the sessions.
+// Counts that fail to be written are kept for the next flush.
+func (u *SessionUsage) Flush() {
+	u.mu.Lock()
+	counts := u.counts
+	u.counts = map[uint]*sessionCount{}
+	u.mu.Unlock()
+
+	for sessionID, c := range counts {
+		err := u.db.Model(&models.Session{}).Where("id = ?", sessionID).UpdateColumns(map[string]interface{}{
+			"api_requests":  gorm.Expr("api_requests + ?", c.requests),
+			"api_throttled": gorm.Expr("api_throttled + ?", c.throttled),
+			"api_used_at":   gorm.Expr("GREATEST(COALESCE(api_used_at, ?), ?)", c.usedAt, c.usedAt),
+		}).Error
+		if err != nil {
+			log.Printf("Session usage: failed to count requests of session %d: %v", sessionID, err)
+			u.restore(sessionID, c)
+		}
+	}
+}
+
+// restore puts back counts that could not be written
+func (u *SessionUsage) restore(sessionID uint, c *sessionCount) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	current, ok := u.counts[sessionID]
+	if !ok {
+		u.counts[sessionID] = c
+		return
+	}
+	current.requests += c.requests
+	current.throttled += c.throttled
+	if c.usedAt.After(current.usedAt) {
+		current.usedAt = c.usedAt
+	}
+}
+
+// LimitSessions limits the authenticated requests per session and counts
+// them in usage, whether they send the cookie or the session's token as a
+// bearer token: a script can send the cookie as well as a browser. A
+// session's own APIRateLimit takes the place of the limiter's. Every
+// request is told its usage in X-RateLimit-* headers, requests over the
+// limit are answered with 429 Too Many Requests. It must run after
+// AuthMiddleware.
+func LimitSessions(usage *SessionUsage, limiter *ratelimit.Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session := GetSessionFromContext(r.Context())
+			if session == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := strconv.FormatUint(uint64(session.ID), 10)
+			hit := limiter.Hit(key)
+			if session.APIRateLimit > 0 {
+				hit = limiter.HitLimit(key, session.APIRateLimit)
+			}
+			if hit.Limit > 0 {
+				w.Header().Set("X-RateLimit-Limit", strconv.Itoa(hit.Limit))
+				w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(hit.Remaining))
+				w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(hit.Reset.Unix(), 10))
+			}
+			usage.count(session.ID, !hit.Allowed)
+
+			if !hit.Allowed {
+				retry := math.Ceil(time.Until(hit.Reset).Seconds())
+				if retry < 1 {
+					retry = 1
+				}
+				w.Header().Set("Retry-After", strconv.Itoa(int(retry)))
+				http.Error(w, "Too many requests with this session, try again later", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
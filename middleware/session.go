@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"overtime/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const SessionContextKey contextKey = "session"
+
+// sessionTouchInterval limits how often a session's last activity is written
+const sessionTouchInterval = time.Minute
+
+// userAgentLength is the longest user agent stored with a session
+const userAgentLength = 512
+
+// StartSession records a new session for user on the requesting device and
+// sets its auth cookie
+func StartSession(db *gorm.DB, w http.ResponseWriter, r *http.Request, user *models.User, expiration time.Duration) error {
+	code, err := models.GenerateApprovalCode()
+	if err != nil {
+		return err
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > userAgentLength {
+		userAgent = userAgent[:userAgentLength]
+	}
+
+	now := time.Now()
+	session := models.Session{
+		Code:       code,
+		UserID:     user.ID,
+		UserAgent:  userAgent,
+		IP:         ClientIP(r),
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(expiration),
+	}
+
+	// Sessions that can no longer be used are of no interest to anyone
+	db.Where("user_id = ? AND (expires_at < ? OR revoked_at IS NOT NULL)", user.ID, now).Delete(&models.Session{})
+
+	if err := db.Create(&session).Error; err != nil {
+		return err
+	}
+
+	token, err := GenerateToken(user, code, expiration)
+	if err != nil {
+		return err
+	}
+
+	SetAuthCookie(w, r, token, expiration)
+	return nil
+}
+
+// loadSession returns the active session a token refers to. Sessions of
+// deactivated users are not active.
+func loadSession(db *gorm.DB, claims *Claims) (*models.Session, bool) {
+	if claims.ID == "" {
+		return nil, false
+	}
+
+	var session models.Session
+	if err := db.Preload("User").Where("code = ?", claims.ID).First(&session).Error; err != nil {
+		return nil, false
+	}
+	if session.UserID != claims.UserID || !session.IsActive() {
+		return nil, false
+	}
+	if session.User == nil || session.User.DeactivatedAt != nil {
+		return nil, false
+	}
+	return &session, true
+}
+
+// touchSession records activity on the session, at most once per
+// sessionTouchInterval
+func touchSession(db *gorm.DB, r *http.Request, session *models.Session) {
+	if time.Since(session.LastSeenAt) < sessionTouchInterval {
+		return
+	}
+
+	session.LastSeenAt = time.Now()
+	session.IP = ClientIP(r)
+	db.Model(session).Updates(map[string]interface{}{
+		"last_seen_at": session.LastSeenAt,
+		"ip":           session.IP,
+	})
+}
+
+// RevokeSession logs the session's device out
+func RevokeSession(db *gorm.DB, session *models.Session) error {
+	return db.Model(session).Update("revoked_at", time.Now()).Error
+}
+
+func GetSessionFromContext(ctx context.Context) *models.Session {
+	session, ok := ctx.Value(SessionContextKey).(*models.Session)
+	if !ok {
+		return nil
+	}
+	return session
+}
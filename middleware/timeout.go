@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Timeout cancels the request context after d, which aborts the database
+// queries still running for the request. If the context is done before the
+// handler answered, because of the timeout or because the client went away,
+// expired answers instead of the handler. A zero d only cancels requests of
+// clients that went away.
+func Timeout(d time.Duration, expired http.HandlerFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if d > 0 {
+				ctx, cancel := context.WithTimeout(r.Context(), d)
+				defer cancel()
+				r = r.WithContext(ctx)
+			}
+
+			tw := &timeoutWriter{ResponseWriter: w, r: r, expired: expired}
+			next.ServeHTTP(tw, r)
+			if !tw.wroteHeader && r.Context().Err() != nil {
+				tw.expire()
+			}
+		})
+	}
+}
+
+// timeoutWriter replaces the handler's answer with the expired one when the
+// request context is done by the time the handler starts answering
+type timeoutWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	expired     http.HandlerFunc
+	wroteHeader bool
+	// discard drops the rest of the handler's answer once it was replaced
+	discard bool
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	if tw.wroteHeader {
+		return
+	}
+	if tw.r.Context().Err() != nil {
+		tw.expire()
+		return
+	}
+	tw.wroteHeader = true
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	if tw.discard {
+		return len(b), nil
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+func (tw *timeoutWriter) Flush() {
+	if flusher, ok := tw.ResponseWriter.(http.Flusher); ok && !tw.discard {
+		flusher.Flush()
+	}
+}
+
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// expire answers with expired, dropping the headers the handler had set, e.g.
+// those of a CSV download
+func (tw *timeoutWriter) expire() {
+	tw.wroteHeader = true
+	tw.discard = true
+
+	header := tw.ResponseWriter.Header()
+	for key := range header {
+		delete(header, key)
+	}
+
+	if errors.Is(tw.r.Context().Err(), context.DeadlineExceeded) {
+		log.Printf("%s %s timed out", tw.r.Method, tw.r.URL.Path)
+	}
+	tw.expired(tw.ResponseWriter, tw.r)
+}
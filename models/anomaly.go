@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+)
+
+// Kinds of overtime anomalies
+const (
+	AnomalyUser = "user"
+	AnomalyTeam = "team"
+)
+
+// AnomalyAlert records that HR was told about unusual overtime of a user or
+// team in a month, so each anomaly is only reported once
+type AnomalyAlert struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	OrganizationID uint      `gorm:"index" json:"organization_id"`
+	Kind           string    `gorm:"not null;size:20;uniqueIndex:idx_anomaly_alerts_subject_month,priority:1" json:"kind"`
+	SubjectID      uint      `gorm:"not null;uniqueIndex:idx_anomaly_alerts_subject_month,priority:2" json:"subject_id"`
+	// Month is the month of the anomaly as YYYY-MM
+	Month string `gorm:"not null;size:7;uniqueIndex:idx_anomaly_alerts_subject_month,priority:3" json:"month"`
+	// Hours were booked in the month when the anomaly was found, Average is
+	// the monthly average they were compared with
+	Hours   float64 `json:"hours"`
+	Average float64 `json:"average"`
+}
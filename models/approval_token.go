@@ -0,0 +1,35 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// ApprovalToken backs a one-click approval link emailed to an approver.
+// The link carries a signed token referencing Code, so it stops working
+// once UsedAt is set or ExpiresAt has passed.
+type ApprovalToken struct {
+	ID         uint           `gorm:"primaryKey" json:"id"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+	Code       string         `gorm:"uniqueIndex;not null;size:64" json:"-"`
+	EntryID    uint           `gorm:"not null;index" json:"entry_id"`
+	Entry      *OvertimeEntry `gorm:"foreignKey:EntryID" json:"entry,omitempty"`
+	ApproverID uint           `gorm:"not null;index" json:"approver_id"`
+	Approver   *User          `gorm:"foreignKey:ApproverID" json:"approver,omitempty"`
+	ExpiresAt  time.Time      `gorm:"not null" json:"expires_at"`
+	UsedAt     *time.Time     `json:"used_at"`
+}
+
+func GenerateApprovalCode() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+func (t *ApprovalToken) IsValid() bool {
+	return t.UsedAt == nil && time.Now().Before(t.ExpiresAt)
+}
@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// Audited actions
+const (
+	AuditMagicLinkRequested = "magic_link_requested"
+	AuditMagicLinkLogin     = "magic_link_login"
+	AuditSessionRevoked     = "session_revoked"
+	AuditUserAnonymized     = "user_anonymized"
+	AuditEntriesBulkEdited  = "entries_bulk_edited"
+	AuditUsersMerged        = "users_merged"
+	AuditUserSignedUp       = "user_signed_up"
+	AuditSignupVerified     = "signup_verified"
+	AuditUserActivated      = "user_activated"
+	AuditUserRejected       = "user_rejected"
+	AuditEntryCorrected     = "entry_corrected"
+	AuditMonthClosed        = "month_closed"
+	AuditExportLegalHold    = "export_legal_hold"
+	AuditUserSynced         = "user_synced"
+	AuditMembershipChanged  = "membership_changed"
+	AuditBalanceExpired     = "balance_expired"
+	AuditBalanceAdjusted    = "balance_adjusted"
+	AuditPayoutApproved     = "payout_approved"
+	AuditTokenRateLimited   = "token_rate_limited"
+)
+
+// AuditLog records security relevant actions. UserID is the user the action
+// concerns and is nil when nobody could be identified.
+type AuditLog struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt      time.Time `gorm:"index" json:"created_at"`
+	OrganizationID uint      `gorm:"index" json:"organization_id"`
+	UserID         *uint     `gorm:"index" json:"user_id"`
+	User           *User     `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	Action         string    `gorm:"not null;size:64;index" json:"action"`
+	Detail         string    `gorm:"type:text" json:"detail"`
+	IP             string    `gorm:"size:64" json:"ip"`
+}
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// Avatar is the picture a user uploaded, already cropped and scaled to a
+// small square PNG. It lives apart from User so lists of users do not load
+// the image data.
+type Avatar struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UserID    uint      `gorm:"uniqueIndex;not null" json:"user_id"`
+	User      *User     `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	Data      []byte    `gorm:"not null" json:"-"`
+}
@@ -0,0 +1,106 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// BalancePeriod is how often a balance rule is applied
+type BalancePeriod string
+
+const (
+	PeriodMonth   BalancePeriod = "MONTH"
+	PeriodQuarter BalancePeriod = "QUARTER"
+	PeriodYear    BalancePeriod = "YEAR"
+)
+
+func (p BalancePeriod) Valid() bool {
+	return p == PeriodMonth || p == PeriodQuarter || p == PeriodYear
+}
+
+// Label names the end of the period, e.g. "month end"
+func (p BalancePeriod) Label() string {
+	switch p {
+	case PeriodMonth:
+		return "month end"
+	case PeriodQuarter:
+		return "quarter end"
+	default:
+		return "year end"
+	}
+}
+
+// Before returns the last period that ended on or before date: its start,
+// its end, which is the start of the next one, and its name, e.g. "2026-Q3"
+func (p BalancePeriod) Before(date time.Time) (start, end time.Time, name string) {
+	switch p {
+	case PeriodMonth:
+		end = time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
+		start = end.AddDate(0, -1, 0)
+		return start, end, start.Format("2006-01")
+	case PeriodQuarter:
+		end = time.Date(date.Year(), (date.Month()-1)/3*3+1, 1, 0, 0, 0, 0, time.UTC)
+		start = end.AddDate(0, -3, 0)
+		return start, end, fmt.Sprintf("%d-Q%d", start.Year(), (int(start.Month())-1)/3+1)
+	default:
+		end = time.Date(date.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+		start = end.AddDate(-1, 0, 0)
+		return start, end, start.Format("2006")
+	}
+}
+
+// BalanceRule limits the balance users carry over into the next period: at
+// the end of every period, the hours above MaxHours expire. Rules apply to
+// the periods ending after they were created.
+type BalanceRule struct {
+	ID             uint          `gorm:"primaryKey" json:"id"`
+	CreatedAt      time.Time     `json:"created_at"`
+	OrganizationID uint          `gorm:"index" json:"organization_id"`
+	Period         BalancePeriod `gorm:"not null;size:10" json:"period"`
+	MaxHours       float64       `gorm:"not null" json:"max_hours"`
+}
+
+// Label describes the rule, e.g. "carry over at most 20h at year end"
+func (r *BalanceRule) Label() string {
+	return fmt.Sprintf("carry over at most %gh at %s", r.MaxHours, r.Period.Label())
+}
+
+// CompensationKind says why a compensation changed a balance
+type CompensationKind string
+
+const (
+	// CompensationExpiry takes the hours a balance rule let expire
+	CompensationExpiry CompensationKind = "EXPIRY"
+	// CompensationAdjustment is a correction HR or an admin made by hand,
+	// e.g. after a migration error or a settlement
+	CompensationAdjustment CompensationKind = "ADJUSTMENT"
+	// CompensationPayout takes the hours of an approved payout request
+	CompensationPayout CompensationKind = "PAYOUT"
+)
+
+// Compensation changes a user's overtime balance outside of entries and time
+// off. Negative hours are taken off the balance.
+type Compensation struct {
+	ID             uint             `gorm:"primaryKey" json:"id"`
+	CreatedAt      time.Time        `json:"created_at"`
+	OrganizationID uint             `gorm:"index" json:"organization_id"`
+	UserID         uint             `gorm:"not null;index" json:"user_id"`
+	User           User             `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	Date           time.Time        `gorm:"not null;type:date" json:"date"`
+	Hours          float64          `gorm:"not null" json:"hours"`
+	Kind           CompensationKind `gorm:"not null;size:20" json:"kind"`
+	Reason         string           `gorm:"size:500" json:"reason"`
+	// CreatedBy is nil for compensations the system generated
+	CreatedBy *uint `json:"created_by"`
+	Creator   *User `gorm:"foreignKey:CreatedBy" json:"creator,omitempty"`
+	// RuleID and Period identify the balance rule and the period, as named by
+	// BalancePeriod.Before, an expiry was applied for
+	RuleID *uint  `gorm:"index" json:"rule_id,omitempty"`
+	Period string `gorm:"size:10" json:"period,omitempty"`
+}
+
+// SystemGenerated reports whether the compensation was applied by the
+// system rather than by a person
+func (c *Compensation) SystemGenerated() bool {
+	return c.CreatedBy == nil
+}
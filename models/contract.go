@@ -0,0 +1,56 @@
+package models
+
+import (
+	"time"
+)
+
+// Contract is an employee's agreed working time from ValidFrom until the
+// user's next contract starts. Users without a contract count as full-time.
+type Contract struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	OrganizationID uint      `gorm:"index" json:"organization_id"`
+	UserID         uint      `gorm:"not null;uniqueIndex:idx_contracts_user_valid_from,priority:1" json:"user_id"`
+	ValidFrom      time.Time `gorm:"not null;type:date;uniqueIndex:idx_contracts_user_valid_from,priority:2" json:"valid_from"`
+	// WeeklyHours are the hours worked in a regular week
+	WeeklyHours float64 `gorm:"not null" json:"weekly_hours"`
+	// PartTimePercent is the share of a full-time position, 100 for full-time
+	PartTimePercent float64 `gorm:"not null;default:100" json:"part_time_percent"`
+}
+
+// FullTimeWeeklyHours are the weekly hours of users without a contract
+const FullTimeWeeklyHours = 40
+
+// DailyHours are the hours of a regular working day, assuming a five day
+// week. A nil contract counts as full-time.
+func (c *Contract) DailyHours() float64 {
+	if c == nil {
+		return FullTimeWeeklyHours / 5
+	}
+	return c.WeeklyHours / 5
+}
+
+// PartTimeFactor scales limits meant for full-time staff, a nil contract
+// counts as full-time
+func (c *Contract) PartTimeFactor() float64 {
+	if c == nil {
+		return 1
+	}
+	return c.PartTimePercent / 100
+}
+
+// ContractOn returns the contract in effect on day, or nil if none of the
+// contracts started by then. Days are compared by date, whatever their
+// time zone.
+func ContractOn(contracts []Contract, day time.Time) *Contract {
+	date := day.Format("2006-01-02")
+	var current *Contract
+	for i := range contracts {
+		from := contracts[i].ValidFrom.Format("2006-01-02")
+		if from <= date && (current == nil || from > current.ValidFrom.Format("2006-01-02")) {
+			current = &contracts[i]
+		}
+	}
+	return current
+}
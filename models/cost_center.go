@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+)
+
+// CostCenter is what payroll books overtime on. Users are booked on their
+// own cost center if they have one, otherwise on their team's.
+type CostCenter struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Codes are unique within an organization
+	OrganizationID uint   `gorm:"uniqueIndex:idx_cost_centers_organization_code,priority:1" json:"organization_id"`
+	Code           string `gorm:"uniqueIndex:idx_cost_centers_organization_code,priority:2;not null;size:50" json:"code"`
+	Name           string `gorm:"size:200" json:"name"`
+}
+
+// Label returns the code followed by the name, if there is one
+func (c *CostCenter) Label() string {
+	if c.Name == "" {
+		return c.Code
+	}
+	return c.Code + " " + c.Name
+}
@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// ExportArchive is a copy of a generated monthly export, kept to prove what
+// was handed out, e.g. to payroll. Checksum is the hex encoded SHA-256 of
+// Data.
+type ExportArchive struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt      time.Time `gorm:"index" json:"created_at"`
+	OrganizationID uint      `gorm:"index" json:"organization_id"`
+	// Month is the exported month as YYYY-MM
+	Month    string `gorm:"not null;size:7;index" json:"month"`
+	Filename string `gorm:"size:255" json:"filename"`
+	Format   string `gorm:"size:20" json:"format"`
+	// Generator says what produced the export, e.g. a user's download or a
+	// delivery to an export destination
+	Generator string `gorm:"size:255" json:"generator"`
+	// Filters are the filters a download was limited by, as a query string
+	Filters  string `gorm:"size:255" json:"filters"`
+	Checksum string `gorm:"not null;size:64;index" json:"checksum"`
+	Size     int    `json:"size"`
+	Data     []byte `json:"-"`
+}
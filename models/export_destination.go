@@ -0,0 +1,70 @@
+package models
+
+import (
+	"time"
+)
+
+// Kinds of export destinations
+const (
+	DestinationDir  = "DIR"
+	DestinationSFTP = "SFTP"
+	DestinationS3   = "S3"
+)
+
+// ExportDestination is where an organization's monthly overtime export is
+// delivered to, e.g. payroll's SFTP server. The previous month's export is
+// sent on Day of every month.
+type ExportDestination struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	OrganizationID uint      `gorm:"index" json:"organization_id"`
+	Name           string    `gorm:"not null;size:100" json:"name"`
+	Kind           string    `gorm:"not null;size:10" json:"kind"`
+	// Host is the SFTP server as host:port or the S3 endpoint URL
+	Host string `gorm:"size:255" json:"host"`
+	// HostKey is the SFTP server's public key in authorized_keys format, the
+	// connection is refused if the server presents another one
+	HostKey string `gorm:"size:1000" json:"host_key"`
+	Bucket  string `gorm:"size:255" json:"bucket"`
+	Region  string `gorm:"size:50" json:"region"`
+	// Path is the directory on the SFTP server, below DELIVERY_DIR for
+	// directories or the key prefix in the S3 bucket
+	Path string `gorm:"size:255" json:"path"`
+	// Username and Password log into the SFTP server, for S3 they are the
+	// access key and the secret key
+	Username string `gorm:"size:255" json:"username"`
+	Password string `gorm:"size:255" json:"-"`
+	Format   string `gorm:"not null;size:20" json:"format"`
+	Day      int    `gorm:"not null;default:1" json:"day"`
+	Enabled  bool   `gorm:"not null;default:true" json:"enabled"`
+}
+
+// KindLabel names the kind of destination for display
+func (d *ExportDestination) KindLabel() string {
+	switch d.Kind {
+	case DestinationSFTP:
+		return "SFTP"
+	case DestinationS3:
+		return "S3"
+	default:
+		return "Directory"
+	}
+}
+
+// ExportDelivery logs an attempt to deliver a month's export to a
+// destination. Error is empty for successful deliveries.
+type ExportDelivery struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	OrganizationID uint      `gorm:"index" json:"organization_id"`
+	DestinationID  uint      `gorm:"not null;index:idx_export_deliveries_destination_month,priority:1" json:"destination_id"`
+	// Month is the exported month as YYYY-MM
+	Month    string `gorm:"not null;size:7;index:idx_export_deliveries_destination_month,priority:2" json:"month"`
+	Filename string `gorm:"size:255" json:"filename"`
+	Error    string `gorm:"size:1000" json:"error"`
+}
+
+func (d *ExportDelivery) Succeeded() bool {
+	return d.Error == ""
+}
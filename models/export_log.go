@@ -0,0 +1,38 @@
+package models
+
+import "time"
+
+// Kinds of exports in the export log
+const (
+	ExportOvertime     = "overtime"
+	ExportSupervisor   = "supervisor"
+	ExportCompliance   = "compliance"
+	ExportMatrix       = "matrix"
+	ExportArchived     = "archive"
+	ExportMonthArchive = "month_archive"
+	ExportPersonalData = "personal_data"
+	ExportUsers        = "users"
+)
+
+// ExportLog records a download of personal data, to account for who took
+// which data out of the application. Entries on LegalHold are exempt from
+// the retention policy.
+type ExportLog struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt      time.Time `gorm:"index" json:"created_at"`
+	OrganizationID uint      `gorm:"index" json:"organization_id"`
+	UserID         uint      `gorm:"not null;index" json:"user_id"`
+	User           *User     `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	Kind           string    `gorm:"not null;size:32;index" json:"kind"`
+	Filename       string    `gorm:"size:255" json:"filename"`
+	Format         string    `gorm:"size:20" json:"format"`
+	// Filters are the filters the export was limited by, as a query string
+	Filters string `gorm:"size:255" json:"filters"`
+	// Rows is how many records of people the export held, nil for archived
+	// files that are handed out as they were stored
+	Rows *int `json:"rows"`
+	// Pseudonymized exports named no one, see worksCouncilView
+	Pseudonymized bool   `gorm:"not null;default:false" json:"pseudonymized"`
+	IP            string `gorm:"size:64" json:"ip"`
+	LegalHold     bool   `gorm:"not null;default:false" json:"legal_hold"`
+}
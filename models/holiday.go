@@ -0,0 +1,35 @@
+package models
+
+import (
+	"time"
+)
+
+// Holiday is a public holiday of an organization. Overtime worked on it is
+// flagged like overtime on weekends.
+type Holiday struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	// An organization has one holiday per date
+	OrganizationID uint      `gorm:"uniqueIndex:idx_holidays_organization_date,priority:1" json:"organization_id"`
+	Date           time.Time `gorm:"not null;type:date;uniqueIndex:idx_holidays_organization_date,priority:2" json:"date"`
+	Name           string    `gorm:"size:100" json:"name"`
+}
+
+// Kinds of days entries are flagged with
+const (
+	DayWeekend = "WEEKEND"
+	DayHoliday = "HOLIDAY"
+)
+
+// DayKind returns what kind of day the date is: DayHoliday if it is one of
+// the organization's holidays, DayWeekend on Saturdays and Sundays, and empty
+// on working days
+func DayKind(date time.Time, holiday bool) string {
+	if holiday {
+		return DayHoliday
+	}
+	if weekday := date.Weekday(); weekday == time.Saturday || weekday == time.Sunday {
+		return DayWeekend
+	}
+	return ""
+}
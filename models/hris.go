@@ -0,0 +1,44 @@
+package models
+
+import "time"
+
+// Kinds of HR systems users are synced from
+const (
+	HRISPersonio = "PERSONIO"
+	HRISBambooHR = "BAMBOOHR"
+)
+
+// HRISConnection syncs an organization's users from its HR system, the source
+// of truth for their names, email addresses, teams and contract hours. Users
+// are matched to employees by User.HRISID, or by email address the first time.
+type HRISConnection struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	OrganizationID uint      `gorm:"uniqueIndex" json:"organization_id"`
+	Kind           string    `gorm:"not null;size:20" json:"kind"`
+	// Company is the BambooHR company subdomain
+	Company string `gorm:"size:100" json:"company"`
+	// ClientID and Secret are Personio's API credentials, BambooHR only
+	// needs the API key in Secret
+	ClientID string `gorm:"size:255" json:"client_id"`
+	Secret   string `gorm:"size:255" json:"-"`
+	Enabled  bool   `gorm:"not null;default:true" json:"enabled"`
+	// LastResult sums up the changes of the last sync, LastError is empty
+	// when it succeeded
+	LastSyncAt *time.Time `json:"last_sync_at"`
+	LastResult string     `gorm:"size:255" json:"last_result"`
+	LastError  string     `gorm:"size:1000" json:"last_error"`
+}
+
+// KindLabel names the HR system for display
+func (c *HRISConnection) KindLabel() string {
+	switch c.Kind {
+	case HRISPersonio:
+		return "Personio"
+	case HRISBambooHR:
+		return "BambooHR"
+	default:
+		return c.Kind
+	}
+}
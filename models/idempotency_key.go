@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// IdempotencyKey remembers the response to an API request sent with an
+// Idempotency-Key header, so that a client retrying the request gets the
+// original response instead of creating a duplicate. Keys belong to the user
+// who sent them.
+type IdempotencyKey struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_idempotency_keys_user_key" json:"user_id"`
+	Key       string    `gorm:"not null;size:255;uniqueIndex:idx_idempotency_keys_user_key" json:"key"`
+	// Fingerprint is the hex encoded SHA-256 of the request's method, path
+	// and body, a key may not be reused for a different request
+	Fingerprint string `gorm:"not null;size:64" json:"-"`
+	// Status is zero while the request is in progress
+	Status      int    `json:"status"`
+	ContentType string `gorm:"size:255" json:"-"`
+	Body        []byte `json:"-"`
+}
+
+// Completed reports whether the response to the request was stored
+func (k *IdempotencyKey) Completed() bool {
+	return k.Status != 0
+}
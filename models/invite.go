@@ -13,17 +13,25 @@ type Invite struct {
 	CreatedAt time.Time      `json:"created_at"`
 	UpdatedAt time.Time      `json:"updated_at"`
 	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
-	Code      string         `gorm:"uniqueIndex;not null;size:64" json:"code"`
-	FullName  string         `gorm:"not null;size:200" json:"full_name"`
-	Role      Role           `gorm:"not null;size:20" json:"role"`
-	Used      bool           `gorm:"default:false" json:"used"`
-	CreatedBy uint           `gorm:"not null" json:"created_by"`
-	Creator   User           `gorm:"foreignKey:CreatedBy" json:"creator,omitempty"`
-	ExpiresAt time.Time      `gorm:"not null" json:"expires_at"`
-	TeamID    *uint          `gorm:"index" json:"team_id"`
-	Team      *Team          `gorm:"foreignKey:TeamID" json:"team,omitempty"`
-	ProjectID *uint          `gorm:"index" json:"project_id"`
-	Project   *Project       `gorm:"foreignKey:ProjectID" json:"project,omitempty"`
+	// OrganizationID is the organization the invited user joins
+	OrganizationID uint          `gorm:"index" json:"organization_id"`
+	Organization   *Organization `gorm:"foreignKey:OrganizationID" json:"organization,omitempty"`
+	Code           string        `gorm:"uniqueIndex;not null;size:64" json:"code"`
+	FullName       string        `gorm:"not null;size:200" json:"full_name"`
+	Role           Role          `gorm:"not null;size:20" json:"role"`
+	Used           bool          `gorm:"default:false" json:"used"`
+	CreatedBy      uint          `gorm:"not null" json:"created_by"`
+	Creator        User          `gorm:"foreignKey:CreatedBy" json:"creator,omitempty"`
+	ExpiresAt      time.Time     `gorm:"not null" json:"expires_at"`
+	TeamID         *uint         `gorm:"index" json:"team_id"`
+	Team           *Team         `gorm:"foreignKey:TeamID" json:"team,omitempty"`
+	ProjectID      *uint         `gorm:"index" json:"project_id"`
+	Project        *Project      `gorm:"foreignKey:ProjectID" json:"project,omitempty"`
+	// Email is registered as given when set, the invited user cannot change it
+	Email string `gorm:"size:255" json:"email"`
+	// ShortCode backs the short /i/ link shown with the invite's QR code,
+	// invites created before short links have none
+	ShortCode *string `gorm:"size:16;uniqueIndex" json:"short_code,omitempty"`
 }
 
 func GenerateInviteCode() (string, error) {
@@ -34,6 +42,30 @@ func GenerateInviteCode() (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
+// shortCodeAlphabet leaves out characters that are easily confused when a
+// link is typed from paper
+const shortCodeAlphabet = "23456789abcdefghjkmnpqrstuvwxyz"
+
+// GenerateShortCode returns a random code for a short invite link, short
+// enough to type but too many to guess while an invite is valid
+func GenerateShortCode() (string, error) {
+	code := make([]byte, 10)
+	random := make([]byte, 1)
+	for i := 0; i < len(code); {
+		if _, err := rand.Read(random); err != nil {
+			return "", err
+		}
+		// Reject bytes past the last full multiple of the alphabet so every
+		// character is equally likely
+		if int(random[0]) >= 256-256%len(shortCodeAlphabet) {
+			continue
+		}
+		code[i] = shortCodeAlphabet[int(random[0])%len(shortCodeAlphabet)]
+		i++
+	}
+	return string(code), nil
+}
+
 func (i *Invite) IsValid() bool {
 	return !i.Used && time.Now().Before(i.ExpiresAt)
 }
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+)
+
+// InviteTemplate holds the role, team and project of a kind of invite, so
+// invites for a batch of people can be created at once
+type InviteTemplate struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Template names are unique within an organization
+	OrganizationID uint   `gorm:"uniqueIndex:idx_invite_templates_organization_name,priority:1" json:"organization_id"`
+	Name           string `gorm:"uniqueIndex:idx_invite_templates_organization_name,priority:2;not null;size:100" json:"name"`
+	Role           Role   `gorm:"not null;size:20" json:"role"`
+	// Deleting the team or project leaves templates without one
+	TeamID    *uint    `gorm:"index" json:"team_id"`
+	Team      *Team    `gorm:"foreignKey:TeamID;constraint:OnDelete:SET NULL" json:"team,omitempty"`
+	ProjectID *uint    `gorm:"index" json:"project_id"`
+	Project   *Project `gorm:"foreignKey:ProjectID;constraint:OnDelete:SET NULL" json:"project,omitempty"`
+}
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// JiraAccount maps a user to their Atlassian account so worklogs imported
+// from Jira/Tempo can be attributed to them
+type JiraAccount struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UserID    uint      `gorm:"uniqueIndex;not null" json:"user_id"`
+	User      *User     `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	AccountID string    `gorm:"uniqueIndex;not null;size:128" json:"account_id"`
+}
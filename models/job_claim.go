@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// JobClaim records which replica runs a periodic job until when, for
+// deployments without Redis that run several replicas on one database
+type JobClaim struct {
+	Name         string    `gorm:"primaryKey;size:100" json:"name"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	Owner        string    `gorm:"size:255" json:"owner"`
+	ClaimedUntil time.Time `gorm:"not null" json:"claimed_until"`
+}
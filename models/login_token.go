@@ -0,0 +1,44 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"time"
+)
+
+// LoginTokenVerifySignup is the purpose of links that confirm the email
+// address of an account from open signup
+const LoginTokenVerifySignup = "VERIFY_SIGNUP"
+
+// LoginTokenLinkTelegram is the purpose of the codes users send to the
+// Telegram bot to link their chat. Their Code is what the user sends.
+const LoginTokenLinkTelegram = "LINK_TELEGRAM"
+
+// LoginToken backs an emailed login link. Like ApprovalToken, the link
+// carries a signed token referencing Code and works once before ExpiresAt.
+type LoginToken struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	Code      string     `gorm:"uniqueIndex;not null;size:64" json:"-"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	User      *User      `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	// Purpose is empty for login links, a link for one purpose does not work
+	// for another
+	Purpose string `gorm:"size:20;not null;default:''" json:"purpose,omitempty"`
+}
+
+func (t *LoginToken) IsValid() bool {
+	return t.UsedAt == nil && time.Now().Before(t.ExpiresAt)
+}
+
+// GenerateTelegramLinkCode returns a code short enough to type into a chat
+func GenerateTelegramLinkCode() (string, error) {
+	bytes := make([]byte, 10)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.EncodeToString(bytes), nil
+}
@@ -0,0 +1,38 @@
+package models
+
+import "time"
+
+// MonthClose says how an organization closes months. On Day of every month
+// the previous month is closed, zero leaves months open. Entries dated in
+// ClosedThrough, a month as YYYY-MM, or before can no longer be changed.
+type MonthClose struct {
+	Day           int
+	ClosedThrough string
+	// Format is the export format of the archives
+	Format string
+}
+
+func (c MonthClose) Enabled() bool {
+	return c.Day > 0
+}
+
+// Closed reports whether the month of date is closed
+func (c MonthClose) Closed(date time.Time) bool {
+	return c.ClosedThrough != "" && date.Format("2006-01") <= c.ClosedThrough
+}
+
+// MonthArchive is the export of a month taken when it was closed, kept as
+// it was at the time. Entries and Hours summarize it, Pending are the
+// entries still waiting for approval then.
+type MonthArchive struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	OrganizationID uint      `gorm:"not null;uniqueIndex:idx_month_archives_organization_month,priority:1" json:"organization_id"`
+	// Month is the archived month as YYYY-MM
+	Month    string  `gorm:"not null;size:7;uniqueIndex:idx_month_archives_organization_month,priority:2" json:"month"`
+	Filename string  `gorm:"size:255" json:"filename"`
+	Data     []byte  `json:"-"`
+	Entries  int64   `json:"entries"`
+	Hours    float64 `json:"hours"`
+	Pending  int64   `json:"pending"`
+}
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"math"
+	"time"
+)
+
+// NightWindow is the time of day overtime counts as night work in, from
+// Start to End as HH:MM. A window ending at or before its start runs past
+// midnight. Night hours weigh Multiplier times in costs. The zero value has
+// no night.
+type NightWindow struct {
+	Start      string
+	End        string
+	Multiplier float64
+}
+
+func (n NightWindow) Enabled() bool {
+	return n.Start != "" && n.End != "" && n.Start != n.End
+}
+
+// NightHours returns how many of the entry's hours fall into the window, in
+// proportion to the part of its start to end time that does. Entries without
+// a start and end time have no night hours.
+func (n NightWindow) NightHours(e *OvertimeEntry) float64 {
+	if !n.Enabled() {
+		return 0
+	}
+	start, end, ok := e.WorkPeriod()
+	if !ok {
+		return 0
+	}
+	windowStart, err := time.Parse("15:04", n.Start)
+	if err != nil {
+		return 0
+	}
+	windowEnd, err := time.Parse("15:04", n.End)
+	if err != nil {
+		return 0
+	}
+
+	// Work periods end at most a day after the entry's date, so the windows
+	// starting the day before up to the day after cover them
+	var night time.Duration
+	day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	for offset := -1; offset <= 1; offset++ {
+		from := day.AddDate(0, 0, offset).Add(time.Duration(windowStart.Hour())*time.Hour + time.Duration(windowStart.Minute())*time.Minute)
+		to := day.AddDate(0, 0, offset).Add(time.Duration(windowEnd.Hour())*time.Hour + time.Duration(windowEnd.Minute())*time.Minute)
+		if !to.After(from) {
+			to = to.AddDate(0, 0, 1)
+		}
+		if from.Before(start) {
+			from = start
+		}
+		if to.After(end) {
+			to = end
+		}
+		if to.After(from) {
+			night += to.Sub(from)
+		}
+	}
+
+	share := float64(night) / float64(end.Sub(start))
+	return math.Round(e.Hours*share*100) / 100
+}
+
+// WeightedHours returns the entry's hours with its night hours weighed by the
+// multiplier, what its cost is calculated from
+func (n NightWindow) WeightedHours(e *OvertimeEntry) float64 {
+	night := n.NightHours(e)
+	return e.Hours - night + night*n.Multiplier
+}
@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+)
+
+// Organization is a tenant of the instance, e.g. one subsidiary. Users, teams,
+// projects, entries and invites belong to exactly one organization and are
+// never visible to members of another.
+type Organization struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Name      string    `gorm:"uniqueIndex;not null;size:100" json:"name"`
+}
@@ -1,21 +1,218 @@
 package models
 
 import (
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"gorm.io/gorm"
 )
 
+type EntryStatus string
+
+const (
+	StatusPending  EntryStatus = "PENDING"
+	StatusApproved EntryStatus = "APPROVED"
+	StatusRejected EntryStatus = "REJECTED"
+)
+
+// Class returns the CSS badge suffix for the status
+func (s EntryStatus) Class() string {
+	return strings.ToLower(string(s))
+}
+
+// ApprovalStage identifies which approver a pending entry is waiting for
+type ApprovalStage string
+
+const (
+	StageSupervisor ApprovalStage = "SUPERVISOR"
+	StageHR         ApprovalStage = "HR"
+)
+
 type OvertimeEntry struct {
 	ID          uint           `gorm:"primaryKey" json:"id"`
 	CreatedAt   time.Time      `json:"created_at"`
 	UpdatedAt   time.Time      `json:"updated_at"`
 	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
-	UserID      uint           `gorm:"not null;index" json:"user_id"`
+	UserID      uint           `gorm:"not null;index:idx_overtime_entries_user_date,priority:1" json:"user_id"`
 	User        User           `gorm:"foreignKey:UserID" json:"user,omitempty"`
-	Date        time.Time      `gorm:"not null;type:date" json:"date"`
+	Date        time.Time      `gorm:"not null;type:date;index:idx_overtime_entries_user_date,priority:2;index" json:"date"`
 	Hours       float64        `gorm:"not null" json:"hours"`
 	Description string         `gorm:"size:500" json:"description"`
+	CreatedBy   *uint          `gorm:"index" json:"created_by"`
+	Creator     *User          `gorm:"foreignKey:CreatedBy" json:"creator,omitempty"`
+	UpdatedBy   *uint          `json:"updated_by"`
+	Updater     *User          `gorm:"foreignKey:UpdatedBy" json:"updater,omitempty"`
+	// Entries recorded before approvals were introduced count as approved
+	Status     EntryStatus `gorm:"not null;size:20;default:APPROVED;index" json:"status"`
+	ReviewedBy *uint       `json:"reviewed_by"`
+	Reviewer   *User       `gorm:"foreignKey:ReviewedBy" json:"reviewer,omitempty"`
+	ReviewedAt *time.Time  `json:"reviewed_at"`
+	// ReviewComment holds the reviewer's note, e.g. the reason for a rejection
+	ReviewComment string `gorm:"size:500" json:"review_comment"`
+	// Stage and the supervisor approval fields track two-stage approval chains
+	Stage                ApprovalStage `gorm:"not null;size:20;default:SUPERVISOR" json:"stage"`
+	SupervisorApprovedBy *uint         `json:"supervisor_approved_by"`
+	SupervisorApprover   *User         `gorm:"foreignKey:SupervisorApprovedBy" json:"supervisor_approver,omitempty"`
+	SupervisorApprovedAt *time.Time    `json:"supervisor_approved_at"`
+	// ClientID is generated by the offline app so queued entries sync only once
+	ClientID *string `gorm:"size:64;uniqueIndex" json:"client_id,omitempty"`
+	// ExternalID identifies the record an entry was imported from, e.g. a Tempo worklog
+	ExternalID *string `gorm:"size:128;uniqueIndex" json:"external_id,omitempty"`
+	// OrganizationID is copied from the owner so entry queries can be scoped directly
+	OrganizationID uint `gorm:"index" json:"organization_id"`
+	// WorkedHours is the whole day's work for entries whose overtime was
+	// calculated from worked time, Hours is what exceeds the contract
+	WorkedHours *float64 `json:"worked_hours,omitempty"`
+	// StartTime and EndTime optionally record when the overtime was worked,
+	// as HH:MM on Date. An end at or before the start is on the next day.
+	StartTime *string `gorm:"size:5" json:"start_time,omitempty"`
+	EndTime   *string `gorm:"size:5" json:"end_time,omitempty"`
+	// CorrectedBy is the HR user who last corrected someone else's entry
+	CorrectedBy *uint `json:"corrected_by,omitempty"`
+	Corrector   *User `gorm:"foreignKey:CorrectedBy" json:"corrector,omitempty"`
+	// ProjectID is the project the overtime was worked on, the owner's home
+	// project or one they are a member of
+	ProjectID *uint    `gorm:"index" json:"project_id"`
+	Project   *Project `gorm:"foreignKey:ProjectID;constraint:OnDelete:SET NULL" json:"project,omitempty"`
+	// TeamName and ProjectName are recorded when the entry is logged, so it
+	// keeps them when teams and projects are renamed or reorganized. They are
+	// empty without a team or project.
+	TeamName    string `gorm:"size:100" json:"team_name"`
+	ProjectName string `gorm:"size:100" json:"project_name"`
+	// Acknowledgment is the user's note on an entry that takes their month
+	// over the organization's soft limit, e.g. who agreed to the hours. It is
+	// empty for entries within the limit.
+	Acknowledgment string `gorm:"size:500" json:"acknowledgment,omitempty"`
+	// DayKind flags entries on weekends and holidays, DayWeekend or
+	// DayHoliday. It is empty on working days.
+	DayKind string `gorm:"size:10" json:"day_kind,omitempty"`
+}
+
+// OvertimeRate returns what an hour of the entry's overtime costs: the
+// owner's own rate if set, otherwise the rate of the project it was logged
+// on. User and Project must be loaded.
+func (e *OvertimeEntry) OvertimeRate() float64 {
+	if e.User.HourlyRate != nil {
+		return *e.User.HourlyRate
+	}
+	if e.Project != nil {
+		return e.Project.HourlyRate
+	}
+	return 0
+}
+
+// EntryError is a problem with an entry's values that can be shown to the user as is
+type EntryError string
+
+func (e EntryError) Error() string {
+	return string(e)
+}
+
+const (
+	ErrInvalidDate        EntryError = "Invalid date format"
+	ErrInvalidHours       EntryError = "Invalid hours (must be between 0 and 24)"
+	ErrDescriptionTooLong EntryError = "Description is too long (at most 500 characters)"
+	ErrInvalidWorkedHours EntryError = "Invalid worked hours (must be between 0 and 24)"
+	ErrInvalidTimes       EntryError = "Invalid start or end time (enter both as HH:MM, or neither)"
+	ErrNotOnProject       EntryError = "The employee is not assigned to the project"
+	ErrAcknowledgmentLong EntryError = "Acknowledgment is too long (at most 500 characters)"
+)
+
+// Validate checks the values every new or edited entry must satisfy,
+// whichever way it was recorded
+func (e *OvertimeEntry) Validate() error {
+	if e.Date.IsZero() {
+		return ErrInvalidDate
+	}
+	if e.Hours <= 0 || e.Hours > 24 {
+		return ErrInvalidHours
+	}
+	if utf8.RuneCountInString(e.Description) > 500 {
+		return ErrDescriptionTooLong
+	}
+	if utf8.RuneCountInString(e.Acknowledgment) > 500 {
+		return ErrAcknowledgmentLong
+	}
+	if e.StartTime != nil || e.EndTime != nil {
+		if _, _, ok := e.WorkPeriod(); !ok {
+			return ErrInvalidTimes
+		}
+	}
+	return nil
+}
+
+// WorkPeriod returns when the overtime was worked, or ok false unless the
+// entry has a valid start and end time. The times are on the entry's date in
+// the owner's timezone but returned in UTC, so periods compare as wall clock
+// times.
+func (e *OvertimeEntry) WorkPeriod() (start, end time.Time, ok bool) {
+	if e.StartTime == nil || e.EndTime == nil {
+		return start, end, false
+	}
+	startClock, err := time.Parse("15:04", *e.StartTime)
+	if err != nil {
+		return start, end, false
+	}
+	endClock, err := time.Parse("15:04", *e.EndTime)
+	if err != nil {
+		return start, end, false
+	}
+
+	day := time.Date(e.Date.Year(), e.Date.Month(), e.Date.Day(), 0, 0, 0, 0, time.UTC)
+	start = day.Add(time.Duration(startClock.Hour())*time.Hour + time.Duration(startClock.Minute())*time.Minute)
+	end = day.Add(time.Duration(endClock.Hour())*time.Hour + time.Duration(endClock.Minute())*time.Minute)
+	if !end.After(start) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return start, end, true
+}
+
+// WorkedTime returns the hours worked that day for entries recorded as worked
+// time, zero for declared overtime
+func (e *OvertimeEntry) WorkedTime() float64 {
+	if e.WorkedHours == nil {
+		return 0
+	}
+	return *e.WorkedHours
+}
+
+func (e *OvertimeEntry) IsPending() bool {
+	return e.Status == StatusPending
+}
+
+func (e *OvertimeEntry) IsRejected() bool {
+	return e.Status == StatusRejected
+}
+
+// StatusClass returns the CSS badge suffix for the entry, distinguishing
+// entries that wait for the HR stage of their approval chain
+func (e *OvertimeEntry) StatusClass() string {
+	if e.IsPending() && e.Stage == StageHR {
+		return "pending-hr"
+	}
+	return e.Status.Class()
+}
+
+// OverSoftLimit reports whether the entry took its user's month over the
+// soft limit, which approvers are shown
+func (e *OvertimeEntry) OverSoftLimit() bool {
+	return e.Acknowledgment != ""
+}
+
+// OnWeekend reports whether the entry is on a Saturday or Sunday that is not a holiday
+func (e *OvertimeEntry) OnWeekend() bool {
+	return e.DayKind == DayWeekend
+}
+
+// OnHoliday reports whether the entry is on one of the organization's holidays
+func (e *OvertimeEntry) OnHoliday() bool {
+	return e.DayKind == DayHoliday
+}
+
+// EnteredOnBehalf reports whether the entry was recorded by someone other than its owner
+func (e *OvertimeEntry) EnteredOnBehalf() bool {
+	return e.CreatedBy != nil && *e.CreatedBy != e.UserID
 }
 
 type OvertimeFilter struct {
@@ -0,0 +1,87 @@
+package models
+
+import (
+	"fmt"
+	"time"
+	"unicode"
+)
+
+// PasswordPolicy is the rule set new passwords of an organization must follow
+type PasswordPolicy struct {
+	MinLength int
+	// MinClasses is how many of lowercase letters, uppercase letters, digits
+	// and symbols a password must mix
+	MinClasses int
+	// CheckBreached rejects passwords known from data breaches
+	CheckBreached bool
+	// History is how many recent passwords, the current one included,
+	// cannot be reused
+	History int
+	// MaxAge forces a password change at the next login; zero disables it
+	MaxAge time.Duration
+}
+
+// PasswordError is a password that breaks the policy, shown to the user as is
+type PasswordError string
+
+func (e PasswordError) Error() string {
+	return string(e)
+}
+
+// DefaultPasswordPolicy applies until an administrator changes it
+var DefaultPasswordPolicy = PasswordPolicy{MinLength: 5}
+
+// passwordClasses counts the character classes used in password
+func passwordClasses(password string) int {
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	count := 0
+	for _, used := range []bool{lower, upper, digit, symbol} {
+		if used {
+			count++
+		}
+	}
+	return count
+}
+
+// Validate checks the length and character classes of password. The breach
+// check needs a network lookup and is done by the caller.
+func (p PasswordPolicy) Validate(password string) error {
+	if len(password) < p.MinLength {
+		return PasswordError(fmt.Sprintf("Password must be at least %d characters", p.MinLength))
+	}
+	if passwordClasses(password) < p.MinClasses {
+		return PasswordError(fmt.Sprintf("Password must mix at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinClasses))
+	}
+	return nil
+}
+
+// Rules describes the policy for the password forms
+func (p PasswordPolicy) Rules() []string {
+	rules := []string{fmt.Sprintf("at least %d characters", p.MinLength)}
+	if p.MinClasses > 1 {
+		rules = append(rules, fmt.Sprintf("at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinClasses))
+	}
+	if p.CheckBreached {
+		rules = append(rules, "not found in known data breaches")
+	}
+	if p.History > 0 {
+		rules = append(rules, fmt.Sprintf("different from your last %d passwords", p.History))
+	}
+	return rules
+}
+
+// ErrPasswordBreached is returned for passwords from known data breaches
+const ErrPasswordBreached PasswordError = "This password has appeared in a data breach, please choose another one"
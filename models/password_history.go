@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// PasswordHistory keeps the previous password hashes of a user so recent
+// passwords cannot be reused
+type PasswordHistory struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt    time.Time `json:"created_at"`
+	UserID       uint      `gorm:"index;not null" json:"user_id"`
+	PasswordHash string    `gorm:"not null" json:"-"`
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+)
+
+// PayoutRequest asks to have overtime from the user's balance paid out. The
+// hours are taken from the balance while the request is pending. Approving
+// it takes them for good with a payout compensation, which goes into the
+// payroll export of its month.
+type PayoutRequest struct {
+	ID             uint        `gorm:"primaryKey" json:"id"`
+	CreatedAt      time.Time   `json:"created_at"`
+	UpdatedAt      time.Time   `json:"updated_at"`
+	OrganizationID uint        `gorm:"index" json:"organization_id"`
+	UserID         uint        `gorm:"not null;index" json:"user_id"`
+	User           User        `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	Hours          float64     `gorm:"not null" json:"hours"`
+	Note           string      `gorm:"size:500" json:"note"`
+	Status         EntryStatus `gorm:"not null;size:20;default:PENDING;index" json:"status"`
+	ReviewedBy     *uint       `json:"reviewed_by"`
+	Reviewer       *User       `gorm:"foreignKey:ReviewedBy" json:"reviewer,omitempty"`
+	ReviewedAt     *time.Time  `json:"reviewed_at"`
+	// ReviewComment holds the reviewer's note, e.g. the reason for a rejection
+	ReviewComment string `gorm:"size:500" json:"review_comment"`
+	// CompensationID is the payout compensation of an approved request
+	CompensationID *uint `json:"compensation_id,omitempty"`
+}
+
+func (p *PayoutRequest) IsPending() bool {
+	return p.Status == StatusPending
+}
+
+// StatusClass returns the CSS badge suffix for the request's status
+func (p *PayoutRequest) StatusClass() string {
+	return p.Status.Class()
+}
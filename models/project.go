@@ -8,6 +8,11 @@ type Project struct {
 	ID        uint      `gorm:"primaryKey" json:"id"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
-	Name      string    `gorm:"uniqueIndex;not null;size:100" json:"name"`
-	Users     []User    `gorm:"foreignKey:ProjectID" json:"users,omitempty"`
+	// Project names are unique within an organization
+	OrganizationID uint   `gorm:"uniqueIndex:idx_projects_organization_name,priority:1" json:"organization_id"`
+	Name           string `gorm:"uniqueIndex:idx_projects_organization_name,priority:2;not null;size:100" json:"name"`
+	Users          []User `gorm:"foreignKey:ProjectID" json:"users,omitempty"`
+	// HourlyRate is what an hour of overtime on the project costs, in the
+	// organization's currency. Zero means no rate was set.
+	HourlyRate float64 `gorm:"not null;default:0" json:"hourly_rate"`
 }
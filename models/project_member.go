@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// ProjectMember assigns a user to a project besides their home project,
+// User.ProjectID. Members log overtime on any of their projects and are
+// supervised there like on their home project.
+type ProjectMember struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	OrganizationID uint      `gorm:"index" json:"organization_id"`
+	UserID         uint      `gorm:"not null;uniqueIndex:idx_project_members_user_project,priority:1" json:"user_id"`
+	User           *User     `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	ProjectID      uint      `gorm:"not null;index;uniqueIndex:idx_project_members_user_project,priority:2" json:"project_id"`
+	Project        *Project  `gorm:"foreignKey:ProjectID" json:"project,omitempty"`
+}
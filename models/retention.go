@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// RetentionPolicy says how long an organization keeps data. Zero keeps the
+// data forever.
+type RetentionPolicy struct {
+	// EntryYears purges overtime entries dated longer ago
+	EntryYears int
+	// AuditLogYears purges audit log entries recorded longer ago
+	AuditLogYears int
+	// InviteDays purges invites that were used or expired longer ago
+	InviteDays int
+}
+
+func (p RetentionPolicy) Enabled() bool {
+	return p.EntryYears > 0 || p.AuditLogYears > 0 || p.InviteDays > 0
+}
+
+// RetentionCutoffs are the points in time before which data is purged when
+// the policy is applied at a given time. Zero cutoffs purge nothing.
+type RetentionCutoffs struct {
+	Entries   time.Time
+	AuditLogs time.Time
+	Invites   time.Time
+}
+
+func (p RetentionPolicy) Cutoffs(at time.Time) RetentionCutoffs {
+	var cutoffs RetentionCutoffs
+	if p.EntryYears > 0 {
+		cutoffs.Entries = at.AddDate(-p.EntryYears, 0, 0)
+	}
+	if p.AuditLogYears > 0 {
+		cutoffs.AuditLogs = at.AddDate(-p.AuditLogYears, 0, 0)
+	}
+	if p.InviteDays > 0 {
+		cutoffs.Invites = at.AddDate(0, 0, -p.InviteDays)
+	}
+	return cutoffs
+}
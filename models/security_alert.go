@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// Kinds of security alerts
+const (
+	AlertFailedLogins    = "failed_logins"
+	AlertNewAddress      = "new_address"
+	AlertPasswordChanged = "password_changed"
+)
+
+// SecurityAlert records suspicious activity on a user's account. The user is
+// shown it until they dismiss it, administrators are emailed when it is
+// raised.
+type SecurityAlert struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	CreatedAt      time.Time  `json:"created_at"`
+	OrganizationID uint       `gorm:"index" json:"organization_id"`
+	UserID         uint       `gorm:"not null;index" json:"user_id"`
+	Kind           string     `gorm:"not null;size:32" json:"kind"`
+	Detail         string     `gorm:"type:text" json:"detail"`
+	IP             string     `gorm:"size:64" json:"ip"`
+	SeenAt         *time.Time `json:"seen_at"`
+}
+
+// LoginAddress is a network a user logged in from, logins from other
+// networks raise an alert
+type LoginAddress struct {
+	ID     uint `gorm:"primaryKey" json:"id"`
+	UserID uint `gorm:"not null;uniqueIndex:idx_login_addresses_user_network,priority:1" json:"user_id"`
+	// Network is the /24 of IPv4 and the /48 of IPv6 addresses, so a new
+	// address from the same provider is not taken for a new place
+	Network     string    `gorm:"not null;size:64;uniqueIndex:idx_login_addresses_user_network,priority:2" json:"network"`
+	FirstSeenAt time.Time `json:"first_seen_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+}
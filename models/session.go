@@ -0,0 +1,87 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// Session is a login on one device. The auth cookie carries a signed token
+// referencing Code, so revoking the session logs the device out.
+type Session struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	Code       string     `gorm:"uniqueIndex;not null;size:64" json:"-"`
+	UserID     uint       `gorm:"not null;index" json:"user_id"`
+	User       *User      `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	UserAgent  string     `gorm:"size:512" json:"user_agent"`
+	IP         string     `gorm:"size:64" json:"ip"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `gorm:"not null;index" json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	// APIRequests and APIThrottled count the requests made with the
+	// session, by a browser or with its token as a bearer token, and how many
+	// of them were over the rate limit
+	APIRequests  int64      `gorm:"not null;default:0" json:"api_requests"`
+	APIThrottled int64      `gorm:"not null;default:0" json:"api_throttled"`
+	APIUsedAt    *time.Time `gorm:"index" json:"api_used_at"`
+	// APIRateLimit is the requests per window allowed to the session, set by
+	// admins on the token usage page. Zero allows API_RATE_LIMIT.
+	APIRateLimit int `gorm:"not null;default:0" json:"api_rate_limit"`
+}
+
+func (s *Session) IsActive() bool {
+	return s.RevokedAt == nil && time.Now().Before(s.ExpiresAt)
+}
+
+// Device names the browser and operating system from the user agent, e.g.
+// "Firefox on Linux"
+func (s *Session) Device() string {
+	ua := s.UserAgent
+	if ua == "" {
+		return "Unknown device"
+	}
+
+	browser := ""
+	switch {
+	case strings.Contains(ua, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(ua, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		browser = "Safari"
+	case strings.Contains(ua, "curl/"):
+		browser = "curl"
+	}
+
+	system := ""
+	switch {
+	case strings.Contains(ua, "Android"):
+		system = "Android"
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"):
+		system = "iOS"
+	case strings.Contains(ua, "Windows"):
+		system = "Windows"
+	case strings.Contains(ua, "Mac OS X"):
+		system = "macOS"
+	case strings.Contains(ua, "Linux"):
+		system = "Linux"
+	}
+
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	}
+	if len(ua) > 40 {
+		return ua[:40] + "..."
+	}
+	return ua
+}
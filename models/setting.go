@@ -0,0 +1,112 @@
+package models
+
+import (
+	"time"
+)
+
+// Setting is one value of an organization's settings. Values are stored as
+// text under their name, so adding a setting needs no schema change.
+type Setting struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	OrganizationID uint      `gorm:"uniqueIndex:idx_settings_organization_name,priority:1" json:"organization_id"`
+	Name           string    `gorm:"uniqueIndex:idx_settings_organization_name,priority:2;not null;size:100" json:"name"`
+	Value          string    `gorm:"type:text" json:"value"`
+}
+
+const (
+	SettingCompanyName = "company_name"
+	SettingAccentColor = "accent_color"
+	SettingFooterText  = "footer_text"
+	// SettingLogo holds the base64 encoded logo image, SettingLogoType its content type
+	SettingLogo     = "logo"
+	SettingLogoType = "logo_type"
+)
+
+// Runtime settings that used to be fixed at compile time or in the environment
+const (
+	SettingInviteExpirationDays = "invite_expiration_days"
+	SettingPasswordMinLength    = "password_min_length"
+	SettingPasswordMinClasses   = "password_min_classes"
+	SettingPasswordBreachCheck  = "password_breach_check"
+	SettingPasswordHistory      = "password_history"
+	SettingPasswordMaxAgeDays   = "password_max_age_days"
+	SettingMaxHoursPerEntry     = "max_hours_per_entry"
+	SettingMaxHoursPerMonth     = "max_hours_per_month"
+	SettingMaxHoursPerDay       = "max_hours_per_day"
+	// SettingSoftHoursPerMonth is how many hours a user may book per month
+	// before entries need an acknowledgment, empty for no soft limit
+	SettingSoftHoursPerMonth = "soft_hours_per_month"
+	// Night work, see NightWindow
+	SettingNightStart      = "night_start"
+	SettingNightEnd        = "night_end"
+	SettingNightMultiplier = "night_multiplier"
+	SettingExportFormat    = "export_format"
+	// SettingCurrency is the ISO 4217 code hourly rates and costs are in
+	SettingCurrency = "currency"
+	// SettingOvertimeMode is one of the OvertimeMode values
+	SettingOvertimeMode = "overtime_mode"
+	// SettingMaxConsecutiveDays is how many days in a row users may work
+	// before the compliance report flags them
+	SettingMaxConsecutiveDays = "max_consecutive_days"
+	// SettingMaxFutureDays and SettingMaxPastMonths limit how far from today
+	// entries may be dated
+	SettingMaxFutureDays = "max_future_days"
+	SettingMaxPastMonths = "max_past_months"
+	// Retention periods, see RetentionPolicy
+	SettingRetentionEntryYears    = "retention_entry_years"
+	SettingRetentionAuditLogYears = "retention_audit_log_years"
+	SettingRetentionInviteDays    = "retention_invite_days"
+	// SettingRetentionReportedAt is when admins were last told what the
+	// retention policy is about to delete
+	SettingRetentionReportedAt = "retention_reported_at"
+	// SettingOpenSignup lets people register as employees without an
+	// invite. SettingSignupDomains is a comma separated list of the email
+	// domains they may register with, SettingSignupApproval holds their
+	// accounts until an administrator activates them.
+	SettingOpenSignup     = "open_signup"
+	SettingSignupDomains  = "signup_domains"
+	SettingSignupApproval = "signup_approval"
+	// SettingHREditEntries lets HR correct the entries of other users
+	SettingHREditEntries = "hr_edit_entries"
+	// Month closing, see MonthClose
+	SettingMonthCloseDay = "month_close_day"
+	SettingClosedThrough = "closed_through"
+	// SettingArchiveExports keeps a copy of every monthly export, see
+	// ExportArchive
+	SettingArchiveExports = "archive_exports"
+	// SettingWorksCouncilRoles is a comma separated list of the roles that
+	// see pseudonymous data and aggregates in entry lists and reports
+	SettingWorksCouncilRoles = "works_council_roles"
+	// SettingAnalyticsMinGroup is how many employees a group needs before
+	// reports show its figures to roles other than administrators, empty or
+	// zero shows figures per employee
+	SettingAnalyticsMinGroup = "analytics_min_group"
+)
+
+// How users record overtime. Declared overtime is entered as is, with worked
+// time users enter the hours worked that day and overtime is what exceeds
+// their contract.
+const (
+	OvertimeModeDeclared = "declared"
+	OvertimeModeWorked   = "worked"
+)
+
+// Branding replaces the default product name and colors in the interface
+type Branding struct {
+	OrganizationID uint
+	CompanyName    string
+	AccentColor    string
+	FooterText     string
+	// LogoVersion changes whenever the logo does; zero means there is no logo
+	LogoVersion int64
+}
+
+// Name returns the company name, falling back to the product name
+func (b Branding) Name() string {
+	if b.CompanyName != "" {
+		return b.CompanyName
+	}
+	return "overtime"
+}
@@ -8,6 +8,15 @@ type Team struct {
 	ID        uint      `gorm:"primaryKey" json:"id"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
-	Name      string    `gorm:"uniqueIndex;not null;size:100" json:"name"`
-	Users     []User    `gorm:"foreignKey:TeamID" json:"users,omitempty"`
+	// Team names are unique within an organization
+	OrganizationID uint   `gorm:"uniqueIndex:idx_teams_organization_name,priority:1" json:"organization_id"`
+	Name           string `gorm:"uniqueIndex:idx_teams_organization_name,priority:2;not null;size:100" json:"name"`
+	Users          []User `gorm:"foreignKey:TeamID" json:"users,omitempty"`
+	// RequireHRApproval adds an HR stage after the supervisor approval
+	RequireHRApproval bool `gorm:"default:false" json:"require_hr_approval"`
+	// CalendarURL is the CalDAV collection approved overtime is published to
+	CalendarURL string `gorm:"size:500" json:"calendar_url"`
+	// CostCenter is where the overtime of the team's members is booked
+	CostCenterID *uint       `gorm:"index" json:"cost_center_id"`
+	CostCenter   *CostCenter `gorm:"foreignKey:CostCenterID" json:"cost_center,omitempty"`
 }
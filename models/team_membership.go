@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// TeamMembership records that a user belongs to a team from ValidFrom until
+// their next membership starts, so reports attribute entries to the team of
+// their date. Users whose team never changed have none and count in their
+// current team.
+type TeamMembership struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	OrganizationID uint      `gorm:"index" json:"organization_id"`
+	UserID         uint      `gorm:"not null;uniqueIndex:idx_team_memberships_user_valid_from,priority:1" json:"user_id"`
+	ValidFrom      time.Time `gorm:"not null;type:date;uniqueIndex:idx_team_memberships_user_valid_from,priority:2" json:"valid_from"`
+	// TeamID is nil while the user was in no team
+	TeamID *uint `gorm:"index" json:"team_id"`
+	Team   *Team `gorm:"foreignKey:TeamID;constraint:OnDelete:SET NULL" json:"team,omitempty"`
+}
+
+// TeamOn returns the membership in effect on day. Days before the first
+// membership belong to it, nil is only returned without memberships. Days
+// are compared by date, whatever their time zone.
+func TeamOn(memberships []TeamMembership, day time.Time) *TeamMembership {
+	date := day.Format("2006-01-02")
+	var current, first *TeamMembership
+	for i := range memberships {
+		from := memberships[i].ValidFrom.Format("2006-01-02")
+		if first == nil || from < first.ValidFrom.Format("2006-01-02") {
+			first = &memberships[i]
+		}
+		if from <= date && (current == nil || from > current.ValidFrom.Format("2006-01-02")) {
+			current = &memberships[i]
+		}
+	}
+	if current == nil {
+		return first
+	}
+	return current
+}
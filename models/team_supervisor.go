@@ -7,8 +7,8 @@ import (
 )
 
 // TeamSupervisor represents a team assignment for a supervisor
-// The supervisor's project is stored on User.ProjectID
-// This table tracks which teams within that project the supervisor can view
+// The supervisor's projects are User.ProjectID and their ProjectMemberships
+// This table tracks which teams within those projects the supervisor can view
 type TeamSupervisor struct {
 	ID        uint           `gorm:"primaryKey" json:"id"`
 	CreatedAt time.Time      `json:"created_at"`
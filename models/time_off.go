@@ -0,0 +1,35 @@
+package models
+
+import (
+	"time"
+)
+
+// TimeOffRequest asks to take approved overtime as time off on a day. Hours
+// are taken from the user's balance while the request is pending and stay
+// taken once it is approved.
+type TimeOffRequest struct {
+	ID             uint        `gorm:"primaryKey" json:"id"`
+	CreatedAt      time.Time   `json:"created_at"`
+	UpdatedAt      time.Time   `json:"updated_at"`
+	OrganizationID uint        `gorm:"index" json:"organization_id"`
+	UserID         uint        `gorm:"not null;index" json:"user_id"`
+	User           User        `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	Date           time.Time   `gorm:"not null;type:date" json:"date"`
+	Hours          float64     `gorm:"not null" json:"hours"`
+	Note           string      `gorm:"size:500" json:"note"`
+	Status         EntryStatus `gorm:"not null;size:20;default:PENDING;index" json:"status"`
+	ReviewedBy     *uint       `json:"reviewed_by"`
+	Reviewer       *User       `gorm:"foreignKey:ReviewedBy" json:"reviewer,omitempty"`
+	ReviewedAt     *time.Time  `json:"reviewed_at"`
+	// ReviewComment holds the reviewer's note, e.g. the reason for a rejection
+	ReviewComment string `gorm:"size:500" json:"review_comment"`
+}
+
+func (t *TimeOffRequest) IsPending() bool {
+	return t.Status == StatusPending
+}
+
+// StatusClass returns the CSS badge suffix for the request's status
+func (t *TimeOffRequest) StatusClass() string {
+	return t.Status.Class()
+}
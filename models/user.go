@@ -16,20 +16,69 @@ const (
 )
 
 type User struct {
-	ID                 uint           `gorm:"primaryKey" json:"id"`
-	CreatedAt          time.Time      `json:"created_at"`
-	UpdatedAt          time.Time      `json:"updated_at"`
-	DeletedAt          gorm.DeletedAt `gorm:"index" json:"-"`
-	Username           string         `gorm:"uniqueIndex;not null;size:100" json:"username"`
-	FullName           string         `gorm:"not null;size:200" json:"full_name"`
-	PasswordHash       string         `gorm:"not null" json:"-"`
-	Role               Role           `gorm:"not null;size:20" json:"role"`
-	MustChangePassword bool           `gorm:"default:true" json:"must_change_password"`
-	TeamID             *uint          `gorm:"index" json:"team_id"`
-	Team               *Team          `gorm:"foreignKey:TeamID" json:"team,omitempty"`
-	ProjectID          *uint          `gorm:"index" json:"project_id"`
-	Project            *Project       `gorm:"foreignKey:ProjectID" json:"project,omitempty"`
-	OvertimeEntries    []OvertimeEntry `gorm:"foreignKey:UserID" json:"overtime_entries,omitempty"`
+	ID             uint           `gorm:"primaryKey" json:"id"`
+	CreatedAt      time.Time      `json:"created_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+	DeletedAt      gorm.DeletedAt `gorm:"index" json:"-"`
+	OrganizationID uint           `gorm:"index;uniqueIndex:idx_users_organization_employee_number,priority:1;uniqueIndex:idx_users_organization_external_id,priority:1;uniqueIndex:idx_users_organization_hris_id,priority:1" json:"organization_id"`
+	Organization   *Organization  `gorm:"foreignKey:OrganizationID" json:"organization,omitempty"`
+	// PlatformAdmin lets an administrator create organizations; everything
+	// else an administrator does is limited to their own organization
+	PlatformAdmin      bool             `gorm:"default:false" json:"platform_admin"`
+	Username           string           `gorm:"uniqueIndex;not null;size:100" json:"username"`
+	FullName           string           `gorm:"not null;size:200" json:"full_name"`
+	Email              string           `gorm:"size:255" json:"email"`
+	Timezone           string           `gorm:"size:64" json:"timezone"`
+	TelegramChatID     *int64           `gorm:"uniqueIndex" json:"-"`
+	PasswordHash       string           `gorm:"not null" json:"-"`
+	Role               Role             `gorm:"not null;size:20" json:"role"`
+	MustChangePassword bool             `gorm:"default:true" json:"must_change_password"`
+	PasswordChangedAt  *time.Time       `json:"password_changed_at"`
+	AnonymizedAt       *time.Time       `json:"anonymized_at,omitempty"`  // set once personal data was erased
+	DeactivatedAt      *time.Time       `json:"deactivated_at,omitempty"` // set once merged into another account or gone from the HRIS
+	TeamID             *uint            `gorm:"index" json:"team_id"`
+	Team               *Team            `gorm:"foreignKey:TeamID" json:"team,omitempty"`
+	ProjectID          *uint            `gorm:"index" json:"project_id"`
+	Project            *Project         `gorm:"foreignKey:ProjectID" json:"project,omitempty"`
+	OvertimeEntries    []OvertimeEntry  `gorm:"foreignKey:UserID" json:"overtime_entries,omitempty"`
+	TeamAssignments    []TeamSupervisor `gorm:"foreignKey:UserID" json:"team_assignments,omitempty"`
+	// ProjectMemberships are the projects the user works on besides their
+	// home project
+	ProjectMemberships []ProjectMember `gorm:"foreignKey:UserID" json:"project_memberships,omitempty"`
+	// HourlyRate overrides the rate of the user's project when set
+	HourlyRate *float64 `json:"hourly_rate,omitempty"`
+	// CostCenter overrides the cost center of the user's team when set
+	CostCenterID *uint       `gorm:"index" json:"cost_center_id"`
+	CostCenter   *CostCenter `gorm:"foreignKey:CostCenterID" json:"cost_center,omitempty"`
+	// EmployeeNumber and ExternalID let payroll and ERP systems match the
+	// account to their records, each is unique within the organization
+	EmployeeNumber *string `gorm:"size:50;uniqueIndex:idx_users_organization_employee_number,priority:2" json:"employee_number,omitempty"`
+	ExternalID     *string `gorm:"size:128;uniqueIndex:idx_users_organization_external_id,priority:2" json:"external_id,omitempty"`
+	// HRISID is the employee's ID in the organization's HR system, for users
+	// synced from it
+	HRISID *string `gorm:"column:hris_id;size:128;uniqueIndex:idx_users_organization_hris_id,priority:2" json:"hris_id,omitempty"`
+	// AvatarVersion changes with every uploaded avatar and is zero without
+	// one, avatar URLs carry it so browsers can cache them
+	AvatarVersion int64 `gorm:"not null;default:0" json:"-"`
+	// PendingApproval holds accounts created by open signup until an
+	// administrator activates them, they cannot be logged in to until then
+	PendingApproval bool `gorm:"not null;default:false" json:"pending_approval"`
+	// PendingVerification holds accounts created by open signup with an email
+	// address until the emailed verification link is opened. They cannot be
+	// logged in to, and their address is not trusted, until then.
+	PendingVerification bool `gorm:"not null;default:false" json:"pending_verification"`
+	// ApprovalDigest replaces the email per entry waiting for the user's
+	// approval with a daily digest, DigestSentAt is when the last one went out
+	ApprovalDigest bool       `gorm:"not null;default:false" json:"approval_digest"`
+	DigestSentAt   *time.Time `json:"-"`
+	// ApprovalsSeenAt is when the user last opened the approvals page,
+	// entries submitted since are new to them
+	ApprovalsSeenAt *time.Time `json:"-"`
+	// SecurityAlerts raises alerts on failed logins, logins from new
+	// addresses and password changes of the account. ReceiveSecurityAlerts
+	// emails them to administrators.
+	SecurityAlerts        bool `gorm:"not null;default:true" json:"security_alerts"`
+	ReceiveSecurityAlerts bool `gorm:"not null;default:true" json:"receive_security_alerts"`
 }
 
 func (u *User) DisplayName() string {
@@ -39,6 +88,36 @@ func (u *User) DisplayName() string {
 	return u.Username
 }
 
+// PasswordExpired reports whether the password is older than maxAge.
+// Passwords set before changes were tracked count from account creation.
+func (u *User) PasswordExpired(maxAge time.Duration) bool {
+	changed := u.CreatedAt
+	if u.PasswordChangedAt != nil {
+		changed = *u.PasswordChangedAt
+	}
+	return time.Since(changed) > maxAge
+}
+
+// Location returns the user's configured timezone, falling back to UTC
+func (u *User) Location() *time.Location {
+	if u.Timezone != "" {
+		if loc, err := time.LoadLocation(u.Timezone); err == nil {
+			return loc
+		}
+	}
+	return time.UTC
+}
+
+// Now returns the current time in the user's timezone
+func (u *User) Now() time.Time {
+	return time.Now().In(u.Location())
+}
+
+// LocalTime converts a timestamp to the user's timezone for display
+func (u *User) LocalTime(t time.Time) time.Time {
+	return t.In(u.Location())
+}
+
 func (u *User) IsAdmin() bool {
 	return u.Role == RoleAdmin
 }
@@ -55,11 +134,97 @@ func (u *User) IsSupervisor() bool {
 	return u.Role == RoleSupervisor
 }
 
-func (u *User) CanManageOvertimeFor(userID uint) bool {
-	if u.IsAdmin() {
+// SupervisedTeamIDs returns the IDs of the teams a supervisor is assigned to.
+// TeamAssignments must be preloaded for the result to be meaningful.
+func (u *User) SupervisedTeamIDs() []uint {
+	teamIDs := make([]uint, 0, len(u.TeamAssignments))
+	for _, a := range u.TeamAssignments {
+		teamIDs = append(teamIDs, a.TeamID)
+	}
+	return teamIDs
+}
+
+// ProjectIDs returns the IDs of the user's home project and the projects they
+// are a member of. ProjectMemberships must be preloaded for the memberships
+// to count.
+func (u *User) ProjectIDs() []uint {
+	projectIDs := make([]uint, 0, len(u.ProjectMemberships)+1)
+	if u.ProjectID != nil {
+		projectIDs = append(projectIDs, *u.ProjectID)
+	}
+	for _, m := range u.ProjectMemberships {
+		if u.ProjectID == nil || m.ProjectID != *u.ProjectID {
+			projectIDs = append(projectIDs, m.ProjectID)
+		}
+	}
+	return projectIDs
+}
+
+// OnProject reports whether the user works on the project, as their home
+// project or as a member
+func (u *User) OnProject(projectID uint) bool {
+	for _, id := range u.ProjectIDs() {
+		if id == projectID {
+			return true
+		}
+	}
+	return false
+}
+
+// supervisesTeam reports whether the supervisor is assigned to the team
+func (u *User) supervisesTeam(teamID *uint) bool {
+	if !u.IsSupervisor() || teamID == nil {
+		return false
+	}
+	for _, a := range u.TeamAssignments {
+		if a.TeamID == *teamID {
+			return true
+		}
+	}
+	return false
+}
+
+// SupervisesEntry reports whether the entry was logged on one of the
+// supervisor's projects by a member of one of their teams. entry.User must be
+// loaded.
+func (u *User) SupervisesEntry(entry *OvertimeEntry) bool {
+	return entry.ProjectID != nil && u.OnProject(*entry.ProjectID) && u.supervisesTeam(entry.User.TeamID)
+}
+
+// SameOrganization reports whether the other user belongs to the user's organization
+func (u *User) SameOrganization(other *User) bool {
+	return other != nil && u.OrganizationID == other.OrganizationID
+}
+
+// CanManageEntry reports whether the user may edit or delete the entry.
+// Supervisors manage the entries logged on their projects. entry.User must be
+// loaded.
+func (u *User) CanManageEntry(entry *OvertimeEntry) bool {
+	if !u.SameOrganization(&entry.User) {
+		return false
+	}
+	if u.IsAdmin() || u.ID == entry.UserID {
 		return true
 	}
-	return u.ID == userID
+	return u.SupervisesEntry(entry)
+}
+
+// CanCorrectOvertimeFor reports whether HR may edit the target's entries,
+// which the organization has to allow
+func (u *User) CanCorrectOvertimeFor(target *User, allowed bool) bool {
+	return allowed && u.IsHR() && u.SameOrganization(target) && u.ID != target.ID
+}
+
+// CanReviewEntry reports whether the user may decide on the entry at its
+// current approval stage. entry.User must be loaded.
+func (u *User) CanReviewEntry(entry *OvertimeEntry) bool {
+	if !u.SameOrganization(&entry.User) {
+		return false
+	}
+	if entry.Stage == StageHR {
+		return u.IsAdmin() || (u.IsHR() && u.ID != entry.UserID)
+	}
+	return u.IsAdmin() || u.SupervisesEntry(entry)
 }
 
 func (u *User) CanViewAllOvertime() bool {
@@ -70,6 +235,45 @@ func (u *User) CanExport() bool {
 	return u.IsAdmin() || u.IsHR()
 }
 
+// CanViewCosts reports whether the user may see what overtime costs
+func (u *User) CanViewCosts() bool {
+	return u.IsAdmin() || u.IsHR()
+}
+
+// OvertimeCostCenter returns the cost center the user's overtime is booked
+// on: their own if set, otherwise their team's, or nil. The cost centers must
+// be loaded.
+func (u *User) OvertimeCostCenter() *CostCenter {
+	if u.CostCenter != nil {
+		return u.CostCenter
+	}
+	if u.Team != nil {
+		return u.Team.CostCenter
+	}
+	return nil
+}
+
+// CanManageMemberships reports whether the user may move users between teams
+// and projects. Roles and accounts stay with admins.
+func (u *User) CanManageMemberships() bool {
+	return u.IsAdmin() || u.IsHR()
+}
+
+// CanAdjustBalances reports whether the user may correct other users'
+// balances with adjustments
+func (u *User) CanAdjustBalances() bool {
+	return u.IsAdmin() || u.IsHR()
+}
+
+// CanReviewPayouts reports whether the user may approve payouts of overtime
+func (u *User) CanReviewPayouts() bool {
+	return u.IsAdmin() || u.IsHR()
+}
+
 func (u *User) CanCreateInvites() bool {
 	return u.IsAdmin()
 }
+
+func (u *User) CanManageOrganizations() bool {
+	return u.IsAdmin() && u.PlatformAdmin
+}
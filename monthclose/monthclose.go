@@ -0,0 +1,237 @@
+// Package monthclose closes the previous month of the organizations that
+// close months: its entries can no longer be changed, its export is archived
+// and the approvers are reminded of the entries still waiting for them.
+package monthclose
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"overtime/config"
+	"overtime/mailer"
+	"overtime/models"
+	"overtime/scheduler"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Closer periodically closes the previous month of every organization whose
+// day of the month has come and that did not archive it yet. A month that
+// was reopened by an administrator is not closed again.
+type Closer struct {
+	db     *gorm.DB
+	config *config.Config
+	mailer *mailer.Mailer
+	// schedule looks up how an organization closes months
+	schedule func(organizationID uint) models.MonthClose
+	// export writes the organization's overtime in the month starting at
+	// month in the export format
+	export func(w io.Writer, organizationID uint, month time.Time, format string) error
+	// archive keeps a copy of the export in the export archive
+	archive func(organizationID uint, month time.Time, filename, format, generator string, data []byte) error
+	// approvers looks up who reviews a pending entry
+	approvers func(entry *models.OvertimeEntry) []models.User
+}
+
+func NewCloser(db *gorm.DB, cfg *config.Config, mail *mailer.Mailer, schedule func(organizationID uint) models.MonthClose,
+	export func(w io.Writer, organizationID uint, month time.Time, format string) error,
+	archive func(organizationID uint, month time.Time, filename, format, generator string, data []byte) error,
+	approvers func(entry *models.OvertimeEntry) []models.User) *Closer {
+	return &Closer{
+		db:        db,
+		config:    cfg,
+		mailer:    mail,
+		schedule:  schedule,
+		export:    export,
+		archive:   archive,
+		approvers: approvers,
+	}
+}
+
+func (c *Closer) Enabled() bool {
+	return c.config.MonthCloseInterval > 0
+}
+
+// Run closes the due months once immediately and then on every interval, on
+// whichever replica claims the run from lock. It never returns.
+func (c *Closer) Run(lock *scheduler.Lock) {
+	ticker := time.NewTicker(c.config.MonthCloseInterval)
+	defer ticker.Stop()
+	for {
+		if lock.Claim("monthclose", c.config.MonthCloseInterval) {
+			if err := c.CloseDue(); err != nil {
+				log.Printf("Month close failed: %v", err)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// CloseDue closes the previous month of the organizations due
+func (c *Closer) CloseDue() error {
+	now := time.Now().UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0)
+
+	var organizations []models.Organization
+	if err := c.db.Find(&organizations).Error; err != nil {
+		return err
+	}
+
+	for i := range organizations {
+		schedule := c.schedule(organizations[i].ID)
+		if !schedule.Enabled() || now.Day() < schedule.Day {
+			continue
+		}
+
+		var archived int64
+		err := c.db.Model(&models.MonthArchive{}).
+			Where("organization_id = ? AND month = ?", organizations[i].ID, month.Format("2006-01")).
+			Count(&archived).Error
+		if err != nil {
+			return err
+		}
+		if archived > 0 {
+			continue
+		}
+
+		if err := c.Close(&organizations[i], month, schedule); err != nil {
+			log.Printf("Closing %s of organization %s failed: %v", month.Format("2006-01"), organizations[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// Close locks the month starting at month, archives its export and reminds
+// the approvers of the entries still pending in it
+func (c *Closer) Close(organization *models.Organization, month time.Time, schedule models.MonthClose) error {
+	var buf bytes.Buffer
+	if err := c.export(&buf, organization.ID, month, schedule.Format); err != nil {
+		return err
+	}
+
+	archive := models.MonthArchive{
+		OrganizationID: organization.ID,
+		Month:          month.Format("2006-01"),
+		Filename:       fmt.Sprintf("overtime_%d_%02d_closed.csv", month.Year(), int(month.Month())),
+		Data:           buf.Bytes(),
+	}
+	err := entriesIn(c.db, organization.ID, month).
+		Select("COUNT(*) AS entries, COALESCE(SUM(hours), 0) AS hours, COUNT(*) FILTER (WHERE status = ?) AS pending", models.StatusPending).
+		Row().Scan(&archive.Entries, &archive.Hours, &archive.Pending)
+	if err != nil {
+		return err
+	}
+
+	err = c.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&archive).Error; err != nil {
+			return err
+		}
+		// Administrators may have closed later months already
+		if archive.Month > schedule.ClosedThrough {
+			if err := markClosed(tx, organization.ID, archive.Month); err != nil {
+				return err
+			}
+		}
+		return tx.Create(&models.AuditLog{
+			OrganizationID: organization.ID,
+			Action:         models.AuditMonthClosed,
+			Detail: fmt.Sprintf("%s closed automatically: %d entries with %.2f hours archived, %d still pending",
+				archive.Month, archive.Entries, archive.Hours, archive.Pending),
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Closed %s of organization %s", archive.Month, organization.Name)
+
+	if err := c.archive(organization.ID, month, archive.Filename, schedule.Format, "month close", archive.Data); err != nil {
+		log.Printf("Failed to archive the export of %s for organization %s: %v", archive.Month, organization.Name, err)
+	}
+
+	if archive.Pending > 0 {
+		c.remind(organization, month)
+	}
+	return nil
+}
+
+func entriesIn(db *gorm.DB, organizationID uint, month time.Time) *gorm.DB {
+	return db.Model(&models.OvertimeEntry{}).
+		Where("organization_id = ? AND date >= ? AND date < ?", organizationID, month, month.AddDate(0, 1, 0))
+}
+
+func markClosed(tx *gorm.DB, organizationID uint, month string) error {
+	setting := models.Setting{OrganizationID: organizationID, Name: models.SettingClosedThrough, Value: month}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "organization_id"}, {Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value", "updated_at"}),
+	}).Create(&setting).Error
+}
+
+// remind emails every approver the entries of the closed month that still
+// wait for their decision
+func (c *Closer) remind(organization *models.Organization, month time.Time) {
+	var entries []models.OvertimeEntry
+	err := entriesIn(c.db, organization.ID, month).Preload("User").
+		Where("status = ?", models.StatusPending).
+		Order("date asc, id asc").
+		Find(&entries).Error
+	if err != nil {
+		log.Printf("Failed to load the pending entries of %s for organization %s: %v", month.Format("2006-01"), organization.Name, err)
+		return
+	}
+
+	approvers := map[uint]models.User{}
+	waiting := map[uint][]models.OvertimeEntry{}
+	for _, entry := range entries {
+		for _, approver := range c.approvers(&entry) {
+			if approver.Email == "" {
+				continue
+			}
+			approvers[approver.ID] = approver
+			waiting[approver.ID] = append(waiting[approver.ID], entry)
+		}
+	}
+
+	for id, approver := range approvers {
+		subject := fmt.Sprintf("%s was closed with entries waiting for your approval", month.Format("January 2006"))
+		if err := c.mailer.Send([]string{approver.Email}, subject, c.body(&approver, month, waiting[id])); err != nil {
+			log.Printf("Month close reminder to %s failed: %v", approver.Email, err)
+		}
+	}
+}
+
+func (c *Closer) body(approver *models.User, month time.Time, entries []models.OvertimeEntry) string {
+	var lines []string
+	for _, entry := range entries {
+		line := fmt.Sprintf("- %s  %-30s %6.2f h", entry.Date.Format("2006-01-02"), entry.User.DisplayName(), entry.Hours)
+		if entry.Description != "" {
+			line += "  " + entry.Description
+		}
+		lines = append(lines, line)
+	}
+
+	return fmt.Sprintf(`Hello %s,
+
+%s was closed and its export archived. These entries in it still wait
+for your approval:
+
+%s
+
+Review them here: %s/approvals?month=%d&year=%d
+
+Entries of a closed month can no longer be changed, but they can still be
+approved or rejected.
+`,
+		approver.DisplayName(),
+		month.Format("January 2006"),
+		strings.Join(lines, "\n"),
+		c.config.BaseURL,
+		int(month.Month()),
+		month.Year(),
+	)
+}
@@ -0,0 +1,461 @@
+// Package qrcode encodes short texts, such as links, as QR codes. It only
+// implements what links need: byte mode, error correction level M and
+// versions 1 to 10, which hold up to 213 bytes.
+package qrcode
+
+import (
+	"errors"
+	"image"
+	"image/color"
+)
+
+// ErrTooLong is returned for texts that do not fit the largest supported
+// version
+var ErrTooLong = errors.New("qrcode: text too long")
+
+// quietZone is the light border around the code that scanners need, in
+// modules
+const quietZone = 4
+
+// version describes a QR code version at error correction level M
+type version struct {
+	// blocks are the data codewords of each error correction block
+	blocks []int
+	// ecc is the number of error correction codewords per block
+	ecc int
+	// alignment are the row and column centers of the alignment patterns
+	alignment []int
+}
+
+var versions = []version{
+	{blocks: []int{16}, ecc: 10},
+	{blocks: []int{28}, ecc: 16, alignment: []int{6, 18}},
+	{blocks: []int{44}, ecc: 26, alignment: []int{6, 22}},
+	{blocks: []int{32, 32}, ecc: 18, alignment: []int{6, 26}},
+	{blocks: []int{43, 43}, ecc: 24, alignment: []int{6, 30}},
+	{blocks: []int{27, 27, 27, 27}, ecc: 16, alignment: []int{6, 34}},
+	{blocks: []int{31, 31, 31, 31}, ecc: 18, alignment: []int{6, 22, 38}},
+	{blocks: []int{38, 38, 39, 39}, ecc: 22, alignment: []int{6, 24, 42}},
+	{blocks: []int{36, 36, 36, 37, 37}, ecc: 22, alignment: []int{6, 26, 46}},
+	{blocks: []int{43, 43, 43, 43, 44}, ecc: 26, alignment: []int{6, 28, 50}},
+}
+
+func (v version) dataCodewords() int {
+	total := 0
+	for _, n := range v.blocks {
+		total += n
+	}
+	return total
+}
+
+// Code is an encoded QR code
+type Code struct {
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+// Encode returns the smallest QR code holding text
+func Encode(text string) (*Code, error) {
+	number, codewords, err := encodeData([]byte(text))
+	if err != nil {
+		return nil, err
+	}
+	code := newCode(number, versions[number-1])
+	code.drawCodewords(codewords)
+	code.applyBestMask()
+	return code, nil
+}
+
+// encodeData picks the smallest version data fits in and returns its
+// number with the data and error correction codewords
+func encodeData(data []byte) (int, []byte, error) {
+	for i, v := range versions {
+		number := i + 1
+		countBits := 8
+		if number >= 10 {
+			countBits = 16
+		}
+		capacity := 8 * v.dataCodewords()
+		if 4+countBits+8*len(data) > capacity {
+			continue
+		}
+
+		var bits bitBuffer
+		bits.append(0b0100, 4)
+		bits.append(len(data), countBits)
+		for _, b := range data {
+			bits.append(int(b), 8)
+		}
+		bits.append(0, min(4, capacity-len(bits)))
+		bits.append(0, (8-len(bits)%8)%8)
+		for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+			bits.append(pad, 8)
+		}
+		return number, interleave(v, bits.bytes()), nil
+	}
+	return 0, nil, ErrTooLong
+}
+
+// Image renders the code with scale pixels per module, including the quiet
+// zone
+func (c *Code) Image(scale int) image.Image {
+	side := (c.size + 2*quietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, side, side))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+	for y := 0; y < c.size; y++ {
+		for x := 0; x < c.size; x++ {
+			if !c.modules[y][x] {
+				continue
+			}
+			for py := 0; py < scale; py++ {
+				for px := 0; px < scale; px++ {
+					img.SetGray((x+quietZone)*scale+px, (y+quietZone)*scale+py, color.Gray{})
+				}
+			}
+		}
+	}
+	return img
+}
+
+// newCode draws the function patterns of a version, leaving the modules for
+// the data empty
+func newCode(number int, v version) *Code {
+	size := 17 + 4*number
+	c := &Code{size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for i := range c.modules {
+		c.modules[i] = make([]bool, size)
+		c.function[i] = make([]bool, size)
+	}
+
+	// Timing patterns, then the finders, their separators and the alignment
+	// patterns on top
+	for i := 0; i < size; i++ {
+		c.set(6, i, i%2 == 0)
+		c.set(i, 6, i%2 == 0)
+	}
+	for _, center := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := center[0]+dx, center[1]+dy
+				if x < 0 || x >= size || y < 0 || y >= size {
+					continue
+				}
+				distance := max(abs(dx), abs(dy))
+				c.set(x, y, distance != 2 && distance != 4)
+			}
+		}
+	}
+	last := len(v.alignment) - 1
+	for i, cy := range v.alignment {
+		for j, cx := range v.alignment {
+			// Those would overlap the finders
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					c.set(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format information, it is drawn once the mask is chosen
+	c.drawFormat(0)
+	if number >= 7 {
+		c.drawVersion(number)
+	}
+	return c
+}
+
+// set draws a function module
+func (c *Code) set(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.function[y][x] = true
+}
+
+// drawFormat draws the error correction level and mask, twice
+func (c *Code) drawFormat(mask int) {
+	// Level M is 00
+	data := mask
+	remainder := data
+	for i := 0; i < 10; i++ {
+		remainder = (remainder << 1) ^ ((remainder >> 9) * 0x537)
+	}
+	bits := (data<<10 | remainder) ^ 0x5412
+
+	for i := 0; i <= 5; i++ {
+		c.set(8, i, bit(bits, i))
+	}
+	c.set(8, 7, bit(bits, 6))
+	c.set(8, 8, bit(bits, 7))
+	c.set(7, 8, bit(bits, 8))
+	for i := 9; i < 15; i++ {
+		c.set(14-i, 8, bit(bits, i))
+	}
+
+	for i := 0; i < 8; i++ {
+		c.set(c.size-1-i, 8, bit(bits, i))
+	}
+	for i := 8; i < 15; i++ {
+		c.set(8, c.size-15+i, bit(bits, i))
+	}
+	c.set(8, c.size-8, true)
+}
+
+// drawVersion draws the version number of versions 7 and up, twice
+func (c *Code) drawVersion(number int) {
+	remainder := number
+	for i := 0; i < 12; i++ {
+		remainder = (remainder << 1) ^ ((remainder >> 11) * 0x1F25)
+	}
+	bits := number<<12 | remainder
+	for i := 0; i < 18; i++ {
+		a, b := c.size-11+i%3, i/3
+		c.set(a, b, bit(bits, i))
+		c.set(b, a, bit(bits, i))
+	}
+}
+
+// drawCodewords fills the data modules in the zigzag order of the standard,
+// two columns at a time from the bottom right
+func (c *Code) drawCodewords(codewords []byte) {
+	i := 0
+	for right := c.size - 1; right >= 1; right -= 2 {
+		// The vertical timing pattern is skipped entirely
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vertical := 0; vertical < c.size; vertical++ {
+			y := vertical
+			if upward {
+				y = c.size - 1 - vertical
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if c.function[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				c.modules[y][x] = codewords[i>>3]>>(7-i&7)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// masks decide which data modules a mask pattern inverts
+var masks = []func(x, y int) bool{
+	func(x, y int) bool { return (x+y)%2 == 0 },
+	func(x, y int) bool { return y%2 == 0 },
+	func(x, y int) bool { return x%3 == 0 },
+	func(x, y int) bool { return (x+y)%3 == 0 },
+	func(x, y int) bool { return (x/3+y/2)%2 == 0 },
+	func(x, y int) bool { return x*y%2+x*y%3 == 0 },
+	func(x, y int) bool { return (x*y%2+x*y%3)%2 == 0 },
+	func(x, y int) bool { return ((x+y)%2+x*y%3)%2 == 0 },
+}
+
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.size; y++ {
+		for x := 0; x < c.size; x++ {
+			if !c.function[y][x] && masks[mask](x, y) {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+// applyBestMask applies the mask pattern that is easiest to scan, the one
+// with the lowest penalty
+func (c *Code) applyBestMask() {
+	best, lowest := 0, -1
+	for mask := range masks {
+		c.applyMask(mask)
+		c.drawFormat(mask)
+		if penalty := c.penalty(); lowest < 0 || penalty < lowest {
+			best, lowest = mask, penalty
+		}
+		// Masks are their own inverse
+		c.applyMask(mask)
+	}
+	c.applyMask(best)
+	c.drawFormat(best)
+}
+
+// penalty scores how hard the code is to scan: long runs of one color, 2x2
+// blocks, patterns that look like finders and an unbalanced share of dark
+// modules all count against it
+func (c *Code) penalty() int {
+	penalty := 0
+	line := make([]bool, c.size)
+	for _, vertical := range []bool{false, true} {
+		for i := 0; i < c.size; i++ {
+			for j := 0; j < c.size; j++ {
+				if vertical {
+					line[j] = c.modules[j][i]
+				} else {
+					line[j] = c.modules[i][j]
+				}
+			}
+			penalty += linePenalty(line)
+		}
+	}
+
+	dark := 0
+	for y := 0; y < c.size; y++ {
+		for x := 0; x < c.size; x++ {
+			if c.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 && c.modules[y][x] == c.modules[y-1][x] && c.modules[y][x] == c.modules[y][x-1] && c.modules[y][x] == c.modules[y-1][x-1] {
+				penalty += 3
+			}
+		}
+	}
+	total := c.size * c.size
+	penalty += (abs(dark*20-total*10)+total-1)/total*10 - 10
+	return penalty
+}
+
+// finderLike is the 1:1:3:1:1 pattern of the finders with four light
+// modules on one side
+var finderLike = [][]bool{
+	{true, false, true, true, true, false, true, false, false, false, false},
+	{false, false, false, false, true, false, true, true, true, false, true},
+}
+
+func linePenalty(line []bool) int {
+	penalty := 0
+	run := 1
+	for i := 1; i <= len(line); i++ {
+		if i < len(line) && line[i] == line[i-1] {
+			run++
+			continue
+		}
+		if run >= 5 {
+			penalty += run - 2
+		}
+		run = 1
+	}
+	for i := 0; i+len(finderLike[0]) <= len(line); i++ {
+		for _, pattern := range finderLike {
+			matches := true
+			for j, dark := range pattern {
+				if line[i+j] != dark {
+					matches = false
+					break
+				}
+			}
+			if matches {
+				penalty += 40
+			}
+		}
+	}
+	return penalty
+}
+
+// interleave splits the data codewords into the version's blocks, adds the
+// error correction codewords of each and interleaves them as the standard
+// requires
+func interleave(v version, data []byte) []byte {
+	divisor := reedSolomonDivisor(v.ecc)
+	blocks := make([][]byte, len(v.blocks))
+	eccs := make([][]byte, len(v.blocks))
+	longest := 0
+	for i, n := range v.blocks {
+		blocks[i], data = data[:n], data[n:]
+		eccs[i] = reedSolomonRemainder(blocks[i], divisor)
+		longest = max(longest, n)
+	}
+
+	var result []byte
+	for i := 0; i < longest; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < v.ecc; i++ {
+		for _, ecc := range eccs {
+			result = append(result, ecc[i])
+		}
+	}
+	return result
+}
+
+// reedSolomonDivisor returns the generator polynomial of degree, without its
+// leading coefficient
+func reedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+// reedSolomonRemainder returns the error correction codewords of data
+func reedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coefficient := range divisor {
+			result[i] ^= gfMultiply(coefficient, factor)
+		}
+	}
+	return result
+}
+
+// gfMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
+
+// bitBuffer collects the bits of the data codewords
+type bitBuffer []bool
+
+func (b *bitBuffer) append(value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		*b = append(*b, value>>i&1 == 1)
+	}
+}
+
+func (b bitBuffer) bytes() []byte {
+	result := make([]byte, len(b)/8)
+	for i, set := range b {
+		if set {
+			result[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	return result
+}
+
+func bit(value, i int) bool {
+	return value>>i&1 == 1
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
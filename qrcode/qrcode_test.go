@@ -0,0 +1,416 @@
+package qrcode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// The tables below are taken from the standard, not from the encoder, so the
+// decoder checks the encoder against the standard rather than against itself.
+
+// formatWords are the format information words of level M by mask
+var formatWords = []int{
+	0b101010000010010, 0b101000100100101, 0b101111001111100, 0b101101101001011,
+	0b100010111111001, 0b100000011001110, 0b100111110010111, 0b100101010100000,
+}
+
+// versionWords are the version information words of versions 7 and up
+var versionWords = map[int]int{7: 0x07C94, 8: 0x085BC, 9: 0x09A99, 10: 0x0A4D3}
+
+// mBlocks are the data codewords of each block and the error correction
+// codewords per block of versions 1 to 10 at level M
+var mBlocks = []struct {
+	data []int
+	ecc  int
+}{
+	{[]int{16}, 10},
+	{[]int{28}, 16},
+	{[]int{44}, 26},
+	{[]int{32, 32}, 18},
+	{[]int{43, 43}, 24},
+	{[]int{27, 27, 27, 27}, 16},
+	{[]int{31, 31, 31, 31}, 18},
+	{[]int{38, 38, 39, 39}, 22},
+	{[]int{36, 36, 36, 37, 37}, 22},
+	{[]int{43, 43, 43, 43, 44}, 26},
+}
+
+// alignmentCenters are the alignment pattern centers of versions 2 to 10
+var alignmentCenters = [][]int{
+	nil, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34}, {6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+// byteCapacity is how many bytes versions 1 to 10 hold at level M
+var byteCapacity = []int{14, 26, 42, 62, 84, 106, 122, 152, 180, 213}
+
+func TestReedSolomonKnownAnswers(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		// Annex I of ISO/IEC 18004, "01234567" as version 1-M
+		{"01234567", []byte{0x10, 0x20, 0x0C, 0x56, 0x61, 0x80, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11},
+			[]byte{0xA5, 0x24, 0xD4, 0xC1, 0xED, 0x36, 0xC7, 0x87, 0x2C, 0x55}},
+		// "HELLO WORLD" as version 1-M
+		{"HELLO WORLD", []byte{0x20, 0x5B, 0x0B, 0x78, 0xD1, 0x72, 0xDC, 0x4D, 0x43, 0x40, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11},
+			[]byte{0xC4, 0x23, 0x27, 0x77, 0xEB, 0xD7, 0xE7, 0xE2, 0x5D, 0x17}},
+	}
+	for _, test := range tests {
+		got := reedSolomonRemainder(test.data, reedSolomonDivisor(len(test.want)))
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: error correction = % X, want % X", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEncodeDecodes(t *testing.T) {
+	for i, capacity := range byteCapacity {
+		number := i + 1
+		for _, length := range []int{capacity, (capacity + 1) / 2} {
+			if number > 1 && length <= byteCapacity[i-1] {
+				continue
+			}
+			text := sampleText(length)
+			t.Run(fmt.Sprintf("version %d, %d bytes", number, length), func(t *testing.T) {
+				code, err := Encode(text)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := 17 + 4*number; code.size != want {
+					t.Fatalf("size = %d, want %d", code.size, want)
+				}
+				decoded, err := decode(code.modules)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if decoded != text {
+					t.Errorf("decoded %q, want %q", decoded, text)
+				}
+			})
+		}
+	}
+}
+
+func TestEveryMaskDecodes(t *testing.T) {
+	text := sampleText(40)
+	number, codewords, err := encodeData([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for mask := range masks {
+		code := newCode(number, versions[number-1])
+		code.drawCodewords(codewords)
+		code.applyMask(mask)
+		code.drawFormat(mask)
+
+		decoded, err := decode(code.modules)
+		if err != nil {
+			t.Errorf("mask %d: %v", mask, err)
+			continue
+		}
+		if decoded != text {
+			t.Errorf("mask %d: decoded %q, want %q", mask, decoded, text)
+		}
+	}
+}
+
+func TestEncodeTooLong(t *testing.T) {
+	if _, err := Encode(sampleText(byteCapacity[len(byteCapacity)-1] + 1)); !errors.Is(err, ErrTooLong) {
+		t.Errorf("error = %v, want ErrTooLong", err)
+	}
+}
+
+func TestImage(t *testing.T) {
+	code, err := Encode("https://example.com/r/ABC123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := code.Image(3)
+	if want := (code.size + 2*quietZone) * 3; img.Bounds().Dx() != want || img.Bounds().Dy() != want {
+		t.Errorf("image is %v, want %dx%d", img.Bounds(), want, want)
+	}
+}
+
+// sampleText is a link-like text of the given length
+func sampleText(length int) string {
+	text := "https://overtime.example.com/invite/"
+	for len(text) < length {
+		text += "aZ09-_~."
+	}
+	return text[:length]
+}
+
+// decode reads the text of a byte mode QR code at level M from its modules,
+// checking the format and version information and the error correction of
+// every block
+func decode(modules [][]bool) (string, error) {
+	size := len(modules)
+	number := (size - 17) / 4
+	if number < 1 || number > len(mBlocks) || 17+4*number != size {
+		return "", fmt.Errorf("size %d is no version", size)
+	}
+	dark := func(row, col int) bool { return modules[row][col] }
+
+	// Format information, bit 14 first: around the top left finder, and
+	// split between the other two
+	var first, second int
+	for col := 0; col <= 5; col++ {
+		first = first<<1 | b(dark(8, col))
+	}
+	first = first<<1 | b(dark(8, 7))
+	first = first<<1 | b(dark(8, 8))
+	first = first<<1 | b(dark(7, 8))
+	for row := 5; row >= 0; row-- {
+		first = first<<1 | b(dark(row, 8))
+	}
+	for row := size - 1; row >= size-7; row-- {
+		second = second<<1 | b(dark(row, 8))
+	}
+	for col := size - 8; col < size; col++ {
+		second = second<<1 | b(dark(8, col))
+	}
+	if first != second {
+		return "", fmt.Errorf("format copies differ: %015b and %015b", first, second)
+	}
+	mask := -1
+	for m, word := range formatWords {
+		if word == first {
+			mask = m
+		}
+	}
+	if mask < 0 {
+		return "", fmt.Errorf("format %015b is not level M", first)
+	}
+	if !dark(size-8, 8) {
+		return "", errors.New("dark module missing")
+	}
+
+	// Version information, bit 0 first: in 6x3 blocks next to the top right
+	// and bottom left finders
+	if number >= 7 {
+		var topRight, bottomLeft int
+		for i := 17; i >= 0; i-- {
+			topRight = topRight<<1 | b(dark(i/3, size-11+i%3))
+			bottomLeft = bottomLeft<<1 | b(dark(size-11+i%3, i/3))
+		}
+		if topRight != versionWords[number] || bottomLeft != versionWords[number] {
+			return "", fmt.Errorf("version information %018b and %018b, want %018b", topRight, bottomLeft, versionWords[number])
+		}
+	}
+
+	reserved := functionModules(number)
+	unmasked := func(row, col int) bool {
+		var flip bool
+		switch mask {
+		case 0:
+			flip = (row+col)%2 == 0
+		case 1:
+			flip = row%2 == 0
+		case 2:
+			flip = col%3 == 0
+		case 3:
+			flip = (row+col)%3 == 0
+		case 4:
+			flip = (row/2+col/3)%2 == 0
+		case 5:
+			flip = (row*col)%2+(row*col)%3 == 0
+		case 6:
+			flip = ((row*col)%2+(row*col)%3)%2 == 0
+		case 7:
+			flip = ((row+col)%2+(row*col)%3)%2 == 0
+		}
+		return dark(row, col) != flip
+	}
+
+	// Codewords in two-column strips from the bottom right, up and down in
+	// turn, right column first
+	var stream []byte
+	var current byte
+	bits := 0
+	upward := true
+	for col := size - 1; col > 0; col -= 2 {
+		if col == 6 {
+			col--
+		}
+		for i := 0; i < size; i++ {
+			row := i
+			if upward {
+				row = size - 1 - i
+			}
+			for _, c := range []int{col, col - 1} {
+				if reserved[row][c] {
+					continue
+				}
+				current = current<<1 | byte(b(unmasked(row, c)))
+				bits++
+				if bits == 8 {
+					stream = append(stream, current)
+					current, bits = 0, 0
+				}
+			}
+		}
+		upward = !upward
+	}
+
+	// Deinterleave: data codewords block by block, the short blocks first,
+	// then the error correction codewords likewise
+	layout := mBlocks[number-1]
+	total := 0
+	longest := 0
+	for _, n := range layout.data {
+		total += n + layout.ecc
+		longest = max(longest, n)
+	}
+	if len(stream) < total {
+		return "", fmt.Errorf("%d codewords, want %d", len(stream), total)
+	}
+	blocks := make([][]byte, len(layout.data))
+	k := 0
+	for i := 0; i < longest; i++ {
+		for j, n := range layout.data {
+			if i < n {
+				blocks[j] = append(blocks[j], stream[k])
+				k++
+			}
+		}
+	}
+	var data []byte
+	for _, block := range blocks {
+		data = append(data, block...)
+	}
+	for i := 0; i < layout.ecc; i++ {
+		for j := range blocks {
+			blocks[j] = append(blocks[j], stream[k])
+			k++
+		}
+	}
+	for j, block := range blocks {
+		if err := checkSyndromes(block, layout.ecc); err != nil {
+			return "", fmt.Errorf("block %d: %v", j, err)
+		}
+	}
+
+	// Byte mode segment, terminator and padding
+	r := bitReader{data: data}
+	if mode := r.read(4); mode != 0b0100 {
+		return "", fmt.Errorf("mode %04b is not byte mode", mode)
+	}
+	countBits := 8
+	if number >= 10 {
+		countBits = 16
+	}
+	length := r.read(countBits)
+	if 4+countBits+8*length > 8*len(data) {
+		return "", fmt.Errorf("length %d does not fit", length)
+	}
+	text := make([]byte, length)
+	for i := range text {
+		text[i] = byte(r.read(8))
+	}
+	if r.pos+4 <= 8*len(data) && r.read(4) != 0 {
+		return "", errors.New("missing terminator")
+	}
+	for pad, i := byte(0xEC), (r.pos+7)/8; i < len(data); pad, i = pad^0xEC^0x11, i+1 {
+		if data[i] != pad {
+			return "", fmt.Errorf("padding codeword %d is %02X, want %02X", i, data[i], pad)
+		}
+	}
+	return string(text), nil
+}
+
+// functionModules marks the modules of a version that hold no data
+func functionModules(number int) [][]bool {
+	size := 17 + 4*number
+	reserved := make([][]bool, size)
+	for i := range reserved {
+		reserved[i] = make([]bool, size)
+	}
+	fill := func(top, left, height, width int) {
+		for row := top; row < top+height; row++ {
+			for col := left; col < left+width; col++ {
+				reserved[row][col] = true
+			}
+		}
+	}
+
+	// Finders with their separators and format information
+	fill(0, 0, 9, 9)
+	fill(0, size-8, 9, 8)
+	fill(size-8, 0, 8, 9)
+	// Alignment patterns, except where the finders are
+	centers := alignmentCenters[number-1]
+	for _, row := range centers {
+		for _, col := range centers {
+			if reserved[row][col] {
+				continue
+			}
+			fill(row-2, col-2, 5, 5)
+		}
+	}
+	// Timing patterns
+	fill(6, 0, 1, size)
+	fill(0, 6, size, 1)
+	if number >= 7 {
+		fill(0, size-11, 6, 3)
+		fill(size-11, 0, 3, 6)
+	}
+	return reserved
+}
+
+// checkSyndromes checks that the block, data and error correction codewords,
+// is a multiple of the generator polynomial: it evaluates to zero at the
+// generator's roots 2^0 to 2^(ecc-1)
+func checkSyndromes(block []byte, ecc int) error {
+	var exp [510]byte
+	var log [256]int
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i], exp[i+255] = byte(x), byte(x)
+		log[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11D
+		}
+	}
+	multiply := func(a, b byte) byte {
+		if a == 0 || b == 0 {
+			return 0
+		}
+		return exp[log[a]+log[b]]
+	}
+
+	for i := 0; i < ecc; i++ {
+		var value byte
+		for _, coefficient := range block {
+			value = multiply(value, exp[i]) ^ coefficient
+		}
+		if value != 0 {
+			return fmt.Errorf("syndrome %d is %02X", i, value)
+		}
+	}
+	return nil
+}
+
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) read(n int) int {
+	value := 0
+	for i := 0; i < n; i++ {
+		value = value<<1 | int(r.data[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return value
+}
+
+func b(dark bool) int {
+	if dark {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,164 @@
+// Package ratelimit counts requests, such as login attempts, per key in
+// fixed windows. Counters live in memory or, when several replicas run, in
+// Redis so that the limit holds across all of them.
+package ratelimit
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"overtime/redis"
+)
+
+// keyPrefix keeps the keys apart from other data in a shared Redis
+const keyPrefix = "overtime:ratelimit:"
+
+type Limiter struct {
+	name   string
+	limit  int
+	window time.Duration
+	client *redis.Client
+
+	mu       sync.Mutex
+	counters map[string]*counter
+	pruned   time.Time
+}
+
+type counter struct {
+	hits    int
+	expires time.Time
+}
+
+// New returns a limiter allowing limit hits per key in every window. name
+// tells its counters apart from those of other limiters. A limit of zero
+// allows everything.
+func New(name string, limit int, window time.Duration, client *redis.Client) *Limiter {
+	return &Limiter{
+		name:     name,
+		limit:    limit,
+		window:   window,
+		client:   client,
+		counters: map[string]*counter{},
+	}
+}
+
+// Usage is the state of a key's window after a hit
+type Usage struct {
+	// Limit is zero when the limiter allows everything
+	Limit     int
+	Remaining int
+	Reset     time.Time
+	Allowed   bool
+}
+
+// Allow counts a hit on key and reports whether it is within the limit
+func (l *Limiter) Allow(key string) bool {
+	return l.Hit(key).Allowed
+}
+
+// Hit counts a hit on key and returns the usage of its window
+func (l *Limiter) Hit(key string) Usage {
+	return l.HitLimit(key, l.limit)
+}
+
+// HitLimit counts a hit on key against limit instead of the limiter's own,
+// for keys with a limit of their own. A limit of zero allows everything.
+func (l *Limiter) HitLimit(key string, limit int) Usage {
+	if limit <= 0 {
+		return Usage{Allowed: true}
+	}
+	if l.client != nil {
+		return l.hitRedis(key, limit)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	c, ok := l.counters[key]
+	if !ok || now.After(c.expires) {
+		l.prune(now)
+		c = &counter{expires: now.Add(l.window)}
+		l.counters[key] = c
+	}
+	c.hits++
+	return usage(limit, c.hits, c.expires)
+}
+
+// Hits returns how often key was hit in its current window, without counting
+// a hit
+func (l *Limiter) Hits(key string) int {
+	if l.client != nil {
+		value, err := l.client.Get(keyPrefix + l.name + ":" + key)
+		if err != nil {
+			return 0
+		}
+		hits, _ := strconv.Atoi(string(value))
+		return hits
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.counters[key]
+	if !ok || time.Now().After(c.expires) {
+		return 0
+	}
+	return c.hits
+}
+
+func usage(limit, hits int, reset time.Time) Usage {
+	remaining := limit - hits
+	if remaining < 0 {
+		remaining = 0
+	}
+	return Usage{
+		Limit:     limit,
+		Remaining: remaining,
+		Reset:     reset,
+		Allowed:   hits <= limit,
+	}
+}
+
+// prune drops the expired counters, once per window, so keys seen once do
+// not pile up
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < l.window {
+		return
+	}
+	l.pruned = now
+	for key, c := range l.counters {
+		if now.After(c.expires) {
+			delete(l.counters, key)
+		}
+	}
+}
+
+// hitRedis lets requests through while Redis is down, a limit is not worth
+// locking everyone out
+func (l *Limiter) hitRedis(key string, limit int) Usage {
+	key = keyPrefix + l.name + ":" + key
+	now := time.Now()
+
+	// The counter is created with its expiry first, so it cannot outlive the
+	// window if INCR is the only command to reach the server
+	if _, err := l.client.SetNX(key, []byte("0"), l.window); err != nil {
+		log.Printf("Rate limit: failed to start window for %s: %v", key, err)
+		return Usage{Allowed: true}
+	}
+	hits, err := l.client.Incr(key)
+	if err != nil {
+		log.Printf("Rate limit: failed to count %s: %v", key, err)
+		return Usage{Allowed: true}
+	}
+
+	// The window may have been started by another replica
+	reset := now.Add(l.window)
+	if ttl, err := l.client.Do("PTTL", key); err == nil {
+		if ms, ok := ttl.(int64); ok && ms >= 0 {
+			reset = now.Add(time.Duration(ms) * time.Millisecond)
+		}
+	}
+	return usage(limit, int(hits), reset)
+}
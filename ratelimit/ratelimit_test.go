@@ -0,0 +1,37 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHitLimit(t *testing.T) {
+	limiter := New("test", 3, time.Minute, nil)
+
+	// A key with a limit of its own is held to it, the others to the
+	// limiter's
+	for i := 1; i <= 2; i++ {
+		if hit := limiter.HitLimit("token", 1); hit.Allowed != (i == 1) || hit.Limit != 1 {
+			t.Fatalf("hit %d on token = %+v", i, hit)
+		}
+	}
+	for i := 1; i <= 4; i++ {
+		if hit := limiter.Hit("other"); hit.Allowed != (i <= 3) || hit.Limit != 3 {
+			t.Fatalf("hit %d on other = %+v", i, hit)
+		}
+	}
+
+	// A key may be allowed more than the limiter's limit
+	for i := 1; i <= 5; i++ {
+		if hit := limiter.HitLimit("busy", 5); !hit.Allowed || hit.Remaining != 5-i {
+			t.Fatalf("hit %d on busy = %+v", i, hit)
+		}
+	}
+
+	if hit := New("off", 0, time.Minute, nil).HitLimit("token", 1); !hit.Allowed || hit.Limit != 1 {
+		t.Fatalf("limit of a key on a limiter allowing everything = %+v", hit)
+	}
+	if hit := limiter.HitLimit("token", 0); !hit.Allowed || hit.Limit != 0 {
+		t.Fatalf("zero limit = %+v", hit)
+	}
+}
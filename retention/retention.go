@@ -0,0 +1,302 @@
+// Package retention applies the organizations' data retention policies.
+package retention
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"overtime/config"
+	"overtime/mailer"
+	"overtime/models"
+	"overtime/scheduler"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Counts are the records a retention policy deletes after reporting them
+type Counts struct {
+	Entries   int64
+	AuditLogs int64
+	// ExportLogs, security alerts and login addresses follow the audit log
+	// retention period
+	ExportLogs     int64
+	SecurityAlerts int64
+	LoginAddresses int64
+	Invites        int64
+}
+
+func (c Counts) Total() int64 {
+	return c.Entries + c.AuditLogs + c.ExportLogs + c.SecurityAlerts + c.LoginAddresses + c.Invites
+}
+
+// Purger periodically deletes data past its organization's retention
+// period. Admins are emailed a report of what will be deleted first, and
+// the deletion follows RetentionNotice later.
+type Purger struct {
+	db     *gorm.DB
+	config *config.Config
+	mailer *mailer.Mailer
+	// policy looks up an organization's retention policy
+	policy func(organizationID uint) models.RetentionPolicy
+}
+
+func NewPurger(db *gorm.DB, cfg *config.Config, mail *mailer.Mailer, policy func(organizationID uint) models.RetentionPolicy) *Purger {
+	return &Purger{
+		db:     db,
+		config: cfg,
+		mailer: mail,
+		policy: policy,
+	}
+}
+
+// Run applies the policies once immediately and then on every interval, on
+// whichever replica claims the run from lock. It never returns.
+func (p *Purger) Run(lock *scheduler.Lock) {
+	ticker := time.NewTicker(p.config.RetentionInterval)
+	defer ticker.Stop()
+	for {
+		if lock.Claim("retention", p.config.RetentionInterval) {
+			if err := p.Apply(); err != nil {
+				log.Printf("Retention purge failed: %v", err)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// Apply reports or purges the data of every organization with a retention
+// policy
+func (p *Purger) Apply() error {
+	var organizations []models.Organization
+	if err := p.db.Find(&organizations).Error; err != nil {
+		return err
+	}
+
+	for _, organization := range organizations {
+		if err := p.applyOrganization(&organization, time.Now()); err != nil {
+			log.Printf("Retention purge of organization %s failed: %v", organization.Name, err)
+		}
+	}
+	return nil
+}
+
+func (p *Purger) applyOrganization(organization *models.Organization, now time.Time) error {
+	db := p.db
+	policy := p.policy(organization.ID)
+
+	var reported models.Setting
+	db.Where("organization_id = ? AND name = ?", organization.ID, models.SettingRetentionReportedAt).Limit(1).Find(&reported)
+	reportedAt, _ := time.Parse(time.RFC3339, reported.Value)
+
+	if !policy.Enabled() {
+		if reported.ID != 0 {
+			return db.Delete(&reported).Error
+		}
+		return nil
+	}
+
+	// Report what is due by the end of the notice period and wait for it
+	if reportedAt.IsZero() {
+		purgeAt := now.Add(p.config.RetentionNotice)
+		counts, err := count(db, organization.ID, policy.Cutoffs(purgeAt))
+		if err != nil || counts.Total() == 0 {
+			return err
+		}
+		if err := p.report(organization, policy, counts, purgeAt); err != nil {
+			return err
+		}
+		return markReported(db, organization.ID, now.Format(time.RFC3339))
+	}
+
+	if now.Before(reportedAt.Add(p.config.RetentionNotice)) {
+		return nil
+	}
+
+	var counts Counts
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		counts, err = purge(tx, organization.ID, policy.Cutoffs(now))
+		if err != nil {
+			return err
+		}
+		return tx.Delete(&reported).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Retention purge of organization %s deleted %d entries, %d audit log entries, %d export log entries, %d security alerts, %d login addresses and %d invites",
+		organization.Name, counts.Entries, counts.AuditLogs, counts.ExportLogs, counts.SecurityAlerts, counts.LoginAddresses, counts.Invites)
+	return nil
+}
+
+// scopes select the records of each kind that are past their cutoff. Soft
+// deleted records are purged as well.
+func entriesBefore(db *gorm.DB, organizationID uint, cutoff time.Time) *gorm.DB {
+	return db.Unscoped().Model(&models.OvertimeEntry{}).Where("organization_id = ? AND date < ?", organizationID, cutoff)
+}
+
+func auditLogsBefore(db *gorm.DB, organizationID uint, cutoff time.Time) *gorm.DB {
+	return db.Model(&models.AuditLog{}).Where("organization_id = ? AND created_at < ?", organizationID, cutoff)
+}
+
+// Exports on legal hold are kept regardless of their age
+func exportLogsBefore(db *gorm.DB, organizationID uint, cutoff time.Time) *gorm.DB {
+	return db.Model(&models.ExportLog{}).Where("organization_id = ? AND created_at < ? AND legal_hold = ?", organizationID, cutoff, false)
+}
+
+func securityAlertsBefore(db *gorm.DB, organizationID uint, cutoff time.Time) *gorm.DB {
+	return db.Model(&models.SecurityAlert{}).Where("organization_id = ? AND created_at < ?", organizationID, cutoff)
+}
+
+// Login addresses have no organization of their own, and count from the
+// last login from them
+func loginAddressesBefore(db *gorm.DB, organizationID uint, cutoff time.Time) *gorm.DB {
+	return db.Model(&models.LoginAddress{}).
+		Where("user_id IN (SELECT id FROM users WHERE organization_id = ?) AND last_seen_at < ?", organizationID, cutoff)
+}
+
+func invitesBefore(db *gorm.DB, organizationID uint, cutoff time.Time) *gorm.DB {
+	// Used invites are marked used when they are redeemed, which is their
+	// last update
+	return db.Unscoped().Model(&models.Invite{}).
+		Where("organization_id = ? AND ((used = ? AND updated_at < ?) OR expires_at < ?)", organizationID, true, cutoff, cutoff)
+}
+
+func count(db *gorm.DB, organizationID uint, cutoffs models.RetentionCutoffs) (Counts, error) {
+	var counts Counts
+	if !cutoffs.Entries.IsZero() {
+		if err := entriesBefore(db, organizationID, cutoffs.Entries).Count(&counts.Entries).Error; err != nil {
+			return counts, err
+		}
+	}
+	if !cutoffs.AuditLogs.IsZero() {
+		if err := auditLogsBefore(db, organizationID, cutoffs.AuditLogs).Count(&counts.AuditLogs).Error; err != nil {
+			return counts, err
+		}
+		if err := exportLogsBefore(db, organizationID, cutoffs.AuditLogs).Count(&counts.ExportLogs).Error; err != nil {
+			return counts, err
+		}
+		if err := securityAlertsBefore(db, organizationID, cutoffs.AuditLogs).Count(&counts.SecurityAlerts).Error; err != nil {
+			return counts, err
+		}
+		if err := loginAddressesBefore(db, organizationID, cutoffs.AuditLogs).Count(&counts.LoginAddresses).Error; err != nil {
+			return counts, err
+		}
+	}
+	if !cutoffs.Invites.IsZero() {
+		if err := invitesBefore(db, organizationID, cutoffs.Invites).Count(&counts.Invites).Error; err != nil {
+			return counts, err
+		}
+	}
+	return counts, nil
+}
+
+func purge(tx *gorm.DB, organizationID uint, cutoffs models.RetentionCutoffs) (Counts, error) {
+	var counts Counts
+	if !cutoffs.Entries.IsZero() {
+		// Approval links reference the entries
+		entries := entriesBefore(tx, organizationID, cutoffs.Entries).Select("id")
+		if err := tx.Unscoped().Where("entry_id IN (?)", entries).Delete(&models.ApprovalToken{}).Error; err != nil {
+			return counts, err
+		}
+
+		result := entriesBefore(tx, organizationID, cutoffs.Entries).Delete(&models.OvertimeEntry{})
+		if result.Error != nil {
+			return counts, result.Error
+		}
+		counts.Entries = result.RowsAffected
+	}
+	if !cutoffs.AuditLogs.IsZero() {
+		result := auditLogsBefore(tx, organizationID, cutoffs.AuditLogs).Delete(&models.AuditLog{})
+		if result.Error != nil {
+			return counts, result.Error
+		}
+		counts.AuditLogs = result.RowsAffected
+
+		result = exportLogsBefore(tx, organizationID, cutoffs.AuditLogs).Delete(&models.ExportLog{})
+		if result.Error != nil {
+			return counts, result.Error
+		}
+		counts.ExportLogs = result.RowsAffected
+
+		result = securityAlertsBefore(tx, organizationID, cutoffs.AuditLogs).Delete(&models.SecurityAlert{})
+		if result.Error != nil {
+			return counts, result.Error
+		}
+		counts.SecurityAlerts = result.RowsAffected
+
+		result = loginAddressesBefore(tx, organizationID, cutoffs.AuditLogs).Delete(&models.LoginAddress{})
+		if result.Error != nil {
+			return counts, result.Error
+		}
+		counts.LoginAddresses = result.RowsAffected
+	}
+	if !cutoffs.Invites.IsZero() {
+		result := invitesBefore(tx, organizationID, cutoffs.Invites).Delete(&models.Invite{})
+		if result.Error != nil {
+			return counts, result.Error
+		}
+		counts.Invites = result.RowsAffected
+	}
+	return counts, nil
+}
+
+func markReported(db *gorm.DB, organizationID uint, value string) error {
+	setting := models.Setting{OrganizationID: organizationID, Name: models.SettingRetentionReportedAt, Value: value}
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "organization_id"}, {Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value", "updated_at"}),
+	}).Create(&setting).Error
+}
+
+// report emails the organization's admins what the policy is going to delete
+func (p *Purger) report(organization *models.Organization, policy models.RetentionPolicy, counts Counts, purgeAt time.Time) error {
+	var admins []models.User
+	p.db.Where("organization_id = ? AND role = ? AND email <> ''", organization.ID, models.RoleAdmin).Find(&admins)
+
+	var to []string
+	for _, admin := range admins {
+		to = append(to, admin.Email)
+	}
+	if len(to) == 0 {
+		log.Printf("Retention report of organization %s has no admin to go to", organization.Name)
+	}
+
+	var lines []string
+	if counts.Entries > 0 {
+		lines = append(lines, fmt.Sprintf("- %d overtime entries dated more than %d years ago", counts.Entries, policy.EntryYears))
+	}
+	if counts.AuditLogs > 0 {
+		lines = append(lines, fmt.Sprintf("- %d audit log entries older than %d years", counts.AuditLogs, policy.AuditLogYears))
+	}
+	if counts.ExportLogs > 0 {
+		lines = append(lines, fmt.Sprintf("- %d export log entries older than %d years and not on legal hold", counts.ExportLogs, policy.AuditLogYears))
+	}
+	if counts.SecurityAlerts > 0 {
+		lines = append(lines, fmt.Sprintf("- %d security alerts older than %d years", counts.SecurityAlerts, policy.AuditLogYears))
+	}
+	if counts.LoginAddresses > 0 {
+		lines = append(lines, fmt.Sprintf("- %d login addresses last used more than %d years ago", counts.LoginAddresses, policy.AuditLogYears))
+	}
+	if counts.Invites > 0 {
+		lines = append(lines, fmt.Sprintf("- %d invites used or expired more than %d days ago", counts.Invites, policy.InviteDays))
+	}
+
+	body := fmt.Sprintf(`The data retention policy of %s will delete on %s:
+
+%s
+
+Nothing has been deleted yet. To keep the data, change the retention
+periods in the settings before then.
+`,
+		organization.Name,
+		purgeAt.UTC().Format("2006-01-02 15:04 MST"),
+		strings.Join(lines, "\n"),
+	)
+
+	return p.mailer.Send(to, "Data retention report", body)
+}
@@ -0,0 +1,88 @@
+// Package scheduler keeps periodic jobs, like backups and retention purges,
+// from running on every replica at once.
+package scheduler
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"overtime/database"
+	"overtime/models"
+	"overtime/redis"
+
+	"gorm.io/gorm"
+)
+
+// keyPrefix keeps the keys apart from other data in a shared Redis
+const keyPrefix = "overtime:job:"
+
+// Lock decides which replica runs a periodic job. Jobs are claimed in Redis
+// when configured and otherwise in the database, which every replica shares.
+// A Lock without either, or a nil Lock, runs every job.
+type Lock struct {
+	client *redis.Client
+	db     *gorm.DB
+	owner  string
+}
+
+func NewLock(client *redis.Client, db *gorm.DB) *Lock {
+	host, _ := os.Hostname()
+	return &Lock{client: client, db: db, owner: host + ":" + strconv.Itoa(os.Getpid())}
+}
+
+// Claim reports whether this replica runs job now. The first replica to
+// claim a job holds it until just before its next run is due, so the others,
+// whose timers fire in between, skip that run.
+func (l *Lock) Claim(job string, interval time.Duration) bool {
+	if l == nil {
+		return true
+	}
+
+	var claimed bool
+	var err error
+	switch {
+	case l.client != nil:
+		claimed, err = l.client.SetNX(keyPrefix+job, []byte(l.owner), interval-interval/10)
+	case l.db != nil:
+		claimed, err = l.claimInDatabase(job, interval)
+	default:
+		return true
+	}
+	if err != nil {
+		// Running twice is better than not at all, the jobs are idempotent
+		log.Printf("Scheduler: failed to claim %s, running it anyway: %v", job, err)
+		return true
+	}
+	return claimed
+}
+
+// claimInDatabase claims job in its JobClaim. An advisory lock on the job
+// makes replicas whose timers fire at the same moment take turns, so only
+// the first one finds the claim expired.
+func (l *Lock) claimInDatabase(job string, interval time.Duration) (bool, error) {
+	claimed := false
+	err := l.db.Transaction(func(tx *gorm.DB) error {
+		var locked bool
+		if err := tx.Raw("SELECT pg_try_advisory_xact_lock(?)", database.LockKey("job:"+job)).Scan(&locked).Error; err != nil {
+			return err
+		}
+		if !locked {
+			return nil
+		}
+
+		var claim models.JobClaim
+		if err := tx.Where("name = ?", job).Limit(1).Find(&claim).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		if claim.Name != "" && now.Before(claim.ClaimedUntil) {
+			return nil
+		}
+
+		claimed = true
+		return tx.Save(&models.JobClaim{Name: job, Owner: l.owner, ClaimedUntil: now.Add(interval - interval/10)}).Error
+	})
+	return claimed, err
+}
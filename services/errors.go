@@ -0,0 +1,27 @@
+// Package services implements the operations that change several records at
+// once. Each runs in a single transaction, so it either completes or leaves
+// the database untouched.
+package services
+
+// Error is the reason an operation was refused. Handlers compare it with
+// errors.Is and map it to a message; any other error is a database failure.
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+const (
+	ErrNotFound          Error = "not found"
+	ErrInviteInvalid     Error = "invite does not exist"
+	ErrInviteExpired     Error = "invite has expired or already been used"
+	ErrUsernameTaken     Error = "username already exists"
+	ErrEmailTaken        Error = "email address is already in use"
+	ErrAlreadyAnonymized Error = "user is already anonymized"
+	ErrDeactivated       Error = "user is deactivated"
+	ErrInUse             Error = "still has assigned users"
+	ErrNotPending        Error = "is no longer pending"
+	// ErrInsufficientBalance refuses time off or payouts beyond the overtime
+	// available
+	ErrInsufficientBalance Error = "not enough overtime for the request"
+)
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"overtime/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DeleteTeam deletes a team of the organization unless users are still
+// assigned to it
+func DeleteTeam(db *gorm.DB, organizationID, teamID uint) error {
+	return deleteUnused(db, &models.Team{}, "team_id", teamID, organizationID)
+}
+
+// DeleteProject deletes a project of the organization unless users are still
+// assigned to it, as their home project or as members, or entries were logged
+// on it
+func DeleteProject(db *gorm.DB, organizationID, projectID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var project models.Project
+		if err := findInOrganization(tx.Clauses(clause.Locking{Strength: "UPDATE"}), &project, projectID, organizationID); err != nil {
+			return err
+		}
+
+		for _, model := range []interface{}{&models.User{}, &models.ProjectMember{}, &models.OvertimeEntry{}} {
+			var count int64
+			if err := tx.Model(model).Where("project_id = ?", projectID).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return ErrInUse
+			}
+		}
+
+		return tx.Delete(&project).Error
+	})
+}
+
+// DeleteCostCenter deletes a cost center of the organization unless teams or
+// users are still booked on it
+func DeleteCostCenter(db *gorm.DB, organizationID, costCenterID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var costCenter models.CostCenter
+		if err := findInOrganization(tx.Clauses(clause.Locking{Strength: "UPDATE"}), &costCenter, costCenterID, organizationID); err != nil {
+			return err
+		}
+
+		for _, model := range []interface{}{&models.Team{}, &models.User{}} {
+			var count int64
+			if err := tx.Model(model).Where("cost_center_id = ?", costCenterID).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return ErrInUse
+			}
+		}
+
+		return tx.Delete(&costCenter).Error
+	})
+}
+
+// deleteUnused deletes the record unless a user references it in column. The
+// record stays locked until it is deleted, so no user can be assigned to it
+// in between.
+func deleteUnused(db *gorm.DB, model interface{}, column string, id, organizationID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := findInOrganization(tx.Clauses(clause.Locking{Strength: "UPDATE"}), model, id, organizationID); err != nil {
+			return err
+		}
+
+		var count int64
+		if err := tx.Model(&models.User{}).Where(column+" = ?", id).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrInUse
+		}
+
+		return tx.Delete(model).Error
+	})
+}
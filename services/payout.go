@@ -0,0 +1,104 @@
+package services
+
+import (
+	"time"
+
+	"overtime/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RequestPayout stores a pending payout request unless it takes more hours
+// than the user's balance. Like time off, the user stays locked until the
+// request is stored.
+func RequestPayout(db *gorm.DB, request *models.PayoutRequest) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := findInOrganization(tx.Clauses(clause.Locking{Strength: "UPDATE"}), &user, request.UserID, request.OrganizationID); err != nil {
+			return err
+		}
+
+		balance, err := TimeOffBalance(tx, user.ID)
+		if err != nil {
+			return err
+		}
+		if request.Hours > balance {
+			return ErrInsufficientBalance
+		}
+
+		request.Status = models.StatusPending
+		return tx.Create(request).Error
+	})
+}
+
+// ReviewPayout records a decision on a pending payout request. Approving it
+// takes the hours off the balance with a payout compensation dated date,
+// which puts it in that month's payroll export. Approval is refused if the
+// balance no longer covers the request.
+func ReviewPayout(db *gorm.DB, request *models.PayoutRequest, reviewerID uint, status models.EntryStatus, comment string, date time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := findInOrganization(tx.Clauses(clause.Locking{Strength: "UPDATE"}), &user, request.UserID, request.OrganizationID); err != nil {
+			return err
+		}
+
+		if status == models.StatusApproved {
+			// The balance already accounts for the pending request
+			balance, err := TimeOffBalance(tx, user.ID)
+			if err != nil {
+				return err
+			}
+			if balance < 0 {
+				return ErrInsufficientBalance
+			}
+		}
+
+		now := time.Now()
+		updates := map[string]interface{}{
+			"status":         status,
+			"reviewed_by":    reviewerID,
+			"reviewed_at":    now,
+			"review_comment": comment,
+		}
+		var compensation models.Compensation
+		if status == models.StatusApproved {
+			reason := "Payout"
+			if request.Note != "" {
+				reason += ": " + request.Note
+			}
+			compensation = models.Compensation{
+				OrganizationID: request.OrganizationID,
+				UserID:         request.UserID,
+				Date:           date,
+				Hours:          -request.Hours,
+				Kind:           models.CompensationPayout,
+				Reason:         reason,
+				CreatedBy:      &reviewerID,
+			}
+			if err := tx.Create(&compensation).Error; err != nil {
+				return err
+			}
+			updates["compensation_id"] = compensation.ID
+		}
+
+		result := tx.Model(&models.PayoutRequest{}).
+			Where("id = ? AND status = ?", request.ID, models.StatusPending).
+			Updates(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotPending
+		}
+
+		request.Status = status
+		request.ReviewedBy = &reviewerID
+		request.ReviewedAt = &now
+		request.ReviewComment = comment
+		if status == models.StatusApproved {
+			request.CompensationID = &compensation.ID
+		}
+		return nil
+	})
+}
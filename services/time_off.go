@@ -0,0 +1,133 @@
+package services
+
+import (
+	"time"
+
+	"overtime/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// TimeOffBalance returns the overtime hours a user can still take as time
+// off: approved overtime less the hours of time off that was approved or is
+// waiting for approval and of pending payouts, changed by the user's
+// compensations
+func TimeOffBalance(db *gorm.DB, userID uint) (float64, error) {
+	return balance(db, userID, nil)
+}
+
+// BalanceBefore returns the user's balance from the overtime, time off and
+// compensations dated before end and the payouts requested before it
+func BalanceBefore(db *gorm.DB, userID uint, end time.Time) (float64, error) {
+	return balance(db, userID, &end)
+}
+
+func balance(db *gorm.DB, userID uint, end *time.Time) (float64, error) {
+	datedBefore := func(query *gorm.DB) *gorm.DB {
+		if end == nil {
+			return query
+		}
+		return query.Where("date < ?", end.Format("2006-01-02"))
+	}
+
+	var overtime, timeOff, compensation, payout float64
+	err := db.Model(&models.OvertimeEntry{}).Scopes(datedBefore).
+		Where("user_id = ? AND status = ?", userID, models.StatusApproved).
+		Select("COALESCE(SUM(hours), 0)").Scan(&overtime).Error
+	if err != nil {
+		return 0, err
+	}
+
+	err = db.Model(&models.TimeOffRequest{}).Scopes(datedBefore).
+		Where("user_id = ? AND status IN ?", userID, []models.EntryStatus{models.StatusApproved, models.StatusPending}).
+		Select("COALESCE(SUM(hours), 0)").Scan(&timeOff).Error
+	if err != nil {
+		return 0, err
+	}
+
+	err = db.Model(&models.Compensation{}).Scopes(datedBefore).
+		Where("user_id = ?", userID).
+		Select("COALESCE(SUM(hours), 0)").Scan(&compensation).Error
+	if err != nil {
+		return 0, err
+	}
+
+	// Approved payouts are compensations
+	payouts := db.Model(&models.PayoutRequest{}).Where("user_id = ? AND status = ?", userID, models.StatusPending)
+	if end != nil {
+		payouts = payouts.Where("created_at < ?", *end)
+	}
+	if err := payouts.Select("COALESCE(SUM(hours), 0)").Scan(&payout).Error; err != nil {
+		return 0, err
+	}
+	return overtime - timeOff + compensation - payout, nil
+}
+
+// RequestTimeOff stores a pending request unless it takes more hours than
+// the user's balance. The user stays locked until the request is stored, so
+// concurrent requests cannot overdraw the balance together.
+func RequestTimeOff(db *gorm.DB, request *models.TimeOffRequest) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := findInOrganization(tx.Clauses(clause.Locking{Strength: "UPDATE"}), &user, request.UserID, request.OrganizationID); err != nil {
+			return err
+		}
+
+		balance, err := TimeOffBalance(tx, user.ID)
+		if err != nil {
+			return err
+		}
+		if request.Hours > balance {
+			return ErrInsufficientBalance
+		}
+
+		request.Status = models.StatusPending
+		return tx.Create(request).Error
+	})
+}
+
+// ReviewTimeOff records a decision on a pending request. Approval is refused
+// if the balance no longer covers the request, e.g. because overtime it was
+// based on was deleted in the meantime.
+func ReviewTimeOff(db *gorm.DB, request *models.TimeOffRequest, reviewerID uint, status models.EntryStatus, comment string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := findInOrganization(tx.Clauses(clause.Locking{Strength: "UPDATE"}), &user, request.UserID, request.OrganizationID); err != nil {
+			return err
+		}
+
+		if status == models.StatusApproved {
+			// The balance already accounts for the pending request
+			balance, err := TimeOffBalance(tx, user.ID)
+			if err != nil {
+				return err
+			}
+			if balance < 0 {
+				return ErrInsufficientBalance
+			}
+		}
+
+		now := time.Now()
+		result := tx.Model(&models.TimeOffRequest{}).
+			Where("id = ? AND status = ?", request.ID, models.StatusPending).
+			Updates(map[string]interface{}{
+				"status":         status,
+				"reviewed_by":    reviewerID,
+				"reviewed_at":    now,
+				"review_comment": comment,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotPending
+		}
+
+		request.Status = status
+		request.ReviewedBy = &reviewerID
+		request.ReviewedAt = &now
+		request.ReviewComment = comment
+		return nil
+	})
+}
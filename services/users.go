@@ -0,0 +1,527 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"overtime/models"
+	"overtime/passhash"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Registration is what a user enters on the invite page, or on the signup
+// page of an organization with open signup
+type Registration struct {
+	InviteCode string
+	Username   string
+	// FullName is only entered without an invite, invites name the person
+	FullName string
+	Email    string
+	Password string
+}
+
+// Register creates the account for an invite and marks the invite used. The
+// invite row stays locked until the account exists, so one invite cannot be
+// redeemed twice by concurrent requests.
+func Register(db *gorm.DB, reg Registration) (*models.User, error) {
+	hashedPassword, err := passhash.Hash(reg.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	var user models.User
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var invite models.Invite
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("code = ?", reg.InviteCode).First(&invite).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInviteInvalid
+		}
+		if err != nil {
+			return err
+		}
+		if !invite.IsValid() {
+			return ErrInviteExpired
+		}
+
+		// Invites for an address register exactly that address
+		if invite.Email != "" {
+			reg.Email = invite.Email
+		}
+		if err := checkRegistration(tx, &reg); err != nil {
+			return err
+		}
+
+		// The user set their own password, no need to change it
+		now := time.Now()
+		user = models.User{
+			Username:           reg.Username,
+			FullName:           invite.FullName,
+			Email:              reg.Email,
+			PasswordHash:       hashedPassword,
+			PasswordChangedAt:  &now,
+			Role:               invite.Role,
+			MustChangePassword: false,
+			OrganizationID:     invite.OrganizationID,
+			TeamID:             invite.TeamID,
+			ProjectID:          invite.ProjectID,
+		}
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		// Create skips zero values that have a column default
+		if err := tx.Model(&user).Update("must_change_password", false).Error; err != nil {
+			return err
+		}
+
+		// Supervisors invited for a team supervise it right away (the home
+		// project is stored on the User record via ProjectID)
+		if user.IsSupervisor() && invite.TeamID != nil {
+			assignment := models.TeamSupervisor{UserID: user.ID, TeamID: *invite.TeamID}
+			if err := tx.Create(&assignment).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(&invite).Update("used", true).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// SignUp creates an employee account in an organization with open signup.
+// With pendingApproval the account cannot be logged in to until an
+// administrator activates it. Accounts with an email address wait for it to
+// be verified as well.
+func SignUp(db *gorm.DB, organizationID uint, reg Registration, pendingApproval bool) (*models.User, error) {
+	hashedPassword, err := passhash.Hash(reg.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	var user models.User
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := checkRegistration(tx, &reg); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		user = models.User{
+			Username:          reg.Username,
+			FullName:          reg.FullName,
+			Email:             reg.Email,
+			PasswordHash:      hashedPassword,
+			PasswordChangedAt: &now,
+			Role:              models.RoleEmployee,
+			OrganizationID:    organizationID,
+			PendingApproval:   pendingApproval,
+			// Nobody confirmed the address belongs to whoever signed up
+			PendingVerification: reg.Email != "",
+		}
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		// Create skips zero values that have a column default
+		return tx.Model(&user).Update("must_change_password", false).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// checkRegistration normalizes the username of a new account and refuses
+// usernames and email addresses that are taken
+func checkRegistration(tx *gorm.DB, reg *Registration) error {
+	reg.Username = NormalizeUsername(reg.Username)
+	taken, err := UsernameTaken(tx, reg.Username)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrUsernameTaken
+	}
+
+	emailTaken, err := EmailTaken(tx, reg.Email, 0)
+	if err != nil {
+		return err
+	}
+	if emailTaken {
+		return ErrEmailTaken
+	}
+	return nil
+}
+
+// NormalizeUsername is how new usernames are stored: without surrounding
+// spaces and in lower case. Usernames are unique ignoring case, accounts from
+// before keep the case they were created with.
+func NormalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// UsernameTaken reports whether an account has the normalized username.
+// Deleted accounts keep their usernames.
+func UsernameTaken(db *gorm.DB, username string) (bool, error) {
+	var count int64
+	err := db.Unscoped().Model(&models.User{}).Where("LOWER(username) = ?", username).Count(&count).Error
+	return count > 0, err
+}
+
+// EmailTaken reports whether an account other than userID uses the email
+// address. Addresses log in like usernames, so they are compared ignoring
+// case across all organizations; empty addresses are never taken.
+func EmailTaken(db *gorm.DB, email string, userID uint) (bool, error) {
+	if email == "" {
+		return false, nil
+	}
+	var count int64
+	err := db.Model(&models.User{}).Where("LOWER(email) = LOWER(?) AND id <> ?", email, userID).Count(&count).Error
+	return count > 0, err
+}
+
+// ActivateUser lets an account from open signup log in, assigning it to the
+// team and project an administrator picked
+func ActivateUser(db *gorm.DB, organizationID, userID uint, teamID, projectID *uint) (*models.User, error) {
+	var user models.User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := findInOrganization(tx.Clauses(clause.Locking{Strength: "UPDATE"}), &user, userID, organizationID); err != nil {
+			return err
+		}
+		if !user.PendingApproval {
+			return ErrNotPending
+		}
+		return tx.Model(&user).Updates(map[string]interface{}{
+			"pending_approval": false,
+			"team_id":          teamID,
+			"project_id":       projectID,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// VerifySignup confirms the email address of an account from open signup
+func VerifySignup(db *gorm.DB, userID uint) (*models.User, error) {
+	var user models.User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error; err != nil {
+			return err
+		}
+		if !user.PendingVerification {
+			return ErrNotPending
+		}
+		user.PendingVerification = false
+		return tx.Model(&user).Update("pending_verification", false).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// RejectUser deletes an account from open signup that was never activated
+func RejectUser(db *gorm.DB, organizationID, userID uint) (*models.User, error) {
+	var user models.User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := findInOrganization(tx.Clauses(clause.Locking{Strength: "UPDATE"}), &user, userID, organizationID); err != nil {
+			return err
+		}
+		if !user.PendingApproval {
+			return ErrNotPending
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.Session{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&user).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// DeleteUser deletes a user of the organization together with their entries,
+// contracts, time off and payout requests, compensations, password history,
+// sessions, security alerts and login addresses, their team supervisor
+// assignments and team and project memberships, their login and approval
+// links, Jira account and idempotency keys
+func DeleteUser(db *gorm.DB, organizationID, userID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := findInOrganization(tx, &user, userID, organizationID); err != nil {
+			return err
+		}
+
+		for _, model := range []interface{}{&models.OvertimeEntry{}, &models.Contract{}, &models.TimeOffRequest{}, &models.PayoutRequest{}, &models.Compensation{}, &models.PasswordHistory{}, &models.Session{}, &models.Avatar{}, &models.SecurityAlert{}, &models.LoginAddress{},
+			&models.TeamSupervisor{}, &models.ProjectMember{}, &models.TeamMembership{}, &models.LoginToken{}, &models.JiraAccount{}, &models.IdempotencyKey{}} {
+			if err := tx.Where("user_id = ?", user.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("approver_id = ?", user.ID).Delete(&models.ApprovalToken{}).Error; err != nil {
+			return err
+		}
+
+		// Soft delete, since User has DeletedAt
+		return tx.Delete(&user).Error
+	})
+}
+
+// AnonymizeUser removes the personal data of a user of the organization while
+// keeping their entries for the organization's records. The account can no
+// longer be logged in to.
+func AnonymizeUser(db *gorm.DB, organizationID, userID uint) (*models.User, error) {
+	var user models.User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := findInOrganization(tx, &user, userID, organizationID); err != nil {
+			return err
+		}
+		if user.AnonymizedAt != nil {
+			return ErrAlreadyAnonymized
+		}
+
+		now := time.Now()
+		updates := map[string]interface{}{
+			"username":         fmt.Sprintf("anonymized-%d", user.ID),
+			"full_name":        "Anonymized user",
+			"email":            "",
+			"timezone":         "",
+			"telegram_chat_id": nil,
+			"employee_number":  nil,
+			"external_id":      nil,
+			"hris_id":          nil,
+			"avatar_version":   0,
+			// Matches no password, so the account cannot be logged in to
+			"password_hash":       "!",
+			"password_changed_at": nil,
+			"anonymized_at":       now,
+		}
+		if err := tx.Model(&user).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&models.OvertimeEntry{}).Where("user_id = ?", user.ID).
+			Updates(map[string]interface{}{"description": "", "review_comment": "", "acknowledgment": ""}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&models.TimeOffRequest{}).Where("user_id = ?", user.ID).
+			Updates(map[string]interface{}{"note": "", "review_comment": ""}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&models.PayoutRequest{}).Where("user_id = ?", user.ID).
+			Updates(map[string]interface{}{"note": "", "review_comment": ""}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&models.Compensation{}).Where("user_id = ? AND kind = ?", user.ID, models.CompensationAdjustment).
+			Update("reason", "").Error; err != nil {
+			return err
+		}
+		// Payouts keep what the payroll export calls them
+		if err := tx.Model(&models.Compensation{}).Where("user_id = ? AND kind = ?", user.ID, models.CompensationPayout).
+			Update("reason", "Payout").Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&models.AuditLog{}).Where("user_id = ?", user.ID).
+			Updates(map[string]interface{}{"ip": "", "detail": ""}).Error; err != nil {
+			return err
+		}
+
+		for _, model := range []interface{}{&models.JiraAccount{}, &models.PasswordHistory{}, &models.Session{}, &models.LoginToken{}, &models.Avatar{}, &models.SecurityAlert{}, &models.LoginAddress{},
+			&models.IdempotencyKey{}} {
+			if err := tx.Where("user_id = ?", user.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// MergeUsers moves everything a duplicate account of the organization did
+// onto the account the person keeps: their entries and time off, the entries
+// and requests they created or reviewed, their team supervisor assignments,
+// team and project memberships, login addresses and security alerts. The
+// source account is deactivated; it keeps its username but can no longer be
+// logged in to, and its unused approval links stop working. Its email
+// address, Telegram chat, Jira account, payroll identifiers and avatar move
+// to the target unless it has its own.
+func MergeUsers(db *gorm.DB, organizationID, sourceID, targetID uint) (source, target *models.User, err error) {
+	source, target = &models.User{}, &models.User{}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, user := range []struct {
+			dest *models.User
+			id   uint
+		}{{source, sourceID}, {target, targetID}} {
+			if err := findInOrganization(tx.Clauses(clause.Locking{Strength: "UPDATE"}), user.dest, user.id, organizationID); err != nil {
+				return err
+			}
+			if user.dest.DeactivatedAt != nil {
+				return ErrDeactivated
+			}
+		}
+		if target.AnonymizedAt != nil {
+			return ErrAlreadyAnonymized
+		}
+
+		// The links were emailed to the source and name it as the approver
+		if err := tx.Where("approver_id = ? AND used_at IS NULL", source.ID).Delete(&models.ApprovalToken{}).Error; err != nil {
+			return err
+		}
+
+		// Deleted entries move too, so their history stays with the person
+		reassign := []struct {
+			model  interface{}
+			column string
+		}{
+			{&models.OvertimeEntry{}, "user_id"},
+			{&models.OvertimeEntry{}, "created_by"},
+			{&models.OvertimeEntry{}, "updated_by"},
+			{&models.OvertimeEntry{}, "reviewed_by"},
+			{&models.OvertimeEntry{}, "supervisor_approved_by"},
+			{&models.OvertimeEntry{}, "corrected_by"},
+			{&models.TimeOffRequest{}, "user_id"},
+			{&models.TimeOffRequest{}, "reviewed_by"},
+			{&models.PayoutRequest{}, "user_id"},
+			{&models.PayoutRequest{}, "reviewed_by"},
+			{&models.Compensation{}, "user_id"},
+			{&models.Compensation{}, "created_by"},
+			{&models.SecurityAlert{}, "user_id"},
+			{&models.ApprovalToken{}, "approver_id"},
+		}
+		for _, r := range reassign {
+			if err := tx.Unscoped().Model(r.model).Where(r.column+" = ?", source.ID).Update(r.column, target.ID).Error; err != nil {
+				return err
+			}
+		}
+
+		// Teams both supervise keep the target's assignment
+		if err := tx.Where("user_id = ? AND team_id IN (?)", source.ID,
+			tx.Model(&models.TeamSupervisor{}).Select("team_id").Where("user_id = ?", target.ID)).
+			Delete(&models.TeamSupervisor{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.TeamSupervisor{}).Where("user_id = ?", source.ID).Update("user_id", target.ID).Error; err != nil {
+			return err
+		}
+
+		// Likewise projects both are members of
+		if err := tx.Where("user_id = ? AND project_id IN (?)", source.ID,
+			tx.Model(&models.ProjectMember{}).Select("project_id").Where("user_id = ?", target.ID)).
+			Delete(&models.ProjectMember{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.ProjectMember{}).Where("user_id = ?", source.ID).Update("user_id", target.ID).Error; err != nil {
+			return err
+		}
+
+		// Team memberships starting on a day the target's also starts on keep
+		// the target's, and networks both logged in from keep the target's
+		// address
+		if err := tx.Where("user_id = ? AND valid_from IN (?)", source.ID,
+			tx.Model(&models.TeamMembership{}).Select("valid_from").Where("user_id = ?", target.ID)).
+			Delete(&models.TeamMembership{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.TeamMembership{}).Where("user_id = ?", source.ID).Update("user_id", target.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ? AND network IN (?)", source.ID,
+			tx.Model(&models.LoginAddress{}).Select("network").Where("user_id = ?", target.ID)).
+			Delete(&models.LoginAddress{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.LoginAddress{}).Where("user_id = ?", source.ID).Update("user_id", target.ID).Error; err != nil {
+			return err
+		}
+
+		var jira int64
+		if err := tx.Model(&models.JiraAccount{}).Where("user_id = ?", target.ID).Count(&jira).Error; err != nil {
+			return err
+		}
+		if jira == 0 {
+			if err := tx.Model(&models.JiraAccount{}).Where("user_id = ?", source.ID).Update("user_id", target.ID).Error; err != nil {
+				return err
+			}
+		}
+
+		// Taken before the source is cleared, which also clears the struct
+		moved := map[string]interface{}{}
+		if target.AvatarVersion == 0 && source.AvatarVersion != 0 {
+			if err := tx.Model(&models.Avatar{}).Where("user_id = ?", source.ID).Update("user_id", target.ID).Error; err != nil {
+				return err
+			}
+			moved["avatar_version"] = source.AvatarVersion
+		}
+		if target.Email == "" && source.Email != "" {
+			moved["email"] = source.Email
+		}
+		if target.TelegramChatID == nil && source.TelegramChatID != nil {
+			moved["telegram_chat_id"] = *source.TelegramChatID
+		}
+		if target.EmployeeNumber == nil && source.EmployeeNumber != nil {
+			moved["employee_number"] = *source.EmployeeNumber
+		}
+		if target.ExternalID == nil && source.ExternalID != nil {
+			moved["external_id"] = *source.ExternalID
+		}
+		if target.HRISID == nil && source.HRISID != nil {
+			moved["hris_id"] = *source.HRISID
+		}
+
+		// Clear the source first, the Telegram chat and identifiers are unique
+		now := time.Now()
+		if err := tx.Model(source).Updates(map[string]interface{}{
+			"email":            "",
+			"telegram_chat_id": nil,
+			"employee_number":  nil,
+			"external_id":      nil,
+			"hris_id":          nil,
+			"avatar_version":   0,
+			// Matches no password, so the account cannot be logged in to
+			"password_hash":  "!",
+			"deactivated_at": now,
+		}).Error; err != nil {
+			return err
+		}
+		if len(moved) > 0 {
+			if err := tx.Model(target).Updates(moved).Error; err != nil {
+				return err
+			}
+		}
+
+		for _, model := range []interface{}{&models.JiraAccount{}, &models.PasswordHistory{}, &models.Session{}, &models.LoginToken{}, &models.Avatar{}} {
+			if err := tx.Where("user_id = ?", source.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return source, target, nil
+}
+
+// findInOrganization loads the record with the given ID, reporting ErrNotFound
+// if it does not exist or belongs to another organization
+func findInOrganization(tx *gorm.DB, dest interface{}, id, organizationID uint) error {
+	err := tx.Where("organization_id = ?", organizationID).First(dest, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
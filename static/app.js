@@ -0,0 +1,163 @@
+// Offline entry queue. While the device is offline, submitting a form marked
+// with data-offline-queue stores the entry on the device instead; queued
+// entries are sent to /api/v1/entries/sync once the connection returns.
+(function () {
+  "use strict";
+
+  var QUEUE_KEY = "overtime-offline-queue";
+
+  if ("serviceWorker" in navigator) {
+    navigator.serviceWorker.register("/sw.js");
+  }
+
+  function loadQueue() {
+    try {
+      return JSON.parse(localStorage.getItem(QUEUE_KEY)) || [];
+    } catch (err) {
+      return [];
+    }
+  }
+
+  function saveQueue(queue) {
+    localStorage.setItem(QUEUE_KEY, JSON.stringify(queue));
+  }
+
+  function newClientID() {
+    if (window.crypto && crypto.randomUUID) {
+      return crypto.randomUUID();
+    }
+    return Date.now().toString(36) + "-" + Math.random().toString(36).slice(2);
+  }
+
+  function showStatus(message) {
+    var el = document.getElementById("offline-status");
+    if (!el) {
+      return;
+    }
+    var count = loadQueue().length;
+    var text = message || "";
+    if (count > 0) {
+      text += (text ? " " : "") + count + (count === 1 ? " entry is" : " entries are") + " waiting to sync.";
+    }
+    el.textContent = text;
+    el.style.display = text ? "" : "none";
+  }
+
+  // Requests with the session cookie send the page's CSRF token
+  function csrfToken() {
+    var meta = document.querySelector('meta[name="csrf-token"]');
+    return meta ? meta.content : "";
+  }
+
+  function sync() {
+    var queue = loadQueue();
+    if (queue.length === 0 || !navigator.onLine) {
+      showStatus();
+      return;
+    }
+
+    fetch("/api/v1/entries/sync", {
+      method: "POST",
+      credentials: "same-origin",
+      headers: {
+        "Content-Type": "application/json",
+        "X-CSRF-Token": csrfToken(),
+      },
+      body: JSON.stringify({ entries: queue }),
+    })
+      .then(function (response) {
+        // A redirect means the session expired; keep the queue for later
+        if (!response.ok || response.redirected) {
+          throw new Error("sync failed");
+        }
+        return response.json();
+      })
+      .then(function (body) {
+        var handled = {};
+        var errors = [];
+        body.results.forEach(function (result) {
+          handled[result.client_id] = true;
+          if (result.error) {
+            var entry = queue.find(function (e) {
+              return e.client_id === result.client_id;
+            });
+            errors.push((entry ? entry.date + ": " : "") + result.error);
+          }
+        });
+        saveQueue(
+          loadQueue().filter(function (entry) {
+            return !handled[entry.client_id];
+          }),
+        );
+        showStatus(errors.length ? "Some offline entries were refused - " + errors.join("; ") + "." : "Offline entries synced.");
+      })
+      .catch(function () {
+        showStatus();
+      });
+  }
+
+  document.addEventListener("submit", function (event) {
+    var form = event.target;
+    if (!form.hasAttribute("data-offline-queue") || navigator.onLine) {
+      return;
+    }
+    event.preventDefault();
+
+    if (form.user_id && form.user_id.value !== form.getAttribute("data-user-id")) {
+      showStatus("Entries for other employees cannot be saved offline.");
+      return;
+    }
+
+    var entry = {
+      client_id: newClientID(),
+      date: form.date.value,
+      description: form.description.value,
+    };
+    if (form.worked_hours) {
+      entry.worked_hours = parseFloat(form.worked_hours.value);
+    } else {
+      entry.hours = parseFloat(form.hours.value);
+    }
+    if (form.start_time && form.start_time.value && form.end_time.value) {
+      entry.start_time = form.start_time.value;
+      entry.end_time = form.end_time.value;
+    }
+    if (form.acknowledge && form.acknowledge.checked) {
+      entry.acknowledgment = form.acknowledgment.value;
+    }
+    var queue = loadQueue();
+    queue.push(entry);
+    saveQueue(queue);
+    form.reset();
+    showStatus("You are offline. The entry was saved on this device.");
+  });
+
+  // Password strength meter for inputs marked with data-password-strength,
+  // which names the meter element. The score counts length steps and
+  // character classes; the server enforces the actual policy.
+  function passwordScore(password) {
+    var score = 0;
+    if (password.length >= 8) score++;
+    if (password.length >= 12) score++;
+    var classes = [/[a-z]/, /[A-Z]/, /[0-9]/, /[^a-zA-Z0-9]/].filter(function (re) {
+      return re.test(password);
+    }).length;
+    if (classes >= 2) score++;
+    if (classes >= 3) score++;
+    return password ? Math.max(score, 1) : 0;
+  }
+
+  document.addEventListener("input", function (event) {
+    var input = event.target;
+    if (!input.hasAttribute || !input.hasAttribute("data-password-strength")) {
+      return;
+    }
+    var meter = document.getElementById(input.getAttribute("data-password-strength"));
+    if (meter) {
+      meter.value = passwordScore(input.value);
+    }
+  });
+
+  window.addEventListener("online", sync);
+  document.addEventListener("DOMContentLoaded", sync);
+})();
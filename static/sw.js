@@ -0,0 +1,57 @@
+// Service worker for the overtime app. Static assets are served from the
+// cache and a few pages are kept so entries can be logged offline; the
+// entries themselves are queued by app.js and synced when back online.
+const CACHE = "overtime-v5";
+const ASSETS = ["/static/app.js", "/static/manifest.webmanifest", "/static/icon.svg"];
+const OFFLINE_PAGES = ["/overtime/new", "/dashboard", "/supervisor/dashboard"];
+
+self.addEventListener("install", (event) => {
+  event.waitUntil(caches.open(CACHE).then((cache) => cache.addAll(ASSETS)));
+  self.skipWaiting();
+});
+
+self.addEventListener("activate", (event) => {
+  event.waitUntil(
+    caches
+      .keys()
+      .then((keys) => Promise.all(keys.filter((key) => key !== CACHE).map((key) => caches.delete(key))))
+      .then(() => self.clients.claim()),
+  );
+});
+
+self.addEventListener("fetch", (event) => {
+  const request = event.request;
+  const url = new URL(request.url);
+  if (request.method !== "GET" || url.origin !== self.location.origin) {
+    return;
+  }
+
+  // Cached pages hold personal data, drop them when the user logs out
+  if (url.pathname === "/logout") {
+    event.respondWith(caches.delete(CACHE).then(() => fetch(request)));
+    return;
+  }
+
+  if (url.pathname.startsWith("/static/")) {
+    event.respondWith(caches.match(request).then((cached) => cached || fetch(request)));
+    return;
+  }
+
+  if (request.mode === "navigate") {
+    event.respondWith(networkFirst(request, url));
+  }
+});
+
+async function networkFirst(request, url) {
+  try {
+    const response = await fetch(request);
+    if (response.ok && !response.redirected && OFFLINE_PAGES.includes(url.pathname)) {
+      const cache = await caches.open(CACHE);
+      cache.put(url.pathname, response.clone());
+    }
+    return response;
+  } catch (err) {
+    const cached = (await caches.match(url.pathname)) || (await caches.match("/overtime/new"));
+    return cached || Response.error();
+  }
+}
@@ -0,0 +1,172 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"overtime/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type gormStore struct {
+	db *gorm.DB
+}
+
+// NewGORM returns the store backed by the database connection
+func NewGORM(db *gorm.DB) Store {
+	return &gormStore{db: db}
+}
+
+// first loads the record into dest, ErrNotFound if there is none
+func first(query *gorm.DB, dest interface{}, conds ...interface{}) error {
+	err := query.First(dest, conds...).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *gormStore) Transaction(ctx context.Context, fn func(tx Store) error) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(&gormStore{db: tx})
+	})
+}
+
+func (s *gormStore) Entry(ctx context.Context, organizationID, id uint) (*models.OvertimeEntry, error) {
+	var entry models.OvertimeEntry
+	query := s.db.WithContext(ctx).Preload("User").Preload("User.Team").Preload("Project").
+		Preload("Creator").Preload("Updater").Preload("Reviewer").Preload("Corrector").
+		Where("overtime_entries.organization_id = ?", organizationID)
+	if err := first(query, &entry, id); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (s *gormStore) Entries(ctx context.Context, organizationID uint, ids []uint) ([]models.OvertimeEntry, error) {
+	var entries []models.OvertimeEntry
+	err := s.db.WithContext(ctx).Preload("User").Preload("User.Team").
+		Where("organization_id = ? AND id IN ?", organizationID, ids).
+		Order("date asc, id asc").Find(&entries).Error
+	return entries, err
+}
+
+func (s *gormStore) CreateEntry(ctx context.Context, entry *models.OvertimeEntry) error {
+	return s.db.WithContext(ctx).Omit(clause.Associations).Create(entry).Error
+}
+
+func (s *gormStore) SaveEntry(ctx context.Context, entry *models.OvertimeEntry) error {
+	return s.db.WithContext(ctx).Omit(clause.Associations).Save(entry).Error
+}
+
+func (s *gormStore) DeleteEntry(ctx context.Context, entry *models.OvertimeEntry) error {
+	return s.db.WithContext(ctx).Delete(entry).Error
+}
+
+func (s *gormStore) BookedHours(ctx context.Context, userID, exceptID uint, from, to time.Time) (float64, error) {
+	var booked float64
+	err := s.db.WithContext(ctx).Model(&models.OvertimeEntry{}).
+		Where("user_id = ? AND id <> ? AND status <> ?", userID, exceptID, models.StatusRejected).
+		Where("date >= ? AND date < ?", from, to).
+		Select("COALESCE(SUM(hours), 0)").Scan(&booked).Error
+	return booked, err
+}
+
+func (s *gormStore) User(ctx context.Context, organizationID, id uint) (*models.User, error) {
+	var user models.User
+	if err := first(s.db.WithContext(ctx).Where("organization_id = ?", organizationID), &user, id); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *gormStore) UsersWithRole(ctx context.Context, organizationID uint, role models.Role) ([]models.User, error) {
+	var users []models.User
+	err := s.db.WithContext(ctx).
+		Where("organization_id = ? AND role = ?", organizationID, role).
+		Order("id asc").Find(&users).Error
+	return users, err
+}
+
+func (s *gormStore) TeamSupervisors(ctx context.Context, organizationID, teamID, projectID uint) ([]models.User, error) {
+	var users []models.User
+	err := s.db.WithContext(ctx).
+		Joins("JOIN team_supervisors ON team_supervisors.user_id = users.id AND team_supervisors.deleted_at IS NULL").
+		Where("users.organization_id = ? AND users.role = ? AND team_supervisors.team_id = ?",
+			organizationID, models.RoleSupervisor, teamID).
+		Where("(users.project_id = ? OR users.id IN (SELECT user_id FROM project_members WHERE project_id = ?))", projectID, projectID).
+		Order("users.id asc").Find(&users).Error
+	return users, err
+}
+
+func (s *gormStore) Contracts(ctx context.Context, userID uint) ([]models.Contract, error) {
+	var contracts []models.Contract
+	err := s.db.WithContext(ctx).Where("user_id = ?", userID).Order("valid_from desc").Find(&contracts).Error
+	return contracts, err
+}
+
+func (s *gormStore) OnProject(ctx context.Context, userID, projectID uint) (bool, error) {
+	var count int64
+	err := s.db.WithContext(ctx).Model(&models.ProjectMember{}).
+		Where("user_id = ? AND project_id = ?", userID, projectID).Count(&count).Error
+	return count > 0, err
+}
+
+func (s *gormStore) TeamMemberships(ctx context.Context, userID uint) ([]models.TeamMembership, error) {
+	var memberships []models.TeamMembership
+	err := s.db.WithContext(ctx).Where("user_id = ?", userID).Order("valid_from desc").Find(&memberships).Error
+	return memberships, err
+}
+
+func (s *gormStore) Team(ctx context.Context, id uint) (*models.Team, error) {
+	var team models.Team
+	if err := first(s.db.WithContext(ctx), &team, id); err != nil {
+		return nil, err
+	}
+	return &team, nil
+}
+
+func (s *gormStore) Project(ctx context.Context, id uint) (*models.Project, error) {
+	var project models.Project
+	if err := first(s.db.WithContext(ctx), &project, id); err != nil {
+		return nil, err
+	}
+	return &project, nil
+}
+
+func (s *gormStore) CreateApprovalToken(ctx context.Context, token *models.ApprovalToken) error {
+	return s.db.WithContext(ctx).Create(token).Error
+}
+
+func (s *gormStore) RevokeApprovalTokens(ctx context.Context, entryID uint) error {
+	return s.db.WithContext(ctx).Where("entry_id = ? AND used_at IS NULL", entryID).Delete(&models.ApprovalToken{}).Error
+}
+
+func (s *gormStore) IsHoliday(ctx context.Context, organizationID uint, date time.Time) (bool, error) {
+	var count int64
+	err := s.db.WithContext(ctx).Model(&models.Holiday{}).
+		Where("organization_id = ? AND date = ?", organizationID, date.Format("2006-01-02")).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func (s *gormStore) Settings(ctx context.Context, organizationID uint, names ...string) (map[string]models.Setting, error) {
+	var settings []models.Setting
+	err := s.db.WithContext(ctx).Where("organization_id = ? AND name IN ?", organizationID, names).Find(&settings).Error
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]models.Setting, len(settings))
+	for _, setting := range settings {
+		byName[setting.Name] = setting
+	}
+	return byName, nil
+}
+
+func (s *gormStore) CreateAuditLog(ctx context.Context, entry *models.AuditLog) error {
+	return s.db.WithContext(ctx).Create(entry).Error
+}
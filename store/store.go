@@ -0,0 +1,78 @@
+// Package store loads and saves the records the handlers work with. Handlers
+// get a Store passed to their constructor; production uses the GORM store,
+// tests use a fake.
+//
+// Logging, editing and deleting entries, the checks they go through and the
+// approval requests they send use the store. Lists and reports still query
+// the database directly.
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"overtime/models"
+)
+
+// ErrNotFound is returned when the requested record does not exist, or not in
+// the requested organization
+var ErrNotFound = errors.New("record not found")
+
+type Store interface {
+	// Transaction runs fn with a store whose changes are committed when fn
+	// returns nil and rolled back otherwise
+	Transaction(ctx context.Context, fn func(tx Store) error) error
+
+	// Entry returns the organization's entry with its owner, the owner's
+	// team, its project, creator, updater, reviewer and corrector loaded
+	Entry(ctx context.Context, organizationID, id uint) (*models.OvertimeEntry, error)
+	// Entries returns the organization's entries among ids by date, with
+	// their owners and the owners' teams loaded
+	Entries(ctx context.Context, organizationID uint, ids []uint) ([]models.OvertimeEntry, error)
+	// CreateEntry stores a new entry, leaving its associations alone
+	CreateEntry(ctx context.Context, entry *models.OvertimeEntry) error
+	// SaveEntry stores every field of an entry, leaving its associations
+	// alone
+	SaveEntry(ctx context.Context, entry *models.OvertimeEntry) error
+	// DeleteEntry deletes the entry
+	DeleteEntry(ctx context.Context, entry *models.OvertimeEntry) error
+	// BookedHours sums the user's pending and approved hours dated from from
+	// until before to, not counting the entry exceptID
+	BookedHours(ctx context.Context, userID, exceptID uint, from, to time.Time) (float64, error)
+
+	// User returns the organization's user
+	User(ctx context.Context, organizationID, id uint) (*models.User, error)
+	// UsersWithRole returns the organization's users with the role
+	UsersWithRole(ctx context.Context, organizationID uint, role models.Role) ([]models.User, error)
+	// TeamSupervisors returns the supervisors assigned to the team who work
+	// on the project
+	TeamSupervisors(ctx context.Context, organizationID, teamID, projectID uint) ([]models.User, error)
+	// Contracts returns the user's contracts, latest first
+	Contracts(ctx context.Context, userID uint) ([]models.Contract, error)
+	// OnProject reports whether the user is a member of the project besides
+	// their home project
+	OnProject(ctx context.Context, userID, projectID uint) (bool, error)
+
+	// TeamMemberships returns the user's team history
+	TeamMemberships(ctx context.Context, userID uint) ([]models.TeamMembership, error)
+	// Team returns the team
+	Team(ctx context.Context, id uint) (*models.Team, error)
+	// Project returns the project
+	Project(ctx context.Context, id uint) (*models.Project, error)
+
+	// CreateApprovalToken stores the token behind an emailed approval link
+	CreateApprovalToken(ctx context.Context, token *models.ApprovalToken) error
+	// RevokeApprovalTokens deletes the entry's unused approval tokens, so
+	// links emailed for it stop working
+	RevokeApprovalTokens(ctx context.Context, entryID uint) error
+
+	// IsHoliday reports whether the date is one of the organization's
+	// holidays
+	IsHoliday(ctx context.Context, organizationID uint, date time.Time) (bool, error)
+	// Settings returns the organization's saved settings among names, by
+	// name. Settings that were never saved are missing.
+	Settings(ctx context.Context, organizationID uint, names ...string) (map[string]models.Setting, error)
+	// CreateAuditLog records the audit log entry
+	CreateAuditLog(ctx context.Context, entry *models.AuditLog) error
+}
@@ -0,0 +1,302 @@
+// Package telegram runs a Telegram bot for logging overtime from a chat.
+package telegram
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"overtime/config"
+	"overtime/models"
+	"overtime/scheduler"
+	"overtime/services"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// pollTimeout is how long a getUpdates call waits for new messages
+const pollTimeout = 50 * time.Second
+
+// Telegram answers getUpdates calls from more than one replica with a
+// conflict, so the replicas claim the bot in turn. The one holding the claim
+// polls for leaseInterval, the others try again every claimRetry.
+const (
+	leaseInterval = 10 * time.Minute
+	claimRetry    = 15 * time.Second
+)
+
+type update struct {
+	UpdateID int64    `json:"update_id"`
+	Message  *message `json:"message"`
+}
+
+type message struct {
+	Text string `json:"text"`
+	Chat struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+}
+
+type apiResponse struct {
+	OK          bool            `json:"ok"`
+	Description string          `json:"description"`
+	Result      json.RawMessage `json:"result"`
+}
+
+// Bot answers "log 2h fixing prod" and "my balance" messages from chats that
+// users linked to their account in their profile
+type Bot struct {
+	db     *gorm.DB
+	config *config.Config
+	http   *http.Client
+	// record validates and stores a new entry and starts its approval
+	record func(entry *models.OvertimeEntry) error
+}
+
+func NewBot(db *gorm.DB, cfg *config.Config, record func(entry *models.OvertimeEntry) error) *Bot {
+	return &Bot{
+		db:     db,
+		config: cfg,
+		http:   &http.Client{Timeout: pollTimeout + 10*time.Second},
+		record: record,
+	}
+}
+
+// Enabled reports whether a bot token is configured
+func (b *Bot) Enabled() bool {
+	return b.config.TelegramBotToken != ""
+}
+
+// Run long-polls Telegram for messages and answers them, on one replica at a
+// time. It never returns.
+func (b *Bot) Run(lock *scheduler.Lock) {
+	for {
+		if !lock.Claim("telegram-poll", leaseInterval) {
+			time.Sleep(claimRetry)
+			continue
+		}
+		b.poll(time.Now().Add(leaseInterval - leaseInterval/10))
+	}
+}
+
+// poll answers messages until the claim held until then is about to expire.
+// The last messages are confirmed before it returns, so the replica polling
+// next does not answer them again.
+func (b *Bot) poll(until time.Time) {
+	var offset int64
+	for time.Until(until) > pollTimeout+claimRetry {
+		updates, err := b.getUpdates(offset, pollTimeout)
+		if err != nil {
+			log.Printf("Telegram: %v", err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message != nil && u.Message.Text != "" {
+				b.reply(u.Message.Chat.ID, b.handle(u.Message.Chat.ID, u.Message.Text))
+			}
+		}
+	}
+
+	if offset > 0 {
+		if _, err := b.getUpdates(offset, 0); err != nil {
+			log.Printf("Telegram: %v", err)
+		}
+	}
+}
+
+var (
+	logCommand     = regexp.MustCompile(`(?i)^/?log\s+(\d+(?:[.,]\d+)?)\s*(?:h|hrs?|hours?)?(?:\s+(.*))?$`)
+	balanceCommand = regexp.MustCompile(`(?i)^/?(my\s+)?balance$`)
+	// linkCommand is what the link on the profile page sends, /start with
+	// the code
+	linkCommand = regexp.MustCompile(`(?i)^/?(?:start|link)\s+([A-Z2-7]+)$`)
+)
+
+const helpText = `Commands:
+log 2h fixing prod - record 2 hours of overtime for today
+my balance - show your overtime hours`
+
+// handle returns the answer to a message sent from the given chat
+func (b *Bot) handle(chatID int64, text string) string {
+	text = strings.TrimSpace(text)
+
+	// Everyone in a group could log hours and read the balance of the user
+	// who linked it, group and channel chats have negative IDs
+	if chatID <= 0 {
+		return "Overtime can only be logged from a private chat with the bot."
+	}
+	if match := linkCommand.FindStringSubmatch(text); match != nil {
+		return b.link(chatID, strings.ToUpper(match[1]))
+	}
+
+	var user models.User
+	if err := b.db.Where("telegram_chat_id = ? AND deactivated_at IS NULL", chatID).First(&user).Error; err != nil {
+		return "This chat is not linked to an overtime account yet. Create a link code on your profile page and send it here."
+	}
+
+	if match := logCommand.FindStringSubmatch(text); match != nil {
+		return b.logOvertime(&user, match[1], match[2])
+	}
+	if balanceCommand.MatchString(text) {
+		return balance(b.db, &user)
+	}
+	return helpText
+}
+
+// link links the chat to the account that created the code, unlinking it
+// from any other account. Codes work once.
+func (b *Bot) link(chatID int64, code string) string {
+	var user models.User
+	err := b.db.Transaction(func(tx *gorm.DB) error {
+		var token models.LoginToken
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("User").
+			Where("code = ? AND purpose = ?", code, models.LoginTokenLinkTelegram).First(&token).Error
+		if err != nil {
+			return err
+		}
+		if !token.IsValid() || token.User == nil || token.User.DeactivatedAt != nil {
+			return gorm.ErrRecordNotFound
+		}
+		user = *token.User
+
+		now := time.Now()
+		if err := tx.Model(&token).Update("used_at", now).Error; err != nil {
+			return err
+		}
+		err = tx.Model(&models.User{}).Where("telegram_chat_id = ? AND id <> ?", chatID, user.ID).
+			Update("telegram_chat_id", nil).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&user).Update("telegram_chat_id", chatID).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "This code is unknown or has expired. Create a new one on your profile page."
+	}
+	if err != nil {
+		log.Printf("Telegram: failed to link chat: %v", err)
+		return "Failed to link this chat, please try again later."
+	}
+
+	return fmt.Sprintf("This chat is now linked to %s.\n\n%s", user.Username, helpText)
+}
+
+func (b *Bot) logOvertime(user *models.User, hoursStr, description string) string {
+	hours, err := strconv.ParseFloat(strings.Replace(hoursStr, ",", ".", 1), 64)
+	if err != nil {
+		return models.ErrInvalidHours.Error()
+	}
+
+	now := user.Now()
+	entry := models.OvertimeEntry{
+		UserID:      user.ID,
+		User:        *user,
+		Date:        time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, user.Location()),
+		Hours:       hours,
+		Description: strings.TrimSpace(description),
+		CreatedBy:   &user.ID,
+		UpdatedBy:   &user.ID,
+	}
+	if err := b.record(&entry); err != nil {
+		var entryErr models.EntryError
+		if errors.As(err, &entryErr) {
+			return entryErr.Error()
+		}
+		log.Printf("Telegram: failed to create entry for user %d: %v", user.ID, err)
+		return "Failed to create entry, please try again later."
+	}
+
+	return fmt.Sprintf("Logged %.2fh for %s, waiting for approval.", entry.Hours, entry.Date.Format("2006-01-02"))
+}
+
+// balance summarizes the user's approved and pending overtime
+func balance(db *gorm.DB, user *models.User) string {
+	now := user.Now()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, user.Location())
+	yearStart := time.Date(now.Year(), 1, 1, 0, 0, 0, 0, user.Location())
+
+	var totals struct {
+		Month   float64
+		Year    float64
+		Pending float64
+	}
+	db.Model(&models.OvertimeEntry{}).
+		Select("COALESCE(SUM(CASE WHEN status = ? AND date >= ? THEN hours END), 0) AS month, "+
+			"COALESCE(SUM(CASE WHEN status = ? AND date >= ? THEN hours END), 0) AS year, "+
+			"COALESCE(SUM(CASE WHEN status = ? THEN hours END), 0) AS pending",
+			models.StatusApproved, monthStart, models.StatusApproved, yearStart, models.StatusPending).
+		Where("user_id = ?", user.ID).
+		Scan(&totals)
+
+	text := fmt.Sprintf("Approved overtime: %.2fh this month, %.2fh this year.\nPending approval: %.2fh.",
+		totals.Month, totals.Year, totals.Pending)
+
+	if available, err := services.TimeOffBalance(db, user.ID); err == nil {
+		text += fmt.Sprintf("\nAvailable as time off: %.2fh.", available)
+	}
+
+	var contracts []models.Contract
+	db.Where("user_id = ?", user.ID).Find(&contracts)
+	if contract := models.ContractOn(contracts, now); contract != nil {
+		text += fmt.Sprintf("\nContract: %gh per week (%g%% of full-time).", contract.WeeklyHours, contract.PartTimePercent)
+	}
+	return text
+}
+
+func (b *Bot) getUpdates(offset int64, timeout time.Duration) ([]update, error) {
+	var updates []update
+	err := b.call("getUpdates", map[string]interface{}{
+		"offset":          offset,
+		"timeout":         int(timeout.Seconds()),
+		"allowed_updates": []string{"message"},
+	}, &updates)
+	return updates, err
+}
+
+func (b *Bot) reply(chatID int64, text string) {
+	err := b.call("sendMessage", map[string]interface{}{
+		"chat_id": chatID,
+		"text":    text,
+	}, nil)
+	if err != nil {
+		log.Printf("Telegram: failed to reply to chat %d: %v", chatID, err)
+	}
+}
+
+// call invokes a Bot API method and decodes its result into result, if given
+func (b *Bot) call(method string, params interface{}, result interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	url := "https://api.telegram.org/bot" + b.config.TelegramBotToken + "/" + method
+	resp, err := b.http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The error includes the URL, which contains the bot token
+		return fmt.Errorf("%s request failed", method)
+	}
+	defer resp.Body.Close()
+
+	var response apiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("%s: decode response: %w", method, err)
+	}
+	if !response.OK {
+		return fmt.Errorf("%s: %s", method, response.Description)
+	}
+	if result != nil {
+		return json.Unmarshal(response.Result, result)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sync"
+)
+
+// pages are the page templates, each paired with the base layout and partials
+var pages = []string{
+	"login", "register", "change-password", "dashboard",
+	"overtime-form", "overtime-edit", "invites", "export", "export-archive", "export-log", "all-entries",
+	"users", "user-edit", "pending-users", "teams", "projects", "cost-centers",
+	"supervisors", "supervisor-dashboard", "supervisor-teams", "supervisor-export",
+	"approval-email", "approvals", "time-off", "compliance", "matrix", "allocation", "deliveries", "hris", "profile", "api-docs", "organizations", "settings",
+	"login-link", "sessions", "token-usage", "backups", "timeout", "diagnostics", "error",
+}
+
+// parseTemplates parses every page into templates
+func parseTemplates(templates map[string]*template.Template, funcMap template.FuncMap) error {
+	for _, page := range pages {
+		tmpl, err := template.New("").Funcs(funcMap).ParseFiles(
+			"templates/base.html",
+			"templates/partials.html",
+			"templates/"+page+".html",
+		)
+		if err != nil {
+			return err
+		}
+		templates[page] = tmpl
+	}
+	return nil
+}
+
+// reloadTemplates parses the templates again before every request, so
+// changes to them show without a restart (DEV_MODE). The handlers read the
+// map being replaced, so requests are served one at a time. Parse errors are
+// shown in the browser.
+func reloadTemplates(templates map[string]*template.Template, funcMap template.FuncMap) func(http.Handler) http.Handler {
+	var mu sync.Mutex
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err := parseTemplates(templates, funcMap); err != nil {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "Template error\n\n%v\n", err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,238 @@
+// Package tempo imports overtime worklogs from Jira via the Tempo API.
+package tempo
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"overtime/config"
+	"overtime/models"
+	"overtime/scheduler"
+
+	"gorm.io/gorm"
+)
+
+// Worklog is the part of a Tempo worklog the importer needs
+type Worklog struct {
+	ID               int64  `json:"tempoWorklogId"`
+	TimeSpentSeconds int    `json:"timeSpentSeconds"`
+	StartDate        string `json:"startDate"`
+	Description      string `json:"description"`
+	Author           struct {
+		AccountID string `json:"accountId"`
+	} `json:"author"`
+	Issue struct {
+		ID int64 `json:"id"`
+	} `json:"issue"`
+	Attributes struct {
+		Values []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"values"`
+	} `json:"attributes"`
+}
+
+type worklogPage struct {
+	Metadata struct {
+		Next string `json:"next"`
+	} `json:"metadata"`
+	Results []Worklog `json:"results"`
+}
+
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+func NewClient(cfg *config.Config) *Client {
+	return &Client{
+		baseURL: strings.TrimRight(cfg.TempoAPIURL, "/"),
+		token:   cfg.TempoAPIToken,
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Worklogs returns all worklogs started between from and to, inclusive
+func (c *Client) Worklogs(from, to time.Time) ([]Worklog, error) {
+	query := url.Values{}
+	query.Set("from", from.Format("2006-01-02"))
+	query.Set("to", to.Format("2006-01-02"))
+	query.Set("limit", "1000")
+	next := c.baseURL + "/worklogs?" + query.Encode()
+
+	var worklogs []Worklog
+	for next != "" {
+		page, err := c.fetch(next)
+		if err != nil {
+			return nil, err
+		}
+		worklogs = append(worklogs, page.Results...)
+		next = page.Metadata.Next
+	}
+	return worklogs, nil
+}
+
+func (c *Client) fetch(pageURL string) (*worklogPage, error) {
+	req, err := http.NewRequest(http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tempo: unexpected status %s", resp.Status)
+	}
+
+	var page worklogPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("tempo: decode worklogs: %w", err)
+	}
+	return &page, nil
+}
+
+// Importer periodically turns worklogs tagged as overtime into pending
+// overtime entries for users with a linked Jira account
+type Importer struct {
+	db     *gorm.DB
+	config *config.Config
+	client *Client
+	// record validates and stores a new entry and starts its approval
+	record func(entry *models.OvertimeEntry) error
+}
+
+func NewImporter(db *gorm.DB, cfg *config.Config, record func(entry *models.OvertimeEntry) error) *Importer {
+	return &Importer{
+		db:     db,
+		config: cfg,
+		client: NewClient(cfg),
+		record: record,
+	}
+}
+
+// Enabled reports whether a Tempo API token is configured
+func (i *Importer) Enabled() bool {
+	return i.config.TempoAPIToken != ""
+}
+
+// Run imports once immediately and then on every interval, on whichever
+// replica claims the import from lock. It never returns.
+func (i *Importer) Run(lock *scheduler.Lock) {
+	ticker := time.NewTicker(i.config.TempoImportInterval)
+	defer ticker.Stop()
+	for {
+		if lock.Claim("tempo-import", i.config.TempoImportInterval) {
+			if created, err := i.Import(); err != nil {
+				log.Printf("Tempo import failed: %v", err)
+			} else if created > 0 {
+				log.Printf("Tempo import created %d overtime entries", created)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// Import pulls the worklogs of the last TempoImportDays days and creates an
+// entry for each new overtime worklog. Worklogs are keyed by their Tempo ID,
+// so running the import again never creates duplicates.
+func (i *Importer) Import() (int, error) {
+	to := time.Now()
+	from := to.AddDate(0, 0, -i.config.TempoImportDays)
+
+	worklogs, err := i.client.Worklogs(from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	db := i.db
+
+	var accounts []models.JiraAccount
+	if err := db.Preload("User").Find(&accounts).Error; err != nil {
+		return 0, err
+	}
+	users := make(map[string]*models.User, len(accounts))
+	for _, account := range accounts {
+		if account.User != nil {
+			users[account.AccountID] = account.User
+		}
+	}
+
+	created := 0
+	for _, worklog := range worklogs {
+		user, ok := users[worklog.Author.AccountID]
+		if !ok || !i.isOvertime(worklog) {
+			continue
+		}
+
+		externalID := fmt.Sprintf("tempo:%d", worklog.ID)
+
+		// Deleted entries count as imported so removing one sticks
+		var count int64
+		db.Unscoped().Model(&models.OvertimeEntry{}).Where("external_id = ?", externalID).Count(&count)
+		if count > 0 {
+			continue
+		}
+
+		date, err := time.ParseInLocation("2006-01-02", worklog.StartDate, user.Location())
+		if err != nil {
+			log.Printf("Tempo worklog %d: invalid start date %q", worklog.ID, worklog.StartDate)
+			continue
+		}
+
+		entry := models.OvertimeEntry{
+			UserID:      user.ID,
+			User:        *user,
+			Date:        date,
+			Hours:       float64(worklog.TimeSpentSeconds) / 3600,
+			Description: i.description(worklog),
+			ExternalID:  &externalID,
+		}
+		if err := i.record(&entry); err != nil {
+			log.Printf("Tempo worklog %d: failed to create entry: %v", worklog.ID, err)
+			continue
+		}
+		created++
+	}
+	return created, nil
+}
+
+// isOvertime reports whether the worklog is tagged as overtime, either with a
+// work attribute whose key or value is the tag or with #tag in its description
+func (i *Importer) isOvertime(worklog Worklog) bool {
+	tag := strings.ToLower(i.config.TempoOvertimeTag)
+	for _, attribute := range worklog.Attributes.Values {
+		if strings.EqualFold(attribute.Key, tag) && attribute.Value != "" && attribute.Value != "false" {
+			return true
+		}
+		if strings.EqualFold(attribute.Value, tag) {
+			return true
+		}
+	}
+	return strings.Contains(strings.ToLower(worklog.Description), "#"+tag)
+}
+
+// description returns the worklog description without the overtime tag
+func (i *Importer) description(worklog Worklog) string {
+	tag := regexp.MustCompile(`(?i)#` + regexp.QuoteMeta(i.config.TempoOvertimeTag) + `\b`)
+	description := strings.Join(strings.Fields(tag.ReplaceAllString(worklog.Description, "")), " ")
+	if description == "" {
+		description = fmt.Sprintf("Jira issue %d", worklog.Issue.ID)
+	}
+	if runes := []rune(description); len(runes) > 500 {
+		description = string(runes[:500])
+	}
+	return description
+}